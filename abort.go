@@ -0,0 +1,162 @@
+package backupstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+	"github.com/longhorn/backupstore/util"
+)
+
+// AbortedError is returned by the backup or the restore aborted by AbortBackup or AbortRestore
+type AbortedError struct {
+	// Operation is either "backup" or "restore"
+	Operation  string
+	VolumeName string
+	BackupName string
+}
+
+func (e *AbortedError) Error() string {
+	return fmt.Sprintf("%v of backup %v of volume %v is aborted", e.Operation, e.BackupName, e.VolumeName)
+}
+
+// IsAbortedError checks if the error is caused by aborting the backup or the restore
+func IsAbortedError(err error) bool {
+	var abortedErr *AbortedError
+	return errors.As(err, &abortedErr)
+}
+
+// abortHandle cancels the context of a running backup or restore
+type abortHandle struct {
+	cancel context.CancelFunc
+}
+
+var (
+	abortHandlesLock sync.Mutex
+	// runningBackups are the backups running in this process keyed by the volume and the backup name
+	runningBackups = map[string]map[*abortHandle]bool{}
+	// runningRestores are the restores running in this process keyed by the source volume
+	runningRestores = map[string]map[*abortHandle]bool{}
+)
+
+func getBackupAbortKey(volumeName, backupName string) string {
+	return volumeName + "/" + backupName
+}
+
+// registerAbortable returns the context cancelled by aborting the operation, and the function unregistering it
+// once the operation ends
+func registerAbortable(running map[string]map[*abortHandle]bool, key string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	handle := &abortHandle{cancel: cancel}
+
+	abortHandlesLock.Lock()
+	defer abortHandlesLock.Unlock()
+	if running[key] == nil {
+		running[key] = map[*abortHandle]bool{}
+	}
+	running[key][handle] = true
+
+	return ctx, func() {
+		abortHandlesLock.Lock()
+		defer abortHandlesLock.Unlock()
+		delete(running[key], handle)
+		if len(running[key]) == 0 {
+			delete(running, key)
+		}
+		cancel()
+	}
+}
+
+// abortRunning cancels the operations registered by the key, it returns false if there is none
+func abortRunning(running map[string]map[*abortHandle]bool, key string) bool {
+	abortHandlesLock.Lock()
+	defer abortHandlesLock.Unlock()
+	handles := running[key]
+	for handle := range handles {
+		handle.cancel()
+	}
+	return len(handles) != 0
+}
+
+// AbortBackup aborts the backup of the volume running in this process. The backup pipeline stops, the backup
+// fails with AbortedError, and the backup config is marked aborted in the backup targets instead of being left
+// in progress. The blocks uploaded by the aborted backup are garbage collected right away if no other operation
+// of the volume is running, otherwise by the next backup deletion. The backup already finalizing completes as
+// usual. It fails if the backup isn't running.
+func AbortBackup(volumeName, backupName string) error {
+	if !abortRunning(runningBackups, getBackupAbortKey(volumeName, backupName)) {
+		return fmt.Errorf("backup %v of volume %v is not running", backupName, volumeName)
+	}
+	log.WithFields(logrus.Fields{
+		LogFieldVolume: volumeName,
+		LogFieldBackup: backupName,
+	}).Info("Aborting backup")
+	return nil
+}
+
+// AbortRestore aborts the restores from the backups of the volume running in this process. The restore pipelines
+// stop and the restores fail with AbortedError. The restored volume is left partially restored. It fails if no
+// restore of the volume is running.
+func AbortRestore(volumeName string) error {
+	if !abortRunning(runningRestores, volumeName) {
+		return fmt.Errorf("no restore of volume %v is running", volumeName)
+	}
+	log.WithField(LogFieldVolume, volumeName).Info("Aborting restore")
+	return nil
+}
+
+// isBackupAborted checks if the backup was aborted by AbortBackup before it completed
+func isBackupAborted(backup *Backup) bool {
+	return backup != nil && backup.Aborted != ""
+}
+
+// checkBackupAborted fails the restore of the aborted backup, which doesn't have any blocks
+func checkBackupAborted(backup *Backup) error {
+	if !isBackupAborted(backup) {
+		return nil
+	}
+	return fmt.Errorf("backup %v of volume %v was aborted at %v", backup.Name, backup.VolumeName, backup.Aborted)
+}
+
+// markBackupAborted replaces the in progress backup config with the aborted one in the backup targets
+func markBackupAborted(targets []*backupTarget, deltaBackup *Backup) {
+	aborted := util.Now()
+	for _, target := range targets {
+		if err := saveBackup(target.bsDriver, &Backup{
+			Name:              deltaBackup.Name,
+			VolumeName:        deltaBackup.VolumeName,
+			CompressionMethod: deltaBackup.CompressionMethod,
+			Aborted:           aborted,
+		}); err != nil {
+			log.WithError(err).Warnf("Failed to mark backup %v aborted in %v", deltaBackup.Name, target.destURL)
+		}
+	}
+}
+
+// cleanupAbortedBackup garbage collects the blocks uploaded by the aborted backup. It's skipped if the deletion
+// lock cannot be acquired, e.g. the other backups of the volume are running, then the next backup deletion does it.
+func cleanupAbortedBackup(targets []*backupTarget, volumeName string) {
+	for _, target := range targets {
+		log := log.WithFields(logrus.Fields{
+			LogFieldVolume:  volumeName,
+			LogFieldDestURL: target.destURL,
+		})
+		lock, err := New(target.bsDriver, volumeName, DELETION_LOCK)
+		if err != nil {
+			log.WithError(err).Warn("Skipped cleanup of aborted backup")
+			continue
+		}
+		if err := lock.Lock(); err != nil {
+			log.WithError(err).Info("Skipped cleanup of aborted backup, the blocks are garbage collected later")
+			continue
+		}
+		if err := deleteDeltaBlockBackups(target.bsDriver, nil, volumeName, nil); err != nil {
+			log.WithError(err).Warn("Failed to clean up aborted backup")
+		}
+		lock.Unlock()
+	}
+}
@@ -0,0 +1,78 @@
+package backupstore
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestAbortRunning(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Error(AbortBackup("pvc-1", "backup-1"))
+	assert.Error(AbortRestore("pvc-1"))
+
+	ctx, unregister := registerAbortable(runningBackups, getBackupAbortKey("pvc-1", "backup-1"))
+	restoreCtx1, unregisterRestore1 := registerAbortable(runningRestores, "pvc-1")
+	restoreCtx2, unregisterRestore2 := registerAbortable(runningRestores, "pvc-1")
+	defer unregisterRestore2()
+
+	assert.Error(AbortBackup("pvc-1", "backup-2"))
+	assert.NoError(AbortBackup("pvc-1", "backup-1"))
+	assert.Error(ctx.Err())
+	assert.NoError(restoreCtx1.Err())
+
+	// all the restores of the volume are aborted
+	assert.NoError(AbortRestore("pvc-1"))
+	assert.Error(restoreCtx1.Err())
+	assert.Error(restoreCtx2.Err())
+
+	unregister()
+	unregisterRestore1()
+	assert.Error(AbortBackup("pvc-1", "backup-1"))
+	assert.NoError(AbortRestore("pvc-1"))
+
+	err := &AbortedError{Operation: "backup", VolumeName: "pvc-1", BackupName: "backup-1"}
+	assert.True(IsAbortedError(err))
+	assert.False(IsAbortedError(nil))
+}
+
+func TestCleanupAbortedBackup(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	assert.NoError(saveVolume(m, &Volume{Name: "pvc-1", LastBackupName: "backup-1"}))
+	a, b := util.GetChecksum([]byte("a")), util.GetChecksum([]byte("b"))
+	for _, checksum := range []string{a, b} {
+		assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", checksum), bytes.NewReader([]byte(checksum))))
+	}
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-1", VolumeName: "pvc-1", CreatedTime: "2023-01-01T00:00:00Z",
+		Blocks: []BlockMapping{{BlockChecksum: a}}}))
+
+	// the aborted backup replaces the in progress one, and can't be restored
+	deltaBackup := &Backup{Name: "backup-2", VolumeName: "pvc-1", CompressionMethod: "lz4",
+		Blocks: []BlockMapping{{BlockChecksum: b}}}
+	targets := []*backupTarget{{destURL: mockDriverURL, bsDriver: m}}
+	markBackupAborted(targets, deltaBackup)
+	backup, err := loadBackup(m, "backup-2", "pvc-1")
+	assert.NoError(err)
+	assert.True(isBackupAborted(backup))
+	assert.True(isBackupInProgress(backup))
+	assert.Empty(backup.Blocks)
+	assert.Error(checkBackupAborted(backup))
+	assert.NoError(checkBackupAborted(deltaBackup))
+
+	// only the blocks uploaded by the aborted backup are removed
+	cleanupAbortedBackup(targets, "pvc-1")
+	assert.True(m.FileExists(getBlockFilePath(m, "pvc-1", a)))
+	assert.False(m.FileExists(getBlockFilePath(m, "pvc-1", b)))
+	v, err := loadVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal(int64(1), v.BlockCount)
+}
@@ -0,0 +1,256 @@
+package backupstore
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+
+	"github.com/gammazero/workerpool"
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/backupstore/types"
+	"github.com/longhorn/backupstore/util"
+)
+
+type AuditOptions struct {
+	// VolumeName limits the audit to a single backup volume, all volumes are audited if empty
+	VolumeName string
+	// SkipOrphanBlocks skips listing the block objects of each volume.
+	// Missing blocks are still detected via FileExists checks.
+	SkipOrphanBlocks bool
+	// VerifyBlockHeaders reads the header of each referenced block, only the header is downloaded if the driver
+	// supports the ranged reads. The blocks not compressed by the method of the backup are reported corrupted.
+	VerifyBlockHeaders bool
+}
+
+type AuditReport struct {
+	TargetURL string
+	// VersioningStatus is the object versioning status of the backup target. The storage of the versioned
+	// backup target keeps growing by the noncurrent versions unless SetPurgeNoncurrentVersionsEnabled is set.
+	VersioningStatus VersioningStatus `json:",omitempty"`
+	Volumes          map[string]*VolumeAuditReport
+	Messages         map[types.MessageType]string `json:",omitempty"`
+}
+
+type VolumeAuditReport struct {
+	Name string
+
+	BackupCount int
+	BlockCount  int
+
+	// CorruptedBackups maps the backup name to the reason the backup config cannot be used
+	CorruptedBackups  map[string]string   `json:",omitempty"`
+	InProgressBackups []string            `json:",omitempty"`
+	AbortedBackups    []string            `json:",omitempty"` // aborted by AbortBackup, their blocks are orphans
+	MissingBlocks     map[string][]string `json:",omitempty"` // block checksum -> referencing backups
+	OrphanBlocks      []string            `json:",omitempty"`
+	CorruptedBlocks   map[string]string   `json:",omitempty"` // block checksum -> reason
+
+	Messages map[types.MessageType]string `json:",omitempty"`
+}
+
+// IsHealthy reports whether no problem was found for the volume
+func (r *VolumeAuditReport) IsHealthy() bool {
+	return len(r.CorruptedBackups) == 0 && len(r.MissingBlocks) == 0 &&
+		len(r.OrphanBlocks) == 0 && len(r.CorruptedBlocks) == 0 && len(r.Messages) == 0
+}
+
+// IsHealthy reports whether no problem was found on the whole backup target
+func (r *AuditReport) IsHealthy() bool {
+	if len(r.Messages) != 0 {
+		return false
+	}
+	for _, v := range r.Volumes {
+		if !v.IsHealthy() {
+			return false
+		}
+	}
+	return true
+}
+
+// AuditBackupTarget walks all backup volumes and backups on the backup target,
+// verifying that the metadata can be parsed and that every block referenced
+// by a backup exists in the backupstore. Unreferenced blocks are reported
+// as orphans. The audit is read only and doesn't modify the backupstore.
+func AuditBackupTarget(targetURL string, opts *AuditOptions) (*AuditReport, error) {
+	if opts == nil {
+		opts = &AuditOptions{}
+	}
+
+	driver, err := GetBackupStoreDriver(targetURL)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AuditReport{
+		TargetURL: driver.GetURL(),
+		Volumes:   make(map[string]*VolumeAuditReport),
+		Messages:  make(map[types.MessageType]string),
+	}
+
+	versioningStatus, err := getVersioningStatus(driver)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to get versioning status of backup target %v", driver.GetURL())
+	} else {
+		report.VersioningStatus = versioningStatus
+		if versioningStatus != VersioningStatusUnsupported && versioningStatus != VersioningStatusDisabled &&
+			!IsPurgeNoncurrentVersionsEnabled() {
+			log.Warnf("Backup target %v is versioned %v, the noncurrent versions of the removed objects are kept",
+				driver.GetURL(), versioningStatus)
+		}
+	}
+
+	volumeNames := []string{opts.VolumeName}
+	if opts.VolumeName == "" {
+		jobQueues := workerpool.New(runtime.NumCPU() * 16)
+		volumeNames, err = getVolumeNames(jobQueues, driver)
+		jobQueues.StopWait()
+		if err != nil {
+			// keep auditing the volumes we could find
+			report.Messages[types.MessageTypeError] = err.Error()
+		}
+	} else if !util.ValidateName(opts.VolumeName) {
+		return nil, fmt.Errorf("invalid volume name %v", opts.VolumeName)
+	}
+
+	for _, volumeName := range volumeNames {
+		report.Volumes[volumeName] = auditVolume(driver, volumeName, opts)
+	}
+
+	if len(report.Messages) == 0 {
+		report.Messages = nil
+	}
+	return report, nil
+}
+
+func auditVolume(driver BackupStoreDriver, volumeName string, opts *AuditOptions) *VolumeAuditReport {
+	log := log.WithFields(logrus.Fields{
+		"volume": volumeName,
+		"kind":   driver.Kind(),
+	})
+	log.Info("Auditing backup volume")
+
+	report := &VolumeAuditReport{
+		Name:             volumeName,
+		CorruptedBackups: make(map[string]string),
+		MissingBlocks:    make(map[string][]string),
+		CorruptedBlocks:  make(map[string]string),
+		Messages:         make(map[types.MessageType]string),
+	}
+	defer func() {
+		if len(report.CorruptedBackups) == 0 {
+			report.CorruptedBackups = nil
+		}
+		if len(report.MissingBlocks) == 0 {
+			report.MissingBlocks = nil
+		}
+		if len(report.CorruptedBlocks) == 0 {
+			report.CorruptedBlocks = nil
+		}
+		if len(report.Messages) == 0 {
+			report.Messages = nil
+		}
+	}()
+
+	if _, err := loadVolume(driver, volumeName); err != nil {
+		report.Messages[types.MessageTypeError] = fmt.Sprintf("cannot load volume config: %v", err)
+		return report
+	}
+
+	backupNames, err := getBackupNamesForVolume(driver, volumeName)
+	if err != nil {
+		report.Messages[types.MessageTypeError] = fmt.Sprintf("cannot list backups: %v", err)
+		return report
+	}
+	report.BackupCount = len(backupNames)
+
+	blockInfos := make(map[string]*BlockInfo)
+	if !opts.SkipOrphanBlocks {
+		blockNames, err := getBlockNamesForVolume(driver, volumeName)
+		if err != nil {
+			report.Messages[types.MessageTypeError] = fmt.Sprintf("cannot list blocks: %v", err)
+			return report
+		}
+		for _, name := range blockNames {
+			blockInfos[name] = &BlockInfo{
+				checksum: name,
+				path:     getBlockFilePath(driver, volumeName, name),
+			}
+		}
+		report.BlockCount = len(blockNames)
+	}
+
+	for _, backupName := range backupNames {
+		backup, err := loadBackup(driver, backupName, volumeName)
+		if err != nil {
+			report.CorruptedBackups[backupName] = err.Error()
+			continue
+		}
+		if isBackupAborted(backup) {
+			report.AbortedBackups = append(report.AbortedBackups, backupName)
+			continue
+		}
+		if isBackupInProgress(backup) {
+			report.InProgressBackups = append(report.InProgressBackups, backupName)
+			continue
+		}
+
+		if backup.SingleFile.FilePath != "" {
+			if !driver.FileExists(backup.SingleFile.FilePath) {
+				report.CorruptedBackups[backupName] = fmt.Sprintf("cannot find backup file %v", backup.SingleFile.FilePath)
+			}
+			continue
+		}
+
+		for _, block := range backup.Blocks {
+			info, known := blockInfos[block.BlockChecksum]
+			if !known {
+				info = &BlockInfo{checksum: block.BlockChecksum}
+				if opts.SkipOrphanBlocks && driver.FileExists(getBlockFilePath(driver, volumeName, block.BlockChecksum)) {
+					info.path = getBlockFilePath(driver, volumeName, block.BlockChecksum)
+				}
+				blockInfos[block.BlockChecksum] = info
+			}
+			if !isBlockPresent(info) {
+				report.MissingBlocks[block.BlockChecksum] = append(report.MissingBlocks[block.BlockChecksum], backupName)
+			} else if opts.VerifyBlockHeaders && info.refcount == 0 {
+				if err := verifyBlockHeader(driver, info.path, getBlockCompressionMethod(backup, block)); err != nil {
+					report.CorruptedBlocks[block.BlockChecksum] = err.Error()
+				}
+			}
+			info.refcount++
+		}
+	}
+
+	// In progress backups may reference blocks that are not recorded
+	// anywhere yet, so the orphan detection would be unreliable.
+	if !opts.SkipOrphanBlocks && len(report.InProgressBackups) == 0 && len(report.CorruptedBackups) == 0 {
+		for _, info := range blockInfos {
+			if isBlockSafeToDelete(info) {
+				report.OrphanBlocks = append(report.OrphanBlocks, info.checksum)
+			}
+		}
+		sort.Strings(report.OrphanBlocks)
+	}
+
+	log.WithFields(logrus.Fields{
+		"backups":        report.BackupCount,
+		"corrupted":      len(report.CorruptedBackups),
+		"missing_blocks": len(report.MissingBlocks),
+		"orphan_blocks":  len(report.OrphanBlocks),
+	}).Info("Audited backup volume")
+	return report
+}
+
+// verifyBlockHeader checks if the block starts with the header of the compression method, the compression method of
+// the block with the block header is taken from the block header
+func verifyBlockHeader(driver BackupStoreDriver, blkFile, compressionMethod string) error {
+	header, err := readFileRange(driver, blkFile, 0, BLOCK_HEADER_SIZE+util.COMPRESSION_HEADER_SIZE)
+	if err != nil {
+		return err
+	}
+	if blockHeader, ok := ParseBlockHeader(header); ok {
+		return util.CheckCompressionHeader(blockHeader.CompressionMethod, header[BLOCK_HEADER_SIZE:])
+	}
+	return util.CheckCompressionHeader(compressionMethod, header)
+}
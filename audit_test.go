@@ -0,0 +1,68 @@
+package backupstore
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestAuditBackupTarget(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &mockStoreDriver{delay: time.Millisecond}
+	m.Init()
+	defer m.uninstall()
+
+	blk1 := util.GetChecksum([]byte("block-1"))
+	blk2 := util.GetChecksum([]byte("block-2"))
+	blk3 := util.GetChecksum([]byte("block-3"))
+
+	m.fs.MkdirAll(getBackupPath(m, "pvc-1"), 0755)
+	afero.WriteFile(m.fs, getVolumeFilePath(m, "pvc-1"), []byte(`{"Name":"pvc-1"}`), 0644)
+	afero.WriteFile(m.fs, getBlockFilePath(m, "pvc-1", blk1), []byte("data"), 0644)
+	afero.WriteFile(m.fs, getBlockFilePath(m, "pvc-1", blk3), []byte("data"), 0644)
+	afero.WriteFile(m.fs, getBackupConfigPath(m, "backup-1", "pvc-1"),
+		[]byte(fmt.Sprintf(`{"Name":"backup-1","VolumeName":"pvc-1","CreatedTime":"2021-06-07T08:57:25Z",`+
+			`"Blocks":[{"Offset":0,"BlockChecksum":"%s"},{"Offset":2097152,"BlockChecksum":"%s"}]}`, blk1, blk2)), 0644)
+
+	report, err := AuditBackupTarget(mockDriverURL, nil)
+	assert.NoError(err)
+	assert.False(report.IsHealthy())
+	assert.Equal(1, len(report.Volumes))
+
+	volumeReport := report.Volumes["pvc-1"]
+	assert.Equal(1, volumeReport.BackupCount)
+	assert.Equal(2, volumeReport.BlockCount)
+	assert.Equal([]string{"backup-1"}, volumeReport.MissingBlocks[blk2])
+	assert.Equal([]string{blk3}, volumeReport.OrphanBlocks)
+	assert.Empty(volumeReport.CorruptedBlocks)
+
+	// the block not compressed by the method of the backup is corrupted
+	compressed, err := util.CompressData(LEGACY_COMPRESSION_METHOD, []byte("block-3"))
+	assert.NoError(err)
+	data, err := io.ReadAll(compressed)
+	assert.NoError(err)
+	afero.WriteFile(m.fs, getBlockFilePath(m, "pvc-1", blk3), data, 0644)
+	afero.WriteFile(m.fs, getBackupConfigPath(m, "backup-3", "pvc-1"),
+		[]byte(fmt.Sprintf(`{"Name":"backup-3","VolumeName":"pvc-1","CreatedTime":"2021-06-07T08:57:25Z",`+
+			`"Blocks":[{"Offset":0,"BlockChecksum":"%s"}]}`, blk3)), 0644)
+	report, err = AuditBackupTarget(mockDriverURL, &AuditOptions{VerifyBlockHeaders: true})
+	assert.NoError(err)
+	volumeReport = report.Volumes["pvc-1"]
+	assert.Len(volumeReport.CorruptedBlocks, 1)
+	assert.Contains(volumeReport.CorruptedBlocks[blk1], "not compressed by gzip")
+
+	// a corrupted backup config disables the orphan detection
+	afero.WriteFile(m.fs, getBackupConfigPath(m, "backup-2", "pvc-1"), []byte("{"), 0644)
+	report, err = AuditBackupTarget(mockDriverURL, &AuditOptions{VolumeName: "pvc-1"})
+	assert.NoError(err)
+	volumeReport = report.Volumes["pvc-1"]
+	assert.Equal(1, len(volumeReport.CorruptedBackups))
+	assert.Equal(0, len(volumeReport.OrphanBlocks))
+}
@@ -0,0 +1,105 @@
+package azblob
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/pkg/errors"
+
+	"github.com/longhorn/backupstore"
+)
+
+const (
+	archiveStatusRehydratePrefix = "rehydrate-pending-to-"
+)
+
+// rehydrateETAs are the upper bounds of the rehydration times documented by Azure, the high priority one
+// applies to the blobs smaller than 10 GiB which is always the case for the backup blocks
+var rehydrateETAs = map[azblob.RehydratePriority]time.Duration{
+	azblob.RehydratePriorityHigh:     1 * time.Hour,
+	azblob.RehydratePriorityStandard: 15 * time.Hour,
+}
+
+// isErrorCode checks if the request failed with the Azure storage error code
+func isErrorCode(err error, code azblob.StorageErrorCode) bool {
+	var storageErr *azblob.StorageError
+	return errors.As(err, &storageErr) && storageErr.ErrorCode == code
+}
+
+func getRehydratePriority(priority backupstore.RehydratePriority) azblob.RehydratePriority {
+	if priority == backupstore.RehydratePriorityHigh {
+		return azblob.RehydratePriorityHigh
+	}
+	return azblob.RehydratePriorityStandard
+}
+
+func (s *service) getBlobArchiveState(blob string) (backupstore.ArchiveState, error) {
+	props, err := s.getBlobProperties(blob)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get properties of blob %v", blob)
+	}
+	if strings.HasPrefix(stringValue(props.ArchiveStatus), archiveStatusRehydratePrefix) {
+		return backupstore.ArchiveStateRehydrating, nil
+	}
+	if stringValue(props.AccessTier) == string(azblob.AccessTierArchive) {
+		return backupstore.ArchiveStateArchived, nil
+	}
+	return backupstore.ArchiveStateOnline, nil
+}
+
+// rehydrateBlob moves the archived blob to the hot tier by the rehydration priority
+func (s *service) rehydrateBlob(blob string, priority azblob.RehydratePriority) error {
+	options := &azblob.SetTierOptions{RehydratePriority: &priority}
+	err := s.do(func(containerClient azblob.ContainerClient) error {
+		_, err := containerClient.NewBlockBlobClient(blob).SetTier(context.Background(), azblob.AccessTierHot, options)
+		return err
+	})
+	if isErrorCode(err, azblob.StorageErrorCodeBlobBeingRehydrated) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to rehydrate blob %v", blob)
+	}
+	return nil
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// ArchiveState returns if the blob is online, archived or being rehydrated
+func (s *BackupStoreDriver) ArchiveState(filePath string) (backupstore.ArchiveState, error) {
+	path, err := s.updatePath(filePath)
+	if err != nil {
+		return "", err
+	}
+	return s.service.getBlobArchiveState(path)
+}
+
+// Rehydrate moves the archived blob to the hot tier, and returns the estimated time until it's readable
+func (s *BackupStoreDriver) Rehydrate(filePath string, priority backupstore.RehydratePriority) (time.Duration, error) {
+	path, err := s.updatePath(filePath)
+	if err != nil {
+		return 0, err
+	}
+	state, err := s.service.getBlobArchiveState(path)
+	if err != nil {
+		return 0, err
+	}
+	if state == backupstore.ArchiveStateOnline {
+		return 0, nil
+	}
+
+	azPriority := getRehydratePriority(priority)
+	if state == backupstore.ArchiveStateArchived {
+		if err := s.service.rehydrateBlob(path, azPriority); err != nil {
+			return 0, err
+		}
+	}
+	return rehydrateETAs[azPriority], nil
+}
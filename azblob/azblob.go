@@ -3,6 +3,7 @@ package azblob
 import (
 	"fmt"
 	"io"
+	nethttp "net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -12,6 +13,7 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/util"
 )
 
 var (
@@ -47,7 +49,7 @@ func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
 	}
 
 	b := &BackupStoreDriver{}
-	b.service, err = newService(u)
+	b.service, err = newService(u, destURL)
 	if err != nil {
 		return nil, err
 	}
@@ -59,6 +61,13 @@ func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
 
 	b.path = strings.TrimLeft(b.path, "/")
 
+	// don't connect to the non-compliant endpoint at all
+	if backupstore.IsFIPSModeEnabled() {
+		if err := b.CheckFIPSCompliance(); err != nil {
+			return nil, &backupstore.NonCompliantTargetError{URL: destURL, Reason: err}
+		}
+	}
+
 	if _, err := b.List(""); err != nil {
 		return nil, err
 	}
@@ -83,27 +92,97 @@ func (s *BackupStoreDriver) GetURL() string {
 	return s.destURL
 }
 
-func (s *BackupStoreDriver) updatePath(path string) string {
-	return filepath.Join(s.path, path)
+// CheckFIPSCompliance fails if the custom endpoint isn't connected by TLS
+func (s *BackupStoreDriver) CheckFIPSCompliance() error {
+	credential, err := s.service.getCredential()
+	if err != nil {
+		return err
+	}
+	if credential.Endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(credential.Endpoint)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("endpoint %v is not connected by TLS", credential.Endpoint)
+	}
+	return nil
+}
+
+// updatePath returns the blob name of the path, which must stay under the path of the backup target, so the
+// tenants sharing the container under different prefixes cannot reach each other's blobs
+func (s *BackupStoreDriver) updatePath(path string) (string, error) {
+	return util.JoinPathWithin(s.path, path)
+}
+
+// updateDirPath returns the blob name prefix of the directory path
+func (s *BackupStoreDriver) updateDirPath(path string) (string, error) {
+	dirPath, err := s.updatePath(path)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(dirPath, "/") {
+		dirPath += "/"
+	}
+	return dirPath, nil
 }
 
 // List return items that on the backup target including prefixes
 func (s *BackupStoreDriver) List(listPath string) ([]string, error) {
 	var result []string
 
-	path := s.updatePath(listPath) + "/"
+	path, err := s.updateDirPath(listPath)
+	if err != nil {
+		return result, err
+	}
 	contents, err := s.service.listBlobs(path, "/")
 	if err != nil {
 		return result, err
 	}
 
-	sizeC := len(*contents)
+	return getListEntries(path, *contents), nil
+}
+
+// ListPrefix lists the entries of the path starting with the prefix, the filtering is done by Azure Blob Storage
+func (s *BackupStoreDriver) ListPrefix(listPath, prefix string) ([]string, error) {
+	path, err := s.updateDirPath(listPath)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := s.service.listBlobs(path+prefix, "/")
+	if err != nil {
+		return nil, err
+	}
+
+	return getListEntries(path, *contents), nil
+}
+
+// ListPage lists up to limit entries of the path starting from the continuation token
+func (s *BackupStoreDriver) ListPage(listPath, continuationToken string, limit int) ([]string, string, error) {
+	path, err := s.updateDirPath(listPath)
+	if err != nil {
+		return nil, "", err
+	}
+	contents, nextMarker, err := s.service.listBlobsPage(path, "/", continuationToken, int32(limit))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return getListEntries(path, contents), nextMarker, nil
+}
+
+func getListEntries(path string, contents []string) []string {
+	var result []string
+
+	sizeC := len(contents)
 	if sizeC == 0 {
-		return result, nil
+		return result
 	}
 
 	result = []string{}
-	for _, blob := range *contents {
+	for _, blob := range contents {
 		r := strings.TrimPrefix(blob, path)
 		r = strings.TrimSuffix(r, "/")
 		if r != "" {
@@ -111,7 +190,7 @@ func (s *BackupStoreDriver) List(listPath string) ([]string, error) {
 		}
 	}
 
-	return result, nil
+	return result
 }
 
 // FileExists checks if file exists on the backup target
@@ -121,7 +200,10 @@ func (s *BackupStoreDriver) FileExists(filePath string) bool {
 
 // FileSize return content length of the filePath on the backup target
 func (s *BackupStoreDriver) FileSize(filePath string) int64 {
-	path := s.updatePath(filePath)
+	path, err := s.updatePath(filePath)
+	if err != nil {
+		return -1
+	}
 	head, err := s.service.getBlobProperties(path)
 	if err != nil || head.ContentLength == nil {
 		log.WithError(err).Errorf("Failed to get azblob properties: %v", path)
@@ -132,7 +214,10 @@ func (s *BackupStoreDriver) FileSize(filePath string) int64 {
 
 // FileTime returns file last modified time on the backup target
 func (s *BackupStoreDriver) FileTime(filePath string) time.Time {
-	path := s.updatePath(filePath)
+	path, err := s.updatePath(filePath)
+	if err != nil {
+		return time.Time{}
+	}
 	blobProp, err := s.service.getBlobProperties(path)
 	if err != nil || blobProp.ContentLength == nil {
 		log.WithError(err).Errorf("Failed to get azblob properties: %v", path)
@@ -143,11 +228,21 @@ func (s *BackupStoreDriver) FileTime(filePath string) time.Time {
 
 // Remove deletes files on the backup target
 func (s *BackupStoreDriver) Remove(path string) error {
-	return s.service.deleteBlobs(s.updatePath(path))
+	prefix, err := s.updatePath(path)
+	if err != nil {
+		return err
+	}
+	if backupstore.IsPurgeNoncurrentVersionsEnabled() {
+		return s.service.purgeBlobs(prefix)
+	}
+	return s.service.deleteBlobs(prefix)
 }
 
 func (s *BackupStoreDriver) Read(src string) (io.ReadCloser, error) {
-	path := s.updatePath(src)
+	path, err := s.updatePath(src)
+	if err != nil {
+		return nil, err
+	}
 	rc, err := s.service.getBlob(path)
 	if err != nil {
 		return nil, err
@@ -157,10 +252,73 @@ func (s *BackupStoreDriver) Read(src string) (io.ReadCloser, error) {
 
 // Write creates a item on the backup target from io stream
 func (s *BackupStoreDriver) Write(dst string, rs io.ReadSeeker) error {
-	path := s.updatePath(dst)
+	path, err := s.updatePath(dst)
+	if err != nil {
+		return err
+	}
 	return s.service.putBlob(path, rs)
 }
 
+// WriteVerified creates a item on the backup target from io stream, and returns the MD5 checksum of the stored item
+func (s *BackupStoreDriver) WriteVerified(dst string, rs io.ReadSeeker) (string, error) {
+	path, err := s.updatePath(dst)
+	if err != nil {
+		return "", err
+	}
+	return s.service.putBlobVerified(path, rs)
+}
+
+// FileETag returns the ETag of the blob, or an empty string if the blob doesn't exist
+func (s *BackupStoreDriver) FileETag(filePath string) (string, error) {
+	path, err := s.updatePath(filePath)
+	if err != nil {
+		return "", err
+	}
+	blobProp, err := s.service.getBlobProperties(path)
+	if err != nil {
+		if isStatusError(err, nethttp.StatusNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+	if blobProp.ETag == nil {
+		return "", nil
+	}
+	return *blobProp.ETag, nil
+}
+
+// WriteIfMatch creates or replaces the item on the backup target only if its ETag is still etag
+func (s *BackupStoreDriver) WriteIfMatch(dst string, rs io.ReadSeeker, etag string) error {
+	path, err := s.updatePath(dst)
+	if err != nil {
+		return err
+	}
+	if err := s.service.putBlobIfMatch(path, rs, etag); err != nil {
+		if backupstore.IsConflictError(err) {
+			return &backupstore.ConflictError{Path: dst, ETag: etag}
+		}
+		return err
+	}
+	return nil
+}
+
+// WriteVerifiedIfMatch creates or replaces the item like WriteIfMatch, and returns the MD5 checksum of the stored
+// item like WriteVerified
+func (s *BackupStoreDriver) WriteVerifiedIfMatch(dst string, rs io.ReadSeeker, etag string) (string, error) {
+	path, err := s.updatePath(dst)
+	if err != nil {
+		return "", err
+	}
+	checksum, err := s.service.putBlobVerifiedIfMatch(path, rs, etag)
+	if err != nil {
+		if backupstore.IsConflictError(err) {
+			return "", &backupstore.ConflictError{Path: dst, ETag: etag}
+		}
+		return "", err
+	}
+	return checksum, nil
+}
+
 // Upload creates a item on the backup target by opening source file
 func (s *BackupStoreDriver) Upload(src, dst string) error {
 	file, err := os.Open(src)
@@ -169,7 +327,10 @@ func (s *BackupStoreDriver) Upload(src, dst string) error {
 		return nil
 	}
 	defer file.Close()
-	path := s.updatePath(dst)
+	path, err := s.updatePath(dst)
+	if err != nil {
+		return err
+	}
 	return s.service.putBlob(path, file)
 }
 
@@ -189,7 +350,10 @@ func (s *BackupStoreDriver) Download(src, dst string) error {
 	}
 	defer f.Close()
 
-	path := s.updatePath(src)
+	path, err := s.updatePath(src)
+	if err != nil {
+		return err
+	}
 	rc, err := s.service.getBlob(path)
 	if err != nil {
 		return err
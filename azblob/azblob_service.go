@@ -2,22 +2,30 @@ package azblob
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
 	"io"
+	nethttp "net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/pkg/errors"
 
+	"github.com/longhorn/backupstore"
 	"github.com/longhorn/backupstore/http"
+	"github.com/longhorn/backupstore/types"
+	"github.com/longhorn/backupstore/util"
 )
 
 const (
 	azureURL           = "core.windows.net"
 	azureConnNameKey   = "AccountName=%s;AccountKey=%s;"
+	azureConnNameSAS   = "AccountName=%s;SharedAccessSignature=%s;"
 	blobEndpoint       = "BlobEndpoint=%s;"
 	blobEndpointScheme = "DefaultEndpointsProtocol=%s;"
 	blobEndpointSuffix = "EndpointSuffix=%s;"
@@ -29,10 +37,19 @@ type service struct {
 	Container       string
 	EndpointSuffix  string
 	ContainerClient azblob.ContainerClient
+
+	// credentialProvider is consulted instead of the environment variables if specified,
+	// the container client is recreated with the refreshed credential on authorization failures
+	credentialProvider backupstore.CredentialProvider
+	destURL            string
+	clientLock         sync.RWMutex
 }
 
-func newService(u *url.URL) (*service, error) {
-	s := service{}
+func newService(u *url.URL, destURL string) (*service, error) {
+	s := service{
+		credentialProvider: backupstore.GetCredentialProvider(destURL),
+		destURL:            destURL,
+	}
 	if u.User != nil {
 		s.EndpointSuffix = u.Host
 		s.Container = u.User.Username()
@@ -40,16 +57,54 @@ func newService(u *url.URL) (*service, error) {
 		s.Container = u.Host
 	}
 
-	accountName := os.Getenv("AZBLOB_ACCOUNT_NAME")
-	accountKey := os.Getenv("AZBLOB_ACCOUNT_KEY")
-	azureEndpoint := os.Getenv("AZBLOB_ENDPOINT")
+	containerClient, err := s.newContainerClient()
+	if err != nil {
+		return nil, err
+	}
+	s.ContainerClient = containerClient
+	return &s, nil
+}
+
+func (s *service) getCredential() (*util.AzureCredential, error) {
+	credential := map[string]string{
+		types.AZBlobAccountName: os.Getenv(types.AZBlobAccountName),
+		types.AZBlobAccountKey:  os.Getenv(types.AZBlobAccountKey),
+		types.AZBlobEndpoint:    os.Getenv(types.AZBlobEndpoint),
+		types.AZBlobSASToken:    os.Getenv(types.AZBlobSASToken),
+	}
+	if s.credentialProvider != nil {
+		var err error
+		if credential, err = s.credentialProvider.GetCredential(s.destURL); err != nil {
+			return nil, errors.Wrapf(err, "failed to get credential for %v", s.destURL)
+		}
+	}
+
+	typed, err := util.CredentialFromMap(KIND, credential)
+	if err != nil {
+		return nil, err
+	}
+	return typed.(*util.AzureCredential), nil
+}
+
+func (s *service) newContainerClient() (azblob.ContainerClient, error) {
+	credential, err := s.getCredential()
+	if err != nil {
+		return azblob.ContainerClient{}, err
+	}
+
+	accountName := credential.AccountName
+	accountKey := credential.AccountKey
+	azureEndpoint := credential.Endpoint
 
 	connStr := fmt.Sprintf(azureConnNameKey, accountName, accountKey)
+	if sasToken := credential.SASToken; sasToken != "" && accountKey == "" {
+		connStr = fmt.Sprintf(azureConnNameSAS, accountName, strings.TrimLeft(sasToken, "?"))
+	}
 	if azureEndpoint != "" {
 		blobEndpointURL := fmt.Sprintf("%s/%s", strings.TrimRight(azureEndpoint, "/"), accountName)
 		endPointURL, err := url.Parse(azureEndpoint)
 		if err != nil {
-			return nil, err
+			return azblob.ContainerClient{}, err
 		}
 		connStr = fmt.Sprintf(blobEndpointScheme+connStr+blobEndpoint, endPointURL.Scheme, blobEndpointURL)
 	}
@@ -61,16 +116,91 @@ func newService(u *url.URL) (*service, error) {
 	customCerts := getCustomCerts()
 	httpClient, err := http.GetClientWithCustomCerts(customCerts)
 	if err != nil {
-		return nil, err
+		return azblob.ContainerClient{}, err
 	}
 	opts := azblob.ClientOptions{Transporter: httpClient}
 	serviceClient, err := azblob.NewServiceClientFromConnectionString(connStr, &opts)
 	if err != nil {
-		return nil, err
+		return azblob.ContainerClient{}, err
 	}
 
-	s.ContainerClient = serviceClient.NewContainerClient(s.Container)
-	return &s, nil
+	return serviceClient.NewContainerClient(s.Container), nil
+}
+
+// isAuthError checks if the request is rejected due to the credential, e.g. the SAS token expired
+func isAuthError(err error) bool {
+	var storageErr *azblob.StorageError
+	if !errors.As(err, &storageErr) {
+		return false
+	}
+	return storageErr.StatusCode() == nethttp.StatusUnauthorized || storageErr.StatusCode() == nethttp.StatusForbidden
+}
+
+// do runs the request with the container client. If the request is rejected due to the credential
+// and there is a credential provider, the credential is refreshed and the request is retried once.
+func (s *service) do(request func(containerClient azblob.ContainerClient) error) (err error) {
+	defer func() {
+		err = classifyError(err)
+	}()
+
+	s.clientLock.RLock()
+	containerClient := s.ContainerClient
+	s.clientLock.RUnlock()
+
+	err = request(containerClient)
+	if err == nil || s.credentialProvider == nil || !isAuthError(err) {
+		return err
+	}
+
+	log.WithError(err).Warnf("Refreshing credential for %v since the request is rejected", s.destURL)
+	if refreshErr := s.credentialProvider.RefreshCredential(s.destURL); refreshErr != nil {
+		log.WithError(refreshErr).Errorf("Failed to refresh credential for %v", s.destURL)
+		return err
+	}
+	containerClient, err = s.newContainerClient()
+	if err != nil {
+		return err
+	}
+	s.clientLock.Lock()
+	s.ContainerClient = containerClient
+	s.clientLock.Unlock()
+
+	return request(containerClient)
+}
+
+// classifyError classifies the Azure storage error by the error code or the HTTP status code, the storage error
+// can still be found in the classified error by errors.As
+func classifyError(err error) error {
+	var storageErr *azblob.StorageError
+	if err == nil || !errors.As(err, &storageErr) {
+		return err
+	}
+
+	class := backupstore.ErrorClass("")
+	switch storageErr.ErrorCode {
+	case azblob.StorageErrorCodeBlobNotFound, azblob.StorageErrorCodeContainerNotFound,
+		azblob.StorageErrorCodeResourceNotFound:
+		class = backupstore.ErrorClassNotFound
+	case azblob.StorageErrorCodeAuthenticationFailed, azblob.StorageErrorCodeAuthorizationFailure,
+		azblob.StorageErrorCodeInsufficientAccountPermissions, azblob.StorageErrorCodeAccountIsDisabled:
+		class = backupstore.ErrorClassPermissionDenied
+	case azblob.StorageErrorCodeServerBusy:
+		class = backupstore.ErrorClassThrottled
+	case azblob.StorageErrorCodeInternalError, azblob.StorageErrorCodeOperationTimedOut:
+		class = backupstore.ErrorClassUnavailable
+	case azblob.StorageErrorCodeConditionNotMet, azblob.StorageErrorCodeBlobAlreadyExists:
+		class = backupstore.ErrorClassConflict
+	case azblob.StorageErrorCodeBlobArchived, azblob.StorageErrorCodeBlobBeingRehydrated:
+		class = backupstore.ErrorClassArchived
+	case azblob.StorageErrorCodeInvalidQueryParameterValue, azblob.StorageErrorCodeInvalidHeaderValue,
+		azblob.StorageErrorCodeRequestBodyTooLarge, azblob.StorageErrorCodeInvalidRange:
+		class = backupstore.ErrorClassInvalid
+	default:
+		if storageErr.Response() != nil {
+			class = backupstore.ClassifyHTTPStatus(storageErr.StatusCode())
+		}
+	}
+	return backupstore.NewDriverError(class, string(storageErr.ErrorCode), err)
 }
 
 func getCustomCerts() []byte {
@@ -85,10 +215,50 @@ func getCustomCerts() []byte {
 
 func (s *service) listBlobs(prefix, delimiter string) (*[]string, error) {
 	listOptions := &azblob.ContainerListBlobHierarchySegmentOptions{Prefix: &prefix}
-	pager := s.ContainerClient.ListBlobsHierarchy(delimiter, listOptions)
 
 	var blobs []string
-	for pager.NextPage(context.Background()) {
+	err := s.do(func(containerClient azblob.ContainerClient) error {
+		blobs = nil
+		pager := containerClient.ListBlobsHierarchy(delimiter, listOptions)
+		for pager.NextPage(context.Background()) {
+			resp := pager.PageResponse()
+			for _, v := range resp.ContainerListBlobHierarchySegmentResult.Segment.BlobItems {
+				blobs = append(blobs, *v.Name)
+			}
+			for _, v := range resp.ContainerListBlobHierarchySegmentResult.Segment.BlobPrefixes {
+				blobs = append(blobs, *v.Name)
+			}
+		}
+		return pager.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &blobs, nil
+}
+
+// listBlobsPage lists up to maxResults blobs starting from the marker,
+// the returned marker is empty if there are no more blobs
+func (s *service) listBlobsPage(prefix, delimiter, marker string, maxResults int32) ([]string, string, error) {
+	listOptions := &azblob.ContainerListBlobHierarchySegmentOptions{
+		Prefix:     &prefix,
+		Maxresults: &maxResults,
+	}
+	if marker != "" {
+		listOptions.Marker = &marker
+	}
+
+	var (
+		blobs      []string
+		nextMarker string
+	)
+	err := s.do(func(containerClient azblob.ContainerClient) error {
+		blobs, nextMarker = nil, ""
+		pager := containerClient.ListBlobsHierarchy(delimiter, listOptions)
+		if !pager.NextPage(context.Background()) {
+			return pager.Err()
+		}
 		resp := pager.PageResponse()
 		for _, v := range resp.ContainerListBlobHierarchySegmentResult.Segment.BlobItems {
 			blobs = append(blobs, *v.Name)
@@ -96,19 +266,24 @@ func (s *service) listBlobs(prefix, delimiter string) (*[]string, error) {
 		for _, v := range resp.ContainerListBlobHierarchySegmentResult.Segment.BlobPrefixes {
 			blobs = append(blobs, *v.Name)
 		}
+		if resp.ContainerListBlobHierarchySegmentResult.NextMarker != nil {
+			nextMarker = *resp.ContainerListBlobHierarchySegmentResult.NextMarker
+		}
+		return pager.Err()
+	})
+	if err != nil {
+		return nil, "", err
 	}
 
-	if err := pager.Err(); err != nil {
-		return nil, err
-	}
-
-	return &blobs, nil
+	return blobs, nextMarker, nil
 }
 
 func (s *service) getBlobProperties(blob string) (*azblob.GetBlobPropertiesResponse, error) {
-	blobClient := s.ContainerClient.NewBlockBlobClient(blob)
-
-	response, err := blobClient.GetProperties(context.Background(), nil)
+	var response azblob.GetBlobPropertiesResponse
+	err := s.do(func(containerClient azblob.ContainerClient) (err error) {
+		response, err = containerClient.NewBlockBlobClient(blob).GetProperties(context.Background(), nil)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -117,9 +292,14 @@ func (s *service) getBlobProperties(blob string) (*azblob.GetBlobPropertiesRespo
 }
 
 func (s *service) putBlob(blob string, reader io.ReadSeeker) error {
-	blobClient := s.ContainerClient.NewBlockBlobClient(blob)
-
-	_, err := blobClient.Upload(context.Background(), streaming.NopCloser(reader), nil)
+	err := s.do(func(containerClient azblob.ContainerClient) error {
+		// rewind the body in case the request is retried
+		if _, err := reader.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := containerClient.NewBlockBlobClient(blob).Upload(context.Background(), streaming.NopCloser(reader), nil)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -127,10 +307,78 @@ func (s *service) putBlob(blob string, reader io.ReadSeeker) error {
 	return nil
 }
 
-func (s *service) getBlob(blob string) (io.ReadCloser, error) {
-	blobClient := s.ContainerClient.NewBlockBlobClient(blob)
+// putBlobVerified uploads the blob, and returns the MD5 checksum in hex of the stored blob computed by Azure
+func (s *service) putBlobVerified(blob string, reader io.ReadSeeker) (string, error) {
+	var response azblob.BlockBlobUploadResponse
+	err := s.do(func(containerClient azblob.ContainerClient) (err error) {
+		// rewind the body in case the request is retried
+		if _, err := reader.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		response, err = containerClient.NewBlockBlobClient(blob).Upload(context.Background(), streaming.NopCloser(reader), nil)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(response.ContentMD5), nil
+}
+
+// putBlobIfMatch uploads the blob only if its ETag is still etag, an empty etag requires the blob not to exist.
+// ConflictError is returned if the condition doesn't hold.
+func (s *service) putBlobIfMatch(blob string, reader io.ReadSeeker, etag string) error {
+	_, err := s.putBlobVerifiedIfMatch(blob, reader, etag)
+	return err
+}
+
+// putBlobVerifiedIfMatch uploads the blob like putBlobIfMatch, and returns the MD5 checksum in hex of the stored
+// blob like putBlobVerified
+func (s *service) putBlobVerifiedIfMatch(blob string, reader io.ReadSeeker, etag string) (string, error) {
+	conditions := &azblob.ModifiedAccessConditions{}
+	if etag == "" {
+		conditions.IfNoneMatch = to.StringPtr("*")
+	} else {
+		conditions.IfMatch = to.StringPtr(etag)
+	}
+	options := &azblob.UploadBlockBlobOptions{
+		BlobAccessConditions: &azblob.BlobAccessConditions{ModifiedAccessConditions: conditions},
+	}
+
+	var response azblob.BlockBlobUploadResponse
+	err := s.do(func(containerClient azblob.ContainerClient) (err error) {
+		// rewind the body in case the request is retried
+		if _, err := reader.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		response, err = containerClient.NewBlockBlobClient(blob).Upload(context.Background(), streaming.NopCloser(reader), options)
+		return err
+	})
+	if isStatusError(err, nethttp.StatusPreconditionFailed) || isStatusError(err, nethttp.StatusConflict) {
+		return "", &backupstore.ConflictError{Path: blob, ETag: etag}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(response.ContentMD5), nil
+}
+
+// isStatusError checks if the request failed with the HTTP status code
+func isStatusError(err error, statusCode int) bool {
+	var storageErr *azblob.StorageError
+	return errors.As(err, &storageErr) && storageErr.StatusCode() == statusCode
+}
 
-	response, err := blobClient.Download(context.Background(), nil)
+func (s *service) getBlob(blob string) (io.ReadCloser, error) {
+	var response *azblob.DownloadResponse
+	err := s.do(func(containerClient azblob.ContainerClient) (err error) {
+		response, err = containerClient.NewBlockBlobClient(blob).Download(context.Background(), nil)
+		return err
+	})
+	if isErrorCode(err, azblob.StorageErrorCodeBlobArchived) {
+		return nil, &backupstore.ArchivedError{Path: blob}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -146,8 +394,10 @@ func (s *service) deleteBlobs(blob string) error {
 
 	var deletionFailures []string
 	for _, blob := range *blobs {
-		blobClient := s.ContainerClient.NewBlockBlobClient(blob)
-		_, err = blobClient.Delete(context.Background(), nil)
+		err = s.do(func(containerClient azblob.ContainerClient) error {
+			_, err := containerClient.NewBlockBlobClient(blob).Delete(context.Background(), nil)
+			return err
+		})
 		if err != nil {
 			log.WithError(err).Errorf("Failed to delete blob object: %v", blob)
 			deletionFailures = append(deletionFailures, blob)
@@ -0,0 +1,116 @@
+package azblob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/pkg/errors"
+
+	"github.com/longhorn/backupstore"
+)
+
+const (
+	// versioningProbeBlob is uploaded to detect the blob versioning, which is a storage account setting not
+	// readable by the container clients
+	versioningProbeBlob = ".versioning-probe"
+)
+
+// VersioningStatus returns if the blob versioning is enabled, a probe blob is uploaded and purged to detect it
+func (s *BackupStoreDriver) VersioningStatus() (backupstore.VersioningStatus, error) {
+	probe, err := s.updatePath(versioningProbeBlob)
+	if err != nil {
+		return "", err
+	}
+	versionID, err := s.service.putBlobVersion(probe, strings.NewReader(""))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to upload versioning probe to %v", s.destURL)
+	}
+	if versionID == "" {
+		if err := s.service.deleteBlobs(probe); err != nil {
+			log.WithError(err).Warnf("Failed to remove versioning probe %v", probe)
+		}
+		return backupstore.VersioningStatusDisabled, nil
+	}
+	if err := s.service.purgeBlobs(probe); err != nil {
+		log.WithError(err).Warnf("Failed to purge versioning probe %v", probe)
+	}
+	return backupstore.VersioningStatusEnabled, nil
+}
+
+// putBlobVersion uploads the blob, and returns the version ID of the blob, which is empty if the versioning
+// is disabled
+func (s *service) putBlobVersion(blob string, reader io.ReadSeeker) (string, error) {
+	var response azblob.BlockBlobUploadResponse
+	err := s.do(func(containerClient azblob.ContainerClient) (err error) {
+		// rewind the body in case the request is retried
+		if _, err := reader.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		response, err = containerClient.NewBlockBlobClient(blob).Upload(context.Background(), streaming.NopCloser(reader), nil)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if response.VersionID == nil {
+		return "", nil
+	}
+	return *response.VersionID, nil
+}
+
+// purgeBlobs deletes the blobs with the prefix, and then all their previous versions. The current version of
+// a blob cannot be deleted by its version ID, so it's turned into a previous version by deleting the blob first.
+func (s *service) purgeBlobs(prefix string) error {
+	if err := s.deleteBlobs(prefix); err != nil {
+		return err
+	}
+
+	listOptions := &azblob.ContainerListBlobFlatSegmentOptions{
+		Prefix:  &prefix,
+		Include: []azblob.ListBlobsIncludeItem{azblob.ListBlobsIncludeItemVersions},
+	}
+	type blobVersion struct {
+		name      string
+		versionID string
+	}
+	var versions []blobVersion
+	err := s.do(func(containerClient azblob.ContainerClient) error {
+		versions = nil
+		pager := containerClient.ListBlobsFlat(listOptions)
+		for pager.NextPage(context.Background()) {
+			resp := pager.PageResponse()
+			for _, v := range resp.ContainerListBlobFlatSegmentResult.Segment.BlobItems {
+				// the blob written again since the deletion is kept
+				if v.VersionID == nil || (v.IsCurrentVersion != nil && *v.IsCurrentVersion) {
+					continue
+				}
+				versions = append(versions, blobVersion{*v.Name, *v.VersionID})
+			}
+		}
+		return pager.Err()
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to list blob versions with prefix %v before purging them", prefix)
+	}
+
+	var deletionFailures []string
+	for _, version := range versions {
+		err := s.do(func(containerClient azblob.ContainerClient) error {
+			_, err := containerClient.NewBlobClient(version.name).WithVersionID(version.versionID).Delete(context.Background(), nil)
+			return err
+		})
+		if err != nil {
+			log.WithError(err).Errorf("Failed to delete blob object: %v version: %v", version.name, version.versionID)
+			deletionFailures = append(deletionFailures, version.name+"?versionid="+version.versionID)
+		}
+	}
+
+	if len(deletionFailures) > 0 {
+		return fmt.Errorf("failed to delete blob versions %v", deletionFailures)
+	}
+	return nil
+}
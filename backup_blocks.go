@@ -0,0 +1,40 @@
+package backupstore
+
+import (
+	"sort"
+)
+
+// BackupBlock is a block of the delta block backup
+type BackupBlock struct {
+	Offset   int64
+	Checksum string
+	// Size is the size of the block in the volume, the block object is compressed by the compression method of the backup
+	Size int64
+	// Path is the path of the block object in the backup target
+	Path string
+}
+
+// ListBlocksForBackup returns the blocks of the delta block backup sorted by offset without downloading them, so
+// the blocks can be prefetched, mirrored or restored by the external tools. The offsets not listed are zeros.
+func ListBlocksForBackup(backupURL string) ([]BackupBlock, error) {
+	bsDriver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	backup, err := loadCompletedBackup(backupURL)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]BackupBlock, 0, len(backup.Blocks))
+	for _, block := range backup.Blocks {
+		blocks = append(blocks, BackupBlock{
+			Offset:   block.Offset,
+			Checksum: block.BlockChecksum,
+			Size:     DEFAULT_BLOCK_SIZE,
+			Path:     getBlockFilePath(bsDriver, backup.VolumeName, block.BlockChecksum),
+		})
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Offset < blocks[j].Offset })
+	return blocks, nil
+}
@@ -0,0 +1,44 @@
+package backupstore
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestListBlocksForBackup(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		m.fs.MkdirAll(filepath.Join(backupstoreBase, VOLUME_DIRECTORY), 0755)
+		return m, nil
+	})
+
+	a, b := util.GetChecksum([]byte("a")), util.GetChecksum([]byte("b"))
+	assert.NoError(saveVolume(m, &Volume{Name: "pvc-1", Size: 4 * DEFAULT_BLOCK_SIZE}))
+	assert.NoError(saveBackup(m, &Backup{
+		Name:        "backup-1",
+		VolumeName:  "pvc-1",
+		CreatedTime: util.Now(),
+		Blocks:      []BlockMapping{{Offset: 3 * DEFAULT_BLOCK_SIZE, BlockChecksum: a}, {Offset: 0, BlockChecksum: b}},
+	}))
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-2", VolumeName: "pvc-1"}))
+
+	blocks, err := ListBlocksForBackup(EncodeBackupURL("backup-1", "pvc-1", mockDriverURL))
+	assert.NoError(err)
+	assert.Equal([]BackupBlock{
+		{Offset: 0, Checksum: b, Size: DEFAULT_BLOCK_SIZE, Path: getBlockFilePath(m, "pvc-1", b)},
+		{Offset: 3 * DEFAULT_BLOCK_SIZE, Checksum: a, Size: DEFAULT_BLOCK_SIZE, Path: getBlockFilePath(m, "pvc-1", a)},
+	}, blocks)
+
+	// the in progress backup has no blocks to list
+	_, err = ListBlocksForBackup(EncodeBackupURL("backup-2", "pvc-1", mockDriverURL))
+	assert.Error(err)
+}
@@ -0,0 +1,330 @@
+package backupstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+	"github.com/longhorn/backupstore/util"
+)
+
+// BackupChainRepairOptions are the options of RepairBackupChainWithOptions
+type BackupChainRepairOptions struct {
+	// SourceURLs are the other backup targets holding the backups of the volume, e.g. the additional backup
+	// targets of the backups or the destinations of CopyBackup. The missing blocks are copied from them.
+	SourceURLs []string
+	// DryRun only reports the problems without changing the backup target
+	DryRun bool
+}
+
+// BackupChainRepairReport is the result of the backup chain repair of a volume
+type BackupChainRepairReport struct {
+	VolumeName string
+	// MissingBlocks are the blocks referenced by the backups but missing before the repair
+	MissingBlocks []string `json:",omitempty"`
+	// RepairedBlocks are the missing blocks materialized again by the repair
+	RepairedBlocks []string `json:",omitempty"`
+	// BrokenBackups maps the backup name to the reason it cannot be restored after the repair
+	BrokenBackups map[string]string `json:",omitempty"`
+	// RepairedBackups are the backups marked broken before, which can be restored again
+	RepairedBackups []string `json:",omitempty"`
+	// ProvenanceMismatches maps the backup name to the reason its provenance doesn't match the backup config, e.g.
+	// the config was tampered with. The repair doesn't sign the provenance again, see ResignBackupProvenance.
+	ProvenanceMismatches map[string]string `json:",omitempty"`
+	// LastBackupName is the base of the next incremental backup after the repair
+	LastBackupName string
+}
+
+// BrokenBackupError is returned when restoring the backup marked broken by RepairBackupChain
+type BrokenBackupError struct {
+	BackupName string
+	VolumeName string
+	Reason     string
+}
+
+func (e *BrokenBackupError) Error() string {
+	return fmt.Sprintf("backup %v of volume %v is broken: %v", e.BackupName, e.VolumeName, e.Reason)
+}
+
+// IsBrokenBackupError checks if the error is caused by the backup marked broken
+func IsBrokenBackupError(err error) bool {
+	var brokenErr *BrokenBackupError
+	return errors.As(err, &brokenErr)
+}
+
+// checkBackupBroken fails if the backup has been marked broken
+func checkBackupBroken(backup *Backup) error {
+	if backup.Broken == "" {
+		return nil
+	}
+	return &BrokenBackupError{BackupName: backup.Name, VolumeName: backup.VolumeName, Reason: backup.Broken}
+}
+
+// RepairBackupChain repairs the backups of the volume referencing the missing blocks, see
+// RepairBackupChainWithOptions
+func RepairBackupChain(volumeURL string) (*BackupChainRepairReport, error) {
+	return RepairBackupChainWithOptions(volumeURL, nil)
+}
+
+// RepairBackupChainWithOptions detects the backups of the volume which cannot be restored since the blocks
+// they share with the deleted backups are missing. The missing zero blocks are written again, and the other
+// missing blocks are copied from the backups in the source backup targets. The backups still missing blocks
+// are marked broken, so they fail to restore with BrokenBackupError right away, and the next backup of the
+// volume is based on the latest intact backup instead of reusing the missing blocks.
+func RepairBackupChainWithOptions(volumeURL string, opts *BackupChainRepairOptions) (*BackupChainRepairReport, error) {
+	if opts == nil {
+		opts = &BackupChainRepairOptions{}
+	}
+
+	bsDriver, err := GetBackupStoreDriver(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	_, volumeName, _, err := DecodeBackupURL(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	if !util.ValidateName(volumeName) {
+		return nil, fmt.Errorf("invalid volume name %v", volumeName)
+	}
+
+	sourceDrivers := []BackupStoreDriver{}
+	for _, sourceURL := range opts.SourceURLs {
+		driver, err := GetBackupStoreDriver(sourceURL)
+		if err != nil {
+			return nil, err
+		}
+		sourceDrivers = append(sourceDrivers, driver)
+	}
+
+	// the deletion lock prevents the backups from being created or deleted during the repair
+	lock, err := New(bsDriver, volumeName, DELETION_LOCK)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	if err := lock.Lock(); err != nil {
+		return nil, err
+	}
+
+	return repairBackupChain(bsDriver, sourceDrivers, volumeName, opts.DryRun)
+}
+
+func repairBackupChain(bsDriver BackupStoreDriver, sourceDrivers []BackupStoreDriver, volumeName string,
+	dryRun bool) (*BackupChainRepairReport, error) {
+	log := log.WithFields(logrus.Fields{
+		LogFieldVolume:  volumeName,
+		LogFieldDestURL: bsDriver.GetURL(),
+	})
+
+	volume, err := loadVolume(bsDriver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	backupNames, err := getBackupNamesForVolume(bsDriver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(backupNames)
+
+	backups := []*Backup{}
+	for _, backupName := range backupNames {
+		backup, err := loadBackup(bsDriver, backupName, volumeName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load backup %v for repair", backupName)
+		}
+		if isBackupInProgress(backup) {
+			continue
+		}
+		backups = append(backups, backup)
+	}
+
+	// the missing blocks are checked once no matter how many backups reference them
+	missing := map[string]bool{}
+	checked := map[string]bool{}
+	compressionMethods := map[string]string{}
+	for _, backup := range backups {
+		for _, block := range backup.Blocks {
+			if checked[block.BlockChecksum] {
+				continue
+			}
+			checked[block.BlockChecksum] = true
+			compressionMethods[block.BlockChecksum] = getBlockCompressionMethod(backup, block)
+			if !bsDriver.FileExists(getBlockFilePath(bsDriver, volumeName, block.BlockChecksum)) {
+				missing[block.BlockChecksum] = true
+			}
+		}
+	}
+
+	report := &BackupChainRepairReport{
+		VolumeName:           volumeName,
+		BrokenBackups:        map[string]string{},
+		ProvenanceMismatches: map[string]string{},
+	}
+	for checksum := range missing {
+		report.MissingBlocks = append(report.MissingBlocks, checksum)
+	}
+	sort.Strings(report.MissingBlocks)
+
+	if !dryRun {
+		for _, checksum := range report.MissingBlocks {
+			if err := materializeBlock(bsDriver, sourceDrivers, volumeName, checksum, compressionMethods[checksum]); err != nil {
+				log.WithError(err).Warnf("Cannot materialize missing block %v", checksum)
+				continue
+			}
+			delete(missing, checksum)
+			report.RepairedBlocks = append(report.RepairedBlocks, checksum)
+		}
+	}
+
+	lastBackup := &Backup{}
+	for _, backup := range backups {
+		if err := checkBackupProvenanceSubject(bsDriver, backup); err != nil {
+			var provenanceErr *ProvenanceError
+			if !errors.As(err, &provenanceErr) {
+				return nil, err
+			}
+			report.ProvenanceMismatches[backup.Name] = provenanceErr.Reason
+			log.WithField(LogFieldBackup, backup.Name).Warnf("Backup doesn't match its provenance: %v",
+				provenanceErr.Reason)
+		}
+
+		reason := getBackupBrokenReason(bsDriver, backup, missing)
+		if reason != "" {
+			report.BrokenBackups[backup.Name] = reason
+		} else if backup.SingleFile.FilePath == "" {
+			if err := getLatestBackup(backup, lastBackup); err != nil {
+				return nil, err
+			}
+		}
+		if reason == backup.Broken {
+			continue
+		}
+		if reason == "" {
+			report.RepairedBackups = append(report.RepairedBackups, backup.Name)
+		}
+		if dryRun {
+			continue
+		}
+		backup.Broken = reason
+		if err := saveBackup(bsDriver, backup); err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			log.WithField(LogFieldBackup, backup.Name).Warnf("Marked backup broken: %v", reason)
+		}
+	}
+
+	// the next backup must not reuse the missing blocks of a broken last backup
+	report.LastBackupName = volume.LastBackupName
+	if _, broken := report.BrokenBackups[volume.LastBackupName]; volume.LastBackupName != "" &&
+		(broken || !containsBackup(backups, volume.LastBackupName)) {
+		report.LastBackupName = lastBackup.Name
+	}
+	if !dryRun && report.LastBackupName != volume.LastBackupName {
+		if _, err := updateVolume(bsDriver, volumeName, func(v *Volume) error {
+			v.LastBackupName = lastBackup.Name
+			v.LastBackupAt = lastBackup.SnapshotCreatedAt
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		log.Infof("Rebased next backup from %v to %v", volume.LastBackupName, lastBackup.Name)
+	}
+
+	if len(report.BrokenBackups) == 0 {
+		report.BrokenBackups = nil
+	}
+	if len(report.ProvenanceMismatches) == 0 {
+		report.ProvenanceMismatches = nil
+	}
+	return report, nil
+}
+
+// getBackupBrokenReason returns why the backup cannot be restored, or an empty string if it can
+func getBackupBrokenReason(bsDriver BackupStoreDriver, backup *Backup, missing map[string]bool) string {
+	if backup.SingleFile.FilePath != "" {
+		if !backup.SingleFile.Inline && !bsDriver.FileExists(backup.SingleFile.FilePath) {
+			return fmt.Sprintf("backup file %v is missing", backup.SingleFile.FilePath)
+		}
+		return ""
+	}
+	missingBlocks := 0
+	for _, block := range backup.Blocks {
+		if missing[block.BlockChecksum] {
+			missingBlocks++
+		}
+	}
+	if missingBlocks > 0 {
+		return fmt.Sprintf("%v of %v blocks are missing", missingBlocks, len(backup.Blocks))
+	}
+	return ""
+}
+
+// materializeBlock writes the missing block again, the zero block is generated and the other blocks are copied
+// from the source backup targets
+func materializeBlock(bsDriver BackupStoreDriver, sourceDrivers []BackupStoreDriver, volumeName, checksum,
+	compressionMethod string) error {
+	blkFile := getBlockFilePath(bsDriver, volumeName, checksum)
+
+	zeroBlock := make([]byte, DEFAULT_BLOCK_SIZE)
+	if checksum == util.GetChecksum(zeroBlock) {
+		rs, err := util.CompressData(compressionMethod, zeroBlock)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		writeBlockHeader(&buf, compressionMethod, len(zeroBlock))
+		if _, err := buf.ReadFrom(rs); err != nil {
+			return err
+		}
+		return bsDriver.Write(blkFile, bytes.NewReader(buf.Bytes()))
+	}
+
+	for _, sourceDriver := range sourceDrivers {
+		srcFile := getBlockFilePath(sourceDriver, volumeName, checksum)
+		if !sourceDriver.FileExists(srcFile) {
+			continue
+		}
+		if err := copyBlock(sourceDriver, bsDriver, srcFile, blkFile, checksum, compressionMethod); err != nil {
+			log.WithError(err).Warnf("Failed to copy block %v from %v", checksum, sourceDriver.GetURL())
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("block %v is not found in any source backup target", checksum)
+}
+
+// copyBlock copies the block after verifying it can be decoded, by the block header or the compression method of
+// the backups
+func copyBlock(srcDriver, dstDriver BackupStoreDriver, srcFile, dstFile, checksum, compressionMethod string) error {
+	rc, err := srcDriver.Read(srcFile)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	buf := blockBuffers.Get()
+	defer blockBuffers.Put(buf)
+	if _, err := decodeBlock(compressionMethod, data, buf, checksum); err != nil {
+		return err
+	}
+	return dstDriver.Write(dstFile, bytes.NewReader(data))
+}
+
+func containsBackup(backups []*Backup, backupName string) bool {
+	for _, backup := range backups {
+		if backup.Name == backupName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package backupstore
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestRepairBackupChain(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	source := &writableMockStoreDriver{&mockStoreDriver{fs: afero.NewMemMapFs(), destURL: "mock://source"}}
+
+	writeBlock := func(driver BackupStoreDriver, data []byte) string {
+		checksum := util.GetChecksum(data)
+		compressed, err := util.CompressData("lz4", data)
+		assert.NoError(err)
+		assert.NoError(driver.Write(getBlockFilePath(driver, "pvc-1", checksum), compressed))
+		return checksum
+	}
+	a := writeBlock(m, bytes.Repeat([]byte("a"), DEFAULT_BLOCK_SIZE))
+	b := writeBlock(source, bytes.Repeat([]byte("b"), DEFAULT_BLOCK_SIZE))
+	zero := util.GetChecksum(make([]byte, DEFAULT_BLOCK_SIZE))
+
+	assert.NoError(addVolume(m, &Volume{Name: "pvc-1", LastBackupName: "backup-2", CompressionMethod: "lz4"}))
+	assert.NoError(saveBackup(m, &Backup{
+		Name:              "backup-1",
+		VolumeName:        "pvc-1",
+		SnapshotCreatedAt: "2026-01-01T00:00:00Z",
+		CreatedTime:       "2026-01-01T00:00:00Z",
+		CompressionMethod: "lz4",
+		Blocks:            []BlockMapping{{Offset: 0, BlockChecksum: a}, {Offset: DEFAULT_BLOCK_SIZE, BlockChecksum: zero}},
+	}))
+	assert.NoError(saveBackup(m, &Backup{
+		Name:              "backup-2",
+		VolumeName:        "pvc-1",
+		SnapshotCreatedAt: "2026-01-02T00:00:00Z",
+		CreatedTime:       "2026-01-02T00:00:00Z",
+		CompressionMethod: "lz4",
+		IsIncremental:     true,
+		Blocks:            []BlockMapping{{Offset: 0, BlockChecksum: a}, {Offset: DEFAULT_BLOCK_SIZE, BlockChecksum: b}},
+	}))
+
+	// the dry run changes nothing
+	report, err := repairBackupChain(m, nil, "pvc-1", true)
+	assert.NoError(err)
+	assert.ElementsMatch([]string{b, zero}, report.MissingBlocks)
+	assert.Empty(report.RepairedBlocks)
+	assert.Len(report.BrokenBackups, 2)
+	assert.False(m.FileExists(getBlockFilePath(m, "pvc-1", zero)))
+
+	// the zero block is materialized, the other block cannot be found
+	report, err = repairBackupChain(m, nil, "pvc-1", false)
+	assert.NoError(err)
+	assert.Equal([]string{zero}, report.RepairedBlocks)
+	assert.Equal(map[string]string{"backup-2": "1 of 2 blocks are missing"}, report.BrokenBackups)
+	assert.Equal("backup-1", report.LastBackupName)
+
+	backup, err := loadBackup(m, "backup-2", "pvc-1")
+	assert.NoError(err)
+	assert.True(IsBrokenBackupError(checkBackupBroken(backup)))
+	volume, err := loadVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal("backup-1", volume.LastBackupName)
+
+	rc, err := m.Read(getBlockFilePath(m, "pvc-1", zero))
+	assert.NoError(err)
+	var buf bytes.Buffer
+	assert.NoError(util.DecompressAndVerifyInto("lz4", &buf, rc, zero))
+	rc.Close()
+
+	// the block is copied from the source backup target, and the backup can be restored again
+	report, err = repairBackupChain(m, []BackupStoreDriver{source}, "pvc-1", false)
+	assert.NoError(err)
+	assert.Equal([]string{b}, report.RepairedBlocks)
+	assert.Empty(report.BrokenBackups)
+	assert.Equal([]string{"backup-2"}, report.RepairedBackups)
+
+	backup, err = loadBackup(m, "backup-2", "pvc-1")
+	assert.NoError(err)
+	assert.NoError(checkBackupBroken(backup))
+	assert.True(m.FileExists(getBlockFilePath(m, "pvc-1", b)))
+}
@@ -0,0 +1,58 @@
+package backupstore
+
+import (
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+	"github.com/longhorn/backupstore/util"
+)
+
+// The backup is finalized in two phases, so a crash in between leaves the backup in a state that can be resolved
+// deterministically:
+//
+//  1. prepare: the backup config is saved with all the blocks and Backup.Prepared, it's still in progress.
+//  2. commit: the volume config is updated to reference the backup as the last backup, which is the commit point,
+//     then the backup config is saved as completed.
+//
+// A prepared backup is rolled forward if the volume config references it, otherwise it's rolled back by marking it
+// aborted, then its blocks are collected by the next backup deletion.
+
+func isBackupPrepared(backup *Backup) bool {
+	return backup != nil && backup.Prepared != "" && backup.CreatedTime == ""
+}
+
+// commitBackup saves the prepared backup as completed, the backup is created at the time it was prepared
+func commitBackup(bsDriver BackupStoreDriver, backup *Backup) error {
+	backup.CreatedTime = backup.Prepared
+	backup.Prepared = ""
+	return saveBackup(bsDriver, backup)
+}
+
+// resolvePreparedBackup rolls the prepared backup forward or back by the volume config, and returns the resolved
+// backup. The caller must hold a lock excluding the backups of the volume, so the backup isn't being finalized.
+func resolvePreparedBackup(bsDriver BackupStoreDriver, volume *Volume, backup *Backup) (*Backup, error) {
+	log := log.WithFields(logrus.Fields{
+		LogFieldBackup:  backup.Name,
+		LogFieldVolume:  volume.Name,
+		LogFieldDestURL: bsDriver.GetURL(),
+	})
+	if volume.LastBackupName == backup.Name {
+		log.Info("Rolling forward prepared backup referenced by volume")
+		if err := commitBackup(bsDriver, backup); err != nil {
+			return nil, err
+		}
+		return backup, nil
+	}
+
+	log.Info("Rolling back prepared backup not referenced by volume")
+	aborted := &Backup{
+		Name:              backup.Name,
+		VolumeName:        backup.VolumeName,
+		CompressionMethod: backup.CompressionMethod,
+		Aborted:           util.Now(),
+	}
+	if err := saveBackup(bsDriver, aborted); err != nil {
+		return nil, err
+	}
+	return aborted, nil
+}
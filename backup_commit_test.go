@@ -0,0 +1,58 @@
+package backupstore
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestResolvePreparedBackups(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m, nil
+	})
+
+	// the volume config update is the commit point of backup-2, backup-3 crashed before it
+	assert.NoError(addVolume(m, &Volume{Name: "pvc-1", LastBackupName: "backup-2", CompressionMethod: "lz4"}))
+	a, b, c := util.GetChecksum([]byte("a")), util.GetChecksum([]byte("b")), util.GetChecksum([]byte("c"))
+	for _, checksum := range []string{a, b, c} {
+		assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", checksum), bytes.NewReader([]byte(checksum))))
+	}
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-1", VolumeName: "pvc-1", CreatedTime: "2026-01-01T00:00:00Z",
+		Blocks: []BlockMapping{{BlockChecksum: a}}}))
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-2", VolumeName: "pvc-1", Prepared: "2026-01-02T00:00:00Z",
+		Blocks: []BlockMapping{{BlockChecksum: b}}}))
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-3", VolumeName: "pvc-1", Prepared: "2026-01-03T00:00:00Z",
+		Blocks: []BlockMapping{{BlockChecksum: c}}}))
+
+	// the prepared backups are in progress for the versions without the two phase finalization
+	backup, err := loadBackup(m, "backup-2", "pvc-1")
+	assert.NoError(err)
+	assert.True(isBackupPrepared(backup))
+	assert.True(isBackupInProgress(backup))
+
+	// the deletion resolves the prepared backups instead of skipping the block deletion
+	assert.NoError(DeleteDeltaBlockBackup(EncodeBackupURL("backup-1", "pvc-1", mockDriverURL)))
+	backup, err = loadBackup(m, "backup-2", "pvc-1")
+	assert.NoError(err)
+	assert.False(isBackupPrepared(backup))
+	assert.Equal("2026-01-02T00:00:00Z", backup.CreatedTime)
+	assert.Len(backup.Blocks, 1)
+	backup, err = loadBackup(m, "backup-3", "pvc-1")
+	assert.NoError(err)
+	assert.False(isBackupPrepared(backup))
+	assert.True(isBackupAborted(backup))
+	assert.Empty(backup.Blocks)
+
+	assert.False(m.FileExists(getBlockFilePath(m, "pvc-1", a)))
+	assert.True(m.FileExists(getBlockFilePath(m, "pvc-1", b)))
+	assert.False(m.FileExists(getBlockFilePath(m, "pvc-1", c)))
+}
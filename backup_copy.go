@@ -0,0 +1,304 @@
+package backupstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gammazero/workerpool"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+)
+
+const (
+	// DEFAULT_COPY_CONCURRENT_LIMIT is the number of the blocks copied in parallel
+	DEFAULT_COPY_CONCURRENT_LIMIT = 16
+)
+
+// CopyBackup copies the completed backup to the backup target destURL and returns the URL of the copy. The
+// blocks already in the destination volume are skipped, so copying the backups of a volume from the oldest to
+// the newest only copies the changed blocks. The backup isn't copied again if it exists in the destination.
+func CopyBackup(backupURL, destURL string) (string, error) {
+	srcDriver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return "", err
+	}
+	dstDriver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return "", err
+	}
+	backupName, volumeName, _, err := DecodeBackupURL(backupURL)
+	if err != nil {
+		return "", err
+	}
+	if backupName == "" {
+		return "", fmt.Errorf("missing backup name in %v", backupURL)
+	}
+
+	// the backup lock of the source prevents the backup from being deleted while copying it
+	for _, driver := range []BackupStoreDriver{srcDriver, dstDriver} {
+		lock, err := New(driver, volumeName, BACKUP_LOCK)
+		if err != nil {
+			return "", err
+		}
+		defer lock.Unlock()
+		if err := lock.Lock(); err != nil {
+			return "", err
+		}
+	}
+
+	if err := copyBackup(srcDriver, dstDriver, backupName, volumeName); err != nil {
+		return "", err
+	}
+	return EncodeBackupURL(backupName, volumeName, destURL), nil
+}
+
+// backupCopier copies the backups between the backup targets, it limits the rate of the bytes read from the source
+// and verifies the copied files if required
+type backupCopier struct {
+	srcDriver       BackupStoreDriver
+	dstDriver       BackupStoreDriver
+	concurrentLimit int
+	limiter         *rateLimiter
+	verify          bool
+
+	lock         sync.Mutex
+	copiedBlocks int64
+	copiedBytes  int64
+}
+
+func newBackupCopier(srcDriver, dstDriver BackupStoreDriver) *backupCopier {
+	return &backupCopier{
+		srcDriver:       srcDriver,
+		dstDriver:       dstDriver,
+		concurrentLimit: DEFAULT_COPY_CONCURRENT_LIMIT,
+		limiter:         newRateLimiter(0),
+	}
+}
+
+func copyBackup(srcDriver, dstDriver BackupStoreDriver, backupName, volumeName string) error {
+	_, err := newBackupCopier(srcDriver, dstDriver).copyBackup(backupName, volumeName)
+	return err
+}
+
+// copyBackup copies the backup and its missing blocks, it returns false if the backup exists in the destination
+func (c *backupCopier) copyBackup(backupName, volumeName string) (bool, error) {
+	srcDriver, dstDriver := c.srcDriver, c.dstDriver
+	log := log.WithFields(logrus.Fields{
+		LogFieldBackup:  backupName,
+		LogFieldVolume:  volumeName,
+		LogFieldDestURL: dstDriver.GetURL(),
+	})
+
+	backup, err := loadBackup(srcDriver, backupName, volumeName)
+	if err != nil {
+		return false, err
+	}
+	if isBackupInProgress(backup) {
+		return false, fmt.Errorf("backup %v of volume %v is in progress", backupName, volumeName)
+	}
+	if dstDriver.FileExists(getBackupConfigPath(dstDriver, backupName, volumeName)) {
+		copied, err := loadBackup(dstDriver, backupName, volumeName)
+		if err == nil && !isBackupInProgress(copied) {
+			log.Info("Backup already exists in the destination, skipping copy")
+			return false, c.copyBackupProvenance(backupName, volumeName)
+		}
+	}
+
+	srcVolume, err := loadVolume(srcDriver, volumeName)
+	if err != nil {
+		return false, err
+	}
+	if !volumeExists(dstDriver, volumeName) {
+		// the new volume is placed by the block layout of the destination
+		volume := &Volume{
+			Name:                 srcVolume.Name,
+			Size:                 srcVolume.Size,
+			Labels:               srcVolume.Labels,
+			CreatedTime:          srcVolume.CreatedTime,
+			BackingImageName:     srcVolume.BackingImageName,
+			BackingImageChecksum: srcVolume.BackingImageChecksum,
+			CompressionMethod:    srcVolume.CompressionMethod,
+			StorageClassName:     srcVolume.StorageClassName,
+			BackendStoreDriver:   srcVolume.BackendStoreDriver,
+			EncryptionRequired:   srcVolume.EncryptionRequired,
+		}
+		if err := setNewVolumeBlockLayout(dstDriver, volume); err != nil {
+			return false, err
+		}
+		if err := addVolume(dstDriver, volume); err != nil {
+			return false, err
+		}
+	}
+	dstVolume, err := loadVolume(dstDriver, volumeName)
+	if err != nil {
+		return false, err
+	}
+	if err := checkVolumeOwnership(dstVolume, false); err != nil {
+		return false, err
+	}
+	if err := checkVolumeCompressionMigration(dstVolume); err != nil {
+		return false, err
+	}
+	// the blocks are shared by the backups of the volume, so they must be compressed by the same method
+	if dstVolume.CompressionMethod != backup.CompressionMethod {
+		return false, fmt.Errorf("cannot copy backup %v compressed by %v to volume %v compressed by %v",
+			backupName, backup.CompressionMethod, volumeName, dstVolume.CompressionMethod)
+	}
+
+	copiedBlocks, err := c.copyBlocks(volumeName, backup.Blocks)
+	if err != nil {
+		return false, err
+	}
+
+	isSingleFile := backup.SingleFile.FilePath != ""
+	if isSingleFile && !backup.SingleFile.Inline {
+		dstPath := getSingleFileBackupFilePath(dstDriver, backup)
+		if err := c.copyFile(backup.SingleFile.FilePath, dstPath); err != nil {
+			return false, err
+		}
+		backup.SingleFile.FilePath = dstPath
+	} else if isSingleFile {
+		backup.SingleFile.FilePath = getSingleFileBackupFilePath(dstDriver, backup)
+	}
+
+	// the provenance is copied before the backup is completed in the destination, so the copied backup is
+	// verified as the source
+	if err := c.copyBackupProvenance(backupName, volumeName); err != nil {
+		return false, err
+	}
+	if err := saveBackup(dstDriver, backup); err != nil {
+		return false, err
+	}
+
+	if _, err := updateVolume(dstDriver, volumeName, func(v *Volume) error {
+		v.BlockCount += copiedBlocks
+		if !isSingleFile && isBackupNewer(backup, v.LastBackupAt) {
+			v.LastBackupName = backup.Name
+			v.LastBackupAt = backup.SnapshotCreatedAt
+		}
+		return nil
+	}); err != nil {
+		return false, err
+	}
+
+	log.Infof("Copied backup with %v blocks and %v new blocks", len(backup.Blocks), copiedBlocks)
+	return true, nil
+}
+
+// copyBackupProvenance copies the provenance of the backup if the source has one and the destination doesn't. The
+// subject of the provenance doesn't depend on the backup target, so the copy is still valid.
+func (c *backupCopier) copyBackupProvenance(backupName, volumeName string) error {
+	srcPath := getBackupProvenancePath(c.srcDriver, backupName, volumeName)
+	dstPath := getBackupProvenancePath(c.dstDriver, backupName, volumeName)
+	if !c.srcDriver.FileExists(srcPath) || c.dstDriver.FileExists(dstPath) {
+		return nil
+	}
+	return c.copyFile(srcPath, dstPath)
+}
+
+// isBackupNewer checks if the backup is newer than the last backup of the volume
+func isBackupNewer(backup *Backup, lastBackupAt string) bool {
+	if lastBackupAt == "" {
+		return true
+	}
+	lastBackupTime, err := time.Parse(time.RFC3339, lastBackupAt)
+	if err != nil {
+		return true
+	}
+	backupTime, err := time.Parse(time.RFC3339, backup.SnapshotCreatedAt)
+	if err != nil {
+		return false
+	}
+	return backupTime.After(lastBackupTime)
+}
+
+// copyBlocks copies the blocks missing in the destination volume, and returns the number of the copied blocks
+func (c *backupCopier) copyBlocks(volumeName string, blocks []BlockMapping) (int64, error) {
+	var (
+		lock   sync.Mutex
+		copied int64
+		errs   []error
+	)
+	checksums := map[string]bool{}
+	pool := workerpool.New(c.concurrentLimit)
+	for _, block := range blocks {
+		checksum := block.BlockChecksum
+		if checksums[checksum] {
+			continue
+		}
+		checksums[checksum] = true
+
+		pool.Submit(func() {
+			dstPath := getBlockFilePath(c.dstDriver, volumeName, checksum)
+			if c.dstDriver.FileExists(dstPath) {
+				return
+			}
+			err := c.copyFile(getBlockFilePath(c.srcDriver, volumeName, checksum), dstPath)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			copied++
+		})
+	}
+	pool.StopWait()
+	if len(errs) > 0 {
+		return 0, errs[0]
+	}
+
+	c.lock.Lock()
+	c.copiedBlocks += copied
+	c.lock.Unlock()
+	return copied, nil
+}
+
+func (c *backupCopier) copyFile(srcPath, dstPath string) error {
+	rc, err := c.srcDriver.Read(srcPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %v", srcPath)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %v", srcPath)
+	}
+	c.limiter.wait(int64(len(data)))
+	if err := c.dstDriver.Write(dstPath, bytes.NewReader(data)); err != nil {
+		return errors.Wrapf(err, "failed to write %v", dstPath)
+	}
+	if c.verify {
+		if err := verifyCopiedFile(c.dstDriver, dstPath, data); err != nil {
+			return err
+		}
+	}
+
+	c.lock.Lock()
+	c.copiedBytes += int64(len(data))
+	c.lock.Unlock()
+	return nil
+}
+
+// verifyCopiedFile reads the copied file back and compares it with the data written
+func verifyCopiedFile(driver BackupStoreDriver, path string, data []byte) error {
+	rc, err := driver.Read(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read back %v", path)
+	}
+	defer rc.Close()
+	copied, err := io.ReadAll(rc)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read back %v", path)
+	}
+	if !bytes.Equal(copied, data) {
+		return fmt.Errorf("copied file %v of %v bytes differs from the source of %v bytes", path, len(copied), len(data))
+	}
+	return nil
+}
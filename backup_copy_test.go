@@ -0,0 +1,60 @@
+package backupstore
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestCopyBackup(t *testing.T) {
+	assert := assert.New(t)
+
+	src := &writableMockStoreDriver{&mockStoreDriver{}}
+	src.Init()
+	defer src.uninstall()
+	dst := &writableMockStoreDriver{&mockStoreDriver{}}
+	dst.Init()
+	defer dst.uninstall()
+
+	assert.NoError(saveVolume(src, &Volume{Name: "pvc-1", Size: 4096, CompressionMethod: "lz4"}))
+	a, b, c := util.GetChecksum([]byte("a")), util.GetChecksum([]byte("b")), util.GetChecksum([]byte("c"))
+	for _, checksum := range []string{a, b, c} {
+		assert.NoError(src.Write(getBlockFilePath(src, "pvc-1", checksum), bytes.NewReader([]byte(checksum))))
+	}
+	backups := []*Backup{
+		{Name: "backup-1", SnapshotCreatedAt: "2023-01-01T00:00:00Z", Blocks: []BlockMapping{{BlockChecksum: a}, {Offset: 1, BlockChecksum: b}}},
+		{Name: "backup-2", SnapshotCreatedAt: "2023-01-02T00:00:00Z", Blocks: []BlockMapping{{BlockChecksum: b}, {Offset: 1, BlockChecksum: c}}},
+	}
+	for _, backup := range backups {
+		backup.VolumeName = "pvc-1"
+		backup.CompressionMethod = "lz4"
+		backup.CreatedTime = "2023-01-02T00:00:00Z"
+		assert.NoError(saveBackup(src, backup))
+	}
+
+	// the newer backup is copied first
+	assert.NoError(copyBackup(src, dst, "backup-2", "pvc-1"))
+	assert.NoError(copyBackup(src, dst, "backup-1", "pvc-1"))
+	assert.NoError(copyBackup(src, dst, "backup-1", "pvc-1"))
+
+	v, err := loadVolume(dst, "pvc-1")
+	assert.NoError(err)
+	assert.Equal("backup-2", v.LastBackupName)
+	assert.Equal(int64(3), v.BlockCount)
+	assert.Equal(int64(4096), v.Size)
+	for _, checksum := range []string{a, b, c} {
+		assert.True(dst.FileExists(getBlockFilePath(dst, "pvc-1", checksum)))
+	}
+	copied, err := loadBackup(dst, "backup-1", "pvc-1")
+	assert.NoError(err)
+	assert.Equal(backups[0].Blocks, copied.Blocks)
+
+	// the blocks are shared by the backups, so the compression methods must match
+	backups[0].CompressionMethod = "gzip"
+	assert.NoError(saveBackup(src, backups[0]))
+	assert.NoError(dst.Remove(getBackupConfigPath(dst, "backup-1", "pvc-1")))
+	assert.Error(copyBackup(src, dst, "backup-1", "pvc-1"))
+}
@@ -0,0 +1,297 @@
+package backupstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gammazero/workerpool"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	BACKUP_FS_VOLUME_FILE       = "volume.json"
+	BACKUP_FS_BACKUPS_DIRECTORY = "backups"
+	BACKUP_FS_BACKUP_SUFFIX     = ".json"
+	BACKUP_FS_DATA_SUFFIX       = ".img"
+)
+
+// BackupFS is a read-only fs.FS over a backup target, so the generic tooling like fs.WalkDir can browse the
+// backupstore without knowing the driver. The volumes are the directories in the root:
+//
+//	<volume>/volume.json                  the VolumeInfo of the volume
+//	<volume>/backups/<backup>.json        the BackupInfo of the completed backup
+//	<volume>/backups/<backup>.img         the data of the completed delta block backup, read by BackupReader
+//
+// The backups in progress and the aborted backups are hidden.
+type BackupFS struct {
+	driver BackupStoreDriver
+}
+
+// NewBackupFS opens the backup target for browsing
+func NewBackupFS(destURL string) (*BackupFS, error) {
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	return &BackupFS{driver: driver}, nil
+}
+
+// Open implements fs.FS
+func (b *BackupFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	file, err := b.open(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return file, nil
+}
+
+func (b *BackupFS) open(name string) (fs.File, error) {
+	if name == "." {
+		return b.openRoot()
+	}
+
+	parts := strings.Split(name, "/")
+	volumeName := parts[0]
+	if !util.ValidateName(volumeName) || !volumeExists(b.driver, volumeName) {
+		return nil, fs.ErrNotExist
+	}
+	switch {
+	case len(parts) == 1:
+		volumeFile, err := b.openVolume(volumeName)
+		if err != nil {
+			return nil, err
+		}
+		return newBackupFSDir(volumeName, []fs.DirEntry{
+			fs.FileInfoToDirEntry(volumeFile.info),
+			fs.FileInfoToDirEntry(&backupFSFileInfo{name: BACKUP_FS_BACKUPS_DIRECTORY, mode: fs.ModeDir}),
+		}), nil
+	case len(parts) == 2 && parts[1] == BACKUP_FS_VOLUME_FILE:
+		return b.openVolume(volumeName)
+	case len(parts) == 2 && parts[1] == BACKUP_FS_BACKUPS_DIRECTORY:
+		return b.openBackups(volumeName)
+	case len(parts) == 3 && parts[1] == BACKUP_FS_BACKUPS_DIRECTORY:
+		return b.openBackup(volumeName, parts[2])
+	}
+	return nil, fs.ErrNotExist
+}
+
+func (b *BackupFS) openVolume(volumeName string) (*backupFSFile, error) {
+	volume, err := loadVolume(b.driver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	return newBackupFSJSONFile(BACKUP_FS_VOLUME_FILE, parseBackupFSTime(volume.CreatedTime), fillVolumeInfo(volume))
+}
+
+func (b *BackupFS) openRoot() (fs.File, error) {
+	jobQueues := workerpool.New(runtime.NumCPU() * 16)
+	defer jobQueues.StopWait()
+
+	volumeNames, err := getVolumeNames(jobQueues, b.driver)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(volumeNames)
+	entries := make([]fs.DirEntry, 0, len(volumeNames))
+	for _, volumeName := range volumeNames {
+		entries = append(entries, fs.FileInfoToDirEntry(&backupFSFileInfo{name: volumeName, mode: fs.ModeDir}))
+	}
+	return newBackupFSDir(".", entries), nil
+}
+
+// loadBackupFSBackup loads the backup shown by the file system, fs.ErrNotExist is returned for the hidden backups
+func (b *BackupFS) loadBackupFSBackup(volumeName, backupName string) (*Backup, error) {
+	if !util.ValidateName(backupName) ||
+		!b.driver.FileExists(getBackupConfigPath(b.driver, backupName, volumeName)) {
+		return nil, fs.ErrNotExist
+	}
+	backup, err := loadBackup(b.driver, backupName, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	if isBackupInProgress(backup) || isBackupAborted(backup) {
+		return nil, fs.ErrNotExist
+	}
+	return backup, nil
+}
+
+func (b *BackupFS) openBackups(volumeName string) (fs.File, error) {
+	volume, err := loadVolume(b.driver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	backupNames, err := getBackupNamesForVolume(b.driver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []fs.DirEntry{}
+	for _, backupName := range backupNames {
+		backup, err := b.loadBackupFSBackup(volumeName, backupName)
+		if err != nil {
+			log.WithError(err).Debugf("Skipped backup %v of volume %v in backup file system", backupName, volumeName)
+			continue
+		}
+		modTime := parseBackupFSTime(backup.CreatedTime)
+		backupFile, err := newBackupFSJSONFile(backupName+BACKUP_FS_BACKUP_SUFFIX, modTime,
+			fillFullBackupInfo(backup, volume, b.driver.GetURL()))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(backupFile.info))
+		if backup.SingleFile.FilePath == "" {
+			entries = append(entries, fs.FileInfoToDirEntry(&backupFSFileInfo{
+				name:    backupName + BACKUP_FS_DATA_SUFFIX,
+				size:    getBackupDataSize(volume, backup),
+				modTime: modTime,
+			}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return newBackupFSDir(BACKUP_FS_BACKUPS_DIRECTORY, entries), nil
+}
+
+func (b *BackupFS) openBackup(volumeName, fileName string) (fs.File, error) {
+	switch {
+	case strings.HasSuffix(fileName, BACKUP_FS_BACKUP_SUFFIX):
+		backup, err := b.loadBackupFSBackup(volumeName, strings.TrimSuffix(fileName, BACKUP_FS_BACKUP_SUFFIX))
+		if err != nil {
+			return nil, err
+		}
+		volume, err := loadVolume(b.driver, volumeName)
+		if err != nil {
+			return nil, err
+		}
+		return newBackupFSJSONFile(fileName, parseBackupFSTime(backup.CreatedTime),
+			fillFullBackupInfo(backup, volume, b.driver.GetURL()))
+	case strings.HasSuffix(fileName, BACKUP_FS_DATA_SUFFIX):
+		backup, err := b.loadBackupFSBackup(volumeName, strings.TrimSuffix(fileName, BACKUP_FS_DATA_SUFFIX))
+		if err != nil {
+			return nil, err
+		}
+		if backup.SingleFile.FilePath != "" {
+			return nil, fs.ErrNotExist
+		}
+		reader, err := NewBackupReader(EncodeBackupURL(backup.Name, volumeName, b.driver.GetURL()), 0)
+		if err != nil {
+			return nil, err
+		}
+		return &backupFSFile{
+			info: &backupFSFileInfo{
+				name:    fileName,
+				size:    reader.Size(),
+				modTime: parseBackupFSTime(backup.CreatedTime),
+			},
+			SectionReader: io.NewSectionReader(reader, 0, reader.Size()),
+		}, nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+func parseBackupFSTime(timestamp string) time.Time {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+type backupFSFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i *backupFSFileInfo) Name() string { return i.name }
+func (i *backupFSFileInfo) Size() int64  { return i.size }
+func (i *backupFSFileInfo) Mode() fs.FileMode {
+	if i.mode.IsDir() {
+		return i.mode | 0555
+	}
+	return i.mode | 0444
+}
+func (i *backupFSFileInfo) ModTime() time.Time { return i.modTime }
+func (i *backupFSFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *backupFSFileInfo) Sys() interface{}   { return nil }
+
+// backupFSFile is a regular file of BackupFS, it supports io.Seeker and io.ReaderAt
+type backupFSFile struct {
+	info *backupFSFileInfo
+	*io.SectionReader
+}
+
+func newBackupFSJSONFile(name string, modTime time.Time, v interface{}) (*backupFSFile, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return &backupFSFile{
+		info:          &backupFSFileInfo{name: name, size: int64(len(data)), modTime: modTime},
+		SectionReader: io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))),
+	}, nil
+}
+
+func (f *backupFSFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *backupFSFile) Close() error {
+	return nil
+}
+
+// backupFSDir is a directory of BackupFS, the entries are listed when it's opened. The directories have no
+// modification time, so they can be listed without loading the volumes.
+type backupFSDir struct {
+	info    *backupFSFileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func newBackupFSDir(name string, entries []fs.DirEntry) *backupFSDir {
+	return &backupFSDir{
+		info:    &backupFSFileInfo{name: name, mode: fs.ModeDir},
+		entries: entries,
+	}
+}
+
+func (d *backupFSDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *backupFSDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *backupFSDir) Close() error {
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile
+func (d *backupFSDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return remaining[:n], nil
+}
@@ -0,0 +1,65 @@
+package backupstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestBackupFS(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m, nil
+	})
+
+	data := bytes.Repeat([]byte("data"), DEFAULT_BLOCK_SIZE/4)
+	checksum := util.GetChecksum(data)
+	assert.NoError(addVolume(m, &Volume{Name: "pvc-1", Size: 2 * DEFAULT_BLOCK_SIZE, CompressionMethod: "none",
+		CreatedTime: "2026-01-01T00:00:00Z"}))
+	assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", checksum), bytes.NewReader(data)))
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-1", VolumeName: "pvc-1", CompressionMethod: "none",
+		Blocks: []BlockMapping{{Offset: DEFAULT_BLOCK_SIZE, BlockChecksum: checksum}}, CreatedTime: "2026-01-02T00:00:00Z"}))
+	// the backup in progress is hidden
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-2", VolumeName: "pvc-1", CompressionMethod: "none"}))
+
+	fsys, err := NewBackupFS(mockDriverURL)
+	assert.NoError(err)
+	assert.NoError(fstest.TestFS(fsys, "pvc-1/volume.json", "pvc-1/backups/backup-1.json", "pvc-1/backups/backup-1.img"))
+
+	entries, err := fs.ReadDir(fsys, "pvc-1/backups")
+	assert.NoError(err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal([]string{"backup-1.img", "backup-1.json"}, names)
+
+	content, err := fs.ReadFile(fsys, "pvc-1/backups/backup-1.json")
+	assert.NoError(err)
+	info := &BackupInfo{}
+	assert.NoError(json.Unmarshal(content, info))
+	assert.Equal("backup-1", info.Name)
+	assert.Equal("pvc-1", info.VolumeName)
+
+	content, err = fs.ReadFile(fsys, "pvc-1/backups/backup-1.img")
+	assert.NoError(err)
+	assert.Equal(append(make([]byte, DEFAULT_BLOCK_SIZE), data...), content)
+
+	_, err = fsys.Open("pvc-1/backups/backup-2.json")
+	assert.ErrorIs(err, fs.ErrNotExist)
+	_, err = fsys.Open("pvc-2")
+	assert.ErrorIs(err, fs.ErrNotExist)
+	_, err = fsys.Open("/pvc-1")
+	assert.ErrorIs(err, fs.ErrInvalid)
+}
@@ -0,0 +1,129 @@
+package backupstore
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+type BackupNameCollisionPolicy string
+
+const (
+	// BackupNameCollisionPolicyError fails with BackupNameCollisionError if the name is taken, the default
+	BackupNameCollisionPolicyError = BackupNameCollisionPolicy("error")
+	// BackupNameCollisionPolicySuffix appends the first free suffix -1, -2, ... to the name if it is taken
+	BackupNameCollisionPolicySuffix = BackupNameCollisionPolicy("suffix")
+
+	// MAX_BACKUP_NAME_SUFFIX is the largest suffix tried by BackupNameCollisionPolicySuffix
+	MAX_BACKUP_NAME_SUFFIX = 100
+
+	// BACKUP_NAME_TIMESTAMP_FORMAT is the format of the Timestamp of the backup name templates
+	BACKUP_NAME_TIMESTAMP_FORMAT = "20060102T150405Z"
+)
+
+// BackupNameTemplate generates the backup names from the Go text template executed with BackupNameData, e.g.
+// `{{.VolumeName}}-{{.Timestamp}}-{{.Labels.app}}`, instead of the random names. The generated name
+// must be a valid name, and a missing label fails the backup.
+type BackupNameTemplate struct {
+	Template        string
+	CollisionPolicy BackupNameCollisionPolicy
+}
+
+// BackupNameData is the data the backup name templates are executed with
+type BackupNameData struct {
+	VolumeName   string
+	SnapshotName string
+	// Timestamp is the UTC time the backup is created at in BACKUP_NAME_TIMESTAMP_FORMAT
+	Timestamp string
+	Labels    map[string]string
+}
+
+// BackupNameCollisionError is returned when the name generated by the template is taken by another backup
+type BackupNameCollisionError struct {
+	BackupName string
+	VolumeName string
+}
+
+func (e *BackupNameCollisionError) Error() string {
+	return fmt.Sprintf("backup %v of volume %v already exists", e.BackupName, e.VolumeName)
+}
+
+// IsBackupNameCollisionError checks if the error is caused by the generated backup name taken by another backup
+func IsBackupNameCollisionError(err error) bool {
+	var collisionErr *BackupNameCollisionError
+	return errors.As(err, &collisionErr)
+}
+
+// Validate checks if the template can be parsed and the collision policy is known
+func (t *BackupNameTemplate) Validate() error {
+	if _, err := t.parse(); err != nil {
+		return err
+	}
+	switch t.CollisionPolicy {
+	case "", BackupNameCollisionPolicyError, BackupNameCollisionPolicySuffix:
+		return nil
+	}
+	return fmt.Errorf("unknown backup name collision policy %v", t.CollisionPolicy)
+}
+
+func (t *BackupNameTemplate) parse() (*template.Template, error) {
+	tmpl, err := template.New("backup-name").Option("missingkey=error").Parse(t.Template)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid backup name template %v", t.Template)
+	}
+	return tmpl, nil
+}
+
+func newBackupNameData(volumeName, snapshotName string, labels map[string]string) *BackupNameData {
+	return &BackupNameData{
+		VolumeName:   volumeName,
+		SnapshotName: snapshotName,
+		Timestamp:    time.Now().UTC().Format(BACKUP_NAME_TIMESTAMP_FORMAT),
+		Labels:       labels,
+	}
+}
+
+// generateBackupName executes the template, and resolves the collision with the backups of the volume in any of
+// the backup targets by the collision policy. The caller must hold the backup lock of the volume in all the
+// backup targets.
+func generateBackupName(drivers []BackupStoreDriver, t *BackupNameTemplate, data *BackupNameData) (string, error) {
+	tmpl, err := t.parse()
+	if err != nil {
+		return "", err
+	}
+	var name strings.Builder
+	if err := tmpl.Execute(&name, data); err != nil {
+		return "", errors.Wrapf(err, "failed to generate backup name by template %v", t.Template)
+	}
+	backupName := name.String()
+	if !util.ValidateName(backupName) {
+		return "", fmt.Errorf("invalid backup name %v generated by template %v", backupName, t.Template)
+	}
+
+	taken := func(backupName string) bool {
+		for _, driver := range drivers {
+			if driver.FileExists(getBackupConfigPath(driver, backupName, data.VolumeName)) {
+				return true
+			}
+		}
+		return false
+	}
+	if !taken(backupName) {
+		return backupName, nil
+	}
+	if t.CollisionPolicy != BackupNameCollisionPolicySuffix {
+		return "", &BackupNameCollisionError{BackupName: backupName, VolumeName: data.VolumeName}
+	}
+	for i := 1; i <= MAX_BACKUP_NAME_SUFFIX; i++ {
+		suffixed := fmt.Sprintf("%v-%v", backupName, i)
+		if !taken(suffixed) {
+			return suffixed, nil
+		}
+	}
+	return "", &BackupNameCollisionError{BackupName: backupName, VolumeName: data.VolumeName}
+}
@@ -0,0 +1,45 @@
+package backupstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateBackupName(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	drivers := []BackupStoreDriver{m}
+
+	data := &BackupNameData{
+		VolumeName:   "pvc-1",
+		SnapshotName: "snap-1",
+		Timestamp:    "20230102T030405Z",
+		Labels:       map[string]string{"app": "db"},
+	}
+	tmpl := &BackupNameTemplate{Template: `{{.Labels.app}}-{{.SnapshotName}}-{{.Timestamp}}`}
+	assert.NoError(tmpl.Validate())
+	name, err := generateBackupName(drivers, tmpl, data)
+	assert.NoError(err)
+	assert.Equal("db-snap-1-20230102T030405Z", name)
+
+	assert.NoError(saveBackup(m, &Backup{Name: name, VolumeName: "pvc-1"}))
+	_, err = generateBackupName(drivers, tmpl, data)
+	assert.True(IsBackupNameCollisionError(err))
+
+	tmpl.CollisionPolicy = BackupNameCollisionPolicySuffix
+	name, err = generateBackupName(drivers, tmpl, data)
+	assert.NoError(err)
+	assert.Equal("db-snap-1-20230102T030405Z-1", name)
+
+	// the missing labels and the invalid names fail the backup
+	_, err = generateBackupName(drivers, &BackupNameTemplate{Template: `backup-{{.Labels.tier}}`}, data)
+	assert.Error(err)
+	_, err = generateBackupName(drivers, &BackupNameTemplate{Template: `{{.VolumeName}}/{{.SnapshotName}}`}, data)
+	assert.Error(err)
+	assert.Error((&BackupNameTemplate{Template: `{{.VolumeName`}).Validate())
+	assert.Error((&BackupNameTemplate{Template: "backup", CollisionPolicy: "overwrite"}).Validate())
+}
@@ -0,0 +1,258 @@
+package backupstore
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+)
+
+const (
+	DEFAULT_BACKUP_READER_CACHE_BLOCKS = 64
+)
+
+// BackupReader reads the data of a delta block backup without restoring it. The blocks are fetched
+// from the backupstore on demand when they are accessed, and the recently used blocks are cached.
+// Only the part read of the uncompressed blocks is fetched if the driver supports the ranged reads,
+// the part isn't verified then since the block checksum covers the whole block.
+type BackupReader struct {
+	bsDriver          BackupStoreDriver
+	volumeName        string
+	backupName        string
+	compressionMethod string
+	size              int64
+	// rangeReads fetches the part read of the uncompressed blocks instead of the whole blocks
+	rangeReads bool
+
+	// blocks maps the block offset to the block checksum, the unmapped blocks are zero
+	blocks map[int64]string
+	// blockCompressionMethods maps the checksum of the blocks to their compression method if it differs from
+	// the one of the backup
+	blockCompressionMethods map[string]string
+
+	cacheLock   sync.Mutex
+	cacheBlocks int
+	cacheList   *list.List
+	cache       map[int64]*list.Element
+}
+
+type cachedBlock struct {
+	offset int64
+	data   []byte
+}
+
+// NewBackupReader opens the delta block backup for reading. cacheBlocks is the number of the blocks
+// cached in memory, DEFAULT_BACKUP_READER_CACHE_BLOCKS is used if it's not positive.
+func NewBackupReader(backupURL string, cacheBlocks int) (*BackupReader, error) {
+	bsDriver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return nil, err
+	}
+
+	backup, err := loadCompletedBackup(backupURL)
+	if err != nil {
+		return nil, err
+	}
+
+	volume, err := loadVolume(bsDriver, backup.VolumeName)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVolumeCompressionMigration(volume); err != nil {
+		return nil, err
+	}
+
+	if cacheBlocks <= 0 {
+		cacheBlocks = DEFAULT_BACKUP_READER_CACHE_BLOCKS
+	}
+	r := &BackupReader{
+		bsDriver:          bsDriver,
+		volumeName:        backup.VolumeName,
+		backupName:        backup.Name,
+		compressionMethod: backup.CompressionMethod,
+		size:              getBackupDataSize(volume, backup),
+		blocks:            make(map[int64]string, len(backup.Blocks)),
+		cacheBlocks:       cacheBlocks,
+		cacheList:         list.New(),
+		cache:             make(map[int64]*list.Element),
+	}
+	if _, ok := bsDriver.(BackupStoreRangeReader); ok && backup.CompressionMethod == "none" {
+		r.rangeReads = true
+	}
+	for _, block := range backup.Blocks {
+		r.blocks[block.Offset] = block.BlockChecksum
+		if block.CompressionMethod != "" {
+			if r.blockCompressionMethods == nil {
+				r.blockCompressionMethods = map[string]string{}
+			}
+			r.blockCompressionMethods[block.BlockChecksum] = block.CompressionMethod
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		LogFieldBackup: backup.Name,
+		LogFieldVolume: backup.VolumeName,
+	}).Infof("Opened backup for reading with %v blocks and size %v", len(backup.Blocks), r.size)
+	return r, nil
+}
+
+// getBackupDataSize returns the size of the backup data, which is the volume size or the end of the last block
+// if the volume has been shrunk after the backup
+func getBackupDataSize(volume *Volume, backup *Backup) int64 {
+	size := volume.Size
+	for _, block := range backup.Blocks {
+		if end := block.Offset + DEFAULT_BLOCK_SIZE; end > size {
+			size = end
+		}
+	}
+	return size
+}
+
+// Size returns the size of the backup data
+func (r *BackupReader) Size() int64 {
+	return r.size
+}
+
+// ReadAt implements io.ReaderAt, it's safe for concurrent use
+func (r *BackupReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("invalid negative offset %v", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) && off < r.size {
+		blockOffset := off - off%DEFAULT_BLOCK_SIZE
+		start := off - blockOffset
+		end := int64(len(p) - n)
+		if remaining := r.size - off; end > remaining {
+			end = remaining
+		}
+		if end > DEFAULT_BLOCK_SIZE-start {
+			end = DEFAULT_BLOCK_SIZE - start
+		}
+
+		data, err := r.getBlockRange(blockOffset, start, end)
+		if err != nil {
+			return n, err
+		}
+		if data == nil {
+			// the block is not mapped
+			for i := int64(0); i < end; i++ {
+				p[n+int(i)] = 0
+			}
+		} else {
+			copy(p[n:n+int(end)], data)
+		}
+		n += int(end)
+		off += end
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// getBlockRange returns length bytes from start of the block at the block offset, or nil if the block is not
+// mapped. Only the range is fetched if the block is uncompressed and not cached.
+func (r *BackupReader) getBlockRange(offset, start, length int64) ([]byte, error) {
+	if r.rangeReads && length < DEFAULT_BLOCK_SIZE {
+		checksum, ok := r.blocks[offset]
+		if !ok {
+			return nil, nil
+		}
+		r.cacheLock.Lock()
+		_, cached := r.cache[offset]
+		r.cacheLock.Unlock()
+		if !cached {
+			blkFile := getBlockFilePath(r.bsDriver, r.volumeName, checksum)
+			data, err := readFileRange(r.bsDriver, blkFile, start, length)
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(data)) != length {
+				return nil, fmt.Errorf("invalid size %v of block %v range from %v", len(data), checksum, start)
+			}
+			return data, nil
+		}
+	}
+
+	data, err := r.getBlock(offset)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return data[start : start+length], nil
+}
+
+// getBlock returns the block data at the block offset, or nil if the block is not mapped
+func (r *BackupReader) getBlock(offset int64) ([]byte, error) {
+	checksum, ok := r.blocks[offset]
+	if !ok {
+		return nil, nil
+	}
+
+	r.cacheLock.Lock()
+	if elem, ok := r.cache[offset]; ok {
+		r.cacheList.MoveToFront(elem)
+		data := elem.Value.(*cachedBlock).data
+		r.cacheLock.Unlock()
+		return data, nil
+	}
+	r.cacheLock.Unlock()
+
+	data, err := r.fetchBlock(checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+	if elem, ok := r.cache[offset]; ok {
+		// fetched by another reader in the meantime
+		r.cacheList.MoveToFront(elem)
+		return elem.Value.(*cachedBlock).data, nil
+	}
+	r.cache[offset] = r.cacheList.PushFront(&cachedBlock{offset: offset, data: data})
+	for r.cacheList.Len() > r.cacheBlocks {
+		oldest := r.cacheList.Back()
+		r.cacheList.Remove(oldest)
+		delete(r.cache, oldest.Value.(*cachedBlock).offset)
+	}
+	return data, nil
+}
+
+func (r *BackupReader) fetchBlock(checksum string) ([]byte, error) {
+	blkFile := getBlockFilePath(r.bsDriver, r.volumeName, checksum)
+	rc, err := r.bsDriver.Read(blkFile)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	method := r.compressionMethod
+	if blockMethod, ok := r.blockCompressionMethods[checksum]; ok {
+		method = blockMethod
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(DEFAULT_BLOCK_SIZE)
+	if _, err := decodeBlock(method, data, &buf, checksum); err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) != DEFAULT_BLOCK_SIZE {
+		return nil, fmt.Errorf("invalid size %v of block %v", buf.Len(), checksum)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,81 @@
+package backupstore
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+// rangeMockStoreDriver counts the bytes read by the ranged reads
+type rangeMockStoreDriver struct {
+	*writableMockStoreDriver
+	rangeBytes int64
+}
+
+func (m *rangeMockStoreDriver) ReadRange(src string, offset, length int64) (io.ReadCloser, error) {
+	data, err := readFileRange(m.writableMockStoreDriver, src, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	m.rangeBytes += int64(len(data))
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func TestBackupReaderRangeReads(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	driver := &rangeMockStoreDriver{writableMockStoreDriver: m}
+
+	data := bytes.Repeat([]byte("0123456789"), DEFAULT_BLOCK_SIZE/10+1)[:DEFAULT_BLOCK_SIZE]
+	checksum := util.GetChecksum(data)
+	blkFile := getBlockFilePath(m, "pvc-1", checksum)
+	assert.NoError(m.Write(blkFile, bytes.NewReader(data)))
+
+	// the rest of the file is discarded without the ranged reads
+	part, err := readFileRange(m, blkFile, 5, 3)
+	assert.NoError(err)
+	assert.Equal("567", string(part))
+	part, err = readFileRange(m, blkFile, DEFAULT_BLOCK_SIZE-2, 10)
+	assert.NoError(err)
+	assert.Equal("01", string(part))
+
+	r := &BackupReader{
+		bsDriver:          driver,
+		volumeName:        "pvc-1",
+		compressionMethod: "none",
+		size:              2 * DEFAULT_BLOCK_SIZE,
+		rangeReads:        true,
+		blocks:            map[int64]string{DEFAULT_BLOCK_SIZE: checksum},
+		cacheBlocks:       1,
+		cacheList:         list.New(),
+		cache:             map[int64]*list.Element{},
+	}
+
+	p := make([]byte, 4)
+	_, err = r.ReadAt(p, DEFAULT_BLOCK_SIZE+12)
+	assert.NoError(err)
+	assert.Equal("2345", string(p))
+	assert.Equal(int64(4), driver.rangeBytes)
+
+	// the partial reads across the blocks fill the unmapped block with zeros
+	p = make([]byte, 6)
+	_, err = r.ReadAt(p, DEFAULT_BLOCK_SIZE-3)
+	assert.NoError(err)
+	assert.Equal([]byte{0, 0, 0, '0', '1', '2'}, p)
+	assert.Equal(int64(7), driver.rangeBytes)
+
+	// the whole blocks are fetched and verified as usual
+	p = make([]byte, DEFAULT_BLOCK_SIZE)
+	_, err = r.ReadAt(p, DEFAULT_BLOCK_SIZE)
+	assert.NoError(err)
+	assert.Equal(data, p)
+	assert.Equal(int64(7), driver.rangeBytes)
+}
@@ -0,0 +1,350 @@
+package backupstore
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	// DEFAULT_BACKUP_SCHEDULE_WINDOW is how long the scheduled backup can be started after its window opens
+	DEFAULT_BACKUP_SCHEDULE_WINDOW = time.Hour
+	// DEFAULT_MAX_CONCURRENT_BACKUPS_PER_TARGET serializes the scheduled backups of each backup target
+	DEFAULT_MAX_CONCURRENT_BACKUPS_PER_TARGET = 1
+)
+
+// createScheduledBackup starts the scheduled backups, replaced by the tests
+var createScheduledBackup = CreateDeltaBlockBackup
+
+// BackupSchedule is a recurring backup started by BackupScheduler
+type BackupSchedule struct {
+	// Name identifies the schedule in the scheduler
+	Name string
+	// Cron is the standard 5-field cron expression of when the backup windows open, e.g. "0 2 * * *" opens
+	// the window at 2am every day, or one of the descriptors @hourly, @daily, @weekly and @monthly. The time
+	// is in the local time zone.
+	Cron string
+	// Window defaults to DEFAULT_BACKUP_SCHEDULE_WINDOW. The backup which cannot be started until the window
+	// closes, e.g. waiting for the other backups of the backup target, is skipped.
+	Window time.Duration
+	// Jitter delays the start of the backup randomly by up to Jitter after the window opens, so the schedules
+	// of many volumes don't hit the backup target at once. It's capped by the window.
+	Jitter time.Duration
+	// NewConfig returns the config of the backup when it's about to start. The backup is named by the
+	// BackupName or the NameTemplate of the config, or generated if neither is set. The OnComplete of the
+	// config is called as usual.
+	NewConfig func() (*DeltaBackupConfig, error)
+	// OnSkip is called if the backup of the window opened at windowStart is skipped, optional
+	OnSkip func(windowStart time.Time, err error)
+}
+
+// BackupSchedulerOptions are the options of NewBackupScheduler
+type BackupSchedulerOptions struct {
+	// MaxConcurrentBackupsPerTarget caps the scheduled backups running in each backup target, defaults to
+	// DEFAULT_MAX_CONCURRENT_BACKUPS_PER_TARGET. The backup waits for all of its backup targets.
+	MaxConcurrentBackupsPerTarget int
+}
+
+// BackupScheduler starts the recurring backups in their windows, for the callers without a scheduler. A schedule
+// never runs 2 backups at once, and the backups of all the schedules are capped per backup target.
+type BackupScheduler struct {
+	lock         sync.Mutex
+	maxPerTarget int
+	schedules    map[string]*scheduledBackup
+	// slots are the semaphores of the backup targets keyed by the backup target URL without the params
+	slots   map[string]chan struct{}
+	started bool
+}
+
+type scheduledBackup struct {
+	schedule BackupSchedule
+	cron     *cronSchedule
+	// stop is closed to stop the loop of the schedule, nil if the loop isn't running
+	stop    chan struct{}
+	running bool
+}
+
+// NewBackupScheduler creates a stopped backup scheduler
+func NewBackupScheduler(opts *BackupSchedulerOptions) *BackupScheduler {
+	if opts == nil {
+		opts = &BackupSchedulerOptions{}
+	}
+	maxPerTarget := opts.MaxConcurrentBackupsPerTarget
+	if maxPerTarget <= 0 {
+		maxPerTarget = DEFAULT_MAX_CONCURRENT_BACKUPS_PER_TARGET
+	}
+	return &BackupScheduler{
+		maxPerTarget: maxPerTarget,
+		schedules:    map[string]*scheduledBackup{},
+		slots:        map[string]chan struct{}{},
+	}
+}
+
+// AddSchedule adds the schedule, which starts right away if the scheduler is started
+func (s *BackupScheduler) AddSchedule(schedule *BackupSchedule) error {
+	if schedule == nil || schedule.Name == "" {
+		return fmt.Errorf("invalid empty backup schedule name")
+	}
+	if schedule.NewConfig == nil {
+		return fmt.Errorf("BUG: missing NewConfig of backup schedule %v", schedule.Name)
+	}
+	if schedule.Window < 0 || schedule.Jitter < 0 {
+		return fmt.Errorf("invalid negative window or jitter of backup schedule %v", schedule.Name)
+	}
+	cron, err := parseCron(schedule.Cron)
+	if err != nil {
+		return err
+	}
+	if cron.next(time.Now()).IsZero() {
+		return fmt.Errorf("cron expression %q of backup schedule %v never matches", schedule.Cron, schedule.Name)
+	}
+
+	sb := &scheduledBackup{
+		schedule: *schedule,
+		cron:     cron,
+	}
+	if sb.schedule.Window == 0 {
+		sb.schedule.Window = DEFAULT_BACKUP_SCHEDULE_WINDOW
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, exists := s.schedules[schedule.Name]; exists {
+		return fmt.Errorf("backup schedule %v already exists", schedule.Name)
+	}
+	s.schedules[schedule.Name] = sb
+	if s.started {
+		s.startSchedule(sb)
+	}
+	return nil
+}
+
+// RemoveSchedule removes the schedule, the backup already started keeps running
+func (s *BackupScheduler) RemoveSchedule(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if sb, exists := s.schedules[name]; exists {
+		s.stopSchedule(sb)
+		delete(s.schedules, name)
+	}
+}
+
+// Start starts the schedules
+func (s *BackupScheduler) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+	for _, sb := range s.schedules {
+		s.startSchedule(sb)
+	}
+}
+
+// Stop stops the schedules, the backups already started keep running and the ones waiting for their backup
+// targets are skipped
+func (s *BackupScheduler) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.started {
+		return
+	}
+	s.started = false
+	for _, sb := range s.schedules {
+		s.stopSchedule(sb)
+	}
+}
+
+// startSchedule requires the scheduler lock held
+func (s *BackupScheduler) startSchedule(sb *scheduledBackup) {
+	stop := make(chan struct{})
+	sb.stop = stop
+	go s.runSchedule(sb, stop)
+}
+
+// stopSchedule requires the scheduler lock held
+func (s *BackupScheduler) stopSchedule(sb *scheduledBackup) {
+	if sb.stop != nil {
+		close(sb.stop)
+		sb.stop = nil
+	}
+}
+
+func (s *BackupScheduler) runSchedule(sb *scheduledBackup, stop chan struct{}) {
+	for {
+		windowStart := sb.cron.next(time.Now())
+		if windowStart.IsZero() {
+			log.Warnf("Stopped backup schedule %v since cron expression %q no longer matches", sb.schedule.Name,
+				sb.schedule.Cron)
+			return
+		}
+		timer := time.NewTimer(time.Until(windowStart.Add(getScheduleJitter(&sb.schedule))))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.startScheduledBackup(sb, windowStart, stop)
+	}
+}
+
+// getScheduleJitter returns the random delay of the backup start within the jitter and the window
+func getScheduleJitter(schedule *BackupSchedule) time.Duration {
+	jitter := schedule.Jitter
+	if jitter > schedule.Window {
+		jitter = schedule.Window
+	}
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
+
+// startScheduledBackup starts the backup of the window opened at windowStart once its backup targets are
+// available, or skips it if the window closes first
+func (s *BackupScheduler) startScheduledBackup(sb *scheduledBackup, windowStart time.Time, stop chan struct{}) {
+	log := log.WithField("schedule", sb.schedule.Name)
+
+	err := s.tryStartScheduledBackup(sb, windowStart, stop)
+	if err == nil {
+		return
+	}
+	log.WithError(err).Warnf("Skipped scheduled backup of window opened at %v", windowStart)
+	if sb.schedule.OnSkip != nil {
+		sb.schedule.OnSkip(windowStart, err)
+	}
+}
+
+func (s *BackupScheduler) tryStartScheduledBackup(sb *scheduledBackup, windowStart time.Time, stop chan struct{}) error {
+	deadline := windowStart.Add(sb.schedule.Window)
+	if !time.Now().Before(deadline) {
+		return fmt.Errorf("backup window closed at %v", deadline)
+	}
+
+	s.lock.Lock()
+	if sb.running {
+		s.lock.Unlock()
+		return fmt.Errorf("previous backup of schedule %v is still running", sb.schedule.Name)
+	}
+	sb.running = true
+	s.lock.Unlock()
+
+	started := false
+	defer func() {
+		if !started {
+			s.setScheduleRunning(sb, false)
+		}
+	}()
+
+	config, err := sb.schedule.NewConfig()
+	if err != nil {
+		return errors.Wrapf(err, "failed to get backup config of schedule %v", sb.schedule.Name)
+	}
+	if config == nil {
+		return fmt.Errorf("BUG: invalid empty config of backup schedule %v", sb.schedule.Name)
+	}
+
+	targetKeys := getScheduleTargetKeys(config)
+	if err := s.acquireSlots(targetKeys, deadline, stop); err != nil {
+		return err
+	}
+
+	// OnComplete is called exactly once no matter how the backup ends, so it releases the backup targets
+	onComplete := config.OnComplete
+	config.OnComplete = func(summary *BackupSummary) {
+		s.releaseSlots(targetKeys)
+		s.setScheduleRunning(sb, false)
+		if onComplete != nil {
+			onComplete(summary)
+		}
+	}
+	started = true
+
+	backupName := config.BackupName
+	if backupName == "" && config.NameTemplate == nil {
+		backupName = util.GenerateName("backup")
+	}
+	log.WithFields(logrus.Fields{
+		"schedule":      sb.schedule.Name,
+		LogFieldBackup:  backupName,
+		LogFieldDestURL: config.DestURL,
+	}).Infof("Starting scheduled backup of window opened at %v", windowStart)
+	if _, err := createScheduledBackup(backupName, config); err != nil {
+		// the failure is reported by OnComplete
+		log.WithError(err).Warnf("Failed to start scheduled backup of schedule %v", sb.schedule.Name)
+	}
+	return nil
+}
+
+func (s *BackupScheduler) setScheduleRunning(sb *scheduledBackup, running bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sb.running = running
+}
+
+func (s *BackupScheduler) getSlot(targetKey string) chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	slot, exists := s.slots[targetKey]
+	if !exists {
+		slot = make(chan struct{}, s.maxPerTarget)
+		s.slots[targetKey] = slot
+	}
+	return slot
+}
+
+// acquireSlots takes a slot of each backup target in the order of the keys, so the backups sharing the backup
+// targets don't deadlock
+func (s *BackupScheduler) acquireSlots(targetKeys []string, deadline time.Time, stop chan struct{}) error {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for i, targetKey := range targetKeys {
+		select {
+		case s.getSlot(targetKey) <- struct{}{}:
+		case <-timer.C:
+			s.releaseSlots(targetKeys[:i])
+			return fmt.Errorf("backup target %v is busy until the backup window closed at %v", targetKey, deadline)
+		case <-stop:
+			s.releaseSlots(targetKeys[:i])
+			return fmt.Errorf("backup scheduler stopped")
+		}
+	}
+	return nil
+}
+
+func (s *BackupScheduler) releaseSlots(targetKeys []string) {
+	for _, targetKey := range targetKeys {
+		<-s.getSlot(targetKey)
+	}
+}
+
+// getScheduleTargetKeys returns the sorted keys of the backup targets of the backup, the URL params don't
+// identify the backup target
+func getScheduleTargetKeys(config *DeltaBackupConfig) []string {
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, destURL := range config.getDestURLs() {
+		key := destURL
+		if u, err := url.Parse(destURL); err == nil {
+			u.RawQuery = ""
+			key = u.String()
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,188 @@
+package backupstore
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/types"
+)
+
+func TestParseCron(t *testing.T) {
+	assert := assert.New(t)
+
+	at := func(value string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", value, time.UTC)
+		assert.NoError(err)
+		return tm
+	}
+	// 2023-01-02 is a Monday
+	now := at("2023-01-02 10:30")
+	for spec, next := range map[string]string{
+		"* * * * *":        "2023-01-02 10:31",
+		"0 2 * * *":        "2023-01-03 02:00",
+		"@hourly":          "2023-01-02 11:00",
+		"@weekly":          "2023-01-08 00:00",
+		"*/15 * * * *":     "2023-01-02 10:45",
+		"45/5 10 * * *":    "2023-01-02 10:45",
+		"0 9-17/4 * * 1-5": "2023-01-02 13:00",
+		"0 0 * * 7":        "2023-01-08 00:00",
+		"0 0 1,15 * *":     "2023-01-15 00:00",
+		"0 0 15 * 3":       "2023-01-04 00:00",
+		"30 10 2 1 *":      "2024-01-02 10:30",
+		"0 0 29 2 *":       "2024-02-29 00:00",
+	} {
+		cron, err := parseCron(spec)
+		if !assert.NoError(err, spec) {
+			continue
+		}
+		assert.Equal(at(next), cron.next(now), spec)
+	}
+
+	cron, err := parseCron("0 0 30 2 *")
+	assert.NoError(err)
+	assert.True(cron.next(now).IsZero())
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *",
+		"* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@every"} {
+		_, err := parseCron(spec)
+		assert.Error(err, spec)
+	}
+}
+
+func TestBackupScheduler(t *testing.T) {
+	assert := assert.New(t)
+
+	started := make(chan *DeltaBackupConfig, 10)
+	createScheduledBackup = func(backupName string, config *DeltaBackupConfig) (bool, error) {
+		assert.NotEmpty(backupName)
+		started <- config
+		return false, nil
+	}
+	defer func() {
+		createScheduledBackup = CreateDeltaBlockBackup
+	}()
+	complete := func(config *DeltaBackupConfig) {
+		config.OnComplete(&BackupSummary{State: types.ProgressStateComplete})
+	}
+
+	s := NewBackupScheduler(nil)
+	assert.Error(s.AddSchedule(&BackupSchedule{Name: "invalid", Cron: "* * *", NewConfig: func() (*DeltaBackupConfig, error) {
+		return nil, nil
+	}}))
+	assert.Error(s.AddSchedule(&BackupSchedule{Name: "no-config", Cron: "@daily"}))
+
+	skipped := make(chan error, 10)
+	completed := make(chan *BackupSummary, 10)
+	newSchedule := func(name, destURL string) *scheduledBackup {
+		schedule := &BackupSchedule{
+			Name: name,
+			Cron: "@daily",
+			NewConfig: func() (*DeltaBackupConfig, error) {
+				return &DeltaBackupConfig{
+					DestURL: destURL,
+					OnComplete: func(summary *BackupSummary) {
+						completed <- summary
+					},
+				}, nil
+			},
+			OnSkip: func(windowStart time.Time, err error) {
+				skipped <- err
+			},
+		}
+		assert.NoError(s.AddSchedule(schedule))
+		assert.Error(s.AddSchedule(schedule))
+		return s.schedules[name]
+	}
+	vol1 := newSchedule("vol-1", "s3://bucket@region/backupstore?consistencyBarrier=true")
+	vol2 := newSchedule("vol-2", "s3://bucket@region/backupstore")
+	vol3 := newSchedule("vol-3", "nfs://server:/backupstore")
+	assert.Equal(DEFAULT_BACKUP_SCHEDULE_WINDOW, vol1.schedule.Window)
+	stop := make(chan struct{})
+
+	// the backup is started in the window
+	now := time.Now()
+	s.startScheduledBackup(vol1, now, stop)
+	config := <-started
+	assert.Equal("s3://bucket@region/backupstore?consistencyBarrier=true", config.DestURL)
+
+	// the schedule doesn't run 2 backups at once
+	s.startScheduledBackup(vol1, now, stop)
+	assert.Error(<-skipped)
+
+	// the backup of the same backup target waits for the running one until the window closes
+	vol2.schedule.Window = 100 * time.Millisecond
+	s.startScheduledBackup(vol2, now, stop)
+	assert.Error(<-skipped)
+	s.startScheduledBackup(vol2, now.Add(-time.Hour), stop)
+	assert.Error(<-skipped)
+
+	// the backup of the other backup target isn't capped
+	s.startScheduledBackup(vol3, now, stop)
+	complete(<-started)
+	assert.Equal(types.ProgressStateComplete, (<-completed).State)
+
+	vol2.schedule.Window = time.Minute
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.startScheduledBackup(vol2, time.Now(), stop)
+	}()
+	select {
+	case <-started:
+		assert.Fail("backup started before the backup target is available")
+	case <-time.After(100 * time.Millisecond):
+	}
+	complete(config)
+	<-completed
+	complete(<-started)
+	<-completed
+	<-done
+
+	// the failure to get the config skips the backup
+	vol3.schedule.NewConfig = func() (*DeltaBackupConfig, error) {
+		return nil, fmt.Errorf("snapshot failed")
+	}
+	s.startScheduledBackup(vol3, time.Now(), stop)
+	assert.Error(<-skipped)
+	assert.False(vol3.running)
+
+	// the stopped scheduler skips the waiting backups
+	s.startScheduledBackup(vol1, time.Now(), stop)
+	config = <-started
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.startScheduledBackup(vol2, time.Now(), stop)
+	}()
+	close(stop)
+	wg.Wait()
+	assert.Error(<-skipped)
+	complete(config)
+	<-completed
+
+	// the schedules are started and stopped with the scheduler
+	s.Start()
+	for _, sb := range []*scheduledBackup{vol1, vol2, vol3} {
+		assert.NotNil(sb.stop)
+	}
+	s.RemoveSchedule("vol-3")
+	assert.Nil(vol3.stop)
+	s.Stop()
+	assert.Nil(vol1.stop)
+	assert.Len(s.schedules, 2)
+	assert.Empty(started)
+}
+
+func TestGetScheduleJitter(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Zero(getScheduleJitter(&BackupSchedule{Window: time.Hour}))
+	for i := 0; i < 100; i++ {
+		assert.Less(getScheduleJitter(&BackupSchedule{Window: time.Second, Jitter: time.Hour}), time.Second)
+	}
+}
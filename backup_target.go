@@ -0,0 +1,189 @@
+package backupstore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+	"github.com/longhorn/backupstore/types"
+	"github.com/longhorn/backupstore/util"
+)
+
+// BackupTargetStatus is the completion status of a backup on one of the backup targets
+type BackupTargetStatus struct {
+	DestURL   string
+	State     types.ProgressState
+	BackupURL string
+	Error     string
+}
+
+// DeltaBlockBackupTargetOperations can be optionally implemented by the DeltaBlockBackupOperations
+// to receive the per-target completion status when backing up to multiple backup targets
+type DeltaBlockBackupTargetOperations interface {
+	UpdateBackupTargetStatus(id, volumeID string, statuses []BackupTargetStatus) error
+}
+
+// backupTarget tracks the state of a backup on one of the backup targets
+type backupTarget struct {
+	sync.Mutex
+
+	destURL  string
+	bsDriver BackupStoreDriver
+	lock     *FileLock
+	volume   *Volume
+	// limiter adapts the concurrent block uploads to the backup target, nil for the static concurrency
+	limiter *util.AIMDLimiter
+	// blockFilter is the bloom filter of the blocks in the backup target, nil if disabled
+	blockFilter *blockFilter
+	// overwriteBlocks uploads the blocks even if they exist, set by the forced full backup
+	overwriteBlocks bool
+
+	lastBackup     *Backup
+	newBlockCounts int64
+
+	backupURL string
+	err       error
+}
+
+func (t *backupTarget) failed() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.err != nil
+}
+
+func (t *backupTarget) setError(err error) {
+	t.Lock()
+	defer t.Unlock()
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+func (t *backupTarget) writeBlock(blkFile string, data []byte) error {
+	if err := checkCircuitBreaker(t.bsDriver.GetURL()); err != nil {
+		return err
+	}
+	if t.limiter == nil {
+		err := writeBlockVerified(t.bsDriver, blkFile, data, t.overwriteBlocks)
+		recordCircuitBreakerResult(t.bsDriver.GetURL(), err)
+		return err
+	}
+	t.limiter.Acquire()
+	start := time.Now()
+	err := writeBlockVerified(t.bsDriver, blkFile, data, t.overwriteBlocks)
+	t.limiter.Release(time.Since(start), err)
+	recordCircuitBreakerResult(t.bsDriver.GetURL(), err)
+	return err
+}
+
+func (t *backupTarget) addNewBlock(checksum string) {
+	t.Lock()
+	defer t.Unlock()
+	t.newBlockCounts++
+	if t.blockFilter != nil {
+		t.blockFilter.add(checksum)
+	}
+}
+
+func (t *backupTarget) status() BackupTargetStatus {
+	t.Lock()
+	defer t.Unlock()
+	if t.err != nil {
+		return BackupTargetStatus{
+			DestURL: t.destURL,
+			State:   types.ProgressStateError,
+			Error:   t.err.Error(),
+		}
+	}
+	return BackupTargetStatus{
+		DestURL:   t.destURL,
+		State:     types.ProgressStateComplete,
+		BackupURL: t.backupURL,
+	}
+}
+
+// getDestURLs returns the backup targets of the backup, the DestURL is always the first one
+func (config *DeltaBackupConfig) getDestURLs() []string {
+	destURLs := []string{config.DestURL}
+	for _, destURL := range config.DestURLs {
+		if destURL == "" || destURL == config.DestURL {
+			continue
+		}
+		destURLs = append(destURLs, destURL)
+	}
+	return destURLs
+}
+
+// checkBackupTargetVolumes checks if the volumes in the backup targets take the same blocks. The blocks are read
+// and compressed once for all the backup targets, so the volumes compressed differently cannot be backed up in
+// the same pass.
+func checkBackupTargetVolumes(targets []*backupTarget) error {
+	primary := targets[0]
+	for _, target := range targets[1:] {
+		if target.volume.CompressionMethod != primary.volume.CompressionMethod {
+			return fmt.Errorf("volume %v is compressed by %v in %v but by %v in %v, cannot back up to both",
+				primary.volume.Name, primary.volume.CompressionMethod, primary.destURL,
+				target.volume.CompressionMethod, target.destURL)
+		}
+		if target.volume.BackendStoreDriver != primary.volume.BackendStoreDriver {
+			return fmt.Errorf("volume %v uses backend store driver %v in %v but %v in %v, cannot back up to both",
+				primary.volume.Name, primary.volume.BackendStoreDriver, primary.destURL,
+				target.volume.BackendStoreDriver, target.destURL)
+		}
+	}
+	return nil
+}
+
+func getActiveBackupTargets(targets []*backupTarget) []*backupTarget {
+	active := []*backupTarget{}
+	for _, target := range targets {
+		if !target.failed() {
+			active = append(active, target)
+		}
+	}
+	return active
+}
+
+// getCommonLastBackup returns the last backup that all the backup targets can use
+// as the base of the incremental backup. The snapshot can be compared only once,
+// hence we fall back to the full backup if the backup targets disagree.
+func getCommonLastBackup(targets []*backupTarget) *Backup {
+	var lastBackup *Backup
+	for _, target := range targets {
+		if target.lastBackup == nil {
+			return nil
+		}
+		if lastBackup == nil {
+			lastBackup = target.lastBackup
+			continue
+		}
+		if lastBackup.SnapshotName != target.lastBackup.SnapshotName {
+			log.WithFields(logrus.Fields{
+				LogFieldReason:     LogReasonFallback,
+				LogFieldEvent:      LogEventBackup,
+				LogFieldObject:     LogObjectBackup,
+				LogFieldLastBackup: target.lastBackup.Name,
+				LogFieldDestURL:    target.destURL,
+			}).Info("Backup targets have different last snapshots, creating full backup")
+			return nil
+		}
+	}
+	return lastBackup
+}
+
+func updateBackupTargetsStatus(deltaOps DeltaBlockBackupOperations, snapshotName, volumeName string, targets []*backupTarget) {
+	targetOps, ok := deltaOps.(DeltaBlockBackupTargetOperations)
+	if !ok {
+		return
+	}
+	statuses := make([]BackupTargetStatus, 0, len(targets))
+	for _, target := range targets {
+		statuses = append(statuses, target.status())
+	}
+	if err := targetOps.UpdateBackupTargetStatus(snapshotName, volumeName, statuses); err != nil {
+		log.WithError(err).Warnf("Failed to update backup target status for volume %v snapshot %v", volumeName, snapshotName)
+	}
+}
@@ -0,0 +1,79 @@
+package backupstore
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/types"
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestMultiTargetBackup(t *testing.T) {
+	assert := assert.New(t)
+
+	primary := &writableMockStoreDriver{&mockStoreDriver{}}
+	primary.Init()
+	defer primary.uninstall()
+	secondary := &writableMockStoreDriver{&mockStoreDriver{fs: afero.NewMemMapFs(), destURL: "mock://secondary"}}
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		if destURL == secondary.destURL {
+			return secondary, nil
+		}
+		return primary, nil
+	})
+
+	data := append(bytes.Repeat([]byte("a"), DEFAULT_BLOCK_SIZE), bytes.Repeat([]byte("b"), DEFAULT_BLOCK_SIZE)...)
+	source := &memoryBlockSource{data: data, extents: []types.Mapping{{Offset: 0, Size: 2 * DEFAULT_BLOCK_SIZE}}}
+	newConfig := func(snapshotName string) *DeltaBackupConfig {
+		return &DeltaBackupConfig{
+			Volume:          &Volume{Name: "pvc-1", Size: 2 * DEFAULT_BLOCK_SIZE, CompressionMethod: "lz4"},
+			Snapshot:        &Snapshot{Name: snapshotName, CreatedTime: util.Now()},
+			DestURL:         mockDriverURL,
+			DestURLs:        []string{secondary.destURL},
+			Source:          source,
+			ConcurrentLimit: 1,
+		}
+	}
+
+	// the blocks are uploaded to both backup targets
+	summary := runDeltaBlockBackup("backup-1", newConfig("snap-1"))
+	assert.Equal(types.ProgressStateComplete, summary.State, "%v", summary.Error)
+	if assert.Len(summary.Targets, 2) {
+		assert.Equal(mockDriverURL, summary.Targets[0].DestURL)
+		assert.Equal(secondary.destURL, summary.Targets[1].DestURL)
+		for _, status := range summary.Targets {
+			assert.Equal(types.ProgressStateComplete, status.State, status.Error)
+		}
+	}
+	for _, driver := range []BackupStoreDriver{primary, secondary} {
+		backup, err := loadBackup(driver, "backup-1", "pvc-1")
+		assert.NoError(err)
+		assert.Equal("lz4", backup.CompressionMethod)
+		assert.Len(backup.Blocks, 2)
+		for _, block := range backup.Blocks {
+			assert.True(driver.FileExists(getBlockFilePath(driver, "pvc-1", block.BlockChecksum)))
+		}
+		volume, err := loadVolume(driver, "pvc-1")
+		assert.NoError(err)
+		assert.Equal("backup-1", volume.LastBackupName)
+		assert.Equal(int64(2), volume.BlockCount)
+	}
+
+	// the volume compressed differently in the secondary backup target cannot share the blocks
+	_, err := updateVolume(secondary, "pvc-1", func(v *Volume) error {
+		v.CompressionMethod = "gzip"
+		return nil
+	})
+	assert.NoError(err)
+	summary = runDeltaBlockBackup("backup-2", newConfig("snap-2"))
+	assert.Equal(types.ProgressStateError, summary.State)
+	assert.Contains(summary.Error.Error(), "compressed by lz4")
+	for _, driver := range []BackupStoreDriver{primary, secondary} {
+		_, err := loadBackup(driver, "backup-2", "pvc-1")
+		assert.Error(err)
+	}
+}
@@ -17,22 +17,42 @@ type Volume struct {
 	CreatedTime          string
 	LastBackupName       string
 	LastBackupAt         string
-	BlockCount           int64  `json:",string"`
-	BackingImageName     string `json:",string"`
-	BackingImageChecksum string `json:",string"`
-	CompressionMethod    string `json:",string"`
-	StorageClassName     string `json:",string"`
-	BackendStoreDriver   string `json:",string"`
+	BlockCount           int64        `json:",string"`
+	BackingImageName     string       `json:",string"`
+	BackingImageChecksum string       `json:",string"`
+	CompressionMethod    string       `json:",string"`
+	StorageClassName     string       `json:",string"`
+	BackendStoreDriver   string       `json:",string"`
+	Quota                *VolumeQuota `json:",omitempty"`
+	// MigratingCompressionMethod is the compression method the blocks are being recompressed with
+	MigratingCompressionMethod string `json:",omitempty"`
+	// VolumeRecords is set once the created backups update the volume by the volume records, LastRecordSeq is
+	// the sequence number of the last record folded into the volume config
+	VolumeRecords bool  `json:",omitempty"`
+	LastRecordSeq int64 `json:",string,omitempty"`
+	// OwnerClusterID is the UUID of the cluster owning the volume, LastWriter is the identity which wrote the
+	// volume config last
+	OwnerClusterID string `json:",omitempty"`
+	LastWriter     string `json:",omitempty"`
+	// BlockLayout is the directory layout of the blocks, it's set when the volume is created
+	BlockLayout *BlockLayout `json:",omitempty"`
+	// EncryptionRequired rejects the backups of the snapshots which are not LUKS encrypted
+	EncryptionRequired bool `json:",omitempty"`
 }
 
 type Snapshot struct {
 	Name        string
 	CreatedTime string
+	// Checksum identifies the data of the snapshot, e.g. the checksum computed by the replica. It's saved in the
+	// backup config, so the backups of the snapshot can be found by FindBackupsBySnapshot
+	Checksum string
 }
 
 type ProcessingBlocks struct {
 	sync.Mutex
 	blocks map[string][]*BlockMapping
+	// compressionMethods are the compression methods of the blocks which differ from the one of the backup
+	compressionMethods map[string]string
 }
 
 type Backup struct {
@@ -41,11 +61,36 @@ type Backup struct {
 	VolumeName        string
 	SnapshotName      string
 	SnapshotCreatedAt string
+	// SnapshotChecksum identifies the data of the snapshot backed up, only set if the checksum was provided
+	SnapshotChecksum  string `json:",omitempty"`
 	CreatedTime       string
 	Size              int64 `json:",string"`
 	Labels            map[string]string
 	IsIncremental     bool
 	CompressionMethod string
+	DeletionProtected bool `json:",omitempty"`
+	// CreatedBy is the version of the library that created the backup
+	CreatedBy string `json:",omitempty"`
+	// RequiredFeatures are the features required for restoring the backup
+	RequiredFeatures []string `json:",omitempty"`
+	// CompressionStats is the summary of the blocks compressed by the backup
+	CompressionStats *CompressionStats `json:",omitempty"`
+	// ComplianceMode is ComplianceModeFIPS if the backup was created in FIPS mode
+	ComplianceMode string `json:",omitempty"`
+	// Broken is the reason the backup cannot be restored, set by RepairBackupChain if its blocks are lost
+	Broken string `json:",omitempty"`
+	// ChainBase is set if the backup was forced to be a full backup, none of its blocks were deduplicated
+	// against the blocks uploaded before it
+	ChainBase bool `json:",omitempty"`
+	// Aborted is when the backup was aborted by AbortBackup, the aborted backup has no blocks
+	Aborted string `json:",omitempty"`
+	// Prepared is when the backup was prepared by the first phase of the finalization, the prepared backup has all
+	// its blocks but stays in progress until it's committed
+	Prepared string `json:",omitempty"`
+	// TrashedAt is when the backup was soft deleted, only set for the backups in the trash
+	TrashedAt string `json:",omitempty"`
+	// BlockCRCs are the CRC32-C of the blocks changed by the backup, only set if the CRCs were provided
+	BlockCRCs map[int64]uint32 `json:",omitempty"`
 
 	ProcessingBlocks *ProcessingBlocks
 
@@ -74,6 +119,11 @@ func addVolume(driver BackupStoreDriver, volume *Volume) error {
 		return fmt.Errorf("invalid volume name %v", volume.Name)
 	}
 
+	// the new volume is owned by the cluster creating it
+	if cluster, _ := GetClusterIdentity(); cluster != "" {
+		volume.OwnerClusterID = cluster
+	}
+
 	if err := saveVolume(driver, volume); err != nil {
 		log.WithError(err).Errorf("Failed to add volume %v", volume.Name)
 		return err
@@ -88,10 +138,12 @@ func removeVolume(volumeName string, driver BackupStoreDriver) error {
 		return fmt.Errorf("invalid volume name %v", volumeName)
 	}
 
-	volumeDir := getVolumePath(volumeName)
-	volumeBlocksDirectory := getBlockPath(volumeName)
-	volumeBackupsDirectory := getBackupPath(volumeName)
-	volumeLocksDirectory := getLockPath(volumeName)
+	volumeDir := getVolumePath(driver, volumeName)
+	volumeBlocksDirectory := getBlockPath(driver, volumeName)
+	volumeBackupsDirectory := getBackupPath(driver, volumeName)
+	volumeLocksDirectory := getLockPath(driver, volumeName)
+	volumeTrashDirectory := getTrashPath(driver, volumeName)
+	volumeHistoryDirectory := getVolumeHistoryPath(driver, volumeName)
 	if err := driver.Remove(volumeBackupsDirectory); err != nil {
 		return errors.Wrapf(err, "failed to remove all the backups for volume %v", volumeName)
 	}
@@ -101,10 +153,18 @@ func removeVolume(volumeName string, driver BackupStoreDriver) error {
 	if err := driver.Remove(volumeLocksDirectory); err != nil {
 		return errors.Wrapf(err, "failed to remove all the locks for volume %v", volumeName)
 	}
+	if err := driver.Remove(volumeTrashDirectory); err != nil {
+		return errors.Wrapf(err, "failed to remove the trash for volume %v", volumeName)
+	}
+	if err := driver.Remove(volumeHistoryDirectory); err != nil {
+		return errors.Wrapf(err, "failed to remove the config history for volume %v", volumeName)
+	}
 	if err := driver.Remove(volumeDir); err != nil {
 		return errors.Wrapf(err, "failed to remove backup volume %v directory in backupstore", volumeName)
 	}
 
+	unsetVolumeBlockLayout(driver, volumeName)
+
 	log.Infof("Removed volume directory in backupstore %v", volumeDir)
 	log.Infof("Removed backupstore volume %v", volumeName)
 
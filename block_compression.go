@@ -0,0 +1,38 @@
+package backupstore
+
+import (
+	"bytes"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+// getBlockCompressionMethod returns the compression method of the block of the backup, the method recorded for the
+// block takes precedence over the one of the backup
+func getBlockCompressionMethod(backup *Backup, block BlockMapping) string {
+	if block.CompressionMethod != "" {
+		return block.CompressionMethod
+	}
+	return backup.CompressionMethod
+}
+
+// hasBlockCompressionMethods checks if any block records a compression method differing from the one of the backup
+func hasBlockCompressionMethods(blocks []BlockMapping) bool {
+	for _, block := range blocks {
+		if block.CompressionMethod != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// detectBlockCompressionMethod returns the compression method of the block data. The block deduplicated with a block
+// stored uncompressed by another backup doesn't record the method, so the data without the header of any compression
+// method is taken as uncompressed if the expected method has a header. The checksum verification catches the wrong
+// guesses.
+func detectBlockCompressionMethod(method string, data []byte) string {
+	magic, err := util.GetCompressionMagic(method)
+	if err != nil || len(magic) == 0 || bytes.HasPrefix(data, magic) || util.DetectCompressionMethod(data) != "" {
+		return method
+	}
+	return "none"
+}
@@ -0,0 +1,114 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const refusingCompressionMethod = "test-refusing"
+
+// refusingCompressor compresses by lz4 but refuses the data starting with 'r'
+type refusingCompressor struct {
+	util.Compressor
+}
+
+func (c refusingCompressor) Compress(dst io.Writer, src io.Reader) error {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 && data[0] == 'r' {
+		return util.ErrIncompressible
+	}
+	return c.Compressor.Compress(dst, bytes.NewReader(data))
+}
+
+func TestBlockCompressionMethod(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	method := refusingCompressionMethod
+	assert.NoError(util.RegisterCompressor(method, func() (util.Compressor, error) {
+		lz4, err := util.GetCompressor("lz4")
+		return refusingCompressor{lz4}, err
+	}, nil))
+	defer util.UnregisterCompressor(method)
+	refused, compressible := bytes.Repeat([]byte("r"), DEFAULT_BLOCK_SIZE), bytes.Repeat([]byte("c"), DEFAULT_BLOCK_SIZE)
+
+	// the refused block is stored uncompressed and the compression method is recorded for it
+	in, out := make(chan *blockBackupJob, 2), make(chan *blockBackupJob, 2)
+	for i, data := range [][]byte{refused, compressible} {
+		in <- &blockBackupJob{offset: int64(i) * DEFAULT_BLOCK_SIZE, checksum: util.GetChecksum(data), data: data}
+	}
+	close(in)
+	var wg sync.WaitGroup
+	errChan := compressBlocks(context.Background(), method, nil, newRateLimiter(0),
+		newCompressionStatsCollector(method), in, out, &wg)
+	wg.Wait()
+	assert.NoError(<-errChan)
+	close(out)
+	jobs := []*blockBackupJob{}
+	for job := range out {
+		jobs = append(jobs, job)
+	}
+	if !assert.Len(jobs, 2) {
+		return
+	}
+	assert.Equal("none", jobs[0].compressionMethod)
+	assert.Equal(refused, jobs[0].compressed.Bytes())
+	assert.Empty(jobs[1].compressionMethod)
+	assert.Less(jobs[1].compressed.Len(), DEFAULT_BLOCK_SIZE)
+
+	deltaBackup := &Backup{
+		Name:              "backup-1",
+		VolumeName:        "pvc-1",
+		CompressionMethod: method,
+		ProcessingBlocks:  &ProcessingBlocks{blocks: map[string][]*BlockMapping{}},
+	}
+	for _, job := range jobs {
+		assert.False(isBlockBeingProcessed(deltaBackup, job.offset, job.checksum))
+		assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", job.checksum), bytes.NewReader(job.compressed.Bytes())))
+		if job.compressionMethod != "" {
+			setBlockCompressionMethod(deltaBackup, job.checksum, job.compressionMethod)
+		}
+		updateBlocksAndProgress(deltaBackup, &progress{totalBlockCounts: 2}, job.checksum, true)
+	}
+	blocks := sortBackupBlocks(deltaBackup.Blocks, 2*DEFAULT_BLOCK_SIZE, DEFAULT_BLOCK_SIZE)
+	assert.Equal([]BlockMapping{
+		{Offset: 0, BlockChecksum: jobs[0].checksum, CompressionMethod: "none"},
+		{Offset: DEFAULT_BLOCK_SIZE, BlockChecksum: jobs[1].checksum},
+	}, blocks)
+	assert.Empty(deltaBackup.ProcessingBlocks.compressionMethods)
+
+	// the backup config requires the feature and keeps the JSON block array
+	deltaBackup.Blocks = blocks
+	cfg := newBackupConfig(deltaBackup, true)
+	assert.Equal([]string{FeatureBlockCompression}, cfg.RequiredFeatures)
+	assert.Equal(blocks, cfg.Blocks)
+	assert.Empty(cfg.BlockIndex)
+	assert.NoError(checkBackupFeatures(&Backup{RequiredFeatures: cfg.RequiredFeatures}))
+
+	// the blocks are read by their compression method
+	for _, block := range blocks {
+		buf := blockBuffers.Get()
+		_, err := readBlock(m, "pvc-1", getBlockCompressionMethod(deltaBackup, block), block, &RestoreBlockProfile{}, buf)
+		assert.NoError(err)
+		assert.Equal(util.GetChecksum(buf.Bytes()), block.BlockChecksum)
+		blockBuffers.Put(buf)
+	}
+
+	// the block deduplicated without the recorded compression method is detected by the header
+	assert.Equal("none", detectBlockCompressionMethod("lz4", refused))
+	assert.Equal("gzip", detectBlockCompressionMethod("gzip", jobs[1].compressed.Bytes()))
+	assert.Equal(method, detectBlockCompressionMethod(method, refused))
+}
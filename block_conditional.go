@@ -0,0 +1,94 @@
+package backupstore
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	conditionalBlockUploadLock    sync.RWMutex
+	conditionalBlockUploadEnabled = true
+	// conditionalBlockUploadUnsupported are the URLs of the backupstores rejecting the conditional writes
+	conditionalBlockUploadUnsupported = map[string]bool{}
+)
+
+// SetConditionalBlockUploadEnabled sets if the blocks are uploaded only if they don't exist in the backupstore,
+// by If-None-Match on S3 and Azure. The blocks are content addressed, so the concurrent backups sharing the
+// blocks don't upload them twice. It's enabled by default. The blocks of the forced full backup are always
+// uploaded, since the existing block cannot be trusted then.
+func SetConditionalBlockUploadEnabled(enabled bool) {
+	conditionalBlockUploadLock.Lock()
+	defer conditionalBlockUploadLock.Unlock()
+	conditionalBlockUploadEnabled = enabled
+}
+
+// IsConditionalBlockUploadEnabled returns if the blocks are uploaded only if they don't exist
+func IsConditionalBlockUploadEnabled() bool {
+	conditionalBlockUploadLock.RLock()
+	defer conditionalBlockUploadLock.RUnlock()
+	return conditionalBlockUploadEnabled
+}
+
+func isConditionalBlockUploadSupported(driver BackupStoreDriver) bool {
+	if _, ok := driver.(BackupStoreConditionalWriter); !ok {
+		return false
+	}
+	conditionalBlockUploadLock.RLock()
+	defer conditionalBlockUploadLock.RUnlock()
+	return conditionalBlockUploadEnabled && !conditionalBlockUploadUnsupported[driver.GetURL()]
+}
+
+func setConditionalBlockUploadUnsupported(driver BackupStoreDriver) {
+	conditionalBlockUploadLock.Lock()
+	defer conditionalBlockUploadLock.Unlock()
+	conditionalBlockUploadUnsupported[driver.GetURL()] = true
+}
+
+// isNotImplementedError checks if the backupstore doesn't implement the request, e.g. the S3-compatible stores
+// without the conditional writes
+func isNotImplementedError(err error) bool {
+	var driverErr *DriverError
+	return errors.As(err, &driverErr) && (driverErr.Code == "NotImplemented" || driverErr.Code == "501")
+}
+
+// writeBlockIfNotExist writes the block only if it doesn't exist. It returns if the block is stored, either by this
+// write or before, so the block needn't be written again. The existing block of a different size is left to be
+// overwritten, since it's a partial write of the backupstores without the atomic writes. If verified, the block is
+// written by WriteVerifiedIfMatch and the checksum of the stored block is returned too, which is empty if the block
+// existed before or the driver doesn't report it.
+func writeBlockIfNotExist(driver BackupStoreDriver, blkFile string, data []byte, verified bool) (string, bool, error) {
+	if !isConditionalBlockUploadSupported(driver) {
+		return "", false, nil
+	}
+
+	var checksum string
+	var err error
+	if verified {
+		writer, ok := driver.(BackupStoreVerifiedConditionalWriter)
+		if !ok {
+			return "", false, nil
+		}
+		checksum, err = writer.WriteVerifiedIfMatch(blkFile, bytes.NewReader(data), "")
+	} else {
+		err = driver.(BackupStoreConditionalWriter).WriteIfMatch(blkFile, bytes.NewReader(data), "")
+	}
+	if IsConflictError(err) {
+		if driver.FileSize(blkFile) != int64(len(data)) {
+			return "", false, nil
+		}
+		log.Debugf("Skipped uploading block %v since it exists", blkFile)
+		return "", true, nil
+	}
+	if isNotImplementedError(err) {
+		log.WithError(err).Warnf("Backupstore %v doesn't support conditional writes, uploading blocks unconditionally",
+			driver.GetURL())
+		setConditionalBlockUploadUnsupported(driver)
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return checksum, true, nil
+}
@@ -0,0 +1,200 @@
+package backupstore
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// conditionalMockStoreDriver supports the conditional writes, or rejects them like the S3-compatible stores
+// without the conditional writes if notImplemented
+type conditionalMockStoreDriver struct {
+	*writableMockStoreDriver
+	notImplemented bool
+	uploads        int
+}
+
+func (m *conditionalMockStoreDriver) FileETag(filePath string) (string, error) {
+	data, err := afero.ReadFile(m.fs, filePath)
+	if err != nil {
+		return "", nil
+	}
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (m *conditionalMockStoreDriver) WriteIfMatch(dst string, rs io.ReadSeeker, etag string) error {
+	if m.notImplemented {
+		return NewDriverError(ErrorClassInvalid, "NotImplemented", errors.New("conditional write not implemented"))
+	}
+	if current, _ := m.FileETag(dst); current != etag {
+		return &ConflictError{Path: dst, ETag: etag}
+	}
+	return m.Write(dst, rs)
+}
+
+func (m *conditionalMockStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	m.uploads++
+	return m.writableMockStoreDriver.Write(dst, rs)
+}
+
+// verifiedConditionalMockStoreDriver supports both the conditional writes and the verified writes, the next
+// corruptions writes store a corrupted block
+type verifiedConditionalMockStoreDriver struct {
+	*conditionalMockStoreDriver
+	corruptions     int
+	conditionalPuts int
+}
+
+func (m *verifiedConditionalMockStoreDriver) WriteVerified(dst string, rs io.ReadSeeker) (string, error) {
+	data, err := io.ReadAll(rs)
+	if err != nil {
+		return "", err
+	}
+	if m.corruptions > 0 {
+		m.corruptions--
+		data = bytes.ToUpper(data)
+	}
+	if err := m.Write(dst, bytes.NewReader(data)); err != nil {
+		return "", err
+	}
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (m *verifiedConditionalMockStoreDriver) WriteVerifiedIfMatch(dst string, rs io.ReadSeeker, etag string) (string, error) {
+	m.conditionalPuts++
+	if m.notImplemented {
+		return "", NewDriverError(ErrorClassInvalid, "NotImplemented", errors.New("conditional write not implemented"))
+	}
+	if current, _ := m.FileETag(dst); current != etag {
+		return "", &ConflictError{Path: dst, ETag: etag}
+	}
+	return m.WriteVerified(dst, rs)
+}
+
+func TestWriteBlockIfNotExist(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &conditionalMockStoreDriver{writableMockStoreDriver: &writableMockStoreDriver{&mockStoreDriver{}}}
+	m.Init()
+	defer m.uninstall()
+	defer SetConditionalBlockUploadEnabled(true)
+
+	data := []byte("compressed block")
+	blkFile := getBlockFilePath(m, "pvc-1", "checksum")
+
+	// the existing block isn't uploaded again
+	assert.NoError(writeBlockVerified(m, blkFile, data, false))
+	assert.NoError(writeBlockVerified(m, blkFile, data, false))
+	assert.Equal(1, m.uploads)
+
+	// the partially written block is overwritten
+	assert.NoError(afero.WriteFile(m.fs, blkFile, data[:4], 0644))
+	assert.NoError(writeBlockVerified(m, blkFile, data, false))
+	assert.Equal(2, m.uploads)
+	stored, err := afero.ReadFile(m.fs, blkFile)
+	assert.NoError(err)
+	assert.Equal(data, stored)
+
+	// the block is uploaded unconditionally if disabled
+	SetConditionalBlockUploadEnabled(false)
+	assert.NoError(writeBlockVerified(m, blkFile, data, false))
+	assert.Equal(3, m.uploads)
+	SetConditionalBlockUploadEnabled(true)
+
+	// the backupstore without the conditional writes falls back to the unconditional writes
+	m.notImplemented = true
+	defer delete(conditionalBlockUploadUnsupported, m.GetURL())
+	assert.NoError(writeBlockVerified(m, blkFile, data, false))
+	assert.Equal(4, m.uploads)
+	assert.False(isConditionalBlockUploadSupported(m))
+}
+
+func TestWriteBlockOverwritesExisting(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &conditionalMockStoreDriver{writableMockStoreDriver: &writableMockStoreDriver{&mockStoreDriver{}}}
+	m.Init()
+	defer m.uninstall()
+
+	data := []byte("compressed block")
+	corrupted := []byte("corrupted block!")
+	blkFile := getBlockFilePath(m, "pvc-1", "checksum")
+
+	// the existing block of the same size is kept by the conditional write
+	assert.NoError(afero.WriteFile(m.fs, blkFile, corrupted, 0644))
+	assert.NoError(writeBlockVerified(m, blkFile, data, false))
+	stored, err := afero.ReadFile(m.fs, blkFile)
+	assert.NoError(err)
+	assert.Equal(corrupted, stored)
+
+	// the forced full backup overwrites it
+	assert.NoError(writeBlockVerified(m, blkFile, data, true))
+	stored, err = afero.ReadFile(m.fs, blkFile)
+	assert.NoError(err)
+	assert.Equal(data, stored)
+
+	// the forced full backup overwrites the verified block without the conditional write
+	verified := &verifiedConditionalMockStoreDriver{conditionalMockStoreDriver: m}
+	assert.NoError(afero.WriteFile(m.fs, blkFile, corrupted, 0644))
+	m.uploads = 0
+	assert.NoError(writeBlockVerified(verified, blkFile, data, true))
+	assert.Equal(1, m.uploads)
+	assert.Equal(0, verified.conditionalPuts)
+	stored, err = afero.ReadFile(m.fs, blkFile)
+	assert.NoError(err)
+	assert.Equal(data, stored)
+}
+
+func TestWriteBlockVerifiedIfNotExist(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &verifiedConditionalMockStoreDriver{
+		conditionalMockStoreDriver: &conditionalMockStoreDriver{
+			writableMockStoreDriver: &writableMockStoreDriver{&mockStoreDriver{}},
+		},
+	}
+	m.Init()
+	defer m.uninstall()
+
+	data := []byte("compressed block")
+	blkFile := getBlockFilePath(m, "pvc-1", "checksum")
+
+	// the verified block is uploaded conditionally, and isn't uploaded again once it exists
+	assert.NoError(writeBlockVerified(m, blkFile, data, false))
+	assert.NoError(writeBlockVerified(m, blkFile, data, false))
+	assert.Equal(1, m.uploads)
+	assert.Equal(2, m.conditionalPuts)
+
+	// the block corrupted by the conditional write is uploaded again unconditionally
+	assert.NoError(m.Remove(blkFile))
+	m.uploads, m.conditionalPuts, m.corruptions = 0, 0, 1
+	assert.NoError(writeBlockVerified(m, blkFile, data, false))
+	assert.Equal(2, m.uploads)
+	assert.Equal(1, m.conditionalPuts)
+	stored, err := afero.ReadFile(m.fs, blkFile)
+	assert.NoError(err)
+	assert.Equal(data, stored)
+
+	// the conditional write counts as the first attempt before the corrupted block is removed
+	assert.NoError(m.Remove(blkFile))
+	m.uploads, m.corruptions = 0, DEFAULT_BLOCK_VERIFY_RETRIES+1
+	assert.True(IsBlockChecksumMismatchError(writeBlockVerified(m, blkFile, data, false)))
+	assert.Equal(DEFAULT_BLOCK_VERIFY_RETRIES+1, m.uploads)
+	assert.False(m.FileExists(blkFile))
+
+	// the backupstore without the conditional writes falls back to the verified writes
+	m.notImplemented = true
+	defer delete(conditionalBlockUploadUnsupported, m.GetURL())
+	m.uploads = 0
+	assert.NoError(writeBlockVerified(m, blkFile, data, false))
+	assert.Equal(1, m.uploads)
+	assert.False(isConditionalBlockUploadSupported(m))
+}
@@ -0,0 +1,126 @@
+package backupstore
+
+import (
+	"hash/crc32"
+)
+
+var blockCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// GetBlockCRC returns the CRC32-C of the block, which is the CRC expected in DeltaBackupConfig.BlockCRCs
+func GetBlockCRC(data []byte) uint32 {
+	return crc32.Checksum(data, blockCRCTable)
+}
+
+// blockCRCIndex maps the CRCs of the blocks backed up at each offset to the checksums of the blocks, so a changed
+// block whose content reverted to the backed up state can be referenced without reading it from the snapshot
+type blockCRCIndex map[int64]map[uint32]string
+
+// loadBlockCRCIndex loads the CRCs recorded by the completed backups of the volume. The CRCs mapping to different
+// checksums at the same offset are collisions, and are dropped from the index.
+func loadBlockCRCIndex(driver BackupStoreDriver, volumeName string) (blockCRCIndex, error) {
+	backupNames, err := getBackupNamesForVolume(driver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	index := blockCRCIndex{}
+	collisions := map[int64]map[uint32]bool{}
+	for _, backupName := range backupNames {
+		backup, err := loadBackup(driver, backupName, volumeName)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to load backup %v for the block CRCs", backupName)
+			continue
+		}
+		if isBackupInProgress(backup) || len(backup.BlockCRCs) == 0 {
+			continue
+		}
+		for _, block := range backup.Blocks {
+			crc, exists := backup.BlockCRCs[block.Offset]
+			if !exists || collisions[block.Offset][crc] {
+				continue
+			}
+			if index[block.Offset] == nil {
+				index[block.Offset] = map[uint32]string{}
+			}
+			checksum, exists := index[block.Offset][crc]
+			if !exists {
+				index[block.Offset][crc] = block.BlockChecksum
+				continue
+			}
+			if checksum != block.BlockChecksum {
+				log.Warnf("Found CRC %v collision of blocks %v and %v at offset %v of volume %v",
+					crc, checksum, block.BlockChecksum, block.Offset, volumeName)
+				delete(index[block.Offset], crc)
+				if collisions[block.Offset] == nil {
+					collisions[block.Offset] = map[uint32]bool{}
+				}
+				collisions[block.Offset][crc] = true
+			}
+		}
+	}
+	return index, nil
+}
+
+// lookup returns the checksum of the block backed up at the offset with the CRC
+func (index blockCRCIndex) lookup(offset int64, crc uint32) (string, bool) {
+	checksum, exists := index[offset][crc]
+	return checksum, exists
+}
+
+// getBlockCRCIndex loads the CRC index of the volume from the first backup target if the caller provides the CRCs
+// of the changed blocks. The blocks are read from the snapshot as usual if the index cannot be loaded.
+func getBlockCRCIndex(targets []*backupTarget, config *DeltaBackupConfig) blockCRCIndex {
+	// the forced full backup reads all the blocks from the snapshot
+	if len(config.BlockCRCs) == 0 || config.ForceFullBackup {
+		return nil
+	}
+	index, err := loadBlockCRCIndex(targets[0].bsDriver, config.Volume.Name)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to load block CRCs of volume %v, reading all the changed blocks", config.Volume.Name)
+		return nil
+	}
+	return index
+}
+
+// prepareRevertedBlock completes the changed block without reading it if its CRC matches a block backed up at the
+// same offset before, and the block still exists in all the backup targets. It returns false if the block needs to
+// be read from the snapshot.
+func prepareRevertedBlock(targets []*backupTarget, config *DeltaBackupConfig, deltaBackup *Backup,
+	offset int64, progress *progress, index blockCRCIndex) bool {
+	crc, exists := config.BlockCRCs[offset]
+	if !exists {
+		return false
+	}
+	checksum, exists := index.lookup(offset, crc)
+	if !exists {
+		return false
+	}
+	// the block is only registered as being processed once it's known to exist, otherwise the block read from
+	// the snapshot may have a different checksum than the one registered
+	for _, target := range getActiveBackupTargets(targets) {
+		if !target.bsDriver.FileExists(getBlockFilePath(target.bsDriver, config.Volume.Name, checksum)) {
+			return false
+		}
+	}
+	prepareBlock(targets, config, deltaBackup, offset, checksum, progress)
+
+	progress.Lock()
+	defer progress.Unlock()
+	progress.revertedBlockCounts++
+	return true
+}
+
+// getBackupBlockCRCs returns the CRCs provided by the caller for the blocks backed up by the backup, the CRCs are
+// saved in the backup config for the later backups to detect the reverted blocks
+func getBackupBlockCRCs(config *DeltaBackupConfig, blocks []BlockMapping) map[int64]uint32 {
+	if len(config.BlockCRCs) == 0 {
+		return nil
+	}
+	crcs := map[int64]uint32{}
+	for _, block := range blocks {
+		if crc, exists := config.BlockCRCs[block.Offset]; exists {
+			crcs[block.Offset] = crc
+		}
+	}
+	return crcs
+}
@@ -0,0 +1,85 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/types"
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestBlockCRCIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	a, b := bytes.Repeat([]byte("a"), DEFAULT_BLOCK_SIZE), bytes.Repeat([]byte("b"), DEFAULT_BLOCK_SIZE)
+	checksumA, checksumB := util.GetChecksum(a), util.GetChecksum(b)
+	assert.NoError(saveVolume(m, &Volume{Name: "pvc-1", Size: 2 * DEFAULT_BLOCK_SIZE}))
+	for _, checksum := range []string{checksumA, checksumB} {
+		assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", checksum), bytes.NewReader([]byte(checksum))))
+	}
+	backups := []*Backup{
+		{
+			Name:      "backup-0",
+			Blocks:    []BlockMapping{{Offset: 0, BlockChecksum: checksumA}, {Offset: DEFAULT_BLOCK_SIZE, BlockChecksum: checksumA}},
+			BlockCRCs: map[int64]uint32{0: GetBlockCRC(a), DEFAULT_BLOCK_SIZE: 1},
+		},
+		{
+			Name:      "backup-1",
+			Blocks:    []BlockMapping{{Offset: 0, BlockChecksum: checksumB}, {Offset: DEFAULT_BLOCK_SIZE, BlockChecksum: checksumB}},
+			BlockCRCs: map[int64]uint32{0: GetBlockCRC(b), DEFAULT_BLOCK_SIZE: 1},
+		},
+	}
+	for _, backup := range backups {
+		backup.VolumeName = "pvc-1"
+		backup.CreatedTime = util.Now()
+		assert.NoError(saveBackup(m, backup))
+	}
+
+	// the CRC mapping to different blocks at the same offset is dropped
+	index, err := loadBlockCRCIndex(m, "pvc-1")
+	assert.NoError(err)
+	checksum, exists := index.lookup(0, GetBlockCRC(a))
+	assert.True(exists)
+	assert.Equal(checksumA, checksum)
+	_, exists = index.lookup(DEFAULT_BLOCK_SIZE, GetBlockCRC(a))
+	assert.False(exists)
+	_, exists = index.lookup(DEFAULT_BLOCK_SIZE, 1)
+	assert.False(exists)
+
+	// the block reverted to the content of backup-0 is completed without reading the snapshot
+	source := &memoryBlockSource{data: append(append([]byte{}, a...), b...)}
+	config := &DeltaBackupConfig{
+		Volume:    &Volume{Name: "pvc-1", Size: 2 * DEFAULT_BLOCK_SIZE},
+		Snapshot:  &Snapshot{Name: "snap-2"},
+		DeltaOps:  newBlockSourceOperations(source, nil),
+		BlockCRCs: map[int64]uint32{0: GetBlockCRC(a), DEFAULT_BLOCK_SIZE: GetBlockCRC(b)},
+	}
+	targets := []*backupTarget{{destURL: mockDriverURL, bsDriver: m}}
+	deltaBackup := &Backup{Name: "backup-2", ProcessingBlocks: &ProcessingBlocks{blocks: map[string][]*BlockMapping{}}}
+	progress := &progress{totalBlockCounts: 2}
+	out := make(chan *blockBackupJob, 2)
+	source.data = nil
+	assert.NoError(backupMapping(context.Background(), targets, config, deltaBackup, DEFAULT_BLOCK_SIZE,
+		types.Mapping{Offset: 0, Size: DEFAULT_BLOCK_SIZE}, progress, index, out))
+	assert.Empty(out)
+	assert.Equal(int64(1), progress.revertedBlockCounts)
+	assert.Equal([]BlockMapping{{Offset: 0, BlockChecksum: checksumA}}, deltaBackup.Blocks)
+
+	// the CRC not found in the index is read from the snapshot
+	source.data = append(append([]byte{}, a...), b...)
+	assert.NoError(backupMapping(context.Background(), targets, config, deltaBackup, DEFAULT_BLOCK_SIZE,
+		types.Mapping{Offset: DEFAULT_BLOCK_SIZE, Size: DEFAULT_BLOCK_SIZE}, progress, index, out))
+	assert.Empty(out)
+	assert.Equal(int64(1), progress.revertedBlockCounts)
+	assert.Len(deltaBackup.Blocks, 2)
+
+	assert.Equal(config.BlockCRCs, getBackupBlockCRCs(config, deltaBackup.Blocks))
+	assert.Nil(getBackupBlockCRCs(&DeltaBackupConfig{}, deltaBackup.Blocks))
+}
@@ -0,0 +1,272 @@
+package backupstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	. "github.com/longhorn/backupstore/logging"
+)
+
+const (
+	// BLOCK_FILTER_FILE is the bloom filter of the block checksums of the volume
+	BLOCK_FILTER_FILE = "blocks.filter"
+
+	// DEFAULT_BLOCK_FILTER_FALSE_POSITIVE_RATE is the false positive rate of the block filter at its capacity
+	DEFAULT_BLOCK_FILTER_FALSE_POSITIVE_RATE = 0.01
+	// DEFAULT_BLOCK_FILTER_MIN_CAPACITY is the minimal number of the blocks the block filter is sized for
+	DEFAULT_BLOCK_FILTER_MIN_CAPACITY = 1024
+
+	blockFilterVersion    = 1
+	blockFilterHeaderSize = 36
+)
+
+var blockFilterMagic = []byte("BSBF")
+
+var (
+	blockFilterLock    sync.RWMutex
+	blockFilterEnabled bool
+)
+
+// SetBlockFilterEnabled enables the bloom filter of the block checksums of the volumes. The filter is loaded at the
+// start of the backup, and the blocks the filter has never seen are uploaded without checking if they exist in the
+// backup target, which saves a Stat call per new block of the incremental backups. The blocks the filter may have
+// seen are still checked, so the false positives and the blocks deleted since don't affect the backup. The blocks
+// written without the filter, e.g. by an older version, are uploaded again once. The filter is built by listing the
+// blocks of the volume if it's missing or full, and saved with the backup. It's disabled by default.
+func SetBlockFilterEnabled(enabled bool) {
+	blockFilterLock.Lock()
+	defer blockFilterLock.Unlock()
+	blockFilterEnabled = enabled
+}
+
+// IsBlockFilterEnabled checks if the bloom filter of the block checksums is enabled
+func IsBlockFilterEnabled() bool {
+	blockFilterLock.RLock()
+	defer blockFilterLock.RUnlock()
+	return blockFilterEnabled
+}
+
+// blockFilter is the bloom filter of the block checksums
+type blockFilter struct {
+	sync.RWMutex
+	// hashes is the number of the bit positions of each checksum
+	hashes uint32
+	// size is the number of the bits
+	size uint64
+	// count is the number of the checksums added, the filter is full once it exceeds the capacity
+	count    uint64
+	capacity uint64
+	bits     []uint64
+}
+
+// newBlockFilter creates the block filter with DEFAULT_BLOCK_FILTER_FALSE_POSITIVE_RATE for the capacity
+func newBlockFilter(capacity uint64) *blockFilter {
+	if capacity < DEFAULT_BLOCK_FILTER_MIN_CAPACITY {
+		capacity = DEFAULT_BLOCK_FILTER_MIN_CAPACITY
+	}
+	size := uint64(math.Ceil(-float64(capacity) * math.Log(DEFAULT_BLOCK_FILTER_FALSE_POSITIVE_RATE) /
+		(math.Ln2 * math.Ln2)))
+	size = (size + 63) / 64 * 64
+	hashes := uint32(math.Round(float64(size) / float64(capacity) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &blockFilter{
+		hashes:   hashes,
+		size:     size,
+		capacity: capacity,
+		bits:     make([]uint64, size/64),
+	}
+}
+
+// getBlockFilterCapacity returns the capacity of the block filter of the volume with the number of the existing
+// blocks, with room for the volume to be rewritten once
+func getBlockFilterCapacity(volume *Volume, blockCount int) uint64 {
+	capacity := 2 * uint64(blockCount)
+	if volumeBlocks := 2 * uint64(volume.Size/DEFAULT_BLOCK_SIZE); volumeBlocks > capacity {
+		capacity = volumeBlocks
+	}
+	return capacity
+}
+
+// blockFilterHashes returns the base hashes of the double hashing, the checksums are uniformly distributed already
+func blockFilterHashes(checksum string) (uint64, uint64) {
+	data, err := hex.DecodeString(checksum)
+	if err != nil || len(data) < 16 {
+		sum := sha256.Sum256([]byte(checksum))
+		data = sum[:]
+	}
+	return binary.LittleEndian.Uint64(data[:8]), binary.LittleEndian.Uint64(data[8:16]) | 1
+}
+
+func (f *blockFilter) add(checksum string) {
+	h1, h2 := blockFilterHashes(checksum)
+	f.Lock()
+	defer f.Unlock()
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		bit := (h1 + i*h2) % f.size
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.count++
+}
+
+// mayContain returns false only if the checksum has never been added
+func (f *blockFilter) mayContain(checksum string) bool {
+	h1, h2 := blockFilterHashes(checksum)
+	f.RLock()
+	defer f.RUnlock()
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		bit := (h1 + i*h2) % f.size
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *blockFilter) full() bool {
+	f.RLock()
+	defer f.RUnlock()
+	return f.count > f.capacity
+}
+
+// merge adds the checksums of the other filter of the same size
+func (f *blockFilter) merge(other *blockFilter) bool {
+	f.Lock()
+	defer f.Unlock()
+	if other.size != f.size || other.hashes != f.hashes {
+		return false
+	}
+	for i := range f.bits {
+		f.bits[i] |= other.bits[i]
+	}
+	if other.count > f.count {
+		f.count = other.count
+	}
+	return true
+}
+
+func (f *blockFilter) MarshalBinary() ([]byte, error) {
+	f.RLock()
+	defer f.RUnlock()
+	buf := bytes.NewBuffer(make([]byte, 0, blockFilterHeaderSize+len(f.bits)*8))
+	buf.Write(blockFilterMagic)
+	for _, v := range []interface{}{uint32(blockFilterVersion), f.hashes, f.size, f.capacity, f.count, f.bits} {
+		if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (f *blockFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < blockFilterHeaderSize || !bytes.Equal(data[:len(blockFilterMagic)], blockFilterMagic) {
+		return fmt.Errorf("invalid block filter header")
+	}
+	version := binary.LittleEndian.Uint32(data[4:8])
+	if version != blockFilterVersion {
+		return fmt.Errorf("unsupported block filter version %v", version)
+	}
+	hashes := binary.LittleEndian.Uint32(data[8:12])
+	size := binary.LittleEndian.Uint64(data[12:20])
+	capacity := binary.LittleEndian.Uint64(data[20:28])
+	count := binary.LittleEndian.Uint64(data[28:36])
+	if hashes == 0 || size == 0 || capacity == 0 || size%64 != 0 || uint64(len(data)-blockFilterHeaderSize) != size/8 {
+		return fmt.Errorf("invalid block filter of %v bits and %v hashes in %v bytes", size, hashes, len(data))
+	}
+
+	bits := make([]uint64, size/64)
+	for i := range bits {
+		bits[i] = binary.LittleEndian.Uint64(data[blockFilterHeaderSize+i*8:])
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.hashes, f.size, f.capacity, f.count, f.bits = hashes, size, capacity, count, bits
+	return nil
+}
+
+func getBlockFilterPath(driver BackupStoreDriver, volumeName string) string {
+	return filepath.Join(getVolumePath(driver, volumeName), BLOCK_FILTER_FILE)
+}
+
+func loadBlockFilter(driver BackupStoreDriver, volumeName string) (*blockFilter, error) {
+	rc, err := driver.Read(getBlockFilterPath(driver, volumeName))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	f := &blockFilter{}
+	if err := f.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// buildBlockFilter builds the block filter of the volume by listing its blocks
+func buildBlockFilter(driver BackupStoreDriver, volume *Volume) (*blockFilter, error) {
+	checksums, err := getBlockNamesForVolume(driver, volume.Name)
+	if err != nil {
+		return nil, err
+	}
+	f := newBlockFilter(getBlockFilterCapacity(volume, len(checksums)))
+	for _, checksum := range checksums {
+		f.add(checksum)
+	}
+	return f, nil
+}
+
+// loadBlockFilterForBackup returns the block filter of the volume for the backup, or nil if the filter is disabled
+// or unavailable, then every block is checked in the backup target
+func loadBlockFilterForBackup(driver BackupStoreDriver, volume *Volume) *blockFilter {
+	if !IsBlockFilterEnabled() {
+		return nil
+	}
+	log := log.WithField(LogFieldVolume, volume.Name)
+
+	if driver.FileExists(getBlockFilterPath(driver, volume.Name)) {
+		f, err := loadBlockFilter(driver, volume.Name)
+		if err == nil && !f.full() {
+			return f
+		}
+		if err != nil {
+			log.WithError(err).Warn("Rebuilding invalid block filter")
+		} else {
+			log.Infof("Rebuilding full block filter of %v blocks", f.count)
+		}
+	}
+	f, err := buildBlockFilter(driver, volume)
+	if err != nil {
+		log.WithError(err).Warn("Failed to build block filter, checking every block in backup target")
+		return nil
+	}
+	return f
+}
+
+// saveBlockFilter saves the block filter of the volume, merged with the filter saved by the other backups since it
+// was loaded. The lost updates of the concurrent saves only cause the blocks to be checked or uploaded again.
+func saveBlockFilter(driver BackupStoreDriver, volumeName string, f *blockFilter) error {
+	if saved, err := loadBlockFilter(driver, volumeName); err == nil {
+		f.merge(saved)
+	}
+	data, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := driver.Write(getBlockFilterPath(driver, volumeName), bytes.NewReader(data)); err != nil {
+		return errors.Wrapf(err, "failed to save block filter of volume %v", volumeName)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package backupstore
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+type statCountingMockStoreDriver struct {
+	*writableMockStoreDriver
+	stats int64
+}
+
+func (m *statCountingMockStoreDriver) FileExists(filePath string) bool {
+	atomic.AddInt64(&m.stats, 1)
+	return m.writableMockStoreDriver.FileExists(filePath)
+}
+
+func TestBlockFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newBlockFilter(0)
+	assert.Equal(uint64(DEFAULT_BLOCK_FILTER_MIN_CAPACITY), f.capacity)
+	checksums := []string{}
+	for i := 0; i < DEFAULT_BLOCK_FILTER_MIN_CAPACITY; i++ {
+		checksums = append(checksums, util.GetChecksum([]byte(fmt.Sprintf("block-%v", i))))
+	}
+	for _, checksum := range checksums {
+		f.add(checksum)
+	}
+	assert.False(f.full())
+
+	// no false negatives, and the false positives are around the rate at the capacity
+	falsePositives := 0
+	for i, checksum := range checksums {
+		assert.True(f.mayContain(checksum))
+		if f.mayContain(util.GetChecksum([]byte(fmt.Sprintf("other-%v", i)))) {
+			falsePositives++
+		}
+	}
+	assert.Less(float64(falsePositives), 4*DEFAULT_BLOCK_FILTER_FALSE_POSITIVE_RATE*DEFAULT_BLOCK_FILTER_MIN_CAPACITY)
+	f.add("checksum-1")
+	assert.True(f.mayContain("checksum-1"))
+
+	data, err := f.MarshalBinary()
+	assert.NoError(err)
+	loaded := &blockFilter{}
+	assert.NoError(loaded.UnmarshalBinary(data))
+	assert.Equal(f.bits, loaded.bits)
+	assert.Equal(f.count, loaded.count)
+	assert.Equal(f.capacity, loaded.capacity)
+	assert.Error(loaded.UnmarshalBinary(data[:len(data)-8]))
+	assert.Error(loaded.UnmarshalBinary([]byte("{}")))
+
+	other := newBlockFilter(0)
+	other.add("checksum-2")
+	assert.True(other.merge(f))
+	assert.True(other.mayContain("checksum-1"))
+	assert.True(other.mayContain("checksum-2"))
+	assert.False(newBlockFilter(10 * DEFAULT_BLOCK_FILTER_MIN_CAPACITY).merge(f))
+}
+
+func TestBlockFilterForBackup(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &statCountingMockStoreDriver{writableMockStoreDriver: &writableMockStoreDriver{&mockStoreDriver{}}}
+	m.Init()
+	defer m.uninstall()
+
+	volume := &Volume{Name: "pvc-1", Size: 4 * DEFAULT_BLOCK_SIZE}
+	existing := util.GetChecksum([]byte("existing"))
+	assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", existing), bytes.NewReader([]byte("existing"))))
+
+	// the filter is disabled by default
+	assert.Nil(loadBlockFilterForBackup(m, volume))
+	SetBlockFilterEnabled(true)
+	defer SetBlockFilterEnabled(false)
+
+	// the missing filter is built from the blocks of the volume
+	f := loadBlockFilterForBackup(m, volume)
+	if !assert.NotNil(f) {
+		return
+	}
+	assert.True(f.mayContain(existing))
+	assert.Equal(uint64(1), f.count)
+
+	config := &DeltaBackupConfig{
+		Volume:   volume,
+		Snapshot: &Snapshot{Name: "snap-1"},
+		DeltaOps: &blockSourceOperations{},
+	}
+	deltaBackup := &Backup{ProcessingBlocks: &ProcessingBlocks{blocks: map[string][]*BlockMapping{}}}
+	target := &backupTarget{destURL: mockDriverURL, bsDriver: m, blockFilter: f}
+	targets := []*backupTarget{target}
+
+	// the new block is uploaded without the check, the existing one is still checked
+	newBlock := util.GetChecksum([]byte("new"))
+	atomic.StoreInt64(&m.stats, 0)
+	assert.Equal(targets, prepareBlock(targets, config, deltaBackup, 0, newBlock, &progress{totalBlockCounts: 2}))
+	assert.Zero(atomic.LoadInt64(&m.stats))
+	assert.Empty(prepareBlock(targets, config, deltaBackup, DEFAULT_BLOCK_SIZE, existing, &progress{totalBlockCounts: 2}))
+	assert.Equal(int64(1), atomic.LoadInt64(&m.stats))
+
+	// the uploaded block is added to the filter
+	job := &blockBackupJob{offset: 0, checksum: newBlock, compressed: bytes.NewBufferString("new"), targets: targets}
+	assert.NoError(uploadBlock(targets, config, deltaBackup, job, &progress{totalBlockCounts: 2}, newBlockQuarantine(1)))
+	assert.True(f.mayContain(newBlock))
+
+	// the saved filter is merged with the one saved by the other backups
+	concurrent := util.GetChecksum([]byte("concurrent"))
+	saved, err := buildBlockFilter(m, volume)
+	assert.NoError(err)
+	saved.add(concurrent)
+	assert.NoError(saveBlockFilter(m, "pvc-1", saved))
+	assert.NoError(saveBlockFilter(m, "pvc-1", f))
+	loaded := loadBlockFilterForBackup(m, volume)
+	if assert.NotNil(loaded) {
+		for _, checksum := range []string{existing, newBlock, concurrent} {
+			assert.True(loaded.mayContain(checksum))
+		}
+	}
+
+	// the full filter is rebuilt
+	f.count = f.capacity + 1
+	m.Remove(getBlockFilePath(m, "pvc-1", existing))
+	assert.NoError(m.Write(getBlockFilterPath(m, "pvc-1"), bytes.NewReader(mustMarshalBlockFilter(t, f))))
+	loaded = loadBlockFilterForBackup(m, volume)
+	if assert.NotNil(loaded) {
+		assert.Equal(uint64(1), loaded.count)
+		assert.True(loaded.mayContain(newBlock))
+	}
+}
+
+func mustMarshalBlockFilter(t *testing.T, f *blockFilter) []byte {
+	data, err := f.MarshalBinary()
+	assert.NoError(t, err)
+	return data
+}
@@ -0,0 +1,178 @@
+package backupstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	// BLOCK_HEADER_SIZE is the size of the header the blocks start with if the block headers are enabled
+	BLOCK_HEADER_SIZE = 16
+
+	BLOCK_HEADER_VERSION = 1
+	// BLOCK_CHECKSUM_SHA512 is the truncated SHA-512 of the uncompressed block, which is the block checksum
+	BLOCK_CHECKSUM_SHA512 = 1
+)
+
+// blockHeaderMagic never starts the data of the builtin compression methods
+var blockHeaderMagic = []byte("LHBK")
+
+// BlockHeader describes the stored block, so the block can be decoded without the backup config, e.g. an orphaned
+// block, and the blocks of a backup can be compressed by different methods.
+//
+// The header is encoded as the magic number "LHBK", the version, the codec ID of the compression method, the
+// checksum algorithm, a reserved byte and the length of the uncompressed block in big endian uint64.
+type BlockHeader struct {
+	Version           uint8
+	CompressionMethod string
+	ChecksumAlgorithm uint8
+	OriginalLength    int64
+}
+
+var (
+	blockHeaderLock    sync.RWMutex
+	blockHeaderEnabled = false
+	// blockCodecIDs are the codec IDs of the compression methods in the block headers
+	blockCodecIDs = map[string]uint8{
+		"none": 0,
+		"gzip": 1,
+		"lz4":  2,
+	}
+)
+
+// SetBlockHeaderEnabled enables the header of the blocks written afterwards. It's disabled by default since the
+// blocks with the header cannot be read by the versions before the header support, the backups created with the
+// header enabled require FeatureBlockHeader. The blocks with the header are detected on reading regardless of the
+// setting.
+func SetBlockHeaderEnabled(enabled bool) {
+	blockHeaderLock.Lock()
+	defer blockHeaderLock.Unlock()
+	blockHeaderEnabled = enabled
+}
+
+func IsBlockHeaderEnabled() bool {
+	blockHeaderLock.RLock()
+	defer blockHeaderLock.RUnlock()
+	return blockHeaderEnabled
+}
+
+// RegisterBlockCodecID assigns the codec ID of the compression method registered by util.RegisterCompressor, so
+// the blocks compressed by it can have the header. The ID must stay the same across the versions, the blocks of
+// the methods without an ID are written without the header.
+func RegisterBlockCodecID(method string, id uint8) error {
+	if _, err := util.GetCompressor(method); err != nil {
+		return err
+	}
+
+	blockHeaderLock.Lock()
+	defer blockHeaderLock.Unlock()
+	for existing, existingID := range blockCodecIDs {
+		if existing == method {
+			return fmt.Errorf("compression method %v already has codec ID %v", method, existingID)
+		}
+		if existingID == id {
+			return fmt.Errorf("codec ID %v is already used by compression method %v", id, existing)
+		}
+	}
+	blockCodecIDs[method] = id
+	return nil
+}
+
+func getBlockCodecID(method string) (uint8, bool) {
+	blockHeaderLock.RLock()
+	defer blockHeaderLock.RUnlock()
+	id, ok := blockCodecIDs[method]
+	return id, ok
+}
+
+func getBlockCodecMethod(id uint8) (string, bool) {
+	blockHeaderLock.RLock()
+	defer blockHeaderLock.RUnlock()
+	for method, methodID := range blockCodecIDs {
+		if methodID == id {
+			return method, true
+		}
+	}
+	return "", false
+}
+
+// writeBlockHeader writes the header of the block compressed by the method to buf if the block headers are
+// enabled, and returns if the header is written. The header is skipped for the methods without a codec ID.
+func writeBlockHeader(buf *bytes.Buffer, method string, length int) bool {
+	if !IsBlockHeaderEnabled() {
+		return false
+	}
+	id, ok := getBlockCodecID(method)
+	if !ok {
+		return false
+	}
+	header := make([]byte, BLOCK_HEADER_SIZE)
+	copy(header, blockHeaderMagic)
+	header[4] = BLOCK_HEADER_VERSION
+	header[5] = id
+	header[6] = BLOCK_CHECKSUM_SHA512
+	binary.BigEndian.PutUint64(header[8:], uint64(length))
+	buf.Write(header)
+	return true
+}
+
+// ParseBlockHeader parses the header of the stored block data, false is returned if the data has no valid header,
+// e.g. the blocks written before the header support
+func ParseBlockHeader(data []byte) (*BlockHeader, bool) {
+	if len(data) < BLOCK_HEADER_SIZE || !bytes.HasPrefix(data, blockHeaderMagic) {
+		return nil, false
+	}
+	header := &BlockHeader{
+		Version:           data[4],
+		ChecksumAlgorithm: data[6],
+		OriginalLength:    int64(binary.BigEndian.Uint64(data[8:])),
+	}
+	if header.Version != BLOCK_HEADER_VERSION || header.ChecksumAlgorithm != BLOCK_CHECKSUM_SHA512 ||
+		header.OriginalLength < 0 {
+		return nil, false
+	}
+	method, ok := getBlockCodecMethod(data[5])
+	if !ok {
+		return nil, false
+	}
+	header.CompressionMethod = method
+	return header, true
+}
+
+// decodeBlockWithHeader decompresses the block data with the header into dst and verifies it
+func decodeBlockWithHeader(header *BlockHeader, data []byte, dst *bytes.Buffer, checksum string) error {
+	if err := util.DecompressAndVerifyInto(header.CompressionMethod, dst, bytes.NewReader(data[BLOCK_HEADER_SIZE:]),
+		checksum); err != nil {
+		return err
+	}
+	if int64(dst.Len()) != header.OriginalLength {
+		return fmt.Errorf("invalid length %v of block, expected %v by block header", dst.Len(), header.OriginalLength)
+	}
+	return nil
+}
+
+// decodeBlock decompresses the stored block data into dst and verifies it, and returns the compression method of
+// the block. The method of the header is used if the block has one, otherwise the method is detected with method
+// as the expected one.
+func decodeBlock(method string, data []byte, dst *bytes.Buffer, checksum string) (string, error) {
+	header, ok := ParseBlockHeader(data)
+	if !ok {
+		method = detectBlockCompressionMethod(method, data)
+		return method, util.DecompressAndVerifyInto(method, dst, bytes.NewReader(data), checksum)
+	}
+	err := decodeBlockWithHeader(header, data, dst, checksum)
+	if err == nil {
+		return header.CompressionMethod, nil
+	}
+	// the block stored uncompressed without the header may start with a valid header by chance
+	dst.Reset()
+	method = detectBlockCompressionMethod(method, data)
+	if util.DecompressAndVerifyInto(method, dst, bytes.NewReader(data), checksum) == nil {
+		return method, nil
+	}
+	return "", err
+}
@@ -0,0 +1,110 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestBlockHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	assert.False(IsBlockHeaderEnabled())
+	SetBlockHeaderEnabled(true)
+	defer SetBlockHeaderEnabled(false)
+
+	assert.Error(RegisterBlockCodecID("lz4", 100))
+	assert.Error(RegisterBlockCodecID("unknown", 100))
+	assert.NoError(util.RegisterCompressor(refusingCompressionMethod, func() (util.Compressor, error) {
+		lz4, err := util.GetCompressor("lz4")
+		return refusingCompressor{lz4}, err
+	}, nil))
+	defer util.UnregisterCompressor(refusingCompressionMethod)
+	assert.Error(RegisterBlockCodecID(refusingCompressionMethod, 2))
+	assert.NoError(RegisterBlockCodecID(refusingCompressionMethod, 100))
+	defer func() {
+		blockHeaderLock.Lock()
+		defer blockHeaderLock.Unlock()
+		delete(blockCodecIDs, refusingCompressionMethod)
+	}()
+
+	// the compressed and the refused blocks are both self-describing
+	refused, compressible := bytes.Repeat([]byte("r"), DEFAULT_BLOCK_SIZE), bytes.Repeat([]byte("c"), DEFAULT_BLOCK_SIZE)
+	in, out := make(chan *blockBackupJob, 2), make(chan *blockBackupJob, 2)
+	for i, data := range [][]byte{refused, compressible} {
+		in <- &blockBackupJob{offset: int64(i) * DEFAULT_BLOCK_SIZE, checksum: util.GetChecksum(data), data: data}
+	}
+	close(in)
+	var wg sync.WaitGroup
+	errChan := compressBlocks(context.Background(), refusingCompressionMethod, nil, newRateLimiter(0),
+		newCompressionStatsCollector(refusingCompressionMethod), in, out, &wg)
+	wg.Wait()
+	assert.NoError(<-errChan)
+	close(out)
+	expectedMethods := []string{"none", refusingCompressionMethod}
+	i := 0
+	for job := range out {
+		header, ok := ParseBlockHeader(job.compressed.Bytes())
+		if !assert.True(ok) {
+			continue
+		}
+		assert.Equal(&BlockHeader{Version: BLOCK_HEADER_VERSION, CompressionMethod: expectedMethods[i],
+			ChecksumAlgorithm: BLOCK_CHECKSUM_SHA512, OriginalLength: DEFAULT_BLOCK_SIZE}, header)
+
+		// the block is decoded by the method of the header regardless of the expected method
+		blkFile := getBlockFilePath(m, "pvc-1", job.checksum)
+		assert.NoError(m.Write(blkFile, bytes.NewReader(job.compressed.Bytes())))
+		buf := blockBuffers.Get()
+		_, err := readBlock(m, "pvc-1", "gzip", BlockMapping{BlockChecksum: job.checksum}, &RestoreBlockProfile{}, buf)
+		assert.NoError(err)
+		assert.Equal(job.checksum, util.GetChecksum(buf.Bytes()))
+		buf.Reset()
+		method, err := decodeBlock("gzip", job.compressed.Bytes(), buf, job.checksum)
+		assert.NoError(err)
+		assert.Equal(expectedMethods[i], method)
+		blockBuffers.Put(buf)
+		assert.NoError(verifyBlockHeader(m, blkFile, "gzip"))
+		i++
+	}
+	assert.Equal(2, i)
+
+	// the blocks written before the header support are detected as usual
+	compressed, err := util.CompressData("lz4", compressible)
+	assert.NoError(err)
+	var legacy bytes.Buffer
+	_, err = legacy.ReadFrom(compressed)
+	assert.NoError(err)
+	_, ok := ParseBlockHeader(legacy.Bytes())
+	assert.False(ok)
+	var buf bytes.Buffer
+	method, err := decodeBlock("lz4", legacy.Bytes(), &buf, util.GetChecksum(compressible))
+	assert.NoError(err)
+	assert.Equal("lz4", method)
+
+	// the uncompressed block without the header may start with a valid header by chance
+	var raw bytes.Buffer
+	writeBlockHeader(&raw, "none", 1)
+	raw.Write(bytes.Repeat([]byte("x"), DEFAULT_BLOCK_SIZE-BLOCK_HEADER_SIZE))
+	_, ok = ParseBlockHeader(raw.Bytes())
+	assert.True(ok)
+	buf.Reset()
+	method, err = decodeBlock("none", raw.Bytes(), &buf, util.GetChecksum(raw.Bytes()))
+	assert.NoError(err)
+	assert.Equal("none", method)
+	assert.Equal(raw.Bytes(), buf.Bytes())
+
+	// the backups referencing the blocks with the header require the feature
+	merged := mergeSnapshotMap(&Backup{Name: "backup-2"}, &Backup{Name: "backup-1",
+		RequiredFeatures: []string{FeatureBlockHeader}})
+	assert.Equal([]string{FeatureBlockHeader}, merged.RequiredFeatures)
+	assert.NoError(checkBackupFeatures(merged))
+}
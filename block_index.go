@@ -0,0 +1,202 @@
+package backupstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"sync"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+// The binary block index replaces the JSON block array of the backup config. It's laid out as
+//
+//	header:  magic "LHBI" | version uint8 | checksum size uint8 | reserved uint16 | record count uint64
+//	records: offset int64 | raw checksum, sorted by offset
+//	trailer: CRC32-C of the header and records
+//
+// All integers are big endian. The fixed-size records allow looking up a block by binary search.
+const (
+	blockIndexMagic      = "LHBI"
+	blockIndexVersion    = 1
+	blockIndexHeaderSize = 16
+	blockIndexCRCSize    = 4
+
+	blockIndexChecksumSize = util.PreservedChecksumLength / 2
+	blockIndexRecordSize   = 8 + blockIndexChecksumSize
+)
+
+var (
+	blockIndexLock    sync.RWMutex
+	blockIndexEnabled bool
+
+	blockIndexCRCTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// SetBackupBlockIndexEnabled sets if the backup configs saved afterwards store the blocks in the binary block index
+// instead of the JSON block array. The backup configs with either format can be read regardless of the setting,
+// but the versions before the block index support cannot restore the backups saved with the block index.
+func SetBackupBlockIndexEnabled(enabled bool) {
+	blockIndexLock.Lock()
+	defer blockIndexLock.Unlock()
+	blockIndexEnabled = enabled
+}
+
+// IsBackupBlockIndexEnabled returns if the binary block index is used for saving the backup configs
+func IsBackupBlockIndexEnabled() bool {
+	blockIndexLock.RLock()
+	defer blockIndexLock.RUnlock()
+	return blockIndexEnabled
+}
+
+// backupConfig is the backup config in the backupstore. Blocks shadows the blocks of the backup,
+// so they can be stored in BlockIndex instead, and RequiredFeatures shadows the features to add the block index.
+type backupConfig struct {
+	*Backup
+	Blocks           []BlockMapping `json:",omitempty"`
+	BlockIndex       []byte         `json:",omitempty"`
+	RequiredFeatures []string       `json:",omitempty"`
+}
+
+func newBackupConfig(backup *Backup, useBlockIndex bool) *backupConfig {
+	cfg := &backupConfig{
+		Backup:           backup,
+		Blocks:           backup.Blocks,
+		RequiredFeatures: removeFeature(backup.RequiredFeatures, FeatureBlockIndex),
+	}
+	if hasBlockCompressionMethods(backup.Blocks) {
+		cfg.RequiredFeatures = addFeature(cfg.RequiredFeatures, FeatureBlockCompression)
+	} else {
+		cfg.RequiredFeatures = removeFeature(cfg.RequiredFeatures, FeatureBlockCompression)
+	}
+	// the block index has no room for the compression methods of the blocks
+	if !useBlockIndex || len(backup.Blocks) == 0 || hasBlockCompressionMethods(backup.Blocks) {
+		return cfg
+	}
+	index, err := encodeBlockIndex(backup.Blocks)
+	if err != nil {
+		log.WithError(err).Warnf("Falling back to JSON block array for backup %v", backup.Name)
+		return cfg
+	}
+	cfg.Blocks = nil
+	cfg.BlockIndex = index
+	cfg.RequiredFeatures = addFeature(cfg.RequiredFeatures, FeatureBlockIndex)
+	return cfg
+}
+
+func (cfg *backupConfig) UnmarshalJSON(data []byte) error {
+	// decode the embedded backup first since the shadowed fields are skipped by the decoder
+	if err := json.Unmarshal(data, cfg.Backup); err != nil {
+		return err
+	}
+	var index struct {
+		BlockIndex []byte
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return err
+	}
+	cfg.BlockIndex = index.BlockIndex
+	if len(cfg.BlockIndex) == 0 {
+		return nil
+	}
+
+	blocks, err := blockIndex(cfg.BlockIndex).decode()
+	if err != nil {
+		return fmt.Errorf("failed to decode block index of backup %v: %v", cfg.Name, err)
+	}
+	cfg.Backup.Blocks = blocks
+	return nil
+}
+
+func encodeBlockIndex(blocks []BlockMapping) ([]byte, error) {
+	sorted := make([]BlockMapping, len(blocks))
+	copy(sorted, blocks)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+
+	buf := bytes.NewBuffer(make([]byte, 0, blockIndexHeaderSize+len(sorted)*blockIndexRecordSize+blockIndexCRCSize))
+	header := make([]byte, blockIndexHeaderSize)
+	copy(header, blockIndexMagic)
+	header[4] = blockIndexVersion
+	header[5] = blockIndexChecksumSize
+	binary.BigEndian.PutUint64(header[8:], uint64(len(sorted)))
+	buf.Write(header)
+
+	record := make([]byte, blockIndexRecordSize)
+	for i, block := range sorted {
+		if i > 0 && block.Offset == sorted[i-1].Offset {
+			return nil, fmt.Errorf("duplicate block offset %v", block.Offset)
+		}
+		checksum, err := hex.DecodeString(block.BlockChecksum)
+		if err != nil || len(checksum) != blockIndexChecksumSize {
+			return nil, fmt.Errorf("invalid checksum %v of block at offset %v", block.BlockChecksum, block.Offset)
+		}
+		binary.BigEndian.PutUint64(record, uint64(block.Offset))
+		copy(record[8:], checksum)
+		buf.Write(record)
+	}
+
+	crc := make([]byte, blockIndexCRCSize)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(buf.Bytes(), blockIndexCRCTable))
+	buf.Write(crc)
+	return buf.Bytes(), nil
+}
+
+type blockIndex []byte
+
+func (index blockIndex) validate() (int, error) {
+	if len(index) < blockIndexHeaderSize+blockIndexCRCSize || string(index[:4]) != blockIndexMagic {
+		return 0, fmt.Errorf("invalid block index header")
+	}
+	if index[4] != blockIndexVersion || index[5] != blockIndexChecksumSize {
+		return 0, fmt.Errorf("unsupported block index version %v checksum size %v", index[4], index[5])
+	}
+	count := binary.BigEndian.Uint64(index[8:])
+	if uint64(len(index)-blockIndexHeaderSize-blockIndexCRCSize) != count*blockIndexRecordSize {
+		return 0, fmt.Errorf("invalid block index size %v for %v records", len(index), count)
+	}
+	body := index[:len(index)-blockIndexCRCSize]
+	if crc32.Checksum(body, blockIndexCRCTable) != binary.BigEndian.Uint32(index[len(body):]) {
+		return 0, fmt.Errorf("block index checksum verification failed")
+	}
+	return int(count), nil
+}
+
+func (index blockIndex) record(i int) BlockMapping {
+	record := index[blockIndexHeaderSize+i*blockIndexRecordSize:]
+	return BlockMapping{
+		Offset:        int64(binary.BigEndian.Uint64(record)),
+		BlockChecksum: hex.EncodeToString(record[8:blockIndexRecordSize]),
+	}
+}
+
+func (index blockIndex) decode() ([]BlockMapping, error) {
+	count, err := index.validate()
+	if err != nil {
+		return nil, err
+	}
+	blocks := make([]BlockMapping, count)
+	for i := range blocks {
+		blocks[i] = index.record(i)
+	}
+	return blocks, nil
+}
+
+func (index blockIndex) offset(i int) int64 {
+	return int64(binary.BigEndian.Uint64(index[blockIndexHeaderSize+i*blockIndexRecordSize:]))
+}
+
+// lookup returns the checksum of the block at the offset by binary search, or false if the block is not mapped.
+// The index should have been validated.
+func (index blockIndex) lookup(count int, offset int64) (string, bool) {
+	i := sort.Search(count, func(i int) bool {
+		return index.offset(i) >= offset
+	})
+	if i == count || index.offset(i) != offset {
+		return "", false
+	}
+	return index.record(i).BlockChecksum, true
+}
@@ -0,0 +1,62 @@
+package backupstore
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestBlockIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	backup := &Backup{Name: "backup-1", VolumeName: "pvc-1"}
+	for _, offset := range []int64{4, 0, 2, 7} {
+		backup.Blocks = append(backup.Blocks, BlockMapping{
+			Offset:        offset * DEFAULT_BLOCK_SIZE,
+			BlockChecksum: util.GetChecksum([]byte{byte(offset)}),
+		})
+	}
+
+	data, err := json.Marshal(newBackupConfig(backup, true))
+	assert.NoError(err)
+	assert.NotContains(string(data), "BlockChecksum")
+
+	loaded := &Backup{}
+	assert.NoError(json.Unmarshal(data, &backupConfig{Backup: loaded}))
+	assert.Equal("backup-1", loaded.Name)
+	assert.Len(loaded.Blocks, 4)
+	for i := 1; i < len(loaded.Blocks); i++ {
+		assert.Less(loaded.Blocks[i-1].Offset, loaded.Blocks[i].Offset)
+	}
+	assert.ElementsMatch(backup.Blocks, loaded.Blocks)
+
+	index, err := encodeBlockIndex(backup.Blocks)
+	assert.NoError(err)
+	count, err := blockIndex(index).validate()
+	assert.NoError(err)
+	checksum, ok := blockIndex(index).lookup(count, 7*DEFAULT_BLOCK_SIZE)
+	assert.True(ok)
+	assert.Equal(util.GetChecksum([]byte{7}), checksum)
+	_, ok = blockIndex(index).lookup(count, 3*DEFAULT_BLOCK_SIZE)
+	assert.False(ok)
+
+	index[blockIndexHeaderSize] ^= 0xff
+	_, err = blockIndex(index).validate()
+	assert.Error(err)
+
+	// the JSON block array is still used if disabled or the checksums cannot be stored in the index
+	data, err = json.Marshal(newBackupConfig(backup, false))
+	assert.NoError(err)
+	assert.Contains(string(data), "BlockChecksum")
+	legacy := &Backup{}
+	assert.NoError(json.Unmarshal(data, &backupConfig{Backup: legacy}))
+	assert.Equal(backup.Blocks, legacy.Blocks)
+
+	backup.Blocks[0].BlockChecksum = "invalid"
+	data, err = json.Marshal(newBackupConfig(backup, true))
+	assert.NoError(err)
+	assert.Contains(string(data), "invalid")
+}
@@ -0,0 +1,120 @@
+package backupstore
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// MAX_BLOCK_LAYOUT_DEPTH is the maximal number of the directory levels of the block layout
+	MAX_BLOCK_LAYOUT_DEPTH = 4
+	// MAX_BLOCK_LAYOUT_WIDTH is the maximal number of the checksum hex digits of each directory level, which
+	// fans out to 16^width directories
+	MAX_BLOCK_LAYOUT_WIDTH = 4
+)
+
+// BlockLayout is the hash partitioned directory layout of the blocks of a backup volume. The blocks are placed in
+// Depth levels of directories named by the next Width hex digits of the block checksum, e.g. Depth 3 and Width 2
+// place the block at blocks/<checksum[0:2]>/<checksum[2:4]>/<checksum[4:6]>/<checksum>.blk. The deeper or wider
+// layouts keep the directories small for the volumes with millions of blocks on the filesystem targets. Depth 0
+// places all the blocks in the blocks directory.
+//
+// The layout is recorded in the volume config when the volume is created and cannot be changed after. The volumes
+// without a block layout place their blocks as the layout of the backup target does.
+type BlockLayout struct {
+	Depth int
+	Width int
+}
+
+// blockPathLayout is the block part of Layout, which the block layout of the volume overrides
+type blockPathLayout interface {
+	BlockPath(checksum string) string
+	BlockPathDepth() int
+}
+
+type volumeBlockLayoutKey struct {
+	url        string
+	volumeName string
+}
+
+var (
+	volumeBlockLayoutsLock sync.RWMutex
+	// volumeBlockLayouts caches the block layouts recorded in the volume configs, nil if the volume has none
+	volumeBlockLayouts = map[volumeBlockLayoutKey]*BlockLayout{}
+)
+
+// Validate checks if the layout is supported
+func (l *BlockLayout) Validate() error {
+	if l.Depth < 0 || l.Depth > MAX_BLOCK_LAYOUT_DEPTH {
+		return fmt.Errorf("invalid block layout depth %v, must be between 0 and %v", l.Depth, MAX_BLOCK_LAYOUT_DEPTH)
+	}
+	if l.Depth > 0 && (l.Width < 1 || l.Width > MAX_BLOCK_LAYOUT_WIDTH) {
+		return fmt.Errorf("invalid block layout width %v, must be between 1 and %v", l.Width, MAX_BLOCK_LAYOUT_WIDTH)
+	}
+	return nil
+}
+
+func (l *BlockLayout) BlockPath(checksum string) string {
+	elems := make([]string, 0, l.Depth+1)
+	for level := 0; level < l.Depth; level++ {
+		elems = append(elems, checksum[level*l.Width:(level+1)*l.Width])
+	}
+	return filepath.Join(append(elems, checksum+BLK_SUFFIX)...)
+}
+
+func (l *BlockLayout) BlockPathDepth() int {
+	return l.Depth
+}
+
+// setVolumeBlockLayout caches the block layout recorded in the volume config loaded from or saved to the backup target
+func setVolumeBlockLayout(driver BackupStoreDriver, v *Volume) {
+	volumeBlockLayoutsLock.Lock()
+	defer volumeBlockLayoutsLock.Unlock()
+	volumeBlockLayouts[volumeBlockLayoutKey{url: driver.GetURL(), volumeName: v.Name}] = v.BlockLayout
+}
+
+func unsetVolumeBlockLayout(driver BackupStoreDriver, volumeName string) {
+	volumeBlockLayoutsLock.Lock()
+	defer volumeBlockLayoutsLock.Unlock()
+	delete(volumeBlockLayouts, volumeBlockLayoutKey{url: driver.GetURL(), volumeName: volumeName})
+}
+
+// getVolumeBlockLayout returns the block layout of the volume. The volume config is read if it hasn't been loaded,
+// and the layout of the backup target is used if the volume has no block layout or doesn't exist yet.
+func getVolumeBlockLayout(driver BackupStoreDriver, volumeName string) blockPathLayout {
+	key := volumeBlockLayoutKey{url: driver.GetURL(), volumeName: volumeName}
+	volumeBlockLayoutsLock.RLock()
+	blockLayout, ok := volumeBlockLayouts[key]
+	volumeBlockLayoutsLock.RUnlock()
+
+	if !ok && volumeExists(driver, volumeName) {
+		v := &Volume{}
+		if err := LoadConfigInBackupStore(driver, getVolumeFilePath(driver, volumeName), v); err != nil {
+			log.WithError(err).Warnf("Failed to load block layout of volume %v", volumeName)
+		} else {
+			v.Name = volumeName
+			setVolumeBlockLayout(driver, v)
+			blockLayout = v.BlockLayout
+		}
+	}
+	if blockLayout != nil {
+		return blockLayout
+	}
+	return getLayout(driver)
+}
+
+// setNewVolumeBlockLayout sets the block layout of the new volume to the default of the backup target if the
+// caller doesn't specify it
+func setNewVolumeBlockLayout(driver BackupStoreDriver, volume *Volume) error {
+	if volume.BlockLayout == nil && getTargetConfig(driver).BlockLayout != nil {
+		blockLayout := *getTargetConfig(driver).BlockLayout
+		volume.BlockLayout = &blockLayout
+	}
+	if volume.BlockLayout != nil {
+		if err := volume.BlockLayout.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package backupstore
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestBlockLayout(t *testing.T) {
+	assert := assert.New(t)
+
+	checksum := util.GetChecksum([]byte("block"))
+	layout := &BlockLayout{Depth: 3, Width: 1}
+	assert.NoError(layout.Validate())
+	assert.Equal(checksum[0:1]+"/"+checksum[1:2]+"/"+checksum[2:3]+"/"+checksum+BLK_SUFFIX, layout.BlockPath(checksum))
+	assert.Equal(3, layout.BlockPathDepth())
+	assert.Equal(checksum+BLK_SUFFIX, (&BlockLayout{}).BlockPath(checksum))
+	assert.Equal(defaultLayout{}.BlockPath(checksum), (&BlockLayout{Depth: 2, Width: 2}).BlockPath(checksum))
+
+	for _, invalid := range []*BlockLayout{{Depth: -1}, {Depth: MAX_BLOCK_LAYOUT_DEPTH + 1, Width: 1}, {Depth: 1},
+		{Depth: 1, Width: MAX_BLOCK_LAYOUT_WIDTH + 1}} {
+		assert.Error(invalid.Validate(), "%+v", *invalid)
+	}
+}
+
+func TestVolumeBlockLayout(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	defer unsetVolumeBlockLayout(m, "pvc-1")
+	defer unsetVolumeBlockLayout(m, "pvc-2")
+
+	// the new volume takes the block layout of the backup target config unless it has one
+	targetConfigsLock.Lock()
+	targetConfigs[m.GetURL()] = &TargetConfig{BlockLayout: &BlockLayout{Depth: 3, Width: 1}}
+	targetConfigsLock.Unlock()
+	defer func() {
+		targetConfigsLock.Lock()
+		delete(targetConfigs, m.GetURL())
+		targetConfigsLock.Unlock()
+	}()
+	volume := &Volume{Name: "pvc-1"}
+	assert.NoError(setNewVolumeBlockLayout(m, volume))
+	assert.Equal(&BlockLayout{Depth: 3, Width: 1}, volume.BlockLayout)
+	other := &Volume{Name: "pvc-2", BlockLayout: &BlockLayout{Depth: 1, Width: 3}}
+	assert.NoError(setNewVolumeBlockLayout(m, other))
+	assert.Equal(&BlockLayout{Depth: 1, Width: 3}, other.BlockLayout)
+	assert.Error(setNewVolumeBlockLayout(m, &Volume{Name: "pvc-3", BlockLayout: &BlockLayout{Depth: 1}}))
+
+	checksum := util.GetChecksum([]byte("block"))
+	assert.Equal(getBlockPath(m, "pvc-1")+defaultLayout{}.BlockPath(checksum), getBlockFilePath(m, "pvc-1", checksum))
+	assert.NoError(saveVolume(m, volume))
+	assert.NoError(saveVolume(m, other))
+	blockPath := getBlockFilePath(m, "pvc-1", checksum)
+	assert.Equal(getBlockPath(m, "pvc-1")+volume.BlockLayout.BlockPath(checksum), blockPath)
+	assert.NoError(m.Write(blockPath, bytes.NewReader([]byte("block"))))
+	assert.NoError(m.Write(getBlockFilePath(m, "pvc-2", checksum), bytes.NewReader([]byte("block"))))
+
+	// the block layout is read from the volume config if it hasn't been loaded
+	unsetVolumeBlockLayout(m, "pvc-1")
+	assert.Equal(blockPath, getBlockFilePath(m, "pvc-1", checksum))
+	for _, volumeName := range []string{"pvc-1", "pvc-2"} {
+		names, err := getBlockNamesForVolume(m, volumeName)
+		assert.NoError(err)
+		assert.Equal([]string{checksum}, names)
+	}
+
+	// the layout of the backup target is used once the volume is removed
+	assert.NoError(m.Remove(getVolumeFilePath(m, "pvc-1")))
+	unsetVolumeBlockLayout(m, "pvc-1")
+	assert.Equal(getBlockPath(m, "pvc-1")+defaultLayout{}.BlockPath(checksum), getBlockFilePath(m, "pvc-1", checksum))
+}
@@ -0,0 +1,181 @@
+package backupstore
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_BLOCK_UPLOAD_RETRY_COUNT = 3
+	// DEFAULT_BLOCK_QUARANTINE_LIMIT limits the failed blocks kept in memory for the retry
+	DEFAULT_BLOCK_QUARANTINE_LIMIT = 64
+
+	maxBlockFailuresInError = 10
+)
+
+var blockUploadRetryInterval = 5 * time.Second
+
+// BlockFailure is a block which cannot be uploaded to the backup target after the retries
+type BlockFailure struct {
+	Offset   int64
+	Checksum string
+	DestURL  string
+	Attempts int
+	Error    string
+}
+
+// BlockUploadError reports the blocks which cannot be uploaded to the backup target
+type BlockUploadError struct {
+	VolumeName   string
+	SnapshotName string
+	Failures     []BlockFailure
+}
+
+func (e *BlockUploadError) Error() string {
+	failures := []string{}
+	for i, f := range e.Failures {
+		if i == maxBlockFailuresInError {
+			failures = append(failures, fmt.Sprintf("and %v more", len(e.Failures)-i))
+			break
+		}
+		failures = append(failures, fmt.Sprintf("offset %v checksum %v after %v attempts: %v",
+			f.Offset, f.Checksum, f.Attempts, f.Error))
+	}
+	return fmt.Sprintf("failed to upload %v blocks of volume %v snapshot %v: %v",
+		len(e.Failures), e.VolumeName, e.SnapshotName, strings.Join(failures, "; "))
+}
+
+// IsBlockUploadError checks if the backup failed by the blocks which cannot be uploaded
+func IsBlockUploadError(err error) bool {
+	var uploadErr *BlockUploadError
+	return errors.As(err, &uploadErr)
+}
+
+// quarantinedBlock is a block which failed to be uploaded to some of the backup targets.
+// The compressed data is kept until the block is retried.
+type quarantinedBlock struct {
+	job      *blockBackupJob
+	failed   map[*backupTarget]error
+	attempts int
+}
+
+// blockQuarantine keeps the failed blocks of a backup pass, so they are retried at the end of the pass
+// instead of failing the backup right away
+type blockQuarantine struct {
+	lock   sync.Mutex
+	limit  int
+	blocks []*quarantinedBlock
+}
+
+func newBlockQuarantine(limit int) *blockQuarantine {
+	return &blockQuarantine{limit: limit}
+}
+
+// add quarantines the block, it returns false if the quarantine is full
+func (q *blockQuarantine) add(job *blockBackupJob, failed map[*backupTarget]error) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.blocks) >= q.limit {
+		return false
+	}
+	q.blocks = append(q.blocks, &quarantinedBlock{
+		job:      job,
+		failed:   failed,
+		attempts: 1,
+	})
+	return true
+}
+
+// release returns the buffers of the quarantined blocks
+func (q *blockQuarantine) release() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, block := range q.blocks {
+		blockBuffers.Put(block.job.compressed)
+		block.job.budget.Release(DEFAULT_BLOCK_SIZE)
+	}
+	q.blocks = nil
+}
+
+// retryQuarantinedBlocks retries uploading the quarantined blocks to the backup targets they failed on.
+// The backup targets still failing are set with BlockUploadError, and the error is returned if no
+// backup target is left.
+func retryQuarantinedBlocks(targets []*backupTarget, config *DeltaBackupConfig,
+	deltaBackup *Backup, progress *progress, quarantine *blockQuarantine) error {
+	defer quarantine.release()
+
+	volume := config.Volume
+	if len(quarantine.blocks) == 0 {
+		return nil
+	}
+	log.Warnf("Retrying %v blocks of volume %v snapshot %v failed to upload",
+		len(quarantine.blocks), volume.Name, config.Snapshot.Name)
+
+	failures := map[*backupTarget][]BlockFailure{}
+	for _, block := range quarantine.blocks {
+		job := block.job
+		for block.attempts < DEFAULT_BLOCK_UPLOAD_RETRY_COUNT && hasRetryableFailures(block.failed) {
+			time.Sleep(time.Duration(block.attempts) * blockUploadRetryInterval)
+			block.attempts++
+			for target, err := range block.failed {
+				if target.failed() {
+					delete(block.failed, target)
+					continue
+				}
+				// the permanent failures are reported without wasting the retries
+				if !IsRetryableError(err) {
+					continue
+				}
+				blkFile := getBlockFilePath(target.bsDriver, volume.Name, job.checksum)
+				if err := target.writeBlock(blkFile, job.compressed.Bytes()); err != nil {
+					block.failed[target] = err
+					continue
+				}
+				target.addNewBlock(job.checksum)
+				delete(block.failed, target)
+			}
+		}
+
+		for target, err := range block.failed {
+			logrus.WithError(err).Errorf("Failed to upload block at offset %v checksum %v to backup target %v after %v attempts",
+				job.offset, job.checksum, target.destURL, block.attempts)
+			failures[target] = append(failures[target], BlockFailure{
+				Offset:   job.offset,
+				Checksum: job.checksum,
+				DestURL:  target.destURL,
+				Attempts: block.attempts,
+				Error:    err.Error(),
+			})
+		}
+	}
+
+	for target, targetFailures := range failures {
+		target.setError(&BlockUploadError{
+			VolumeName:   volume.Name,
+			SnapshotName: config.Snapshot.Name,
+			Failures:     targetFailures,
+		})
+	}
+	if len(getActiveBackupTargets(targets)) == 0 {
+		return targets[0].err
+	}
+
+	for _, block := range quarantine.blocks {
+		completeBlock(targets, config, deltaBackup, progress, block.job.checksum, true)
+	}
+	return nil
+}
+
+func hasRetryableFailures(failed map[*backupTarget]error) bool {
+	for _, err := range failed {
+		if IsRetryableError(err) {
+			return true
+		}
+	}
+	return false
+}
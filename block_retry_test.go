@@ -0,0 +1,85 @@
+package backupstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type flakyMockStoreDriver struct {
+	*writableMockStoreDriver
+	failures map[string]int
+	// err is the injected failure, a retryable one if nil
+	err error
+}
+
+func (m *flakyMockStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	if m.failures[dst] != 0 {
+		m.failures[dst]--
+		if m.err != nil {
+			return m.err
+		}
+		return fmt.Errorf("injected failure")
+	}
+	return m.writableMockStoreDriver.Write(dst, rs)
+}
+
+func TestRetryQuarantinedBlocks(t *testing.T) {
+	assert := assert.New(t)
+
+	interval := blockUploadRetryInterval
+	blockUploadRetryInterval = 0
+	defer func() {
+		blockUploadRetryInterval = interval
+	}()
+
+	m := &flakyMockStoreDriver{writableMockStoreDriver: &writableMockStoreDriver{&mockStoreDriver{}}, failures: map[string]int{}}
+	m.Init()
+	defer m.uninstall()
+
+	config := &DeltaBackupConfig{
+		Volume:   &Volume{Name: "pvc-1"},
+		Snapshot: &Snapshot{Name: "snap-1"},
+		DeltaOps: &blockSourceOperations{},
+	}
+	deltaBackup := &Backup{ProcessingBlocks: &ProcessingBlocks{blocks: map[string][]*BlockMapping{}}}
+	target := &backupTarget{destURL: mockDriverURL, bsDriver: m}
+	quarantine := newBlockQuarantine(1)
+
+	// the first block succeeds on the retry
+	m.failures[getBlockFilePath(m, "pvc-1", "checksum-1")] = 1
+	assert.False(isBlockBeingProcessed(deltaBackup, 0, "checksum-1"))
+	job := &blockBackupJob{offset: 0, checksum: "checksum-1", compressed: bytes.NewBufferString("one"), targets: []*backupTarget{target}}
+	assert.NoError(uploadBlock([]*backupTarget{target}, config, deltaBackup, job, &progress{totalBlockCounts: 2}, quarantine))
+
+	// the quarantine is full, so the second block fails right away
+	m.failures[getBlockFilePath(m, "pvc-1", "checksum-2")] = 1
+	job = &blockBackupJob{offset: DEFAULT_BLOCK_SIZE, checksum: "checksum-2", compressed: bytes.NewBufferString("two"), targets: []*backupTarget{target}}
+	assert.Error(uploadBlock([]*backupTarget{target}, config, deltaBackup, job, &progress{totalBlockCounts: 2}, quarantine))
+
+	assert.NoError(retryQuarantinedBlocks([]*backupTarget{target}, config, deltaBackup, &progress{totalBlockCounts: 2}, quarantine))
+	assert.Len(deltaBackup.Blocks, 1)
+	assert.True(m.FileExists(getBlockFilePath(m, "pvc-1", "checksum-1")))
+
+	// the block still failing after the retries is reported
+	m.failures[getBlockFilePath(m, "pvc-1", "checksum-3")] = DEFAULT_BLOCK_UPLOAD_RETRY_COUNT
+	job = &blockBackupJob{offset: 2 * DEFAULT_BLOCK_SIZE, checksum: "checksum-3", compressed: bytes.NewBufferString("three"), targets: []*backupTarget{target}}
+	assert.NoError(uploadBlock([]*backupTarget{target}, config, deltaBackup, job, &progress{totalBlockCounts: 2}, quarantine))
+	err := retryQuarantinedBlocks([]*backupTarget{target}, config, deltaBackup, &progress{totalBlockCounts: 2}, quarantine)
+	assert.True(IsBlockUploadError(err))
+	assert.Contains(err.Error(), fmt.Sprintf("offset %v checksum checksum-3 after %v attempts", 2*DEFAULT_BLOCK_SIZE, DEFAULT_BLOCK_UPLOAD_RETRY_COUNT))
+
+	// the permanent failure is reported without the retries
+	target = &backupTarget{destURL: mockDriverURL, bsDriver: m}
+	m.err = NewDriverError(ErrorClassPermissionDenied, "AccessDenied", fmt.Errorf("access denied"))
+	m.failures[getBlockFilePath(m, "pvc-1", "checksum-4")] = DEFAULT_BLOCK_UPLOAD_RETRY_COUNT
+	job = &blockBackupJob{offset: 3 * DEFAULT_BLOCK_SIZE, checksum: "checksum-4", compressed: bytes.NewBufferString("four"), targets: []*backupTarget{target}}
+	assert.NoError(uploadBlock([]*backupTarget{target}, config, deltaBackup, job, &progress{totalBlockCounts: 2}, quarantine))
+	err = retryQuarantinedBlocks([]*backupTarget{target}, config, deltaBackup, &progress{totalBlockCounts: 2}, quarantine)
+	assert.True(IsBlockUploadError(err))
+	assert.Contains(err.Error(), "checksum checksum-4 after 1 attempts")
+	assert.Equal(DEFAULT_BLOCK_UPLOAD_RETRY_COUNT-1, m.failures[getBlockFilePath(m, "pvc-1", "checksum-4")])
+}
@@ -0,0 +1,80 @@
+package backupstore
+
+import (
+	"fmt"
+
+	"github.com/longhorn/backupstore/types"
+)
+
+// BlockSource provides the snapshot data of a block device which is not a Longhorn replica, e.g. a LVM thin
+// snapshot, a dm-era device or a ZFS volume, so it can be backed up by the delta block backup.
+type BlockSource interface {
+	// Size returns the size of the block device in bytes
+	Size() int64
+	// ChangedExtents returns the extents changed since the snapshot lastSnapshotName, or all the allocated
+	// extents if lastSnapshotName is empty. The extents should be aligned to the BlockSize of the mappings,
+	// which must be DEFAULT_BLOCK_SIZE.
+	ChangedExtents(lastSnapshotName string) (*types.Mappings, error)
+	// ReadBlockAt reads len(data) bytes of the snapshot at the offset
+	ReadBlockAt(data []byte, offset int64) error
+}
+
+// blockSourceOperations adapts the block source to DeltaBlockBackupOperations. The snapshot checks and the backup
+// status updates are delegated to the optional ops.
+type blockSourceOperations struct {
+	source BlockSource
+	ops    DeltaBlockBackupOperations
+}
+
+func newBlockSourceOperations(source BlockSource, ops DeltaBlockBackupOperations) DeltaBlockBackupOperations {
+	if sourceOps, ok := ops.(*blockSourceOperations); ok {
+		ops = sourceOps.ops
+	}
+	return &blockSourceOperations{
+		source: source,
+		ops:    ops,
+	}
+}
+
+func (o *blockSourceOperations) HasSnapshot(id, volumeID string) bool {
+	if o.ops == nil {
+		// ChangedExtents reports the error if the last snapshot is gone
+		return true
+	}
+	return o.ops.HasSnapshot(id, volumeID)
+}
+
+func (o *blockSourceOperations) CompareSnapshot(id, compareID, volumeID string) (*types.Mappings, error) {
+	mappings, err := o.source.ChangedExtents(compareID)
+	if err != nil {
+		return nil, err
+	}
+	if mappings == nil {
+		return nil, fmt.Errorf("BUG: block source returned no extents for snapshot %v", id)
+	}
+	for _, m := range mappings.Mappings {
+		if m.Offset < 0 || m.Size < 0 || m.Offset+m.Size > o.source.Size() {
+			return nil, fmt.Errorf("invalid extent %+v of snapshot %v beyond the size %v", m, id, o.source.Size())
+		}
+	}
+	return mappings, nil
+}
+
+func (o *blockSourceOperations) OpenSnapshot(id, volumeID string) error {
+	return nil
+}
+
+func (o *blockSourceOperations) ReadSnapshot(id, volumeID string, start int64, data []byte) error {
+	return o.source.ReadBlockAt(data, start)
+}
+
+func (o *blockSourceOperations) CloseSnapshot(id, volumeID string) error {
+	return nil
+}
+
+func (o *blockSourceOperations) UpdateBackupStatus(id, volumeID string, backupState string, backupProgress int, backupURL string, err string) error {
+	if o.ops == nil {
+		return nil
+	}
+	return o.ops.UpdateBackupStatus(id, volumeID, backupState, backupProgress, backupURL, err)
+}
@@ -0,0 +1,57 @@
+package backupstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/types"
+)
+
+type memoryBlockSource struct {
+	data    []byte
+	extents []types.Mapping
+}
+
+func (s *memoryBlockSource) Size() int64 {
+	return int64(len(s.data))
+}
+
+func (s *memoryBlockSource) ChangedExtents(lastSnapshotName string) (*types.Mappings, error) {
+	return &types.Mappings{Mappings: s.extents, BlockSize: DEFAULT_BLOCK_SIZE}, nil
+}
+
+func (s *memoryBlockSource) ReadBlockAt(data []byte, offset int64) error {
+	copy(data, s.data[offset:])
+	return nil
+}
+
+func TestBlockSourceOperations(t *testing.T) {
+	assert := assert.New(t)
+
+	source := &memoryBlockSource{
+		data:    make([]byte, 4*DEFAULT_BLOCK_SIZE),
+		extents: []types.Mapping{{Offset: DEFAULT_BLOCK_SIZE, Size: 2 * DEFAULT_BLOCK_SIZE}},
+	}
+	source.data[DEFAULT_BLOCK_SIZE] = 'a'
+
+	ops := newBlockSourceOperations(source, nil)
+	assert.Same(ops.(*blockSourceOperations).source, newBlockSourceOperations(source, ops).(*blockSourceOperations).source)
+	assert.Nil(newBlockSourceOperations(source, ops).(*blockSourceOperations).ops)
+
+	assert.NoError(ops.OpenSnapshot("snap-2", "vol"))
+	assert.True(ops.HasSnapshot("snap-1", "vol"))
+	assert.NoError(ops.UpdateBackupStatus("snap-2", "vol", string(types.ProgressStateInProgress), 0, "", ""))
+
+	mappings, err := ops.CompareSnapshot("snap-2", "snap-1", "vol")
+	assert.NoError(err)
+	assert.Equal(source.extents, mappings.Mappings)
+
+	block := make([]byte, DEFAULT_BLOCK_SIZE)
+	assert.NoError(ops.ReadSnapshot("snap-2", "vol", DEFAULT_BLOCK_SIZE, block))
+	assert.Equal(byte('a'), block[0])
+
+	source.extents = []types.Mapping{{Offset: 3 * DEFAULT_BLOCK_SIZE, Size: 2 * DEFAULT_BLOCK_SIZE}}
+	_, err = ops.CompareSnapshot("snap-2", "snap-1", "vol")
+	assert.Error(err)
+}
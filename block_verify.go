@@ -0,0 +1,92 @@
+package backupstore
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DEFAULT_BLOCK_VERIFY_RETRIES is the number of times a block is uploaded again after the checksum
+	// returned by the backend doesn't match the block
+	DEFAULT_BLOCK_VERIFY_RETRIES = 3
+)
+
+// BlockChecksumMismatchError is returned when the block stored by the backend doesn't match the uploaded block
+type BlockChecksumMismatchError struct {
+	Path           string
+	Expected       string
+	StoredChecksum string
+}
+
+func (e *BlockChecksumMismatchError) Error() string {
+	return fmt.Sprintf("block %v is stored with MD5 %v instead of %v", e.Path, e.StoredChecksum, e.Expected)
+}
+
+// IsBlockChecksumMismatchError checks if the error is caused by the block corrupted during the upload
+func IsBlockChecksumMismatchError(err error) bool {
+	var mismatchErr *BlockChecksumMismatchError
+	return errors.As(err, &mismatchErr)
+}
+
+// writeBlockVerified writes the block and compares the MD5 checksum of the stored block reported by the driver
+// with the block, the block is uploaded again on mismatch. The corrupted block is removed if the retries are
+// exhausted, so the following backups don't reuse it. The block is written without verification if the driver
+// doesn't report the checksum or in FIPS mode. The block already stored, e.g. by a concurrent backup sharing it,
+// isn't uploaded again if the driver supports the conditional writes, unless overwrite is set by the forced full
+// backup, since the existing block may be corrupted.
+func writeBlockVerified(driver BackupStoreDriver, blkFile string, data []byte, overwrite bool) error {
+	writer, ok := driver.(BackupStoreVerifiedWriter)
+	// MD5 isn't approved in FIPS mode
+	verified := ok && !IsFIPSModeEnabled()
+
+	if !verified {
+		if !overwrite {
+			_, stored, err := writeBlockIfNotExist(driver, blkFile, data, false)
+			if err != nil || stored {
+				return err
+			}
+		}
+		return driver.Write(blkFile, bytes.NewReader(data))
+	}
+
+	sum := md5.Sum(data)
+	expected := hex.EncodeToString(sum[:])
+	var mismatchErr error
+	// the conditional write is the first attempt, the block is overwritten unconditionally on mismatch
+	attempt := 0
+	if !overwrite {
+		storedChecksum, stored, err := writeBlockIfNotExist(driver, blkFile, data, true)
+		if err != nil {
+			return err
+		}
+		if stored {
+			if storedChecksum == "" || strings.EqualFold(storedChecksum, expected) {
+				return nil
+			}
+			mismatchErr = &BlockChecksumMismatchError{Path: blkFile, Expected: expected, StoredChecksum: storedChecksum}
+			log.WithError(mismatchErr).Warnf("Uploading block %v again since it's corrupted", blkFile)
+			attempt++
+		}
+	}
+	for ; attempt <= DEFAULT_BLOCK_VERIFY_RETRIES; attempt++ {
+		storedChecksum, err := writer.WriteVerified(blkFile, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if storedChecksum == "" || strings.EqualFold(storedChecksum, expected) {
+			return nil
+		}
+		mismatchErr = &BlockChecksumMismatchError{Path: blkFile, Expected: expected, StoredChecksum: storedChecksum}
+		log.WithError(mismatchErr).Warnf("Uploading block %v again since it's corrupted", blkFile)
+	}
+
+	if err := driver.Remove(blkFile); err != nil {
+		log.WithError(err).Errorf("Failed to remove corrupted block %v", blkFile)
+	}
+	return mismatchErr
+}
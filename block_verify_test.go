@@ -0,0 +1,63 @@
+package backupstore
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// corruptingMockStoreDriver flips the first byte of the stored data for the first corruptions writes
+type corruptingMockStoreDriver struct {
+	*writableMockStoreDriver
+	corruptions int
+	writes      int
+}
+
+func (m *corruptingMockStoreDriver) WriteVerified(dst string, rs io.ReadSeeker) (string, error) {
+	data, err := io.ReadAll(rs)
+	if err != nil {
+		return "", err
+	}
+	m.writes++
+	if m.writes <= m.corruptions {
+		data = append([]byte{data[0] ^ 0xff}, data[1:]...)
+	}
+	if err := afero.WriteFile(m.fs, dst, data, 0644); err != nil {
+		return "", err
+	}
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (m *corruptingMockStoreDriver) Remove(path string) error {
+	return m.fs.RemoveAll(path)
+}
+
+func TestWriteBlockVerified(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &corruptingMockStoreDriver{writableMockStoreDriver: &writableMockStoreDriver{&mockStoreDriver{}}}
+	m.Init()
+	defer m.uninstall()
+
+	data := []byte("compressed block")
+	blkFile := getBlockFilePath(m, "pvc-1", "checksum")
+
+	// the corrupted uploads are retried
+	m.corruptions = DEFAULT_BLOCK_VERIFY_RETRIES
+	assert.NoError(writeBlockVerified(m, blkFile, data, false))
+	assert.Equal(DEFAULT_BLOCK_VERIFY_RETRIES+1, m.writes)
+	stored, err := afero.ReadFile(m.fs, blkFile)
+	assert.NoError(err)
+	assert.Equal(data, stored)
+
+	// the corrupted block is removed once the retries are exhausted
+	m.writes, m.corruptions = 0, DEFAULT_BLOCK_VERIFY_RETRIES+1
+	err = writeBlockVerified(m, blkFile, data, false)
+	assert.True(IsBlockChecksumMismatchError(err))
+	assert.False(m.FileExists(blkFile))
+}
@@ -0,0 +1,189 @@
+package backupstore
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gammazero/workerpool"
+	"github.com/pkg/errors"
+)
+
+const (
+	// CATALOG_CLOCK_SKEW_TOLERANCE is the allowed clock skew between the nodes creating the backups and the
+	// backupstore. A backup config is never modified before the backup is created, so the configs modified
+	// earlier than the lower bound of the query minus the tolerance are skipped without being downloaded.
+	CATALOG_CLOCK_SKEW_TOLERANCE = 10 * time.Minute
+)
+
+type catalogEntry struct {
+	backup *Backup
+	time   time.Time
+}
+
+// getBackupPointInTime returns the point in time the backup data represents, which is the snapshot creation
+// time, or the backup creation time for the backups without the snapshot creation time
+func getBackupPointInTime(backup *Backup) (time.Time, error) {
+	timestamp := backup.SnapshotCreatedAt
+	if timestamp == "" {
+		timestamp = backup.CreatedTime
+	}
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "cannot parse backup %v time %v", backup.Name, timestamp)
+	}
+	return t, nil
+}
+
+// loadCatalog loads the completed backups of the volume in parallel, sorted by the point in time. The backups
+// whose configs were last modified before notBefore are skipped by the modification time only.
+func loadCatalog(driver BackupStoreDriver, volumeName string, notBefore time.Time) ([]*catalogEntry, error) {
+	backupNames, err := getBackupNamesForVolume(driver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		lock    sync.Mutex
+		entries []*catalogEntry
+	)
+	pool := workerpool.New(runtime.NumCPU() * 16)
+	for _, name := range backupNames {
+		backupName := name
+		pool.Submit(func() {
+			if !notBefore.IsZero() {
+				modificationTime := driver.FileTime(getBackupConfigPath(driver, backupName, volumeName))
+				if !modificationTime.IsZero() && modificationTime.Before(notBefore.Add(-CATALOG_CLOCK_SKEW_TOLERANCE)) {
+					return
+				}
+			}
+
+			backup, err := loadBackup(driver, backupName, volumeName)
+			if err != nil {
+				log.WithError(err).Warnf("Failed to load backup %v of volume %v for catalog", backupName, volumeName)
+				return
+			}
+			if isBackupInProgress(backup) {
+				return
+			}
+			t, err := getBackupPointInTime(backup)
+			if err != nil {
+				log.WithError(err).Warnf("Failed to get point in time of backup %v of volume %v", backupName, volumeName)
+				return
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			entries = append(entries, &catalogEntry{backup: backup, time: t})
+		})
+	}
+	pool.StopWait()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].time.Equal(entries[j].time) {
+			return entries[i].backup.Name < entries[j].backup.Name
+		}
+		return entries[i].time.Before(entries[j].time)
+	})
+	return entries, nil
+}
+
+// ListBackupsBetween returns the backups of the volume representing the points in time between from and to
+// inclusively, sorted from the oldest. A zero from or to leaves the range unbounded on that side.
+func ListBackupsBetween(volumeURL string, from, to time.Time) ([]*BackupInfo, error) {
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return nil, fmt.Errorf("invalid time range from %v to %v", from, to)
+	}
+
+	driver, err := GetBackupStoreDriver(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	_, volumeName, _, err := DecodeBackupURL(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	volume, err := loadVolume(driver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := loadCatalog(driver, volumeName, from)
+	if err != nil {
+		return nil, err
+	}
+	backups := []*BackupInfo{}
+	for _, entry := range entries {
+		if (!from.IsZero() && entry.time.Before(from)) || (!to.IsZero() && entry.time.After(to)) {
+			continue
+		}
+		backups = append(backups, fillFullBackupInfo(entry.backup, volume, driver.GetURL()))
+	}
+	return backups, nil
+}
+
+// FindNearestBackup returns the latest backup of the volume representing a point in time not after t,
+// which is the backup to restore for the state of the volume at t
+func FindNearestBackup(volumeURL string, t time.Time) (*BackupInfo, error) {
+	driver, err := GetBackupStoreDriver(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	_, volumeName, _, err := DecodeBackupURL(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	volume, err := loadVolume(driver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := loadCatalog(driver, volumeName, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !entries[i].time.After(t) {
+			return fillFullBackupInfo(entries[i].backup, volume, driver.GetURL()), nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find backup of volume %v at or before %v", volumeName, t.Format(time.RFC3339))
+}
+
+// FindBackupsBySnapshot returns the completed backups of the volume whose snapshot has the checksum, sorted from
+// the oldest, so the caller can skip backing up the snapshot again, e.g. after the failover of the volume. The
+// aborted and the broken backups are not returned since they cannot be restored.
+func FindBackupsBySnapshot(volumeURL, snapshotChecksum string) ([]*BackupInfo, error) {
+	if snapshotChecksum == "" {
+		return nil, fmt.Errorf("snapshot checksum hasn't been specified")
+	}
+
+	driver, err := GetBackupStoreDriver(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	_, volumeName, _, err := DecodeBackupURL(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	volume, err := loadVolume(driver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := loadCatalog(driver, volumeName, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	backups := []*BackupInfo{}
+	for _, entry := range entries {
+		backup := entry.backup
+		if backup.SnapshotChecksum != snapshotChecksum || isBackupAborted(backup) || backup.Broken != "" {
+			continue
+		}
+		backups = append(backups, fillFullBackupInfo(backup, volume, driver.GetURL()))
+	}
+	return backups, nil
+}
@@ -0,0 +1,105 @@
+package backupstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupCatalog(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	volumeURL := EncodeBackupURL("", "pvc-1", mockDriverURL)
+	assert.NoError(saveVolume(m, &Volume{Name: "pvc-1"}))
+	base := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		assert.NoError(saveBackup(m, &Backup{
+			Name:              fmt.Sprintf("backup-%v", i),
+			VolumeName:        "pvc-1",
+			SnapshotCreatedAt: base.Add(time.Duration(i) * time.Hour).Format(time.RFC3339),
+			CreatedTime:       base.Add(time.Duration(i)*time.Hour + time.Minute).Format(time.RFC3339),
+		}))
+	}
+	// the in progress backup is never listed
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-5", VolumeName: "pvc-1"}))
+
+	backups, err := ListBackupsBetween(volumeURL, base.Add(time.Hour), base.Add(3*time.Hour))
+	assert.NoError(err)
+	assert.Len(backups, 3)
+	for i, backup := range backups {
+		assert.Equal(fmt.Sprintf("backup-%v", i+1), backup.Name)
+		assert.Equal("pvc-1", backup.VolumeName)
+	}
+
+	backups, err = ListBackupsBetween(volumeURL, time.Time{}, base.Add(90*time.Minute))
+	assert.NoError(err)
+	assert.Len(backups, 2)
+
+	_, err = ListBackupsBetween(volumeURL, base.Add(time.Hour), base)
+	assert.Error(err)
+
+	// the backups modified long before the lower bound are skipped without loading them
+	path := getBackupConfigPath(m, "backup-4", "pvc-1")
+	assert.NoError(m.fs.Chtimes(path, base, base))
+	backups, err = ListBackupsBetween(volumeURL, base.Add(time.Hour), time.Time{})
+	assert.NoError(err)
+	assert.Len(backups, 3)
+
+	backup, err := FindNearestBackup(volumeURL, base.Add(150*time.Minute))
+	assert.NoError(err)
+	assert.Equal("backup-2", backup.Name)
+	backup, err = FindNearestBackup(volumeURL, base.Add(48*time.Hour))
+	assert.NoError(err)
+	assert.Equal("backup-4", backup.Name)
+	_, err = FindNearestBackup(volumeURL, base.Add(-time.Second))
+	assert.Error(err)
+}
+
+func TestFindBackupsBySnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	volumeURL := EncodeBackupURL("", "pvc-1", mockDriverURL)
+	assert.NoError(saveVolume(m, &Volume{Name: "pvc-1"}))
+	base := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, checksum := range []string{"checksum-a", "checksum-b", "checksum-a", ""} {
+		assert.NoError(saveBackup(m, &Backup{
+			Name:              fmt.Sprintf("backup-%v", i),
+			VolumeName:        "pvc-1",
+			SnapshotName:      fmt.Sprintf("snap-%v", i),
+			SnapshotChecksum:  checksum,
+			SnapshotCreatedAt: base.Add(time.Duration(i) * time.Hour).Format(time.RFC3339),
+			CreatedTime:       base.Add(time.Duration(i)*time.Hour + time.Minute).Format(time.RFC3339),
+		}))
+	}
+	// the in progress, the aborted and the broken backups of the snapshot are skipped
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-4", VolumeName: "pvc-1", SnapshotChecksum: "checksum-a"}))
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-5", VolumeName: "pvc-1", SnapshotChecksum: "checksum-a",
+		CreatedTime: base.Format(time.RFC3339), Aborted: base.Format(time.RFC3339)}))
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-6", VolumeName: "pvc-1", SnapshotChecksum: "checksum-a",
+		CreatedTime: base.Format(time.RFC3339), Broken: "lost blocks"}))
+
+	backups, err := FindBackupsBySnapshot(volumeURL, "checksum-a")
+	assert.NoError(err)
+	assert.Len(backups, 2)
+	assert.Equal("backup-0", backups[0].Name)
+	assert.Equal("snap-0", backups[0].SnapshotName)
+	assert.Equal("checksum-a", backups[0].SnapshotChecksum)
+	assert.Equal(EncodeBackupURL("backup-0", "pvc-1", mockDriverURL), backups[0].URL)
+	assert.Equal("backup-2", backups[1].Name)
+
+	backups, err = FindBackupsBySnapshot(volumeURL, "checksum-c")
+	assert.NoError(err)
+	assert.Empty(backups)
+	_, err = FindBackupsBySnapshot(volumeURL, "")
+	assert.Error(err)
+}
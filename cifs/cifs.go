@@ -23,7 +23,8 @@ var (
 
 	// Ref: https://github.com/longhorn/backupstore/pull/91
 	defaultMountInterval = 1 * time.Second
-	defaultMountTimeout  = 5 * time.Second
+	// defaultMountTimeout bounds each mount attempt unless it's overridden by util.MountTimeoutParam
+	defaultMountTimeout = time.Minute
 )
 
 type BackupStoreDriver struct {
@@ -31,6 +32,8 @@ type BackupStoreDriver struct {
 	serverPath   string
 	mountDir     string
 	mountOptions []string
+	// mountTimeouts are the timeouts of mounting and cleaning up the share, overridden by the URL params
+	mountTimeouts util.MountTimeouts
 
 	username string
 	password string
@@ -82,9 +85,13 @@ func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
 	} else {
 		b.mountOptions = []string{"soft"}
 	}
+	if b.mountTimeouts, err = util.ParseMountTimeouts(u, util.MountTimeouts{Mount: defaultMountTimeout}); err != nil {
+		return nil, err
+	}
 
 	if err := b.mount(); err != nil {
-		return nil, errors.Wrapf(err, "cannot mount CIFS share %v, options %v", b.serverPath, b.mountOptions)
+		return nil, errors.Wrapf(err, "cannot mount CIFS share %v, options %v, %v", b.serverPath, b.mountOptions,
+			b.mountTimeouts)
 	}
 
 	if _, err := b.List(""); err != nil {
@@ -99,7 +106,7 @@ func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
 func (b *BackupStoreDriver) mount() error {
 	mounter := mount.New("")
 
-	mounted, err := util.EnsureMountPoint(KIND, b.mountDir, mounter, log)
+	mounted, err := util.EnsureMountPointWithTimeout(KIND, b.mountDir, mounter, log, b.mountTimeouts.Cleanup)
 	if err != nil {
 		return err
 	}
@@ -115,7 +122,13 @@ func (b *BackupStoreDriver) mount() error {
 	log.Infof("Mounting CIFS share %v on mount point %v with options %+v", b.destURL, b.mountDir, b.mountOptions)
 
 	return util.MountWithTimeout(mounter, "//"+b.serverPath, b.mountDir, KIND, b.mountOptions, sensitiveMountOptions,
-		defaultMountInterval, defaultMountTimeout)
+		defaultMountInterval, b.mountTimeouts.Mount)
+}
+
+// Remount mounts the share again if the mount point is stale, it's called by the file operations failed with
+// ESTALE or EIO before retrying
+func (b *BackupStoreDriver) Remount() error {
+	return b.mount()
 }
 
 func (b *BackupStoreDriver) Kind() string {
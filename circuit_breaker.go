@@ -0,0 +1,180 @@
+package backupstore
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DEFAULT_CIRCUIT_BREAKER_FAILURE_RATE = 0.5
+	DEFAULT_CIRCUIT_BREAKER_MIN_REQUESTS = 20
+	DEFAULT_CIRCUIT_BREAKER_WINDOW       = time.Minute
+	DEFAULT_CIRCUIT_BREAKER_COOL_DOWN    = 30 * time.Second
+)
+
+// ErrTargetUnhealthy is returned right away for the requests to the backup target while its circuit breaker is
+// open, instead of sending the requests to the target which is failing most of them
+var ErrTargetUnhealthy = errors.New("backup target is unhealthy")
+
+// IsTargetUnhealthyError checks if the request failed fast since the backup target is unhealthy
+func IsTargetUnhealthyError(err error) bool {
+	return errors.Is(err, ErrTargetUnhealthy)
+}
+
+// CircuitBreakerConfig trips the circuit breaker of a backup target once FailureRate of at least MinRequests
+// requests within Window fail by the transient failures, e.g. the timeouts of a dead NFS server. The breaker
+// stays open for CoolDown, then the requests are let through again and the first result closes the breaker or
+// opens it for another CoolDown. The zero values take the defaults.
+type CircuitBreakerConfig struct {
+	// FailureRate is between 0 and 1
+	FailureRate float64
+	MinRequests int
+	Window      time.Duration
+	CoolDown    time.Duration
+}
+
+var circuitBreakerNow = time.Now
+
+var (
+	circuitBreakersLock sync.Mutex
+	// circuitBreakerConfig is nil if the circuit breakers are disabled
+	circuitBreakerConfig *CircuitBreakerConfig
+	// circuitBreakers are the circuit breakers of the backup targets by the URL without the query
+	circuitBreakers = map[string]*circuitBreaker{}
+)
+
+type circuitBreaker struct {
+	windowStart time.Time
+	requests    int
+	failures    int
+	// openUntil is set once the breaker trips, the breaker is half open after it until a result is recorded
+	openUntil time.Time
+}
+
+func (c *CircuitBreakerConfig) withDefaults() (*CircuitBreakerConfig, error) {
+	config := *c
+	if config.FailureRate < 0 || config.FailureRate > 1 {
+		return nil, fmt.Errorf("invalid circuit breaker failure rate %v, must be between 0 and 1", config.FailureRate)
+	}
+	if config.MinRequests < 0 || config.Window < 0 || config.CoolDown < 0 {
+		return nil, fmt.Errorf("invalid negative circuit breaker config %+v", config)
+	}
+	if config.FailureRate == 0 {
+		config.FailureRate = DEFAULT_CIRCUIT_BREAKER_FAILURE_RATE
+	}
+	if config.MinRequests == 0 {
+		config.MinRequests = DEFAULT_CIRCUIT_BREAKER_MIN_REQUESTS
+	}
+	if config.Window == 0 {
+		config.Window = DEFAULT_CIRCUIT_BREAKER_WINDOW
+	}
+	if config.CoolDown == 0 {
+		config.CoolDown = DEFAULT_CIRCUIT_BREAKER_COOL_DOWN
+	}
+	return &config, nil
+}
+
+// SetCircuitBreakerConfig enables the circuit breakers of the backup targets, or disables them if config is nil.
+// They are disabled by default. The state of the breakers is reset.
+func SetCircuitBreakerConfig(config *CircuitBreakerConfig) error {
+	if config != nil {
+		var err error
+		if config, err = config.withDefaults(); err != nil {
+			return err
+		}
+	}
+
+	circuitBreakersLock.Lock()
+	defer circuitBreakersLock.Unlock()
+	circuitBreakerConfig = config
+	circuitBreakers = map[string]*circuitBreaker{}
+	return nil
+}
+
+// getCircuitBreakerKey returns the backup target URL without the backup and the volume in the query, so the
+// backup URLs and the driver URLs of the same backup target share the breaker
+func getCircuitBreakerKey(destURL string) string {
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return destURL
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	return strings.TrimRight(u.String(), "/")
+}
+
+// checkCircuitBreaker returns ErrTargetUnhealthy if the circuit breaker of the backup target is open
+func checkCircuitBreaker(destURL string) error {
+	circuitBreakersLock.Lock()
+	defer circuitBreakersLock.Unlock()
+	if circuitBreakerConfig == nil {
+		return nil
+	}
+	key := getCircuitBreakerKey(destURL)
+	breaker, ok := circuitBreakers[key]
+	if !ok || !circuitBreakerNow().Before(breaker.openUntil) {
+		return nil
+	}
+	return errors.Wrapf(ErrTargetUnhealthy, "%v failed %v of the last %v requests, retry after %v", key,
+		breaker.failures, breaker.requests, breaker.openUntil.Format(time.RFC3339))
+}
+
+// recordCircuitBreakerResult records the result of a request to the backup target. Only the transient failures
+// count, the other failures like the missing files mean the backup target is reachable.
+func recordCircuitBreakerResult(destURL string, err error) {
+	if IsTargetUnhealthyError(err) {
+		return
+	}
+	class := GetErrorClass(err)
+	failed := class == ErrorClassUnavailable || class == ErrorClassUnknown
+
+	circuitBreakersLock.Lock()
+	defer circuitBreakersLock.Unlock()
+	config := circuitBreakerConfig
+	if config == nil {
+		return
+	}
+	key := getCircuitBreakerKey(destURL)
+	breaker, ok := circuitBreakers[key]
+	if !ok {
+		breaker = &circuitBreaker{}
+		circuitBreakers[key] = breaker
+	}
+
+	now := circuitBreakerNow()
+	if !breaker.openUntil.IsZero() {
+		// the requests let through before the breaker tripped are ignored
+		if now.Before(breaker.openUntil) {
+			return
+		}
+		// the first result after the cool-down decides if the backup target has recovered
+		if failed {
+			breaker.openUntil = now.Add(config.CoolDown)
+			log.Warnf("Backup target %v is still unhealthy, failing the requests fast until %v", key,
+				breaker.openUntil.Format(time.RFC3339))
+			return
+		}
+		log.Infof("Backup target %v has recovered", key)
+		*breaker = circuitBreaker{}
+	}
+
+	if now.Sub(breaker.windowStart) > config.Window {
+		breaker.windowStart = now
+		breaker.requests, breaker.failures = 0, 0
+	}
+	breaker.requests++
+	if failed {
+		breaker.failures++
+	}
+	if breaker.requests >= config.MinRequests &&
+		float64(breaker.failures) >= config.FailureRate*float64(breaker.requests) {
+		breaker.openUntil = now.Add(config.CoolDown)
+		log.WithError(err).Warnf("Backup target %v failed %v of the last %v requests, failing the requests fast until %v",
+			key, breaker.failures, breaker.requests, breaker.openUntil.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,89 @@
+package backupstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	circuitBreakerNow = func() time.Time { return now }
+	defer func() { circuitBreakerNow = time.Now }()
+	defer SetCircuitBreakerConfig(nil)
+
+	destURL := "nfs://127.0.0.1:/opt/backupstore"
+	unavailable := NewDriverError(ErrorClassUnavailable, "", fmt.Errorf("connection timed out"))
+	notFound := NewDriverError(ErrorClassNotFound, "", fmt.Errorf("no such file"))
+
+	// disabled by default
+	for i := 0; i < 2*DEFAULT_CIRCUIT_BREAKER_MIN_REQUESTS; i++ {
+		recordCircuitBreakerResult(destURL, unavailable)
+	}
+	assert.NoError(checkCircuitBreaker(destURL))
+
+	assert.Error(SetCircuitBreakerConfig(&CircuitBreakerConfig{FailureRate: 1.5}))
+	assert.Error(SetCircuitBreakerConfig(&CircuitBreakerConfig{CoolDown: -time.Second}))
+	assert.NoError(SetCircuitBreakerConfig(&CircuitBreakerConfig{FailureRate: 0.5, MinRequests: 4, Window: time.Minute,
+		CoolDown: 30 * time.Second}))
+
+	// the failures other than the transient ones don't count
+	for i := 0; i < 4; i++ {
+		recordCircuitBreakerResult(destURL, notFound)
+	}
+	assert.NoError(checkCircuitBreaker(destURL))
+
+	// the window expires before the failure rate is reached
+	now = now.Add(2 * time.Minute)
+	recordCircuitBreakerResult(destURL, nil)
+	recordCircuitBreakerResult(destURL, unavailable)
+	recordCircuitBreakerResult(destURL, nil)
+	assert.NoError(checkCircuitBreaker(destURL))
+	recordCircuitBreakerResult(destURL, unavailable)
+	err := checkCircuitBreaker(destURL)
+	assert.True(IsTargetUnhealthyError(err))
+	// the backup URLs share the breaker of the backup target
+	assert.True(IsTargetUnhealthyError(checkCircuitBreaker(destURL + "/?backup=backup-1&volume=pvc-1")))
+	assert.NoError(checkCircuitBreaker("nfs://127.0.0.2:/opt/backupstore"))
+
+	// the failed probe after the cool-down opens the breaker again
+	now = now.Add(31 * time.Second)
+	assert.NoError(checkCircuitBreaker(destURL))
+	recordCircuitBreakerResult(destURL, unavailable)
+	assert.True(IsTargetUnhealthyError(checkCircuitBreaker(destURL)))
+
+	// the successful probe closes the breaker
+	now = now.Add(31 * time.Second)
+	recordCircuitBreakerResult(destURL, nil)
+	assert.NoError(checkCircuitBreaker(destURL))
+	recordCircuitBreakerResult(destURL, unavailable)
+	assert.NoError(checkCircuitBreaker(destURL))
+}
+
+func TestCircuitBreakerGetDriver(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(SetCircuitBreakerConfig(&CircuitBreakerConfig{MinRequests: 2}))
+	defer SetCircuitBreakerConfig(nil)
+
+	inits := 0
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		inits++
+		return nil, NewDriverError(ErrorClassUnavailable, "", fmt.Errorf("mount timed out"))
+	})
+	defer unregisterDriver(mockDriverName)
+
+	for i := 0; i < 5; i++ {
+		_, err := GetBackupStoreDriver(mockDriverURL)
+		assert.Error(err)
+	}
+	// the dead backup target isn't initialized again once the breaker is open
+	assert.Equal(2, inits)
+	_, err := GetBackupStoreDriver(mockDriverURL)
+	assert.True(IsTargetUnhealthyError(err))
+}
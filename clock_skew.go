@@ -0,0 +1,72 @@
+package backupstore
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// CLOCK_SKEW_WARNING_THRESHOLD is the clock skew between the local clock and the backupstore above which a
+	// warning is logged. The lock expiry of this client is corrected by the detected skew, but the other clients
+	// without the correction may consider the locks expired too early or too late.
+	CLOCK_SKEW_WARNING_THRESHOLD = 30 * time.Second
+	// clockSkewPrecision is the precision of the file times reported by the backupstores
+	clockSkewPrecision = time.Second
+)
+
+var clockSkewNow = time.Now
+
+var (
+	clockSkewsLock sync.RWMutex
+	// clockSkews are the detected clock skews of the backupstores by the driver URL, positive if the backupstore
+	// clock is ahead of the local clock
+	clockSkews = map[string]time.Duration{}
+)
+
+// GetClockSkew returns the clock skew detected between the local clock and the backup target, positive if the
+// backup target clock is ahead. The skew is detected whenever a lock is stored, false is returned before that.
+func GetClockSkew(destURL string) (time.Duration, bool) {
+	clockSkewsLock.RLock()
+	defer clockSkewsLock.RUnlock()
+	skew, ok := clockSkews[destURL]
+	return skew, ok
+}
+
+func getClockSkew(driver BackupStoreDriver) time.Duration {
+	skew, _ := GetClockSkew(driver.GetURL())
+	return skew
+}
+
+// serverNow returns the current time by the backupstore clock in UTC
+func serverNow(driver BackupStoreDriver) time.Time {
+	return clockSkewNow().UTC().Add(getClockSkew(driver))
+}
+
+// detectClockSkew compares the time the backupstore reported for a file written between the local times before
+// and after, and records the skew. The skew within the upload time and the file time precision is ignored.
+func detectClockSkew(driver BackupStoreDriver, file string, before, after, fileTime time.Time) {
+	if fileTime.IsZero() {
+		return
+	}
+
+	var skew time.Duration
+	if fileTime.After(after.Add(clockSkewPrecision)) {
+		skew = fileTime.Sub(after)
+	} else if fileTime.Before(before.Add(-clockSkewPrecision)) {
+		skew = fileTime.Sub(before)
+	}
+
+	abs := skew
+	if abs < 0 {
+		abs = -abs
+	}
+	if abs > CLOCK_SKEW_WARNING_THRESHOLD {
+		log.Warnf("Detected clock skew %v between the local clock and backupstore %v by file %v, "+
+			"the locks of the clients with the skewed clocks may expire prematurely or block the others",
+			skew, driver.GetURL(), file)
+	}
+
+	clockSkewsLock.Lock()
+	defer clockSkewsLock.Unlock()
+	clockSkews[driver.GetURL()] = skew
+}
@@ -0,0 +1,47 @@
+package backupstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClockSkewLockExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	resetClockSkew := func() {
+		clockSkewsLock.Lock()
+		defer clockSkewsLock.Unlock()
+		delete(clockSkews, mockDriverURL)
+	}
+	resetClockSkew()
+	defer resetClockSkew()
+
+	_, ok := GetClockSkew(mockDriverURL)
+	assert.False(ok)
+
+	// the lock isn't expired by the in sync clocks
+	lock, err := New(m, "pvc-1", BACKUP_LOCK)
+	assert.NoError(err)
+	assert.NoError(saveLock(lock))
+	skew, ok := GetClockSkew(mockDriverURL)
+	assert.True(ok)
+	assert.Equal(time.Duration(0), skew)
+	assert.False(lock.isExpired())
+
+	// the local clock is ahead of the backupstore by more than the lock duration
+	clockSkewNow = func() time.Time { return time.Now().Add(5 * time.Minute) }
+	defer func() { clockSkewNow = time.Now }()
+	assert.NoError(saveLock(lock))
+	skew, _ = GetClockSkew(mockDriverURL)
+	assert.InDelta(float64(-5*time.Minute), float64(skew), float64(clockSkewPrecision))
+	assert.False(lock.isExpired())
+
+	// the lock not refreshed for the lock duration by the backupstore clock is still expired
+	lock.serverTime = lock.serverTime.Add(-2 * LOCK_DURATION)
+	assert.True(lock.isExpired())
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/util"
+)
+
+func AuditCmd() cli.Command {
+	return cli.Command{
+		Name:  "audit",
+		Usage: "check the integrity of backups in backupstore: audit <dest>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "volume",
+				Usage: "volume name, audit all volumes if not specified",
+			},
+			cli.BoolFlag{
+				Name:  "skip-orphan-blocks",
+				Usage: "specify if not need to list all blocks for finding orphan blocks",
+			},
+			cli.BoolFlag{
+				Name:  "verify-block-headers",
+				Usage: "specify if need to check the compression header of all referenced blocks",
+			},
+		},
+		Action: cmdAudit,
+	}
+}
+
+func cmdAudit(c *cli.Context) {
+	if err := doAudit(c); err != nil {
+		panic(err)
+	}
+}
+
+func doAudit(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("dest URL")
+	}
+	destURL := c.Args()[0]
+	if destURL == "" {
+		return RequiredMissingError("dest URL")
+	}
+
+	volumeName := c.String("volume")
+	if volumeName != "" && !util.ValidateName(volumeName) {
+		return fmt.Errorf("invalid volume name %v for audit", volumeName)
+	}
+
+	report, err := backupstore.AuditBackupTarget(destURL, &backupstore.AuditOptions{
+		VolumeName:         volumeName,
+		SkipOrphanBlocks:   c.Bool("skip-orphan-blocks"),
+		VerifyBlockHeaders: c.Bool("verify-block-headers"),
+	})
+	if err != nil {
+		return err
+	}
+	data, err := ResponseOutput(report)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
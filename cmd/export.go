@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/nbd"
+)
+
+func ExportBackupCmd() cli.Command {
+	return cli.Command{
+		Name:  "export",
+		Usage: "export a backup as a read-only NBD device: export <backupURL>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "listen",
+				Usage: "address to serve NBD on",
+				Value: "127.0.0.1:10809",
+			},
+			cli.StringFlag{
+				Name:  "export-name",
+				Usage: "NBD export name, the clients can use any name if not specified",
+			},
+			cli.IntFlag{
+				Name:  "cache-blocks",
+				Usage: "number of blocks cached in memory",
+				Value: backupstore.DEFAULT_BACKUP_READER_CACHE_BLOCKS,
+			},
+		},
+		Action: cmdExportBackup,
+	}
+}
+
+func cmdExportBackup(c *cli.Context) {
+	if err := doExportBackup(c); err != nil {
+		panic(err)
+	}
+}
+
+func doExportBackup(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("backup URL")
+	}
+	backupURL := c.Args()[0]
+	if backupURL == "" {
+		return RequiredMissingError("backup URL")
+	}
+
+	reader, err := backupstore.NewBackupReader(backupURL, c.Int("cache-blocks"))
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", c.String("listen"))
+	if err != nil {
+		return fmt.Errorf("failed to listen on %v: %v", c.String("listen"), err)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		l.Close()
+	}()
+
+	logrus.Infof("Serving backup %v as NBD export on %v", backupURL, l.Addr())
+	return nbd.NewServer(c.String("export-name"), reader, reader.Size()).Serve(l)
+}
@@ -13,7 +13,7 @@ func GetConfigMetadataCmd() cli.Command {
 	return cli.Command{
 		Name:        "head",
 		Usage:       "get the config metadata",
-		Description: "this returns the last modification time of a config file for now",
+		Description: "this returns the last modification time and the ETag of a config file",
 		Action:      cmdGetConfigMetadata,
 	}
 }
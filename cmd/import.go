@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/importer"
+	"github.com/longhorn/backupstore/util"
+)
+
+func ImportBackupCmd() cli.Command {
+	return cli.Command{
+		Name:  "import",
+		Usage: "import a restic or kopia snapshot of a volume image as a backup: import <dest>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "tool",
+				Usage: "tool created the snapshot, restic or kopia",
+			},
+			cli.StringFlag{
+				Name:  "repo",
+				Usage: "restic repository",
+			},
+			cli.StringFlag{
+				Name:  "config-file",
+				Usage: "kopia repository config file",
+			},
+			cli.StringFlag{
+				Name:  "snapshot",
+				Usage: "restic snapshot ID or kopia snapshot manifest ID",
+			},
+			cli.StringFlag{
+				Name:  "path",
+				Usage: "path of the volume image file in the restic snapshot",
+			},
+			cli.StringFlag{
+				Name:  "volume",
+				Usage: "volume name",
+			},
+			cli.StringFlag{
+				Name:  "backup-name",
+				Usage: "name of the imported backup",
+			},
+		},
+		Action: cmdImportBackup,
+	}
+}
+
+func cmdImportBackup(c *cli.Context) {
+	if err := doImportBackup(c); err != nil {
+		panic(err)
+	}
+}
+
+func doImportBackup(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("dest URL")
+	}
+	destURL := c.Args()[0]
+	if destURL == "" {
+		return RequiredMissingError("dest URL")
+	}
+
+	volumeName := c.String("volume")
+	if !util.ValidateName(volumeName) {
+		return fmt.Errorf("invalid volume name %v for import", volumeName)
+	}
+	backupName := c.String("backup-name")
+	if !util.ValidateName(backupName) {
+		return fmt.Errorf("invalid backup name %v for import", backupName)
+	}
+	snapshotID := c.String("snapshot")
+	if snapshotID == "" {
+		return RequiredMissingError("snapshot")
+	}
+
+	var source importer.Source
+	switch c.String("tool") {
+	case "restic":
+		source = &importer.ResticSource{
+			Repository: c.String("repo"),
+			SnapshotID: snapshotID,
+			Path:       c.String("path"),
+		}
+	case "kopia":
+		source = &importer.KopiaSource{
+			ConfigFile: c.String("config-file"),
+			SnapshotID: snapshotID,
+		}
+	default:
+		return fmt.Errorf("unsupported import tool %v", c.String("tool"))
+	}
+
+	backupURL, err := importer.ImportBackup(&importer.Config{
+		BackupName: backupName,
+		Volume: &backupstore.Volume{
+			Name:              volumeName,
+			CompressionMethod: "lz4",
+			CreatedTime:       util.Now(),
+		},
+		Snapshot: &backupstore.Snapshot{
+			Name:        backupName,
+			CreatedTime: util.Now(),
+		},
+		DestURL:         destURL,
+		ConcurrentLimit: 4,
+		Source:          source,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(backupURL)
+	return nil
+}
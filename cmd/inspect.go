@@ -11,8 +11,14 @@ import (
 
 func InspectVolumeCmd() cli.Command {
 	return cli.Command{
-		Name:   "inspect-volume",
-		Usage:  "inspect a volume: inspect <volume>",
+		Name:  "inspect-volume",
+		Usage: "inspect a volume: inspect <volume>",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "chain",
+				Usage: "specify if need to inspect the backup chain and the size trends, which reads all the backups of the volume",
+			},
+		},
 		Action: cmdInspectVolume,
 	}
 }
@@ -35,7 +41,11 @@ func doInspectVolume(c *cli.Context) error {
 	}
 	destURL = util.UnescapeURL(destURL)
 
-	info, err := backupstore.InspectVolume(destURL)
+	inspect := backupstore.InspectVolume
+	if c.Bool("chain") {
+		inspect = backupstore.InspectVolumeChain
+	}
+	info, err := inspect(destURL)
 	if err != nil {
 		return err
 	}
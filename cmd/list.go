@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"runtime"
 	"runtime/debug"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -27,6 +28,18 @@ func BackupListCmd() cli.Command {
 				Name:  "volume-only",
 				Usage: "specify if only need list volumes without backup details",
 			},
+			cli.StringFlag{
+				Name:  "volume-prefix",
+				Usage: "only list the volumes with the name prefix",
+			},
+			cli.StringFlag{
+				Name:  "volume-pattern",
+				Usage: "only list the volumes with the names matching the glob pattern, e.g. pvc-*",
+			},
+			cli.StringSliceFlag{
+				Name:  "volume-label",
+				Usage: "only list the volumes with the label in the form of key=value, can be specified multiple times",
+			},
 		},
 		Action: cmdBackupList,
 	}
@@ -56,7 +69,16 @@ func doBackupList(c *cli.Context) error {
 
 	volumeOnly := c.Bool("volume-only")
 
-	list, err := backupstore.List(volumeName, destURL, volumeOnly)
+	var list map[string]*backupstore.VolumeInfo
+	filter, err := getVolumeFilter(c)
+	if err != nil {
+		return err
+	}
+	if filter != nil && volumeName == "" {
+		list, err = backupstore.ListWithFilter(destURL, filter, volumeOnly)
+	} else {
+		list, err = backupstore.List(volumeName, destURL, volumeOnly)
+	}
 	if err != nil {
 		return err
 	}
@@ -68,6 +90,28 @@ func doBackupList(c *cli.Context) error {
 	return nil
 }
 
+// getVolumeFilter returns the volume filter from the flags, or nil if no filter is specified
+func getVolumeFilter(c *cli.Context) (*backupstore.VolumeFilter, error) {
+	filter := &backupstore.VolumeFilter{
+		NamePrefix:  c.String("volume-prefix"),
+		NamePattern: c.String("volume-pattern"),
+	}
+	for _, label := range c.StringSlice("volume-label") {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid volume label %v, must be in the form of key=value", label)
+		}
+		if filter.Labels == nil {
+			filter.Labels = map[string]string{}
+		}
+		filter.Labels[parts[0]] = parts[1]
+	}
+	if filter.NamePrefix == "" && filter.NamePattern == "" && len(filter.Labels) == 0 {
+		return nil, nil
+	}
+	return filter, nil
+}
+
 type ErrorResponse struct {
 	Error string
 }
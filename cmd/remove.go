@@ -18,6 +18,14 @@ func BackupRemoveCmd() cli.Command {
 				Name:  "volume",
 				Usage: "volume name, only use it when deleting a backup volume with dest URL",
 			},
+			cli.BoolFlag{
+				Name:  "force",
+				Usage: "specify if need to delete the deletion protected backups",
+			},
+			cli.BoolFlag{
+				Name:  "skip-trash",
+				Usage: "specify if need to delete the backups immediately instead of moving them to the trash",
+			},
 		},
 		Action: cmdBackupRemove,
 	}
@@ -38,19 +46,57 @@ func doBackupRemove(c *cli.Context) error {
 		return RequiredMissingError("dest URL")
 	}
 
+	opts := &backupstore.DeleteOptions{
+		Force:     c.Bool("force"),
+		SkipTrash: c.Bool("skip-trash"),
+	}
+
 	volumeName := c.String("volume")
 	if volumeName == "" {
 		destURL = util.UnescapeURL(destURL)
-		if err := backupstore.DeleteDeltaBlockBackup(destURL); err != nil {
+		if err := backupstore.DeleteDeltaBlockBackupWithOptions(destURL, opts); err != nil {
 			return err
 		}
 	} else {
 		if !util.ValidateName(volumeName) {
 			return fmt.Errorf("invalid backup volume name %v", volumeName)
 		}
-		if err := backupstore.DeleteBackupVolume(volumeName, destURL); err != nil {
+		if err := backupstore.DeleteBackupVolumeWithOptions(volumeName, destURL, opts); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+func BackupProtectCmd() cli.Command {
+	return cli.Command{
+		Name:  "protect",
+		Usage: "enable or disable the deletion protection of a backup: protect <backup>",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "disable",
+				Usage: "specify if need to disable the deletion protection",
+			},
+		},
+		Action: cmdBackupProtect,
+	}
+}
+
+func cmdBackupProtect(c *cli.Context) {
+	if err := doBackupProtect(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupProtect(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("backup URL")
+	}
+	backupURL := c.Args()[0]
+	if backupURL == "" {
+		return RequiredMissingError("backup URL")
+	}
+	backupURL = util.UnescapeURL(backupURL)
+
+	return backupstore.SetBackupDeletionProtection(backupURL, !c.Bool("disable"))
+}
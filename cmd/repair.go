@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/util"
+)
+
+func RepairBackupChainCmd() cli.Command {
+	return cli.Command{
+		Name:  "repair",
+		Usage: "repair the backups of a volume referencing missing blocks: repair <volume>",
+		Flags: []cli.Flag{
+			cli.StringSliceFlag{
+				Name:  "source",
+				Usage: "another backup target holding the backups of the volume to copy the missing blocks from",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "specify if only need to report the broken backups without repairing them",
+			},
+		},
+		Action: cmdRepairBackupChain,
+	}
+}
+
+func cmdRepairBackupChain(c *cli.Context) {
+	if err := doRepairBackupChain(c); err != nil {
+		panic(err)
+	}
+}
+
+func doRepairBackupChain(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("dest URL")
+	}
+	destURL := c.Args()[0]
+	if destURL == "" {
+		return RequiredMissingError("dest URL")
+	}
+	destURL = util.UnescapeURL(destURL)
+
+	report, err := backupstore.RepairBackupChainWithOptions(destURL, &backupstore.BackupChainRepairOptions{
+		SourceURLs: c.StringSlice("source"),
+		DryRun:     c.Bool("dry-run"),
+	})
+	if err != nil {
+		return err
+	}
+	data, err := ResponseOutput(report)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	"github.com/longhorn/backupstore/httpfile"
+)
+
+func ServeHTTPFileCmd() cli.Command {
+	return cli.Command{
+		Name:  "serve",
+		Usage: "serve a directory as the backup target of the http driver: serve <directory>",
+		Description: "this serves the files of the directory to the http:// or https:// backup targets, " +
+			"it has no authentication and is only meant for testing",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "listen",
+				Usage: "address to serve HTTP on",
+				Value: "127.0.0.1:8080",
+			},
+			cli.StringFlag{
+				Name:  "tls-cert",
+				Usage: "certificate file to serve HTTPS with, requires tls-key",
+			},
+			cli.StringFlag{
+				Name:  "tls-key",
+				Usage: "private key file of the certificate to serve HTTPS with",
+			},
+		},
+		Action: cmdServeHTTPFile,
+	}
+}
+
+func cmdServeHTTPFile(c *cli.Context) {
+	if err := doServeHTTPFile(c); err != nil {
+		panic(err)
+	}
+}
+
+func doServeHTTPFile(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return RequiredMissingError("directory")
+	}
+	root := c.Args()[0]
+	if root == "" {
+		return RequiredMissingError("directory")
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return fmt.Errorf("%v is not a directory", root)
+	}
+	certFile, keyFile := c.String("tls-cert"), c.String("tls-key")
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("tls-cert and tls-key must be specified together")
+	}
+
+	l, err := net.Listen("tcp", c.String("listen"))
+	if err != nil {
+		return fmt.Errorf("failed to listen on %v: %v", c.String("listen"), err)
+	}
+
+	server := &http.Server{Handler: httpfile.NewServer(root)}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		server.Close()
+	}()
+
+	if certFile != "" {
+		logrus.Infof("Serving directory %v as backup target on https://%v", root, l.Addr())
+		err = server.ServeTLS(l, certFile, keyFile)
+	} else {
+		logrus.Infof("Serving directory %v as backup target on http://%v", root, l.Addr())
+		err = server.Serve(l)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
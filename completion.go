@@ -0,0 +1,163 @@
+package backupstore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/longhorn/backupstore/types"
+	"github.com/longhorn/backupstore/util"
+)
+
+// BackupSummary is the result of the delta block backup passed to DeltaBackupConfig.OnComplete
+type BackupSummary struct {
+	VolumeName   string
+	SnapshotName string
+	BackupName   string
+	// BackupURL is the URL of the backup in the first backup target it succeeded in
+	BackupURL     string
+	IsIncremental bool
+
+	// State is ProgressStateComplete if the backup succeeded in any backup target, or ProgressStateError
+	State    types.ProgressState
+	Error    error
+	Progress int
+	Duration time.Duration
+
+	// Targets are the results of the backup in each backup target
+	Targets []BackupTargetStatus
+	// ChangedBlockCount is the number of the blocks changed since the last backup
+	ChangedBlockCount int64
+	CompressionStats  *CompressionStats
+	// PeakMemoryBytes is the high-water mark of the bytes of the block buffers held by the backup
+	PeakMemoryBytes int64
+}
+
+// RestoreSummary is the result of the delta block restore passed to DeltaRestoreConfig.OnComplete
+type RestoreSummary struct {
+	VolumeName     string
+	BackupName     string
+	BackupURL      string
+	LastBackupName string `json:",omitempty"`
+	Filename       string
+
+	// State is ProgressStateComplete if the restore succeeded, or ProgressStateError
+	State    types.ProgressState
+	Error    error
+	Progress int
+	Duration time.Duration
+
+	// Profile is the time breakdown of the restore, nil if the restore failed before restoring any block
+	Profile *RestoreProfile `json:",omitempty"`
+	// PeakMemoryBytes is the high-water mark of the bytes of the block buffers held by the restore
+	PeakMemoryBytes int64
+}
+
+// backupCompletion calls the completion hook of the backup exactly once, no matter if the backup fails before
+// or after the backup goroutine starts
+type backupCompletion struct {
+	once    sync.Once
+	hook    func(summary *BackupSummary)
+	start   time.Time
+	summary BackupSummary
+	// budget is the memory budget of the backup, the high-water mark is reported in the summary
+	budget *util.MemoryBudget
+}
+
+func newBackupCompletion(config *DeltaBackupConfig) *backupCompletion {
+	c := &backupCompletion{
+		hook:  config.OnComplete,
+		start: time.Now(),
+	}
+	if config.Volume != nil {
+		c.summary.VolumeName = config.Volume.Name
+	}
+	if config.Snapshot != nil {
+		c.summary.SnapshotName = config.Snapshot.Name
+	}
+	return c
+}
+
+// complete calls the hook with the summary, the calls after the first one are ignored
+func (c *backupCompletion) complete(progress int, err error) {
+	c.once.Do(func() {
+		if c.hook == nil {
+			return
+		}
+		summary := c.summary
+		summary.State = types.ProgressStateComplete
+		summary.Progress = progress
+		if err != nil {
+			summary.State = types.ProgressStateError
+			summary.Error = err
+		}
+		summary.PeakMemoryBytes = c.budget.PeakBytes()
+		summary.Duration = time.Since(c.start)
+		c.hook(&summary)
+	})
+}
+
+// handlePanic completes the backup with the panic as the error before propagating the panic, it must be deferred
+func (c *backupCompletion) handlePanic() {
+	if r := recover(); r != nil {
+		c.complete(0, fmt.Errorf("panic during backup: %v", r))
+		panic(r)
+	}
+}
+
+// restoreCompletion calls the completion hook of the restore exactly once
+type restoreCompletion struct {
+	once    sync.Once
+	hook    func(summary *RestoreSummary)
+	start   time.Time
+	summary RestoreSummary
+	// budget is the memory budget of the restore, the high-water mark is reported in the summary
+	budget *util.MemoryBudget
+}
+
+func newRestoreCompletion(config *DeltaRestoreConfig) *restoreCompletion {
+	c := &restoreCompletion{
+		hook:  config.OnComplete,
+		start: time.Now(),
+		summary: RestoreSummary{
+			BackupURL:      config.BackupURL,
+			LastBackupName: config.LastBackupName,
+			Filename:       config.Filename,
+		},
+	}
+	if backupName, volumeName, _, err := DecodeBackupURL(config.BackupURL); err == nil {
+		c.summary.BackupName = backupName
+		c.summary.VolumeName = volumeName
+	}
+	return c
+}
+
+// complete calls the hook with the summary, the calls after the first one are ignored
+func (c *restoreCompletion) complete(progress int, profiler *restoreProfiler, err error) {
+	c.once.Do(func() {
+		if c.hook == nil {
+			return
+		}
+		summary := c.summary
+		summary.State = types.ProgressStateComplete
+		summary.Progress = progress
+		if err != nil {
+			summary.State = types.ProgressStateError
+			summary.Error = err
+		}
+		if profiler != nil {
+			summary.Profile = profiler.finish()
+		}
+		summary.PeakMemoryBytes = c.budget.PeakBytes()
+		summary.Duration = time.Since(c.start)
+		c.hook(&summary)
+	})
+}
+
+// handlePanic completes the restore with the panic as the error before propagating the panic, it must be deferred
+func (c *restoreCompletion) handlePanic() {
+	if r := recover(); r != nil {
+		c.complete(0, nil, fmt.Errorf("panic during restore: %v", r))
+		panic(r)
+	}
+}
@@ -0,0 +1,97 @@
+package backupstore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/types"
+)
+
+func TestBackupCompletion(t *testing.T) {
+	assert := assert.New(t)
+
+	summaries := []*BackupSummary{}
+	config := &DeltaBackupConfig{
+		Volume:     &Volume{Name: "pvc-1"},
+		Snapshot:   &Snapshot{Name: "snap-1"},
+		OnComplete: func(summary *BackupSummary) { summaries = append(summaries, summary) },
+	}
+
+	// the hook is called once, the later results are ignored
+	completion := newBackupCompletion(config)
+	completion.summary.BackupName = "backup-1"
+	completion.complete(PROGRESS_PERCENTAGE_BACKUP_TOTAL, nil)
+	completion.complete(0, fmt.Errorf("injected failure"))
+	assert.Len(summaries, 1)
+	assert.Equal("pvc-1", summaries[0].VolumeName)
+	assert.Equal("snap-1", summaries[0].SnapshotName)
+	assert.Equal("backup-1", summaries[0].BackupName)
+	assert.Equal(types.ProgressStateComplete, summaries[0].State)
+	assert.Equal(PROGRESS_PERCENTAGE_BACKUP_TOTAL, summaries[0].Progress)
+	assert.NoError(summaries[0].Error)
+
+	// the panic completes the backup before it's propagated
+	summaries = nil
+	completion = newBackupCompletion(config)
+	assert.Panics(func() {
+		defer completion.handlePanic()
+		panic("injected panic")
+	})
+	assert.Len(summaries, 1)
+	assert.Equal(types.ProgressStateError, summaries[0].State)
+	assert.Contains(summaries[0].Error.Error(), "injected panic")
+
+	// the backup failing before it starts completes with the error
+	summaries = nil
+	config.DeltaOps = nil
+	_, err := CreateDeltaBlockBackup("backup-2", config)
+	assert.Error(err)
+	assert.Len(summaries, 1)
+	assert.Equal(types.ProgressStateError, summaries[0].State)
+	assert.Equal("backup-2", summaries[0].BackupName)
+	assert.Equal(err, summaries[0].Error)
+
+	// no hook is fine
+	config.OnComplete = nil
+	newBackupCompletion(config).complete(0, nil)
+}
+
+func TestRestoreCompletion(t *testing.T) {
+	assert := assert.New(t)
+
+	summaries := []*RestoreSummary{}
+	config := &DeltaRestoreConfig{
+		BackupURL:  EncodeBackupURL("backup-1", "pvc-1", "mock://target"),
+		Filename:   "/dev/null",
+		OnComplete: func(summary *RestoreSummary) { summaries = append(summaries, summary) },
+	}
+
+	completion := newRestoreCompletion(config)
+	profiler := newRestoreProfiler()
+	profiler.recordZeroFill(0, 0, DEFAULT_BLOCK_SIZE)
+	completion.complete(PROGRESS_PERCENTAGE_BACKUP_TOTAL, profiler, nil)
+	completion.complete(0, nil, fmt.Errorf("injected failure"))
+	assert.Len(summaries, 1)
+	assert.Equal("backup-1", summaries[0].BackupName)
+	assert.Equal("pvc-1", summaries[0].VolumeName)
+	assert.Equal("/dev/null", summaries[0].Filename)
+	assert.Equal(types.ProgressStateComplete, summaries[0].State)
+	assert.Equal(PROGRESS_PERCENTAGE_BACKUP_TOTAL, summaries[0].Progress)
+	assert.Equal(int64(DEFAULT_BLOCK_SIZE), summaries[0].Profile.SkippedZeroBytes)
+
+	// the restores failing before they start complete with the error
+	for _, restore := range []func(*DeltaRestoreConfig) error{
+		RestoreDeltaBlockBackup,
+		RestoreDeltaBlockBackupIncrementally,
+	} {
+		summaries = nil
+		err := restore(config)
+		assert.Error(err)
+		assert.Len(summaries, 1)
+		assert.Equal(types.ProgressStateError, summaries[0].State)
+		assert.Equal(err, summaries[0].Error)
+		assert.Nil(summaries[0].Profile)
+	}
+}
@@ -0,0 +1,267 @@
+package backupstore
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	COMPRESSION_CONFIG_FILE = "compression.cfg"
+
+	// DEFAULT_COMPRESSION_BENCHMARK_PROBE_SIZE is the size of the object written to measure the upload throughput
+	DEFAULT_COMPRESSION_BENCHMARK_PROBE_SIZE = 4 * 1024 * 1024
+	// COMPRESSION_BENCHMARK_TOLERANCE is the fraction of the best backup throughput within which the method with
+	// the better compression ratio is preferred, since it saves the storage for nearly no time
+	COMPRESSION_BENCHMARK_TOLERANCE = 0.1
+
+	compressionBenchmarkProbeFile  = "compression-benchmark.probe"
+	compressionBenchmarkSampleSeed = 1
+)
+
+// CompressionBenchmark is the result of a compression method on the sample blocks
+type CompressionBenchmark struct {
+	Method string
+	// Ratio is the compressed size divided by the original size
+	Ratio float64
+	// CPUTime is the time compressing the sample blocks by a single core
+	CPUTime time.Duration
+	// Throughput is the estimated backup throughput in original bytes per second, limited by either the
+	// compression on all the cores or the upload of the compressed data
+	Throughput float64
+}
+
+// CompressionRecommendation is the compression method recommended for the new volumes of a backup target,
+// which is recorded in the backup target once benchmarked
+type CompressionRecommendation struct {
+	Method string
+	// UploadThroughput is the measured upload throughput of the backup target in bytes per second
+	UploadThroughput float64
+	Benchmarks       []CompressionBenchmark
+	BenchmarkedAt    string
+}
+
+type CompressionBenchmarkOptions struct {
+	// Samples are the blocks compressed by the benchmark, synthetic blocks of mixed compressibility are used
+	// if not specified
+	Samples [][]byte
+	// Concurrency is the number of the blocks compressed in parallel by the backup, defaults to GOMAXPROCS
+	Concurrency int
+	// Force reruns the benchmark even if a recommendation has been recorded
+	Force bool
+}
+
+// GetCompressionRecommendation returns the compression method recommendation recorded in the backup target,
+// or nil if the backup target hasn't been benchmarked
+func GetCompressionRecommendation(destURL string) (*CompressionRecommendation, error) {
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	return loadCompressionRecommendation(driver)
+}
+
+// RecommendCompressionMethod benchmarks the compression methods against the upload throughput of the backup
+// target and records the recommended method in the backup target. The recorded recommendation is returned
+// without benchmarking again unless opts.Force is set.
+func RecommendCompressionMethod(destURL string, opts *CompressionBenchmarkOptions) (*CompressionRecommendation, error) {
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	return recommendCompressionMethod(driver, opts)
+}
+
+func getCompressionConfigPath() string {
+	return filepath.Join(backupstoreBase, COMPRESSION_CONFIG_FILE)
+}
+
+func loadCompressionRecommendation(driver BackupStoreDriver) (*CompressionRecommendation, error) {
+	if !driver.FileExists(getCompressionConfigPath()) {
+		return nil, nil
+	}
+	recommendation := &CompressionRecommendation{}
+	if err := LoadConfigInBackupStore(driver, getCompressionConfigPath(), recommendation); err != nil {
+		return nil, errors.Wrapf(err, "failed to load compression recommendation of %v", driver.GetURL())
+	}
+	return recommendation, nil
+}
+
+func recommendCompressionMethod(driver BackupStoreDriver, opts *CompressionBenchmarkOptions) (*CompressionRecommendation, error) {
+	if opts == nil {
+		opts = &CompressionBenchmarkOptions{}
+	}
+	if !opts.Force {
+		recommendation, err := loadCompressionRecommendation(driver)
+		if err != nil || recommendation != nil {
+			return recommendation, err
+		}
+	}
+
+	samples := opts.Samples
+	if len(samples) == 0 {
+		samples = generateCompressionSamples(DEFAULT_BLOCK_SIZE)
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+
+	throughput, err := measureUploadThroughput(driver, DEFAULT_COMPRESSION_BENCHMARK_PROBE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	recommendation := &CompressionRecommendation{
+		UploadThroughput: throughput,
+		BenchmarkedAt:    util.Now(),
+	}
+	for _, method := range util.GetCompressionMethods() {
+		benchmark, err := benchmarkCompressionMethod(method, samples, concurrency, throughput)
+		if err != nil {
+			return nil, err
+		}
+		recommendation.Benchmarks = append(recommendation.Benchmarks, *benchmark)
+	}
+	recommendation.Method = selectCompressionMethod(recommendation.Benchmarks)
+
+	if err := SaveConfigInBackupStore(driver, getCompressionConfigPath(), recommendation); err != nil {
+		return nil, err
+	}
+	log.Infof("Recommended compression method %v for backup target %v with upload throughput %.0f bytes/s",
+		recommendation.Method, driver.GetURL(), throughput)
+	return recommendation, nil
+}
+
+// getRecommendedCompressionMethod returns the recommended compression method of the backup target, and
+// benchmarks the backup target on its first use. LEGACY_COMPRESSION_METHOD is used if the benchmark fails.
+func getRecommendedCompressionMethod(driver BackupStoreDriver) string {
+	recommendation, err := recommendCompressionMethod(driver, nil)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to recommend compression method for backup target %v, using %v",
+			driver.GetURL(), LEGACY_COMPRESSION_METHOD)
+		return LEGACY_COMPRESSION_METHOD
+	}
+	return recommendation.Method
+}
+
+// measureUploadThroughput writes a probe object of incompressible data, and removes it afterwards
+func measureUploadThroughput(driver BackupStoreDriver, size int) (float64, error) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(time.Now().UnixNano())).Read(data)
+
+	probe := filepath.Join(backupstoreBase, compressionBenchmarkProbeFile)
+	start := time.Now()
+	if err := driver.Write(probe, bytes.NewReader(data)); err != nil {
+		return 0, errors.Wrapf(err, "failed to write compression benchmark probe to %v", driver.GetURL())
+	}
+	elapsed := time.Since(start)
+	if err := driver.Remove(probe); err != nil {
+		log.WithError(err).Warnf("Failed to remove compression benchmark probe %v", probe)
+	}
+
+	if elapsed <= 0 {
+		elapsed = time.Nanosecond
+	}
+	return float64(size) / elapsed.Seconds(), nil
+}
+
+// benchmarkCompressionMethod compresses the samples and estimates the backup throughput of the method, which is
+// the lower of the compression throughput on all the cores and the upload throughput of the original data
+func benchmarkCompressionMethod(method string, samples [][]byte, concurrency int, uploadThroughput float64) (*CompressionBenchmark, error) {
+	compressor, err := util.GetCompressor(method)
+	if err != nil {
+		return nil, err
+	}
+
+	var original, compressed int64
+	var buffer bytes.Buffer
+	start := time.Now()
+	for _, sample := range samples {
+		buffer.Reset()
+		if err := compressor.Compress(&buffer, bytes.NewReader(sample)); err != nil {
+			return nil, errors.Wrapf(err, "failed to compress sample by %v", method)
+		}
+		original += int64(len(sample))
+		compressed += int64(buffer.Len())
+	}
+	cpuTime := time.Since(start)
+	if original == 0 {
+		return nil, fmt.Errorf("invalid empty compression benchmark samples")
+	}
+
+	benchmark := &CompressionBenchmark{
+		Method:  method,
+		Ratio:   float64(compressed) / float64(original),
+		CPUTime: cpuTime,
+	}
+	uploadTime := float64(compressed) / uploadThroughput
+	compressTime := cpuTime.Seconds() / float64(concurrency)
+	if compressTime > uploadTime {
+		uploadTime = compressTime
+	}
+	if uploadTime <= 0 {
+		uploadTime = float64(time.Nanosecond) / float64(time.Second)
+	}
+	benchmark.Throughput = float64(original) / uploadTime
+	return benchmark, nil
+}
+
+// selectCompressionMethod picks the method with the best compression ratio among the ones with the backup
+// throughput within COMPRESSION_BENCHMARK_TOLERANCE of the best
+func selectCompressionMethod(benchmarks []CompressionBenchmark) string {
+	best := 0.0
+	for _, b := range benchmarks {
+		if b.Throughput > best {
+			best = b.Throughput
+		}
+	}
+
+	method := ""
+	ratio := 0.0
+	for _, b := range benchmarks {
+		if b.Throughput < best*(1-COMPRESSION_BENCHMARK_TOLERANCE) {
+			continue
+		}
+		if method == "" || b.Ratio < ratio {
+			method = b.Method
+			ratio = b.Ratio
+		}
+	}
+	return method
+}
+
+// generateCompressionSamples generates blocks resembling the volume data: random data as the compressed or
+// encrypted files, text, sparse metadata, and low entropy binary data
+func generateCompressionSamples(blockSize int) [][]byte {
+	r := rand.New(rand.NewSource(compressionBenchmarkSampleSeed))
+
+	random := make([]byte, blockSize)
+	r.Read(random)
+
+	words := []string{"backup", "volume", "snapshot", "block", "the", "of", "data", "error", "info", "2006-01-02"}
+	var text bytes.Buffer
+	for text.Len() < blockSize {
+		text.WriteString(words[r.Intn(len(words))])
+		text.WriteByte(" \n"[r.Intn(2)])
+	}
+
+	sparse := make([]byte, blockSize)
+	for i := 0; i < blockSize; i += 4096 {
+		r.Read(sparse[i : i+256])
+	}
+
+	binary := make([]byte, blockSize)
+	for i := range binary {
+		binary[i] = byte(r.Intn(16))
+	}
+
+	return [][]byte{random, text.Bytes()[:blockSize], sparse, binary}
+}
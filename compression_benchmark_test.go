@@ -0,0 +1,77 @@
+package backupstore
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectCompressionMethod(t *testing.T) {
+	assert := assert.New(t)
+
+	// the upload bound target prefers the better ratio
+	assert.Equal("gzip", selectCompressionMethod([]CompressionBenchmark{
+		{Method: "gzip", Ratio: 0.3, Throughput: 95},
+		{Method: "lz4", Ratio: 0.5, Throughput: 100},
+		{Method: "none", Ratio: 1, Throughput: 50},
+	}))
+	// the CPU bound target prefers the faster method
+	assert.Equal("lz4", selectCompressionMethod([]CompressionBenchmark{
+		{Method: "gzip", Ratio: 0.3, Throughput: 40},
+		{Method: "lz4", Ratio: 0.5, Throughput: 100},
+		{Method: "none", Ratio: 1, Throughput: 98},
+	}))
+}
+
+func TestBenchmarkCompressionMethod(t *testing.T) {
+	assert := assert.New(t)
+
+	samples := [][]byte{bytes.Repeat([]byte("block"), 4096)}
+	benchmark, err := benchmarkCompressionMethod("none", samples, 1, 1024)
+	assert.NoError(err)
+	assert.Equal(1.0, benchmark.Ratio)
+	assert.InDelta(1024, benchmark.Throughput, 1)
+
+	benchmark, err = benchmarkCompressionMethod("gzip", samples, 1, 1024)
+	assert.NoError(err)
+	assert.Less(benchmark.Ratio, 0.1)
+	assert.Greater(benchmark.Throughput, 1024.0)
+
+	_, err = benchmarkCompressionMethod("unknown", samples, 1, 1024)
+	assert.Error(err)
+	_, err = benchmarkCompressionMethod("gzip", nil, 1, 1024)
+	assert.Error(err)
+
+	for _, sample := range generateCompressionSamples(DEFAULT_BLOCK_SIZE) {
+		assert.Len(sample, DEFAULT_BLOCK_SIZE)
+	}
+}
+
+func TestRecommendCompressionMethod(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	recommendation, err := loadCompressionRecommendation(m)
+	assert.NoError(err)
+	assert.Nil(recommendation)
+
+	recommendation, err = recommendCompressionMethod(m, &CompressionBenchmarkOptions{
+		Samples: [][]byte{bytes.Repeat([]byte("block"), 4096)},
+	})
+	assert.NoError(err)
+	assert.Contains([]string{"gzip", "lz4", "none"}, recommendation.Method)
+	assert.Len(recommendation.Benchmarks, 3)
+	assert.Greater(recommendation.UploadThroughput, 0.0)
+	assert.False(m.FileExists(filepath.Join(backupstoreBase, compressionBenchmarkProbeFile)))
+
+	// the recorded recommendation is reused
+	recorded, err := recommendCompressionMethod(m, nil)
+	assert.NoError(err)
+	assert.Equal(recommendation.BenchmarkedAt, recorded.BenchmarkedAt)
+	assert.Equal(recommendation.Method, getRecommendedCompressionMethod(m))
+}
@@ -0,0 +1,80 @@
+package backupstore
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+// compressionCanarySeed makes the canary block the same on every run, so a failure can be reproduced
+const compressionCanarySeed = 0x62737463
+
+// CompressionCanaryError is returned when the canary block doesn't survive the compression round trip at the start
+// of the backup, e.g. the codec has a regression or the memory is corrupted
+type CompressionCanaryError struct {
+	CompressionMethod string
+	Reason            string
+}
+
+func (e *CompressionCanaryError) Error() string {
+	return fmt.Sprintf("compression method %v failed the canary block check: %v", e.CompressionMethod, e.Reason)
+}
+
+// IsCompressionCanaryError checks if the error is caused by the compression method failing the canary block check
+func IsCompressionCanaryError(err error) bool {
+	var canaryErr *CompressionCanaryError
+	return errors.As(err, &canaryErr)
+}
+
+var (
+	compressionCanaryOnce sync.Once
+	compressionCanary     []byte
+)
+
+// getCompressionCanary returns the canary block, which is half random data and half repeated text, so both the
+// literals and the matches of the codecs are exercised
+func getCompressionCanary() []byte {
+	compressionCanaryOnce.Do(func() {
+		compressionCanary = make([]byte, DEFAULT_BLOCK_SIZE)
+		half := DEFAULT_BLOCK_SIZE / 2
+		rand.New(rand.NewSource(compressionCanarySeed)).Read(compressionCanary[:half])
+		pattern := []byte("backupstore compression canary block ")
+		for i := half; i < DEFAULT_BLOCK_SIZE; i += len(pattern) {
+			copy(compressionCanary[i:], pattern)
+		}
+	})
+	return compressionCanary
+}
+
+// checkCompressionCanary compresses the canary block with the compression method the same way as the blocks of the
+// backup, and decompresses and verifies it the same way as the restore does, so the backup fails before any block
+// is uploaded if the round trip doesn't reproduce the block
+func checkCompressionCanary(compressionMethod string) error {
+	if compressionMethod == "none" {
+		return nil
+	}
+	compressor, err := util.GetCompressor(compressionMethod)
+	if err != nil {
+		return err
+	}
+
+	canary := getCompressionCanary()
+	checksum := util.GetChecksum(canary)
+	var compressed bytes.Buffer
+	if err := compressor.Compress(&compressed, bytes.NewReader(canary)); err != nil {
+		// the blocks refused by the compressor are stored uncompressed
+		if errors.Is(err, util.ErrIncompressible) {
+			return nil
+		}
+		return &CompressionCanaryError{CompressionMethod: compressionMethod, Reason: err.Error()}
+	}
+	if _, err := util.DecompressAndVerify(compressionMethod, &compressed, checksum); err != nil {
+		return &CompressionCanaryError{CompressionMethod: compressionMethod, Reason: err.Error()}
+	}
+	return nil
+}
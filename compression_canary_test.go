@@ -0,0 +1,56 @@
+package backupstore
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+// truncatingCompressor loses the last byte of the data on decompression
+type truncatingCompressor struct {
+	compressErr error
+}
+
+func (c *truncatingCompressor) Compress(dst io.Writer, src io.Reader) error {
+	if c.compressErr != nil {
+		return c.compressErr
+	}
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+func (c *truncatingCompressor) Decompress(dst io.Writer, src io.Reader) error {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(data[:len(data)-1])
+	return err
+}
+
+func TestCompressionCanary(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Len(getCompressionCanary(), DEFAULT_BLOCK_SIZE)
+	for _, method := range append(util.GetCompressionMethods(), "none") {
+		assert.NoError(checkCompressionCanary(method), method)
+	}
+	assert.Error(checkCompressionCanary("unknown"))
+
+	broken := &truncatingCompressor{}
+	assert.NoError(util.RegisterCompressor("test-truncating", func() (util.Compressor, error) {
+		return broken, nil
+	}, nil))
+	defer util.UnregisterCompressor("test-truncating")
+	err := checkCompressionCanary("test-truncating")
+	assert.True(IsCompressionCanaryError(err))
+
+	// the blocks refused by the compressor are stored uncompressed, which doesn't go through the codec
+	broken.compressErr = util.ErrIncompressible
+	assert.NoError(checkCompressionCanary("test-truncating"))
+	broken.compressErr = io.ErrShortWrite
+	assert.True(IsCompressionCanaryError(checkCompressionCanary("test-truncating")))
+}
@@ -0,0 +1,282 @@
+package backupstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gammazero/workerpool"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	DEFAULT_COMPRESSION_MIGRATION_CONCURRENT_LIMIT = 4
+)
+
+// CompressionMigrationOptions are the options of the volume compression migration
+type CompressionMigrationOptions struct {
+	// ConcurrentLimit is the number of the blocks recompressed concurrently
+	ConcurrentLimit int
+	// RateLimit limits the bytes read from the backupstore per second, no limit if 0
+	RateLimit int64
+}
+
+// MigrateVolumeCompression recompresses the blocks of the backup volume with the new compression method
+func MigrateVolumeCompression(volumeURL, newMethod string) error {
+	return MigrateVolumeCompressionWithOptions(volumeURL, newMethod, nil)
+}
+
+// MigrateVolumeCompressionWithOptions recompresses the blocks of the backup volume with the new compression method,
+// then updates the compression method of the volume and its backups. The blocks are recompressed in place, so the
+// backups and restores of the volume are refused until the migration is completed. An interrupted migration
+// can be resumed by calling it again, the blocks already recompressed are skipped.
+func MigrateVolumeCompressionWithOptions(volumeURL, newMethod string, opts *CompressionMigrationOptions) error {
+	if opts == nil {
+		opts = &CompressionMigrationOptions{}
+	}
+	if opts.ConcurrentLimit <= 0 {
+		opts.ConcurrentLimit = DEFAULT_COMPRESSION_MIGRATION_CONCURRENT_LIMIT
+	}
+	if _, err := util.GetCompressor(newMethod); err != nil {
+		return err
+	}
+
+	_, volumeName, _, err := DecodeBackupURL(volumeURL)
+	if err != nil {
+		return err
+	}
+
+	bsDriver, err := GetBackupStoreDriver(volumeURL)
+	if err != nil {
+		return err
+	}
+
+	// the deletion lock keeps the backups and restores away while the blocks are being rewritten
+	lock, err := New(bsDriver, volumeName, DELETION_LOCK)
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	volume, err := loadVolume(bsDriver, volumeName)
+	if err != nil {
+		return err
+	}
+	if volume.CompressionMethod == newMethod && volume.MigratingCompressionMethod == "" {
+		return nil
+	}
+
+	log := log.WithFields(logrus.Fields{
+		LogFieldVolume:  volumeName,
+		LogFieldDestURL: bsDriver.GetURL(),
+	})
+	log.Infof("Migrating compression method from %v to %v", volume.CompressionMethod, newMethod)
+
+	volume.MigratingCompressionMethod = newMethod
+	if err := saveVolume(bsDriver, volume); err != nil {
+		return err
+	}
+
+	checksums, err := getBlockNamesForVolume(bsDriver, volumeName)
+	if err != nil {
+		return err
+	}
+	recompressed, err := recompressBlocks(bsDriver, volumeName, checksums, newMethod, opts)
+	if err != nil {
+		return errors.Wrapf(err, "failed to recompress blocks, %v blocks recompressed", recompressed)
+	}
+
+	backupNames, err := getBackupNamesForVolume(bsDriver, volumeName)
+	if err != nil {
+		return err
+	}
+	for _, backupName := range backupNames {
+		backup, err := loadBackup(bsDriver, backupName, volumeName)
+		if err != nil {
+			return err
+		}
+		if backup.SingleFile.FilePath != "" ||
+			(backup.CompressionMethod == newMethod && !hasBlockCompressionMethods(backup.Blocks)) {
+			continue
+		}
+		backup.CompressionMethod = newMethod
+		// all the blocks are recompressed with the new method
+		for i := range backup.Blocks {
+			backup.Blocks[i].CompressionMethod = ""
+		}
+		if err := saveBackup(bsDriver, backup); err != nil {
+			return err
+		}
+	}
+
+	volume.CompressionMethod = newMethod
+	volume.MigratingCompressionMethod = ""
+	if err := saveVolume(bsDriver, volume); err != nil {
+		return err
+	}
+
+	log.Infof("Migrated compression method to %v, %v of %v blocks recompressed", newMethod, recompressed, len(checksums))
+	return nil
+}
+
+// checkVolumeCompressionMigration fails if the blocks of the volume are being recompressed
+func checkVolumeCompressionMigration(volume *Volume) error {
+	if volume.MigratingCompressionMethod != "" {
+		return fmt.Errorf("volume %v compression method migration to %v is not completed",
+			volume.Name, volume.MigratingCompressionMethod)
+	}
+	return nil
+}
+
+func recompressBlocks(bsDriver BackupStoreDriver, volumeName string, checksums []string,
+	newMethod string, opts *CompressionMigrationOptions) (int64, error) {
+	limiter := newRateLimiter(opts.RateLimit)
+
+	var (
+		lock         sync.Mutex
+		recompressed int64
+		errs         []error
+	)
+	pool := workerpool.New(opts.ConcurrentLimit)
+	for _, checksum := range checksums {
+		checksum := checksum
+		pool.Submit(func() {
+			lock.Lock()
+			failed := len(errs) > 0
+			lock.Unlock()
+			if failed {
+				return
+			}
+
+			done, err := recompressBlock(bsDriver, volumeName, checksum, newMethod, limiter)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				errs = append(errs, errors.Wrapf(err, "block %v", checksum))
+			} else if done {
+				recompressed++
+			}
+		})
+	}
+	pool.StopWait()
+
+	if len(errs) > 0 {
+		return recompressed, errs[0]
+	}
+	return recompressed, nil
+}
+
+// recompressBlock recompresses the block with the new method, it returns false if the block is already compressed
+// with the new method
+func recompressBlock(bsDriver BackupStoreDriver, volumeName, checksum, newMethod string, limiter *rateLimiter) (bool, error) {
+	blkFile := getBlockFilePath(bsDriver, volumeName, checksum)
+	rc, err := bsDriver.Read(blkFile)
+	if err != nil {
+		return false, err
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return false, err
+	}
+	limiter.wait(int64(len(data)))
+
+	buf := blockBuffers.Get()
+	defer blockBuffers.Put(buf)
+	found := ""
+	// the method of the block with the header is known
+	if header, ok := ParseBlockHeader(data); ok {
+		if decodeBlockWithHeader(header, data, buf, checksum) == nil {
+			found = header.CompressionMethod
+		} else {
+			buf.Reset()
+		}
+	}
+	if found == newMethod {
+		return false, nil
+	}
+	if found == "" {
+		if util.DecompressAndVerifyInto(newMethod, buf, bytes.NewReader(data), checksum) == nil {
+			return false, nil
+		}
+
+		// the block may be compressed with the original method or the method of an interrupted migration, or
+		// stored uncompressed if it was refused by the compressor
+		methods := []string{"none"}
+		if detected := util.DetectCompressionMethod(data); detected != "" {
+			methods = []string{detected, "none"}
+		}
+		for _, method := range methods {
+			if method == newMethod {
+				continue
+			}
+			buf.Reset()
+			if util.DecompressAndVerifyInto(method, buf, bytes.NewReader(data), checksum) == nil {
+				found = method
+				break
+			}
+		}
+	}
+	if found == "" {
+		return false, fmt.Errorf("cannot detect compression method")
+	}
+
+	compressed := blockBuffers.Get()
+	defer blockBuffers.Put(compressed)
+	compressor, err := util.GetCompressor(newMethod)
+	if err != nil {
+		return false, err
+	}
+	writeBlockHeader(compressed, newMethod, buf.Len())
+	if err := compressor.Compress(compressed, bytes.NewReader(buf.Bytes())); err != nil {
+		if !errors.Is(err, util.ErrIncompressible) {
+			return false, err
+		}
+		// the block refused by the compressor stays uncompressed
+		if found == "none" {
+			return false, nil
+		}
+		compressed.Reset()
+		writeBlockHeader(compressed, "none", buf.Len())
+		compressed.Write(buf.Bytes())
+	}
+	if err := bsDriver.Write(blkFile, bytes.NewReader(compressed.Bytes())); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rateLimiter limits the average rate of the bytes since it's created
+type rateLimiter struct {
+	lock  sync.Mutex
+	rate  int64
+	start time.Time
+	bytes int64
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate, start: time.Now()}
+}
+
+func (l *rateLimiter) wait(n int64) {
+	if l.rate <= 0 {
+		return
+	}
+	l.lock.Lock()
+	l.bytes += n
+	delay := time.Duration(float64(l.bytes)/float64(l.rate)*float64(time.Second)) - time.Since(l.start)
+	l.lock.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
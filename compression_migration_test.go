@@ -0,0 +1,58 @@
+package backupstore
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+type writableMockStoreDriver struct {
+	*mockStoreDriver
+}
+
+func (m *writableMockStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	data, err := io.ReadAll(rs)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(m.fs, dst, data, 0644)
+}
+
+func TestRecompressBlock(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	data := bytes.Repeat([]byte("block"), 1024)
+	checksum := util.GetChecksum(data)
+	compressed, err := util.CompressData("gzip", data)
+	assert.NoError(err)
+	blkFile := getBlockFilePath(m, "pvc-1", checksum)
+	assert.NoError(m.Write(blkFile, compressed))
+
+	limiter := newRateLimiter(0)
+	done, err := recompressBlock(m, "pvc-1", checksum, "lz4", limiter)
+	assert.NoError(err)
+	assert.True(done)
+
+	// resuming the migration skips the recompressed block
+	done, err = recompressBlock(m, "pvc-1", checksum, "lz4", limiter)
+	assert.NoError(err)
+	assert.False(done)
+
+	rc, err := m.Read(blkFile)
+	assert.NoError(err)
+	defer rc.Close()
+	var buf bytes.Buffer
+	assert.NoError(util.DecompressAndVerifyInto("lz4", &buf, rc, checksum))
+	assert.Equal(data, buf.Bytes())
+
+	assert.Error(checkVolumeCompressionMigration(&Volume{Name: "pvc-1", MigratingCompressionMethod: "lz4"}))
+}
@@ -0,0 +1,94 @@
+package backupstore
+
+import (
+	"sync"
+)
+
+const (
+	// COMPRESSION_RATIO_HISTOGRAM_BUCKETS is the number of the buckets of the compression ratio histogram. The
+	// bucket i counts the blocks with the ratio in [i/10, (i+1)/10), the last one counts the blocks not shrunk.
+	COMPRESSION_RATIO_HISTOGRAM_BUCKETS = 11
+)
+
+// DeltaBlockBackupCompressionOperations can be optionally implemented by the DeltaBlockBackupOperations to
+// receive the compression stats of the backup. It's called right before the final backup status update.
+type DeltaBlockBackupCompressionOperations interface {
+	UpdateBackupCompressionStats(id, volumeID string, stats *CompressionStats)
+}
+
+// CompressionStats is the summary of the blocks compressed by a backup. Only the new blocks are compressed,
+// the blocks already in the backup targets are not counted.
+type CompressionStats struct {
+	Method            string
+	BlockCount        int64
+	UncompressedBytes int64 `json:",string"`
+	CompressedBytes   int64 `json:",string"`
+	// Ratio is the compressed bytes divided by the uncompressed bytes
+	Ratio float64
+	// RatioHistogram is the block count by the compression ratio, see COMPRESSION_RATIO_HISTOGRAM_BUCKETS
+	RatioHistogram []int64
+	// CompressedBytesHistogram is the compressed bytes of the blocks counted by RatioHistogram
+	CompressedBytesHistogram []int64
+}
+
+// compressionStatsCollector collects the compressed sizes from the compression workers
+type compressionStatsCollector struct {
+	sync.Mutex
+	stats CompressionStats
+}
+
+func newCompressionStatsCollector(method string) *compressionStatsCollector {
+	return &compressionStatsCollector{
+		stats: CompressionStats{
+			Method:                   method,
+			RatioHistogram:           make([]int64, COMPRESSION_RATIO_HISTOGRAM_BUCKETS),
+			CompressedBytesHistogram: make([]int64, COMPRESSION_RATIO_HISTOGRAM_BUCKETS),
+		},
+	}
+}
+
+func (c *compressionStatsCollector) record(uncompressed, compressed int) {
+	if uncompressed <= 0 {
+		return
+	}
+	bucket := compressed * (COMPRESSION_RATIO_HISTOGRAM_BUCKETS - 1) / uncompressed
+	if bucket >= COMPRESSION_RATIO_HISTOGRAM_BUCKETS {
+		bucket = COMPRESSION_RATIO_HISTOGRAM_BUCKETS - 1
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.stats.BlockCount++
+	c.stats.UncompressedBytes += int64(uncompressed)
+	c.stats.CompressedBytes += int64(compressed)
+	c.stats.RatioHistogram[bucket]++
+	c.stats.CompressedBytesHistogram[bucket] += int64(compressed)
+}
+
+// summary returns a copy of the stats collected so far
+func (c *compressionStatsCollector) summary() *CompressionStats {
+	c.Lock()
+	defer c.Unlock()
+	stats := c.stats
+	stats.RatioHistogram = append([]int64{}, c.stats.RatioHistogram...)
+	stats.CompressedBytesHistogram = append([]int64{}, c.stats.CompressedBytesHistogram...)
+	if stats.UncompressedBytes > 0 {
+		stats.Ratio = float64(stats.CompressedBytes) / float64(stats.UncompressedBytes)
+	}
+	return &stats
+}
+
+func updateBackupCompressionStats(deltaOps DeltaBlockBackupOperations, snapshotName, volumeName string, stats *CompressionStats) {
+	if stats == nil {
+		return
+	}
+	// the block source operations wrap the operations of the caller
+	if sourceOps, ok := deltaOps.(*blockSourceOperations); ok {
+		deltaOps = sourceOps.ops
+	}
+	compressionOps, ok := deltaOps.(DeltaBlockBackupCompressionOperations)
+	if !ok {
+		return
+	}
+	compressionOps.UpdateBackupCompressionStats(snapshotName, volumeName, stats)
+}
@@ -0,0 +1,44 @@
+package backupstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type compressionStatsOperations struct {
+	DeltaBlockBackupOperations
+	stats *CompressionStats
+}
+
+func (o *compressionStatsOperations) UpdateBackupCompressionStats(id, volumeID string, stats *CompressionStats) {
+	o.stats = stats
+}
+
+func TestCompressionStats(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newCompressionStatsCollector("gzip")
+	c.record(1000, 50)
+	c.record(1000, 450)
+	c.record(1000, 1000)
+	c.record(1000, 1010)
+	c.record(0, 0)
+
+	stats := c.summary()
+	assert.Equal("gzip", stats.Method)
+	assert.Equal(int64(4), stats.BlockCount)
+	assert.Equal(int64(4000), stats.UncompressedBytes)
+	assert.Equal(int64(2510), stats.CompressedBytes)
+	assert.InDelta(0.6275, stats.Ratio, 0.0001)
+	assert.Equal([]int64{1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 2}, stats.RatioHistogram)
+	assert.Equal([]int64{50, 0, 0, 0, 450, 0, 0, 0, 0, 0, 2010}, stats.CompressedBytesHistogram)
+
+	// the summary is a copy
+	c.record(1000, 50)
+	assert.Equal(int64(1), stats.RatioHistogram[0])
+
+	ops := &compressionStatsOperations{}
+	updateBackupCompressionStats(newBlockSourceOperations(nil, ops), "snap-1", "pvc-1", stats)
+	assert.Equal(stats, ops.stats)
+}
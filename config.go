@@ -31,10 +31,14 @@ const (
 	CFG_SUFFIX = ".cfg"
 
 	taskTimeout = 90 * time.Second
+
+	// configUpdateRetries is the number of times a config update is reapplied after conflicting with
+	// the concurrent updates
+	configUpdateRetries = 5
 )
 
-func getBackupConfigName(id string) string {
-	return BACKUP_CONFIG_PREFIX + id + CFG_SUFFIX
+func getBackupConfigName(driver BackupStoreDriver, id string) string {
+	return getKeyNaming(driver).backupConfigName(id)
 }
 
 func LoadConfigInBackupStore(driver BackupStoreDriver, filePath string, v interface{}) error {
@@ -54,7 +58,11 @@ func LoadConfigInBackupStore(driver BackupStoreDriver, filePath string, v interf
 		LogFieldFilepath: filePath,
 	}).Info("Loading config in backupstore")
 
-	if err := json.NewDecoder(rc).Decode(v); err != nil {
+	r, err := newMetadataReader(rc)
+	if err != nil {
+		return err
+	}
+	if err := json.NewDecoder(r).Decode(v); err != nil {
 		return err
 	}
 
@@ -68,10 +76,17 @@ func LoadConfigInBackupStore(driver BackupStoreDriver, filePath string, v interf
 }
 
 func SaveConfigInBackupStore(driver BackupStoreDriver, filePath string, v interface{}) error {
+	return saveConfigInBackupStore(driver, filePath, v, "none")
+}
+
+func saveConfigInBackupStore(driver BackupStoreDriver, filePath string, v interface{}, compressionMethod string) error {
 	j, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
+	if j, err = compressMetadata(compressionMethod, j); err != nil {
+		return err
+	}
 	log.WithFields(logrus.Fields{
 		LogFieldReason:   LogReasonStart,
 		LogFieldObject:   LogObjectConfig,
@@ -82,6 +97,9 @@ func SaveConfigInBackupStore(driver BackupStoreDriver, filePath string, v interf
 	if err := driver.Write(filePath, bytes.NewReader(j)); err != nil {
 		return err
 	}
+	if err := waitConfigVisible(driver, filePath, j); err != nil {
+		return err
+	}
 
 	log.WithFields(logrus.Fields{
 		LogFieldReason:   LogReasonComplete,
@@ -136,134 +154,166 @@ func SaveBackupStoreToLocalFile(driver BackupStoreDriver, backupStoreFileURL, lo
 }
 
 func volumeExists(driver BackupStoreDriver, volumeName string) bool {
-	return driver.FileExists(getVolumeFilePath(volumeName))
+	return driver.FileExists(getVolumeFilePath(driver, volumeName))
 }
 
-func getVolumePath(volumeName string) string {
-	checksum := util.GetChecksum([]byte(volumeName))
-	volumeLayer1 := checksum[0:VOLUME_SEPARATE_LAYER1]
-	volumeLayer2 := checksum[VOLUME_SEPARATE_LAYER1:VOLUME_SEPARATE_LAYER2]
-	return filepath.Join(backupstoreBase, VOLUME_DIRECTORY, volumeLayer1, volumeLayer2, volumeName) + "/"
+func getVolumePath(driver BackupStoreDriver, volumeName string) string {
+	return filepath.Join(backupstoreBase, VOLUME_DIRECTORY, getLayout(driver).VolumePath(volumeName)) + "/"
 }
 
-func getVolumeFilePath(volumeName string) string {
-	volumePath := getVolumePath(volumeName)
+func getVolumeFilePath(driver BackupStoreDriver, volumeName string) string {
+	volumePath := getVolumePath(driver, volumeName)
 	volumeCfg := VOLUME_CONFIG_FILE
 	return filepath.Join(volumePath, volumeCfg)
 }
 
 // getVolumeNames returns all volume names based on the folders on the backupstore
 func getVolumeNames(jobQueues *workerpool.WorkerPool, driver BackupStoreDriver) ([]string, error) {
+	return getVolumeNamesWithPrefix(jobQueues, driver, "")
+}
+
+// getVolumeNamesWithPrefix returns the volume names starting with the prefix. The prefix is pushed down to the
+// listing of the directories holding the volumes, and the listing starts below the leading directories of the
+// layout which don't depend on the volume name.
+func getVolumeNamesWithPrefix(jobQueues *workerpool.WorkerPool, driver BackupStoreDriver, namePrefix string) ([]string, error) {
 	names := []string{}
-	volumePathBase := filepath.Join(backupstoreBase, VOLUME_DIRECTORY)
-	lv1Dirs, err := driver.List(volumePathBase)
+	layout := getLayout(driver)
+	staticPrefix := getVolumePathStaticPrefix(layout)
+	volumePathBase := filepath.Join(backupstoreBase, VOLUME_DIRECTORY, staticPrefix)
+	depth := layout.VolumePathDepth()
+	if staticPrefix != "" {
+		depth -= len(strings.Split(staticPrefix, "/"))
+	}
+
+	lv1Prefix := ""
+	if depth == 1 {
+		lv1Prefix = namePrefix
+	}
+	lv1Dirs, err := listWithPrefix(driver, volumePathBase, lv1Prefix)
 	if err != nil {
 		log.WithError(err).Warnf("Failed to list first level dirs for path %v", volumePathBase)
 		return names, err
 	}
 
+	// The volume names are the leaves of the volume paths, hence we need to go
+	// through the rest levels of the layout in parallel
+	dirs := lv1Dirs
+	paths := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		paths = append(paths, filepath.Join(volumePathBase, dir))
+	}
+
 	var errs []string
-	lv1Trackers := make(chan types.JobResult)
-	lv2Trackers := make(chan types.JobResult)
-	defer close(lv1Trackers)
-	defer close(lv2Trackers)
+	for level := 1; level < depth; level++ {
+		levelPrefix := ""
+		if level == depth-1 {
+			levelPrefix = namePrefix
+		}
+		var levelErrs []string
+		dirs, paths, levelErrs = listDirsInParallel(jobQueues, driver, paths, levelPrefix)
+		errs = append(errs, levelErrs...)
+	}
+	names = append(names, dirs...)
+
+	if len(errs) > 0 {
+		return names, errors.New(strings.Join(errs, "\n"))
+	}
+	return names, nil
+}
+
+// listWithPrefix lists the entries of the path starting with the prefix, the filtering is done by the driver
+// if it's supported
+func listWithPrefix(driver BackupStoreDriver, path, prefix string) ([]string, error) {
+	if prefix == "" {
+		return driver.List(path)
+	}
+	if lister, ok := driver.(BackupStorePrefixLister); ok {
+		return lister.ListPrefix(path, prefix)
+	}
+
+	entries, err := driver.List(path)
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, prefix) {
+			result = append(result, entry)
+		}
+	}
+	return result, nil
+}
+
+type listedDir struct {
+	path string
+	dirs []string
+}
+
+// listDirsInParallel lists the entries starting with the prefix of the given paths, then returns the names and
+// the full paths of the entries
+func listDirsInParallel(jobQueues *workerpool.WorkerPool, driver BackupStoreDriver, paths []string, prefix string) ([]string, []string, []string) {
+	var errs []string
+	names := []string{}
+	subPaths := []string{}
+
+	trackers := make(chan types.JobResult)
+	defer close(trackers)
 
 	runner := timeout.New(timeout.Config{
 		Timeout: taskTimeout,
 	})
 
-	for _, lv1Dir := range lv1Dirs {
-		path := filepath.Join(volumePathBase, lv1Dir)
+	for _, p := range paths {
+		path := p
 		jobQueues.Submit(func() {
-			lv2Paths := make([]string, 0)
+			var dirs []string
 			err := runner.Run(context.TODO(), func(_ context.Context) error {
-				lv2Dirs, err := driver.List(path)
+				var err error
+				dirs, err = listWithPrefix(driver, path, prefix)
 				if err != nil {
-					logrus.WithError(err).Warnf("Failed to list second level dirs for path %v", path)
-					return errors.Wrapf(err, "failed to list second level dirs for path %v", path)
-				}
-				for _, lv2Dir := range lv2Dirs {
-					lv2Paths = append(lv2Paths, filepath.Join(path, lv2Dir))
+					logrus.WithError(err).Warnf("Failed to list dirs for path %v", path)
+					return errors.Wrapf(err, "failed to list dirs for path %v", path)
 				}
 				return nil
 			})
 			if err != nil {
-				lv1Trackers <- types.JobResult{
+				trackers <- types.JobResult{
 					Payload: nil,
 					Err:     err,
 				}
 				return
 			}
-			lv1Trackers <- types.JobResult{
-				Payload: lv2Paths,
+			trackers <- types.JobResult{
+				Payload: listedDir{path: path, dirs: dirs},
 				Err:     nil,
 			}
-			return
 		})
 	}
 
-	lv2PathsNum := 0
-	for i := 0; i < len(lv1Dirs); i++ {
-		lv1Tracker := <-lv1Trackers
-		payload, err := lv1Tracker.Payload, lv1Tracker.Err
-		if err != nil {
-			errs = append(errs, err.Error())
+	for i := 0; i < len(paths); i++ {
+		tracker := <-trackers
+		if tracker.Err != nil {
+			errs = append(errs, tracker.Err.Error())
 			continue
 		}
-
-		lv2Paths := payload.([]string)
-		lv2PathsNum += len(lv2Paths)
-		for _, lv2Path := range lv2Paths {
-			path := lv2Path
-			jobQueues.Submit(func() {
-				var volumeNames []string
-				err := runner.Run(context.TODO(), func(_ context.Context) error {
-					volumeNames, err = driver.List(path)
-					if err != nil {
-						logrus.WithError(err).Warnf("Failed to list volume names for path %v", path)
-						return errors.Wrapf(err, "failed to list second level dirs for path %v", path)
-					}
-					return nil
-				})
-				if err != nil {
-					lv2Trackers <- types.JobResult{
-						Payload: nil,
-						Err:     err,
-					}
-					return
-				}
-				lv2Trackers <- types.JobResult{
-					Payload: volumeNames,
-					Err:     nil,
-				}
-				return
-			})
+		listed := tracker.Payload.(listedDir)
+		for _, dir := range listed.dirs {
+			names = append(names, dir)
+			subPaths = append(subPaths, filepath.Join(listed.path, dir))
 		}
 	}
-
-	for i := 0; i < lv2PathsNum; i++ {
-		lv2Tracker := <-lv2Trackers
-		payload, err := lv2Tracker.Payload, lv2Tracker.Err
-		if err != nil {
-			errs = append(errs, err.Error())
-			continue
-		}
-		volumeNames := payload.([]string)
-		names = append(names, volumeNames...)
-	}
-
-	if len(errs) > 0 {
-		return names, errors.New(strings.Join(errs, "\n"))
-	}
-	return names, nil
+	return names, subPaths, errs
 }
 
 func loadVolume(driver BackupStoreDriver, volumeName string) (*Volume, error) {
 	v := &Volume{}
-	file := getVolumeFilePath(volumeName)
+	file := getVolumeFilePath(driver, volumeName)
 	if err := LoadConfigInBackupStore(driver, file, v); err != nil {
 		return nil, err
 	}
+	if err := foldVolumeRecords(driver, v); err != nil {
+		return nil, err
+	}
 	// Backward compatibility
 	if v.CompressionMethod == "" {
 		log.Infof("Falling back compression method to %v for volume %v", LEGACY_COMPRESSION_METHOD, v.Name)
@@ -272,40 +322,85 @@ func loadVolume(driver BackupStoreDriver, volumeName string) (*Volume, error) {
 	if v.BackendStoreDriver == "" {
 		v.BackendStoreDriver = string(BackendStoreDriverV1)
 	}
+	setVolumeBlockLayout(driver, v)
 	return v, nil
 }
 
 func saveVolume(driver BackupStoreDriver, v *Volume) error {
-	return SaveConfigInBackupStore(driver, getVolumeFilePath(v.Name), v)
+	if writer := getLastWriter(); writer != "" {
+		v.LastWriter = writer
+	}
+	if err := saveConfigInBackupStore(driver, getVolumeFilePath(driver, v.Name), v, GetMetadataCompressionMethod()); err != nil {
+		return err
+	}
+	setVolumeBlockLayout(driver, v)
+	recordVolumeConfigRevision(driver, v)
+	return nil
+}
+
+// updateVolume applies the update to the volume config and saves it only if the config hasn't been changed
+// meanwhile. The update is reapplied to the reloaded config on conflict, so it must not depend on the state
+// outside of the volume.
+func updateVolume(driver BackupStoreDriver, volumeName string, update func(v *Volume) error) (*Volume, error) {
+	filePath := getVolumeFilePath(driver, volumeName)
+	for i := 0; ; i++ {
+		// The ETag is read before the config, so any change in between is caught by the conditional write
+		etag, err := getFileETag(driver, filePath)
+		if err != nil {
+			return nil, err
+		}
+		v, err := loadVolume(driver, volumeName)
+		if err != nil {
+			return nil, err
+		}
+		if err := update(v); err != nil {
+			return nil, err
+		}
+		if writer := getLastWriter(); writer != "" {
+			v.LastWriter = writer
+		}
+		err = saveConfigInBackupStoreIfMatch(driver, filePath, v, GetMetadataCompressionMethod(), etag)
+		if err == nil {
+			setVolumeBlockLayout(driver, v)
+			recordVolumeConfigRevision(driver, v)
+			return v, nil
+		}
+		if !IsConflictError(err) || i >= configUpdateRetries {
+			return nil, err
+		}
+		log.WithError(err).Warnf("Retrying update of volume %v config", volumeName)
+	}
 }
 
 func getBackupNamesForVolume(driver BackupStoreDriver, volumeName string) ([]string, error) {
 	result := []string{}
-	fileList, err := driver.List(getBackupPath(volumeName))
+	fileList, err := driver.List(getBackupPath(driver, volumeName))
 	if err != nil {
 		// path doesn't exist
 		return result, nil
 	}
-	return util.ExtractNames(fileList, BACKUP_CONFIG_PREFIX, CFG_SUFFIX), nil
+	naming := getKeyNaming(driver)
+	return util.ExtractNames(fileList, naming.backupPrefix, naming.backupSuffix), nil
 }
 
-func getBackupPath(volumeName string) string {
-	return filepath.Join(getVolumePath(volumeName), BACKUP_DIRECTORY) + "/"
+func getBackupPath(driver BackupStoreDriver, volumeName string) string {
+	return filepath.Join(getVolumePath(driver, volumeName), BACKUP_DIRECTORY) + "/"
 }
 
-func getBackupConfigPath(backupName, volumeName string) string {
-	path := getBackupPath(volumeName)
-	fileName := getBackupConfigName(backupName)
+func getBackupConfigPath(driver BackupStoreDriver, backupName, volumeName string) string {
+	path := getBackupPath(driver, volumeName)
+	fileName := getBackupConfigName(driver, backupName)
 	return filepath.Join(path, fileName)
 }
 
+// isBackupInProgress checks if the backup hasn't completed, including the aborted backup
 func isBackupInProgress(backup *Backup) bool {
 	return backup != nil && backup.CreatedTime == ""
 }
 
 func loadBackup(bsDriver BackupStoreDriver, backupName, volumeName string) (*Backup, error) {
 	backup := &Backup{}
-	if err := LoadConfigInBackupStore(bsDriver, getBackupConfigPath(backupName, volumeName), backup); err != nil {
+	if err := LoadConfigInBackupStore(bsDriver, getBackupConfigPath(bsDriver, backupName, volumeName), &backupConfig{Backup: backup}); err != nil {
 		return nil, err
 	}
 	// Backward compatibility
@@ -320,12 +415,12 @@ func saveBackup(bsDriver BackupStoreDriver, backup *Backup) error {
 	if backup.VolumeName == "" {
 		return fmt.Errorf("missing volume specifier for backup: %v", backup.Name)
 	}
-	filePath := getBackupConfigPath(backup.Name, backup.VolumeName)
-	return SaveConfigInBackupStore(bsDriver, filePath, backup)
+	filePath := getBackupConfigPath(bsDriver, backup.Name, backup.VolumeName)
+	return saveConfigInBackupStore(bsDriver, filePath, newBackupConfig(backup, IsBackupBlockIndexEnabled()), GetMetadataCompressionMethod())
 }
 
 func removeBackup(backup *Backup, bsDriver BackupStoreDriver) error {
-	filePath := getBackupConfigPath(backup.Name, backup.VolumeName)
+	filePath := getBackupConfigPath(bsDriver, backup.Name, backup.VolumeName)
 	if err := bsDriver.Remove(filePath); err != nil {
 		return err
 	}
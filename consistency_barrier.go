@@ -0,0 +1,129 @@
+package backupstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ConsistencyBarrierParam enables the consistency barrier of the backup target by the URL param, e.g.
+	// s3://bucket@region/path/?consistencyBarrier=true. The value is either a boolean, which uses
+	// DEFAULT_CONSISTENCY_BARRIER_RETRIES, or the number of the retries.
+	ConsistencyBarrierParam = "consistencyBarrier"
+
+	DEFAULT_CONSISTENCY_BARRIER_RETRIES = 5
+
+	consistencyBarrierMaxInterval = 2 * time.Second
+)
+
+var (
+	consistencyBarrierMinInterval = 100 * time.Millisecond
+
+	consistencyBarriersLock sync.RWMutex
+	// consistencyBarriers caches the retries of the consistency barrier of the backup targets by the driver URL
+	consistencyBarriers = map[string]int{}
+)
+
+// parseConsistencyBarrier returns the retries of the consistency barrier set by the URL param, 0 if it's disabled
+func parseConsistencyBarrier(u *url.URL) (int, error) {
+	value := u.Query().Get(ConsistencyBarrierParam)
+	if value == "" {
+		return 0, nil
+	}
+	if retries, err := strconv.Atoi(value); err == nil && retries >= 0 {
+		return retries, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %v %v, must be a boolean or the number of the retries", ConsistencyBarrierParam, value)
+	}
+	if !enabled {
+		return 0, nil
+	}
+	return DEFAULT_CONSISTENCY_BARRIER_RETRIES, nil
+}
+
+// loadConsistencyBarrier caches the consistency barrier of the backup target set by the URL
+func loadConsistencyBarrier(driver BackupStoreDriver, u *url.URL) error {
+	retries, err := parseConsistencyBarrier(u)
+	if err != nil {
+		return err
+	}
+
+	consistencyBarriersLock.Lock()
+	defer consistencyBarriersLock.Unlock()
+	if retries == 0 {
+		delete(consistencyBarriers, driver.GetURL())
+		return nil
+	}
+	consistencyBarriers[driver.GetURL()] = retries
+	return nil
+}
+
+func getConsistencyBarrierRetries(driver BackupStoreDriver) int {
+	consistencyBarriersLock.RLock()
+	defer consistencyBarriersLock.RUnlock()
+	return consistencyBarriers[driver.GetURL()]
+}
+
+// waitConfigVisible is the consistency barrier of the eventually consistent backup targets. It re-reads the config
+// just written until the content and the listing of its directory are up to date, so the listings right after the
+// write see the config, e.g. the backup just created. It fails if the config is still not visible after the retries.
+func waitConfigVisible(driver BackupStoreDriver, filePath string, data []byte) error {
+	retries := getConsistencyBarrierRetries(driver)
+	if retries <= 0 {
+		return nil
+	}
+
+	interval := consistencyBarrierMinInterval
+	for i := 0; ; i++ {
+		err := checkConfigVisible(driver, filePath, data)
+		if err == nil {
+			return nil
+		}
+		if i >= retries {
+			return errors.Wrapf(err, "consistency barrier failed after %v retries", retries)
+		}
+		log.WithError(err).Debugf("Waiting for %v to be visible", filePath)
+		time.Sleep(interval)
+		if interval *= 2; interval > consistencyBarrierMaxInterval {
+			interval = consistencyBarrierMaxInterval
+		}
+	}
+}
+
+func checkConfigVisible(driver BackupStoreDriver, filePath string, data []byte) error {
+	rc, err := driver.Read(filePath)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	current, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, data) {
+		return fmt.Errorf("%v is not up to date", filePath)
+	}
+
+	entries, err := driver.List(filepath.Dir(filePath) + "/")
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(filePath)
+	for _, entry := range entries {
+		if strings.TrimPrefix(entry, "/") == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("%v is not listed", filePath)
+}
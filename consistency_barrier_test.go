@@ -0,0 +1,105 @@
+package backupstore
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// laggingMockStoreDriver hides the files from the listings for a number of the listings after they are written
+type laggingMockStoreDriver struct {
+	*writableMockStoreDriver
+	lag    int
+	hidden map[string]int
+}
+
+func (m *laggingMockStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	m.hidden[dst] = m.lag
+	return m.writableMockStoreDriver.Write(dst, rs)
+}
+
+func (m *laggingMockStoreDriver) List(listPath string) ([]string, error) {
+	entries, err := m.writableMockStoreDriver.List(listPath)
+	if err != nil {
+		return nil, err
+	}
+	visible := []string{}
+	for _, entry := range entries {
+		path := filepath.Join(listPath, entry)
+		if m.hidden[path] > 0 {
+			m.hidden[path]--
+			continue
+		}
+		visible = append(visible, entry)
+	}
+	return visible, nil
+}
+
+func TestConsistencyBarrier(t *testing.T) {
+	assert := assert.New(t)
+
+	interval := consistencyBarrierMinInterval
+	consistencyBarrierMinInterval = 0
+	defer func() {
+		consistencyBarrierMinInterval = interval
+	}()
+
+	for value, expected := range map[string]int{
+		"":      0,
+		"false": 0,
+		"true":  DEFAULT_CONSISTENCY_BARRIER_RETRIES,
+		"3":     3,
+	} {
+		u, err := url.Parse(mockDriverURL + "?" + ConsistencyBarrierParam + "=" + value)
+		assert.NoError(err)
+		retries, err := parseConsistencyBarrier(u)
+		assert.NoError(err)
+		assert.Equal(expected, retries, value)
+	}
+	for _, value := range []string{"-1", "always"} {
+		u, err := url.Parse(mockDriverURL + "?" + ConsistencyBarrierParam + "=" + value)
+		assert.NoError(err)
+		_, err = parseConsistencyBarrier(u)
+		assert.Error(err, value)
+	}
+
+	m := &laggingMockStoreDriver{writableMockStoreDriver: &writableMockStoreDriver{&mockStoreDriver{}}, hidden: map[string]int{}}
+	m.Init()
+	defer m.uninstall()
+	defer delete(consistencyBarriers, m.GetURL())
+
+	// the barrier is disabled by default
+	m.lag = 100
+	assert.NoError(saveVolume(m, &Volume{Name: "pvc-1"}))
+	assert.Equal(100, m.hidden[getVolumeFilePath(m, "pvc-1")])
+
+	// the write waits until the config is listed
+	u, err := url.Parse(mockDriverURL + "?" + ConsistencyBarrierParam + "=3")
+	assert.NoError(err)
+	assert.NoError(loadConsistencyBarrier(m, u))
+	m.lag = 2
+	assert.NoError(saveVolume(m, &Volume{Name: "pvc-1"}))
+	assert.Equal(0, m.hidden[getVolumeFilePath(m, "pvc-1")])
+	m.lag = 2
+	assert.NoError(saveConfigInBackupStoreIfMatch(m, getVolumeFilePath(m, "pvc-2"), &Volume{Name: "pvc-2"}, "none", ""))
+
+	// the write fails if the config is still not visible after the retries
+	m.lag = 10
+	assert.Error(saveVolume(m, &Volume{Name: "pvc-1"}))
+
+	// the stale content isn't taken as visible
+	m.lag = 0
+	filePath := getVolumeFilePath(m, "pvc-1")
+	assert.NoError(m.writableMockStoreDriver.Write(filePath, bytes.NewReader([]byte("{}"))))
+	assert.Error(waitConfigVisible(m, filePath, []byte(`{"Name":"pvc-1"}`)))
+
+	// the barrier is disabled by the URL without the param
+	u, err = url.Parse(mockDriverURL)
+	assert.NoError(err)
+	assert.NoError(loadConsistencyBarrier(m, u))
+	assert.Equal(0, getConsistencyBarrierRetries(m))
+}
@@ -0,0 +1,40 @@
+package backupstore
+
+import (
+	"sync"
+)
+
+// CredentialProvider provides the credential of a backup target. It can be used instead of the static
+// credential set up by util.SetupCredential, so the temporary credentials (e.g. AWS STS or Azure SAS tokens)
+// can be rotated during long running backups and restores.
+type CredentialProvider interface {
+	// GetCredential returns the current credential of the backup target, the keys are the same as
+	// the ones used by util.SetupCredential, e.g. types.AWSAccessKey
+	GetCredential(destURL string) (map[string]string, error)
+	// RefreshCredential is called when the backupstore rejects the current credential, e.g. HTTP 401/403
+	RefreshCredential(destURL string) error
+}
+
+var (
+	credentialProvidersLock sync.RWMutex
+	credentialProviders     = map[string]CredentialProvider{}
+)
+
+// SetCredentialProvider sets the credential provider consulted by the driver of the backup target.
+// The drivers created afterwards for the destURL use the provider instead of the environment variables.
+func SetCredentialProvider(destURL string, provider CredentialProvider) {
+	credentialProvidersLock.Lock()
+	defer credentialProvidersLock.Unlock()
+	if provider == nil {
+		delete(credentialProviders, destURL)
+		return
+	}
+	credentialProviders[destURL] = provider
+}
+
+// GetCredentialProvider returns the credential provider of the backup target, or nil if none was set
+func GetCredentialProvider(destURL string) CredentialProvider {
+	credentialProvidersLock.RLock()
+	defer credentialProvidersLock.RUnlock()
+	return credentialProviders[destURL]
+}
@@ -1,13 +1,14 @@
 package backupstore
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -23,9 +24,55 @@ type DeltaBackupConfig struct {
 	Volume          *Volume
 	Snapshot        *Snapshot
 	DestURL         string
+	DestURLs        []string // additional backup targets the blocks are uploaded to in the same pass
 	DeltaOps        DeltaBlockBackupOperations
 	Labels          map[string]string
 	ConcurrentLimit int32
+	// CompressConcurrentLimit is the number of the compression workers, defaults to and is capped at GOMAXPROCS
+	CompressConcurrentLimit int32
+	// CompressRateLimit limits the bytes compressed per second by all the compression workers, no limit if 0
+	CompressRateLimit int64
+	// NiceLevel lowers the scheduling priority of the compression workers to the nice level between 1 and 19,
+	// so the backup yields the CPU to the volume I/O on busy nodes. The priority is kept if 0
+	NiceLevel int
+	// CompressWorkerHook is called on the OS thread of each compression worker before it compresses any block.
+	// The worker is locked to the thread, so the hook can set the thread affinity, e.g. to the CPUs of a NUMA
+	// node by util.SetThreadCPUAffinity, reducing the cache thrash of the backups compressing concurrently on
+	// the node. The workers are numbered from 0 to the number of the compression workers minus 1. The failure
+	// of the hook is logged only.
+	CompressWorkerHook func(worker int) error
+	// AdaptiveConcurrency adjusts the concurrent block uploads to each backup target between 1 and
+	// MaxConcurrentLimit by the upload latency and errors, starting from ConcurrentLimit
+	AdaptiveConcurrency bool
+	// MaxConcurrentLimit defaults to DEFAULT_MAX_CONCURRENT_LIMIT_FACTOR times ConcurrentLimit
+	MaxConcurrentLimit int32
+	// MemoryBudget caps the bytes of the block buffers held by the backup, so the backup fits into the memory
+	// limit of the engine. The concurrent limits are lowered to fit into the budget, and the blocks aren't read
+	// from the snapshot until the budget has room for them. It must be at least MIN_MEMORY_BUDGET, no limit if 0
+	MemoryBudget int64
+	// Source provides the snapshot data instead of DeltaOps if set, DeltaOps is optional for the backup status then
+	Source BlockSource
+	// FilesystemAware skips the changed blocks unallocated by the ext4 or xfs filesystem on the snapshot. The
+	// filesystem must be frozen or unmounted when the snapshot is taken, other filesystems are backed up as is
+	FilesystemAware bool
+	// EncryptionAware skips the compression of the blocks if the volume is LUKS encrypted, since the encrypted
+	// data cannot be compressed. It only applies to the volume without any block in the backup targets yet
+	EncryptionAware bool
+	// ForceOwnership creates the backup even though the volume is owned by another cluster
+	ForceOwnership bool
+	// NameTemplate generates the backup name if the backup name isn't specified
+	NameTemplate *BackupNameTemplate
+	// BlockCRCs are the CRC32-C of the changed blocks by offset, computed by the replica. A changed block whose
+	// CRC matches the block backed up at the same offset before is referenced without being read from the
+	// snapshot, e.g. after the block is overwritten and reverted. The CRCs are saved in the backup config
+	BlockCRCs map[int64]uint32
+	// ForceFullBackup ignores the last backup and uploads all the in use blocks of the snapshot again, even if
+	// they exist in the backup targets, so a corrupted block doesn't propagate to the backups after it. The
+	// backup is marked as the base of a new backup chain
+	ForceFullBackup bool
+	// OnComplete is called exactly once with the result of the backup when it completes or fails, including
+	// the failures before the backup starts and the panics
+	OnComplete func(summary *BackupSummary)
 }
 
 type DeltaRestoreConfig struct {
@@ -34,11 +81,41 @@ type DeltaRestoreConfig struct {
 	LastBackupName  string
 	Filename        string
 	ConcurrentLimit int32
+	// CoalesceSize is the size of the sequential writes the contiguous blocks are coalesced into, up to
+	// MAX_RESTORE_COALESCE_SIZE. It must be a multiple of DEFAULT_BLOCK_SIZE, the blocks are written one by
+	// one if 0. Each restore worker buffers up to CoalesceSize bytes.
+	CoalesceSize int64
+	// ZeroBlockStrategy is how the incremental restore clears the blocks removed since the last restored
+	// backup, ZeroBlockStrategyAllocate if empty
+	ZeroBlockStrategy ZeroBlockStrategy
+	// FingerprintLocal compares the blocks of the existing volume with the checksums of the backup, and only
+	// downloads the differing blocks, so restoring onto a stale copy of the volume, e.g. a DR volume, only
+	// transfers what changed. The local blocks with data outside of the backup are cleared, by writing zeros
+	// if ZeroBlockStrategy keeps the data. OpenVolumeDev must keep the content of the volume. It only applies
+	// to RestoreDeltaBlockBackup.
+	FingerprintLocal bool
+	// OutputFormat is the image format the volume is written in, RestoreOutputFormatRaw if empty. The image
+	// formats stream the image to the volume device from the start, instead of writing the blocks at their
+	// offsets, and cannot be used with FingerprintLocal or CoalesceSize. It only applies to
+	// RestoreDeltaBlockBackup.
+	OutputFormat RestoreOutputFormat
+	// MemoryBudget caps the bytes of the block buffers held by the restore. The concurrent limit is lowered to
+	// the restore workers fitting into the budget, each of them holds 2 blocks and the CoalesceSize bytes. It
+	// must hold at least 1 restore worker, no limit if 0
+	MemoryBudget int64
+	// OnComplete is called exactly once with the result of the restore when it completes or fails, including
+	// the failures before the restore starts and the panics
+	OnComplete func(summary *RestoreSummary)
+
+	// groupMember is set if the restore is started by RestoreMany
+	groupMember *restoreGroupMember
 }
 
 type BlockMapping struct {
 	Offset        int64
 	BlockChecksum string
+	// CompressionMethod is the compression method of the block if it differs from the one of the backup
+	CompressionMethod string `json:",omitempty"`
 }
 
 type Block struct {
@@ -94,8 +171,35 @@ type progress struct {
 	totalBlockCounts     int64
 	processedBlockCounts int64
 	newBlockCounts       int64
+	// revertedBlockCounts is the number of the changed blocks referenced by the CRCs without being read
+	revertedBlockCounts int64
 
 	progress int
+	// milestone is the last progress milestone reported by the BlocksUploaded event
+	milestone int
+	// locks are the locks held by the operation, the progress is reported to the lock watchdog
+	locks []*FileLock
+	// budget is the memory budget of the block buffers of the operation
+	budget *util.MemoryBudget
+	// group is the restores started together with the restore by RestoreMany, nil for the other operations
+	group *RestoreGroup
+	// reflinkUnsupported is set once cloning a block into the restored volume fails, it's accessed atomically
+	reflinkUnsupported int32
+}
+
+// blockBuffers is shared by the stages of the backups and the restores, so the block sized
+// buffers are reused instead of being allocated for each block
+var blockBuffers = util.NewBufferPool(DEFAULT_BLOCK_SIZE)
+
+// GetBlockBufferPoolStats returns the usage of the block buffer pool
+func GetBlockBufferPoolStats() util.BufferPoolStats {
+	return blockBuffers.Stats()
+}
+
+// getBlockBuffer returns a pooled buffer and the block sized slice backed by the buffer
+func getBlockBuffer() (*bytes.Buffer, []byte) {
+	buf := blockBuffers.Get()
+	return buf, buf.Bytes()[:DEFAULT_BLOCK_SIZE]
 }
 
 type DeltaBlockBackupOperations interface {
@@ -116,11 +220,32 @@ type DeltaRestoreOperations interface {
 }
 
 // CreateDeltaBlockBackup creates a delta block backup for the given volume and snapshot.
+// If config.DestURLs is specified, the snapshot is read and compressed once and the blocks
+// are uploaded to all the backup targets. The volume must be compressed by the same method
+// in all the backup targets.
 func CreateDeltaBlockBackup(backupName string, config *DeltaBackupConfig) (isIncremental bool, err error) {
 	if config == nil {
 		return false, fmt.Errorf("BUG: invalid empty config for backup")
 	}
 
+	completion := newBackupCompletion(config)
+	async := false
+	defer func() {
+		if !async {
+			completion.summary.BackupName = backupName
+			completion.summary.IsIncremental = isIncremental
+			completion.complete(0, err)
+		}
+	}()
+	defer completion.handlePanic()
+
+	if config.Source != nil {
+		config.DeltaOps = newBlockSourceOperations(config.Source, config.DeltaOps)
+		if config.Volume != nil && config.Volume.Size == 0 {
+			config.Volume.Size = config.Source.Size()
+		}
+	}
+
 	volume := config.Volume
 	snapshot := config.Snapshot
 	destURL := config.DestURL
@@ -128,6 +253,19 @@ func CreateDeltaBlockBackup(backupName string, config *DeltaBackupConfig) (isInc
 	if deltaOps == nil {
 		return false, fmt.Errorf("BUG: missing DeltaBlockBackupOperations")
 	}
+	if config.NiceLevel < 0 || config.NiceLevel > util.MaxNiceLevel {
+		return false, fmt.Errorf("invalid nice level %v, must be between 0 and %v", config.NiceLevel, util.MaxNiceLevel)
+	}
+	memoryBudget, err := newMemoryBudget(config.MemoryBudget)
+	if err != nil {
+		return false, err
+	}
+	completion.budget = memoryBudget
+	if backupName == "" && config.NameTemplate != nil {
+		if err := config.NameTemplate.Validate(); err != nil {
+			return false, err
+		}
+	}
 
 	log := logrus.WithFields(logrus.Fields{
 		"volume":   volume,
@@ -142,29 +280,93 @@ func CreateDeltaBlockBackup(backupName string, config *DeltaBackupConfig) (isInc
 		}
 	}()
 
-	bsDriver, err := GetBackupStoreDriver(destURL)
-	if err != nil {
-		return false, err
-	}
+	targets := []*backupTarget{}
+	for _, destURL := range config.getDestURLs() {
+		bsDriver, err := GetBackupStoreDriver(destURL)
+		if err != nil {
+			return false, err
+		}
 
-	lock, err := New(bsDriver, volume.Name, BACKUP_LOCK)
-	if err != nil {
-		return false, err
-	}
+		lock, err := New(bsDriver, volume.Name, BACKUP_LOCK)
+		if err != nil {
+			return false, err
+		}
 
-	defer lock.Unlock()
-	if err := lock.Lock(); err != nil {
-		return false, err
-	}
+		defer lock.Unlock()
+		targetVolume, err := addVolumeForFirstBackup(bsDriver, volume, lock)
+		if err != nil {
+			return false, err
+		}
+		if targetVolume == nil {
+			if err := lock.Lock(); err != nil {
+				return false, err
+			}
+
+			// the new volume without a compression method takes the default of the backup target, or the
+			// recommended one if there is no default
+			newVolume := !volumeExists(bsDriver, volume.Name)
+			if volume.CompressionMethod == "" && newVolume {
+				volume.CompressionMethod = getTargetConfig(bsDriver).CompressionMethod
+				if volume.CompressionMethod == "" {
+					volume.CompressionMethod = getRecommendedCompressionMethod(bsDriver)
+				}
+			}
+			if newVolume {
+				if err := setNewVolumeBlockLayout(bsDriver, volume); err != nil {
+					return false, err
+				}
+			}
+
+			if err := addVolume(bsDriver, volume); err != nil {
+				return false, err
+			}
 
-	if err := addVolume(bsDriver, volume); err != nil {
+			if err := checkVolumeQuota(bsDriver, volume.Name, lock); err != nil {
+				return false, err
+			}
+
+			// Update volume from backupstore
+			if targetVolume, err = loadVolume(bsDriver, volume.Name); err != nil {
+				return false, err
+			}
+		} else if err := checkVolumeQuota(bsDriver, volume.Name, lock); err != nil {
+			// the new volume has no backups to prune, but the default quota of the backup target still applies
+			return false, err
+		}
+		if err := checkVolumeCompressionMigration(targetVolume); err != nil {
+			return false, err
+		}
+		if err := checkVolumeOwnership(targetVolume, config.ForceOwnership); err != nil {
+			return false, err
+		}
+
+		targets = append(targets, &backupTarget{
+			destURL:         destURL,
+			bsDriver:        bsDriver,
+			lock:            lock,
+			volume:          targetVolume,
+			blockFilter:     loadBlockFilterForBackup(bsDriver, targetVolume),
+			overwriteBlocks: config.ForceFullBackup,
+		})
+	}
+	if err := checkBackupTargetVolumes(targets); err != nil {
 		return false, err
 	}
+	// The settings in the first backup target take precedence
+	volume = targets[0].volume
+	if config.ConcurrentLimit == 0 {
+		config.ConcurrentLimit = getTargetConfig(targets[0].bsDriver).ConcurrentLimit
+	}
 
-	// Update volume from backupstore
-	volume, err = loadVolume(bsDriver, volume.Name)
-	if err != nil {
-		return false, err
+	if backupName == "" && config.NameTemplate != nil {
+		drivers := []BackupStoreDriver{}
+		for _, target := range targets {
+			drivers = append(drivers, target.bsDriver)
+		}
+		data := newBackupNameData(volume.Name, snapshot.Name, config.Labels)
+		if backupName, err = generateBackupName(drivers, config.NameTemplate, data); err != nil {
+			return false, err
+		}
 	}
 
 	config.Volume.CompressionMethod = volume.CompressionMethod
@@ -173,38 +375,31 @@ func CreateDeltaBlockBackup(backupName string, config *DeltaBackupConfig) (isInc
 	if err := deltaOps.OpenSnapshot(snapshot.Name, volume.Name); err != nil {
 		return false, err
 	}
+	if err := checkVolumeEncryptionPolicy(config, targets); err != nil {
+		deltaOps.CloseSnapshot(snapshot.Name, volume.Name)
+		return false, err
+	}
+	if err := skipCompressionForEncryptedVolume(config, targets); err != nil {
+		deltaOps.CloseSnapshot(snapshot.Name, volume.Name)
+		return false, err
+	}
+	if err := checkCompressionCanary(config.Volume.CompressionMethod); err != nil {
+		deltaOps.CloseSnapshot(snapshot.Name, volume.Name)
+		return false, err
+	}
 
-	backupRequest := &backupRequest{}
-	if volume.LastBackupName != "" {
-		lastBackupName := volume.LastBackupName
-		var backup, err = loadBackup(bsDriver, lastBackupName, volume.Name)
-		if err != nil {
-			log.WithFields(logrus.Fields{
-				LogFieldReason:  LogReasonFallback,
-				LogFieldEvent:   LogEventBackup,
-				LogFieldObject:  LogObjectBackup,
-				LogFieldBackup:  lastBackupName,
-				LogFieldVolume:  volume.Name,
-				LogFieldDestURL: destURL,
-			}).WithError(err).Info("Cannot find previous backup in backupstore")
-		} else if backup.SnapshotName == snapshot.Name {
-			// Generate full snapshot if the snapshot has been backed up last time
-			log.WithFields(logrus.Fields{
-				LogFieldReason:   LogReasonFallback,
-				LogFieldEvent:    LogEventCompare,
-				LogFieldObject:   LogObjectSnapshot,
-				LogFieldSnapshot: backup.SnapshotName,
-				LogFieldVolume:   volume.Name,
-			}).Info("Creating full snapshot config")
-		} else if backup.SnapshotName != "" && !deltaOps.HasSnapshot(backup.SnapshotName, volume.Name) {
-			log.WithFields(logrus.Fields{
-				LogFieldReason:   LogReasonFallback,
-				LogFieldObject:   LogObjectSnapshot,
-				LogFieldSnapshot: backup.SnapshotName,
-				LogFieldVolume:   volume.Name,
-			}).Info("Cannot find last snapshot in local storage")
-		} else {
-			backupRequest.lastBackup = backup
+	for _, target := range targets {
+		if config.ForceFullBackup {
+			continue
+		}
+		target.lastBackup = getLastBackupForIncrementalBackup(target, snapshot, deltaOps)
+	}
+	backupRequest := &backupRequest{
+		lastBackup: getCommonLastBackup(targets),
+	}
+	if !backupRequest.isIncrementalBackup() {
+		for _, target := range targets {
+			target.lastBackup = nil
 		}
 	}
 
@@ -251,30 +446,133 @@ func CreateDeltaBlockBackup(backupName string, config *DeltaBackupConfig) (isInc
 			blocks: map[string][]*BlockMapping{},
 		},
 	}
+	if IsBlockHeaderEnabled() {
+		deltaBackup.RequiredFeatures = []string{FeatureBlockHeader}
+	}
 
 	// keep lock alive for async go routine.
-	if err := lock.Lock(); err != nil {
-		deltaOps.CloseSnapshot(snapshot.Name, volume.Name)
-		return backupRequest.isIncrementalBackup(), err
+	for i, target := range targets {
+		if err := target.lock.Lock(); err != nil {
+			for _, locked := range targets[:i] {
+				locked.lock.Unlock()
+			}
+			deltaOps.CloseSnapshot(snapshot.Name, volume.Name)
+			return backupRequest.isIncrementalBackup(), err
+		}
 	}
+	completion.summary.BackupName = backupName
+	completion.summary.IsIncremental = backupRequest.isIncrementalBackup()
+	abortCtx, unregisterAbort := registerAbortable(runningBackups, getBackupAbortKey(volume.Name, backupName))
+	async = true
 	go func() {
+		aborted := false
+		// the aborted backup is cleaned up after the backup locks are released
+		defer func() {
+			if aborted {
+				cleanupAbortedBackup(targets, volume.Name)
+			}
+		}()
+		defer unregisterAbort()
 		defer deltaOps.CloseSnapshot(snapshot.Name, volume.Name)
-		defer lock.Unlock()
+		defer func() {
+			for _, target := range targets {
+				target.lock.Unlock()
+			}
+		}()
+		defer completion.handlePanic()
 
 		deltaOps.UpdateBackupStatus(snapshot.Name, volume.Name, string(types.ProgressStateInProgress), 0, "", "")
+		emitBackupEvent(EventBackupStarted, targets, config, backupName, 0)
+
+		delta = filterUnusedBlocks(config, delta)
+		completion.summary.ChangedBlockCount, _ = getTotalBackupBlockCounts(delta)
 
 		log.Info("Performing delta block backup")
-		if progress, backup, err := performBackup(bsDriver, config, delta, deltaBackup, backupRequest.lastBackup); err != nil {
+		progress, backup, err := performBackup(abortCtx, targets, config, delta, deltaBackup, memoryBudget)
+		aborted = IsAbortedError(err)
+		if err != nil {
 			logrus.WithError(err).Errorf("Failed to perform backup for volume %v snapshot %v", volume.Name, snapshot.Name)
+			for _, target := range targets {
+				target.setError(err)
+			}
 			deltaOps.UpdateBackupStatus(snapshot.Name, volume.Name, string(types.ProgressStateInProgress), progress, "", err.Error())
 		} else {
+			updateBackupCompressionStats(deltaOps, snapshot.Name, volume.Name, deltaBackup.CompressionStats)
 			deltaOps.UpdateBackupStatus(snapshot.Name, volume.Name, string(types.ProgressStateInProgress), progress, backup, "")
 		}
+		updateBackupTargetsStatus(deltaOps, snapshot.Name, volume.Name, targets)
+		emitBackupResultEvents(targets, config, backupName)
+
+		for _, target := range targets {
+			completion.summary.Targets = append(completion.summary.Targets, target.status())
+		}
+		completion.summary.BackupURL = backup
+		completion.summary.CompressionStats = deltaBackup.CompressionStats
+		completion.complete(progress, err)
 	}()
 	return backupRequest.isIncrementalBackup(), nil
 }
 
-func populateMappings(bsDriver BackupStoreDriver, config *DeltaBackupConfig, deltaBackup *Backup, delta *types.Mappings) (<-chan types.Mapping, <-chan error) {
+// getLastBackupForIncrementalBackup returns the last backup on the backup target
+// which can be used as the base of the incremental backup, or nil for a full backup.
+func getLastBackupForIncrementalBackup(target *backupTarget, snapshot *Snapshot, deltaOps DeltaBlockBackupOperations) *Backup {
+	volume := target.volume
+	if volume.LastBackupName == "" {
+		return nil
+	}
+
+	lastBackupName := volume.LastBackupName
+	backup, err := loadBackup(target.bsDriver, lastBackupName, volume.Name)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			LogFieldReason:  LogReasonFallback,
+			LogFieldEvent:   LogEventBackup,
+			LogFieldObject:  LogObjectBackup,
+			LogFieldBackup:  lastBackupName,
+			LogFieldVolume:  volume.Name,
+			LogFieldDestURL: target.destURL,
+		}).WithError(err).Info("Cannot find previous backup in backupstore")
+		return nil
+	}
+
+	if backup.Broken != "" {
+		log.WithFields(logrus.Fields{
+			LogFieldReason:  LogReasonFallback,
+			LogFieldEvent:   LogEventBackup,
+			LogFieldObject:  LogObjectBackup,
+			LogFieldBackup:  lastBackupName,
+			LogFieldVolume:  volume.Name,
+			LogFieldDestURL: target.destURL,
+		}).Infof("Previous backup is broken: %v", backup.Broken)
+		return nil
+	}
+
+	if backup.SnapshotName == snapshot.Name {
+		// Generate full snapshot if the snapshot has been backed up last time
+		log.WithFields(logrus.Fields{
+			LogFieldReason:   LogReasonFallback,
+			LogFieldEvent:    LogEventCompare,
+			LogFieldObject:   LogObjectSnapshot,
+			LogFieldSnapshot: backup.SnapshotName,
+			LogFieldVolume:   volume.Name,
+		}).Info("Creating full snapshot config")
+		return nil
+	}
+
+	if backup.SnapshotName != "" && !deltaOps.HasSnapshot(backup.SnapshotName, volume.Name) {
+		log.WithFields(logrus.Fields{
+			LogFieldReason:   LogReasonFallback,
+			LogFieldObject:   LogObjectSnapshot,
+			LogFieldSnapshot: backup.SnapshotName,
+			LogFieldVolume:   volume.Name,
+		}).Info("Cannot find last snapshot in local storage")
+		return nil
+	}
+
+	return backup
+}
+
+func populateMappings(ctx context.Context, config *DeltaBackupConfig, deltaBackup *Backup, delta *types.Mappings) (<-chan types.Mapping, <-chan error) {
 	mappingChan := make(chan types.Mapping, 1)
 	errChan := make(chan error, 1)
 
@@ -283,7 +581,12 @@ func populateMappings(bsDriver BackupStoreDriver, config *DeltaBackupConfig, del
 		defer close(errChan)
 
 		for _, mapping := range delta.Mappings {
-			mappingChan <- mapping
+			select {
+			case <-ctx.Done():
+				// the readers are gone after the backup failed or was aborted
+				return
+			case mappingChan <- mapping:
+			}
 		}
 	}()
 
@@ -321,7 +624,9 @@ func updateBlocksAndProgress(deltaBackup *Backup, progress *progress, checksum s
 
 	// Update deltaBackup.Blocks
 	blocks := processingBlocks.blocks[checksum]
+	compressionMethod := processingBlocks.compressionMethods[checksum]
 	for _, block := range blocks {
+		block.CompressionMethod = compressionMethod
 		deltaBackup.Blocks = append(deltaBackup.Blocks, *block)
 	}
 
@@ -335,20 +640,49 @@ func updateBlocksAndProgress(deltaBackup *Backup, progress *progress, checksum s
 		}
 		progress.processedBlockCounts += int64(len(blocks))
 		progress.progress = getProgress(progress.totalBlockCounts, progress.processedBlockCounts)
+		progress.reportLockProgress()
 	}()
 
 	delete(processingBlocks.blocks, checksum)
+	delete(processingBlocks.compressionMethods, checksum)
 }
 
-func backupBlock(bsDriver BackupStoreDriver, config *DeltaBackupConfig,
-	deltaBackup *Backup, offset int64, block []byte, progress *progress) error {
-	var err error
-	newBlock := false
-	volume := config.Volume
-	snapshot := config.Snapshot
-	deltaOps := config.DeltaOps
+// setBlockCompressionMethod records the compression method of the block being processed if it differs from the one
+// of the backup, the blocks are completed with it
+func setBlockCompressionMethod(deltaBackup *Backup, checksum, compressionMethod string) {
+	processingBlocks := deltaBackup.ProcessingBlocks
+
+	processingBlocks.Lock()
+	defer processingBlocks.Unlock()
+
+	if processingBlocks.compressionMethods == nil {
+		processingBlocks.compressionMethods = map[string]string{}
+	}
+	processingBlocks.compressionMethods[checksum] = compressionMethod
+}
 
-	checksum := util.GetChecksum(block)
+// blockBackupJob is a block passing through the read, compress and upload stages of the backup
+type blockBackupJob struct {
+	offset   int64
+	checksum string
+	// data is the block read from the snapshot, backed by buf
+	data []byte
+	buf  *bytes.Buffer
+	// compressed is the compressed data filled by the compress stage
+	compressed *bytes.Buffer
+	// compressionMethod is set by the compress stage if the block isn't compressed by the method of the backup
+	compressionMethod string
+	// targets are the backup targets which don't have the block yet
+	targets []*backupTarget
+	// budget holds the bytes reserved for the buffers of the block, which are released as the buffers are returned
+	budget *util.MemoryBudget
+}
+
+// prepareBlock returns the backup targets the block needs to be uploaded to. No target is returned
+// if the block is being processed by another goroutine or exists in all the backup targets.
+func prepareBlock(targets []*backupTarget, config *DeltaBackupConfig,
+	deltaBackup *Backup, offset int64, checksum string, progress *progress) []*backupTarget {
+	volume := config.Volume
 
 	// This prevents multiple goroutines from trying to upload blocks that contain identical contents
 	// with the same checksum but different offsets).
@@ -357,65 +691,176 @@ func backupBlock(bsDriver BackupStoreDriver, config *DeltaBackupConfig,
 		return nil
 	}
 
-	defer func() {
-		if err != nil {
-			return
+	missingTargets := []*backupTarget{}
+	for _, target := range getActiveBackupTargets(targets) {
+		// the block never seen by the block filter is uploaded without the check, and every block is uploaded
+		// again by the forced full backup
+		if config.ForceFullBackup || (target.blockFilter != nil && !target.blockFilter.mayContain(checksum)) {
+			missingTargets = append(missingTargets, target)
+			continue
 		}
-		deltaBackup.Lock()
-		defer deltaBackup.Unlock()
-		updateBlocksAndProgress(deltaBackup, progress, checksum, newBlock)
-		deltaOps.UpdateBackupStatus(snapshot.Name, volume.Name, string(types.ProgressStateInProgress), progress.progress, "", "")
-	}()
-
-	blkFile := getBlockFilePath(volume.Name, checksum)
-	if bsDriver.FileExists(blkFile) {
-		log.Debugf("Found existing block matching at %v", blkFile)
+		blkFile := getBlockFilePath(target.bsDriver, volume.Name, checksum)
+		if target.bsDriver.FileExists(blkFile) {
+			log.Debugf("Found existing block matching at %v in %v", blkFile, target.destURL)
+			continue
+		}
+		missingTargets = append(missingTargets, target)
+	}
+	if len(missingTargets) == 0 {
+		completeBlock(targets, config, deltaBackup, progress, checksum, false)
 		return nil
 	}
+	return missingTargets
+}
 
-	log.Tracef("Creating new block file at %v", blkFile)
-	newBlock = true
-	rs, err := util.CompressData(deltaBackup.CompressionMethod, block)
-	if err != nil {
-		return err
+func completeBlock(targets []*backupTarget, config *DeltaBackupConfig, deltaBackup *Backup, progress *progress, checksum string, newBlock bool) {
+	deltaBackup.Lock()
+	defer deltaBackup.Unlock()
+	updateBlocksAndProgress(deltaBackup, progress, checksum, newBlock)
+	config.DeltaOps.UpdateBackupStatus(config.Snapshot.Name, config.Volume.Name, string(types.ProgressStateInProgress), progress.progress, "", "")
+
+	// the blocks are completed one at a time under the backup lock
+	if milestone := progress.progress / EVENT_PROGRESS_MILESTONE; milestone > progress.milestone {
+		progress.milestone = milestone
+		emitBackupEvent(EventBlocksUploaded, targets, config, deltaBackup.Name, progress.progress)
+	}
+}
+
+func uploadBlock(targets []*backupTarget, config *DeltaBackupConfig,
+	deltaBackup *Backup, job *blockBackupJob, progress *progress, quarantine *blockQuarantine) error {
+	volume := config.Volume
+	checksum := job.checksum
+
+	log.Tracef("Creating new block file for checksum %v", checksum)
+	data := job.compressed.Bytes()
+	if job.compressionMethod != "" {
+		setBlockCompressionMethod(deltaBackup, checksum, job.compressionMethod)
+	}
+	failed := map[*backupTarget]error{}
+	if len(job.targets) == 1 {
+		target := job.targets[0]
+		if err := target.writeBlock(getBlockFilePath(target.bsDriver, volume.Name, checksum), data); err != nil {
+			failed[target] = err
+		} else {
+			target.addNewBlock(checksum)
+		}
+	} else {
+		// Upload the compressed block to the backup targets concurrently,
+		// a failed backup target doesn't fail the backups on the other targets.
+		var (
+			wg   sync.WaitGroup
+			lock sync.Mutex
+		)
+		for _, target := range job.targets {
+			wg.Add(1)
+			go func(target *backupTarget) {
+				defer wg.Done()
+				blkFile := getBlockFilePath(target.bsDriver, volume.Name, checksum)
+				if err := target.writeBlock(blkFile, data); err != nil {
+					lock.Lock()
+					failed[target] = err
+					lock.Unlock()
+					return
+				}
+				target.addNewBlock(checksum)
+			}(target)
+		}
+		wg.Wait()
+	}
+
+	if len(failed) > 0 && quarantine.add(job, failed) {
+		// the block is retried at the end of the backup pass
+		log.Warnf("Quarantined block at offset %v checksum %v failed to upload to %v backup targets",
+			job.offset, checksum, len(failed))
+		return nil
 	}
+	blockBuffers.Put(job.compressed)
+	job.budget.Release(DEFAULT_BLOCK_SIZE)
 
-	return bsDriver.Write(blkFile, rs)
+	for target, err := range failed {
+		if len(targets) == 1 {
+			return err
+		}
+		blkFile := getBlockFilePath(target.bsDriver, volume.Name, checksum)
+		logrus.WithError(err).Errorf("Failed to upload block %v to backup target %v", blkFile, target.destURL)
+		target.setError(errors.Wrapf(err, "failed to upload block %v", blkFile))
+	}
+	if len(getActiveBackupTargets(targets)) == 0 {
+		return fmt.Errorf("failed to upload block %v to all backup targets", checksum)
+	}
+	completeBlock(targets, config, deltaBackup, progress, checksum, true)
+	return nil
 }
 
-func backupMapping(bsDriver BackupStoreDriver, config *DeltaBackupConfig,
-	deltaBackup *Backup, blockSize int64, mapping types.Mapping, progress *progress) error {
+// backupMapping reads the blocks of the mapping and sends the blocks which need to be uploaded to the compress stage
+func backupMapping(ctx context.Context, targets []*backupTarget, config *DeltaBackupConfig, deltaBackup *Backup,
+	blockSize int64, mapping types.Mapping, progress *progress, crcIndex blockCRCIndex, out chan<- *blockBackupJob) error {
 	volume := config.Volume
 	snapshot := config.Snapshot
 	deltaOps := config.DeltaOps
 
-	block := make([]byte, DEFAULT_BLOCK_SIZE)
+	// the block and its compressed copy are reserved in the memory budget before reading the block, so the
+	// following stages never wait for the budget
+	if progress.budget.Reserve(ctx, blockJobBytes) != nil {
+		return nil
+	}
+	buf, block := getBlockBuffer()
+	defer func() {
+		if buf != nil {
+			blockBuffers.Put(buf)
+			progress.budget.Release(blockJobBytes)
+		}
+	}()
 	blkCounts := mapping.Size / blockSize
 
 	for i := int64(0); i < blkCounts; i++ {
 		log.Tracef("Backup for %v: segment %+v, blocks %v/%v", snapshot.Name, mapping, i+1, blkCounts)
 		offset := mapping.Offset + i*blockSize
+		if prepareRevertedBlock(targets, config, deltaBackup, offset, progress, crcIndex) {
+			continue
+		}
 		if err := deltaOps.ReadSnapshot(snapshot.Name, volume.Name, offset, block); err != nil {
 			logrus.WithError(err).Errorf("Failed to read volume %v snapshot %v block at offset %v size %v",
 				volume.Name, snapshot.Name, offset, len(block))
 			return err
 		}
 
-		if err := backupBlock(bsDriver, config, deltaBackup, offset, block, progress); err != nil {
-			logrus.WithError(err).Errorf("Failed to back up volume %v snapshot %v block at offset %v size %v",
-				volume.Name, snapshot.Name, offset, len(block))
-			return err
+		checksum := util.GetChecksum(block)
+		missingTargets := prepareBlock(targets, config, deltaBackup, offset, checksum, progress)
+		if len(missingTargets) == 0 {
+			continue
 		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case out <- &blockBackupJob{
+			offset:   offset,
+			checksum: checksum,
+			data:     block,
+			buf:      buf,
+			targets:  missingTargets,
+			budget:   progress.budget,
+		}:
+		}
+		// The buffer is owned by the compress stage now
+		buf = nil
+		if progress.budget.Reserve(ctx, blockJobBytes) != nil {
+			return nil
+		}
+		buf, block = getBlockBuffer()
 	}
 
 	return nil
 }
 
-func backupMappings(ctx context.Context, bsDriver BackupStoreDriver, config *DeltaBackupConfig,
-	deltaBackup *Backup, blockSize int64, progress *progress, in <-chan types.Mapping) <-chan error {
+func backupMappings(ctx context.Context, targets []*backupTarget, config *DeltaBackupConfig, deltaBackup *Backup, blockSize int64,
+	progress *progress, crcIndex blockCRCIndex, in <-chan types.Mapping, out chan<- *blockBackupJob, wg *sync.WaitGroup) <-chan error {
 	errChan := make(chan error, 1)
 
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		defer close(errChan)
 		for {
 			select {
@@ -426,7 +871,124 @@ func backupMappings(ctx context.Context, bsDriver BackupStoreDriver, config *Del
 					return
 				}
 
-				if err := backupMapping(bsDriver, config, deltaBackup, blockSize, mapping, progress); err != nil {
+				if err := backupMapping(ctx, targets, config, deltaBackup, blockSize, mapping, progress, crcIndex, out); err != nil {
+					errChan <- err
+					return
+				}
+			}
+		}
+	}()
+
+	return errChan
+}
+
+// compressThread sets up the OS thread of a compression worker
+type compressThread struct {
+	worker    int
+	niceLevel int
+	hook      func(worker int) error
+}
+
+// setup locks the worker to the thread if the thread is set up. The thread stays locked, so it's terminated
+// with the goroutine instead of running the other goroutines at the lowered priority or the set affinity.
+func (t *compressThread) setup() {
+	if t == nil || (t.niceLevel == 0 && t.hook == nil) {
+		return
+	}
+	runtime.LockOSThread()
+	if t.niceLevel > 0 {
+		if err := util.SetThreadNiceLevel(t.niceLevel); err != nil {
+			logrus.WithError(err).Warnf("Failed to set nice level %v of compression worker", t.niceLevel)
+		}
+	}
+	if t.hook != nil {
+		if err := t.hook(t.worker); err != nil {
+			logrus.WithError(err).Warnf("Failed to run hook of compression worker %v", t.worker)
+		}
+	}
+}
+
+func compressBlocks(ctx context.Context, compressionMethod string, thread *compressThread, limiter *rateLimiter,
+	stats *compressionStatsCollector, in <-chan *blockBackupJob, out chan<- *blockBackupJob, wg *sync.WaitGroup) <-chan error {
+	errChan := make(chan error, 1)
+
+	compressor, err := util.GetCompressor(compressionMethod)
+	if err != nil {
+		errChan <- err
+		close(errChan)
+		return errChan
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(errChan)
+		thread.setup()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case job, open := <-in:
+				if !open {
+					return
+				}
+
+				limiter.wait(int64(len(job.data)))
+				buf := blockBuffers.Get()
+				writeBlockHeader(buf, compressionMethod, len(job.data))
+				err := compressor.Compress(buf, bytes.NewReader(job.data))
+				if errors.Is(err, util.ErrIncompressible) {
+					// the block refused by the compressor is stored uncompressed
+					buf.Reset()
+					writeBlockHeader(buf, "none", len(job.data))
+					_, err = buf.Write(job.data)
+					job.compressionMethod = "none"
+				}
+				if err == nil {
+					stats.record(len(job.data), buf.Len())
+				}
+				blockBuffers.Put(job.buf)
+				job.budget.Release(DEFAULT_BLOCK_SIZE)
+				job.data, job.buf = nil, nil
+				if err != nil {
+					logrus.WithError(err).Errorf("Failed to compress block at offset %v", job.offset)
+					blockBuffers.Put(buf)
+					job.budget.Release(DEFAULT_BLOCK_SIZE)
+					errChan <- err
+					return
+				}
+				job.compressed = buf
+
+				select {
+				case <-ctx.Done():
+					return
+				case out <- job:
+				}
+			}
+		}
+	}()
+
+	return errChan
+}
+
+func uploadBlocks(ctx context.Context, targets []*backupTarget, config *DeltaBackupConfig,
+	deltaBackup *Backup, progress *progress, quarantine *blockQuarantine, in <-chan *blockBackupJob) <-chan error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer close(errChan)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case job, open := <-in:
+				if !open {
+					return
+				}
+
+				if err := uploadBlock(targets, config, deltaBackup, job, progress, quarantine); err != nil {
+					logrus.WithError(err).Errorf("Failed to back up volume %v snapshot %v block at offset %v",
+						config.Volume.Name, config.Snapshot.Name, job.offset)
 					errChan <- err
 					return
 				}
@@ -437,6 +999,35 @@ func backupMappings(ctx context.Context, bsDriver BackupStoreDriver, config *Del
 	return errChan
 }
 
+// getCompressConcurrentLimit returns the number of the compression workers. There are never more workers than
+// GOMAXPROCS, since the extra ones only take the CPU from the volume I/O without compressing any faster.
+func getCompressConcurrentLimit(config *DeltaBackupConfig) int32 {
+	maxProcs := int32(runtime.GOMAXPROCS(0))
+	if config.CompressConcurrentLimit > 0 && config.CompressConcurrentLimit < maxProcs {
+		return config.CompressConcurrentLimit
+	}
+	return maxProcs
+}
+
+// getUploadConcurrentLimit returns the number of the upload workers, and sets up the adaptive concurrency
+// of the backup targets if enabled
+func getUploadConcurrentLimit(targets []*backupTarget, config *DeltaBackupConfig) int32 {
+	if !config.AdaptiveConcurrency {
+		return config.ConcurrentLimit
+	}
+	maxConcurrentLimit := config.MaxConcurrentLimit
+	if maxConcurrentLimit <= 0 {
+		maxConcurrentLimit = DEFAULT_MAX_CONCURRENT_LIMIT_FACTOR * config.ConcurrentLimit
+	}
+	if maxConcurrentLimit < config.ConcurrentLimit {
+		maxConcurrentLimit = config.ConcurrentLimit
+	}
+	for _, target := range targets {
+		target.limiter = util.NewAIMDLimiter(int(config.ConcurrentLimit), 1, int(maxConcurrentLimit))
+	}
+	return maxConcurrentLimit
+}
+
 func getTotalBackupBlockCounts(delta *types.Mappings) (int64, error) {
 	totalBlockCounts := int64(0)
 	for _, d := range delta.Mappings {
@@ -450,43 +1041,47 @@ func getTotalBackupBlockCounts(delta *types.Mappings) (int64, error) {
 }
 
 func sortBackupBlocks(blocks []BlockMapping, volumeSize, blockSize int64) []BlockMapping {
-	sortedBlocks := make([]string, volumeSize/blockSize)
+	sortedBlocks := make([]BlockMapping, volumeSize/blockSize)
 	for _, block := range blocks {
 		i := block.Offset / blockSize
-		sortedBlocks[i] = block.BlockChecksum
+		sortedBlocks[i] = block
 	}
 
 	blockMappings := []BlockMapping{}
-	for i, checksum := range sortedBlocks {
-		if checksum != "" {
-			blockMappings = append(blockMappings, BlockMapping{
-				Offset:        int64(i) * blockSize,
-				BlockChecksum: checksum,
-			})
+	for i, block := range sortedBlocks {
+		if block.BlockChecksum != "" {
+			block.Offset = int64(i) * blockSize
+			blockMappings = append(blockMappings, block)
 		}
 	}
 
 	return blockMappings
 }
 
-// performBackup if lastBackup is present we will do an incremental backup
-func performBackup(bsDriver BackupStoreDriver, config *DeltaBackupConfig, delta *types.Mappings, deltaBackup *Backup, lastBackup *Backup) (int, string, error) {
+// performBackup if the lastBackup of the backup targets is present we will do an incremental backup.
+// It returns the backup URL of the first succeeded backup target.
+func performBackup(abortCtx context.Context, targets []*backupTarget, config *DeltaBackupConfig, delta *types.Mappings,
+	deltaBackup *Backup, budget *util.MemoryBudget) (int, string, error) {
 	volume := config.Volume
 	snapshot := config.Snapshot
-	destURL := config.DestURL
 	concurrentLimit := config.ConcurrentLimit
 
 	// create an in progress backup config file
-	if err := saveBackup(bsDriver, &Backup{
-		Name:              deltaBackup.Name,
-		VolumeName:        deltaBackup.VolumeName,
-		CompressionMethod: volume.CompressionMethod,
-		CreatedTime:       "",
-	}); err != nil {
-		return 0, "", err
+	for _, target := range targets {
+		if err := saveBackup(target.bsDriver, &Backup{
+			Name:              deltaBackup.Name,
+			VolumeName:        deltaBackup.VolumeName,
+			CompressionMethod: volume.CompressionMethod,
+			CreatedTime:       "",
+		}); err != nil {
+			target.setError(err)
+		}
+	}
+	if len(getActiveBackupTargets(targets)) == 0 {
+		return 0, "", targets[0].err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(abortCtx)
 	defer cancel()
 
 	totalBlockCounts, err := getTotalBackupBlockCounts(delta)
@@ -498,68 +1093,188 @@ func performBackup(bsDriver BackupStoreDriver, config *DeltaBackupConfig, delta
 
 	progress := &progress{
 		totalBlockCounts: totalBlockCounts,
+		budget:           budget,
+	}
+	for _, target := range targets {
+		progress.locks = append(progress.locks, target.lock)
 	}
 
-	mappingChan, errChan := populateMappings(bsDriver, config, deltaBackup, delta)
+	// The blocks are read, compressed and uploaded in separate stages, so the CPU bound
+	// compression and the IO bound upload don't throttle each other. The stages don't run more
+	// workers than the blocks fitting into the memory budget.
+	concurrentLimit = capConcurrentLimit(concurrentLimit, budget, blockJobBytes)
+	compressConcurrentLimit := capConcurrentLimit(getCompressConcurrentLimit(config), budget, blockJobBytes)
+	compressChan := make(chan *blockBackupJob, compressConcurrentLimit)
+	uploadChan := make(chan *blockBackupJob, concurrentLimit)
+
+	crcIndex := getBlockCRCIndex(targets, config)
+	mappingChan, errChan := populateMappings(ctx, config, deltaBackup, delta)
 
 	errorChans := []<-chan error{errChan}
+	var readWg sync.WaitGroup
 	for i := 0; i < int(concurrentLimit); i++ {
-		errorChans = append(errorChans, backupMappings(ctx, bsDriver, config,
-			deltaBackup, delta.BlockSize, progress, mappingChan))
+		errorChans = append(errorChans, backupMappings(ctx, targets, config,
+			deltaBackup, delta.BlockSize, progress, crcIndex, mappingChan, compressChan, &readWg))
+	}
+	go func() {
+		readWg.Wait()
+		close(compressChan)
+	}()
+
+	var compressWg sync.WaitGroup
+	compressLimiter := newRateLimiter(config.CompressRateLimit)
+	compressionStats := newCompressionStatsCollector(deltaBackup.CompressionMethod)
+	for i := 0; i < int(compressConcurrentLimit); i++ {
+		thread := &compressThread{worker: i, niceLevel: config.NiceLevel, hook: config.CompressWorkerHook}
+		errorChans = append(errorChans, compressBlocks(ctx, deltaBackup.CompressionMethod, thread,
+			compressLimiter, compressionStats, compressChan, uploadChan, &compressWg))
+	}
+	go func() {
+		compressWg.Wait()
+		close(uploadChan)
+	}()
+
+	quarantine := newBlockQuarantine(getBlockQuarantineLimit(budget))
+	uploadConcurrentLimit := capConcurrentLimit(getUploadConcurrentLimit(targets, config), budget, DEFAULT_BLOCK_SIZE)
+	for i := 0; i < int(uploadConcurrentLimit); i++ {
+		errorChans = append(errorChans, uploadBlocks(ctx, targets, config, deltaBackup, progress, quarantine, uploadChan))
 	}
 
 	mergedErrChan := mergeErrorChannels(ctx, errorChans...)
 	err = <-mergedErrChan
+	if err == nil && abortCtx.Err() == nil {
+		err = retryQuarantinedBlocks(targets, config, deltaBackup, progress, quarantine)
+	} else {
+		quarantine.release()
+	}
+	if abortCtx.Err() != nil {
+		err = &AbortedError{Operation: "backup", VolumeName: volume.Name, BackupName: deltaBackup.Name}
+		markBackupAborted(targets, deltaBackup)
+	}
 
 	if err != nil {
 		logrus.WithError(err).Errorf("Failed to backup volume %v snapshot %v", volume.Name, snapshot.Name)
+		for _, target := range targets {
+			target.setError(err)
+		}
 		return progress.progress, "", err
 	}
 
-	log.WithFields(logrus.Fields{
-		LogFieldReason:   LogReasonComplete,
-		LogFieldEvent:    LogEventBackup,
-		LogFieldObject:   LogObjectSnapshot,
-		LogFieldSnapshot: snapshot.Name,
-	}).Infof("Created snapshot changed blocks: %v mappings, %v blocks and %v new blocks",
-		len(delta.Mappings), progress.totalBlockCounts, progress.newBlockCounts)
+	log.WithFields(logrus.Fields{
+		LogFieldReason:   LogReasonComplete,
+		LogFieldEvent:    LogEventBackup,
+		LogFieldObject:   LogObjectSnapshot,
+		LogFieldSnapshot: snapshot.Name,
+	}).Infof("Created snapshot changed blocks: %v mappings, %v blocks, %v new blocks and %v reverted blocks",
+		len(delta.Mappings), progress.totalBlockCounts, progress.newBlockCounts, progress.revertedBlockCounts)
+
+	for _, target := range targets {
+		if target.limiter != nil {
+			log.Debugf("Adaptive upload concurrency to backup target %v ended at %v", target.destURL, target.limiter.Limit())
+		}
+	}
+
+	bufferStats := blockBuffers.Stats()
+	log.Debugf("Block buffer pool: %v gets, hit rate %.2f, peak in use %v bytes",
+		bufferStats.Gets, bufferStats.HitRate, bufferStats.PeakInUseBytes)
+
+	deltaBackup.Blocks = sortBackupBlocks(deltaBackup.Blocks, volume.Size, delta.BlockSize)
+	deltaBackup.CompressionStats = compressionStats.summary()
+	deltaBackup.BlockCRCs = getBackupBlockCRCs(config, deltaBackup.Blocks)
+
+	backupURL := ""
+	for _, target := range getActiveBackupTargets(targets) {
+		if err := finalizeBackup(target, config, deltaBackup); err != nil {
+			logrus.WithError(err).Errorf("Failed to finalize backup for volume %v snapshot %v in %v",
+				volume.Name, snapshot.Name, target.destURL)
+			target.setError(err)
+			continue
+		}
+		if backupURL == "" {
+			backupURL = target.backupURL
+		}
+	}
+	if backupURL == "" {
+		return progress.progress, "", targets[0].err
+	}
+
+	return PROGRESS_PERCENTAGE_BACKUP_TOTAL, backupURL, nil
+}
 
-	deltaBackup.Blocks = sortBackupBlocks(deltaBackup.Blocks, volume.Size, delta.BlockSize)
+// finalizeBackup saves the completed backup config and updates the volume config in the backup target
+func finalizeBackup(target *backupTarget, config *DeltaBackupConfig, deltaBackup *Backup) error {
+	bsDriver := target.bsDriver
+	snapshot := config.Snapshot
 
-	backup := mergeSnapshotMap(deltaBackup, lastBackup)
+	// the last backup is referenced by the volume, the crashed commit of it is rolled forward
+	if isBackupPrepared(target.lastBackup) {
+		if err := commitBackup(bsDriver, target.lastBackup); err != nil {
+			return err
+		}
+	}
+
+	backup := mergeSnapshotMap(deltaBackup, target.lastBackup)
 	backup.SnapshotName = snapshot.Name
 	backup.SnapshotCreatedAt = snapshot.CreatedTime
-	backup.CreatedTime = util.Now()
+	backup.SnapshotChecksum = snapshot.Checksum
+	backup.Prepared = util.Now()
 	backup.Size = int64(len(backup.Blocks)) * DEFAULT_BLOCK_SIZE
 	backup.Labels = config.Labels
-	backup.IsIncremental = lastBackup != nil
+	backup.IsIncremental = target.lastBackup != nil
+	backup.ChainBase = config.ForceFullBackup
+	backup.CreatedBy = Version
+	backup.ComplianceMode = getComplianceMode()
 
+	// prepare, the backup stays in progress until the volume references it
 	if err := saveBackup(bsDriver, backup); err != nil {
-		return progress.progress, "", err
+		return err
+	}
+	if err := saveBackupProvenance(bsDriver, backup, target.destURL); err != nil {
+		return err
+	}
+	// the block filter only saves the checks of the blocks, so the backup doesn't fail without it
+	if target.blockFilter != nil {
+		if err := saveBlockFilter(bsDriver, config.Volume.Name, target.blockFilter); err != nil {
+			log.WithError(err).Warnf("Failed to save block filter in %v", target.destURL)
+		}
 	}
 
-	volume, err = loadVolume(bsDriver, volume.Name)
+	record := &volumeRecord{
+		BackupName:           backup.Name,
+		BackupAt:             backup.SnapshotCreatedAt,
+		NewBlockCount:        target.newBlockCounts,
+		Size:                 config.Volume.Size,
+		Labels:               config.Labels,
+		BackingImageName:     config.Volume.BackingImageName,
+		BackingImageChecksum: config.Volume.BackingImageChecksum,
+		CompressionMethod:    config.Volume.CompressionMethod,
+		StorageClassName:     config.Volume.StorageClassName,
+		BackendStoreDriver:   config.Volume.BackendStoreDriver,
+		LastWriter:           getLastWriter(),
+	}
+	var (
+		volume *Volume
+		err    error
+	)
+	if IsVolumeRecordsEnabled() {
+		volume, err = addVolumeRecord(bsDriver, config.Volume.Name, record)
+	} else {
+		volume, err = updateVolume(bsDriver, config.Volume.Name, func(volume *Volume) error {
+			record.apply(volume)
+			return nil
+		})
+	}
 	if err != nil {
-		return progress.progress, "", err
+		return err
 	}
 
-	volume.LastBackupName = backup.Name
-	volume.LastBackupAt = backup.SnapshotCreatedAt
-	volume.BlockCount = volume.BlockCount + progress.newBlockCounts
-	// The volume may be expanded
-	volume.Size = config.Volume.Size
-	volume.Labels = config.Labels
-	volume.BackingImageName = config.Volume.BackingImageName
-	volume.BackingImageChecksum = config.Volume.BackingImageChecksum
-	volume.CompressionMethod = config.Volume.CompressionMethod
-	volume.StorageClassName = config.Volume.StorageClassName
-	volume.BackendStoreDriver = config.Volume.BackendStoreDriver
-
-	if err := saveVolume(bsDriver, volume); err != nil {
-		return progress.progress, "", err
+	// the backup is committed by the volume update, it's rolled forward by the next backup or deletion if this fails
+	if err := commitBackup(bsDriver, backup); err != nil {
+		return err
 	}
 
-	return PROGRESS_PERCENTAGE_BACKUP_TOTAL, EncodeBackupURL(backup.Name, volume.Name, destURL), nil
+	target.backupURL = EncodeBackupURL(backup.Name, volume.Name, target.destURL)
+	return nil
 }
 
 func mergeSnapshotMap(deltaBackup, lastBackup *Backup) *Backup {
@@ -571,8 +1286,15 @@ func mergeSnapshotMap(deltaBackup, lastBackup *Backup) *Backup {
 		VolumeName:        deltaBackup.VolumeName,
 		SnapshotName:      deltaBackup.SnapshotName,
 		CompressionMethod: deltaBackup.CompressionMethod,
+		CompressionStats:  deltaBackup.CompressionStats,
+		BlockCRCs:         deltaBackup.BlockCRCs,
+		RequiredFeatures:  deltaBackup.RequiredFeatures,
 		Blocks:            []BlockMapping{},
 	}
+	// the blocks of the last backup may have the header
+	if hasFeature(lastBackup.RequiredFeatures, FeatureBlockHeader) {
+		backup.RequiredFeatures = addFeature(backup.RequiredFeatures, FeatureBlockHeader)
+	}
 	var d, l int
 	for d, l = 0, 0; d < len(deltaBackup.Blocks) && l < len(lastBackup.Blocks); {
 		dB := deltaBackup.Blocks[d]
@@ -607,11 +1329,19 @@ func mergeSnapshotMap(deltaBackup, lastBackup *Backup) *Backup {
 }
 
 // RestoreDeltaBlockBackup restores a delta block backup for the given configuration
-func RestoreDeltaBlockBackup(config *DeltaRestoreConfig) error {
+func RestoreDeltaBlockBackup(config *DeltaRestoreConfig) (err error) {
 	if config == nil {
 		return fmt.Errorf("invalid empty config for restore")
 	}
 
+	completion := newRestoreCompletion(config)
+	defer func() {
+		if err != nil {
+			completion.complete(0, nil, err)
+		}
+	}()
+	defer completion.handlePanic()
+
 	volDevName := config.Filename
 	backupURL := config.BackupURL
 	concurrentLimit := config.ConcurrentLimit
@@ -624,6 +1354,9 @@ func RestoreDeltaBlockBackup(config *DeltaRestoreConfig) error {
 	if err != nil {
 		return err
 	}
+	if concurrentLimit == 0 {
+		concurrentLimit = getTargetConfig(bsDriver).RestoreConcurrentLimit
+	}
 
 	srcBackupName, srcVolumeName, _, err := DecodeBackupURL(backupURL)
 	if err != nil {
@@ -651,6 +1384,28 @@ func RestoreDeltaBlockBackup(config *DeltaRestoreConfig) error {
 	if vol.Size == 0 || vol.Size%DEFAULT_BLOCK_SIZE != 0 {
 		return fmt.Errorf("invalid volume size %v", vol.Size)
 	}
+	if err := checkVolumeCompressionMigration(vol); err != nil {
+		return err
+	}
+	coalesceBlocks, err := getRestoreCoalesceBlocks(config)
+	if err != nil {
+		return err
+	}
+	zeroStrategy, err := getZeroBlockStrategy(config)
+	if err != nil {
+		return err
+	}
+	outputFormat, err := getRestoreOutputFormat(config)
+	if err != nil {
+		return err
+	}
+	workerBytes := getRestoreWorkerBytes(coalesceBlocks)
+	memoryBudget, err := newRestoreMemoryBudget(config, workerBytes)
+	if err != nil {
+		return err
+	}
+	completion.budget = memoryBudget
+	concurrentLimit = capConcurrentLimit(concurrentLimit, memoryBudget, workerBytes)
 
 	volDev, volDevPath, err := deltaOps.OpenVolumeDev(volDevName)
 	if err != nil {
@@ -671,6 +1426,21 @@ func RestoreDeltaBlockBackup(config *DeltaRestoreConfig) error {
 	if err != nil {
 		return err
 	}
+	if err := checkBackupFeatures(backup); err != nil {
+		return err
+	}
+	if err := checkBackupCompliance(backup); err != nil {
+		return err
+	}
+	if err := checkBackupBroken(backup); err != nil {
+		return err
+	}
+	if err := checkBackupAborted(backup); err != nil {
+		return err
+	}
+	if err := checkBackupProvenance(bsDriver, backup); err != nil {
+		return err
+	}
 
 	log.WithFields(logrus.Fields{
 		LogFieldReason:     LogReasonStart,
@@ -682,22 +1452,61 @@ func RestoreDeltaBlockBackup(config *DeltaRestoreConfig) error {
 		LogEventBackupURL:  backupURL,
 	}).Info("Restoring delta block backup")
 
+	pin, err := pinRestoredBackup(bsDriver, srcBackupName, srcVolumeName)
+	if err != nil {
+		return err
+	}
 	// keep lock alive for async go routine.
 	if err := lock.Lock(); err != nil {
+		unpinRestoredBackup(pin)
 		return err
 	}
+	abortCtx, unregisterAbort := registerAbortable(runningRestores, srcVolumeName)
 	go func() {
 		var err error
 		currentProgress := 0
 
+		profiler := newRestoreProfiler()
+		defer unregisterAbort()
+		defer unpinRestoredBackup(pin)
 		defer func() {
 			_ = deltaOps.CloseVolumeDev(volDev)
+			updateRestoreProfile(deltaOps, volDevName, profiler)
 			deltaOps.UpdateRestoreStatus(volDevName, currentProgress, err)
+			emitRestoreEvent(bsDriver, backupURL, srcVolumeName, srcBackupName, err)
 			lock.Unlock()
+			completion.complete(currentProgress, profiler, err)
 		}()
+		defer completion.handlePanic()
 
 		progress := &progress{
 			totalBlockCounts: int64(len(backup.Blocks)),
+			locks:            []*FileLock{lock},
+			budget:           memoryBudget,
+		}
+		// every block of the volume is either fingerprinted as unchanged or restored
+		if config.FingerprintLocal {
+			progress.totalBlockCounts = vol.Size / DEFAULT_BLOCK_SIZE
+		}
+		config.groupMember.track(progress)
+
+		ctx, cancel := context.WithCancel(abortCtx)
+		defer cancel()
+
+		if outputFormat != RestoreOutputFormatRaw {
+			err = restoreBlocksToImage(ctx, bsDriver, deltaOps, volDev, volDevName, srcVolumeName, outputFormat, vol,
+				backup, concurrentLimit, progress, profiler)
+			if abortCtx.Err() != nil {
+				err = &AbortedError{Operation: "restore", VolumeName: srcVolumeName, BackupName: backup.Name}
+			}
+			if err != nil {
+				currentProgress = progress.progress
+				logrus.WithError(err).Errorf("Failed to restore volume %v backup %v to %v image", srcVolumeName,
+					backup.Name, outputFormat)
+				return
+			}
+			currentProgress = PROGRESS_PERCENTAGE_BACKUP_TOTAL
+			return
 		}
 
 		// This pre-truncate is to ensure the XFS speculatively
@@ -713,18 +1522,31 @@ func RestoreDeltaBlockBackup(config *DeltaRestoreConfig) error {
 			}
 		}
 
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-
-		blockChan, errChan := populateBlocksForFullRestore(bsDriver, backup)
+		var (
+			blockChan <-chan *Block
+			errChan   <-chan error
+		)
+		blockZeroStrategy := zeroStrategy
+		if config.FingerprintLocal {
+			blockChan, errChan = populateBlocksForFingerprintRestore(ctx, volDevPath, vol.Size, backup, deltaOps,
+				srcVolumeName, progress, profiler)
+			blockZeroStrategy = getFingerprintZeroBlockStrategy(zeroStrategy)
+		} else {
+			blockChan, errChan = populateBlocksForFullRestore(bsDriver, backup)
+		}
+		runChan := coalesceBlockRuns(ctx, blockChan, coalesceBlocks)
 
 		errorChans := []<-chan error{errChan}
 		for i := 0; i < int(concurrentLimit); i++ {
-			errorChans = append(errorChans, restoreBlocks(ctx, bsDriver, config.DeltaOps, volDevPath, srcVolumeName, blockChan, progress))
+			errorChans = append(errorChans, restoreBlocks(ctx, bsDriver, config.DeltaOps, volDevPath, srcVolumeName, runChan,
+				coalesceBlocks, blockZeroStrategy, progress, profiler, i))
 		}
 
 		mergedErrChan := mergeErrorChannels(ctx, errorChans...)
 		err = <-mergedErrChan
+		if abortCtx.Err() != nil {
+			err = &AbortedError{Operation: "restore", VolumeName: srcVolumeName, BackupName: backup.Name}
+		}
 		if err != nil {
 			currentProgress = progress.progress
 			logrus.WithError(err).Errorf("Failed to delta restore volume %v backup %v", srcVolumeName, backup.Name)
@@ -736,29 +1558,93 @@ func RestoreDeltaBlockBackup(config *DeltaRestoreConfig) error {
 	return nil
 }
 
-func restoreBlockToFile(bsDriver BackupStoreDriver, volumeName string, volDev *os.File, decompression string, blk BlockMapping) error {
-	blkFile := getBlockFilePath(volumeName, blk.BlockChecksum)
+// restoreBlockToFile downloads, decompresses, verifies and writes the block, the time of each stage is
+// recorded in the block profile. The block is downloaded as a whole, so the stages can be timed separately.
+func restoreBlockToFile(group *RestoreGroup, bsDriver BackupStoreDriver, volumeName string, volDev *os.File,
+	decompression string, blk BlockMapping, blockProfile *RestoreBlockProfile) (int64, error) {
+	buf := blockBuffers.Get()
+	defer blockBuffers.Put(buf)
+	downloadBytes, err := readRestoreBlock(group, bsDriver, volumeName, decompression, blk, blockProfile, buf)
+	if err != nil {
+		return downloadBytes, err
+	}
+
+	start := time.Now()
+	if _, err := volDev.Seek(blk.Offset, 0); err != nil {
+		return downloadBytes, err
+	}
+	_, err = io.CopyN(volDev, buf, DEFAULT_BLOCK_SIZE)
+	blockProfile.Write = time.Since(start)
+	return downloadBytes, err
+}
+
+// readBlock downloads, decompresses and verifies the block into buf, and returns the downloaded bytes
+func readBlock(bsDriver BackupStoreDriver, volumeName string, decompression string, blk BlockMapping,
+	blockProfile *RestoreBlockProfile, buf *bytes.Buffer) (int64, error) {
+	if _, err := util.GetCompressor(decompression); err != nil {
+		return 0, fmt.Errorf("unsupported decompression method: %v", decompression)
+	}
+
+	if err := checkCircuitBreaker(bsDriver.GetURL()); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	blkFile := getBlockFilePath(bsDriver, volumeName, blk.BlockChecksum)
 	rc, err := bsDriver.Read(blkFile)
+	recordCircuitBreakerResult(bsDriver.GetURL(), err)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer rc.Close()
-	r, err := util.DecompressAndVerify(decompression, rc, blk.BlockChecksum)
+
+	compressed := blockBuffers.Get()
+	defer blockBuffers.Put(compressed)
+	downloadBytes, err := compressed.ReadFrom(rc)
 	if err != nil {
-		return err
+		return downloadBytes, err
 	}
-	if _, err := volDev.Seek(blk.Offset, 0); err != nil {
-		return err
+	blockProfile.Download = time.Since(start)
+
+	start = time.Now()
+	// the checksum of the block with the header is verified along with the decompression
+	if header, ok := ParseBlockHeader(compressed.Bytes()); ok {
+		if err := decodeBlockWithHeader(header, compressed.Bytes(), buf, blk.BlockChecksum); err == nil {
+			blockProfile.Decompress = time.Since(start)
+			return downloadBytes, nil
+		}
+		buf.Reset()
 	}
-	_, err = io.CopyN(volDev, r, DEFAULT_BLOCK_SIZE)
-	return err
+	decompression = detectBlockCompressionMethod(decompression, compressed.Bytes())
+	compressor, err := util.GetCompressor(decompression)
+	if err != nil {
+		return downloadBytes, fmt.Errorf("unsupported decompression method: %v", decompression)
+	}
+	if err := compressor.Decompress(buf, compressed); err != nil {
+		return downloadBytes, err
+	}
+	blockProfile.Decompress = time.Since(start)
+
+	start = time.Now()
+	if util.GetChecksum(buf.Bytes()) != blk.BlockChecksum {
+		return downloadBytes, fmt.Errorf("checksum verification failed for block")
+	}
+	blockProfile.Checksum = time.Since(start)
+	return downloadBytes, nil
 }
 
-func RestoreDeltaBlockBackupIncrementally(config *DeltaRestoreConfig) error {
+func RestoreDeltaBlockBackupIncrementally(config *DeltaRestoreConfig) (err error) {
 	if config == nil {
 		return fmt.Errorf("invalid empty config for restore")
 	}
 
+	completion := newRestoreCompletion(config)
+	defer func() {
+		if err != nil {
+			completion.complete(0, nil, err)
+		}
+	}()
+	defer completion.handlePanic()
+
 	backupURL := config.BackupURL
 	volDevName := config.Filename
 	lastBackupName := config.LastBackupName
@@ -797,11 +1683,23 @@ func RestoreDeltaBlockBackupIncrementally(config *DeltaRestoreConfig) error {
 	if vol.Size == 0 || vol.Size%DEFAULT_BLOCK_SIZE != 0 {
 		return fmt.Errorf("read invalid volume size %v", vol.Size)
 	}
+	if err := checkVolumeCompressionMigration(vol); err != nil {
+		return err
+	}
 
 	// check lastBackupName
 	if !util.ValidateName(lastBackupName) {
 		return fmt.Errorf("invalid parameter lastBackupName %v", lastBackupName)
 	}
+	coalesceBlocks, err := getRestoreCoalesceBlocks(config)
+	if err != nil {
+		return err
+	}
+	memoryBudget, err := newRestoreMemoryBudget(config, getRestoreWorkerBytes(coalesceBlocks))
+	if err != nil {
+		return err
+	}
+	completion.budget = memoryBudget
 
 	// check the file. do not reuse if the file exists
 	if _, err := os.Stat(volDevName); err == nil {
@@ -835,6 +1733,21 @@ func RestoreDeltaBlockBackupIncrementally(config *DeltaRestoreConfig) error {
 	if err != nil {
 		return err
 	}
+	if err := checkBackupFeatures(backup); err != nil {
+		return err
+	}
+	if err := checkBackupCompliance(backup); err != nil {
+		return err
+	}
+	if err := checkBackupBroken(backup); err != nil {
+		return err
+	}
+	if err := checkBackupAborted(backup); err != nil {
+		return err
+	}
+	if err := checkBackupProvenance(bsDriver, backup); err != nil {
+		return err
+	}
 
 	log.WithFields(logrus.Fields{
 		LogFieldReason:     LogReasonStart,
@@ -845,13 +1758,22 @@ func RestoreDeltaBlockBackupIncrementally(config *DeltaRestoreConfig) error {
 		LogFieldVolumeDev:  volDevName,
 		LogEventBackupURL:  backupURL,
 	}).Infof("Started incrementally restoring from %v to %v", lastBackup, backup)
+	pin, err := pinRestoredBackup(bsDriver, srcBackupName, srcVolumeName)
+	if err != nil {
+		return err
+	}
 	// keep lock alive for async go routine.
 	if err := lock.Lock(); err != nil {
+		unpinRestoredBackup(pin)
 		return err
 	}
+	abortCtx, unregisterAbort := registerAbortable(runningRestores, srcVolumeName)
 	go func() {
 		defer volDev.Close()
 		defer lock.Unlock()
+		defer unregisterAbort()
+		defer unpinRestoredBackup(pin)
+		defer completion.handlePanic()
 
 		// This pre-truncate is to ensure the XFS speculatively
 		// preallocates post-EOF blocks get reclaimed when volDev is
@@ -862,16 +1784,26 @@ func RestoreDeltaBlockBackupIncrementally(config *DeltaRestoreConfig) error {
 			log.Debugf("Truncate %v to size %v", volDevName, vol.Size)
 			if err := volDev.Truncate(vol.Size); err != nil {
 				deltaOps.UpdateRestoreStatus(volDevName, 0, err)
+				emitRestoreEvent(bsDriver, backupURL, srcVolumeName, srcBackupName, err)
+				completion.complete(0, nil, err)
 				return
 			}
 		}
 
-		if err := performIncrementalRestore(bsDriver, config, srcVolumeName, volDevName, lastBackup, backup); err != nil {
+		profiler := newRestoreProfiler()
+		err := performIncrementalRestore(abortCtx, bsDriver, lock, config, srcVolumeName, volDevName, lastBackup, backup,
+			memoryBudget, profiler)
+		updateRestoreProfile(deltaOps, volDevName, profiler)
+		if err != nil {
 			deltaOps.UpdateRestoreStatus(volDevName, 0, err)
+			emitRestoreEvent(bsDriver, backupURL, srcVolumeName, srcBackupName, err)
+			completion.complete(0, profiler, err)
 			return
 		}
 
 		deltaOps.UpdateRestoreStatus(volDevName, PROGRESS_PERCENTAGE_BACKUP_TOTAL, nil)
+		emitRestoreEvent(bsDriver, backupURL, srcVolumeName, srcBackupName, nil)
+		completion.complete(PROGRESS_PERCENTAGE_BACKUP_TOTAL, profiler, nil)
 	}()
 	return nil
 }
@@ -897,7 +1829,7 @@ func populateBlocksForIncrementalRestore(bsDriver BackupStoreDriver, lastBackup,
 				blockChan <- &Block{
 					offset:            backup.Blocks[b].Offset,
 					blockChecksum:     backup.Blocks[b].BlockChecksum,
-					compressionMethod: backup.CompressionMethod,
+					compressionMethod: getBlockCompressionMethod(backup, backup.Blocks[b]),
 				}
 				b++
 				continue
@@ -910,7 +1842,7 @@ func populateBlocksForIncrementalRestore(bsDriver BackupStoreDriver, lastBackup,
 					blockChan <- &Block{
 						offset:            bB.Offset,
 						blockChecksum:     bB.BlockChecksum,
-						compressionMethod: backup.CompressionMethod,
+						compressionMethod: getBlockCompressionMethod(backup, bB),
 					}
 				}
 				b++
@@ -919,7 +1851,7 @@ func populateBlocksForIncrementalRestore(bsDriver BackupStoreDriver, lastBackup,
 				blockChan <- &Block{
 					offset:            bB.Offset,
 					blockChecksum:     bB.BlockChecksum,
-					compressionMethod: backup.CompressionMethod,
+					compressionMethod: getBlockCompressionMethod(backup, bB),
 				}
 				b++
 			} else {
@@ -947,7 +1879,7 @@ func populateBlocksForFullRestore(bsDriver BackupStoreDriver, backup *Backup) (<
 			blockChan <- &Block{
 				offset:            block.Offset,
 				blockChecksum:     block.BlockChecksum,
-				compressionMethod: backup.CompressionMethod,
+				compressionMethod: getBlockCompressionMethod(backup, block),
 			}
 		}
 	}()
@@ -955,28 +1887,62 @@ func populateBlocksForFullRestore(bsDriver BackupStoreDriver, backup *Backup) (<
 	return blockChan, errChan
 }
 
-func restoreBlock(bsDriver BackupStoreDriver, deltaOps DeltaRestoreOperations, volumeName string, volDev *os.File, block *Block, progress *progress) error {
+func restoreBlock(bsDriver BackupStoreDriver, deltaOps DeltaRestoreOperations, volumeName string, volDev *os.File,
+	block *Block, zeroStrategy ZeroBlockStrategy, progress *progress, profiler *restoreProfiler, workerID int) (err error) {
+	start := time.Now()
+	blockProfile := RestoreBlockProfile{
+		Offset:        block.offset,
+		BlockChecksum: block.blockChecksum,
+	}
+	downloadBytes := int64(0)
 	defer func() {
-		progress.Lock()
-		defer progress.Unlock()
-
-		progress.processedBlockCounts++
-		progress.progress = getProgress(progress.totalBlockCounts, progress.processedBlockCounts)
-		deltaOps.UpdateRestoreStatus(volumeName, progress.progress, nil)
+		if err == nil {
+			blockProfile.Duration = time.Since(start)
+		}
+		completeRestoreBlock(deltaOps, volumeName, progress, profiler, workerID, blockProfile, downloadBytes,
+			block.isZeroBlock, err)
 	}()
 
 	if block.isZeroBlock {
-		return fillZeros(volDev, block.offset, DEFAULT_BLOCK_SIZE)
+		err = fillZeros(volDev, zeroStrategy, block.offset, DEFAULT_BLOCK_SIZE, profiler)
+		blockProfile.Write = time.Since(start)
+		return err
+	}
+
+	if blkFile, ok := getReflinkBlockFile(bsDriver, volumeName, block, progress); ok {
+		var restored bool
+		if downloadBytes, restored, err = reflinkBlockToFile(blkFile, volDev, block, &blockProfile, progress); restored {
+			return err
+		}
 	}
 
-	return restoreBlockToFile(bsDriver, volumeName, volDev, block.compressionMethod,
+	downloadBytes, err = restoreBlockToFile(progress.group, bsDriver, volumeName, volDev, block.compressionMethod,
 		BlockMapping{
 			Offset:        block.offset,
 			BlockChecksum: block.blockChecksum,
-		})
+		}, &blockProfile)
+	return err
+}
+
+// completeRestoreBlock updates the restore progress, and records the block profile if the block is restored
+func completeRestoreBlock(deltaOps DeltaRestoreOperations, volumeName string, progress *progress,
+	profiler *restoreProfiler, workerID int, blockProfile RestoreBlockProfile, downloadBytes int64, zero bool, err error) {
+	progress.Lock()
+	defer progress.Unlock()
+
+	progress.processedBlockCounts++
+	progress.progress = getProgress(progress.totalBlockCounts, progress.processedBlockCounts)
+	progress.reportLockProgress()
+	deltaOps.UpdateRestoreStatus(volumeName, progress.progress, nil)
+
+	if err == nil {
+		profiler.record(workerID, blockProfile, downloadBytes, zero)
+	}
 }
 
-func restoreBlocks(ctx context.Context, bsDriver BackupStoreDriver, deltaOps DeltaRestoreOperations, volDevPath, volumeName string, in <-chan *Block, progress *progress) <-chan error {
+func restoreBlocks(ctx context.Context, bsDriver BackupStoreDriver, deltaOps DeltaRestoreOperations, volDevPath, volumeName string,
+	in <-chan []*Block, coalesceBlocks int, zeroStrategy ZeroBlockStrategy, progress *progress, profiler *restoreProfiler,
+	workerID int) <-chan error {
 	errChan := make(chan error, 1)
 
 	go func() {
@@ -995,6 +1961,18 @@ func restoreBlocks(ctx context.Context, bsDriver BackupStoreDriver, deltaOps Del
 			}
 		}()
 
+		// the worker holds the buffers of a block run until it exits
+		workerBytes := getRestoreWorkerBytes(coalesceBlocks)
+		if err = progress.budget.Reserve(ctx, workerBytes); err != nil {
+			return
+		}
+		defer progress.budget.Release(workerBytes)
+
+		var runBuf []byte
+		if coalesceBlocks > 1 {
+			runBuf = make([]byte, coalesceBlocks*DEFAULT_BLOCK_SIZE)
+		}
+
 		for {
 			select {
 			case <-ctx.Done():
@@ -1004,12 +1982,16 @@ func restoreBlocks(ctx context.Context, bsDriver BackupStoreDriver, deltaOps Del
 				logrus.Infof("Closing goroutine for restoring blocks for %v since received stop signal", volumeName)
 				err = fmt.Errorf("restoration is cancelled since received stop signal")
 				return
-			case block, open := <-in:
+			case run, open := <-in:
 				if !open {
 					return
 				}
 
-				err = restoreBlock(bsDriver, deltaOps, volumeName, volDev, block, progress)
+				if len(run) == 1 {
+					err = restoreBlock(bsDriver, deltaOps, volumeName, volDev, run[0], zeroStrategy, progress, profiler, workerID)
+				} else {
+					err = restoreBlockRun(bsDriver, deltaOps, volumeName, volDev, run, runBuf, zeroStrategy, progress, profiler, workerID)
+				}
 				if err != nil {
 					return
 				}
@@ -1020,27 +2002,50 @@ func restoreBlocks(ctx context.Context, bsDriver BackupStoreDriver, deltaOps Del
 	return errChan
 }
 
-func performIncrementalRestore(bsDriver BackupStoreDriver, config *DeltaRestoreConfig,
-	srcVolumeName, volDevName string, lastBackup *Backup, backup *Backup) error {
+func performIncrementalRestore(abortCtx context.Context, bsDriver BackupStoreDriver, lock *FileLock,
+	config *DeltaRestoreConfig, srcVolumeName, volDevName string, lastBackup *Backup, backup *Backup,
+	budget *util.MemoryBudget, profiler *restoreProfiler) error {
 	var err error
 	concurrentLimit := config.ConcurrentLimit
+	if concurrentLimit == 0 {
+		concurrentLimit = getTargetConfig(bsDriver).RestoreConcurrentLimit
+	}
 
 	progress := &progress{
 		totalBlockCounts: int64(len(backup.Blocks) + len(lastBackup.Blocks)),
+		locks:            []*FileLock{lock},
+		budget:           budget,
 	}
+	config.groupMember.track(progress)
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(abortCtx)
 	defer cancel()
 
+	coalesceBlocks, err := getRestoreCoalesceBlocks(config)
+	if err != nil {
+		return err
+	}
+	zeroStrategy, err := getZeroBlockStrategy(config)
+	if err != nil {
+		return err
+	}
+
+	concurrentLimit = capConcurrentLimit(concurrentLimit, budget, getRestoreWorkerBytes(coalesceBlocks))
+
 	blockChan, errChan := populateBlocksForIncrementalRestore(bsDriver, lastBackup, backup)
+	runChan := coalesceBlockRuns(ctx, blockChan, coalesceBlocks)
 
 	errorChans := []<-chan error{errChan}
 	for i := 0; i < int(concurrentLimit); i++ {
-		errorChans = append(errorChans, restoreBlocks(ctx, bsDriver, config.DeltaOps, config.Filename, srcVolumeName, blockChan, progress))
+		errorChans = append(errorChans, restoreBlocks(ctx, bsDriver, config.DeltaOps, config.Filename, srcVolumeName, runChan,
+			coalesceBlocks, zeroStrategy, progress, profiler, i))
 	}
 
 	mergedErrChan := mergeErrorChannels(ctx, errorChans...)
 	err = <-mergedErrChan
+	if abortCtx.Err() != nil {
+		err = &AbortedError{Operation: "restore", VolumeName: srcVolumeName, BackupName: backup.Name}
+	}
 	if err != nil {
 		logrus.WithError(err).Errorf("Failed to incrementally restore volume %v backup %v", srcVolumeName, backup.Name)
 	}
@@ -1048,11 +2053,18 @@ func performIncrementalRestore(bsDriver BackupStoreDriver, config *DeltaRestoreC
 	return err
 }
 
-func fillZeros(volDev *os.File, offset, length int64) error {
-	return syscall.Fallocate(int(volDev.Fd()), 0, offset, length)
+func DeleteBackupVolume(volumeName string, destURL string) error {
+	return DeleteBackupVolumeWithOptions(volumeName, destURL, nil)
 }
 
-func DeleteBackupVolume(volumeName string, destURL string) error {
+// DeleteBackupVolumeWithOptions removes the backup volume and all of its backups.
+// It fails with DeletionProtectedError if any backup is protected, unless opts.Force is set.
+// It fails with NotOwnerError if the volume is owned by another cluster, unless opts.ForceOwnership is set.
+func DeleteBackupVolumeWithOptions(volumeName string, destURL string, opts *DeleteOptions) error {
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+
 	bsDriver, err := GetBackupStoreDriver(destURL)
 	if err != nil {
 		return err
@@ -1066,6 +2078,15 @@ func DeleteBackupVolume(volumeName string, destURL string) error {
 		return err
 	}
 	defer lock.Unlock()
+
+	if err := checkVolumeOwnershipInBackupStore(bsDriver, volumeName, opts.ForceOwnership); err != nil {
+		return err
+	}
+	if !opts.Force {
+		if err := checkVolumeDeletionProtection(bsDriver, volumeName); err != nil {
+			return err
+		}
+	}
 	return removeVolume(volumeName, bsDriver)
 }
 
@@ -1109,6 +2130,16 @@ func getLatestBackup(backup *Backup, lastBackup *Backup) error {
 }
 
 func DeleteDeltaBlockBackup(backupURL string) error {
+	return DeleteDeltaBlockBackupWithOptions(backupURL, nil)
+}
+
+// DeleteDeltaBlockBackupWithOptions removes the backup and garbage collects the unreferenced blocks.
+// It fails with DeletionProtectedError if the backup is protected, unless opts.Force is set.
+func DeleteDeltaBlockBackupWithOptions(backupURL string, opts *DeleteOptions) error {
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+
 	bsDriver, err := GetBackupStoreDriver(backupURL)
 	if err != nil {
 		return err
@@ -1118,10 +2149,6 @@ func DeleteDeltaBlockBackup(backupURL string) error {
 	if err != nil {
 		return err
 	}
-	log := log.WithFields(logrus.Fields{
-		"backup": backupName,
-		"volume": volumeName,
-	})
 
 	lock, err := New(bsDriver, volumeName, DELETION_LOCK)
 	if err != nil {
@@ -1132,28 +2159,118 @@ func DeleteDeltaBlockBackup(backupURL string) error {
 	}
 	defer lock.Unlock()
 
-	// If we fail to load the backup we still want to proceed with the deletion of the backup file
-	backupToBeDeleted, err := loadBackup(bsDriver, backupName, volumeName)
+	return deleteDeltaBlockBackup(bsDriver, backupName, volumeName, opts)
+}
+
+// DeleteBackups removes the backups of the volume and garbage collects the unreferenced blocks once for all
+// of them, so deleting many backups doesn't repeat the block reference scan for each backup.
+func DeleteBackups(volumeURL string, backupNames []string) error {
+	return DeleteBackupsWithOptions(volumeURL, backupNames, nil)
+}
+
+// DeleteBackupsWithOptions is DeleteBackups with the options. It fails with DeletionProtectedError before
+// removing any backup if one of them is protected, unless opts.Force is set.
+func DeleteBackupsWithOptions(volumeURL string, backupNames []string, opts *DeleteOptions) error {
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+
+	bsDriver, err := GetBackupStoreDriver(volumeURL)
+	if err != nil {
+		return err
+	}
+
+	_, volumeName, _, err := DecodeBackupURL(volumeURL)
 	if err != nil {
-		log.WithError(err).Warn("Failed to load to be deleted backup")
-		backupToBeDeleted = &Backup{
-			Name:       backupName,
-			VolumeName: volumeName,
+		return err
+	}
+	for _, backupName := range backupNames {
+		if !util.ValidateName(backupName) {
+			return fmt.Errorf("invalid backup name %v", backupName)
 		}
 	}
+	if len(backupNames) == 0 {
+		return nil
+	}
+
+	lock, err := New(bsDriver, volumeName, DELETION_LOCK)
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	return deleteDeltaBlockBackups(bsDriver, backupNames, volumeName, opts)
+}
+
+// deleteDeltaBlockBackup deletes the backup and the blocks no longer referenced, the caller should hold the lock
+func deleteDeltaBlockBackup(bsDriver BackupStoreDriver, backupName, volumeName string, opts *DeleteOptions) error {
+	return deleteDeltaBlockBackups(bsDriver, []string{backupName}, volumeName, opts)
+}
+
+// deleteDeltaBlockBackups deletes the backups and the blocks no longer referenced in a single GC pass, the
+// caller should hold the lock
+func deleteDeltaBlockBackups(bsDriver BackupStoreDriver, deletingBackupNames []string, volumeName string, opts *DeleteOptions) error {
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+	log := log.WithFields(logrus.Fields{
+		"volume": volumeName,
+	})
 
-	// we can delete the requested backupToBeDeleted immediately before GC starts
-	if err := removeBackup(backupToBeDeleted, bsDriver); err != nil {
+	if err := checkVolumeOwnershipInBackupStore(bsDriver, volumeName, opts.ForceOwnership); err != nil {
 		return err
 	}
-	log.Info("Removed backup for volume")
+
+	backupsToBeDeleted := []*Backup{}
+	deleted := map[string]bool{}
+	for _, backupName := range deletingBackupNames {
+		if deleted[backupName] {
+			continue
+		}
+		deleted[backupName] = true
+
+		// If we fail to load the backup we still want to proceed with the deletion of the backup file
+		backup, err := loadBackup(bsDriver, backupName, volumeName)
+		if err != nil {
+			log.WithError(err).WithField("backup", backupName).Warn("Failed to load to be deleted backup")
+			backup = &Backup{
+				Name:       backupName,
+				VolumeName: volumeName,
+			}
+		}
+		if backup.DeletionProtected && !opts.Force {
+			return &DeletionProtectedError{BackupName: backupName, VolumeName: volumeName}
+		}
+		backupsToBeDeleted = append(backupsToBeDeleted, backup)
+	}
+
+	// we can delete the requested backups immediately before GC starts
+	trash := isBackupTrashEnabled(opts)
+	for _, backup := range backupsToBeDeleted {
+		if trash && backup.CreatedTime != "" {
+			if err := trashBackup(bsDriver, backup); err != nil {
+				return err
+			}
+			log.WithField("backup", backup.Name).Info("Moved backup to trash for volume")
+		} else {
+			if err := removeBackup(backup, bsDriver); err != nil {
+				return err
+			}
+			removeBackupProvenance(bsDriver, backup.Name, volumeName)
+			log.WithField("backup", backup.Name).Info("Removed backup for volume")
+		}
+		emitBackupDeletedEvent(bsDriver, volumeName, backup.Name)
+	}
 
 	v, err := loadVolume(bsDriver, volumeName)
 	if err != nil {
 		return errors.Wrap(err, "cannot find volume in backupstore")
 	}
 	updateLastBackup := false
-	if backupToBeDeleted.Name == v.LastBackupName {
+	if deleted[v.LastBackupName] {
 		updateLastBackup = true
 		v.LastBackupName = ""
 		v.LastBackupAt = ""
@@ -1175,11 +2292,22 @@ func DeleteDeltaBlockBackup(backupURL string) error {
 	for _, name := range blockNames {
 		blockInfos[name] = &BlockInfo{
 			checksum: name,
-			path:     getBlockFilePath(volumeName, name),
+			path:     getBlockFilePath(bsDriver, volumeName, name),
 			refcount: 0,
 		}
 	}
 
+	// the blocks of the backups in the trash are kept until the trash is purged
+	if err := addTrashedBlockReferences(bsDriver, blockInfos, volumeName); err != nil {
+		log.WithError(err).Warn("Failed to load backups in trash, skip block deletion")
+		deleteBlocks = false
+	}
+	// the blocks being restored are kept until the restores complete
+	if err := addPinnedBlockReferences(bsDriver, blockInfos, volumeName, backupsToBeDeleted); err != nil {
+		log.WithError(err).Warn("Failed to load block pins, skip block deletion")
+		deleteBlocks = false
+	}
+
 	lastBackup := &Backup{}
 	for _, name := range backupNames {
 		log := log.WithField("backup", name)
@@ -1190,6 +2318,22 @@ func DeleteDeltaBlockBackup(backupURL string) error {
 			break
 		}
 
+		// the blocks uploaded by the aborted backup are unreferenced
+		if isBackupAborted(backup) {
+			continue
+		}
+		// no backup of the volume is running while the deletion lock is held, so the crashed finalization of the
+		// prepared backup can be resolved
+		if isBackupPrepared(backup) {
+			if backup, err = resolvePreparedBackup(bsDriver, v, backup); err != nil {
+				log.WithError(err).Warn("Failed to resolve prepared backup, skip block deletion")
+				deleteBlocks = false
+				break
+			}
+			if isBackupAborted(backup) {
+				continue
+			}
+		}
 		if isBackupInProgress(backup) {
 			log.Info("Found in progress backup, skip block deletion")
 			deleteBlocks = false
@@ -1262,39 +2406,66 @@ func cleanupBlocks(driver BackupStoreDriver, blockMap map[string]*BlockInfo, vol
 	log.Infof("Removed %v unused blocks for volume %v", deletedBlockCount, volume)
 	log.Info("GC completed")
 
-	v, err := loadVolume(driver, volume)
+	// update the block count to what we actually have on disk that is in use
+	v, err := updateVolume(driver, volume, func(v *Volume) error {
+		v.BlockCount = activeBlockCount
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-
-	// update the block count to what we actually have on disk that is in use
-	v.BlockCount = activeBlockCount
-	return saveVolume(driver, v)
+	// the volume records are folded into the volume config by the update
+	return removeCompactedVolumeRecords(driver, v)
 }
 
 func getBlockNamesForVolume(driver BackupStoreDriver, volumeName string) ([]string, error) {
 	names := []string{}
-	blockPathBase := getBlockPath(volumeName)
-	lv1Dirs, err := driver.List(blockPathBase)
+	naming := getKeyNaming(driver)
+	// the block files are listed page by page, since there can be millions of them
+	appendBlockNames := func(entries []string) error {
+		names = append(names, util.ExtractNames(entries, naming.blockPrefix, naming.blockSuffix)...)
+		return nil
+	}
+
+	blockPathBase := getBlockPath(driver, volumeName)
+	depth := getVolumeBlockLayout(driver, volumeName).BlockPathDepth()
+	if depth == 0 {
+		if err := listPages(driver, blockPathBase, appendBlockNames); err != nil {
+			// Directory doesn't exist
+			return []string{}, nil
+		}
+		return names, nil
+	}
+
+	entries, err := driver.List(blockPathBase)
 	// Directory doesn't exist
 	if err != nil {
 		return names, nil
 	}
-	for _, lv1 := range lv1Dirs {
-		lv1Path := filepath.Join(blockPathBase, lv1)
-		lv2Dirs, err := driver.List(lv1Path)
-		if err != nil {
-			return nil, err
-		}
-		for _, lv2 := range lv2Dirs {
-			lv2Path := filepath.Join(lv1Path, lv2)
-			blockNames, err := driver.List(lv2Path)
+
+	// go through the directory levels of the layout down to the block files
+	paths := []string{}
+	for _, entry := range entries {
+		paths = append(paths, filepath.Join(blockPathBase, entry))
+	}
+	for level := 1; level < depth; level++ {
+		subPaths := []string{}
+		for _, path := range paths {
+			dirs, err := driver.List(path)
 			if err != nil {
 				return nil, err
 			}
-			names = append(names, blockNames...)
+			for _, dir := range dirs {
+				subPaths = append(subPaths, filepath.Join(path, dir))
+			}
+		}
+		paths = subPaths
+	}
+	for _, path := range paths {
+		if err := listPages(driver, path, appendBlockNames); err != nil {
+			return nil, err
 		}
 	}
 
-	return util.ExtractNames(names, "", BLK_SUFFIX), nil
+	return names, nil
 }
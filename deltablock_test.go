@@ -0,0 +1,456 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"github.com/longhorn/backupstore/types"
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestCompressBlocksLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	maxProcs := int32(runtime.GOMAXPROCS(0))
+	assert.Equal(maxProcs, getCompressConcurrentLimit(&DeltaBackupConfig{}))
+	assert.Equal(maxProcs, getCompressConcurrentLimit(&DeltaBackupConfig{CompressConcurrentLimit: maxProcs + 1}))
+	assert.Equal(int32(1), getCompressConcurrentLimit(&DeltaBackupConfig{CompressConcurrentLimit: 1}))
+
+	_, err := CreateDeltaBlockBackup("backup-1", &DeltaBackupConfig{
+		Volume:    &Volume{Name: "vol-1"},
+		Snapshot:  &Snapshot{Name: "snap-1"},
+		DeltaOps:  &blockSourceOperations{},
+		NiceLevel: util.MaxNiceLevel + 1,
+	})
+	assert.Error(err)
+
+	data := bytes.Repeat([]byte("a"), 1024)
+	in := make(chan *blockBackupJob, 3)
+	out := make(chan *blockBackupJob, 3)
+	for i := 0; i < 3; i++ {
+		buf := blockBuffers.Get()
+		buf.Write(data)
+		in <- &blockBackupJob{offset: int64(i), data: buf.Bytes(), buf: buf}
+	}
+	close(in)
+
+	// 3KiB at 10KiB per second takes at least 300 milliseconds
+	start := time.Now()
+	var wg sync.WaitGroup
+	stats := newCompressionStatsCollector("lz4")
+	errChan := compressBlocks(context.Background(), "lz4", &compressThread{niceLevel: 10}, newRateLimiter(10*1024), stats, in, out, &wg)
+	wg.Wait()
+	assert.NoError(<-errChan)
+	assert.GreaterOrEqual(time.Since(start), 250*time.Millisecond)
+	assert.Equal(int64(3), stats.summary().BlockCount)
+	assert.Equal(int64(3), stats.summary().RatioHistogram[0])
+
+	close(out)
+	for job := range out {
+		decompressed := &bytes.Buffer{}
+		assert.NoError(util.DecompressAndVerifyInto("lz4", decompressed, job.compressed, util.GetChecksum(data)))
+		assert.Equal(data, decompressed.Bytes())
+	}
+}
+
+func TestCompressWorkerHook(t *testing.T) {
+	assert := assert.New(t)
+
+	var allowed unix.CPUSet
+	assert.NoError(unix.SchedGetaffinity(0, &allowed))
+	cpu := 0
+	for !allowed.IsSet(cpu) {
+		cpu++
+	}
+
+	// the hook pins the thread of each worker without affecting the other threads
+	var (
+		lock    sync.Mutex
+		workers = map[int]int{}
+	)
+	hook := func(worker int) error {
+		if err := util.SetThreadCPUAffinity([]int{cpu}); err != nil {
+			return err
+		}
+		var set unix.CPUSet
+		if err := unix.SchedGetaffinity(0, &set); err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		workers[worker] = set.Count()
+		return nil
+	}
+
+	in, out := make(chan *blockBackupJob), make(chan *blockBackupJob)
+	close(in)
+	var wg sync.WaitGroup
+	errChans := []<-chan error{}
+	for i := 0; i < 2; i++ {
+		errChans = append(errChans, compressBlocks(context.Background(), "lz4", &compressThread{worker: i, hook: hook},
+			newRateLimiter(0), newCompressionStatsCollector("lz4"), in, out, &wg))
+	}
+	wg.Wait()
+	for _, errChan := range errChans {
+		assert.NoError(<-errChan)
+	}
+	assert.Equal(map[int]int{0: 1, 1: 1}, workers)
+
+	var current unix.CPUSet
+	assert.NoError(unix.SchedGetaffinity(0, &current))
+	assert.Equal(allowed.Count(), current.Count())
+}
+
+func TestDeleteBackups(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	createdTime := "2023-01-01T00:00:00Z"
+	assert.NoError(saveVolume(m, &Volume{Name: "pvc-1", LastBackupName: "backup-1"}))
+	a, b, c := util.GetChecksum([]byte("a")), util.GetChecksum([]byte("b")), util.GetChecksum([]byte("c"))
+	for _, checksum := range []string{a, b, c} {
+		assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", checksum), bytes.NewReader([]byte(checksum))))
+	}
+	backups := []*Backup{
+		{Name: "backup-0", Blocks: []BlockMapping{{BlockChecksum: a}, {BlockChecksum: b}}},
+		{Name: "backup-1", Blocks: []BlockMapping{{BlockChecksum: b}, {BlockChecksum: c}}},
+		{Name: "backup-2", Blocks: []BlockMapping{{BlockChecksum: c}}, DeletionProtected: true},
+	}
+	for i, backup := range backups {
+		backup.VolumeName = "pvc-1"
+		backup.CreatedTime = createdTime
+		backup.SnapshotCreatedAt = time.Date(2023, 1, 1, i, 0, 0, 0, time.UTC).Format(time.RFC3339)
+		assert.NoError(saveBackup(m, backup))
+	}
+
+	volumeURL := EncodeBackupURL("", "pvc-1", mockDriverURL)
+	assert.NoError(DeleteBackups(volumeURL, nil))
+	assert.Error(DeleteBackups(volumeURL, []string{"../backup-0"}))
+
+	// none of the backups is removed if any of them is protected
+	err := deleteDeltaBlockBackups(m, []string{"backup-0", "backup-2"}, "pvc-1", nil)
+	assert.True(IsDeletionProtectedError(err))
+	names, err := getBackupNamesForVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Len(names, 3)
+
+	assert.NoError(deleteDeltaBlockBackups(m, []string{"backup-0", "backup-1", "backup-0"}, "pvc-1", nil))
+	names, err = getBackupNamesForVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal([]string{"backup-2"}, names)
+	blocks, err := getBlockNamesForVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal([]string{c}, blocks)
+
+	volume, err := loadVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal("backup-2", volume.LastBackupName)
+}
+
+func TestForceFullBackup(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	volume := &Volume{Name: "pvc-1", Size: 2 * DEFAULT_BLOCK_SIZE, LastBackupName: "backup-1"}
+	assert.NoError(saveVolume(m, volume))
+	existing := util.GetChecksum([]byte("existing"))
+	assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", existing), bytes.NewReader([]byte("existing"))))
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-1", VolumeName: "pvc-1", CreatedTime: util.Now(),
+		Blocks: []BlockMapping{{Offset: 0, BlockChecksum: existing}}, BlockCRCs: map[int64]uint32{0: 1}}))
+
+	config := &DeltaBackupConfig{
+		Volume:    volume,
+		Snapshot:  &Snapshot{Name: "snap-2", CreatedTime: util.Now()},
+		DeltaOps:  &blockSourceOperations{},
+		BlockCRCs: map[int64]uint32{0: 1},
+	}
+	target := &backupTarget{destURL: mockDriverURL, bsDriver: m, volume: volume}
+	targets := []*backupTarget{target}
+	newDeltaBackup := func() *Backup {
+		return &Backup{Name: "backup-2", VolumeName: "pvc-1",
+			ProcessingBlocks: &ProcessingBlocks{blocks: map[string][]*BlockMapping{}}}
+	}
+
+	// the existing block is deduplicated by the regular backup
+	assert.NotNil(getBlockCRCIndex(targets, config))
+	assert.Empty(prepareBlock(targets, config, newDeltaBackup(), 0, existing, &progress{totalBlockCounts: 1}))
+
+	// the forced full backup uploads it again
+	config.ForceFullBackup = true
+	assert.Nil(getBlockCRCIndex(targets, config))
+	deltaBackup := newDeltaBackup()
+	assert.Equal(targets, prepareBlock(targets, config, deltaBackup, 0, existing, &progress{totalBlockCounts: 1}))
+
+	deltaBackup.Blocks = []BlockMapping{{Offset: 0, BlockChecksum: existing}}
+	assert.NoError(finalizeBackup(target, config, deltaBackup))
+	backup, err := loadBackup(m, "backup-2", "pvc-1")
+	assert.NoError(err)
+	assert.True(backup.ChainBase)
+	assert.False(backup.IsIncremental)
+}
+
+// runDeltaBlockBackup creates the backup and waits for it to complete
+func runDeltaBlockBackup(backupName string, config *DeltaBackupConfig) *BackupSummary {
+	summaries := make(chan *BackupSummary, 1)
+	config.OnComplete = func(summary *BackupSummary) {
+		summaries <- summary
+	}
+	CreateDeltaBlockBackup(backupName, config)
+	return <-summaries
+}
+
+func TestForceFullBackupRewritesBlocks(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &conditionalMockStoreDriver{writableMockStoreDriver: &writableMockStoreDriver{&mockStoreDriver{}}}
+	m.Init()
+	defer m.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m, nil
+	})
+
+	data := bytes.Repeat([]byte("a"), DEFAULT_BLOCK_SIZE)
+	source := &memoryBlockSource{data: data, extents: []types.Mapping{{Offset: 0, Size: DEFAULT_BLOCK_SIZE}}}
+	newConfig := func(snapshotName string, force bool) *DeltaBackupConfig {
+		return &DeltaBackupConfig{
+			Volume:          &Volume{Name: "pvc-1", Size: DEFAULT_BLOCK_SIZE, CompressionMethod: "none"},
+			Snapshot:        &Snapshot{Name: snapshotName, CreatedTime: util.Now()},
+			DestURL:         mockDriverURL,
+			Source:          source,
+			ConcurrentLimit: 1,
+			ForceFullBackup: force,
+		}
+	}
+
+	summary := runDeltaBlockBackup("backup-1", newConfig("snap-1", false))
+	assert.Equal(types.ProgressStateComplete, summary.State, "%v", summary.Error)
+	blkFile := getBlockFilePath(m, "pvc-1", util.GetChecksum(data))
+	stored, err := afero.ReadFile(m.fs, blkFile)
+	assert.NoError(err)
+
+	// the block is corrupted in place without changing its size
+	corrupted := append([]byte{stored[0] ^ 0xff}, stored[1:]...)
+	assert.NoError(afero.WriteFile(m.fs, blkFile, corrupted, 0644))
+
+	// the regular backup reuses the existing block
+	summary = runDeltaBlockBackup("backup-2", newConfig("snap-2", false))
+	assert.Equal(types.ProgressStateComplete, summary.State, "%v", summary.Error)
+	rewritten, err := afero.ReadFile(m.fs, blkFile)
+	assert.NoError(err)
+	assert.Equal(corrupted, rewritten)
+
+	// the forced full backup rewrites it even though the conditional writes are enabled
+	assert.True(isConditionalBlockUploadSupported(m))
+	summary = runDeltaBlockBackup("backup-3", newConfig("snap-3", true))
+	assert.Equal(types.ProgressStateComplete, summary.State, "%v", summary.Error)
+	rewritten, err = afero.ReadFile(m.fs, blkFile)
+	assert.NoError(err)
+	assert.Equal(stored, rewritten)
+}
+
+// failingBlockSource fails reading the block at the offset
+type failingBlockSource struct {
+	*memoryBlockSource
+	offset int64
+}
+
+func (s *failingBlockSource) ReadBlockAt(data []byte, offset int64) error {
+	if offset == s.offset {
+		return fmt.Errorf("injected read failure")
+	}
+	return s.memoryBlockSource.ReadBlockAt(data, offset)
+}
+
+// failingCompressor fails compressing the blocks starting with "fail", so the compression canary still passes
+type failingCompressor struct {
+	util.Compressor
+}
+
+func (c *failingCompressor) Compress(dst io.Writer, src io.Reader) error {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(data, []byte("fail")) {
+		return fmt.Errorf("injected compression failure")
+	}
+	return c.Compressor.Compress(dst, bytes.NewReader(data))
+}
+
+// blockWriteMockStoreDriver intercepts the writes of the blocks, the other files are written as usual
+type blockWriteMockStoreDriver struct {
+	*writableMockStoreDriver
+	writeBlock func(dst string) error
+}
+
+func (m *blockWriteMockStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	if strings.Contains(dst, "/"+BLOCKS_DIRECTORY+"/") {
+		if err := m.writeBlock(dst); err != nil {
+			return err
+		}
+	}
+	return m.writableMockStoreDriver.Write(dst, rs)
+}
+
+// waitForGoroutines checks that the goroutines started since there were n goroutines have exited
+func waitForGoroutines(assert *assert.Assertions, n int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for runtime.NumGoroutine() > n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(runtime.NumGoroutine(), n, "leaked goroutines")
+}
+
+func TestBackupPipelineErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &blockWriteMockStoreDriver{writableMockStoreDriver: &writableMockStoreDriver{&mockStoreDriver{}}}
+	m.Init()
+	defer m.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m, nil
+	})
+	assert.NoError(util.RegisterCompressor("failing", func() (util.Compressor, error) {
+		compressor, err := util.GetCompressor("lz4")
+		return &failingCompressor{compressor}, err
+	}, nil))
+	defer util.UnregisterCompressor("failing")
+
+	// the blocks are distinct and in separate mappings, so each stage has more work queued when one fails
+	const blockCount = 8
+	data := make([]byte, blockCount*DEFAULT_BLOCK_SIZE)
+	extents := []types.Mapping{}
+	for i := int64(0); i < blockCount; i++ {
+		copy(data[i*DEFAULT_BLOCK_SIZE:], fmt.Sprintf("block-%v", i))
+		extents = append(extents, types.Mapping{Offset: i * DEFAULT_BLOCK_SIZE, Size: DEFAULT_BLOCK_SIZE})
+	}
+	failing := append([]byte{}, data...)
+	copy(failing[2*DEFAULT_BLOCK_SIZE:], "fail")
+
+	for _, tc := range []struct {
+		name              string
+		source            BlockSource
+		compressionMethod string
+		writeBlock        func(dst string) error
+		expectedErr       string
+	}{
+		{
+			name:              "read",
+			source:            &failingBlockSource{&memoryBlockSource{data, extents}, 2 * DEFAULT_BLOCK_SIZE},
+			compressionMethod: "lz4",
+			expectedErr:       "injected read failure",
+		},
+		{
+			name:              "compress",
+			source:            &memoryBlockSource{failing, extents},
+			compressionMethod: "failing",
+			expectedErr:       "injected compression failure",
+		},
+		{
+			name:              "upload",
+			source:            &memoryBlockSource{data, extents},
+			compressionMethod: "lz4",
+			writeBlock: func(dst string) error {
+				return NewDriverError(ErrorClassPermissionDenied, "AccessDenied", fmt.Errorf("injected upload failure"))
+			},
+			expectedErr: "injected upload failure",
+		},
+	} {
+		m.writeBlock = func(dst string) error { return nil }
+		if tc.writeBlock != nil {
+			m.writeBlock = tc.writeBlock
+		}
+		volumeName := "pvc-" + tc.name
+		goroutines := runtime.NumGoroutine()
+		summary := runDeltaBlockBackup("backup-1", &DeltaBackupConfig{
+			Volume:          &Volume{Name: volumeName, Size: int64(len(data)), CompressionMethod: tc.compressionMethod},
+			Snapshot:        &Snapshot{Name: "snap-1", CreatedTime: util.Now()},
+			DestURL:         mockDriverURL,
+			Source:          tc.source,
+			ConcurrentLimit: 1,
+		})
+		assert.Equal(types.ProgressStateError, summary.State, tc.name)
+		if assert.Error(summary.Error, tc.name) {
+			assert.Contains(summary.Error.Error(), tc.expectedErr, tc.name)
+		}
+		backup, err := loadBackup(m, "backup-1", volumeName)
+		assert.NoError(err, tc.name)
+		assert.True(isBackupInProgress(backup), tc.name)
+		assert.Empty(getLockNamesForVolume(volumeName, m), tc.name)
+		waitForGoroutines(assert, goroutines)
+	}
+}
+
+func TestBackupPipelineAbort(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &blockWriteMockStoreDriver{writableMockStoreDriver: &writableMockStoreDriver{&mockStoreDriver{}}}
+	m.Init()
+	defer m.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m, nil
+	})
+
+	// the first upload blocks until the backup is aborted, the stages before it fill up meanwhile
+	uploading := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	m.writeBlock = func(dst string) error {
+		once.Do(func() {
+			close(uploading)
+			<-release
+		})
+		return nil
+	}
+
+	const blockCount = 16
+	data := make([]byte, blockCount*DEFAULT_BLOCK_SIZE)
+	extents := []types.Mapping{}
+	for i := int64(0); i < blockCount; i++ {
+		copy(data[i*DEFAULT_BLOCK_SIZE:], fmt.Sprintf("block-%v", i))
+		extents = append(extents, types.Mapping{Offset: i * DEFAULT_BLOCK_SIZE, Size: DEFAULT_BLOCK_SIZE})
+	}
+
+	goroutines := runtime.NumGoroutine()
+	summaries := make(chan *BackupSummary, 1)
+	_, err := CreateDeltaBlockBackup("backup-1", &DeltaBackupConfig{
+		Volume:          &Volume{Name: "pvc-1", Size: int64(len(data)), CompressionMethod: "lz4"},
+		Snapshot:        &Snapshot{Name: "snap-1", CreatedTime: util.Now()},
+		DestURL:         mockDriverURL,
+		Source:          &memoryBlockSource{data, extents},
+		ConcurrentLimit: 1,
+		OnComplete: func(summary *BackupSummary) {
+			summaries <- summary
+		},
+	})
+	assert.NoError(err)
+
+	<-uploading
+	assert.NoError(AbortBackup("pvc-1", "backup-1"))
+	close(release)
+	summary := <-summaries
+	assert.Equal(types.ProgressStateError, summary.State)
+	assert.True(IsAbortedError(summary.Error), "%v", summary.Error)
+	// the aborted backup is cleaned up in the background after the completion
+	waitForGoroutines(assert, goroutines)
+}
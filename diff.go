@@ -0,0 +1,110 @@
+package backupstore
+
+import (
+	"fmt"
+	"sort"
+)
+
+type BackupDiff struct {
+	BlockSize int64
+
+	// AddedOffsets are the block offsets only present in the second backup
+	AddedOffsets []int64
+	// RemovedOffsets are the block offsets only present in the first backup
+	RemovedOffsets []int64
+	// ModifiedOffsets are the block offsets present in both backups with different contents
+	ModifiedOffsets []int64
+}
+
+// Offsets returns all the sorted block offsets that differ between the two backups
+func (d *BackupDiff) Offsets() []int64 {
+	offsets := make([]int64, 0, len(d.AddedOffsets)+len(d.RemovedOffsets)+len(d.ModifiedOffsets))
+	offsets = append(offsets, d.AddedOffsets...)
+	offsets = append(offsets, d.RemovedOffsets...)
+	offsets = append(offsets, d.ModifiedOffsets...)
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets
+}
+
+// DiffBackups returns the block offsets that differ between the two delta block backups.
+// The backups can belong to different volumes or backup targets.
+func DiffBackups(backupURL1, backupURL2 string) (*BackupDiff, error) {
+	backup1, err := loadCompletedBackup(backupURL1)
+	if err != nil {
+		return nil, err
+	}
+	backup2, err := loadCompletedBackup(backupURL2)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffBackupBlocks(backup1.Blocks, backup2.Blocks), nil
+}
+
+func loadCompletedBackup(backupURL string) (*Backup, error) {
+	bsDriver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return nil, err
+	}
+
+	backupName, volumeName, _, err := DecodeBackupURL(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	if backupName == "" {
+		return nil, fmt.Errorf("missing backup name in %v", backupURL)
+	}
+
+	backup, err := loadBackup(bsDriver, backupName, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	if isBackupInProgress(backup) {
+		return nil, fmt.Errorf("backup %v is still in progress", backup.Name)
+	}
+	if backup.SingleFile.FilePath != "" {
+		return nil, fmt.Errorf("backup %v is not a delta block backup", backup.Name)
+	}
+	return backup, nil
+}
+
+// diffBackupBlocks compares the block mappings, which are sorted by offset
+func diffBackupBlocks(blocks1, blocks2 []BlockMapping) *BackupDiff {
+	diff := &BackupDiff{
+		BlockSize:       DEFAULT_BLOCK_SIZE,
+		AddedOffsets:    []int64{},
+		RemovedOffsets:  []int64{},
+		ModifiedOffsets: []int64{},
+	}
+
+	for i, j := 0, 0; i < len(blocks1) || j < len(blocks2); {
+		if i >= len(blocks1) {
+			diff.AddedOffsets = append(diff.AddedOffsets, blocks2[j].Offset)
+			j++
+			continue
+		}
+		if j >= len(blocks2) {
+			diff.RemovedOffsets = append(diff.RemovedOffsets, blocks1[i].Offset)
+			i++
+			continue
+		}
+
+		b1 := blocks1[i]
+		b2 := blocks2[j]
+		if b1.Offset == b2.Offset {
+			if b1.BlockChecksum != b2.BlockChecksum {
+				diff.ModifiedOffsets = append(diff.ModifiedOffsets, b1.Offset)
+			}
+			i++
+			j++
+		} else if b1.Offset < b2.Offset {
+			diff.RemovedOffsets = append(diff.RemovedOffsets, b1.Offset)
+			i++
+		} else {
+			diff.AddedOffsets = append(diff.AddedOffsets, b2.Offset)
+			j++
+		}
+	}
+
+	return diff
+}
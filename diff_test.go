@@ -0,0 +1,32 @@
+package backupstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffBackupBlocks(t *testing.T) {
+	assert := assert.New(t)
+
+	blocks1 := []BlockMapping{
+		{Offset: 0, BlockChecksum: "a"},
+		{Offset: 2 * DEFAULT_BLOCK_SIZE, BlockChecksum: "b"},
+		{Offset: 3 * DEFAULT_BLOCK_SIZE, BlockChecksum: "c"},
+	}
+	blocks2 := []BlockMapping{
+		{Offset: 0, BlockChecksum: "a"},
+		{Offset: DEFAULT_BLOCK_SIZE, BlockChecksum: "d"},
+		{Offset: 3 * DEFAULT_BLOCK_SIZE, BlockChecksum: "e"},
+		{Offset: 5 * DEFAULT_BLOCK_SIZE, BlockChecksum: "f"},
+	}
+
+	diff := diffBackupBlocks(blocks1, blocks2)
+	assert.Equal([]int64{DEFAULT_BLOCK_SIZE, 5 * DEFAULT_BLOCK_SIZE}, diff.AddedOffsets)
+	assert.Equal([]int64{2 * DEFAULT_BLOCK_SIZE}, diff.RemovedOffsets)
+	assert.Equal([]int64{3 * DEFAULT_BLOCK_SIZE}, diff.ModifiedOffsets)
+	assert.Equal([]int64{DEFAULT_BLOCK_SIZE, 2 * DEFAULT_BLOCK_SIZE, 3 * DEFAULT_BLOCK_SIZE, 5 * DEFAULT_BLOCK_SIZE}, diff.Offsets())
+
+	diff = diffBackupBlocks(blocks1, blocks1)
+	assert.Equal(0, len(diff.Offsets()))
+}
@@ -0,0 +1,230 @@
+package backupstore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	// DIRECT_IO_ALIGNMENT is the alignment of the offsets, the lengths and the buffers of the O_DIRECT reads
+	DIRECT_IO_ALIGNMENT = 4096
+
+	// DEFAULT_DIRECT_READ_AHEAD is the size of the read ahead window of DirectReader
+	DEFAULT_DIRECT_READ_AHEAD = 2 * DEFAULT_BLOCK_SIZE
+	// DEFAULT_DIRECT_READ_AHEAD_WINDOWS is the number of the read ahead windows cached by DirectReader, so the
+	// concurrent sequential readers of the backup don't evict each other's window
+	DEFAULT_DIRECT_READ_AHEAD_WINDOWS = 4
+)
+
+// DirectReaderOptions are the options of NewDirectReader
+type DirectReaderOptions struct {
+	// ReadAhead is the size of the aligned window read at once, defaults to DEFAULT_DIRECT_READ_AHEAD. It must
+	// be a multiple of DIRECT_IO_ALIGNMENT
+	ReadAhead int64
+	// ReadAheadWindows is the number of the windows kept for the concurrent readers, defaults to
+	// DEFAULT_DIRECT_READ_AHEAD_WINDOWS. Up to ReadAhead times ReadAheadWindows bytes are cached
+	ReadAheadWindows int
+}
+
+// DirectReader reads the block device or the replica file with O_DIRECT, so the snapshot data read once by the
+// backup doesn't fill the page cache and evict the data of the workloads. The reads are served from the aligned
+// read ahead windows, so the blocks can be read at any offset and length. The file is read through the page
+// cache if the filesystem doesn't support O_DIRECT, e.g. tmpfs.
+//
+// DirectReader implements Size and ReadBlockAt of BlockSource, so it can be embedded by the block sources only
+// providing the changed extents.
+type DirectReader struct {
+	file   *os.File
+	size   int64
+	direct bool
+
+	readAhead  int64
+	maxWindows int
+	buffers    *util.AlignedBufferPool
+
+	lock    sync.Mutex
+	windows map[int64]*readAheadWindow
+	// recent is the offsets of the windows from the least to the most recently used
+	recent []int64
+}
+
+type readAheadWindow struct {
+	offset int64
+	buf    []byte
+	n      int
+	err    error
+	ready  chan struct{}
+	refs   int
+}
+
+// NewDirectReader opens the block device or the file for the O_DIRECT reads
+func NewDirectReader(path string, opts *DirectReaderOptions) (*DirectReader, error) {
+	if opts == nil {
+		opts = &DirectReaderOptions{}
+	}
+	readAhead := opts.ReadAhead
+	if readAhead == 0 {
+		readAhead = DEFAULT_DIRECT_READ_AHEAD
+	}
+	if readAhead < 0 || readAhead%DIRECT_IO_ALIGNMENT != 0 {
+		return nil, fmt.Errorf("invalid read ahead %v, must be a multiple of %v", readAhead, DIRECT_IO_ALIGNMENT)
+	}
+	maxWindows := opts.ReadAheadWindows
+	if maxWindows == 0 {
+		maxWindows = DEFAULT_DIRECT_READ_AHEAD_WINDOWS
+	}
+	if maxWindows < 0 {
+		return nil, fmt.Errorf("invalid read ahead windows %v", maxWindows)
+	}
+
+	direct := true
+	file, err := os.OpenFile(path, os.O_RDONLY|unix.O_DIRECT, 0)
+	if errors.Is(err, unix.EINVAL) {
+		log.Warnf("O_DIRECT is not supported for %v, reading it through the page cache", path)
+		direct = false
+		file, err = os.OpenFile(path, os.O_RDONLY, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the size of the block device is only reported by seeking to its end
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed to get size of %v", path)
+	}
+
+	return &DirectReader{
+		file:       file,
+		size:       size,
+		direct:     direct,
+		readAhead:  readAhead,
+		maxWindows: maxWindows,
+		buffers:    util.NewAlignedBufferPool(int(readAhead), DIRECT_IO_ALIGNMENT),
+		windows:    map[int64]*readAheadWindow{},
+	}, nil
+}
+
+// Size returns the size of the block device or the file in bytes
+func (r *DirectReader) Size() int64 {
+	return r.size
+}
+
+// IsDirect checks if the reads bypass the page cache
+func (r *DirectReader) IsDirect() bool {
+	return r.direct
+}
+
+// ReadBlockAt reads len(data) bytes at the offset
+func (r *DirectReader) ReadBlockAt(data []byte, offset int64) error {
+	if offset < 0 || offset+int64(len(data)) > r.size {
+		return fmt.Errorf("cannot read %v bytes at offset %v beyond the size %v", len(data), offset, r.size)
+	}
+	for len(data) > 0 {
+		w := r.acquireWindow(offset - offset%r.readAhead)
+		<-w.ready
+		if w.err != nil {
+			r.releaseWindow(w)
+			return w.err
+		}
+		start := int(offset - w.offset)
+		if start >= w.n {
+			r.releaseWindow(w)
+			return io.ErrUnexpectedEOF
+		}
+		n := copy(data, w.buf[start:w.n])
+		r.releaseWindow(w)
+		data = data[n:]
+		offset += int64(n)
+	}
+	return nil
+}
+
+// Close closes the block device or the file
+func (r *DirectReader) Close() error {
+	return r.file.Close()
+}
+
+// acquireWindow returns the window at the offset, the window is read by the first reader acquiring it
+func (r *DirectReader) acquireWindow(offset int64) *readAheadWindow {
+	r.lock.Lock()
+	if w, exists := r.windows[offset]; exists {
+		w.refs++
+		r.touchWindow(offset)
+		r.lock.Unlock()
+		return w
+	}
+	w := &readAheadWindow{
+		offset: offset,
+		buf:    r.buffers.Get(),
+		ready:  make(chan struct{}),
+		refs:   1,
+	}
+	r.windows[offset] = w
+	r.touchWindow(offset)
+	r.evictWindows()
+	r.lock.Unlock()
+
+	w.n, w.err = r.file.ReadAt(w.buf, offset)
+	if w.err == io.EOF {
+		// the window at the end of the device is short
+		w.err = nil
+	}
+	if w.err != nil {
+		w.err = errors.Wrapf(w.err, "failed to read %v bytes at offset %v", len(w.buf), offset)
+	}
+	close(w.ready)
+	return w
+}
+
+func (r *DirectReader) releaseWindow(w *readAheadWindow) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	w.refs--
+	if w.err != nil && w.refs == 0 && r.windows[w.offset] == w {
+		// the failed read is retried by the next reader
+		delete(r.windows, w.offset)
+		r.removeRecent(w.offset)
+		r.buffers.Put(w.buf)
+		return
+	}
+	r.evictWindows()
+}
+
+// touchWindow marks the window the most recently used, the caller should hold the lock
+func (r *DirectReader) touchWindow(offset int64) {
+	r.removeRecent(offset)
+	r.recent = append(r.recent, offset)
+}
+
+func (r *DirectReader) removeRecent(offset int64) {
+	for i, o := range r.recent {
+		if o == offset {
+			r.recent = append(r.recent[:i], r.recent[i+1:]...)
+			return
+		}
+	}
+}
+
+// evictWindows drops the least recently used windows not being read beyond the limit, the caller should hold
+// the lock
+func (r *DirectReader) evictWindows() {
+	for i := 0; len(r.windows) > r.maxWindows && i < len(r.recent); {
+		w := r.windows[r.recent[i]]
+		if w.refs > 0 {
+			i++
+			continue
+		}
+		delete(r.windows, w.offset)
+		r.recent = append(r.recent[:i], r.recent[i+1:]...)
+		r.buffers.Put(w.buf)
+	}
+}
@@ -0,0 +1,51 @@
+package backupstore
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirectReader(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "replica.img")
+	data := make([]byte, 4*DEFAULT_BLOCK_SIZE+1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	assert.NoError(os.WriteFile(path, data, 0600))
+
+	_, err := NewDirectReader(path, &DirectReaderOptions{ReadAhead: DIRECT_IO_ALIGNMENT + 1})
+	assert.Error(err)
+
+	r, err := NewDirectReader(path, &DirectReaderOptions{ReadAhead: 1024 * 1024, ReadAheadWindows: 2})
+	assert.NoError(err)
+	defer r.Close()
+	assert.Equal(int64(len(data)), r.Size())
+
+	// the concurrent sequential readers share the read ahead windows
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(start int64) {
+			defer wg.Done()
+			block := make([]byte, DEFAULT_BLOCK_SIZE)
+			for offset := start; offset+DEFAULT_BLOCK_SIZE <= int64(len(data)); offset += 2 * DEFAULT_BLOCK_SIZE {
+				assert.NoError(r.ReadBlockAt(block, offset))
+				assert.Equal(data[offset:offset+DEFAULT_BLOCK_SIZE], block)
+			}
+		}(int64(i%2) * DEFAULT_BLOCK_SIZE)
+	}
+	wg.Wait()
+	assert.LessOrEqual(len(r.windows), 2)
+
+	// the unaligned reads and the short tail are served from the windows
+	tail := make([]byte, 1500)
+	offset := int64(len(data) - len(tail))
+	assert.NoError(r.ReadBlockAt(tail, offset))
+	assert.Equal(data[offset:], tail)
+	assert.Error(r.ReadBlockAt(tail, offset+1))
+}
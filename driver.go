@@ -27,6 +27,86 @@ type BackupStoreDriver interface {
 	Download(src, dst string) error
 }
 
+// BackupStorePagedLister can be optionally implemented by the drivers to list the large directories
+// page by page, so the callers don't need to hold the whole listing in memory
+type BackupStorePagedLister interface {
+	// ListPage returns up to limit entries of the path in the same format as List, and the token to
+	// continue the listing with. The listing is complete if the returned token is empty.
+	ListPage(path, continuationToken string, limit int) ([]string, string, error)
+}
+
+// BackupStorePrefixLister can be optionally implemented by the drivers able to filter the listing by the name
+// prefix on the server side, so the directories shared with many foreign entries don't need to be enumerated
+type BackupStorePrefixLister interface {
+	// ListPrefix returns the entries of the path starting with the prefix in the same format as List
+	ListPrefix(path, prefix string) ([]string, error)
+}
+
+// BackupStoreVerifiedWriter can be optionally implemented by the drivers getting the checksum of the stored
+// data back from the backend, so the data corrupted during the upload is detected right away
+type BackupStoreVerifiedWriter interface {
+	// WriteVerified writes the file like Write, and returns the MD5 checksum in hex of the data stored by the
+	// backend. An empty checksum is returned if the backend doesn't report it, e.g. for the encrypted objects.
+	WriteVerified(dst string, rs io.ReadSeeker) (string, error)
+}
+
+// BackupStoreRangeReader can be optionally implemented by the drivers able to read a part of a file, so only the
+// needed part of the large files is downloaded
+type BackupStoreRangeReader interface {
+	// ReadRange reads up to length bytes of the file from offset, less bytes are read if the file ends before.
+	// Caller needs to close.
+	ReadRange(src string, offset, length int64) (io.ReadCloser, error)
+}
+
+// BackupStoreConditionalWriter can be optionally implemented by the drivers supporting the conditional writes,
+// so the concurrent config updates are detected atomically instead of the last writer winning
+type BackupStoreConditionalWriter interface {
+	// FileETag returns the ETag of the file, which changes whenever the file is written. An empty string is
+	// returned if the file doesn't exist.
+	FileETag(filePath string) (string, error)
+	// WriteIfMatch writes the file only if its ETag is still etag, an empty etag requires the file not to exist.
+	// ConflictError is returned if the condition doesn't hold.
+	WriteIfMatch(dst string, rs io.ReadSeeker, etag string) error
+}
+
+// BackupStoreVerifiedConditionalWriter can be optionally implemented by the drivers supporting both the
+// conditional writes and the verified writes, so the blocks are only uploaded if they don't exist yet and are
+// still verified
+type BackupStoreVerifiedConditionalWriter interface {
+	// WriteVerifiedIfMatch writes the file like WriteIfMatch, and returns the checksum of the stored data like
+	// WriteVerified
+	WriteVerifiedIfMatch(dst string, rs io.ReadSeeker, etag string) (string, error)
+}
+
+// BackupStoreArchiveDriver can be optionally implemented by the drivers whose files can be moved to the archive
+// tiers, e.g. S3 Glacier or Azure Archive, which cannot be read until they are rehydrated
+type BackupStoreArchiveDriver interface {
+	// ArchiveState returns if the file is online, archived or being rehydrated
+	ArchiveState(filePath string) (ArchiveState, error)
+	// Rehydrate requests the archived file to be readable again, and returns the estimated time until it is.
+	// Requesting the rehydration of a file being rehydrated already is not an error.
+	Rehydrate(filePath string, priority RehydratePriority) (time.Duration, error)
+}
+
+// BackupStoreReadOnlyDriver can be optionally implemented by the drivers which may be unable to write the backup
+// target, e.g. the anonymous access to a public bucket. The locks of the read-only backup targets are checked
+// against the locks of the other clients but not stored.
+type BackupStoreReadOnlyDriver interface {
+	// IsReadOnly returns true if the backup target can only be read
+	IsReadOnly() bool
+}
+
+// BackupStoreLocalDriver can be optionally implemented by the drivers storing the files on a local or mounted
+// filesystem, e.g. vfs and nfs, so the files can be accessed directly, e.g. cloned into the restored volume
+type BackupStoreLocalDriver interface {
+	// LocalPath returns the path of the file on the local filesystem
+	LocalPath(path string) string
+}
+
+const (
+	DEFAULT_LIST_PAGE_SIZE = 1000
+)
+
 var (
 	initializers map[string]InitFunc
 )
@@ -74,5 +154,85 @@ func GetBackupStoreDriver(destURL string) (BackupStoreDriver, error) {
 	if _, exists := initializers[u.Scheme]; !exists {
 		return nil, fmt.Errorf("driver %v is not supported", u.Scheme)
 	}
-	return initializers[u.Scheme](destURL)
+	// the dead backup target isn't mounted or connected again while its circuit breaker is open
+	if err := checkCircuitBreaker(destURL); err != nil {
+		return nil, err
+	}
+	driver, err := initializers[u.Scheme](destURL)
+	recordCircuitBreakerResult(destURL, err)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTargetCompliance(driver); err != nil {
+		return nil, err
+	}
+	if err := loadConsistencyBarrier(driver, u); err != nil {
+		return nil, err
+	}
+	if err := loadLayout(driver); err != nil {
+		return nil, err
+	}
+	if err := loadTargetConfig(driver); err != nil {
+		return nil, err
+	}
+	return driver, nil
+}
+
+// listPages calls fn with the entries of the path page by page. The whole listing is passed
+// at once if the driver doesn't support the paged listing.
+func listPages(driver BackupStoreDriver, path string, fn func(entries []string) error) error {
+	lister, ok := driver.(BackupStorePagedLister)
+	if !ok {
+		entries, err := driver.List(path)
+		if err != nil {
+			return err
+		}
+		return fn(entries)
+	}
+
+	token := ""
+	for {
+		entries, nextToken, err := lister.ListPage(path, token, DEFAULT_LIST_PAGE_SIZE)
+		if err != nil {
+			return err
+		}
+		if err := fn(entries); err != nil {
+			return err
+		}
+		if nextToken == "" {
+			return nil
+		}
+		token = nextToken
+	}
+}
+
+// isReadOnlyDriver checks if the driver can only read the backup target
+func isReadOnlyDriver(driver BackupStoreDriver) bool {
+	readOnlyDriver, ok := driver.(BackupStoreReadOnlyDriver)
+	return ok && readOnlyDriver.IsReadOnly()
+}
+
+// readFileRange reads up to length bytes of the file from offset. The whole file is read and the rest of the
+// file is discarded if the driver doesn't support the ranged reads.
+func readFileRange(driver BackupStoreDriver, filePath string, offset, length int64) ([]byte, error) {
+	var (
+		rc  io.ReadCloser
+		err error
+	)
+	if reader, ok := driver.(BackupStoreRangeReader); ok {
+		rc, err = reader.ReadRange(filePath, offset, length)
+	} else {
+		rc, err = driver.Read(filePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	if _, ok := driver.(BackupStoreRangeReader); !ok {
+		if _, err := io.CopyN(io.Discard, rc, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+	return io.ReadAll(io.LimitReader(rc, length))
 }
@@ -0,0 +1,155 @@
+package backupstore
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorClass is the canonical class of the backup store driver failures, regardless of the backend
+type ErrorClass string
+
+const (
+	ErrorClassNotFound         = ErrorClass("NotFound")
+	ErrorClassPermissionDenied = ErrorClass("PermissionDenied")
+	ErrorClassConflict         = ErrorClass("Conflict")
+	ErrorClassInvalid          = ErrorClass("Invalid")
+	ErrorClassQuotaExceeded    = ErrorClass("QuotaExceeded")
+	ErrorClassArchived         = ErrorClass("Archived")
+	// ErrorClassThrottled is the request rejected by the rate limit of the backend
+	ErrorClassThrottled = ErrorClass("Throttled")
+	// ErrorClassUnavailable is the transient failure of the backend or the network, e.g. 5xx or timeouts
+	ErrorClassUnavailable = ErrorClass("Unavailable")
+	ErrorClassUnknown     = ErrorClass("Unknown")
+)
+
+// IsRetryable checks if the request failed by the class may succeed when retried. The unknown failures are
+// retryable, since most of the failures not classified by the drivers are transient network failures.
+func (c ErrorClass) IsRetryable() bool {
+	switch c {
+	case ErrorClassThrottled, ErrorClassUnavailable, ErrorClassUnknown:
+		return true
+	}
+	return false
+}
+
+// DriverError is the backend specific failure of the backup store driver classified into the canonical class
+type DriverError struct {
+	Class ErrorClass
+	// Code is the error code of the backend, e.g. the AWS error code or the Azure storage error code
+	Code string
+	Err  error
+}
+
+func (e *DriverError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DriverError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable checks if the request may succeed when retried
+func (e *DriverError) IsRetryable() bool {
+	return e.Class.IsRetryable()
+}
+
+// IsDriverError checks if the error is classified by the backup store driver
+func IsDriverError(err error) bool {
+	var driverErr *DriverError
+	return errors.As(err, &driverErr)
+}
+
+// NewDriverError classifies the error of the backend, the class is derived from the error if it's empty
+func NewDriverError(class ErrorClass, code string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if class == "" {
+		class = GetErrorClass(err)
+	}
+	return &DriverError{Class: class, Code: code, Err: err}
+}
+
+// ClassifyHTTPStatus returns the class of the failed HTTP request by the status code
+func ClassifyHTTPStatus(statusCode int) ErrorClass {
+	switch {
+	case statusCode == http.StatusNotFound:
+		return ErrorClassNotFound
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ErrorClassPermissionDenied
+	case statusCode == http.StatusConflict || statusCode == http.StatusPreconditionFailed:
+		return ErrorClassConflict
+	case statusCode == http.StatusTooManyRequests:
+		return ErrorClassThrottled
+	case statusCode == http.StatusRequestTimeout || statusCode >= http.StatusInternalServerError:
+		return ErrorClassUnavailable
+	case statusCode >= http.StatusBadRequest:
+		return ErrorClassInvalid
+	}
+	return ErrorClassUnknown
+}
+
+// GetErrorClass returns the canonical class of the failure. The errors classified by the drivers keep their
+// class, and the errno, the network and the library errors are classified here.
+func GetErrorClass(err error) ErrorClass {
+	if err == nil {
+		return ""
+	}
+
+	var driverErr *DriverError
+	if errors.As(err, &driverErr) {
+		return driverErr.Class
+	}
+	switch {
+	case IsConflictError(err):
+		return ErrorClassConflict
+	case IsArchivedError(err):
+		return ErrorClassArchived
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorClassUnavailable
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ENOENT:
+			return ErrorClassNotFound
+		case syscall.EACCES, syscall.EPERM, syscall.EROFS:
+			return ErrorClassPermissionDenied
+		case syscall.ENOSPC, syscall.EDQUOT:
+			return ErrorClassQuotaExceeded
+		case syscall.EEXIST:
+			return ErrorClassConflict
+		case syscall.EINVAL, syscall.ENAMETOOLONG, syscall.ENOTDIR, syscall.EISDIR:
+			return ErrorClassInvalid
+		case syscall.EAGAIN, syscall.EINTR, syscall.EIO, syscall.ETIMEDOUT, syscall.ECONNRESET,
+			syscall.ECONNREFUSED, syscall.ECONNABORTED, syscall.EHOSTUNREACH, syscall.ENETUNREACH,
+			syscall.EPIPE, syscall.ESTALE:
+			return ErrorClassUnavailable
+		}
+		return ErrorClassUnknown
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return ErrorClassNotFound
+	case errors.Is(err, os.ErrPermission):
+		return ErrorClassPermissionDenied
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrorClassUnavailable
+	}
+	return ErrorClassUnknown
+}
+
+// IsRetryableError checks if the failed request may succeed when retried, so the callers can back off and retry
+// the failures of any backup store driver uniformly
+func IsRetryableError(err error) bool {
+	return err != nil && GetErrorClass(err).IsRetryable()
+}
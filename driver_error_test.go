@@ -0,0 +1,58 @@
+package backupstore
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDriverErrorClass(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(ErrorClass(""), GetErrorClass(nil))
+	assert.False(IsRetryableError(nil))
+
+	// the class of the driver is kept through the wrapping
+	err := errors.Wrap(NewDriverError(ErrorClassThrottled, "SlowDown", fmt.Errorf("slow down")), "failed to put block")
+	assert.True(IsDriverError(err))
+	assert.Equal(ErrorClassThrottled, GetErrorClass(err))
+	assert.True(IsRetryableError(err))
+	assert.Equal("failed to put block: slow down", err.Error())
+	assert.Nil(NewDriverError(ErrorClassUnknown, "", nil))
+
+	// the class is derived from the error if the driver doesn't classify it
+	err = NewDriverError("", "", &os.PathError{Op: "open", Path: "volume.cfg", Err: syscall.ENOENT})
+	assert.Equal(ErrorClassNotFound, GetErrorClass(err))
+	assert.False(IsRetryableError(err))
+
+	for err, class := range map[error]ErrorClass{
+		&os.PathError{Op: "write", Path: "blk", Err: syscall.ENOSPC}: ErrorClassQuotaExceeded,
+		&os.PathError{Op: "read", Path: "blk", Err: syscall.EIO}:     ErrorClassUnavailable,
+		syscall.EACCES: ErrorClassPermissionDenied,
+		os.ErrNotExist: ErrorClassNotFound,
+		&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}: ErrorClassUnavailable,
+		&net.DNSError{Err: "no such host", Name: "minio"}:   ErrorClassUnavailable,
+		context.DeadlineExceeded:                            ErrorClassUnavailable,
+		&ConflictError{Path: "volume.cfg"}:                  ErrorClassConflict,
+		&ArchivedError{Path: "blk"}:                         ErrorClassArchived,
+		fmt.Errorf("unknown"):                               ErrorClassUnknown,
+	} {
+		assert.Equal(class, GetErrorClass(err), err.Error())
+	}
+	assert.True(ErrorClassUnknown.IsRetryable())
+	assert.False(ErrorClassArchived.IsRetryable())
+
+	assert.Equal(ErrorClassNotFound, ClassifyHTTPStatus(http.StatusNotFound))
+	assert.Equal(ErrorClassPermissionDenied, ClassifyHTTPStatus(http.StatusForbidden))
+	assert.Equal(ErrorClassConflict, ClassifyHTTPStatus(http.StatusPreconditionFailed))
+	assert.Equal(ErrorClassThrottled, ClassifyHTTPStatus(http.StatusTooManyRequests))
+	assert.Equal(ErrorClassUnavailable, ClassifyHTTPStatus(http.StatusBadGateway))
+	assert.Equal(ErrorClassInvalid, ClassifyHTTPStatus(http.StatusBadRequest))
+}
@@ -0,0 +1,83 @@
+package backupstore
+
+import (
+	"bytes"
+
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+)
+
+const (
+	// luksHeaderSize is read from the start of the snapshot to detect the LUKS header
+	luksHeaderSize = 4096
+)
+
+// luksMagic starts both the LUKS1 and the LUKS2 headers
+var luksMagic = []byte{'L', 'U', 'K', 'S', 0xba, 0xbe}
+
+// isSnapshotEncrypted checks if the snapshot starts with a LUKS header, the encrypted data cannot be compressed
+func isSnapshotEncrypted(config *DeltaBackupConfig) (bool, error) {
+	if config.Volume.Size > 0 && config.Volume.Size < luksHeaderSize {
+		return false, nil
+	}
+	header := make([]byte, luksHeaderSize)
+	if err := config.DeltaOps.ReadSnapshot(config.Snapshot.Name, config.Volume.Name, 0, header); err != nil {
+		return false, err
+	}
+	return bytes.HasPrefix(header, luksMagic), nil
+}
+
+// skipCompressionForEncryptedVolume switches the compression method of the volume to none if the backup is
+// encryption aware and the volume is LUKS encrypted. The blocks are deduplicated across the backups and
+// decompressed by the compression method of the volume, so it's only switched before the volume has any block.
+// The volume already backed up keeps its compression method, it can be migrated by MigrateVolumeCompression.
+func skipCompressionForEncryptedVolume(config *DeltaBackupConfig, targets []*backupTarget) error {
+	if !config.EncryptionAware || targets[0].volume.CompressionMethod == "none" {
+		return nil
+	}
+
+	log := log.WithFields(logrus.Fields{
+		LogFieldVolume:   config.Volume.Name,
+		LogFieldSnapshot: config.Snapshot.Name,
+	})
+	encrypted, err := isSnapshotEncrypted(config)
+	if err != nil {
+		log.WithError(err).Warn("Failed to detect LUKS encryption, keeping the compression method")
+		return nil
+	}
+	if !encrypted {
+		return nil
+	}
+
+	for _, target := range targets {
+		if target.volume.LastBackupName != "" {
+			log.Infof("Volume is LUKS encrypted but already backed up to %v, keeping compression method %v",
+				target.destURL, target.volume.CompressionMethod)
+			return nil
+		}
+		blockNames, err := getBlockNamesForVolume(target.bsDriver, target.volume.Name)
+		if err != nil {
+			return err
+		}
+		if len(blockNames) > 0 {
+			log.Infof("Volume is LUKS encrypted but has blocks in %v, keeping compression method %v",
+				target.destURL, target.volume.CompressionMethod)
+			return nil
+		}
+	}
+
+	for _, target := range targets {
+		volume, err := updateVolume(target.bsDriver, target.volume.Name, func(v *Volume) error {
+			v.CompressionMethod = "none"
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		target.volume.CompressionMethod = volume.CompressionMethod
+	}
+	config.Volume.CompressionMethod = "none"
+	log.Info("Volume is LUKS encrypted, skipping the compression of its blocks")
+	return nil
+}
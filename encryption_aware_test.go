@@ -0,0 +1,55 @@
+package backupstore
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipCompressionForEncryptedVolume(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	size := int64(4 * DEFAULT_BLOCK_SIZE)
+	source := &memoryBlockSource{data: make([]byte, size)}
+	config := &DeltaBackupConfig{
+		Volume:          &Volume{Name: "pvc-1", Size: size, CompressionMethod: "lz4"},
+		Snapshot:        &Snapshot{Name: "snap"},
+		DeltaOps:        newBlockSourceOperations(source, nil),
+		EncryptionAware: true,
+	}
+	assert.NoError(addVolume(m, &Volume{Name: "pvc-1", Size: size, CompressionMethod: "lz4"}))
+	newTargets := func() []*backupTarget {
+		volume, err := loadVolume(m, "pvc-1")
+		assert.NoError(err)
+		return []*backupTarget{{bsDriver: m, volume: volume}}
+	}
+
+	// the unencrypted volume is compressed
+	encrypted, err := isSnapshotEncrypted(config)
+	assert.NoError(err)
+	assert.False(encrypted)
+	targets := newTargets()
+	assert.NoError(skipCompressionForEncryptedVolume(config, targets))
+	assert.Equal("lz4", targets[0].volume.CompressionMethod)
+
+	// the encrypted volume with blocks keeps its compression method
+	copy(source.data, luksMagic)
+	assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", "checksum"), bytes.NewReader([]byte("block"))))
+	targets = newTargets()
+	assert.NoError(skipCompressionForEncryptedVolume(config, targets))
+	assert.Equal("lz4", targets[0].volume.CompressionMethod)
+
+	assert.NoError(m.Remove(getBlockFilePath(m, "pvc-1", "checksum")))
+	targets = newTargets()
+	assert.NoError(skipCompressionForEncryptedVolume(config, targets))
+	assert.Equal("none", targets[0].volume.CompressionMethod)
+	assert.Equal("none", config.Volume.CompressionMethod)
+	volume, err := loadVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal("none", volume.CompressionMethod)
+}
@@ -0,0 +1,90 @@
+package backupstore
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+	"github.com/longhorn/backupstore/util"
+)
+
+// EncryptionRequiredError is returned when the backup volume requires the encryption but the snapshot being backed
+// up isn't LUKS encrypted, so the sensitive data isn't backed up in plaintext by accident
+type EncryptionRequiredError struct {
+	VolumeName   string
+	SnapshotName string
+}
+
+func (e *EncryptionRequiredError) Error() string {
+	return fmt.Sprintf("backup volume %v requires encryption but snapshot %v is not encrypted", e.VolumeName,
+		e.SnapshotName)
+}
+
+// IsEncryptionRequiredError checks if the error is caused by backing up an unencrypted snapshot of the backup volume
+// requiring the encryption
+func IsEncryptionRequiredError(err error) bool {
+	var encryptionErr *EncryptionRequiredError
+	return errors.As(err, &encryptionErr)
+}
+
+// SetBackupVolumeEncryptionRequired sets if the backups of the backup volume must be encrypted. The policy only
+// applies to the backups created afterwards.
+func SetBackupVolumeEncryptionRequired(volumeName, destURL string, required bool) error {
+	if !util.ValidateName(volumeName) {
+		return fmt.Errorf("invalid volume name %v", volumeName)
+	}
+
+	bsDriver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return err
+	}
+
+	// prevent racing with the backup creation which updates the volume config
+	lock, err := New(bsDriver, volumeName, DELETION_LOCK)
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	volume, err := loadVolume(bsDriver, volumeName)
+	if err != nil {
+		return err
+	}
+	volume.EncryptionRequired = required
+	if err := saveVolume(bsDriver, volume); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		LogFieldVolume:  volumeName,
+		LogFieldDestURL: destURL,
+	}).Infof("Set backup volume encryption required to %v", required)
+	return nil
+}
+
+// checkVolumeEncryptionPolicy fails the backup if any backup target requires the encryption of the volume and the
+// snapshot doesn't start with a LUKS header. The backup fails as well if the header cannot be read.
+func checkVolumeEncryptionPolicy(config *DeltaBackupConfig, targets []*backupTarget) error {
+	required := false
+	for _, target := range targets {
+		required = required || target.volume.EncryptionRequired
+	}
+	if !required {
+		return nil
+	}
+
+	encrypted, err := isSnapshotEncrypted(config)
+	if err != nil {
+		return errors.Wrapf(err, "failed to check the encryption of snapshot %v required by backup volume %v",
+			config.Snapshot.Name, config.Volume.Name)
+	}
+	if !encrypted {
+		return &EncryptionRequiredError{VolumeName: config.Volume.Name, SnapshotName: config.Snapshot.Name}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package backupstore
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeEncryptionPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		m.fs.MkdirAll(filepath.Join(backupstoreBase, VOLUME_DIRECTORY), 0755)
+		return m, nil
+	})
+
+	size := int64(4 * DEFAULT_BLOCK_SIZE)
+	source := &memoryBlockSource{data: make([]byte, size)}
+	config := &DeltaBackupConfig{
+		Volume:   &Volume{Name: "pvc-1", Size: size},
+		Snapshot: &Snapshot{Name: "snap"},
+		DeltaOps: newBlockSourceOperations(source, nil),
+	}
+	assert.NoError(addVolume(m, &Volume{Name: "pvc-1", Size: size}))
+	newTargets := func() []*backupTarget {
+		volume, err := loadVolume(m, "pvc-1")
+		assert.NoError(err)
+		return []*backupTarget{{bsDriver: m, volume: volume}}
+	}
+
+	// the unencrypted snapshot is backed up unless the volume requires the encryption
+	assert.NoError(checkVolumeEncryptionPolicy(config, newTargets()))
+	assert.NoError(SetBackupVolumeEncryptionRequired("pvc-1", mockDriverURL, true))
+	targets := newTargets()
+	assert.True(targets[0].volume.EncryptionRequired)
+	assert.True(fillVolumeInfo(targets[0].volume).EncryptionRequired)
+	err := checkVolumeEncryptionPolicy(config, targets)
+	assert.True(IsEncryptionRequiredError(err))
+
+	copy(source.data, luksMagic)
+	assert.NoError(checkVolumeEncryptionPolicy(config, targets))
+
+	assert.NoError(SetBackupVolumeEncryptionRequired("pvc-1", mockDriverURL, false))
+	assert.False(newTargets()[0].volume.EncryptionRequired)
+}
@@ -0,0 +1,155 @@
+package backupstore
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// EventType is the type of the activity reported to the event sinks
+type EventType string
+
+const (
+	EventBackupStarted    = EventType("BackupStarted")
+	EventBlocksUploaded   = EventType("BlocksUploaded")
+	EventBackupCompleted  = EventType("BackupCompleted")
+	EventBackupFailed     = EventType("BackupFailed")
+	EventBackupDeleted    = EventType("BackupDeleted")
+	EventRestoreCompleted = EventType("RestoreCompleted")
+	EventRestoreFailed    = EventType("RestoreFailed")
+	EventLockStalled      = EventType("LockStalled")
+	EventLockReleased     = EventType("LockReleased")
+)
+
+const (
+	// EVENT_PROGRESS_MILESTONE is the backup progress step in percentage between the BlocksUploaded events
+	EVENT_PROGRESS_MILESTONE = 10
+)
+
+// Event is the activity of the backupstore reported to the event sinks
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	DestURL      string
+	VolumeName   string
+	BackupName   string `json:",omitempty"`
+	BackupURL    string `json:",omitempty"`
+	SnapshotName string `json:",omitempty"`
+	LockName     string `json:",omitempty"`
+
+	// Progress is the progress of the backup in percentage
+	Progress int    `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+// EventSink receives the events of the backups and the restores, so the external systems can track the
+// backupstore activity without polling. The sinks are called synchronously and must not block.
+type EventSink interface {
+	HandleEvent(event Event)
+}
+
+var (
+	eventSinksLock sync.RWMutex
+	eventSinks     = map[string]EventSink{}
+)
+
+// SetEventSink registers the event sink by name, a nil sink unregisters the existing one
+func SetEventSink(name string, sink EventSink) {
+	eventSinksLock.Lock()
+	defer eventSinksLock.Unlock()
+	if sink == nil {
+		delete(eventSinks, name)
+		return
+	}
+	eventSinks[name] = sink
+}
+
+// emitEvent sends the event to all the registered sinks in the order of their names
+func emitEvent(event Event) {
+	eventSinksLock.RLock()
+	names := make([]string, 0, len(eventSinks))
+	for name := range eventSinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sinks := make([]EventSink, 0, len(names))
+	for _, name := range names {
+		sinks = append(sinks, eventSinks[name])
+	}
+	eventSinksLock.RUnlock()
+
+	if len(sinks) == 0 {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	for _, sink := range sinks {
+		sink.HandleEvent(event)
+	}
+}
+
+// emitBackupEvent sends the event of the delta block backup for each of the active backup targets
+func emitBackupEvent(eventType EventType, targets []*backupTarget, config *DeltaBackupConfig, backupName string, progress int) {
+	for _, target := range getActiveBackupTargets(targets) {
+		emitEvent(Event{
+			Type:         eventType,
+			DestURL:      target.destURL,
+			VolumeName:   config.Volume.Name,
+			BackupName:   backupName,
+			SnapshotName: config.Snapshot.Name,
+			Progress:     progress,
+		})
+	}
+}
+
+// emitBackupResultEvents sends the BackupCompleted or BackupFailed event for each of the backup targets
+func emitBackupResultEvents(targets []*backupTarget, config *DeltaBackupConfig, backupName string) {
+	for _, target := range targets {
+		status := target.status()
+		event := Event{
+			Type:         EventBackupCompleted,
+			DestURL:      target.destURL,
+			VolumeName:   config.Volume.Name,
+			BackupName:   backupName,
+			BackupURL:    status.BackupURL,
+			SnapshotName: config.Snapshot.Name,
+			Progress:     PROGRESS_PERCENTAGE_BACKUP_TOTAL,
+		}
+		if status.Error != "" {
+			event.Type = EventBackupFailed
+			event.Progress = 0
+			event.Error = status.Error
+		}
+		emitEvent(event)
+	}
+}
+
+// emitRestoreEvent sends the RestoreCompleted or RestoreFailed event depending on the restore error
+func emitRestoreEvent(bsDriver BackupStoreDriver, backupURL, volumeName, backupName string, err error) {
+	event := Event{
+		Type:       EventRestoreCompleted,
+		DestURL:    bsDriver.GetURL(),
+		VolumeName: volumeName,
+		BackupName: backupName,
+		BackupURL:  backupURL,
+		Progress:   PROGRESS_PERCENTAGE_BACKUP_TOTAL,
+	}
+	if err != nil {
+		event.Type = EventRestoreFailed
+		event.Progress = 0
+		event.Error = err.Error()
+	}
+	emitEvent(event)
+}
+
+func emitBackupDeletedEvent(bsDriver BackupStoreDriver, volumeName, backupName string) {
+	emitEvent(Event{
+		Type:       EventBackupDeleted,
+		DestURL:    bsDriver.GetURL(),
+		VolumeName: volumeName,
+		BackupName: backupName,
+		BackupURL:  EncodeBackupURL(backupName, volumeName, bsDriver.GetURL()),
+	})
+}
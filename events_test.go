@@ -0,0 +1,69 @@
+package backupstore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type eventRecorder struct {
+	events []Event
+}
+
+func (r *eventRecorder) HandleEvent(event Event) {
+	r.events = append(r.events, event)
+}
+
+func TestBackupEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	recorder := &eventRecorder{}
+	SetEventSink("recorder", recorder)
+	defer SetEventSink("recorder", nil)
+
+	config := &DeltaBackupConfig{
+		Volume:   &Volume{Name: "pvc-1"},
+		Snapshot: &Snapshot{Name: "snap-1"},
+		DeltaOps: &blockSourceOperations{},
+	}
+	deltaBackup := &Backup{Name: "backup-1", ProcessingBlocks: &ProcessingBlocks{blocks: map[string][]*BlockMapping{}}}
+	targets := []*backupTarget{
+		{destURL: "mock://target-1", backupURL: "mock://target-1?backup=backup-1&volume=pvc-1"},
+		{destURL: "mock://target-2"},
+	}
+
+	// the milestones are reported once per crossed progress step
+	progress := &progress{totalBlockCounts: 4}
+	for i := 0; i < 4; i++ {
+		checksum := fmt.Sprintf("checksum-%v", i)
+		assert.False(isBlockBeingProcessed(deltaBackup, int64(i)*DEFAULT_BLOCK_SIZE, checksum))
+		completeBlock(targets, config, deltaBackup, progress, checksum, true)
+	}
+	assert.Len(recorder.events, 8)
+	for i := 2; i < len(recorder.events); i += 2 {
+		assert.Equal(EventBlocksUploaded, recorder.events[i].Type)
+		assert.Greater(recorder.events[i].Progress, recorder.events[i-2].Progress)
+	}
+
+	recorder.events = nil
+	targets[1].setError(fmt.Errorf("injected failure"))
+	emitBackupResultEvents(targets, config, deltaBackup.Name)
+	assert.Len(recorder.events, 2)
+	assert.Equal(EventBackupCompleted, recorder.events[0].Type)
+	assert.Equal(targets[0].backupURL, recorder.events[0].BackupURL)
+	assert.Equal(EventBackupFailed, recorder.events[1].Type)
+	assert.Equal("mock://target-2", recorder.events[1].DestURL)
+	assert.Equal("injected failure", recorder.events[1].Error)
+	assert.False(recorder.events[1].Time.IsZero())
+
+	// the failed backup targets are skipped for the events of the in progress backup
+	recorder.events = nil
+	emitBackupEvent(EventBackupStarted, targets, config, deltaBackup.Name, 0)
+	assert.Len(recorder.events, 1)
+
+	SetEventSink("recorder", nil)
+	recorder.events = nil
+	emitBackupEvent(EventBackupStarted, targets, config, deltaBackup.Name, 0)
+	assert.Empty(recorder.events)
+}
@@ -0,0 +1,124 @@
+package backupstore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Version is the version of the library recorded in the created backups, it can be set by the linker
+var Version = "dev"
+
+// The features a backup may require for restoring. The restorers not supporting any of the required features
+// fail with UnsupportedFeatureError instead of restoring the backup incorrectly.
+const (
+	FeatureBlockIndex  = "block-index"
+	FeatureEncryption  = "encryption"
+	FeaturePacking     = "packing"
+	FeatureCDCChunking = "cdc-chunking"
+	FeatureInlineData  = "inline-data"
+	// FeatureBlockCompression is required by the backups with the blocks not compressed by the method of the backup
+	FeatureBlockCompression = "block-compression"
+	// FeatureBlockHeader is required by the backups referencing the blocks with the header
+	FeatureBlockHeader = "block-header"
+)
+
+var supportedFeatures = map[string]bool{
+	FeatureBlockIndex:       true,
+	FeatureInlineData:       true,
+	FeatureBlockCompression: true,
+	FeatureBlockHeader:      true,
+}
+
+// UnsupportedFeatureError is returned when the backup requires the features not supported by this version
+type UnsupportedFeatureError struct {
+	BackupName string
+	CreatedBy  string
+	Features   []string
+}
+
+func (e *UnsupportedFeatureError) Error() string {
+	return fmt.Sprintf("backup %v created by version %v requires unsupported feature(s) %v",
+		e.BackupName, e.CreatedBy, strings.Join(e.Features, ", "))
+}
+
+// IsUnsupportedFeatureError checks if the error is caused by the unsupported features required by the backup
+func IsUnsupportedFeatureError(err error) bool {
+	var featureErr *UnsupportedFeatureError
+	return errors.As(err, &featureErr)
+}
+
+// GetRequiredFeatures returns the features required for restoring the backup
+func GetRequiredFeatures(backupURL string) ([]string, error) {
+	bsDriver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return nil, err
+	}
+
+	backupName, volumeName, _, err := DecodeBackupURL(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	if backupName == "" {
+		return nil, fmt.Errorf("missing backup name in %v", backupURL)
+	}
+
+	backup, err := loadBackup(bsDriver, backupName, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	return backup.RequiredFeatures, nil
+}
+
+// checkBackupFeatures fails if the backup requires the features not supported by this version
+func checkBackupFeatures(backup *Backup) error {
+	unsupported := []string{}
+	for _, feature := range backup.RequiredFeatures {
+		if !supportedFeatures[feature] {
+			unsupported = append(unsupported, feature)
+		}
+	}
+	if len(unsupported) == 0 {
+		return nil
+	}
+	return &UnsupportedFeatureError{
+		BackupName: backup.Name,
+		CreatedBy:  backup.CreatedBy,
+		Features:   unsupported,
+	}
+}
+
+func addFeature(features []string, feature string) []string {
+	for _, f := range features {
+		if f == feature {
+			return features
+		}
+	}
+	features = append(append([]string{}, features...), feature)
+	sort.Strings(features)
+	return features
+}
+
+func removeFeature(features []string, feature string) []string {
+	result := []string{}
+	for _, f := range features {
+		if f != feature {
+			result = append(result, f)
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+func hasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package backupstore
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestRequiredFeatures(t *testing.T) {
+	assert := assert.New(t)
+
+	backup := &Backup{
+		Name:       "backup-1",
+		VolumeName: "pvc-1",
+		CreatedBy:  "v1.0.0",
+		Blocks:     []BlockMapping{{Offset: 0, BlockChecksum: util.GetChecksum([]byte{0})}},
+	}
+
+	// the block index feature is only required if the blocks are stored in the index
+	data, err := json.Marshal(newBackupConfig(backup, true))
+	assert.NoError(err)
+	loaded := &Backup{}
+	assert.NoError(json.Unmarshal(data, &backupConfig{Backup: loaded}))
+	assert.Equal([]string{FeatureBlockIndex}, loaded.RequiredFeatures)
+	assert.Equal("v1.0.0", loaded.CreatedBy)
+	assert.NoError(checkBackupFeatures(loaded))
+
+	data, err = json.Marshal(newBackupConfig(loaded, false))
+	assert.NoError(err)
+	legacy := &Backup{}
+	assert.NoError(json.Unmarshal(data, &backupConfig{Backup: legacy}))
+	assert.Empty(legacy.RequiredFeatures)
+
+	backup.RequiredFeatures = []string{FeatureEncryption, "unknown"}
+	err = checkBackupFeatures(backup)
+	assert.True(IsUnsupportedFeatureError(err))
+	assert.Contains(err.Error(), "v1.0.0")
+	assert.Contains(err.Error(), FeatureEncryption+", unknown")
+}
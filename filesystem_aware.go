@@ -0,0 +1,74 @@
+package backupstore
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/backupstore/fsmap"
+	"github.com/longhorn/backupstore/types"
+)
+
+// snapshotReader reads the snapshot of the backup by DeltaOps, so the filesystem on it can be parsed
+type snapshotReader struct {
+	deltaOps DeltaBlockBackupOperations
+	snapshot string
+	volume   string
+}
+
+func (r *snapshotReader) ReadAt(p []byte, off int64) (int, error) {
+	if err := r.deltaOps.ReadSnapshot(r.snapshot, r.volume, off, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// filterUnusedBlocks drops the blocks not allocated by the ext4 or xfs filesystem on the snapshot from the
+// changed blocks, so the deleted data is not backed up. The changed blocks are returned as is if the backup
+// is not filesystem aware or the filesystem cannot be parsed.
+func filterUnusedBlocks(config *DeltaBackupConfig, delta *types.Mappings) *types.Mappings {
+	if !config.FilesystemAware || config.Volume.Size == 0 {
+		return delta
+	}
+
+	log := log.WithFields(logrus.Fields{
+		"volume":   config.Volume.Name,
+		"snapshot": config.Snapshot.Name,
+	})
+	reader := &snapshotReader{
+		deltaOps: config.DeltaOps,
+		snapshot: config.Snapshot.Name,
+		volume:   config.Volume.Name,
+	}
+	usedMap, err := fsmap.Parse(reader, config.Volume.Size, delta.BlockSize)
+	if err != nil {
+		log.WithError(err).Warn("Failed to parse filesystem allocation, backing up all the changed blocks")
+		return delta
+	}
+
+	filtered, skipped := filterMappings(delta, usedMap)
+	log.Infof("Skipped %v changed blocks unallocated by %v filesystem", skipped, usedMap.Filesystem)
+	return filtered
+}
+
+// filterMappings keeps the blocks of the mappings used by the filesystem, and returns the number of the
+// dropped blocks
+func filterMappings(delta *types.Mappings, usedMap *fsmap.UsedMap) (*types.Mappings, int64) {
+	filtered := &types.Mappings{
+		Mappings:  []types.Mapping{},
+		BlockSize: delta.BlockSize,
+	}
+	skipped := int64(0)
+	for _, m := range delta.Mappings {
+		for offset := m.Offset; offset < m.Offset+m.Size; offset += delta.BlockSize {
+			if !usedMap.IsUsed(offset, delta.BlockSize) {
+				skipped++
+				continue
+			}
+			if n := len(filtered.Mappings); n > 0 && filtered.Mappings[n-1].Offset+filtered.Mappings[n-1].Size == offset {
+				filtered.Mappings[n-1].Size += delta.BlockSize
+				continue
+			}
+			filtered.Mappings = append(filtered.Mappings, types.Mapping{Offset: offset, Size: delta.BlockSize})
+		}
+	}
+	return filtered, skipped
+}
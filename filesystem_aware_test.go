@@ -0,0 +1,59 @@
+package backupstore
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/types"
+)
+
+func TestFilterUnusedBlocks(t *testing.T) {
+	assert := assert.New(t)
+
+	size := int64(32 * DEFAULT_BLOCK_SIZE)
+	source := &memoryBlockSource{data: make([]byte, size)}
+	all := &types.Mappings{
+		Mappings:  []types.Mapping{{Offset: 0, Size: size}},
+		BlockSize: DEFAULT_BLOCK_SIZE,
+	}
+	config := &DeltaBackupConfig{
+		Volume:          &Volume{Name: "vol", Size: size},
+		Snapshot:        &Snapshot{Name: "snap"},
+		DeltaOps:        newBlockSourceOperations(source, nil),
+		FilesystemAware: true,
+	}
+
+	// the changed blocks are kept if there is no filesystem
+	assert.Equal(all, filterUnusedBlocks(config, all))
+
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not found")
+	}
+	image := filepath.Join(t.TempDir(), "ext4.img")
+	assert.NoError(os.WriteFile(image, source.data, 0600))
+	out, err := exec.Command("mkfs.ext4", "-q", "-F", "-b", "4096", image).CombinedOutput()
+	assert.NoError(err, string(out))
+	source.data, err = os.ReadFile(image)
+	assert.NoError(err)
+
+	filtered := filterUnusedBlocks(config, all)
+	assert.Equal(int64(DEFAULT_BLOCK_SIZE), filtered.BlockSize)
+	assert.NotEmpty(filtered.Mappings)
+	assert.Equal(int64(0), filtered.Mappings[0].Offset)
+	used := int64(0)
+	for i, m := range filtered.Mappings {
+		assert.Equal(int64(0), m.Size%DEFAULT_BLOCK_SIZE)
+		if i > 0 {
+			assert.Greater(m.Offset, filtered.Mappings[i-1].Offset+filtered.Mappings[i-1].Size)
+		}
+		used += m.Size
+	}
+	assert.Less(used, size)
+
+	config.FilesystemAware = false
+	assert.Equal(all, filterUnusedBlocks(config, all))
+}
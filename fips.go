@@ -0,0 +1,123 @@
+package backupstore
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/longhorn/backupstore/http"
+)
+
+const (
+	// ComplianceModeFIPS is recorded in the backups created in FIPS mode
+	ComplianceModeFIPS = "fips"
+)
+
+var (
+	fipsModeLock sync.RWMutex
+	fipsMode     bool
+)
+
+// BackupStoreFIPSChecker can be optionally implemented by the drivers whose connections to the backend may use
+// the algorithms not approved by FIPS 140, e.g. the unencrypted or unverified connections
+type BackupStoreFIPSChecker interface {
+	// CheckFIPSCompliance returns the reason why the driver isn't compliant, or nil if it is
+	CheckFIPSCompliance() error
+}
+
+// SetFIPSModeEnabled enables the strict FIPS mode, which only allows the FIPS-approved algorithms: the blocks are
+// checksummed by SHA-2, the TLS connections are restricted to the AES-GCM cipher suites, and the block uploads
+// aren't verified by the MD5 checksums returned by the backends. The backup targets not compliant are rejected
+// with NonCompliantTargetError, and the backups not created in FIPS mode cannot be restored and fail with
+// NonCompliantBackupError. The backups created in FIPS mode record it in ComplianceMode for auditing.
+func SetFIPSModeEnabled(enabled bool) {
+	fipsModeLock.Lock()
+	defer fipsModeLock.Unlock()
+	fipsMode = enabled
+	http.SetFIPSModeEnabled(enabled)
+}
+
+// IsFIPSModeEnabled checks if the strict FIPS mode is enabled
+func IsFIPSModeEnabled() bool {
+	fipsModeLock.RLock()
+	defer fipsModeLock.RUnlock()
+	return fipsMode
+}
+
+// getComplianceMode returns the compliance mode recorded in the backups created now
+func getComplianceMode() string {
+	if IsFIPSModeEnabled() {
+		return ComplianceModeFIPS
+	}
+	return ""
+}
+
+// NonCompliantTargetError is returned in FIPS mode when the backup target uses the algorithms not approved by FIPS
+type NonCompliantTargetError struct {
+	URL    string
+	Reason error
+}
+
+func (e *NonCompliantTargetError) Error() string {
+	return fmt.Sprintf("backup target %v is not FIPS compliant: %v", e.URL, e.Reason)
+}
+
+func (e *NonCompliantTargetError) Unwrap() error {
+	return e.Reason
+}
+
+// IsNonCompliantTargetError checks if the error is caused by the backup target not compliant with FIPS mode
+func IsNonCompliantTargetError(err error) bool {
+	var targetErr *NonCompliantTargetError
+	return errors.As(err, &targetErr)
+}
+
+// NonCompliantBackupError is returned in FIPS mode when restoring the backup not created in FIPS mode
+type NonCompliantBackupError struct {
+	BackupName     string
+	VolumeName     string
+	ComplianceMode string
+}
+
+func (e *NonCompliantBackupError) Error() string {
+	mode := e.ComplianceMode
+	if mode == "" {
+		mode = "none"
+	}
+	return fmt.Sprintf("backup %v of volume %v is not FIPS compliant, compliance mode: %v",
+		e.BackupName, e.VolumeName, mode)
+}
+
+// IsNonCompliantBackupError checks if the error is caused by the backup not compliant with FIPS mode
+func IsNonCompliantBackupError(err error) bool {
+	var backupErr *NonCompliantBackupError
+	return errors.As(err, &backupErr)
+}
+
+// checkTargetCompliance fails in FIPS mode if the driver isn't compliant
+func checkTargetCompliance(driver BackupStoreDriver) error {
+	if !IsFIPSModeEnabled() {
+		return nil
+	}
+	checker, ok := driver.(BackupStoreFIPSChecker)
+	if !ok {
+		return nil
+	}
+	if err := checker.CheckFIPSCompliance(); err != nil {
+		return &NonCompliantTargetError{URL: driver.GetURL(), Reason: err}
+	}
+	return nil
+}
+
+// checkBackupCompliance fails in FIPS mode if the backup wasn't created in FIPS mode
+func checkBackupCompliance(backup *Backup) error {
+	if !IsFIPSModeEnabled() || backup.ComplianceMode == ComplianceModeFIPS {
+		return nil
+	}
+	return &NonCompliantBackupError{
+		BackupName:     backup.Name,
+		VolumeName:     backup.VolumeName,
+		ComplianceMode: backup.ComplianceMode,
+	}
+}
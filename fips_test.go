@@ -0,0 +1,52 @@
+package backupstore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type nonCompliantMockStoreDriver struct {
+	*writableMockStoreDriver
+}
+
+func (m *nonCompliantMockStoreDriver) CheckFIPSCompliance() error {
+	return fmt.Errorf("endpoint is not connected by TLS")
+}
+
+func TestFIPSMode(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	nonCompliant := &nonCompliantMockStoreDriver{m}
+
+	backup := &Backup{Name: "backup-1", VolumeName: "pvc-1"}
+	assert.Empty(getComplianceMode())
+	assert.NoError(checkBackupCompliance(backup))
+	assert.NoError(checkTargetCompliance(nonCompliant))
+
+	SetFIPSModeEnabled(true)
+	defer SetFIPSModeEnabled(false)
+
+	err := checkBackupCompliance(backup)
+	assert.True(IsNonCompliantBackupError(err))
+	assert.Contains(err.Error(), "compliance mode: none")
+	backup.ComplianceMode = getComplianceMode()
+	assert.Equal(ComplianceModeFIPS, backup.ComplianceMode)
+	assert.NoError(checkBackupCompliance(backup))
+
+	err = checkTargetCompliance(nonCompliant)
+	assert.True(IsNonCompliantTargetError(err))
+	assert.Contains(err.Error(), "not connected by TLS")
+	assert.NoError(checkTargetCompliance(m))
+
+	// the MD5 checksums reported by the driver are ignored
+	blk := getBlockFilePath(m, "pvc-1", "0123456789abcdef")
+	corrupting := &corruptingMockStoreDriver{writableMockStoreDriver: m, corruptions: 1}
+	assert.NoError(writeBlockVerified(corrupting, blk, []byte("data"), false))
+	assert.Equal(0, corrupting.writes)
+	assert.True(m.FileExists(blk))
+}
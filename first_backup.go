@@ -0,0 +1,98 @@
+package backupstore
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+var (
+	firstBackupFastPathLock    sync.RWMutex
+	firstBackupFastPathEnabled bool
+)
+
+// SetFirstBackupFastPathEnabled enables the fast path for the first backup of a new volume. The volume config is
+// created by a conditional write and the backup lock is acquired without the wait for the conflicting locks, since
+// no other operation can hold a lock of a volume which didn't exist. This saves several round trips and the lock
+// check wait on the high latency backup targets. The backup falls back to the regular path if the volume exists or
+// is created concurrently. It's disabled by default.
+func SetFirstBackupFastPathEnabled(enabled bool) {
+	firstBackupFastPathLock.Lock()
+	defer firstBackupFastPathLock.Unlock()
+	firstBackupFastPathEnabled = enabled
+}
+
+// IsFirstBackupFastPathEnabled checks if the fast path for the first backup of a new volume is enabled
+func IsFirstBackupFastPathEnabled() bool {
+	firstBackupFastPathLock.RLock()
+	defer firstBackupFastPathLock.RUnlock()
+	return firstBackupFastPathEnabled
+}
+
+// addVolumeForFirstBackup creates the volume config and acquires the backup lock in one pass if the volume
+// directory is empty. It returns nil if the fast path doesn't apply, then the caller takes the regular path.
+func addVolumeForFirstBackup(driver BackupStoreDriver, volume *Volume, lock *FileLock) (*Volume, error) {
+	if !IsFirstBackupFastPathEnabled() {
+		return nil, nil
+	}
+	// the listing fails if the path doesn't exist
+	if fileList, err := driver.List(getVolumePath(driver, volume.Name)); err == nil && len(fileList) != 0 {
+		return nil, nil
+	}
+
+	if !util.ValidateName(volume.Name) {
+		return nil, fmt.Errorf("invalid volume name %v", volume.Name)
+	}
+	// the new volume without a compression method takes the default of the backup target, or the
+	// recommended one if there is no default
+	if volume.CompressionMethod == "" {
+		volume.CompressionMethod = getTargetConfig(driver).CompressionMethod
+		if volume.CompressionMethod == "" {
+			volume.CompressionMethod = getRecommendedCompressionMethod(driver)
+		}
+	}
+	if err := setNewVolumeBlockLayout(driver, volume); err != nil {
+		return nil, err
+	}
+	// the new volume is owned by the cluster creating it
+	if cluster, _ := GetClusterIdentity(); cluster != "" {
+		volume.OwnerClusterID = cluster
+	}
+	if writer := getLastWriter(); writer != "" {
+		volume.LastWriter = writer
+	}
+
+	// only one of the racing backups creates the volume config, the others take the regular path
+	filePath := getVolumeFilePath(driver, volume.Name)
+	if err := saveConfigInBackupStoreIfMatch(driver, filePath, volume, GetMetadataCompressionMethod(), ""); err != nil {
+		if IsConflictError(err) {
+			log.WithError(err).Infof("Volume %v was created concurrently, falling back to the regular first backup", volume.Name)
+			return nil, nil
+		}
+		log.WithError(err).Errorf("Failed to add volume %v", volume.Name)
+		return nil, err
+	}
+	setVolumeBlockLayout(driver, volume)
+	recordVolumeConfigRevision(driver, volume)
+	log.Infof("Added backupstore volume %v for the first backup", volume.Name)
+
+	if err := lock.lockUncontended(); err != nil {
+		return nil, err
+	}
+	// a lock taken between the listing and the creation of the volume config must be respected, the regular
+	// acquisition waits for it
+	for _, name := range getLockNamesForVolume(volume.Name, driver) {
+		if name != lock.Name {
+			log.Infof("Found lock %v of new volume %v, falling back to the regular lock acquisition", name, volume.Name)
+			lock.Unlock()
+			return nil, nil
+		}
+	}
+
+	v := *volume
+	if v.BackendStoreDriver == "" {
+		v.BackendStoreDriver = string(BackendStoreDriverV1)
+	}
+	return &v, nil
+}
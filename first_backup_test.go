@@ -0,0 +1,60 @@
+package backupstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddVolumeForFirstBackup(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	// the fast path is disabled by default
+	lock, err := New(m, "pvc-1", BACKUP_LOCK)
+	assert.NoError(err)
+	v, err := addVolumeForFirstBackup(m, &Volume{Name: "pvc-1"}, lock)
+	assert.NoError(err)
+	assert.Nil(v)
+	assert.False(volumeExists(m, "pvc-1"))
+
+	SetFirstBackupFastPathEnabled(true)
+	defer SetFirstBackupFastPathEnabled(false)
+
+	// the new volume is created and locked in one pass
+	volume := &Volume{Name: "pvc-1", Size: DEFAULT_BLOCK_SIZE}
+	v, err = addVolumeForFirstBackup(m, volume, lock)
+	assert.NoError(err)
+	if assert.NotNil(v) {
+		assert.Equal("pvc-1", v.Name)
+		assert.NotEmpty(v.CompressionMethod)
+		assert.Equal(volume.CompressionMethod, v.CompressionMethod)
+		assert.Equal(string(BackendStoreDriverV1), v.BackendStoreDriver)
+	}
+	assert.True(lock.Acquired)
+	assert.Equal([]string{lock.Name}, getLockNamesForVolume("pvc-1", m))
+	saved, err := loadVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal(int64(DEFAULT_BLOCK_SIZE), saved.Size)
+	assert.Equal(volume.CompressionMethod, saved.CompressionMethod)
+
+	// the existing volume takes the regular path
+	other, err := New(m, "pvc-1", BACKUP_LOCK)
+	assert.NoError(err)
+	v, err = addVolumeForFirstBackup(m, &Volume{Name: "pvc-1"}, other)
+	assert.NoError(err)
+	assert.Nil(v)
+	assert.False(other.Acquired)
+
+	assert.NoError(lock.Unlock())
+	assert.Empty(getLockNamesForVolume("pvc-1", m))
+
+	// the invalid volume name is rejected before anything is written
+	lock, err = New(m, "pvc/2", BACKUP_LOCK)
+	assert.NoError(err)
+	_, err = addVolumeForFirstBackup(m, &Volume{Name: "pvc/2"}, lock)
+	assert.Error(err)
+}
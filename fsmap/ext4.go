@@ -0,0 +1,129 @@
+package fsmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	ext4SuperblockOffset = 1024
+	ext4SuperblockSize   = 1024
+	ext4Magic            = 0xEF53
+
+	ext4IncompatRecover = 0x4
+	ext4IncompatMetaBG  = 0x10
+	ext4Incompat64Bit   = 0x80
+
+	ext4RoCompatGdtCsum      = 0x10
+	ext4RoCompatMetadataCsum = 0x400
+
+	ext4BGBlockUninit = 0x2
+
+	ext4MinDescSize = 32
+	ext4MaxDescSize = 1024
+)
+
+// parseExt4 reads the used map from the block bitmaps of the ext2/3/4 filesystem. The block groups whose
+// bitmaps are not initialized are considered used.
+func parseExt4(r io.ReaderAt, size, granularity int64) (*UsedMap, error) {
+	sb := make([]byte, ext4SuperblockSize)
+	if err := readAt(r, sb, ext4SuperblockOffset); err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	if le.Uint16(sb[0x38:]) != ext4Magic {
+		return nil, errNotDetected
+	}
+
+	incompat := le.Uint32(sb[0x60:])
+	roCompat := le.Uint32(sb[0x64:])
+	if incompat&ext4IncompatRecover != 0 {
+		return nil, fmt.Errorf("ext4 journal needs recovery, the filesystem must be frozen or unmounted for the snapshot")
+	}
+	if incompat&ext4IncompatMetaBG != 0 {
+		return nil, fmt.Errorf("%w: ext4 meta_bg feature", ErrUnsupportedFilesystem)
+	}
+
+	logBlockSize := le.Uint32(sb[0x18:])
+	if logBlockSize > 6 {
+		return nil, fmt.Errorf("invalid ext4 block size shift %v", logBlockSize)
+	}
+	blockSize := int64(1024) << logBlockSize
+	blocksCount := int64(le.Uint32(sb[0x4:]))
+	descSize := int64(ext4MinDescSize)
+	if incompat&ext4Incompat64Bit != 0 {
+		blocksCount |= int64(le.Uint32(sb[0x150:])) << 32
+		descSize = int64(le.Uint16(sb[0xFE:]))
+		if descSize < ext4MinDescSize || descSize > ext4MaxDescSize {
+			return nil, fmt.Errorf("invalid ext4 group descriptor size %v", descSize)
+		}
+	}
+	firstDataBlock := int64(le.Uint32(sb[0x14:]))
+	blocksPerGroup := int64(le.Uint32(sb[0x20:]))
+	if blocksPerGroup == 0 || blocksPerGroup > 8*blockSize || firstDataBlock >= blocksCount {
+		return nil, fmt.Errorf("invalid ext4 superblock with %v blocks per group", blocksPerGroup)
+	}
+	groups := (blocksCount - firstDataBlock + blocksPerGroup - 1) / blocksPerGroup
+
+	gdt := make([]byte, groups*descSize)
+	if _, err := r.ReadAt(gdt, (firstDataBlock+1)*blockSize); err != nil {
+		return nil, fmt.Errorf("failed to read ext4 group descriptors: %v", err)
+	}
+
+	m := newUsedMap("ext4", size, granularity)
+	// the boot sector and the superblock, and anything beyond the filesystem
+	m.markUsed(0, (firstDataBlock+1)*blockSize)
+	m.markUsed(blocksCount*blockSize, size-blocksCount*blockSize)
+
+	bitmap := make([]byte, blockSize)
+	for group := int64(0); group < groups; group++ {
+		desc := gdt[group*descSize : (group+1)*descSize]
+		start := firstDataBlock + group*blocksPerGroup
+		count := blocksPerGroup
+		if start+count > blocksCount {
+			count = blocksCount - start
+		}
+
+		flags := le.Uint16(desc[0x12:])
+		if flags&ext4BGBlockUninit != 0 && roCompat&(ext4RoCompatGdtCsum|ext4RoCompatMetadataCsum) != 0 {
+			m.markUsed(start*blockSize, count*blockSize)
+			continue
+		}
+
+		bitmapBlock := int64(le.Uint32(desc[0x0:]))
+		if descSize >= 64 {
+			bitmapBlock |= int64(le.Uint32(desc[0x20:])) << 32
+		}
+		if bitmapBlock >= blocksCount {
+			return nil, fmt.Errorf("invalid ext4 block bitmap location %v of group %v", bitmapBlock, group)
+		}
+		if _, err := r.ReadAt(bitmap, bitmapBlock*blockSize); err != nil {
+			return nil, fmt.Errorf("failed to read ext4 block bitmap of group %v: %v", group, err)
+		}
+		markBitmapUsed(m, bitmap, start, count, blockSize)
+	}
+	return m, nil
+}
+
+// markBitmapUsed marks the blocks set in the bitmap as used, the bit i is the block start+i
+func markBitmapUsed(m *UsedMap, bitmap []byte, start, count, blockSize int64) {
+	for i := int64(0); i < count; {
+		b := bitmap[i/8]
+		if i%8 == 0 && count-i >= 8 {
+			switch b {
+			case 0:
+				i += 8
+				continue
+			case 0xff:
+				m.markUsed((start+i)*blockSize, 8*blockSize)
+				i += 8
+				continue
+			}
+		}
+		if b&(1<<uint(i%8)) != 0 {
+			m.markUsed((start+i)*blockSize, blockSize)
+		}
+		i++
+	}
+}
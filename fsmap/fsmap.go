@@ -0,0 +1,118 @@
+package fsmap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "fsmap"})
+)
+
+var (
+	// ErrUnsupportedFilesystem is returned if there is no filesystem at the start of the device, or the
+	// filesystem or its features are not supported
+	ErrUnsupportedFilesystem = errors.New("unsupported filesystem")
+
+	errNotDetected = errors.New("filesystem not detected")
+)
+
+// UsedMap is the allocation map of the filesystem on a device in units of the granularity. A unit is used if
+// any of the filesystem blocks in it is allocated, or the allocation of the unit cannot be determined.
+type UsedMap struct {
+	Filesystem  string
+	Granularity int64
+
+	size int64
+	bits []uint64
+}
+
+func newUsedMap(filesystem string, size, granularity int64) *UsedMap {
+	units := (size + granularity - 1) / granularity
+	return &UsedMap{
+		Filesystem:  filesystem,
+		Granularity: granularity,
+		size:        size,
+		bits:        make([]uint64, (units+63)/64),
+	}
+}
+
+// markUsed marks the units overlapping the byte range as used
+func (m *UsedMap) markUsed(offset, length int64) {
+	if length <= 0 || offset >= m.size {
+		return
+	}
+	if offset+length > m.size {
+		length = m.size - offset
+	}
+	for unit := offset / m.Granularity; unit <= (offset+length-1)/m.Granularity; unit++ {
+		m.bits[unit/64] |= 1 << uint(unit%64)
+	}
+}
+
+// IsUsed checks if any unit overlapping the byte range is used. The range beyond the device is never used.
+func (m *UsedMap) IsUsed(offset, length int64) bool {
+	if length <= 0 || offset >= m.size {
+		return false
+	}
+	if offset+length > m.size {
+		length = m.size - offset
+	}
+	for unit := offset / m.Granularity; unit <= (offset+length-1)/m.Granularity; unit++ {
+		if m.bits[unit/64]&(1<<uint(unit%64)) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// UsedSize returns the bytes of the used units
+func (m *UsedMap) UsedSize() int64 {
+	used := int64(0)
+	for offset := int64(0); offset < m.size; offset += m.Granularity {
+		if m.IsUsed(offset, 1) {
+			used += m.Granularity
+		}
+	}
+	if used > m.size {
+		used = m.size
+	}
+	return used
+}
+
+// Parse detects the ext4 or xfs filesystem at the start of the device of the size, and reads the used map of
+// the filesystem in units of the granularity. The journal or the log is not replayed, so the device must hold
+// a filesystem frozen or unmounted when the snapshot was taken, otherwise the recently allocated blocks may be
+// missing from the map. The ext4 filesystems needing the journal recovery are rejected.
+func Parse(r io.ReaderAt, size, granularity int64) (*UsedMap, error) {
+	if granularity <= 0 {
+		return nil, fmt.Errorf("invalid granularity %v", granularity)
+	}
+
+	for _, parse := range []func(io.ReaderAt, int64, int64) (*UsedMap, error){parseExt4, parseXFS} {
+		m, err := parse(r, size, granularity)
+		if errors.Is(err, errNotDetected) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("Parsed %v filesystem with %v of %v bytes used", m.Filesystem, m.UsedSize(), size)
+		return m, nil
+	}
+	return nil, ErrUnsupportedFilesystem
+}
+
+// readAt reads the full buffer, errNotDetected is returned if the device is too small
+func readAt(r io.ReaderAt, buf []byte, offset int64) error {
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return errNotDetected
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package fsmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExt4(t *testing.T) {
+	assert := assert.New(t)
+
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not found")
+	}
+	dir := t.TempDir()
+	image := filepath.Join(dir, "ext4.img")
+	size := int64(64 << 20)
+	assert.NoError(os.WriteFile(image, nil, 0600))
+	assert.NoError(os.Truncate(image, size))
+	out, err := exec.Command("mkfs.ext4", "-q", "-F", "-b", "4096", image).CombinedOutput()
+	assert.NoError(err, string(out))
+
+	f, err := os.OpenFile(image, os.O_RDWR, 0600)
+	assert.NoError(err)
+	defer f.Close()
+
+	granularity := int64(2 << 20)
+	m, err := Parse(f, size, granularity)
+	assert.NoError(err)
+	assert.Equal("ext4", m.Filesystem)
+	assert.True(m.IsUsed(0, granularity))
+	assert.Less(m.UsedSize(), size/2)
+	assert.False(m.IsUsed(size, granularity))
+
+	// the allocated file blocks are used
+	if _, err := exec.LookPath("debugfs"); err == nil {
+		data := filepath.Join(dir, "data")
+		assert.NoError(os.WriteFile(data, bytes.Repeat([]byte("data"), 4<<20), 0600))
+		out, err := exec.Command("debugfs", "-w", "-R", "write "+data+" data", image).CombinedOutput()
+		assert.NoError(err, string(out))
+		withData, err := Parse(f, size, granularity)
+		assert.NoError(err)
+		assert.GreaterOrEqual(withData.UsedSize()-m.UsedSize(), int64(16<<20))
+	}
+
+	// the journal must be recovered first
+	sb := make([]byte, 4)
+	_, err = f.ReadAt(sb, ext4SuperblockOffset+0x60)
+	assert.NoError(err)
+	binary.LittleEndian.PutUint32(sb, binary.LittleEndian.Uint32(sb)|ext4IncompatRecover)
+	_, err = f.WriteAt(sb, ext4SuperblockOffset+0x60)
+	assert.NoError(err)
+	_, err = Parse(f, size, granularity)
+	assert.Error(err)
+}
+
+func TestParseXFS(t *testing.T) {
+	assert := assert.New(t)
+
+	blockSize, agBlocks := int64(4096), int64(256)
+	size := 2 * agBlocks * blockSize
+	image := make([]byte, size)
+	be := binary.BigEndian
+
+	be.PutUint32(image[0:], xfsMagic)
+	be.PutUint32(image[4:], uint32(blockSize))
+	be.PutUint64(image[8:], uint64(2*agBlocks))
+	be.PutUint32(image[84:], uint32(agBlocks))
+	be.PutUint32(image[88:], 2)
+	be.PutUint16(image[100:], xfsVersion5)
+	be.PutUint16(image[102:], 512)
+
+	putAGF := func(ag, root, levels int64) {
+		agf := image[ag*agBlocks*blockSize+512:]
+		be.PutUint32(agf[0:], xfsAGFMagic)
+		be.PutUint32(agf[16:], uint32(root))
+		be.PutUint32(agf[28:], uint32(levels))
+	}
+	putBlock := func(ag, agBlock, level int64, values ...uint32) []byte {
+		block := image[(ag*agBlocks+agBlock)*blockSize:]
+		be.PutUint32(block[0:], xfsBnoBtreeCRCMagic)
+		be.PutUint16(block[4:], uint16(level))
+		be.PutUint16(block[6:], uint16(len(values)/2))
+		for i, value := range values {
+			be.PutUint32(block[xfsBtreeCRCHeaderSize+4*i:], value)
+		}
+		return block
+	}
+
+	// allocation group 0 has a single leaf, allocation group 1 has a node pointing to a leaf
+	putAGF(0, 2, 1)
+	putBlock(0, 2, 0, 10, 20, 100, 50)
+	putAGF(1, 3, 2)
+	node := putBlock(1, 3, 1, 200, 56)
+	maxRecs := (blockSize - xfsBtreeCRCHeaderSize) / (xfsAllocRecSize + xfsAllocPtrSize)
+	be.PutUint32(node[xfsBtreeCRCHeaderSize+maxRecs*xfsAllocRecSize:], 4)
+	putBlock(1, 4, 0, 200, 56)
+
+	m, err := Parse(bytes.NewReader(image), size, blockSize)
+	assert.NoError(err)
+	assert.Equal("xfs", m.Filesystem)
+	assert.True(m.IsUsed(0, 10*blockSize))
+	assert.False(m.IsUsed(10*blockSize, 20*blockSize))
+	assert.True(m.IsUsed(30*blockSize, blockSize))
+	assert.False(m.IsUsed(100*blockSize, 50*blockSize))
+	assert.True(m.IsUsed(150*blockSize, blockSize))
+	assert.True(m.IsUsed((agBlocks+199)*blockSize, blockSize))
+	assert.False(m.IsUsed((agBlocks+200)*blockSize, 56*blockSize))
+	assert.Equal(size-126*blockSize, m.UsedSize())
+
+	// the unit is used if any of its blocks is used
+	m, err = Parse(bytes.NewReader(image), size, 20*blockSize)
+	assert.NoError(err)
+	assert.False(m.IsUsed(100*blockSize, 20*blockSize))
+	assert.True(m.IsUsed(20*blockSize, 5*blockSize))
+	assert.True(m.IsUsed(0, 20*blockSize))
+
+	_, err = Parse(bytes.NewReader(make([]byte, size)), size, blockSize)
+	assert.ErrorIs(err, ErrUnsupportedFilesystem)
+}
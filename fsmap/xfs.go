@@ -0,0 +1,162 @@
+package fsmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	xfsMagic    = 0x58465342 // XFSB
+	xfsAGFMagic = 0x58414746 // XAGF
+	// the magic of the free space by block number B+tree blocks without and with the CRC
+	xfsBnoBtreeMagic    = 0x41425442 // ABTB
+	xfsBnoBtreeCRCMagic = 0x41423342 // AB3B
+
+	xfsSuperblockSize  = 512
+	xfsVersionNumMask  = 0xf
+	xfsVersion5        = 5
+	xfsBtreeHeaderSize = 16
+	// the CRC enabled blocks carry the block number, the LSN, the UUID, the owner and the CRC
+	xfsBtreeCRCHeaderSize = 56
+	xfsAllocRecSize       = 8
+	xfsAllocPtrSize       = 4
+	xfsMaxBtreeLevels     = 16
+)
+
+type xfsExtent struct {
+	start  int64
+	length int64
+}
+
+// parseXFS reads the used map from the free space B+trees indexed by the block number of the allocation groups.
+// Everything but the free extents is used, including the internal log and the metadata.
+func parseXFS(r io.ReaderAt, size, granularity int64) (*UsedMap, error) {
+	sb := make([]byte, xfsSuperblockSize)
+	if err := readAt(r, sb, 0); err != nil {
+		return nil, err
+	}
+	be := binary.BigEndian
+	if be.Uint32(sb[0:]) != xfsMagic {
+		return nil, errNotDetected
+	}
+
+	blockSize := int64(be.Uint32(sb[4:]))
+	dataBlocks := int64(be.Uint64(sb[8:]))
+	agBlocks := int64(be.Uint32(sb[84:]))
+	agCount := int64(be.Uint32(sb[88:]))
+	sectSize := int64(be.Uint16(sb[102:]))
+	crc := be.Uint16(sb[100:])&xfsVersionNumMask == xfsVersion5
+	if blockSize < 512 || blockSize > 65536 || agBlocks == 0 || agCount == 0 || sectSize < 512 || sectSize > blockSize {
+		return nil, fmt.Errorf("invalid xfs superblock with block size %v and %v blocks per allocation group", blockSize, agBlocks)
+	}
+
+	p := &xfsParser{
+		r:          r,
+		blockSize:  blockSize,
+		agBlocks:   agBlocks,
+		headerSize: xfsBtreeHeaderSize,
+		magic:      xfsBnoBtreeMagic,
+	}
+	if crc {
+		p.headerSize = xfsBtreeCRCHeaderSize
+		p.magic = xfsBnoBtreeCRCMagic
+	}
+
+	var free []xfsExtent
+	agf := make([]byte, sectSize)
+	for ag := int64(0); ag < agCount; ag++ {
+		agStart := ag * agBlocks
+		if _, err := r.ReadAt(agf, agStart*blockSize+sectSize); err != nil {
+			return nil, fmt.Errorf("failed to read xfs AGF of allocation group %v: %v", ag, err)
+		}
+		if be.Uint32(agf[0:]) != xfsAGFMagic {
+			return nil, fmt.Errorf("invalid xfs AGF magic of allocation group %v", ag)
+		}
+		root := int64(be.Uint32(agf[16:]))
+		levels := int64(be.Uint32(agf[28:]))
+		if levels == 0 || levels > xfsMaxBtreeLevels {
+			return nil, fmt.Errorf("invalid xfs free space B+tree levels %v of allocation group %v", levels, ag)
+		}
+		extents, err := p.walk(agStart, root, levels-1)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read xfs free space of allocation group %v: %v", ag, err)
+		}
+		free = append(free, extents...)
+	}
+
+	// The free extents are sorted by the block number, so the gaps between them are used
+	m := newUsedMap("xfs", size, granularity)
+	cursor := int64(0)
+	for _, extent := range free {
+		start := extent.start * blockSize
+		if start < cursor {
+			return nil, fmt.Errorf("invalid xfs free extent at block %v overlapping the previous one", extent.start)
+		}
+		m.markUsed(cursor, start-cursor)
+		cursor = start + extent.length*blockSize
+	}
+	m.markUsed(cursor, size-cursor)
+	if fsEnd := dataBlocks * blockSize; cursor > fsEnd {
+		return nil, fmt.Errorf("invalid xfs free extent beyond the end of the filesystem")
+	}
+	return m, nil
+}
+
+type xfsParser struct {
+	r          io.ReaderAt
+	blockSize  int64
+	agBlocks   int64
+	headerSize int64
+	magic      uint32
+}
+
+// walk returns the free extents in the B+tree block of the allocation group in the order of the block number
+func (p *xfsParser) walk(agStart, agBlock, level int64) ([]xfsExtent, error) {
+	if agBlock >= p.agBlocks {
+		return nil, fmt.Errorf("invalid B+tree block %v", agBlock)
+	}
+	block := make([]byte, p.blockSize)
+	if _, err := p.r.ReadAt(block, (agStart+agBlock)*p.blockSize); err != nil {
+		return nil, err
+	}
+	be := binary.BigEndian
+	if be.Uint32(block[0:]) != p.magic {
+		return nil, fmt.Errorf("invalid B+tree block %v magic", agBlock)
+	}
+	if int64(be.Uint16(block[4:])) != level {
+		return nil, fmt.Errorf("invalid B+tree block %v level", agBlock)
+	}
+	numRecs := int64(be.Uint16(block[6:]))
+
+	if level == 0 {
+		if p.headerSize+numRecs*xfsAllocRecSize > p.blockSize {
+			return nil, fmt.Errorf("invalid B+tree leaf %v with %v records", agBlock, numRecs)
+		}
+		extents := make([]xfsExtent, 0, numRecs)
+		for i := int64(0); i < numRecs; i++ {
+			rec := block[p.headerSize+i*xfsAllocRecSize:]
+			extents = append(extents, xfsExtent{
+				start:  agStart + int64(be.Uint32(rec[0:])),
+				length: int64(be.Uint32(rec[4:])),
+			})
+		}
+		return extents, nil
+	}
+
+	// The node keeps the keys of the maximum number of records, followed by the pointers
+	maxRecs := (p.blockSize - p.headerSize) / (xfsAllocRecSize + xfsAllocPtrSize)
+	if numRecs > maxRecs {
+		return nil, fmt.Errorf("invalid B+tree node %v with %v records", agBlock, numRecs)
+	}
+	var extents []xfsExtent
+	for i := int64(0); i < numRecs; i++ {
+		ptr := block[p.headerSize+maxRecs*xfsAllocRecSize+i*xfsAllocPtrSize:]
+		children, err := p.walk(agStart, int64(be.Uint32(ptr)), level-1)
+		if err != nil {
+			return nil, err
+		}
+		extents = append(extents, children...)
+	}
+	return extents, nil
+}
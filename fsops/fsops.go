@@ -6,35 +6,197 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
 	"github.com/longhorn/backupstore"
 	"github.com/longhorn/backupstore/util"
 )
 
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "fsops"})
+)
+
 const (
 	MaxCleanupLevel = 10
+
+	// MaxRemountRetries is the number of times a file operation failed by the stale share is retried after
+	// remounting the share
+	MaxRemountRetries = 3
+
+	// DefaultWriteRetryInterval is the interval before the first retry of a failed write if it's not specified
+	DefaultWriteRetryInterval = time.Second
+	// MaxWriteRetryInterval caps the interval between the retries, which doubles after each retry
+	MaxWriteRetryInterval = 30 * time.Second
 )
 
 type FileSystemOps interface {
 	LocalPath(path string) string
 }
 
+// FileSystemRemounter can be optionally implemented by the drivers mounting the share, e.g. NFS and CIFS, so the
+// file operations failed with ESTALE or EIO are retried after remounting the share
+type FileSystemRemounter interface {
+	// Remount mounts the share again if the mount point is no longer healthy
+	Remount() error
+}
+
+// WriteOptions makes the writes durable and retries the transient write failures, e.g. for the NFS servers
+// exporting the share with the async option. The zero value writes the files as before.
+type WriteOptions struct {
+	// Fsync syncs the written files and their parent directories, including the created ones, before the
+	// writes return
+	Fsync bool
+	// Retries is the number of times a write failed by a transient error is retried
+	Retries int
+	// RetryInterval is the interval before the first retry, DefaultWriteRetryInterval if 0
+	RetryInterval time.Duration
+}
+
 type FileSystemOperator struct {
 	FileSystemOps
+
+	// remountLock serializes the remounts by the concurrent operations failed by the same stale share
+	remountLock sync.Mutex
+
+	writeOptions WriteOptions
 }
 
 func NewFileSystemOperator(ops FileSystemOps) *FileSystemOperator {
-	return &FileSystemOperator{ops}
+	return &FileSystemOperator{FileSystemOps: ops}
+}
+
+// SetWriteOptions sets the options of the writes, it must be called before the operator is used
+func (f *FileSystemOperator) SetWriteOptions(opts WriteOptions) {
+	f.writeOptions = opts
+}
+
+// staleShareMessages are the messages of ESTALE and EIO printed by the executed commands
+var staleShareMessages = []string{"stale file handle", "stale nfs file handle", "input/output error"}
+
+// isStaleShareError checks if the error is caused by the share no longer accessible through the mount point,
+// the errors of the executed commands are only recognized by the messages
+func isStaleShareError(err error) bool {
+	if errors.Is(err, syscall.ESTALE) || errors.Is(err, syscall.EIO) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, staleMsg := range staleShareMessages {
+		if strings.Contains(msg, staleMsg) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRemount calls fn, and calls it again after remounting the share if it fails with ESTALE or EIO, up to
+// MaxRemountRetries times. The failure is returned right away if the driver doesn't mount the share.
+func (f *FileSystemOperator) withRemount(op, path string, fn func() error) error {
+	remounter, ok := f.FileSystemOps.(FileSystemRemounter)
+	err := fn()
+	for i := 0; ok && i < MaxRemountRetries && err != nil && isStaleShareError(err); i++ {
+		log.WithError(err).Warnf("Remounting share to retry %v of %v, attempt %v", op, path, i+1)
+		f.remountLock.Lock()
+		remountErr := remounter.Remount()
+		f.remountLock.Unlock()
+		if remountErr != nil {
+			return errors.Wrapf(err, "failed to remount share: %v", remountErr)
+		}
+		err = fn()
+	}
+	return err
+}
+
+// transientWriteErrors are the errors of the writes which may succeed if retried
+var transientWriteErrors = []error{syscall.EIO, syscall.EAGAIN, syscall.EINTR, syscall.ETIMEDOUT, syscall.EBUSY,
+	syscall.ESTALE}
+
+func isTransientWriteError(err error) bool {
+	for _, transientErr := range transientWriteErrors {
+		if errors.Is(err, transientErr) {
+			return true
+		}
+	}
+	return false
+}
+
+// withWriteRetry calls fn, and calls it again with backoff if it fails with a transient error, up to the retries
+// of the write options
+func (f *FileSystemOperator) withWriteRetry(op, path string, fn func() error) error {
+	interval := f.writeOptions.RetryInterval
+	if interval <= 0 {
+		interval = DefaultWriteRetryInterval
+	}
+	err := fn()
+	for i := 0; i < f.writeOptions.Retries && err != nil && isTransientWriteError(err); i++ {
+		log.WithError(err).Warnf("Retrying %v of %v in %v, attempt %v", op, path, interval, i+1)
+		time.Sleep(interval)
+		if interval *= 2; interval > MaxWriteRetryInterval {
+			interval = MaxWriteRetryInterval
+		}
+		err = fn()
+	}
+	return err
 }
 
 func (f *FileSystemOperator) preparePath(file string) error {
-	return os.MkdirAll(filepath.Dir(f.LocalPath(file)), os.ModeDir|0700)
+	dir := filepath.Dir(f.LocalPath(file))
+	if f.writeOptions.Fsync {
+		return mkdirAllSync(dir)
+	}
+	return os.MkdirAll(dir, os.ModeDir|0700)
+}
+
+// mkdirAllSync creates the directory and the missing parents, the parent of each created directory is
+// fsynced so the new directory entries are persisted
+func mkdirAllSync(dir string) error {
+	if st, err := os.Stat(dir); err == nil {
+		if !st.IsDir() {
+			return errors.Errorf("%v is not a directory", dir)
+		}
+		return nil
+	}
+
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		if err := mkdirAllSync(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, os.ModeDir|0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return syncPath(parent)
+}
+
+// syncPath fsyncs the file or the directory
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := file.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to sync %v", path)
+	}
+	return nil
+}
+
+func (f *FileSystemOperator) stat(filePath string) (os.FileInfo, error) {
+	var st os.FileInfo
+	err := f.withRemount("stat", filePath, func() (err error) {
+		st, err = os.Stat(f.LocalPath(filePath))
+		return err
+	})
+	return st, err
 }
 
 func (f *FileSystemOperator) FileSize(filePath string) int64 {
-	file := f.LocalPath(filePath)
-	st, err := os.Stat(file)
+	st, err := f.stat(filePath)
 	if err != nil || st.IsDir() {
 		return -1
 	}
@@ -42,8 +204,7 @@ func (f *FileSystemOperator) FileSize(filePath string) int64 {
 }
 
 func (f *FileSystemOperator) FileTime(filePath string) time.Time {
-	file := f.LocalPath(filePath)
-	st, err := os.Stat(file)
+	st, err := f.stat(filePath)
 	if err != nil || st.IsDir() {
 		return time.Time{}
 	}
@@ -56,7 +217,9 @@ func (f *FileSystemOperator) FileExists(filePath string) bool {
 }
 
 func (f *FileSystemOperator) Remove(path string) error {
-	if err := os.RemoveAll(f.LocalPath(path)); err != nil {
+	if err := f.withRemount("remove", path, func() error {
+		return os.RemoveAll(f.LocalPath(path))
+	}); err != nil {
 		return err
 	}
 	//Also automatically cleanup upper level directories
@@ -76,14 +239,49 @@ func (f *FileSystemOperator) Remove(path string) error {
 }
 
 func (f *FileSystemOperator) Read(src string) (io.ReadCloser, error) {
-	file, err := os.Open(f.LocalPath(src))
-	if err != nil {
+	var file *os.File
+	if err := f.withRemount("read", src, func() (err error) {
+		file, err = os.Open(f.LocalPath(src))
+		return err
+	}); err != nil {
 		return nil, err
 	}
 	return file, nil
 }
 
+func (f *FileSystemOperator) ReadRange(src string, offset, length int64) (io.ReadCloser, error) {
+	rc, err := f.Read(src)
+	if err != nil {
+		return nil, err
+	}
+	file := rc.(*os.File)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
 func (f *FileSystemOperator) Write(dst string, rs io.ReadSeeker) error {
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	return f.withWriteRetry("write", dst, func() error {
+		return f.withRemount("write", dst, func() error {
+			// rewind the data in case the write is retried
+			if _, err := rs.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+			return f.write(dst, rs)
+		})
+	})
+}
+
+func (f *FileSystemOperator) write(dst string, rs io.ReadSeeker) error {
 	// we append the timestamp to the tmp files so that we should never have 2 backups using the same tmp file
 	tmpFile := dst + ".tmp" + "." + strconv.FormatInt(time.Now().UTC().UnixNano(), 10)
 	if err := f.preparePath(dst); err != nil {
@@ -95,22 +293,38 @@ func (f *FileSystemOperator) Write(dst string, rs io.ReadSeeker) error {
 	}
 
 	_, err = io.Copy(file, rs)
+	if err == nil && f.writeOptions.Fsync {
+		err = file.Sync()
+	}
 	if err != nil {
 		_ = file.Close()
+		// the partial tmp file is never renamed, e.g. the aborted backup stopped reading the data
+		_ = os.Remove(f.LocalPath(tmpFile))
 		return err
 	}
 
 	// we close the file here to force nfs to sync the data to stable storage
 	err = file.Close()
 	if err != nil {
+		_ = os.Remove(f.LocalPath(tmpFile))
 		return err
 	}
 
-	return os.Rename(f.LocalPath(tmpFile), f.LocalPath(dst))
+	if err := os.Rename(f.LocalPath(tmpFile), f.LocalPath(dst)); err != nil {
+		return err
+	}
+	if f.writeOptions.Fsync {
+		return syncPath(filepath.Dir(f.LocalPath(dst)))
+	}
+	return nil
 }
 
 func (f *FileSystemOperator) List(path string) ([]string, error) {
-	out, err := util.Execute("ls", []string{"-1", f.LocalPath(path)})
+	var out string
+	err := f.withRemount("list", path, func() (err error) {
+		out, err = util.Execute("ls", []string{"-1", f.LocalPath(path)})
+		return err
+	})
 	if err != nil &&
 		!strings.Contains(err.Error(), "No such file or directory") &&
 		!strings.Contains(err.Error(), "cannot open directory") {
@@ -125,6 +339,14 @@ func (f *FileSystemOperator) List(path string) ([]string, error) {
 }
 
 func (f *FileSystemOperator) Upload(src, dst string) error {
+	return f.withWriteRetry("upload", dst, func() error {
+		return f.withRemount("upload", dst, func() error {
+			return f.upload(src, dst)
+		})
+	})
+}
+
+func (f *FileSystemOperator) upload(src, dst string) error {
 	tmpDst := dst + ".tmp" + "." + strconv.FormatInt(time.Now().UTC().UnixNano(), 10)
 	if f.FileExists(tmpDst) {
 		f.Remove(tmpDst)
@@ -136,11 +358,21 @@ func (f *FileSystemOperator) Upload(src, dst string) error {
 	if err != nil {
 		return err
 	}
+	if f.writeOptions.Fsync {
+		if err := syncPath(f.LocalPath(tmpDst)); err != nil {
+			return err
+		}
+	}
 	_, err = util.Execute("mv", []string{f.LocalPath(tmpDst), f.LocalPath(dst)})
+	if err == nil && f.writeOptions.Fsync {
+		err = syncPath(filepath.Dir(f.LocalPath(dst)))
+	}
 	return err
 }
 
 func (f *FileSystemOperator) Download(src, dst string) error {
-	_, err := util.Execute("cp", []string{f.LocalPath(src), dst})
-	return err
+	return f.withRemount("download", src, func() error {
+		_, err := util.Execute("cp", []string{f.LocalPath(src), dst})
+		return err
+	})
 }
@@ -0,0 +1,118 @@
+package fsops
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// staleOps fails the file operations with ESTALE until the share is remounted
+type staleOps struct {
+	dir      string
+	stale    bool
+	remounts int
+}
+
+func (s *staleOps) LocalPath(path string) string {
+	if s.stale {
+		return filepath.Join(s.dir, "stale", path)
+	}
+	return filepath.Join(s.dir, path)
+}
+
+func (s *staleOps) Remount() error {
+	s.remounts++
+	s.stale = false
+	return nil
+}
+
+func TestWithRemount(t *testing.T) {
+	assert := assert.New(t)
+
+	ops := &staleOps{dir: t.TempDir(), stale: true}
+	f := NewFileSystemOperator(ops)
+	staleErr := &os.PathError{Op: "open", Path: "file", Err: syscall.ESTALE}
+
+	calls := 0
+	assert.NoError(f.withRemount("read", "file", func() error {
+		calls++
+		if ops.stale {
+			return staleErr
+		}
+		return nil
+	}))
+	assert.Equal(2, calls)
+	assert.Equal(1, ops.remounts)
+
+	// the retries are bounded
+	calls = 0
+	err := f.withRemount("read", "file", func() error {
+		calls++
+		return staleErr
+	})
+	assert.ErrorIs(err, syscall.ESTALE)
+	assert.Equal(MaxRemountRetries+1, calls)
+
+	// the other errors are not retried
+	calls = 0
+	err = f.withRemount("read", "file", func() error {
+		calls++
+		return os.ErrNotExist
+	})
+	assert.ErrorIs(err, os.ErrNotExist)
+	assert.Equal(1, calls)
+
+	assert.True(isStaleShareError(&os.PathError{Op: "read", Path: "file", Err: syscall.EIO}))
+	assert.True(isStaleShareError(fmt.Errorf("ls: cannot access 'dir': Stale file handle")))
+	assert.False(isStaleShareError(io.ErrUnexpectedEOF))
+}
+
+func TestWithWriteRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	f := NewFileSystemOperator(&staleOps{dir: dir})
+	ioErr := &os.PathError{Op: "write", Path: "file", Err: syscall.EIO}
+
+	// the writes are not retried by default
+	calls := 0
+	err := f.withWriteRetry("write", "file", func() error {
+		calls++
+		return ioErr
+	})
+	assert.ErrorIs(err, syscall.EIO)
+	assert.Equal(1, calls)
+
+	f.SetWriteOptions(WriteOptions{Fsync: true, Retries: 2, RetryInterval: time.Millisecond})
+	calls = 0
+	assert.NoError(f.withWriteRetry("write", "file", func() error {
+		calls++
+		if calls < 3 {
+			return ioErr
+		}
+		return nil
+	}))
+	assert.Equal(3, calls)
+
+	// the permanent errors are not retried
+	calls = 0
+	err = f.withWriteRetry("write", "file", func() error {
+		calls++
+		return &os.PathError{Op: "write", Path: "file", Err: syscall.ENOSPC}
+	})
+	assert.ErrorIs(err, syscall.ENOSPC)
+	assert.Equal(1, calls)
+
+	// the durable writes create the missing directories
+	assert.NoError(f.Write("volumes/pvc-1/volume.cfg", strings.NewReader("config")))
+	data, err := os.ReadFile(filepath.Join(dir, "volumes/pvc-1/volume.cfg"))
+	assert.NoError(err)
+	assert.Equal("config", string(data))
+}
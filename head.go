@@ -1,12 +1,43 @@
 package backupstore
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+	"github.com/longhorn/backupstore/util"
 )
 
 type ConfigMetadata struct {
 	ModificationTime time.Time
+	// ETag changes whenever the config is written, it can be passed to SaveConfigInBackupStoreIfMatch
+	// to detect the concurrent updates
+	ETag string
+}
+
+// ConflictError is returned by the conditional writes when the file has been changed since the ETag was read
+type ConflictError struct {
+	Path string
+	ETag string
+}
+
+func (e *ConflictError) Error() string {
+	if e.ETag == "" {
+		return fmt.Sprintf("%v was created concurrently", e.Path)
+	}
+	return fmt.Sprintf("%v was changed concurrently, ETag %v does not match", e.Path, e.ETag)
+}
+
+// IsConflictError checks if the conditional write failed due to the concurrent update of the file
+func IsConflictError(err error) bool {
+	var conflictErr *ConflictError
+	return errors.As(err, &conflictErr)
 }
 
 func GetConfigMetadata(url string) (*ConfigMetadata, error) {
@@ -22,9 +53,9 @@ func GetConfigMetadata(url string) (*ConfigMetadata, error) {
 
 	var filePath string
 	if backupName != "" {
-		filePath = getBackupConfigPath(backupName, volumeName)
+		filePath = getBackupConfigPath(driver, backupName, volumeName)
 	} else {
-		filePath = getVolumeFilePath(volumeName)
+		filePath = getVolumeFilePath(driver, volumeName)
 	}
 
 	if !driver.FileExists(filePath) {
@@ -32,5 +63,91 @@ func GetConfigMetadata(url string) (*ConfigMetadata, error) {
 	}
 
 	modificationTime := driver.FileTime(filePath)
-	return &ConfigMetadata{ModificationTime: modificationTime}, nil
+	if backupName == "" {
+		if t := getVolumeRecordsModificationTime(driver, volumeName); t.After(modificationTime) {
+			modificationTime = t
+		}
+	}
+	etag, err := getFileETag(driver, filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &ConfigMetadata{ModificationTime: modificationTime, ETag: etag}, nil
+}
+
+// getFileETag returns the ETag of the file, or an empty string if the file doesn't exist. The checksum of
+// the content is used if the driver doesn't support the conditional writes.
+func getFileETag(driver BackupStoreDriver, filePath string) (string, error) {
+	if writer, ok := driver.(BackupStoreConditionalWriter); ok {
+		return writer.FileETag(filePath)
+	}
+
+	if !driver.FileExists(filePath) {
+		return "", nil
+	}
+	rc, err := driver.Read(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return "", err
+	}
+	return util.GetChecksum(data), nil
+}
+
+// writeIfMatch writes the file only if its ETag is still etag, an empty etag requires the file not to exist.
+// The check and the write are not atomic if the driver doesn't support the conditional writes, so only the
+// updates racing within the window are missed then.
+func writeIfMatch(driver BackupStoreDriver, filePath string, rs io.ReadSeeker, etag string) error {
+	if writer, ok := driver.(BackupStoreConditionalWriter); ok {
+		return writer.WriteIfMatch(filePath, rs, etag)
+	}
+
+	currentETag, err := getFileETag(driver, filePath)
+	if err != nil {
+		return err
+	}
+	if currentETag != etag {
+		return &ConflictError{Path: filePath, ETag: etag}
+	}
+	return driver.Write(filePath, rs)
+}
+
+// SaveConfigInBackupStoreIfMatch saves the config only if it hasn't been changed since the ETag was read by
+// GetConfigMetadata. ConflictError is returned otherwise, so the caller can reload the config and retry.
+func SaveConfigInBackupStoreIfMatch(driver BackupStoreDriver, filePath string, v interface{}, etag string) error {
+	return saveConfigInBackupStoreIfMatch(driver, filePath, v, "none", etag)
+}
+
+func saveConfigInBackupStoreIfMatch(driver BackupStoreDriver, filePath string, v interface{}, compressionMethod, etag string) error {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if j, err = compressMetadata(compressionMethod, j); err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LogFieldReason:   LogReasonStart,
+		LogFieldObject:   LogObjectConfig,
+		LogFieldKind:     driver.Kind(),
+		LogFieldFilepath: filePath,
+	}).Infof("Saving config in backupstore if ETag matches %v", etag)
+
+	if err := writeIfMatch(driver, filePath, bytes.NewReader(j), etag); err != nil {
+		return err
+	}
+	if err := waitConfigVisible(driver, filePath, j); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		LogFieldReason:   LogReasonComplete,
+		LogFieldObject:   LogObjectConfig,
+		LogFieldKind:     driver.Kind(),
+		LogFieldFilepath: filePath,
+	}).Info("Saved config in backupstore")
+	return nil
 }
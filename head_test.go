@@ -0,0 +1,38 @@
+package backupstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateVolumeIfMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	assert.NoError(saveVolume(m, &Volume{Name: "pvc-1", BlockCount: 1}))
+	filePath := getVolumeFilePath(m, "pvc-1")
+	etag, err := getFileETag(m, filePath)
+	assert.NoError(err)
+	assert.NotEmpty(etag)
+
+	// the update of the other manager makes the ETag stale
+	assert.NoError(saveVolume(m, &Volume{Name: "pvc-1", BlockCount: 2}))
+	err = saveConfigInBackupStoreIfMatch(m, filePath, &Volume{Name: "pvc-1", BlockCount: 3}, "none", etag)
+	assert.True(IsConflictError(err))
+	err = saveConfigInBackupStoreIfMatch(m, filePath, &Volume{Name: "pvc-1"}, "none", "")
+	assert.True(IsConflictError(err))
+
+	volume, err := updateVolume(m, "pvc-1", func(v *Volume) error {
+		v.BlockCount++
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal(int64(3), volume.BlockCount)
+	volume, err = loadVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal(int64(3), volume.BlockCount)
+}
@@ -6,10 +6,39 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"sync"
 
 	"golang.org/x/net/http/httpproxy"
 )
 
+var (
+	fipsModeLock sync.RWMutex
+	fipsMode     bool
+)
+
+// fipsCipherSuites are the TLS 1.2 cipher suites allowed in FIPS mode, which are all AES-GCM. The TLS 1.3 cipher
+// suites aren't configurable, so TLS 1.3 is negotiated as usual.
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// SetFIPSModeEnabled restricts the TLS connections of the clients created afterwards to the FIPS-approved
+// cipher suites and curves, and disallows the clients skipping the certificate verification
+func SetFIPSModeEnabled(enabled bool) {
+	fipsModeLock.Lock()
+	defer fipsModeLock.Unlock()
+	fipsMode = enabled
+}
+
+func isFIPSModeEnabled() bool {
+	fipsModeLock.RLock()
+	defer fipsModeLock.RUnlock()
+	return fipsMode
+}
+
 func getSystemCerts() *x509.CertPool {
 	certs, _ := x509.SystemCertPool()
 	if certs == nil {
@@ -46,6 +75,14 @@ func GetClient(insecure bool, customCerts []byte) (*http.Client, error) {
 		InsecureSkipVerify: insecure,
 		RootCAs:            certs,
 	}
+	if isFIPSModeEnabled() {
+		if insecure {
+			return nil, fmt.Errorf("cannot skip TLS certificate verification in FIPS mode")
+		}
+		customTransport.TLSClientConfig.MinVersion = tls.VersionTLS12
+		customTransport.TLSClientConfig.CipherSuites = fipsCipherSuites
+		customTransport.TLSClientConfig.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+	}
 	customTransport.Proxy = func(request *http.Request) (*url.URL, error) {
 		return httpproxy.FromEnvironment().ProxyFunc()(request.URL)
 	}
@@ -0,0 +1,301 @@
+package httpfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/backupstore"
+	bshttp "github.com/longhorn/backupstore/http"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "httpfile"})
+)
+
+// BackupStoreDriver stores the backups in a plain HTTP file server by GET, HEAD, PUT and DELETE, e.g. the Server
+// of this package. It needs no external dependency, so the CI and the lab clusters can exercise the remote
+// driver code path against it.
+type BackupStoreDriver struct {
+	destURL string
+	kind    string
+	baseURL *url.URL
+	client  *http.Client
+}
+
+const (
+	KIND     = "http"
+	TLS_KIND = "https"
+
+	// CertEnv is the custom CA certificates in PEM format trusted by the driver for the https backup targets
+	CertEnv = "HTTP_FILE_CERT"
+)
+
+func init() {
+	for _, kind := range []string{KIND, TLS_KIND} {
+		if err := backupstore.RegisterDriver(kind, initFunc); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
+	b := &BackupStoreDriver{}
+
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != KIND && u.Scheme != TLS_KIND {
+		return nil, fmt.Errorf("BUG: Why dispatch %v to %v?", u.Scheme, KIND)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid URL. Must be http://host[:port]/path, or https://host[:port]/path")
+	}
+
+	b.kind = u.Scheme
+	b.baseURL = &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/" + strings.Trim(u.Path, "/")}
+	if b.client, err = bshttp.GetClientWithCustomCerts(getCustomCerts()); err != nil {
+		return nil, err
+	}
+
+	//Test connection
+	if _, err := b.List(""); err != nil {
+		return nil, err
+	}
+
+	b.destURL = strings.TrimRight(b.baseURL.String(), "/")
+	log.Infof("Loaded driver for %v", b.destURL)
+	return b, nil
+}
+
+func getCustomCerts() []byte {
+	certs := os.Getenv(CertEnv)
+	if certs == "" {
+		return nil
+	}
+	return []byte(certs)
+}
+
+func (h *BackupStoreDriver) Kind() string {
+	return h.kind
+}
+
+func (h *BackupStoreDriver) GetURL() string {
+	return h.destURL
+}
+
+// fileURL returns the URL of the file in the backupstore
+func (h *BackupStoreDriver) fileURL(filePath string) string {
+	u := *h.baseURL
+	u.Path = path.Join(u.Path, filePath)
+	return u.String()
+}
+
+// do sends the request of the file, and converts the failed response into the error classified by the HTTP
+// status. The body of the successful response must be closed by the caller.
+func (h *BackupStoreDriver) do(method, filePath string, body io.Reader, header http.Header) (*http.Response, error) {
+	fileURL := h.fileURL(filePath)
+	// the directories are listed by the URLs ending with "/"
+	if filePath == "" || strings.HasSuffix(filePath, "/") {
+		fileURL = strings.TrimRight(fileURL, "/") + "/"
+	}
+	req, err := http.NewRequest(method, fileURL, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	// the body is sent by its size instead of chunked
+	if seeker, ok := body.(io.Seeker); ok {
+		if req.ContentLength, err = seeker.Seek(0, io.SeekEnd); err != nil {
+			return nil, err
+		}
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(body)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, backupstore.NewDriverError(backupstore.ClassifyHTTPStatus(resp.StatusCode),
+			strconv.Itoa(resp.StatusCode), fmt.Errorf("failed to %v %v: %v %v", method, fileURL, resp.Status,
+				strings.TrimSpace(string(message))))
+	}
+	return resp, nil
+}
+
+// getStatusCode returns the HTTP status of the request rejected by the server, 0 for the other errors
+func getStatusCode(err error) int {
+	var driverErr *backupstore.DriverError
+	if !errors.As(err, &driverErr) {
+		return 0
+	}
+	statusCode, _ := strconv.Atoi(driverErr.Code)
+	return statusCode
+}
+
+func isNotFound(err error) bool {
+	return getStatusCode(err) == http.StatusNotFound
+}
+
+func (h *BackupStoreDriver) head(filePath string) (*http.Response, error) {
+	resp, err := h.do(http.MethodHead, filePath, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func (h *BackupStoreDriver) FileExists(filePath string) bool {
+	return h.FileSize(filePath) >= 0
+}
+
+func (h *BackupStoreDriver) FileSize(filePath string) int64 {
+	resp, err := h.head(filePath)
+	if err != nil {
+		return -1
+	}
+	return resp.ContentLength
+}
+
+func (h *BackupStoreDriver) FileTime(filePath string) time.Time {
+	resp, err := h.head(filePath)
+	if err != nil {
+		return time.Time{}
+	}
+	t, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return time.Time{}
+	}
+	return t.UTC()
+}
+
+func (h *BackupStoreDriver) Remove(path string) error {
+	resp, err := h.do(http.MethodDelete, path, nil, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (h *BackupStoreDriver) Read(src string) (io.ReadCloser, error) {
+	resp, err := h.do(http.MethodGet, src, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// ReadRange reads up to length bytes of the file from offset by a ranged GET
+func (h *BackupStoreDriver) ReadRange(src string, offset, length int64) (io.ReadCloser, error) {
+	if length <= 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := h.do(http.MethodGet, src, nil, header)
+	// the range starts after the end of the file
+	if getStatusCode(err) == http.StatusRequestedRangeNotSatisfiable {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		return resp.Body, nil
+	}
+
+	// the server ignoring the range returns the whole file
+	defer resp.Body.Close()
+	if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, length))
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (h *BackupStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	resp, err := h.do(http.MethodPut, dst, rs, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (h *BackupStoreDriver) List(listPath string) ([]string, error) {
+	resp, err := h.do(http.MethodGet, strings.TrimRight(listPath, "/")+"/", nil, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		log.WithError(err).Error("Failed to list http file server")
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result []string
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse listing of %v: %v", listPath, err)
+	}
+	return result, nil
+}
+
+func (h *BackupStoreDriver) Upload(src, dst string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return h.Write(dst, file)
+}
+
+func (h *BackupStoreDriver) Download(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModeDir|0700); err != nil {
+		return err
+	}
+	rc, err := h.Read(src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	file, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, rc); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,127 @@
+package httpfile
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore"
+)
+
+func TestDriver(t *testing.T) {
+	assert := assert.New(t)
+
+	root := t.TempDir()
+	ts := httptest.NewServer(NewServer(root))
+	defer ts.Close()
+
+	_, err := initFunc("http:///path")
+	assert.Error(err)
+
+	driver, err := initFunc(ts.URL + "/backups/")
+	assert.NoError(err)
+	assert.Equal(ts.URL+"/backups", driver.GetURL())
+	assert.Equal(KIND, driver.Kind())
+
+	entries, err := driver.List("")
+	assert.NoError(err)
+	assert.Empty(entries)
+
+	dst := "backupstore/volumes/vol/volume.cfg"
+	assert.NoError(driver.Write(dst, bytes.NewReader([]byte("config"))))
+	assert.FileExists(filepath.Join(root, "backups", dst))
+	assert.True(driver.FileExists(dst))
+	assert.Equal(int64(len("config")), driver.FileSize(dst))
+	assert.False(driver.FileTime(dst).IsZero())
+	// the directories are not files
+	assert.False(driver.FileExists("backupstore/volumes/vol"))
+	assert.Equal(int64(-1), driver.FileSize("backupstore/volumes/vol/missing.cfg"))
+
+	rc, err := driver.Read(dst)
+	assert.NoError(err)
+	data, err := io.ReadAll(rc)
+	assert.NoError(err)
+	assert.NoError(rc.Close())
+	assert.Equal("config", string(data))
+	_, err = driver.Read("backupstore/volumes/vol/missing.cfg")
+	assert.Equal(backupstore.ErrorClassNotFound, backupstore.GetErrorClass(err))
+
+	rangeReader := driver.(backupstore.BackupStoreRangeReader)
+	for _, c := range []struct {
+		offset, length int64
+		expected       string
+	}{
+		{1, 3, "onf"},
+		{4, 10, "ig"},
+		{10, 2, ""},
+	} {
+		rc, err := rangeReader.ReadRange(dst, c.offset, c.length)
+		assert.NoError(err)
+		data, err := io.ReadAll(rc)
+		assert.NoError(err)
+		assert.NoError(rc.Close())
+		assert.Equal(c.expected, string(data))
+	}
+
+	entries, err = driver.List("backupstore/volumes/vol")
+	assert.NoError(err)
+	assert.Equal([]string{"volume.cfg"}, entries)
+	entries, err = driver.List("backupstore/missing")
+	assert.NoError(err)
+	assert.Empty(entries)
+
+	src := filepath.Join(t.TempDir(), "upload")
+	assert.NoError(os.WriteFile(src, []byte("uploaded"), 0644))
+	assert.NoError(driver.Upload(src, "backupstore/volumes/vol/backups/backup.cfg"))
+	downloaded := filepath.Join(t.TempDir(), "dir", "download")
+	assert.NoError(driver.Download("backupstore/volumes/vol/backups/backup.cfg", downloaded))
+	data, err = os.ReadFile(downloaded)
+	assert.NoError(err)
+	assert.Equal("uploaded", string(data))
+
+	// the directories are removed recursively, removing the missing files is not an error
+	assert.NoError(driver.Remove("backupstore/volumes/vol"))
+	assert.False(driver.FileExists(dst))
+	assert.NoError(driver.Remove("backupstore/volumes/vol"))
+	entries, err = driver.List("backupstore/volumes")
+	assert.NoError(err)
+	assert.Empty(entries)
+}
+
+func TestServer(t *testing.T) {
+	assert := assert.New(t)
+
+	root := t.TempDir()
+	ts := httptest.NewServer(NewServer(filepath.Join(root, "served")))
+	defer ts.Close()
+	assert.NoError(os.WriteFile(filepath.Join(root, "secret"), []byte("secret"), 0644))
+
+	request := func(method, path, body string) int {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		assert.NoError(err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// the requests cannot escape the root
+	assert.Equal(http.StatusNotFound, request(http.MethodGet, "/%2e%2e/secret", ""))
+	assert.Equal(http.StatusCreated, request(http.MethodPut, "/%2e%2e/secret", "overwritten"))
+	data, err := os.ReadFile(filepath.Join(root, "secret"))
+	assert.NoError(err)
+	assert.Equal("secret", string(data))
+	assert.FileExists(filepath.Join(root, "served", "secret"))
+
+	assert.Equal(http.StatusForbidden, request(http.MethodDelete, "/", ""))
+	assert.Equal(http.StatusBadRequest, request(http.MethodPut, "/dir/", "data"))
+	assert.Equal(http.StatusNotFound, request(http.MethodGet, "/secret/", ""))
+	assert.Equal(http.StatusMethodNotAllowed, request(http.MethodPost, "/secret", "data"))
+}
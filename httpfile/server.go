@@ -0,0 +1,163 @@
+package httpfile
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Server serves the files under the root directory by the plain HTTP requests understood by the driver:
+//   - GET and HEAD of a file return the file, the ranged GETs are supported
+//   - GET of a directory, whose path ends with "/", returns the JSON array of the names of the entries
+//   - PUT stores the body in the file atomically, the parent directories are created as needed
+//   - DELETE removes the file or the directory recursively, it's not an error if nothing exists
+//
+// It has no authentication and is meant for the CI and the lab backup targets only.
+type Server struct {
+	root string
+}
+
+// NewServer returns the server of the files under the root directory
+func NewServer(root string) *Server {
+	return &Server{root: root}
+}
+
+// localPath returns the path of the requested file under the root, the request cannot escape the root since
+// the path is cleaned as an absolute path first
+func (s *Server) localPath(urlPath string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+urlPath)))
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if strings.HasSuffix(r.URL.Path, "/") {
+			s.serveList(w, r)
+			return
+		}
+		s.serveFile(w, r)
+	case http.MethodPut:
+		s.serveWrite(w, r)
+	case http.MethodDelete:
+		s.serveRemove(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
+	file, err := os.Open(s.localPath(r.URL.Path))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// the directories are only listed by the paths ending with "/"
+	if info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+func (s *Server) serveList(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(s.localPath(r.URL.Path))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	names := []string{}
+	for _, entry := range entries {
+		// skip the files being written
+		if strings.HasPrefix(entry.Name(), tmpFilePrefix) {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	_ = json.NewEncoder(w).Encode(names)
+}
+
+const tmpFilePrefix = ".tmp-"
+
+func (s *Server) serveWrite(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/") {
+		http.Error(w, "cannot write a directory", http.StatusBadRequest)
+		return
+	}
+
+	dst := s.localPath(r.URL.Path)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		writeError(w, err)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), tmpFilePrefix)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r.Body); err != nil {
+		tmp.Close()
+		writeError(w, err)
+		return
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		writeError(w, err)
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) serveRemove(w http.ResponseWriter, r *http.Request) {
+	dst := s.localPath(r.URL.Path)
+	if dst == filepath.Clean(s.root) {
+		http.Error(w, "cannot remove the root", http.StatusForbidden)
+		return
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err), errors.Is(err, syscall.ENOTDIR):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case os.IsPermission(err):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
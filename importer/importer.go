@@ -0,0 +1,185 @@
+package importer
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/types"
+)
+
+var (
+	log = backupstore.GetLog()
+)
+
+const (
+	// LabelImportedFrom is set on the imported backups with the source snapshot, e.g. restic:4bba301e
+	LabelImportedFrom = "backupstore.longhorn.io/imported-from"
+)
+
+// Source is a volume image in a snapshot of a backup repository created by another tool
+type Source interface {
+	// Name identifies the source snapshot, e.g. restic:<snapshot ID>
+	Name() string
+	// Open returns the volume image of the snapshot as a stream and its size in bytes
+	Open() (io.ReadCloser, int64, error)
+}
+
+// Config is the config of importing a snapshot into a volume backup
+type Config struct {
+	BackupName      string
+	Volume          *backupstore.Volume
+	Snapshot        *backupstore.Snapshot
+	DestURL         string
+	Labels          map[string]string
+	ConcurrentLimit int32
+	Source          Source
+}
+
+// ImportBackup imports the volume image of the source snapshot as a backup of the volume, and returns the backup URL.
+// The volume image is read as a stream, the blocks which already exist in the backupstore are deduplicated as usual,
+// so importing the snapshots of the history from the oldest to the newest only uploads the changed blocks.
+func ImportBackup(config *Config) (string, error) {
+	if config == nil || config.Source == nil || config.Volume == nil || config.Snapshot == nil {
+		return "", fmt.Errorf("BUG: invalid empty config for import")
+	}
+
+	rc, size, err := config.Source.Open()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to open import source %v", config.Source.Name())
+	}
+	defer rc.Close()
+
+	// the backup volume size is aligned to the block size, the last block is padded with zeros
+	alignedSize := (size + backupstore.DEFAULT_BLOCK_SIZE - 1) / backupstore.DEFAULT_BLOCK_SIZE * backupstore.DEFAULT_BLOCK_SIZE
+	if config.Volume.Size == 0 {
+		config.Volume.Size = alignedSize
+	}
+	if alignedSize > config.Volume.Size {
+		return "", fmt.Errorf("import source %v size %v exceeds the volume size %v", config.Source.Name(), size, config.Volume.Size)
+	}
+
+	labels := map[string]string{}
+	for k, v := range config.Labels {
+		labels[k] = v
+	}
+	labels[LabelImportedFrom] = config.Source.Name()
+
+	ops := newImportOperations()
+	if _, err := backupstore.CreateDeltaBlockBackup(config.BackupName, &backupstore.DeltaBackupConfig{
+		BackupName:      config.BackupName,
+		Volume:          config.Volume,
+		Snapshot:        config.Snapshot,
+		DestURL:         config.DestURL,
+		DeltaOps:        ops,
+		Labels:          labels,
+		ConcurrentLimit: config.ConcurrentLimit,
+		Source:          newStreamSource(rc, alignedSize),
+	}); err != nil {
+		return "", err
+	}
+
+	backupURL, err := ops.wait()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to import %v", config.Source.Name())
+	}
+	log.Infof("Imported %v as backup %v", config.Source.Name(), backupURL)
+	return backupURL, nil
+}
+
+// streamSource is a BlockSource reading the volume image sequentially. The whole image is backed up as a single
+// extent, which the backup reads block by block in order.
+type streamSource struct {
+	lock   sync.Mutex
+	r      io.Reader
+	size   int64
+	offset int64
+}
+
+func newStreamSource(r io.Reader, size int64) *streamSource {
+	return &streamSource{r: r, size: size}
+}
+
+func (s *streamSource) Size() int64 {
+	return s.size
+}
+
+func (s *streamSource) ChangedExtents(lastSnapshotName string) (*types.Mappings, error) {
+	mappings := &types.Mappings{BlockSize: backupstore.DEFAULT_BLOCK_SIZE}
+	if s.size > 0 {
+		mappings.Mappings = []types.Mapping{{Offset: 0, Size: s.size}}
+	}
+	return mappings, nil
+}
+
+func (s *streamSource) ReadBlockAt(data []byte, offset int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if offset != s.offset {
+		return fmt.Errorf("BUG: non-sequential read at offset %v, expecting offset %v", offset, s.offset)
+	}
+	n, err := io.ReadFull(s.r, data)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	for i := n; i < len(data); i++ {
+		data[i] = 0
+	}
+	s.offset += int64(len(data))
+	return nil
+}
+
+// importOperations receives the status of the backup created by the import
+type importOperations struct {
+	once      sync.Once
+	done      chan struct{}
+	backupURL string
+	err       error
+}
+
+func newImportOperations() *importOperations {
+	return &importOperations{done: make(chan struct{})}
+}
+
+func (o *importOperations) wait() (string, error) {
+	<-o.done
+	return o.backupURL, o.err
+}
+
+// HasSnapshot returns false since the imported snapshots cannot be compared, so the backup is always a full one
+func (o *importOperations) HasSnapshot(id, volumeID string) bool {
+	return false
+}
+
+func (o *importOperations) CompareSnapshot(id, compareID, volumeID string) (*types.Mappings, error) {
+	return nil, fmt.Errorf("BUG: comparing imported snapshot %v", id)
+}
+
+func (o *importOperations) OpenSnapshot(id, volumeID string) error {
+	return nil
+}
+
+func (o *importOperations) ReadSnapshot(id, volumeID string, start int64, data []byte) error {
+	return fmt.Errorf("BUG: reading imported snapshot %v", id)
+}
+
+func (o *importOperations) CloseSnapshot(id, volumeID string) error {
+	return nil
+}
+
+func (o *importOperations) UpdateBackupStatus(id, volumeID string, backupState string, backupProgress int, backupURL string, err string) error {
+	if backupURL == "" && err == "" {
+		return nil
+	}
+	o.once.Do(func() {
+		o.backupURL = backupURL
+		if err != "" {
+			o.err = fmt.Errorf("%v", err)
+		}
+		close(o.done)
+	})
+	return nil
+}
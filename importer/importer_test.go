@@ -0,0 +1,59 @@
+package importer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore"
+)
+
+func TestStreamSource(t *testing.T) {
+	assert := assert.New(t)
+
+	data := bytes.Repeat([]byte{1}, backupstore.DEFAULT_BLOCK_SIZE+10)
+	source := newStreamSource(bytes.NewReader(data), 2*backupstore.DEFAULT_BLOCK_SIZE)
+	mappings, err := source.ChangedExtents("")
+	assert.NoError(err)
+	assert.Len(mappings.Mappings, 1)
+	assert.Equal(int64(2*backupstore.DEFAULT_BLOCK_SIZE), mappings.Mappings[0].Size)
+
+	block := make([]byte, backupstore.DEFAULT_BLOCK_SIZE)
+	assert.Error(source.ReadBlockAt(block, backupstore.DEFAULT_BLOCK_SIZE))
+	assert.NoError(source.ReadBlockAt(block, 0))
+	assert.Equal(byte(1), block[len(block)-1])
+
+	// the last block is padded with zeros
+	assert.NoError(source.ReadBlockAt(block, backupstore.DEFAULT_BLOCK_SIZE))
+	assert.Equal(byte(1), block[9])
+	assert.Equal(byte(0), block[10])
+}
+
+func TestParseSourceMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	output := []byte(`{"time":"2023-01-01T00:00:00Z","tree":"abc","paths":["/data"],"id":"4bba301e","struct_type":"snapshot"}
+{"name":"data","type":"dir","path":"/data","struct_type":"node"}
+{"name":"volume.img","type":"file","path":"/data/volume.img","size":4194304,"struct_type":"node"}
+`)
+	size, err := parseResticFileSize(output, "/data/volume.img")
+	assert.NoError(err)
+	assert.Equal(int64(4194304), size)
+	_, err = parseResticFileSize(output, "/data")
+	assert.Error(err)
+	_, err = parseResticFileSize(output, "/data/missing.img")
+	assert.Error(err)
+
+	for _, manifest := range []string{
+		`{"id":"k1","rootEntry":{"name":"volume.img","type":"f","obj":"Ix1234","size":4194304}}`,
+		`{"id":"k1","rootEntry":{"name":"volume.img","type":"f","obj":"Ix1234","size":"4194304"}}`,
+	} {
+		objectID, size, err := parseKopiaRootEntry([]byte(manifest))
+		assert.NoError(err, manifest)
+		assert.Equal("Ix1234", objectID)
+		assert.Equal(int64(4194304), size)
+	}
+	_, _, err = parseKopiaRootEntry([]byte(`{"rootEntry":{"type":"d","obj":"k1234"}}`))
+	assert.Error(err)
+}
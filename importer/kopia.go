@@ -0,0 +1,84 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+const (
+	KopiaBinary = "kopia"
+)
+
+// KopiaSource is a kopia snapshot of a volume image file, it's read with the kopia CLI.
+// The snapshot source should be the image file itself, so the root entry of the snapshot is the file.
+type KopiaSource struct {
+	// ConfigFile is the kopia repository config file, the default one is used if empty
+	ConfigFile string
+	// SnapshotID is the ID of the snapshot manifest
+	SnapshotID string
+	// Env is the additional environment variables of the kopia commands, e.g. KOPIA_PASSWORD
+	Env []string
+}
+
+func (s *KopiaSource) Name() string {
+	return "kopia:" + s.SnapshotID
+}
+
+func (s *KopiaSource) command(args ...string) *exec.Cmd {
+	if s.ConfigFile != "" {
+		args = append(args, "--config-file", s.ConfigFile)
+	}
+	cmd := exec.Command(KopiaBinary, args...)
+	cmd.Env = append(os.Environ(), s.Env...)
+	return cmd
+}
+
+func (s *KopiaSource) Open() (io.ReadCloser, int64, error) {
+	var stderr bytes.Buffer
+	show := s.command("manifest", "show", s.SnapshotID)
+	show.Stderr = &stderr
+	output, err := show.Output()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to show kopia snapshot %v: %v, %v", s.SnapshotID, err, stderr.String())
+	}
+	objectID, size, err := parseKopiaRootEntry(output)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rc, err := startCommand(s.command("show", objectID))
+	if err != nil {
+		return nil, 0, err
+	}
+	return rc, size, nil
+}
+
+// parseKopiaRootEntry returns the object ID and the size of the root file of the snapshot manifest
+func parseKopiaRootEntry(output []byte) (string, int64, error) {
+	manifest := struct {
+		RootEntry *struct {
+			Type     string      `json:"type"`
+			ObjectID string      `json:"obj"`
+			Size     json.Number `json:"size"`
+		} `json:"rootEntry"`
+	}{}
+	if err := json.Unmarshal(output, &manifest); err != nil {
+		return "", 0, fmt.Errorf("failed to parse kopia snapshot manifest: %v", err)
+	}
+	entry := manifest.RootEntry
+	if entry == nil {
+		return "", 0, fmt.Errorf("missing root entry in kopia snapshot manifest")
+	}
+	if entry.Type != "f" {
+		return "", 0, fmt.Errorf("kopia snapshot root entry type %v is not a file", entry.Type)
+	}
+	size, err := entry.Size.Int64()
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid kopia snapshot root entry size %v", entry.Size)
+	}
+	return entry.ObjectID, size, nil
+}
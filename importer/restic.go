@@ -0,0 +1,114 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+const (
+	ResticBinary = "restic"
+)
+
+// ResticSource is a volume image file in a restic snapshot, it's read with the restic CLI.
+// The repository password and credentials are passed by the environment variables, e.g. RESTIC_PASSWORD.
+type ResticSource struct {
+	Repository string
+	SnapshotID string
+	// Path is the absolute path of the volume image file in the snapshot
+	Path string
+	// Env is the additional environment variables of the restic commands
+	Env []string
+}
+
+func (s *ResticSource) Name() string {
+	return "restic:" + s.SnapshotID
+}
+
+func (s *ResticSource) command(args ...string) *exec.Cmd {
+	cmd := exec.Command(ResticBinary, append([]string{"--repo", s.Repository, "--no-lock"}, args...)...)
+	cmd.Env = append(os.Environ(), s.Env...)
+	return cmd
+}
+
+func (s *ResticSource) Open() (io.ReadCloser, int64, error) {
+	var stderr bytes.Buffer
+	ls := s.command("ls", "--json", s.SnapshotID, s.Path)
+	ls.Stderr = &stderr
+	output, err := ls.Output()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list %v in restic snapshot %v: %v, %v", s.Path, s.SnapshotID, err, stderr.String())
+	}
+	size, err := parseResticFileSize(output, s.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rc, err := startCommand(s.command("dump", s.SnapshotID, s.Path))
+	if err != nil {
+		return nil, 0, err
+	}
+	return rc, size, nil
+}
+
+// parseResticFileSize returns the size of the file in the output of restic ls --json, which is a snapshot
+// followed by a node per line
+func parseResticFileSize(output []byte, path string) (int64, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		node := struct {
+			StructType string `json:"struct_type"`
+			Type       string `json:"type"`
+			Path       string `json:"path"`
+			Size       int64  `json:"size"`
+		}{}
+		if err := json.Unmarshal(scanner.Bytes(), &node); err != nil {
+			return 0, fmt.Errorf("failed to parse restic ls output: %v", err)
+		}
+		if node.StructType != "node" || node.Path != path {
+			continue
+		}
+		if node.Type != "file" {
+			return 0, fmt.Errorf("%v in restic snapshot is a %v instead of a file", path, node.Type)
+		}
+		return node.Size, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("cannot find %v in restic snapshot", path)
+}
+
+// commandReader is the stdout of a running command, closing it waits for the command
+type commandReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func startCommand(cmd *exec.Cmd) (io.ReadCloser, error) {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %v: %v", cmd.Args, err)
+	}
+	return &commandReader{ReadCloser: stdout, cmd: cmd, stderr: stderr}, nil
+}
+
+func (r *commandReader) Close() error {
+	// the command may be blocked on writing if the reader stops early
+	r.ReadCloser.Close()
+	if err := r.cmd.Wait(); err != nil {
+		return fmt.Errorf("failed to execute %v: %v, %v", r.cmd.Args, err, r.stderr.String())
+	}
+	return nil
+}
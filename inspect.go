@@ -2,6 +2,7 @@ package backupstore
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -28,6 +29,68 @@ func InspectVolume(volumeURL string) (*VolumeInfo, error) {
 	return fillVolumeInfo(volume), nil
 }
 
+// InspectVolumeChain inspects the volume like InspectVolume, and fills the backup chain and the size trend fields
+// of the volume info as well, which reads the configs of all the backups of the volume
+func InspectVolumeChain(volumeURL string) (*VolumeInfo, error) {
+	volumeInfo, err := InspectVolume(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := GetBackupStoreDriver(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := fillVolumeChainInfo(driver, volumeInfo); err != nil {
+		return nil, err
+	}
+	return volumeInfo, nil
+}
+
+// fillVolumeChainInfo computes the chain and the size fields of the volume info from the completed backups
+func fillVolumeChainInfo(driver BackupStoreDriver, volumeInfo *VolumeInfo) error {
+	entries, err := loadCatalog(driver, volumeInfo.Name, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	depth := 0
+	var compressedBytes, uncompressedBytes int64
+	for _, entry := range entries {
+		backup := entry.backup
+		if !backup.IsIncremental || backup.ChainBase {
+			depth = 0
+			volumeInfo.LastChainBaseAt = backup.CreatedTime
+		} else {
+			depth++
+		}
+		if depth > volumeInfo.ChainDepth {
+			volumeInfo.ChainDepth = depth
+		}
+
+		stats := backup.CompressionStats
+		if stats == nil {
+			continue
+		}
+		compressedBytes += stats.CompressedBytes
+		uncompressedBytes += stats.UncompressedBytes
+		created, err := time.Parse(time.RFC3339, backup.CreatedTime)
+		if err != nil {
+			continue
+		}
+		if volumeInfo.MonthlyGrowth == nil {
+			volumeInfo.MonthlyGrowth = map[string]int64{}
+		}
+		volumeInfo.MonthlyGrowth[created.UTC().Format("2006-01")] += stats.CompressedBytes
+	}
+
+	volumeInfo.PhysicalSize = volumeInfo.DataStored
+	if uncompressedBytes > 0 {
+		volumeInfo.PhysicalSize = int64(float64(volumeInfo.DataStored) * float64(compressedBytes) / float64(uncompressedBytes))
+	}
+	return nil
+}
+
 func InspectBackup(backupURL string) (*BackupInfo, error) {
 	driver, err := GetBackupStoreDriver(backupURL)
 	if err != nil {
@@ -54,6 +117,8 @@ func InspectBackup(backupURL string) (*BackupInfo, error) {
 			LogFieldVolume: volumeName,
 		}).Info("Failed to load backup in backupstore")
 		return nil, err
+	} else if isBackupAborted(backup) {
+		return nil, fmt.Errorf("backup %v was aborted", backup.Name)
 	} else if isBackupInProgress(backup) {
 		// for now we don't return in progress backups to the ui
 		return nil, fmt.Errorf("backup %v is still in progress", backup.Name)
@@ -77,6 +142,8 @@ func fillVolumeInfo(volume *Volume) *VolumeInfo {
 		BackingImageChecksum: volume.BackingImageChecksum,
 		StorageClassname:     volume.StorageClassName,
 		BackendStoreDriver:   volume.BackendStoreDriver,
+		Quota:                volume.Quota,
+		EncryptionRequired:   volume.EncryptionRequired,
 	}
 }
 
@@ -86,11 +153,19 @@ func fillBackupInfo(backup *Backup, destURL string) *BackupInfo {
 		URL:               EncodeBackupURL(backup.Name, backup.VolumeName, destURL),
 		SnapshotName:      backup.SnapshotName,
 		SnapshotCreated:   backup.SnapshotCreatedAt,
+		SnapshotChecksum:  backup.SnapshotChecksum,
 		Created:           backup.CreatedTime,
 		Size:              backup.Size,
 		Labels:            backup.Labels,
 		IsIncremental:     backup.IsIncremental,
 		CompressionMethod: backup.CompressionMethod,
+		DeletionProtected: backup.DeletionProtected,
+		CreatedBy:         backup.CreatedBy,
+		RequiredFeatures:  backup.RequiredFeatures,
+		CompressionStats:  backup.CompressionStats,
+		ComplianceMode:    backup.ComplianceMode,
+		Broken:            backup.Broken,
+		ChainBase:         backup.ChainBase,
 	}
 }
 
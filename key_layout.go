@@ -0,0 +1,189 @@
+package backupstore
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/pkg/errors"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+// KeyLayout names the backup configs and the blocks in the backupstore, for the organizations requiring e.g. the
+// classification tags in the object keys. The names must be reversible, since the backup names and the block
+// checksums are extracted from the listed names: the templates can only put a fixed prefix and suffix around
+// the backup name or the checksum.
+//
+// The key layout is recorded in the backup target config and cannot be changed once there are backup volumes.
+type KeyLayout struct {
+	// BackupKeyTemplate is a text/template for the backup config file name, the field BackupName is available
+	// and the name must end with .cfg. For example: "confidential-backup_{{.BackupName}}.cfg"
+	BackupKeyTemplate string `json:",omitempty"`
+	// BlockKeyTemplate is a text/template for the block file name, the field Checksum is available and the name
+	// must end with .blk. For example: "{{.Checksum}}.confidential.blk"
+	BlockKeyTemplate string `json:",omitempty"`
+}
+
+// keyNaming is the prefix and the suffix around the backup names and the block checksums rendered by a KeyLayout
+type keyNaming struct {
+	backupPrefix string
+	backupSuffix string
+	blockPrefix  string
+	blockSuffix  string
+}
+
+var (
+	defaultKeyNaming = &keyNaming{
+		backupPrefix: BACKUP_CONFIG_PREFIX,
+		backupSuffix: CFG_SUFFIX,
+		blockSuffix:  BLK_SUFFIX,
+	}
+
+	keyNamingsLock sync.RWMutex
+	// keyNamings caches the naming of the key layouts of the backup targets by the driver URL
+	keyNamings = map[string]*keyNaming{}
+)
+
+type backupKeyTemplateData struct {
+	BackupName string
+}
+
+type blockKeyTemplateData struct {
+	Checksum string
+}
+
+// Validate checks if the names rendered by the templates are reversible
+func (l *KeyLayout) Validate() error {
+	_, err := newKeyNaming(l)
+	return err
+}
+
+func newKeyNaming(l *KeyLayout) (*keyNaming, error) {
+	naming := *defaultKeyNaming
+	if l == nil {
+		return &naming, nil
+	}
+
+	var err error
+	if l.BackupKeyTemplate != "" {
+		naming.backupPrefix, naming.backupSuffix, err = parseKeyTemplate(l.BackupKeyTemplate, CFG_SUFFIX,
+			[]string{"backup-0123456789abcdef", "backup-fedcba9876543210"},
+			func(name string) interface{} { return backupKeyTemplateData{BackupName: name} })
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid backup key template %v", l.BackupKeyTemplate)
+		}
+	}
+	if l.BlockKeyTemplate != "" {
+		naming.blockPrefix, naming.blockSuffix, err = parseKeyTemplate(l.BlockKeyTemplate, BLK_SUFFIX,
+			[]string{util.GetChecksum([]byte("sample-block-1")), util.GetChecksum([]byte("sample-block-2"))},
+			func(checksum string) interface{} { return blockKeyTemplateData{Checksum: checksum} })
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid block key template %v", l.BlockKeyTemplate)
+		}
+	}
+	return &naming, nil
+}
+
+// parseKeyTemplate returns the fixed prefix and suffix the template renders around the value. The template is
+// rendered with the sample values, which must appear once in the names surrounded by the same prefix and suffix.
+func parseKeyTemplate(text, requiredSuffix string, samples []string, data func(value string) interface{}) (string, string, error) {
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", "", err
+	}
+
+	prefix, suffix := "", ""
+	for i, sample := range samples {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data(sample)); err != nil {
+			return "", "", err
+		}
+		name := buf.String()
+		if strings.Count(name, sample) != 1 {
+			return "", "", fmt.Errorf("the name %v must contain the value exactly once", name)
+		}
+		index := strings.Index(name, sample)
+		if i == 0 {
+			prefix, suffix = name[:index], name[index+len(sample):]
+		} else if name[:index] != prefix || name[index+len(sample):] != suffix {
+			return "", "", fmt.Errorf("the name %v must only add a fixed prefix and suffix to the value", name)
+		}
+	}
+
+	if strings.ContainsAny(prefix+suffix, "/\\") {
+		return "", "", fmt.Errorf("the name must not contain path separators")
+	}
+	if !strings.HasSuffix(suffix, requiredSuffix) {
+		return "", "", fmt.Errorf("the name must end with %v", requiredSuffix)
+	}
+	if !util.ValidateName(prefix + samples[0] + suffix) {
+		return "", "", fmt.Errorf("the name contains invalid characters")
+	}
+	return prefix, suffix, nil
+}
+
+func (n *keyNaming) backupConfigName(backupName string) string {
+	return n.backupPrefix + backupName + n.backupSuffix
+}
+
+func (n *keyNaming) blockFileName(checksum string) string {
+	return n.blockPrefix + checksum + n.blockSuffix
+}
+
+// getKeyNaming returns the naming of the key layout of the backup target, the default naming is used if no key
+// layout has been recorded in the backup target config
+func getKeyNaming(driver BackupStoreDriver) *keyNaming {
+	keyNamingsLock.RLock()
+	defer keyNamingsLock.RUnlock()
+	if naming, ok := keyNamings[driver.GetURL()]; ok {
+		return naming
+	}
+	return defaultKeyNaming
+}
+
+func setKeyNaming(driver BackupStoreDriver, l *KeyLayout) error {
+	naming, err := newKeyNaming(l)
+	if err != nil {
+		return err
+	}
+	keyNamingsLock.Lock()
+	defer keyNamingsLock.Unlock()
+	keyNamings[driver.GetURL()] = naming
+	return nil
+}
+
+func isKeyLayoutEqual(a, b *KeyLayout) bool {
+	if a == nil {
+		a = &KeyLayout{}
+	}
+	if b == nil {
+		b = &KeyLayout{}
+	}
+	return *a == *b
+}
+
+// checkKeyLayoutChange checks if the key layout of the backup target can be changed, the backups and the blocks
+// cannot be found by the names of the other key layout
+func checkKeyLayoutChange(driver BackupStoreDriver, l *KeyLayout) error {
+	current, err := loadTargetConfigFile(driver)
+	if err != nil {
+		return err
+	}
+	if isKeyLayoutEqual(current.KeyLayout, l) {
+		return nil
+	}
+
+	volumeDirs, err := driver.List(filepath.Join(backupstoreBase, VOLUME_DIRECTORY))
+	if err != nil {
+		return err
+	}
+	if len(volumeDirs) > 0 {
+		return fmt.Errorf("cannot change the key layout of backup target %v since it contains backup volumes",
+			driver.GetURL())
+	}
+	return nil
+}
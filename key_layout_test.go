@@ -0,0 +1,97 @@
+package backupstore
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestKeyLayoutValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&KeyLayout{}).Validate())
+	assert.NoError((&KeyLayout{
+		BackupKeyTemplate: "confidential-backup_{{.BackupName}}.cfg",
+		BlockKeyTemplate:  "{{.Checksum}}.confidential.blk",
+	}).Validate())
+	assert.NoError((&TargetConfig{KeyLayout: &KeyLayout{BlockKeyTemplate: "c1-{{.Checksum}}.blk"}}).Validate())
+
+	for _, l := range []*KeyLayout{
+		// not reversible
+		{BlockKeyTemplate: "{{slice .Checksum 0 8}}.blk"},
+		{BlockKeyTemplate: "{{.Checksum}}-{{.Checksum}}.blk"},
+		{BlockKeyTemplate: "{{slice .Checksum 0 2}}-{{.Checksum}}.blk"},
+		{BackupKeyTemplate: "backup.cfg"},
+		// not a file name of the required suffix
+		{BlockKeyTemplate: "{{.Checksum}}.confidential"},
+		{BackupKeyTemplate: "confidential/backup_{{.BackupName}}.cfg"},
+		{BackupKeyTemplate: "backup {{.BackupName}}.cfg"},
+		// invalid template
+		{BlockKeyTemplate: "{{.Checksum}.blk"},
+		{BlockKeyTemplate: "{{.BackupName}}.blk"},
+	} {
+		assert.Error(l.Validate(), "%+v", *l)
+		assert.Error((&TargetConfig{KeyLayout: l}).Validate(), "%+v", *l)
+	}
+}
+
+func TestKeyLayout(t *testing.T) {
+	assert := assert.New(t)
+
+	mock := &mockStoreDriver{}
+	m := &writableMockStoreDriver{mock}
+	mock.Init()
+	defer mock.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m, nil
+	})
+	defer func() {
+		targetConfigsLock.Lock()
+		delete(targetConfigs, mockDriverURL)
+		targetConfigsLock.Unlock()
+		keyNamingsLock.Lock()
+		delete(keyNamings, mockDriverURL)
+		keyNamingsLock.Unlock()
+	}()
+
+	keyLayout := &KeyLayout{
+		BackupKeyTemplate: "confidential-backup_{{.BackupName}}.cfg",
+		BlockKeyTemplate:  "{{.Checksum}}.confidential.blk",
+	}
+	assert.NoError(m.fs.MkdirAll(filepath.Join(backupstoreBase, VOLUME_DIRECTORY), 0755))
+	assert.NoError(SetTargetConfig(mockDriverURL, &TargetConfig{KeyLayout: keyLayout}))
+
+	// the other clients take the key layout when registering the backup target
+	keyNamingsLock.Lock()
+	delete(keyNamings, mockDriverURL)
+	keyNamingsLock.Unlock()
+	_, err := GetBackupStoreDriver(mockDriverURL)
+	assert.NoError(err)
+
+	assert.NoError(addVolume(m, &Volume{Name: "pvc-1"}))
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-1", VolumeName: "pvc-1", CreatedTime: "2026-01-01T00:00:00Z"}))
+	assert.Equal("confidential-backup_backup-1.cfg", filepath.Base(getBackupConfigPath(m, "backup-1", "pvc-1")))
+	assert.True(m.FileExists(getBackupConfigPath(m, "backup-1", "pvc-1")))
+	names, err := getBackupNamesForVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal([]string{"backup-1"}, names)
+
+	checksum := util.GetChecksum([]byte("block"))
+	blkFile := getBlockFilePath(m, "pvc-1", checksum)
+	assert.Equal(checksum+".confidential.blk", filepath.Base(blkFile))
+	assert.Equal(filepath.Join(getBlockPath(m, "pvc-1"), checksum[0:2], checksum[2:4]), filepath.Dir(blkFile))
+	assert.NoError(m.Write(blkFile, strings.NewReader("block")))
+	blocks, err := getBlockNamesForVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal([]string{checksum}, blocks)
+
+	// the backups and the blocks cannot be found once the key layout is changed
+	assert.Error(SetTargetConfig(mockDriverURL, &TargetConfig{}))
+	assert.Error(SetTargetConfig(mockDriverURL, &TargetConfig{KeyLayout: &KeyLayout{BlockKeyTemplate: "{{.Checksum}}.blk"}}))
+	assert.NoError(SetTargetConfig(mockDriverURL, &TargetConfig{KeyLayout: keyLayout, ConcurrentLimit: 4}))
+}
@@ -0,0 +1,295 @@
+package backupstore
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/pkg/errors"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	LAYOUT_CONFIG_FILE = "layout.cfg"
+
+	LayoutKindDefault        = "default"
+	LayoutKindFlatHashed     = "flat-hashed"
+	LayoutKindPrefixTemplate = "prefix-template"
+
+	FLAT_HASHED_VOLUME_LAYER = 4
+)
+
+// Layout decides where the backup volumes and the blocks are placed in the backupstore
+type Layout interface {
+	// Kind returns the kind the layout is recorded with in the backupstore
+	Kind() string
+	// VolumePath returns the backup volume directory relative to the volumes directory
+	VolumePath(volumeName string) string
+	// VolumePathDepth returns the number of directory levels of VolumePath
+	VolumePathDepth() int
+	// BlockPath returns the block file path relative to the blocks directory of the backup volume
+	BlockPath(checksum string) string
+	// BlockPathDepth returns the number of directory levels of BlockPath excluding the block file
+	BlockPathDepth() int
+}
+
+// LayoutConfig is the layout recorded in the backupstore, so the readers can resolve the paths
+type LayoutConfig struct {
+	Kind string
+	// VolumePathTemplate is a text/template for the backup volume directory used by the prefix-template layout.
+	// The fields VolumeName and VolumeChecksum are available, and the last path element must be the VolumeName.
+	// For example: "tenant-a/{{slice .VolumeChecksum 0 2}}/{{.VolumeName}}"
+	VolumePathTemplate string `json:",omitempty"`
+}
+
+var (
+	layoutsLock sync.RWMutex
+	// layouts caches the layout of the backup targets by the driver URL
+	layouts = map[string]Layout{}
+)
+
+// defaultLayout places the backup volumes and the blocks in 2 levels of hashed directories:
+// volumes/<vol checksum[0:2]>/<vol checksum[2:4]>/<volume> and blocks/<checksum[0:2]>/<checksum[2:4]>/<checksum>.blk
+type defaultLayout struct{}
+
+func (defaultLayout) Kind() string {
+	return LayoutKindDefault
+}
+
+func (defaultLayout) VolumePath(volumeName string) string {
+	checksum := util.GetChecksum([]byte(volumeName))
+	volumeLayer1 := checksum[0:VOLUME_SEPARATE_LAYER1]
+	volumeLayer2 := checksum[VOLUME_SEPARATE_LAYER1:VOLUME_SEPARATE_LAYER2]
+	return filepath.Join(volumeLayer1, volumeLayer2, volumeName)
+}
+
+func (defaultLayout) VolumePathDepth() int {
+	return 3
+}
+
+func (defaultLayout) BlockPath(checksum string) string {
+	blockSubDirLayer1 := checksum[0:BLOCK_SEPARATE_LAYER1]
+	blockSubDirLayer2 := checksum[BLOCK_SEPARATE_LAYER1:BLOCK_SEPARATE_LAYER2]
+	return filepath.Join(blockSubDirLayer1, blockSubDirLayer2, checksum+BLK_SUFFIX)
+}
+
+func (defaultLayout) BlockPathDepth() int {
+	return 2
+}
+
+// flatHashedLayout avoids deep prefixes for the object stores:
+// volumes/<vol checksum[0:4]>/<volume> and blocks/<checksum>.blk
+type flatHashedLayout struct{}
+
+func (flatHashedLayout) Kind() string {
+	return LayoutKindFlatHashed
+}
+
+func (flatHashedLayout) VolumePath(volumeName string) string {
+	checksum := util.GetChecksum([]byte(volumeName))
+	return filepath.Join(checksum[0:FLAT_HASHED_VOLUME_LAYER], volumeName)
+}
+
+func (flatHashedLayout) VolumePathDepth() int {
+	return 2
+}
+
+func (flatHashedLayout) BlockPath(checksum string) string {
+	return checksum + BLK_SUFFIX
+}
+
+func (flatHashedLayout) BlockPathDepth() int {
+	return 0
+}
+
+// prefixTemplateLayout renders the backup volume directory from a user specified template,
+// the blocks are placed the same as the default layout
+type prefixTemplateLayout struct {
+	defaultLayout
+
+	tmpl  *template.Template
+	depth int
+	// staticPrefix is the leading directories of the template without any action, shared by all the volumes
+	staticPrefix string
+}
+
+type volumePathTemplateData struct {
+	VolumeName     string
+	VolumeChecksum string
+}
+
+func newPrefixTemplateLayout(volumePathTemplate string) (*prefixTemplateLayout, error) {
+	tmpl, err := template.New("volume-path").Option("missingkey=error").Parse(volumePathTemplate)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid volume path template %v", volumePathTemplate)
+	}
+	l := &prefixTemplateLayout{tmpl: tmpl}
+
+	// Validate the template with a sample volume name, the volumes can only be found on the
+	// backupstore if the volume name is the last path element
+	sampleVolumeName := "sample-volume"
+	path, err := l.render(sampleVolumeName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid volume path template %v", volumePathTemplate)
+	}
+	if filepath.Base(path) != sampleVolumeName || filepath.IsAbs(path) || strings.HasPrefix(path, "..") {
+		return nil, fmt.Errorf("invalid volume path template %v: the last path element must be the volume name", volumePathTemplate)
+	}
+	l.depth = len(strings.Split(path, "/"))
+
+	if i := strings.Index(volumePathTemplate, "{{"); i >= 0 {
+		if j := strings.LastIndex(volumePathTemplate[:i], "/"); j >= 0 {
+			staticPrefix := filepath.Clean(volumePathTemplate[:j])
+			if strings.HasPrefix(path, staticPrefix+"/") {
+				l.staticPrefix = staticPrefix
+			}
+		}
+	}
+	return l, nil
+}
+
+func (l *prefixTemplateLayout) render(volumeName string) (string, error) {
+	var buf bytes.Buffer
+	if err := l.tmpl.Execute(&buf, volumePathTemplateData{
+		VolumeName:     volumeName,
+		VolumeChecksum: util.GetChecksum([]byte(volumeName)),
+	}); err != nil {
+		return "", err
+	}
+	return filepath.Clean(buf.String()), nil
+}
+
+func (l *prefixTemplateLayout) Kind() string {
+	return LayoutKindPrefixTemplate
+}
+
+func (l *prefixTemplateLayout) VolumePath(volumeName string) string {
+	path, err := l.render(volumeName)
+	if err != nil {
+		// the template has been validated, fall back to the volume name in case of misuse
+		log.WithError(err).Errorf("Failed to render volume path for volume %v", volumeName)
+		return volumeName
+	}
+	return path
+}
+
+func (l *prefixTemplateLayout) VolumePathDepth() int {
+	return l.depth
+}
+
+// getVolumePathStaticPrefix returns the leading directories shared by the paths of all the volumes,
+// so the volume listing can start below them
+func getVolumePathStaticPrefix(layout Layout) string {
+	if l, ok := layout.(*prefixTemplateLayout); ok {
+		return l.staticPrefix
+	}
+	return ""
+}
+
+// NewLayout creates the layout from the layout config
+func NewLayout(config *LayoutConfig) (Layout, error) {
+	if config == nil {
+		return defaultLayout{}, nil
+	}
+	switch config.Kind {
+	case "", LayoutKindDefault:
+		return defaultLayout{}, nil
+	case LayoutKindFlatHashed:
+		return flatHashedLayout{}, nil
+	case LayoutKindPrefixTemplate:
+		return newPrefixTemplateLayout(config.VolumePathTemplate)
+	default:
+		return nil, fmt.Errorf("unsupported backupstore layout %v", config.Kind)
+	}
+}
+
+func getLayoutConfigPath() string {
+	return filepath.Join(backupstoreBase, LAYOUT_CONFIG_FILE)
+}
+
+// getLayout returns the layout of the backup target, the default layout is used
+// if no layout has been recorded in the backupstore
+func getLayout(driver BackupStoreDriver) Layout {
+	layoutsLock.RLock()
+	defer layoutsLock.RUnlock()
+	if layout, ok := layouts[driver.GetURL()]; ok {
+		return layout
+	}
+	return defaultLayout{}
+}
+
+func loadLayoutConfig(driver BackupStoreDriver) (*LayoutConfig, error) {
+	config := &LayoutConfig{Kind: LayoutKindDefault}
+	if !driver.FileExists(getLayoutConfigPath()) {
+		return config, nil
+	}
+	if err := LoadConfigInBackupStore(driver, getLayoutConfigPath(), config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// loadLayout reads the layout recorded in the backupstore and caches it for the path resolving
+func loadLayout(driver BackupStoreDriver) error {
+	config, err := loadLayoutConfig(driver)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load backupstore layout of %v", driver.GetURL())
+	}
+	layout, err := NewLayout(config)
+	if err != nil {
+		return err
+	}
+
+	layoutsLock.Lock()
+	defer layoutsLock.Unlock()
+	layouts[driver.GetURL()] = layout
+	return nil
+}
+
+// SetBackupStoreLayout records the layout of the backup target. The layout can only be chosen
+// when registering the backup target, it cannot be changed once there are backup volumes.
+func SetBackupStoreLayout(destURL string, config *LayoutConfig) error {
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return err
+	}
+
+	layout, err := NewLayout(config)
+	if err != nil {
+		return err
+	}
+
+	current, err := loadLayoutConfig(driver)
+	if err != nil {
+		return err
+	}
+	if current.Kind == layout.Kind() && current.VolumePathTemplate == config.VolumePathTemplate {
+		return nil
+	}
+
+	volumeDirs, err := driver.List(filepath.Join(backupstoreBase, VOLUME_DIRECTORY))
+	if err != nil {
+		return err
+	}
+	if len(volumeDirs) > 0 {
+		return fmt.Errorf("cannot change the layout of backup target %v from %v to %v since it contains backup volumes",
+			driver.GetURL(), current.Kind, layout.Kind())
+	}
+
+	if err := SaveConfigInBackupStore(driver, getLayoutConfigPath(), &LayoutConfig{
+		Kind:               layout.Kind(),
+		VolumePathTemplate: config.VolumePathTemplate,
+	}); err != nil {
+		return err
+	}
+
+	layoutsLock.Lock()
+	defer layoutsLock.Unlock()
+	layouts[driver.GetURL()] = layout
+	log.Infof("Set backupstore layout of %v to %v", driver.GetURL(), layout.Kind())
+	return nil
+}
@@ -0,0 +1,86 @@
+package backupstore
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gammazero/workerpool"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestNewLayout(t *testing.T) {
+	assert := assert.New(t)
+
+	checksum := util.GetChecksum([]byte("pvc-1"))
+
+	layout, err := NewLayout(nil)
+	assert.NoError(err)
+	assert.Equal(LayoutKindDefault, layout.Kind())
+	assert.Equal(checksum[0:2]+"/"+checksum[2:4]+"/pvc-1", layout.VolumePath("pvc-1"))
+
+	layout, err = NewLayout(&LayoutConfig{Kind: LayoutKindFlatHashed})
+	assert.NoError(err)
+	assert.Equal(checksum[0:4]+"/pvc-1", layout.VolumePath("pvc-1"))
+	assert.Equal(checksum+BLK_SUFFIX, layout.BlockPath(checksum))
+
+	layout, err = NewLayout(&LayoutConfig{
+		Kind:               LayoutKindPrefixTemplate,
+		VolumePathTemplate: "tenant-a/{{slice .VolumeChecksum 0 2}}/{{.VolumeName}}",
+	})
+	assert.NoError(err)
+	assert.Equal("tenant-a/"+checksum[0:2]+"/pvc-1", layout.VolumePath("pvc-1"))
+	assert.Equal(3, layout.VolumePathDepth())
+	assert.Equal("tenant-a", getVolumePathStaticPrefix(layout))
+
+	layout, err = NewLayout(&LayoutConfig{Kind: LayoutKindPrefixTemplate, VolumePathTemplate: "{{.VolumeName}}"})
+	assert.NoError(err)
+	assert.Equal("", getVolumePathStaticPrefix(layout))
+
+	for _, tmpl := range []string{"{{.VolumeName}}/tenant-a", "/{{.VolumeName}}", "{{.Unknown}}", "{{.VolumeName"} {
+		_, err = NewLayout(&LayoutConfig{Kind: LayoutKindPrefixTemplate, VolumePathTemplate: tmpl})
+		assert.Error(err, tmpl)
+	}
+
+	_, err = NewLayout(&LayoutConfig{Kind: "unknown"})
+	assert.Error(err)
+}
+
+func TestFlatHashedLayoutListing(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &mockStoreDriver{delay: time.Millisecond}
+	m.Init()
+	defer m.uninstall()
+
+	layoutsLock.Lock()
+	layouts[m.GetURL()] = flatHashedLayout{}
+	layoutsLock.Unlock()
+	defer func() {
+		layoutsLock.Lock()
+		delete(layouts, m.GetURL())
+		layoutsLock.Unlock()
+	}()
+
+	for _, name := range []string{"pvc-1", "pvc-2"} {
+		m.fs.MkdirAll(getVolumePath(m, name), 0755)
+		afero.WriteFile(m.fs, getVolumeFilePath(m, name), []byte(`{"Name":"`+name+`"}`), 0644)
+	}
+	blk := util.GetChecksum([]byte("block"))
+	afero.WriteFile(m.fs, getBlockFilePath(m, "pvc-1", blk), []byte("data"), 0644)
+	assert.False(strings.Contains(strings.TrimPrefix(getBlockFilePath(m, "pvc-1", blk), getBlockPath(m, "pvc-1")), "/"))
+
+	jobQueues := workerpool.New(runtime.NumCPU())
+	defer jobQueues.StopWait()
+	names, err := getVolumeNames(jobQueues, m)
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"pvc-1", "pvc-2"}, names)
+
+	blockNames, err := getBlockNamesForVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal([]string{blk}, blockNames)
+}
@@ -3,6 +3,7 @@ package backupstore
 import (
 	"errors"
 	"fmt"
+	"path"
 	"runtime"
 	"strings"
 
@@ -29,6 +30,20 @@ type VolumeInfo struct {
 	BackingImageChecksum string
 	StorageClassname     string
 	BackendStoreDriver   string
+	Quota                *VolumeQuota `json:",omitempty"`
+	EncryptionRequired   bool         `json:",omitempty"`
+
+	// ChainDepth is the number of the incremental backups in the longest chain after a full backup, only set
+	// by InspectVolumeChain like the other fields below
+	ChainDepth int `json:",omitempty"`
+	// LastChainBaseAt is when the last full backup was created
+	LastChainBaseAt string `json:",omitempty"`
+	// PhysicalSize is the estimated size of the stored blocks after the compression, it's DataStored scaled by
+	// the compression ratio of the backups with the compression stats
+	PhysicalSize int64 `json:",string,omitempty"`
+	// MonthlyGrowth is the compressed bytes of the blocks uploaded by the backups created in the month, keyed by
+	// the month formatted as 2006-01. The backups without the compression stats are not counted.
+	MonthlyGrowth map[string]int64 `json:",omitempty"`
 }
 
 type BackupInfo struct {
@@ -36,11 +51,19 @@ type BackupInfo struct {
 	URL               string
 	SnapshotName      string
 	SnapshotCreated   string
+	SnapshotChecksum  string `json:",omitempty"`
 	Created           string
 	Size              int64 `json:",string"`
 	Labels            map[string]string
 	IsIncremental     bool
-	CompressionMethod string `json:",omitempty"`
+	CompressionMethod string            `json:",omitempty"`
+	DeletionProtected bool              `json:",omitempty"`
+	CreatedBy         string            `json:",omitempty"`
+	RequiredFeatures  []string          `json:",omitempty"`
+	CompressionStats  *CompressionStats `json:",omitempty"`
+	ComplianceMode    string            `json:",omitempty"`
+	Broken            string            `json:",omitempty"`
+	ChainBase         bool              `json:",omitempty"`
 
 	VolumeName             string `json:",omitempty"`
 	VolumeSize             int64  `json:",string,omitempty"`
@@ -63,7 +86,7 @@ func addListVolume(driver BackupStoreDriver, volumeName string, volumeOnly bool)
 	if !volumeExists(driver, volumeName) {
 		// If the backup volume folder exist but volume.cfg not exist
 		// save the error in Messages field
-		volumeInfo.Messages[types.MessageTypeError] = fmt.Sprintf("cannot find %v in backupstore", getVolumeFilePath(volumeName))
+		volumeInfo.Messages[types.MessageTypeError] = fmt.Sprintf("cannot find %v in backupstore", getVolumeFilePath(driver, volumeName))
 		return volumeInfo, nil
 	}
 
@@ -117,3 +140,127 @@ func List(volumeName, destURL string, volumeOnly bool) (map[string]*VolumeInfo,
 	}
 	return resp, nil
 }
+
+// VolumeFilter selects the backup volumes to list, all the conditions must be met
+type VolumeFilter struct {
+	// NamePrefix is the prefix of the volume names
+	NamePrefix string
+	// NamePattern is the glob pattern of the volume names in the syntax of path.Match
+	NamePattern string
+	// Labels are the labels the volumes must have
+	Labels map[string]string
+	// OwnerClusterID is the UUID of the cluster owning the volumes
+	OwnerClusterID string
+	// IncludeUnowned also selects the volumes not owned by any cluster if OwnerClusterID is set
+	IncludeUnowned bool
+}
+
+// namePrefix returns the longest volume name prefix implied by the filter, so it can be pushed down to the listing
+func (f *VolumeFilter) namePrefix() string {
+	patternPrefix := f.NamePattern
+	if i := strings.IndexAny(patternPrefix, `*?[\`); i >= 0 {
+		patternPrefix = patternPrefix[:i]
+	}
+	if len(patternPrefix) > len(f.NamePrefix) {
+		return patternPrefix
+	}
+	return f.NamePrefix
+}
+
+// exactName returns the only volume name matching the filter, or an empty string if the pattern isn't a plain name
+func (f *VolumeFilter) exactName() string {
+	if f.NamePattern == "" || strings.ContainsAny(f.NamePattern, `*?[\`) {
+		return ""
+	}
+	return f.NamePattern
+}
+
+func (f *VolumeFilter) matchName(volumeName string) bool {
+	if !strings.HasPrefix(volumeName, f.NamePrefix) {
+		return false
+	}
+	if f.NamePattern == "" {
+		return true
+	}
+	matched, err := path.Match(f.NamePattern, volumeName)
+	return err == nil && matched
+}
+
+// matchVolume checks the labels and the owner against the volume config, which is only loaded if needed
+func (f *VolumeFilter) matchVolume(driver BackupStoreDriver, volumeName string) (bool, error) {
+	if len(f.Labels) == 0 && f.OwnerClusterID == "" {
+		return true, nil
+	}
+	volume, err := loadVolume(driver, volumeName)
+	if err != nil {
+		return false, err
+	}
+	if f.OwnerClusterID != "" && volume.OwnerClusterID != f.OwnerClusterID &&
+		!(f.IncludeUnowned && volume.OwnerClusterID == "") {
+		return false, nil
+	}
+	for key, value := range f.Labels {
+		if v, exists := volume.Labels[key]; !exists || v != value {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ListWithFilter lists the backup volumes selected by the filter. The name prefix and the literal prefix of the
+// name pattern are pushed down to the driver listing, the labels and the owner are checked against the volume
+// configs, so the backups of the volumes not selected are never listed.
+func ListWithFilter(destURL string, filter *VolumeFilter, volumeOnly bool) (map[string]*VolumeInfo, error) {
+	if filter == nil {
+		return List("", destURL, volumeOnly)
+	}
+	if _, err := path.Match(filter.NamePattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid volume name pattern %v: %v", filter.NamePattern, err)
+	}
+
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var volumeNames []string
+	if name := filter.exactName(); name != "" {
+		if volumeExists(driver, name) {
+			volumeNames = []string{name}
+		}
+	} else {
+		jobQueues := workerpool.New(runtime.NumCPU() * 16)
+		volumeNames, err = getVolumeNamesWithPrefix(jobQueues, driver, filter.namePrefix())
+		jobQueues.StopWait()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var resp = make(map[string]*VolumeInfo)
+	var errs []string
+	for _, volumeName := range volumeNames {
+		if !filter.matchName(volumeName) {
+			continue
+		}
+		matched, err := filter.matchVolume(driver, volumeName)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to check labels and owner of volume %v", volumeName)
+			continue
+		}
+		if !matched {
+			continue
+		}
+		volumeInfo, err := addListVolume(driver, volumeName, volumeOnly)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		resp[volumeName] = volumeInfo
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+	return resp, nil
+}
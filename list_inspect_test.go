@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -124,11 +126,11 @@ func TestListBackupVolumeNames(t *testing.T) {
 	assert.Equal(0, len(volumeInfo))
 
 	// create pvc-1 folder and config
-	m.fs.MkdirAll(getVolumePath("pvc-1"), 0755)
-	afero.WriteFile(m.fs, getVolumeFilePath("pvc-1"), []byte(`{"Name":"pvc-1"}`), 0644)
+	m.fs.MkdirAll(getVolumePath(m, "pvc-1"), 0755)
+	afero.WriteFile(m.fs, getVolumeFilePath(m, "pvc-1"), []byte(`{"Name":"pvc-1"}`), 0644)
 
 	// create pvc-2 folder without config
-	m.fs.MkdirAll(getVolumePath("pvc-2"), 0755)
+	m.fs.MkdirAll(getVolumePath(m, "pvc-2"), 0755)
 
 	// list backup volume names
 	volumeInfo, err = List("", mockDriverURL, true)
@@ -138,6 +140,84 @@ func TestListBackupVolumeNames(t *testing.T) {
 	assert.Equal(1, len(volumeInfo["pvc-2"].Messages))
 }
 
+type prefixListerMockStoreDriver struct {
+	*mockStoreDriver
+	prefixes []string
+}
+
+func (m *prefixListerMockStoreDriver) ListPrefix(listPath, prefix string) ([]string, error) {
+	m.prefixes = append(m.prefixes, prefix)
+	entries, err := m.List(listPath)
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, prefix) {
+			result = append(result, entry)
+		}
+	}
+	return result, nil
+}
+
+func TestListWithFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	mock := &mockStoreDriver{}
+	m := &prefixListerMockStoreDriver{mockStoreDriver: mock}
+	mock.Init()
+	defer mock.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m, nil
+	})
+	defer func() {
+		layoutsLock.Lock()
+		delete(layouts, m.GetURL())
+		layoutsLock.Unlock()
+	}()
+
+	// the volumes are placed below the static prefix of the recorded layout
+	afero.WriteFile(m.fs, getLayoutConfigPath(), []byte(`{"Kind":"prefix-template","VolumePathTemplate":"tenant-a/{{.VolumeName}}"}`), 0644)
+	assert.NoError(loadLayout(m))
+
+	for name, labels := range map[string]string{
+		"pvc-1":   `{"app":"db"}`,
+		"pvc-2":   `{"app":"web"}`,
+		"pvc-10":  `{"app":"db"}`,
+		"other-1": `{"app":"db"}`,
+	} {
+		m.fs.MkdirAll(getVolumePath(m, name), 0755)
+		afero.WriteFile(m.fs, getVolumeFilePath(m, name), []byte(`{"Name":"`+name+`","Labels":`+labels+`}`), 0644)
+	}
+
+	volumeInfo, err := ListWithFilter(mockDriverURL, &VolumeFilter{NamePrefix: "pvc-"}, true)
+	assert.NoError(err)
+	assert.Len(volumeInfo, 3)
+	assert.Equal([]string{"pvc-"}, m.prefixes)
+
+	volumeInfo, err = ListWithFilter(mockDriverURL, &VolumeFilter{NamePattern: "pvc-?"}, true)
+	assert.NoError(err)
+	assert.Len(volumeInfo, 2)
+	assert.Contains(volumeInfo, "pvc-1")
+	assert.Contains(volumeInfo, "pvc-2")
+
+	volumeInfo, err = ListWithFilter(mockDriverURL, &VolumeFilter{NamePattern: "*-1*", Labels: map[string]string{"app": "db"}}, true)
+	assert.NoError(err)
+	assert.Len(volumeInfo, 3)
+	assert.NotContains(volumeInfo, "pvc-2")
+
+	// the plain name is looked up without listing
+	m.prefixes = nil
+	volumeInfo, err = ListWithFilter(mockDriverURL, &VolumeFilter{NamePattern: "pvc-10"}, true)
+	assert.NoError(err)
+	assert.Len(volumeInfo, 1)
+	assert.Empty(m.prefixes)
+
+	_, err = ListWithFilter(mockDriverURL, &VolumeFilter{NamePattern: "pvc-["}, true)
+	assert.Error(err)
+}
+
 func TestListBackupVolumeBackups(t *testing.T) {
 	assert := assert.New(t)
 
@@ -146,7 +226,7 @@ func TestListBackupVolumeBackups(t *testing.T) {
 	defer m.uninstall()
 
 	// create pvc-1 folder
-	m.fs.MkdirAll(getVolumePath("pvc-1"), 0755)
+	m.fs.MkdirAll(getVolumePath(m, "pvc-1"), 0755)
 
 	// list pvc-1 without config
 	volumeInfo, err := List("pvc-1", mockDriverURL, false)
@@ -154,15 +234,15 @@ func TestListBackupVolumeBackups(t *testing.T) {
 	assert.Equal(1, len(volumeInfo["pvc-1"].Messages))
 
 	// create pvc-1 config
-	afero.WriteFile(m.fs, getVolumeFilePath("pvc-1"), []byte(`{"Name":"pvc-1"}`), 0644)
+	afero.WriteFile(m.fs, getVolumeFilePath(m, "pvc-1"), []byte(`{"Name":"pvc-1"}`), 0644)
 
 	// create backups folder
-	m.fs.MkdirAll(getBackupPath("pvc-1"), 0755)
+	m.fs.MkdirAll(getBackupPath(m, "pvc-1"), 0755)
 
 	// create 100 backups config
 	for i := 1; i <= 100; i++ {
 		backup := fmt.Sprintf("backup-%d", i)
-		afero.WriteFile(m.fs, getBackupConfigPath(backup, "pvc-1"),
+		afero.WriteFile(m.fs, getBackupConfigPath(m, backup, "pvc-1"),
 			[]byte(fmt.Sprintf(`{"Name":"%s","CreatedTime":"%s"}`, backup, time.Now().String())), 0644)
 	}
 
@@ -181,7 +261,7 @@ func TestInspectVolume(t *testing.T) {
 	defer m.uninstall()
 
 	// create pvc-1 folder and config
-	m.fs.MkdirAll(getVolumePath("pvc-1"), 0755)
+	m.fs.MkdirAll(getVolumePath(m, "pvc-1"), 0755)
 
 	volumeURL := EncodeBackupURL("", "pvc-1", mockDriverURL)
 	volumeInfo, err := InspectVolume(volumeURL)
@@ -189,7 +269,7 @@ func TestInspectVolume(t *testing.T) {
 	assert.Nil(volumeInfo)
 
 	// create pvc-1 config
-	afero.WriteFile(m.fs, getVolumeFilePath("pvc-1"),
+	afero.WriteFile(m.fs, getVolumeFilePath(m, "pvc-1"),
 		[]byte(`{"Name":"pvc-1","Size":"2147483648","CreatedTime":"2021-05-12T00:52:01Z","LastBackupName":"backup-3","LastBackupAt":"2021-05-17T05:31:01Z"}`), 0644)
 
 	// inspect backup volume config
@@ -211,7 +291,7 @@ func TestInspectBackup(t *testing.T) {
 	defer m.uninstall()
 
 	// create pvc-1 folder and config
-	m.fs.MkdirAll(getVolumePath("pvc-1"), 0755)
+	m.fs.MkdirAll(getVolumePath(m, "pvc-1"), 0755)
 
 	backupURL := EncodeBackupURL("backup-1", "pvc-1", mockDriverURL)
 	backupInfo, err := InspectBackup(backupURL)
@@ -219,27 +299,27 @@ func TestInspectBackup(t *testing.T) {
 	assert.Nil(backupInfo)
 
 	// create pvc-1 config
-	afero.WriteFile(m.fs, getVolumeFilePath("pvc-1"),
+	afero.WriteFile(m.fs, getVolumeFilePath(m, "pvc-1"),
 		[]byte(`{"Name":"pvc-1","Size":"2147483648","CreatedTime":"2021-05-12T00:52:01Z","LastBackupName":"backup-3","LastBackupAt":"2021-05-17T05:31:01Z"}`), 0644)
 
 	// create backups folder
-	m.fs.MkdirAll(getBackupPath("pvc-1"), 0755)
+	m.fs.MkdirAll(getBackupPath(m, "pvc-1"), 0755)
 
 	// inspect an invalid backup-1 config
-	afero.WriteFile(m.fs, getBackupConfigPath("backup-1", "pvc-1"), []byte(""), 0644)
+	afero.WriteFile(m.fs, getBackupConfigPath(m, "backup-1", "pvc-1"), []byte(""), 0644)
 	backupInfo, err = InspectBackup(backupURL)
 	assert.Error(err)
 	assert.Nil(backupInfo)
 
 	// create a in progress backup-1 config
-	afero.WriteFile(m.fs, getBackupConfigPath("backup-1", "pvc-1"),
+	afero.WriteFile(m.fs, getBackupConfigPath(m, "backup-1", "pvc-1"),
 		[]byte(`{"Name":"backup-1"}`), 0644)
 	backupInfo, err = InspectBackup(backupURL)
 	assert.Error(err)
 	assert.Nil(backupInfo)
 
 	// create a valid backup-1 config
-	afero.WriteFile(m.fs, getBackupConfigPath("backup-1", "pvc-1"),
+	afero.WriteFile(m.fs, getBackupConfigPath(m, "backup-1", "pvc-1"),
 		[]byte(`{"Name":"backup-1","VolumeName":"pvc-1","Size":"115343360","SnapshotName":"1eb35e75-73d8-4e8c-9761-3df6ec35ba9a","SnapshotCreatedAt":"2021-06-07T08:57:23Z","CreatedTime":"2021-06-07T08:57:25Z","Size":"115343360"}`), 0644)
 
 	// inspect backup-1 config
@@ -261,8 +341,8 @@ func BenchmarkBackupVolumeNames10ms32volumes(b *testing.B) {
 	// create 32 backup volumes
 	for i := 1; i <= 32; i++ {
 		pvc := fmt.Sprintf("pvc-%d", i)
-		m.fs.MkdirAll(getVolumePath(pvc), 0755)
-		afero.WriteFile(m.fs, getVolumeFilePath(pvc), []byte(fmt.Sprintf(`{"Name":%s}`, pvc)), 0644)
+		m.fs.MkdirAll(getVolumePath(m, pvc), 0755)
+		afero.WriteFile(m.fs, getVolumeFilePath(m, pvc), []byte(fmt.Sprintf(`{"Name":%s}`, pvc)), 0644)
 	}
 
 	for i := 0; i < b.N; i++ {
@@ -278,8 +358,8 @@ func BenchmarkBackupVolumeNames100ms32volumes(b *testing.B) {
 	// create 32 backup volumes
 	for i := 1; i <= 32; i++ {
 		pvc := fmt.Sprintf("pvc-%d", i)
-		m.fs.MkdirAll(getVolumePath(pvc), 0755)
-		afero.WriteFile(m.fs, getVolumeFilePath(pvc), []byte(fmt.Sprintf(`{"Name":%s}`, pvc)), 0644)
+		m.fs.MkdirAll(getVolumePath(m, pvc), 0755)
+		afero.WriteFile(m.fs, getVolumeFilePath(m, pvc), []byte(fmt.Sprintf(`{"Name":%s}`, pvc)), 0644)
 	}
 
 	for i := 0; i < b.N; i++ {
@@ -295,8 +375,8 @@ func BenchmarkBackupVolumeNames250ms32volumes(b *testing.B) {
 	// create 32 backup volumes
 	for i := 1; i <= 32; i++ {
 		pvc := fmt.Sprintf("pvc-%d", i)
-		m.fs.MkdirAll(getVolumePath(pvc), 0755)
-		afero.WriteFile(m.fs, getVolumeFilePath(pvc), []byte(fmt.Sprintf(`{"Name":%s}`, pvc)), 0644)
+		m.fs.MkdirAll(getVolumePath(m, pvc), 0755)
+		afero.WriteFile(m.fs, getVolumeFilePath(m, pvc), []byte(fmt.Sprintf(`{"Name":%s}`, pvc)), 0644)
 	}
 
 	for i := 0; i < b.N; i++ {
@@ -312,8 +392,8 @@ func BenchmarkBackupVolumeNames500ms32volumes(b *testing.B) {
 	// create 32 backup volumes
 	for i := 1; i <= 32; i++ {
 		pvc := fmt.Sprintf("pvc-%d", i)
-		m.fs.MkdirAll(getVolumePath(pvc), 0755)
-		afero.WriteFile(m.fs, getVolumeFilePath(pvc), []byte(fmt.Sprintf(`{"Name":%s}`, pvc)), 0644)
+		m.fs.MkdirAll(getVolumePath(m, pvc), 0755)
+		afero.WriteFile(m.fs, getVolumeFilePath(m, pvc), []byte(fmt.Sprintf(`{"Name":%s}`, pvc)), 0644)
 	}
 
 	for i := 0; i < b.N; i++ {
@@ -321,19 +401,77 @@ func BenchmarkBackupVolumeNames500ms32volumes(b *testing.B) {
 	}
 }
 
+// pagedMockStoreDriver lists the entries page by page, the continuation token is the index of the next entry
+type pagedMockStoreDriver struct {
+	*mockStoreDriver
+	pages int
+}
+
+func (m *pagedMockStoreDriver) ListPage(listPath, continuationToken string, limit int) ([]string, string, error) {
+	entries, err := m.List(listPath)
+	if err != nil {
+		return nil, "", err
+	}
+	m.pages++
+
+	start := 0
+	if continuationToken != "" {
+		start, _ = strconv.Atoi(continuationToken)
+	}
+	end := start + limit
+	if end >= len(entries) {
+		return entries[start:], "", nil
+	}
+	return entries[start:end], strconv.Itoa(end), nil
+}
+
+func TestListPages(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &mockStoreDriver{}
+	m.Init()
+	defer m.uninstall()
+
+	blockPath := getBlockPath(m, "pvc-1")
+	m.fs.MkdirAll(blockPath, 0755)
+	for i := 0; i < DEFAULT_LIST_PAGE_SIZE*2+1; i++ {
+		afero.WriteFile(m.fs, filepath.Join(blockPath, fmt.Sprintf("%05d%v", i, BLK_SUFFIX)), []byte{}, 0644)
+	}
+
+	paged := &pagedMockStoreDriver{mockStoreDriver: m}
+	count := 0
+	err := listPages(paged, blockPath, func(entries []string) error {
+		count += len(entries)
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal(DEFAULT_LIST_PAGE_SIZE*2+1, count)
+	assert.Equal(3, paged.pages)
+
+	// the driver without paged listing gets the whole listing at once
+	calls := 0
+	err = listPages(m, blockPath, func(entries []string) error {
+		calls++
+		assert.Len(entries, DEFAULT_LIST_PAGE_SIZE*2+1)
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal(1, calls)
+}
+
 func BenchmarkListBackupVolumeBackups10ms(b *testing.B) {
 	m := &mockStoreDriver{delay: 10 * time.Millisecond}
 	m.Init()
 	defer m.uninstall()
 
 	// create pvc-1 config
-	m.fs.MkdirAll(getBackupPath("pvc-1"), 0755)
-	afero.WriteFile(m.fs, getVolumeFilePath("pvc-1"), []byte(`{"Name":"pvc-1"}`), 0644)
+	m.fs.MkdirAll(getBackupPath(m, "pvc-1"), 0755)
+	afero.WriteFile(m.fs, getVolumeFilePath(m, "pvc-1"), []byte(`{"Name":"pvc-1"}`), 0644)
 
 	// create 100 backups
 	for i := 1; i <= 100; i++ {
 		backup := fmt.Sprintf("backup-%d", i)
-		afero.WriteFile(m.fs, getBackupConfigPath(backup, "pvc-1"),
+		afero.WriteFile(m.fs, getBackupConfigPath(m, backup, "pvc-1"),
 			[]byte(fmt.Sprintf(`{"Name":"%s","CreatedTime":"%s"}`, backup, time.Now().String())), 0644)
 	}
 
@@ -348,13 +486,13 @@ func BenchmarkListBackupVolumeBackups100ms(b *testing.B) {
 	defer m.uninstall()
 
 	// create pvc-1 config
-	m.fs.MkdirAll(getBackupPath("pvc-1"), 0755)
-	afero.WriteFile(m.fs, getVolumeFilePath("pvc-1"), []byte(`{"Name":"pvc-1"}`), 0644)
+	m.fs.MkdirAll(getBackupPath(m, "pvc-1"), 0755)
+	afero.WriteFile(m.fs, getVolumeFilePath(m, "pvc-1"), []byte(`{"Name":"pvc-1"}`), 0644)
 
 	// create 100 backups
 	for i := 1; i <= 100; i++ {
 		backup := fmt.Sprintf("backup-%d", i)
-		afero.WriteFile(m.fs, getBackupConfigPath(backup, "pvc-1"),
+		afero.WriteFile(m.fs, getBackupConfigPath(m, backup, "pvc-1"),
 			[]byte(fmt.Sprintf(`{"Name":"%s","CreatedTime":"%s"}`, backup, time.Now().String())), 0644)
 	}
 
@@ -369,13 +507,13 @@ func BenchmarkListBackupVolumeBackups250ms(b *testing.B) {
 	defer m.uninstall()
 
 	// create pvc-1 config
-	m.fs.MkdirAll(getBackupPath("pvc-1"), 0755)
-	afero.WriteFile(m.fs, getVolumeFilePath("pvc-1"), []byte(`{"Name":"pvc-1"}`), 0644)
+	m.fs.MkdirAll(getBackupPath(m, "pvc-1"), 0755)
+	afero.WriteFile(m.fs, getVolumeFilePath(m, "pvc-1"), []byte(`{"Name":"pvc-1"}`), 0644)
 
 	// create 100 backups
 	for i := 1; i <= 100; i++ {
 		backup := fmt.Sprintf("backup-%d", i)
-		afero.WriteFile(m.fs, getBackupConfigPath(backup, "pvc-1"),
+		afero.WriteFile(m.fs, getBackupConfigPath(m, backup, "pvc-1"),
 			[]byte(fmt.Sprintf(`{"Name":"%s","CreatedTime":"%s"}`, backup, time.Now().String())), 0644)
 	}
 
@@ -390,13 +528,13 @@ func BenchmarkListBackupVolumeBackups500ms(b *testing.B) {
 	defer m.uninstall()
 
 	// create pvc-1 config
-	m.fs.MkdirAll(getBackupPath("pvc-1"), 0755)
-	afero.WriteFile(m.fs, getVolumeFilePath("pvc-1"), []byte(`{"Name":"pvc-1"}`), 0644)
+	m.fs.MkdirAll(getBackupPath(m, "pvc-1"), 0755)
+	afero.WriteFile(m.fs, getVolumeFilePath(m, "pvc-1"), []byte(`{"Name":"pvc-1"}`), 0644)
 
 	// create 100 backups
 	for i := 1; i <= 100; i++ {
 		backup := fmt.Sprintf("backup-%d", i)
-		afero.WriteFile(m.fs, getBackupConfigPath(backup, "pvc-1"),
+		afero.WriteFile(m.fs, getBackupConfigPath(m, backup, "pvc-1"),
 			[]byte(fmt.Sprintf(`{"Name":"%s","CreatedTime":"%s"}`, backup, time.Now().String())), 0644)
 	}
 
@@ -404,3 +542,48 @@ func BenchmarkListBackupVolumeBackups500ms(b *testing.B) {
 		List("pvc-1", mockDriverURL, false)
 	}
 }
+
+func TestInspectVolumeChain(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	assert.NoError(saveVolume(m, &Volume{Name: "pvc-1", Size: 8 * DEFAULT_BLOCK_SIZE, BlockCount: 4}))
+	backups := []*Backup{
+		{Name: "backup-1", CreatedTime: "2026-01-10T00:00:00Z"},
+		{Name: "backup-2", CreatedTime: "2026-01-20T00:00:00Z", IsIncremental: true},
+		{Name: "backup-3", CreatedTime: "2026-02-01T00:00:00Z", IsIncremental: true},
+		{Name: "backup-4", CreatedTime: "2026-02-10T00:00:00Z", IsIncremental: true, ChainBase: true},
+		{Name: "backup-5", CreatedTime: "2026-03-01T00:00:00Z", IsIncremental: true},
+		{Name: "backup-6", IsIncremental: true},
+	}
+	for i, backup := range backups {
+		backup.VolumeName = "pvc-1"
+		if i < 3 {
+			backup.CompressionStats = &CompressionStats{UncompressedBytes: DEFAULT_BLOCK_SIZE,
+				CompressedBytes: DEFAULT_BLOCK_SIZE / 2}
+		}
+		assert.NoError(saveBackup(m, backup))
+	}
+
+	// the chain isn't inspected by default, which reads all the backups
+	volumeInfo, err := InspectVolume(EncodeBackupURL("", "pvc-1", mockDriverURL))
+	assert.NoError(err)
+	assert.Equal(int64(4*DEFAULT_BLOCK_SIZE), volumeInfo.DataStored)
+	assert.Zero(volumeInfo.ChainDepth)
+	assert.Empty(volumeInfo.LastChainBaseAt)
+	assert.Zero(volumeInfo.PhysicalSize)
+	assert.Nil(volumeInfo.MonthlyGrowth)
+
+	// the in progress backup isn't counted
+	volumeInfo, err = InspectVolumeChain(EncodeBackupURL("", "pvc-1", mockDriverURL))
+	assert.NoError(err)
+	assert.Equal(2, volumeInfo.ChainDepth)
+	assert.Equal("2026-02-10T00:00:00Z", volumeInfo.LastChainBaseAt)
+	assert.Equal(int64(4*DEFAULT_BLOCK_SIZE), volumeInfo.DataStored)
+	assert.Equal(int64(2*DEFAULT_BLOCK_SIZE), volumeInfo.PhysicalSize)
+	assert.Equal(map[string]int64{"2026-01": DEFAULT_BLOCK_SIZE, "2026-02": DEFAULT_BLOCK_SIZE / 2},
+		volumeInfo.MonthlyGrowth)
+}
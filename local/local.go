@@ -0,0 +1,198 @@
+package local
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/fsops"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "local"})
+)
+
+// BackupStoreDriver writes to a locally mounted path. Unlike vfs, the data and the parent directories
+// are fsynced and the files are atomically renamed into place, so a crash never leaves partial files.
+type BackupStoreDriver struct {
+	destURL string
+	path    string
+
+	*fsops.FileSystemOperator
+}
+
+const (
+	KIND       = "local"
+	KIND_ALIAS = "file"
+)
+
+func init() {
+	for _, kind := range []string{KIND, KIND_ALIAS} {
+		if err := backupstore.RegisterDriver(kind, initFunc); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
+	b := &BackupStoreDriver{}
+	b.FileSystemOperator = fsops.NewFileSystemOperator(b)
+
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != KIND && u.Scheme != KIND_ALIAS {
+		return nil, fmt.Errorf("BUG: Why dispatch %v to %v?", u.Scheme, KIND)
+	}
+
+	if u.Host != "" {
+		return nil, fmt.Errorf("local path must follow: %v:///path/ format", u.Scheme)
+	}
+
+	b.path = u.Path
+	if b.path == "" {
+		return nil, fmt.Errorf("cannot find local path")
+	}
+	if st, err := os.Stat(b.path); err != nil || !st.IsDir() {
+		return nil, fmt.Errorf("local path %v doesn't exist or is not a directory", b.path)
+	}
+
+	b.destURL = u.Scheme + "://" + b.path
+	log.Infof("Loaded driver for %v", b.destURL)
+	return b, nil
+}
+
+func (l *BackupStoreDriver) LocalPath(path string) string {
+	return filepath.Join(l.path, path)
+}
+
+func (l *BackupStoreDriver) Kind() string {
+	return KIND
+}
+
+func (l *BackupStoreDriver) GetURL() string {
+	return l.destURL
+}
+
+func (l *BackupStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	return l.writeFile(dst, rs)
+}
+
+func (l *BackupStoreDriver) Upload(src, dst string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return l.writeFile(dst, file)
+}
+
+func (l *BackupStoreDriver) Remove(path string) error {
+	if err := l.FileSystemOperator.Remove(path); err != nil {
+		return err
+	}
+	// The upper level directories may have been cleaned up as well, persist the nearest existing one
+	dir := filepath.Dir(l.LocalPath(path))
+	for dir != l.path && dir != "/" {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return syncDir(dir)
+}
+
+// writeFile writes the data to a temporary file in the destination directory, fsyncs it, renames it
+// to the destination and fsyncs the directory. An anonymous O_TMPFILE is used if supported, so
+// no temporary file is left behind if the process crashes in the middle of the write.
+func (l *BackupStoreDriver) writeFile(dst string, r io.Reader) (err error) {
+	dstPath := l.LocalPath(dst)
+	dir := filepath.Dir(dstPath)
+	if err := mkdirAllSync(dir); err != nil {
+		return errors.Wrapf(err, "failed to create directory %v", dir)
+	}
+
+	// we append the timestamp to the tmp files so that we should never have 2 backups using the same tmp file
+	tmpPath := dstPath + ".tmp" + "." + strconv.FormatInt(time.Now().UTC().UnixNano(), 10)
+
+	file, anonymous, err := openTmpFile(dir, tmpPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create temporary file for %v", dstPath)
+	}
+	linked := !anonymous
+	defer func() {
+		if file != nil {
+			_ = file.Close()
+		}
+		if err != nil && linked {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err = io.Copy(file, r); err != nil {
+		return errors.Wrapf(err, "failed to write %v", dstPath)
+	}
+	if err = file.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to sync %v", dstPath)
+	}
+	if anonymous {
+		if err = linkTmpFile(file, tmpPath); err != nil {
+			return errors.Wrapf(err, "failed to link temporary file for %v", dstPath)
+		}
+		linked = true
+	}
+	err = file.Close()
+	file = nil
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpPath, dstPath); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// mkdirAllSync creates the directory and the missing parents, the parent of each created directory is
+// fsynced so the new directory entries are persisted
+func mkdirAllSync(dir string) error {
+	if st, err := os.Stat(dir); err == nil {
+		if !st.IsDir() {
+			return fmt.Errorf("%v is not a directory", dir)
+		}
+		return nil
+	}
+
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		if err := mkdirAllSync(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, os.ModeDir|0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return syncDir(parent)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to sync directory %v", dir)
+	}
+	return nil
+}
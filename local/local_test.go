@@ -0,0 +1,47 @@
+package local
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteAndRemove(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	driver, err := initFunc("file://" + dir)
+	assert.NoError(err)
+	assert.Equal("file://"+dir, driver.GetURL())
+
+	_, err = initFunc("local://" + filepath.Join(dir, "nonexistent"))
+	assert.Error(err)
+
+	dst := "backupstore/volumes/ab/cd/vol/volume.cfg"
+	assert.NoError(driver.Write(dst, bytes.NewReader([]byte("first"))))
+	assert.NoError(driver.Write(dst, bytes.NewReader([]byte("second"))))
+
+	rc, err := driver.Read(dst)
+	assert.NoError(err)
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	assert.NoError(err)
+	assert.Equal("second", string(data))
+
+	// no temporary file should be left behind
+	entries, err := os.ReadDir(filepath.Join(dir, filepath.Dir(dst)))
+	assert.NoError(err)
+	assert.Len(entries, 1)
+
+	src := filepath.Join(t.TempDir(), "upload")
+	assert.NoError(os.WriteFile(src, []byte("uploaded"), 0600))
+	assert.NoError(driver.Upload(src, "backupstore/upload"))
+	assert.Equal(int64(len("uploaded")), driver.FileSize("backupstore/upload"))
+
+	assert.NoError(driver.Remove(dst))
+	assert.False(driver.FileExists(dst))
+}
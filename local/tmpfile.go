@@ -0,0 +1,30 @@
+package local
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openTmpFile opens an anonymous O_TMPFILE in the directory. It falls back to a regular file at tmpPath
+// if the filesystem doesn't support O_TMPFILE, e.g. some FUSE or network filesystems.
+func openTmpFile(dir, tmpPath string) (file *os.File, anonymous bool, err error) {
+	file, err = os.OpenFile(dir, os.O_WRONLY|unix.O_TMPFILE, 0600)
+	if err == nil {
+		return file, true, nil
+	}
+	log.WithError(err).Debugf("O_TMPFILE is not supported in %v, falling back to regular temporary file", dir)
+
+	file, err = os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	return file, false, nil
+}
+
+// linkTmpFile gives the anonymous file a name so it can be atomically renamed to the destination
+func linkTmpFile(file *os.File, tmpPath string) error {
+	procPath := fmt.Sprintf("/proc/self/fd/%d", file.Fd())
+	return unix.Linkat(unix.AT_FDCWD, procPath, unix.AT_FDCWD, tmpPath, unix.AT_SYMLINK_FOLLOW)
+}
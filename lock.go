@@ -1,7 +1,9 @@
 package backupstore
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -20,6 +22,7 @@ const (
 	LOCK_DURATION         = time.Second * 150
 	LOCK_REFRESH_INTERVAL = time.Second * 60
 	LOCK_CHECK_WAIT_TIME  = time.Second * 2
+	LOCK_RETRY_INTERVAL   = time.Second * 5
 )
 
 type LockType int
@@ -30,26 +33,85 @@ const RESTORE_LOCK LockType = 1
 const DELETION_LOCK LockType = 2
 
 type FileLock struct {
-	Name       string
-	Type       LockType
-	Acquired   bool
+	Name     string
+	Type     LockType
+	Acquired bool
+	// Owner, Operation and CreatedTime are only used for the diagnostics of the blocked locks
+	Owner       string `json:",omitempty"`
+	Operation   string `json:",omitempty"`
+	CreatedTime string `json:",omitempty"`
+
 	driver     BackupStoreDriver
 	volume     string
 	count      int32
 	serverTime time.Time // UTC time
 	keepAlive  chan struct{}
 	mutex      sync.Mutex
+	// released is set if the lock has been released by the watchdog, the owner's unlock is a no-op then
+	released bool
 }
 
 func New(driver BackupStoreDriver, volumeName string, lockType LockType) (*FileLock, error) {
+	owner, _ := os.Hostname()
 	return &FileLock{driver: driver, volume: volumeName,
-		Type: lockType, Name: util.GenerateName(LOCK_PREFIX)}, nil
+		Type: lockType, Name: util.GenerateName(LOCK_PREFIX),
+		Owner: owner, Operation: getLockOperation(lockType), CreatedTime: util.Now()}, nil
+}
+
+func getLockOperation(lockType LockType) string {
+	switch lockType {
+	case BACKUP_LOCK:
+		return "backup/restore"
+	case DELETION_LOCK:
+		return "deletion"
+	default:
+		return "untyped"
+	}
+}
+
+// LockHolder describes a lock which blocks the acquisition of another lock
+type LockHolder struct {
+	Name      string
+	Type      LockType
+	Acquired  bool
+	Owner     string
+	Operation string
+	Since     string
+}
+
+// LockBlockedError is returned when the lock cannot be acquired due to the conflicting locks
+type LockBlockedError struct {
+	VolumeName string
+	LockFile   string
+	Type       LockType
+	// QueuePosition is the number of the conflicting locks that have priority over the lock
+	QueuePosition int
+	Holders       []LockHolder
+}
+
+func (e *LockBlockedError) Error() string {
+	holders := []string{}
+	for _, h := range e.Holders {
+		state := "pending"
+		if h.Acquired {
+			state = "acquired"
+		}
+		holders = append(holders, fmt.Sprintf("%v (%v %v lock by %v since %v)", h.Name, state, h.Operation, h.Owner, h.Since))
+	}
+	return fmt.Sprintf("failed lock %v type %v acquisition: queue position %v, blocked by %v",
+		e.LockFile, e.Type, e.QueuePosition, strings.Join(holders, ", "))
+}
+
+// IsLockBlockedError checks if the error is caused by the conflicting locks
+func IsLockBlockedError(err error) bool {
+	var blockedErr *LockBlockedError
+	return errors.As(err, &blockedErr)
 }
 
 // isExpired checks whether the current lock is expired
 func (lock *FileLock) isExpired() bool {
-	// server time is always in UTC
-	isExpired := time.Now().UTC().Sub(lock.serverTime) > LOCK_DURATION
+	// server time is always in UTC, the local time is corrected by the detected clock skew of the backupstore
+	isExpired := serverNow(lock.driver).Sub(lock.serverTime) > LOCK_DURATION
 	return isExpired
 }
 
@@ -58,23 +120,51 @@ func (lock *FileLock) String() string {
 		lock.volume, lock.Name, lock.Type, lock.Acquired, lock.serverTime)
 }
 
-func (lock *FileLock) canAcquire() bool {
-	canAcquire := true
+// getBlockingLocks returns the conflicting locks which have priority over the lock
+func (lock *FileLock) getBlockingLocks() []*FileLock {
 	locks := getLocksForVolume(lock.volume, lock.driver)
-	file := getLockFilePath(lock.volume, lock.Name)
+	file := getLockFilePath(lock.driver, lock.volume, lock.Name)
 	log.WithField("lock", lock).Infof("Trying to acquire lock %v", file)
 	log.Infof("backupstore volume %v contains locks %v", lock.volume, locks)
 
+	blockingLocks := []*FileLock{}
 	for _, serverLock := range locks {
 		serverLockHasDifferentType := serverLock.Type != lock.Type
 		serverLockHasPriority := compareLocks(serverLock, lock) < 0
 		if serverLockHasDifferentType && serverLockHasPriority && !serverLock.isExpired() {
-			canAcquire = false
-			break
+			blockingLocks = append(blockingLocks, serverLock)
 		}
 	}
 
-	return canAcquire
+	return blockingLocks
+}
+
+func (lock *FileLock) newLockBlockedError(blockingLocks []*FileLock) *LockBlockedError {
+	err := &LockBlockedError{
+		VolumeName:    lock.volume,
+		LockFile:      getLockFilePath(lock.driver, lock.volume, lock.Name),
+		Type:          lock.Type,
+		QueuePosition: len(blockingLocks),
+	}
+	for _, blockingLock := range blockingLocks {
+		since := blockingLock.CreatedTime
+		if since == "" {
+			since = blockingLock.serverTime.Format(time.RFC3339)
+		}
+		operation := blockingLock.Operation
+		if operation == "" {
+			operation = getLockOperation(blockingLock.Type)
+		}
+		err.Holders = append(err.Holders, LockHolder{
+			Name:      blockingLock.Name,
+			Type:      blockingLock.Type,
+			Acquired:  blockingLock.Acquired,
+			Owner:     blockingLock.Owner,
+			Operation: operation,
+			Since:     since,
+		})
+	}
+	return err
 }
 
 func (lock *FileLock) Lock() error {
@@ -104,29 +194,49 @@ func (lock *FileLock) Lock() error {
 	// we only try to acquire once, since backup operations generally take a long time
 	// there is no point in trying to wait for lock acquisition, better to throw an error
 	// and let the calling code retry with an exponential backoff.
-	if !lock.canAcquire() {
-		file := getLockFilePath(lock.volume, lock.Name)
+	if blockingLocks := lock.getBlockingLocks(); len(blockingLocks) != 0 {
 		_ = removeLock(lock)
-		return fmt.Errorf("failed lock %v type %v acquisition", file, lock.Type)
+		return lock.newLockBlockedError(blockingLocks)
 	}
 
-	file := getLockFilePath(lock.volume, lock.Name)
+	return lock.acquire()
+}
+
+// lockUncontended acquires the lock without waiting for the conflicting locks. It's only safe if no other lock
+// of the volume can exist, e.g. the caller has just created the volume, and the caller must verify it after.
+func (lock *FileLock) lockUncontended() error {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+	if lock.Acquired {
+		atomic.AddInt32(&lock.count, 1)
+		_ = saveLock(lock)
+		return nil
+	}
+	return lock.acquire()
+}
+
+// acquire marks the lock acquired on the backupstore and starts refreshing it, the caller must hold the mutex
+func (lock *FileLock) acquire() error {
+	file := getLockFilePath(lock.driver, lock.volume, lock.Name)
 	log.Infof("Acquired lock %v type %v on backupstore", file, lock.Type)
 	lock.Acquired = true
+	lock.released = false
 	atomic.AddInt32(&lock.count, 1)
 	if err := saveLock(lock); err != nil {
 		_ = removeLock(lock)
 		return errors.Wrapf(err, "failed to store updated lock %v type %v after acquisition", file, lock.Type)
 	}
+	trackLock(lock)
 
 	// enable lock refresh
-	lock.keepAlive = make(chan struct{})
+	keepAlive := make(chan struct{})
+	lock.keepAlive = keepAlive
 	go func() {
 		refreshTimer := time.NewTicker(LOCK_REFRESH_INTERVAL)
 		defer refreshTimer.Stop()
 		for {
 			select {
-			case <-lock.keepAlive:
+			case <-keepAlive:
 				return
 			case <-refreshTimer.C:
 				lock.mutex.Lock()
@@ -144,14 +254,62 @@ func (lock *FileLock) Lock() error {
 	return nil
 }
 
+// TryLock retries acquiring the lock until it is acquired or the context is done. If the lock cannot be
+// acquired in time, the returned error wraps the *LockBlockedError of the last attempt.
+func (lock *FileLock) TryLock(ctx context.Context) error {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+	if lock.Acquired {
+		atomic.AddInt32(&lock.count, 1)
+		_ = saveLock(lock)
+		return nil
+	}
+
+	// the lock is stored once and keeps its place in the queue while waiting, see Lock
+	if err := saveLock(lock); err != nil {
+		return err
+	}
+	time.Sleep(LOCK_CHECK_WAIT_TIME)
+
+	for {
+		blockingLocks := lock.getBlockingLocks()
+		if len(blockingLocks) == 0 {
+			return lock.acquire()
+		}
+
+		err := lock.newLockBlockedError(blockingLocks)
+		log.WithError(err).Infof("Waiting for lock acquisition of volume %v", lock.volume)
+		select {
+		case <-ctx.Done():
+			_ = removeLock(lock)
+			return errors.Wrapf(err, "failed to acquire lock before %v", ctx.Err())
+		case <-time.After(LOCK_RETRY_INTERVAL):
+		}
+
+		// the expired lock is ignored by the other clients, it's only stored again then since storing it
+		// earlier would give up its place in the queue
+		if lock.isExpired() {
+			if err := saveLock(lock); err != nil {
+				_ = removeLock(lock)
+				return err
+			}
+		}
+	}
+}
+
 func (lock *FileLock) Unlock() error {
 	lock.mutex.Lock()
 	defer lock.mutex.Unlock()
+	if lock.released {
+		return nil
+	}
 	if atomic.AddInt32(&lock.count, -1) <= 0 {
 		lock.Acquired = false
 		if lock.keepAlive != nil {
 			close(lock.keepAlive)
+			lock.keepAlive = nil
 		}
+		untrackLock(lock)
 		if err := removeLock(lock); err != nil {
 			return err
 		}
@@ -161,9 +319,27 @@ func (lock *FileLock) Unlock() error {
 	return nil
 }
 
+// forceRelease releases the lock regardless of the nested acquisitions, used by the watchdog for the stalled locks
+func (lock *FileLock) forceRelease() error {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+	if !lock.Acquired {
+		return nil
+	}
+	lock.Acquired = false
+	lock.released = true
+	atomic.StoreInt32(&lock.count, 0)
+	if lock.keepAlive != nil {
+		close(lock.keepAlive)
+		lock.keepAlive = nil
+	}
+	untrackLock(lock)
+	return removeLock(lock)
+}
+
 func loadLock(volumeName string, name string, driver BackupStoreDriver) (*FileLock, error) {
-	lock := &FileLock{}
-	file := getLockFilePath(volumeName, name)
+	lock := &FileLock{driver: driver, volume: volumeName}
+	file := getLockFilePath(driver, volumeName, name)
 	if err := LoadConfigInBackupStore(driver, file, lock); err != nil {
 		return nil, err
 	}
@@ -173,7 +349,10 @@ func loadLock(volumeName string, name string, driver BackupStoreDriver) (*FileLo
 }
 
 func removeLock(lock *FileLock) error {
-	file := getLockFilePath(lock.volume, lock.Name)
+	if isReadOnlyDriver(lock.driver) {
+		return nil
+	}
+	file := getLockFilePath(lock.driver, lock.volume, lock.Name)
 	if err := lock.driver.Remove(file); err != nil {
 		return err
 	}
@@ -182,11 +361,19 @@ func removeLock(lock *FileLock) error {
 }
 
 func saveLock(lock *FileLock) error {
-	file := getLockFilePath(lock.volume, lock.Name)
+	// the lock of the read-only backup target is only held locally, the locks of the other clients still block it
+	if isReadOnlyDriver(lock.driver) {
+		lock.serverTime = serverNow(lock.driver)
+		return nil
+	}
+	file := getLockFilePath(lock.driver, lock.volume, lock.Name)
+	before := clockSkewNow()
 	if err := SaveConfigInBackupStore(lock.driver, file, lock); err != nil {
 		return err
 	}
+	after := clockSkewNow()
 	lock.serverTime = lock.driver.FileTime(file)
+	detectClockSkew(lock.driver, file, before, after, lock.serverTime)
 	log.Infof("Stored lock %v type %v on backupstore", file, lock.Type)
 	return nil
 }
@@ -210,7 +397,7 @@ func compareLocks(a *FileLock, b *FileLock) int {
 }
 
 func getLockNamesForVolume(volumeName string, driver BackupStoreDriver) []string {
-	fileList, err := driver.List(getLockPath(volumeName))
+	fileList, err := driver.List(getLockPath(driver, volumeName))
 	if err != nil {
 		// path doesn't exist
 		return []string{}
@@ -225,7 +412,7 @@ func getLocksForVolume(volumeName string, driver BackupStoreDriver) []*FileLock
 	for _, name := range names {
 		lock, err := loadLock(volumeName, name, driver)
 		if err != nil {
-			file := getLockFilePath(volumeName, name)
+			file := getLockFilePath(driver, volumeName, name)
 			log.WithError(err).Warnf("Failed to load lock %v on backupstore", file)
 			continue
 		}
@@ -235,12 +422,12 @@ func getLocksForVolume(volumeName string, driver BackupStoreDriver) []*FileLock
 	return locks
 }
 
-func getLockPath(volumeName string) string {
-	return filepath.Join(getVolumePath(volumeName), LOCKS_DIRECTORY) + "/"
+func getLockPath(driver BackupStoreDriver, volumeName string) string {
+	return filepath.Join(getVolumePath(driver, volumeName), LOCKS_DIRECTORY) + "/"
 }
 
-func getLockFilePath(volumeName string, name string) string {
-	path := getLockPath(volumeName)
+func getLockFilePath(driver BackupStoreDriver, volumeName string, name string) string {
+	path := getLockPath(driver, volumeName)
 	fileName := name + LOCK_SUFFIX
 	return filepath.Join(path, fileName)
 }
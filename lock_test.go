@@ -0,0 +1,147 @@
+package backupstore
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// lockCountingMockStoreDriver counts the writes of the lock files
+type lockCountingMockStoreDriver struct {
+	*writableMockStoreDriver
+	lockWrites int32
+}
+
+func (m *lockCountingMockStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	if strings.HasSuffix(dst, LOCK_SUFFIX) {
+		atomic.AddInt32(&m.lockWrites, 1)
+	}
+	return m.writableMockStoreDriver.Write(dst, rs)
+}
+
+func TestLockBlocked(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	holder, err := New(m, "pvc-1", DELETION_LOCK)
+	assert.NoError(err)
+	hostname, _ := os.Hostname()
+	assert.Equal(hostname, holder.Owner)
+	assert.Equal("deletion", holder.Operation)
+	assert.NotEmpty(holder.CreatedTime)
+	assert.NoError(holder.lockUncontended())
+	defer holder.Unlock()
+
+	lock, err := New(m, "pvc-1", BACKUP_LOCK)
+	assert.NoError(err)
+	assert.Equal("backup/restore", lock.Operation)
+	err = lock.Lock()
+	assert.True(IsLockBlockedError(err))
+	assert.False(lock.Acquired)
+	assert.False(m.FileExists(getLockFilePath(m, "pvc-1", lock.Name)))
+
+	blockedErr := &LockBlockedError{}
+	assert.True(errors.As(err, &blockedErr))
+	assert.Equal("pvc-1", blockedErr.VolumeName)
+	assert.Equal(BACKUP_LOCK, blockedErr.Type)
+	assert.Equal(1, blockedErr.QueuePosition)
+	assert.Len(blockedErr.Holders, 1)
+	assert.Equal(LockHolder{
+		Name:      holder.Name,
+		Type:      DELETION_LOCK,
+		Acquired:  true,
+		Owner:     hostname,
+		Operation: "deletion",
+		Since:     holder.CreatedTime,
+	}, blockedErr.Holders[0])
+	assert.Contains(err.Error(), "acquired deletion lock by "+hostname)
+
+	// the lock of the same type doesn't conflict
+	shared, err := New(m, "pvc-1", DELETION_LOCK)
+	assert.NoError(err)
+	assert.NoError(shared.Lock())
+	assert.NoError(shared.Unlock())
+}
+
+func TestLockExpired(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	// the lock left by a crashed client isn't refreshed anymore
+	stale, err := New(m, "pvc-1", DELETION_LOCK)
+	assert.NoError(err)
+	stale.Acquired = true
+	assert.NoError(saveLock(stale))
+	staleTime := time.Now().Add(-2 * LOCK_DURATION)
+	assert.NoError(m.fs.Chtimes(getLockFilePath(m, "pvc-1", stale.Name), staleTime, staleTime))
+
+	lock, err := New(m, "pvc-1", BACKUP_LOCK)
+	assert.NoError(err)
+	assert.NoError(lock.Lock())
+	assert.True(lock.Acquired)
+	assert.NoError(lock.Unlock())
+
+	lock, err = New(m, "pvc-1", BACKUP_LOCK)
+	assert.NoError(err)
+	assert.NoError(lock.TryLock(context.Background()))
+	assert.True(lock.Acquired)
+	assert.NoError(lock.Unlock())
+}
+
+func TestTryLock(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &lockCountingMockStoreDriver{writableMockStoreDriver: &writableMockStoreDriver{&mockStoreDriver{}}}
+	m.Init()
+	defer m.uninstall()
+
+	holder, err := New(m, "pvc-1", DELETION_LOCK)
+	assert.NoError(err)
+	assert.NoError(holder.lockUncontended())
+
+	// the contended lock isn't acquired before the deadline, and its lock file is removed
+	lock, err := New(m, "pvc-1", BACKUP_LOCK)
+	assert.NoError(err)
+	atomic.StoreInt32(&m.lockWrites, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), LOCK_CHECK_WAIT_TIME+time.Second)
+	err = lock.TryLock(ctx)
+	cancel()
+	assert.True(IsLockBlockedError(err))
+	assert.Contains(err.Error(), context.DeadlineExceeded.Error())
+	assert.False(lock.Acquired)
+	assert.False(m.FileExists(getLockFilePath(m, "pvc-1", lock.Name)))
+	assert.Equal(int32(1), atomic.LoadInt32(&m.lockWrites))
+
+	// the waiting lock is acquired once the holder releases it, without storing the lock file on every retry
+	lock, err = New(m, "pvc-1", BACKUP_LOCK)
+	assert.NoError(err)
+	atomic.StoreInt32(&m.lockWrites, 0)
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		done <- lock.TryLock(ctx)
+	}()
+	time.Sleep(LOCK_CHECK_WAIT_TIME + LOCK_RETRY_INTERVAL)
+	assert.Equal(int32(1), atomic.LoadInt32(&m.lockWrites))
+	assert.NoError(holder.Unlock())
+
+	assert.NoError(<-done)
+	assert.True(lock.Acquired)
+	// stored once while waiting and once more on the acquisition
+	assert.Equal(int32(2), atomic.LoadInt32(&m.lockWrites))
+	assert.NoError(lock.Unlock())
+}
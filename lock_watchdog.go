@@ -0,0 +1,202 @@
+package backupstore
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+)
+
+const (
+	// DEFAULT_LOCK_STALL_THRESHOLD is how long a lock can be held without progress before it's reported as stalled
+	DEFAULT_LOCK_STALL_THRESHOLD = 30 * time.Minute
+	// DEFAULT_LOCK_WATCHDOG_INTERVAL is the interval the watchdog checks the held locks at
+	DEFAULT_LOCK_WATCHDOG_INTERVAL = time.Minute
+)
+
+// LockWatchdogConfig configures the watchdog of the locks held by this process
+type LockWatchdogConfig struct {
+	// StallThreshold defaults to DEFAULT_LOCK_STALL_THRESHOLD
+	StallThreshold time.Duration
+	// CheckInterval defaults to DEFAULT_LOCK_WATCHDOG_INTERVAL
+	CheckInterval time.Duration
+	// AutoRelease releases the stalled locks, so a wedged backup or restore doesn't block the other operations
+	// of the volume. The wedged operation keeps running without the lock, so it should be cancelled separately.
+	AutoRelease bool
+}
+
+// HeldLock is the state of a lock held by this process
+type HeldLock struct {
+	Name       string
+	VolumeName string
+	DestURL    string
+	Type       LockType
+	Operation  string
+	AcquiredAt time.Time
+	// LastProgressAt is the last time the operation holding the lock made progress
+	LastProgressAt time.Time
+	// Stalled is set once the lock has been held longer than the stall threshold without progress
+	Stalled bool
+}
+
+var (
+	heldLocksLock sync.Mutex
+	// heldLocks tracks the locks acquired by this process
+	heldLocks = map[*FileLock]*HeldLock{}
+
+	lockWatchdogLock sync.Mutex
+	lockWatchdogStop chan struct{}
+)
+
+// SetLockWatchdog starts the watchdog of the locks held by this process, or stops it if config is nil. The
+// watchdog warns about the locks held longer than the stall threshold without progress, and releases them if
+// AutoRelease is set. Both are recorded by the LockStalled and LockReleased events.
+func SetLockWatchdog(config *LockWatchdogConfig) {
+	lockWatchdogLock.Lock()
+	defer lockWatchdogLock.Unlock()
+
+	if lockWatchdogStop != nil {
+		close(lockWatchdogStop)
+		lockWatchdogStop = nil
+	}
+	if config == nil {
+		return
+	}
+
+	c := *config
+	if c.StallThreshold <= 0 {
+		c.StallThreshold = DEFAULT_LOCK_STALL_THRESHOLD
+	}
+	if c.CheckInterval <= 0 {
+		c.CheckInterval = DEFAULT_LOCK_WATCHDOG_INTERVAL
+	}
+	stop := make(chan struct{})
+	lockWatchdogStop = stop
+
+	go func() {
+		ticker := time.NewTicker(c.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				checkHeldLocks(&c, now)
+			}
+		}
+	}()
+}
+
+// GetHeldLocks returns the locks held by this process ordered by the acquisition time
+func GetHeldLocks() []HeldLock {
+	heldLocksLock.Lock()
+	defer heldLocksLock.Unlock()
+
+	locks := make([]HeldLock, 0, len(heldLocks))
+	for _, held := range heldLocks {
+		locks = append(locks, *held)
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].AcquiredAt.Before(locks[j].AcquiredAt)
+	})
+	return locks
+}
+
+func trackLock(lock *FileLock) {
+	now := time.Now()
+	heldLocksLock.Lock()
+	defer heldLocksLock.Unlock()
+	heldLocks[lock] = &HeldLock{
+		Name:           lock.Name,
+		VolumeName:     lock.volume,
+		DestURL:        lock.driver.GetURL(),
+		Type:           lock.Type,
+		Operation:      lock.Operation,
+		AcquiredAt:     now,
+		LastProgressAt: now,
+	}
+}
+
+func untrackLock(lock *FileLock) {
+	heldLocksLock.Lock()
+	defer heldLocksLock.Unlock()
+	delete(heldLocks, lock)
+}
+
+// reportProgress records the progress of the operation holding the lock
+func (lock *FileLock) reportProgress() {
+	heldLocksLock.Lock()
+	defer heldLocksLock.Unlock()
+	if held, ok := heldLocks[lock]; ok {
+		held.LastProgressAt = time.Now()
+		held.Stalled = false
+	}
+}
+
+// checkHeldLocks reports the stalled locks, and releases them if AutoRelease is set
+func checkHeldLocks(config *LockWatchdogConfig, now time.Time) {
+	stalled := []*FileLock{}
+	events := []Event{}
+	func() {
+		heldLocksLock.Lock()
+		defer heldLocksLock.Unlock()
+		for lock, held := range heldLocks {
+			idle := now.Sub(held.LastProgressAt)
+			if idle < config.StallThreshold {
+				continue
+			}
+			if !held.Stalled {
+				held.Stalled = true
+				log.WithFields(logrus.Fields{
+					LogFieldVolume:  held.VolumeName,
+					LogFieldDestURL: held.DestURL,
+				}).Warnf("Lock %v of %v has been held for %v without progress", held.Name, held.Operation, idle)
+				events = append(events, Event{
+					Type:       EventLockStalled,
+					DestURL:    held.DestURL,
+					VolumeName: held.VolumeName,
+					LockName:   held.Name,
+					Error:      fmt.Sprintf("no progress for %v", idle),
+				})
+			}
+			stalled = append(stalled, lock)
+		}
+	}()
+	for _, event := range events {
+		emitEvent(event)
+	}
+
+	if !config.AutoRelease {
+		return
+	}
+	// the locks are released outside of heldLocksLock, since the lock mutex is taken before it
+	for _, lock := range stalled {
+		log := log.WithFields(logrus.Fields{
+			LogFieldVolume:  lock.volume,
+			LogFieldDestURL: lock.driver.GetURL(),
+		})
+		if err := lock.forceRelease(); err != nil {
+			log.WithError(err).Errorf("Failed to release stalled lock %v", lock.Name)
+			continue
+		}
+		log.Warnf("Released stalled lock %v of %v", lock.Name, lock.Operation)
+		emitEvent(Event{
+			Type:       EventLockReleased,
+			DestURL:    lock.driver.GetURL(),
+			VolumeName: lock.volume,
+			LockName:   lock.Name,
+			Error:      fmt.Sprintf("released after no progress for %v", config.StallThreshold),
+		})
+	}
+}
+
+// reportLockProgress reports the progress of the operation to the watchdog of its locks
+func (p *progress) reportLockProgress() {
+	for _, lock := range p.locks {
+		lock.reportProgress()
+	}
+}
@@ -0,0 +1,62 @@
+package backupstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockWatchdog(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	recorder := &eventRecorder{}
+	SetEventSink("recorder", recorder)
+	defer SetEventSink("recorder", nil)
+
+	// acquire the lock without waiting for the conflicting locks
+	lock, err := New(m, "pvc-1", BACKUP_LOCK)
+	assert.NoError(err)
+	lock.Acquired = true
+	lock.count = 1
+	assert.NoError(saveLock(lock))
+	trackLock(lock)
+	file := getLockFilePath(m, "pvc-1", lock.Name)
+
+	held := GetHeldLocks()
+	assert.Len(held, 1)
+	assert.Equal(lock.Name, held[0].Name)
+	assert.Equal("pvc-1", held[0].VolumeName)
+	assert.False(held[0].Stalled)
+
+	config := &LockWatchdogConfig{StallThreshold: time.Minute}
+	checkHeldLocks(config, time.Now())
+	assert.Empty(recorder.events)
+
+	// the stalled lock is only reported once until there is progress
+	checkHeldLocks(config, time.Now().Add(2*time.Minute))
+	checkHeldLocks(config, time.Now().Add(3*time.Minute))
+	assert.Len(recorder.events, 1)
+	assert.Equal(EventLockStalled, recorder.events[0].Type)
+	assert.Equal(lock.Name, recorder.events[0].LockName)
+	assert.True(GetHeldLocks()[0].Stalled)
+	assert.True(lock.Acquired)
+
+	(&progress{locks: []*FileLock{lock}}).reportLockProgress()
+	assert.False(GetHeldLocks()[0].Stalled)
+
+	config.AutoRelease = true
+	checkHeldLocks(config, time.Now().Add(2*time.Minute))
+	assert.Len(recorder.events, 3)
+	assert.Equal(EventLockReleased, recorder.events[2].Type)
+	assert.False(lock.Acquired)
+	assert.False(m.FileExists(file))
+	assert.Empty(GetHeldLocks())
+
+	// the owner's unlock of the released lock is a no-op
+	assert.NoError(lock.Unlock())
+}
@@ -0,0 +1,356 @@
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	"github.com/longhorn/backupstore"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "memory"})
+)
+
+var (
+	// ErrInjected is returned by the operations failed by the injected error rate
+	ErrInjected = errors.New("injected failure")
+	// ErrPartialWrite is returned by the writes which stored only a part of the data
+	ErrPartialWrite = errors.New("injected partial write")
+)
+
+// Failures are the failure modes injected into the operations of a memory backupstore
+type Failures struct {
+	// Latency is added to every operation
+	Latency time.Duration
+	// ErrorRate is the probability between 0 and 1 that an operation fails with ErrInjected
+	ErrorRate float64
+	// PartialWriteRate is the probability between 0 and 1 that a write stores only half of the data
+	// and fails with ErrPartialWrite
+	PartialWriteRate float64
+	// Seed makes the injected failures reproducible, a random seed is used if zero
+	Seed int64
+}
+
+// BackupStoreDriver keeps the backupstore in memory, so the backup flows can be tested without any
+// external storage. The drivers of the same URL share the data until Reset is called.
+type BackupStoreDriver struct {
+	destURL string
+	store   *store
+}
+
+const (
+	KIND = "memory"
+)
+
+type store struct {
+	sync.Mutex
+
+	fs       afero.Fs
+	failures Failures
+	rand     *rand.Rand
+
+	// writeLock serializes the writes, so the conditional writes are atomic
+	writeLock sync.Mutex
+	// generations are the ETags of the files, taken from the generation counter of the store on every write
+	generations map[string]int64
+	generation  int64
+}
+
+var (
+	storesLock sync.Mutex
+	stores     = map[string]*store{}
+)
+
+func init() {
+	if err := backupstore.RegisterDriver(KIND, initFunc); err != nil {
+		panic(err)
+	}
+}
+
+func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
+	destURL, err := normalizeURL(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &BackupStoreDriver{
+		destURL: destURL,
+		store:   getStore(destURL),
+	}
+	log.Debugf("Loaded driver for %v", b.destURL)
+	return b, nil
+}
+
+func normalizeURL(destURL string) (string, error) {
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme != KIND {
+		return "", fmt.Errorf("BUG: Why dispatch %v to %v?", u.Scheme, KIND)
+	}
+
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid URL. Must be memory://name or memory://name/path")
+	}
+	return KIND + "://" + u.Host + strings.TrimRight(u.Path, "/"), nil
+}
+
+func getStore(destURL string) *store {
+	storesLock.Lock()
+	defer storesLock.Unlock()
+	s, exists := stores[destURL]
+	if !exists {
+		s = &store{fs: afero.NewMemMapFs(), generations: map[string]int64{}}
+		s.setFailures(Failures{})
+		stores[destURL] = s
+	}
+	return s
+}
+
+// SetFailures sets the failures injected into the operations of the memory backupstore
+func SetFailures(destURL string, failures Failures) error {
+	destURL, err := normalizeURL(destURL)
+	if err != nil {
+		return err
+	}
+	getStore(destURL).setFailures(failures)
+	return nil
+}
+
+// Reset drops the data and the injected failures of the memory backupstore
+func Reset(destURL string) error {
+	destURL, err := normalizeURL(destURL)
+	if err != nil {
+		return err
+	}
+	storesLock.Lock()
+	defer storesLock.Unlock()
+	delete(stores, destURL)
+	return nil
+}
+
+func (s *store) setFailures(failures Failures) {
+	s.Lock()
+	defer s.Unlock()
+	seed := failures.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	s.failures = failures
+	s.rand = rand.New(rand.NewSource(seed))
+}
+
+// inject waits for the latency and returns the error if the operation should fail
+func (s *store) inject(op, path string) error {
+	s.Lock()
+	failures := s.failures
+	fail := failures.ErrorRate > 0 && s.rand.Float64() < failures.ErrorRate
+	s.Unlock()
+
+	if failures.Latency > 0 {
+		time.Sleep(failures.Latency)
+	}
+	if fail {
+		return errors.Wrapf(ErrInjected, "failed to %v %v", op, path)
+	}
+	return nil
+}
+
+func (s *store) partialWrite() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.failures.PartialWriteRate > 0 && s.rand.Float64() < s.failures.PartialWriteRate
+}
+
+func (m *BackupStoreDriver) Kind() string {
+	return KIND
+}
+
+func (m *BackupStoreDriver) GetURL() string {
+	return m.destURL
+}
+
+func (m *BackupStoreDriver) FileExists(filePath string) bool {
+	return m.FileSize(filePath) >= 0
+}
+
+func (m *BackupStoreDriver) FileSize(filePath string) int64 {
+	if err := m.store.inject("stat", filePath); err != nil {
+		return -1
+	}
+	st, err := m.store.fs.Stat(filePath)
+	if err != nil || st.IsDir() {
+		return -1
+	}
+	return st.Size()
+}
+
+func (m *BackupStoreDriver) FileTime(filePath string) time.Time {
+	if err := m.store.inject("stat", filePath); err != nil {
+		return time.Time{}
+	}
+	st, err := m.store.fs.Stat(filePath)
+	if err != nil || st.IsDir() {
+		return time.Time{}
+	}
+	return st.ModTime().UTC()
+}
+
+func (m *BackupStoreDriver) Remove(path string) error {
+	if err := m.store.inject("remove", path); err != nil {
+		return err
+	}
+	return m.store.fs.RemoveAll(path)
+}
+
+func (m *BackupStoreDriver) Read(src string) (io.ReadCloser, error) {
+	if err := m.store.inject("read", src); err != nil {
+		return nil, err
+	}
+	data, err := afero.ReadFile(m.store.fs, src)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *BackupStoreDriver) ReadRange(src string, offset, length int64) (io.ReadCloser, error) {
+	if err := m.store.inject("read", src); err != nil {
+		return nil, err
+	}
+	data, err := afero.ReadFile(m.store.fs, src)
+	if err != nil {
+		return nil, err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	end := offset + length
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return io.NopCloser(bytes.NewReader(data[offset:end])), nil
+}
+
+func (m *BackupStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	if err := m.store.inject("write", dst); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(rs)
+	if err != nil {
+		return err
+	}
+	return m.writeFile(dst, data)
+}
+
+func (m *BackupStoreDriver) FileETag(filePath string) (string, error) {
+	if err := m.store.inject("stat", filePath); err != nil {
+		return "", err
+	}
+	m.store.writeLock.Lock()
+	defer m.store.writeLock.Unlock()
+	return m.fileETag(filePath), nil
+}
+
+func (m *BackupStoreDriver) fileETag(filePath string) string {
+	if st, err := m.store.fs.Stat(filePath); err != nil || st.IsDir() {
+		return ""
+	}
+	return strconv.FormatInt(m.store.generations[filePath], 10)
+}
+
+func (m *BackupStoreDriver) WriteIfMatch(dst string, rs io.ReadSeeker, etag string) error {
+	if err := m.store.inject("write", dst); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(rs)
+	if err != nil {
+		return err
+	}
+
+	m.store.writeLock.Lock()
+	defer m.store.writeLock.Unlock()
+	if m.fileETag(dst) != etag {
+		return &backupstore.ConflictError{Path: dst, ETag: etag}
+	}
+	return m.writeFileLocked(dst, data)
+}
+
+func (m *BackupStoreDriver) writeFile(dst string, data []byte) error {
+	m.store.writeLock.Lock()
+	defer m.store.writeLock.Unlock()
+	return m.writeFileLocked(dst, data)
+}
+
+func (m *BackupStoreDriver) writeFileLocked(dst string, data []byte) error {
+	m.store.generation++
+	m.store.generations[dst] = m.store.generation
+	if err := m.store.fs.MkdirAll(filepath.Dir(dst), os.ModeDir|0700); err != nil {
+		return err
+	}
+	if m.store.partialWrite() {
+		if err := afero.WriteFile(m.store.fs, dst, data[:len(data)/2], 0600); err != nil {
+			return err
+		}
+		return errors.Wrapf(ErrPartialWrite, "failed to write %v", dst)
+	}
+	return afero.WriteFile(m.store.fs, dst, data, 0600)
+}
+
+func (m *BackupStoreDriver) List(path string) ([]string, error) {
+	if err := m.store.inject("list", path); err != nil {
+		return nil, err
+	}
+	infos, err := afero.ReadDir(m.store.fs, path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var result []string
+	for _, info := range infos {
+		result = append(result, info.Name())
+	}
+	return result, nil
+}
+
+func (m *BackupStoreDriver) Upload(src, dst string) error {
+	if err := m.store.inject("upload", dst); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return m.writeFile(dst, data)
+}
+
+func (m *BackupStoreDriver) Download(src, dst string) error {
+	if err := m.store.inject("download", src); err != nil {
+		return err
+	}
+	data, err := afero.ReadFile(m.store.fs, src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModeDir|0700); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0600)
+}
@@ -0,0 +1,169 @@
+package memory
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore"
+)
+
+func TestDriver(t *testing.T) {
+	assert := assert.New(t)
+
+	destURL := "memory://test-driver"
+	defer Reset(destURL)
+
+	_, err := initFunc("memory:///path")
+	assert.Error(err)
+
+	driver, err := initFunc(destURL)
+	assert.NoError(err)
+	assert.Equal(destURL, driver.GetURL())
+
+	dst := "backupstore/volumes/vol/volume.cfg"
+	assert.NoError(driver.Write(dst, bytes.NewReader([]byte("config"))))
+
+	// the drivers of the same URL share the data
+	shared, err := initFunc(destURL + "/")
+	assert.NoError(err)
+	assert.Equal(int64(len("config")), shared.FileSize(dst))
+	assert.False(shared.FileTime(dst).IsZero())
+	rc, err := shared.Read(dst)
+	assert.NoError(err)
+	data, err := io.ReadAll(rc)
+	assert.NoError(err)
+	assert.NoError(rc.Close())
+	assert.Equal("config", string(data))
+
+	for _, r := range []struct {
+		offset, length int64
+		expected       string
+	}{{2, 3, "nfi"}, {4, 10, "ig"}, {10, 1, ""}} {
+		rc, err = driver.(*BackupStoreDriver).ReadRange(dst, r.offset, r.length)
+		assert.NoError(err)
+		data, err = io.ReadAll(rc)
+		assert.NoError(err)
+		assert.Equal(r.expected, string(data))
+	}
+
+	entries, err := driver.List("backupstore/volumes")
+	assert.NoError(err)
+	assert.Equal([]string{"vol"}, entries)
+	entries, err = driver.List("backupstore/nonexistent")
+	assert.NoError(err)
+	assert.Empty(entries)
+
+	src := filepath.Join(t.TempDir(), "upload")
+	assert.NoError(os.WriteFile(src, []byte("uploaded"), 0600))
+	assert.NoError(driver.Upload(src, "backupstore/upload"))
+	downloaded := filepath.Join(t.TempDir(), "download", "file")
+	assert.NoError(driver.Download("backupstore/upload", downloaded))
+	data, err = os.ReadFile(downloaded)
+	assert.NoError(err)
+	assert.Equal("uploaded", string(data))
+
+	assert.NoError(driver.Remove("backupstore/volumes"))
+	assert.False(driver.FileExists(dst))
+
+	assert.NoError(Reset(destURL))
+	driver, err = initFunc(destURL)
+	assert.NoError(err)
+	assert.False(driver.FileExists("backupstore/upload"))
+}
+
+func TestFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	destURL := "memory://test-failures"
+	defer Reset(destURL)
+
+	driver, err := initFunc(destURL)
+	assert.NoError(err)
+
+	assert.NoError(SetFailures(destURL, Failures{ErrorRate: 1}))
+	err = driver.Write("file", bytes.NewReader([]byte("data")))
+	assert.True(errors.Is(err, ErrInjected))
+	_, err = driver.List("")
+	assert.True(errors.Is(err, ErrInjected))
+	assert.False(driver.FileExists("file"))
+
+	assert.NoError(SetFailures(destURL, Failures{PartialWriteRate: 1}))
+	err = driver.Write("file", bytes.NewReader([]byte("data")))
+	assert.True(errors.Is(err, ErrPartialWrite))
+	assert.Equal(int64(2), driver.FileSize("file"))
+
+	assert.NoError(SetFailures(destURL, Failures{}))
+	assert.NoError(driver.Write("file", bytes.NewReader([]byte("data"))))
+	assert.Equal(int64(4), driver.FileSize("file"))
+}
+
+func TestSingleFileBackup(t *testing.T) {
+	assert := assert.New(t)
+
+	destURL := "memory://test-backup"
+	defer Reset(destURL)
+
+	src := filepath.Join(t.TempDir(), "snapshot")
+	assert.NoError(os.WriteFile(src, []byte("snapshot data"), 0600))
+
+	backupURL, err := backupstore.CreateSingleFileBackup(
+		&backupstore.Volume{Name: "vol", Size: 4096, CreatedTime: "2023-01-01T00:00:00Z"},
+		&backupstore.Snapshot{Name: "snap", CreatedTime: "2023-01-01T00:00:00Z"},
+		src, destURL)
+	assert.NoError(err)
+
+	restored, err := backupstore.RestoreSingleFileBackup(backupURL, t.TempDir())
+	assert.NoError(err)
+	data, err := os.ReadFile(restored)
+	assert.NoError(err)
+	assert.Equal("snapshot data", string(data))
+
+	assert.NoError(backupstore.DeleteSingleFileBackup(backupURL))
+	_, err = backupstore.InspectBackup(backupURL)
+	assert.Error(err)
+}
+
+func TestConditionalWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	destURL := "memory://test-conditional"
+	defer Reset(destURL)
+
+	driver, err := initFunc(destURL)
+	assert.NoError(err)
+	writer := driver.(backupstore.BackupStoreConditionalWriter)
+
+	dst := "backupstore/volumes/vol/volume.cfg"
+	assert.True(backupstore.IsConflictError(writer.WriteIfMatch(dst, bytes.NewReader([]byte("{}")), "1")))
+	assert.NoError(writer.WriteIfMatch(dst, bytes.NewReader([]byte("{}")), ""))
+	assert.True(backupstore.IsConflictError(writer.WriteIfMatch(dst, bytes.NewReader([]byte("{}")), "")))
+
+	// the ETag read by one manager is stale once the other one updates the config
+	etag, err := writer.FileETag(dst)
+	assert.NoError(err)
+	assert.NotEmpty(etag)
+	assert.NoError(driver.Write(dst, bytes.NewReader([]byte("{}"))))
+	err = backupstore.SaveConfigInBackupStoreIfMatch(driver, dst, &backupstore.Volume{Name: "vol"}, etag)
+	assert.True(backupstore.IsConflictError(err))
+
+	etag, err = writer.FileETag(dst)
+	assert.NoError(err)
+	assert.NoError(backupstore.SaveConfigInBackupStoreIfMatch(driver, dst, &backupstore.Volume{Name: "vol"}, etag))
+
+	src := filepath.Join(t.TempDir(), "snapshot")
+	assert.NoError(os.WriteFile(src, []byte("snapshot data"), 0600))
+	backupURL, err := backupstore.CreateSingleFileBackup(
+		&backupstore.Volume{Name: "vol-2", Size: 4096, CreatedTime: "2023-01-01T00:00:00Z"},
+		&backupstore.Snapshot{Name: "snap", CreatedTime: "2023-01-01T00:00:00Z"},
+		src, destURL)
+	assert.NoError(err)
+	metadata, err := backupstore.GetConfigMetadata(backupURL)
+	assert.NoError(err)
+	assert.NotEmpty(metadata.ETag)
+}
@@ -0,0 +1,79 @@
+package backupstore
+
+import (
+	"fmt"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	// blockJobBytes is the memory reserved for a block in the pipelines, the block buffer and the compressed copy
+	// of the block
+	blockJobBytes = 2 * DEFAULT_BLOCK_SIZE
+
+	// MIN_MEMORY_BUDGET is the smallest memory budget of the backups and the restores, which holds a single block
+	// in the pipeline
+	MIN_MEMORY_BUDGET = blockJobBytes
+)
+
+// newMemoryBudget validates the memory budget of the backup or the restore, 0 means no limit
+func newMemoryBudget(limit int64) (*util.MemoryBudget, error) {
+	if limit < 0 {
+		return nil, fmt.Errorf("invalid negative memory budget %v", limit)
+	}
+	if limit > 0 && limit < MIN_MEMORY_BUDGET {
+		return nil, fmt.Errorf("memory budget %v is less than the minimum %v", limit, MIN_MEMORY_BUDGET)
+	}
+	return util.NewMemoryBudget(limit), nil
+}
+
+// capConcurrentLimit lowers the concurrent limit to the number of the workers fitting into the memory budget if
+// each of them reserves workerBytes, there is at least 1 worker
+func capConcurrentLimit(concurrentLimit int32, budget *util.MemoryBudget, workerBytes int64) int32 {
+	if budget.Limit() <= 0 || workerBytes <= 0 {
+		return concurrentLimit
+	}
+	maxWorkers := budget.Limit() / workerBytes
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+	if int64(concurrentLimit) > maxWorkers {
+		return int32(maxWorkers)
+	}
+	return concurrentLimit
+}
+
+// getBlockQuarantineLimit limits the blocks quarantined by the backup, so the memory budget has room for a block
+// in the pipeline besides the compressed blocks kept by the quarantine until the end of the pass
+func getBlockQuarantineLimit(budget *util.MemoryBudget) int {
+	if budget.Limit() <= 0 {
+		return DEFAULT_BLOCK_QUARANTINE_LIMIT
+	}
+	limit := (budget.Limit() - blockJobBytes) / DEFAULT_BLOCK_SIZE
+	if limit > DEFAULT_BLOCK_QUARANTINE_LIMIT {
+		return DEFAULT_BLOCK_QUARANTINE_LIMIT
+	}
+	return int(limit)
+}
+
+// getRestoreWorkerBytes returns the memory reserved by a restore worker for its lifetime, the block and its
+// compressed copy, and the buffer of the coalesced writes
+func getRestoreWorkerBytes(coalesceBlocks int) int64 {
+	workerBytes := int64(blockJobBytes)
+	if coalesceBlocks > 1 {
+		workerBytes += int64(coalesceBlocks) * DEFAULT_BLOCK_SIZE
+	}
+	return workerBytes
+}
+
+// newRestoreMemoryBudget validates the memory budget of the restore, which must hold at least a restore worker
+func newRestoreMemoryBudget(config *DeltaRestoreConfig, workerBytes int64) (*util.MemoryBudget, error) {
+	budget, err := newMemoryBudget(config.MemoryBudget)
+	if err != nil {
+		return nil, err
+	}
+	if budget.Limit() > 0 && budget.Limit() < workerBytes {
+		return nil, fmt.Errorf("memory budget %v cannot hold a restore worker of %v bytes", budget.Limit(), workerBytes)
+	}
+	return budget, nil
+}
@@ -0,0 +1,79 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/types"
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestMemoryBudgetLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := newMemoryBudget(-1)
+	assert.Error(err)
+	_, err = newMemoryBudget(MIN_MEMORY_BUDGET - 1)
+	assert.Error(err)
+	_, err = newRestoreMemoryBudget(&DeltaRestoreConfig{MemoryBudget: MIN_MEMORY_BUDGET}, getRestoreWorkerBytes(4))
+	assert.Error(err)
+
+	unlimited, err := newMemoryBudget(0)
+	assert.NoError(err)
+	assert.Equal(int32(16), capConcurrentLimit(16, unlimited, blockJobBytes))
+	assert.Equal(DEFAULT_BLOCK_QUARANTINE_LIMIT, getBlockQuarantineLimit(unlimited))
+
+	budget, err := newMemoryBudget(5 * DEFAULT_BLOCK_SIZE)
+	assert.NoError(err)
+	assert.Equal(int32(2), capConcurrentLimit(16, budget, blockJobBytes))
+	assert.Equal(int32(1), capConcurrentLimit(1, budget, blockJobBytes))
+	assert.Equal(int32(1), capConcurrentLimit(16, budget, getRestoreWorkerBytes(4)))
+	assert.Equal(3, getBlockQuarantineLimit(budget))
+}
+
+func TestBackupMappingMemoryBudget(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	a, b := bytes.Repeat([]byte("a"), DEFAULT_BLOCK_SIZE), bytes.Repeat([]byte("b"), DEFAULT_BLOCK_SIZE)
+	source := &memoryBlockSource{data: append(append([]byte{}, a...), b...)}
+	config := &DeltaBackupConfig{
+		Volume:   &Volume{Name: "pvc-1", Size: 2 * DEFAULT_BLOCK_SIZE},
+		Snapshot: &Snapshot{Name: "snap-1"},
+		DeltaOps: newBlockSourceOperations(source, nil),
+	}
+	targets := []*backupTarget{{destURL: mockDriverURL, bsDriver: m}}
+	deltaBackup := &Backup{Name: "backup-1", ProcessingBlocks: &ProcessingBlocks{blocks: map[string][]*BlockMapping{}}}
+
+	// the budget only holds a block, so the second block isn't read until the first one is released
+	budget := util.NewMemoryBudget(MIN_MEMORY_BUDGET)
+	progress := &progress{totalBlockCounts: 2, budget: budget}
+	out := make(chan *blockBackupJob, 2)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- backupMapping(context.Background(), targets, config, deltaBackup, DEFAULT_BLOCK_SIZE,
+			types.Mapping{Offset: 0, Size: 2 * DEFAULT_BLOCK_SIZE}, progress, nil, out)
+	}()
+
+	job := <-out
+	assert.Equal(util.GetChecksum(a), job.checksum)
+	assert.Equal(budget, job.budget)
+	assert.Empty(out)
+	// the compress and upload stages return the buffers of the block
+	blockBuffers.Put(job.buf)
+	job.budget.Release(DEFAULT_BLOCK_SIZE)
+	job.budget.Release(DEFAULT_BLOCK_SIZE)
+
+	job = <-out
+	assert.Equal(util.GetChecksum(b), job.checksum)
+	blockBuffers.Put(job.buf)
+	job.budget.Release(blockJobBytes)
+	assert.NoError(<-errChan)
+	assert.Equal(int64(MIN_MEMORY_BUDGET), budget.PeakBytes())
+}
@@ -0,0 +1,86 @@
+package backupstore
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+var (
+	metadataCompressionLock   sync.RWMutex
+	metadataCompressionMethod = "none"
+)
+
+// SetMetadataCompressionMethod sets the compression method of the volume and backup config files saved afterwards.
+// The supported methods are "none" (default) and the compression methods with a magic number, e.g. "gzip" and "lz4".
+// The compressed config files are detected on reading regardless of the setting, but they cannot be read by the
+// versions before the compression support.
+func SetMetadataCompressionMethod(method string) error {
+	if method == "" {
+		method = "none"
+	}
+	if method != "none" {
+		if magic, err := util.GetCompressionMagic(method); err != nil || len(magic) == 0 {
+			return fmt.Errorf("unsupported metadata compression method: %v", method)
+		}
+	}
+
+	metadataCompressionLock.Lock()
+	defer metadataCompressionLock.Unlock()
+	metadataCompressionMethod = method
+	return nil
+}
+
+// GetMetadataCompressionMethod returns the compression method of the volume and backup config files
+func GetMetadataCompressionMethod() string {
+	metadataCompressionLock.RLock()
+	defer metadataCompressionLock.RUnlock()
+	return metadataCompressionMethod
+}
+
+func compressMetadata(method string, data []byte) ([]byte, error) {
+	if method == "none" {
+		return data, nil
+	}
+	compressor, err := util.GetCompressor(method)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := compressor.Compress(&buf, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// newMetadataReader returns the reader of the uncompressed metadata, the compression method is detected
+// by the magic number
+func newMetadataReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(util.COMPRESSION_HEADER_SIZE)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	// the uncompressed JSON metadata starts with '{'
+	if len(head) == 0 || head[0] == '{' {
+		return br, nil
+	}
+	method := util.DetectCompressionMethod(head)
+	if method == "" {
+		return br, nil
+	}
+
+	compressor, err := util.GetCompressor(method)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := compressor.Decompress(&buf, br); err != nil {
+		return nil, fmt.Errorf("failed to decompress %v metadata: %v", method, err)
+	}
+	return &buf, nil
+}
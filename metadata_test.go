@@ -0,0 +1,35 @@
+package backupstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Error(SetMetadataCompressionMethod("zip"))
+	assert.Equal("none", GetMetadataCompressionMethod())
+
+	volume := &Volume{Name: "vol", Size: 1024, BlockCount: 100000}
+	uncompressed, err := json.Marshal(volume)
+	assert.NoError(err)
+
+	for _, method := range []string{"none", "gzip", "lz4"} {
+		data, err := compressMetadata(method, uncompressed)
+		assert.NoError(err)
+		if method != "none" {
+			assert.NotEqual(uncompressed, data)
+		}
+
+		r, err := newMetadataReader(bytes.NewReader(data))
+		assert.NoError(err)
+		v := &Volume{}
+		assert.NoError(json.NewDecoder(r).Decode(v), method)
+		assert.Equal(volume.Name, v.Name)
+		assert.Equal(volume.BlockCount, v.BlockCount)
+	}
+}
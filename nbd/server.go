@@ -0,0 +1,333 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The read-only subset of the NBD fixed newstyle protocol, see
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+const (
+	nbdMagic      = 0x4e42444d41474943 // NBDMAGIC
+	nbdOptMagic   = 0x49484156454f5054 // IHAVEOPT
+	nbdRepMagic   = 0x3e889045565a9
+	nbdReqMagic   = 0x25609513
+	nbdReplyMagic = 0x67446698
+
+	nbdFlagFixedNewstyle = 1 << 0
+	nbdFlagNoZeroes      = 1 << 1
+
+	nbdFlagCFixedNewstyle = 1 << 0
+	nbdFlagCNoZeroes      = 1 << 1
+
+	nbdFlagHasFlags = 1 << 0
+	nbdFlagReadOnly = 1 << 1
+
+	nbdOptExportName = 1
+	nbdOptAbort      = 2
+	nbdOptList       = 3
+	nbdOptInfo       = 6
+	nbdOptGo         = 7
+
+	nbdRepAck        = 1
+	nbdRepServer     = 2
+	nbdRepInfo       = 3
+	nbdRepErrUnsup   = 1<<31 + 1
+	nbdRepErrUnknown = 1<<31 + 6
+
+	nbdInfoExport = 0
+
+	nbdCmdRead  = 0
+	nbdCmdWrite = 1
+	nbdCmdDisc  = 2
+	nbdCmdFlush = 3
+	nbdCmdTrim  = 4
+
+	nbdEPERM  = 1
+	nbdEIO    = 5
+	nbdEINVAL = 22
+
+	// maxOptionLength and maxRequestLength limit the memory allocated for a client
+	maxOptionLength  = 64 << 10
+	maxRequestLength = 32 << 20
+
+	transmissionFlags = nbdFlagHasFlags | nbdFlagReadOnly
+)
+
+var log = logrus.WithFields(logrus.Fields{"pkg": "nbd"})
+
+// Server exports a read-only block device over the NBD protocol.
+// The reads are served by the export, the writes are rejected.
+type Server struct {
+	exportName string
+	export     io.ReaderAt
+	size       int64
+
+	lock  sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// NewServer creates a server for the export with the size in bytes.
+// The clients can use any export name if exportName is empty.
+func NewServer(exportName string, export io.ReaderAt, size int64) *Server {
+	return &Server{
+		exportName: exportName,
+		export:     export,
+		size:       size,
+		conns:      map[net.Conn]struct{}{},
+	}
+}
+
+// Serve accepts and serves the connections on the listener until the listener is closed
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.closeConns()
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(conn); err != nil {
+				log.WithError(err).Warnf("Failed to serve NBD connection from %v", conn.RemoteAddr())
+			}
+		}()
+	}
+}
+
+func (s *Server) closeConns() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// ServeConn serves a single client connection, the connection is closed when it returns
+func (s *Server) ServeConn(conn net.Conn) error {
+	s.lock.Lock()
+	s.conns[conn] = struct{}{}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	ok, err := s.handshake(conn)
+	if err != nil || !ok {
+		return err
+	}
+	return s.transmission(conn)
+}
+
+// handshake negotiates the export, it returns false if the client aborted the negotiation
+func (s *Server) handshake(conn net.Conn) (bool, error) {
+	hdr := make([]byte, 18)
+	binary.BigEndian.PutUint64(hdr[0:], nbdMagic)
+	binary.BigEndian.PutUint64(hdr[8:], nbdOptMagic)
+	binary.BigEndian.PutUint16(hdr[16:], nbdFlagFixedNewstyle|nbdFlagNoZeroes)
+	if _, err := conn.Write(hdr); err != nil {
+		return false, err
+	}
+
+	var clientFlags uint32
+	if err := binary.Read(conn, binary.BigEndian, &clientFlags); err != nil {
+		return false, err
+	}
+	if clientFlags&nbdFlagCFixedNewstyle == 0 {
+		return false, fmt.Errorf("client doesn't support fixed newstyle negotiation")
+	}
+	noZeroes := clientFlags&nbdFlagCNoZeroes != 0
+
+	for {
+		var opt struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		if err := binary.Read(conn, binary.BigEndian, &opt); err != nil {
+			return false, err
+		}
+		if opt.Magic != nbdOptMagic {
+			return false, fmt.Errorf("invalid option magic %x", opt.Magic)
+		}
+		if opt.Length > maxOptionLength {
+			return false, fmt.Errorf("option %v length %v exceeds the limit", opt.Option, opt.Length)
+		}
+		data := make([]byte, opt.Length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return false, err
+		}
+
+		switch opt.Option {
+		case nbdOptExportName:
+			if !s.isExport(string(data)) {
+				// there is no way to report the error for this option
+				return false, fmt.Errorf("unknown export %v", string(data))
+			}
+			reply := make([]byte, 10, 134)
+			binary.BigEndian.PutUint64(reply[0:], uint64(s.size))
+			binary.BigEndian.PutUint16(reply[8:], transmissionFlags)
+			if !noZeroes {
+				reply = append(reply, make([]byte, 124)...)
+			}
+			_, err := conn.Write(reply)
+			return err == nil, err
+		case nbdOptAbort:
+			return false, writeOptionReply(conn, opt.Option, nbdRepAck, nil)
+		case nbdOptList:
+			name := make([]byte, 4+len(s.exportName))
+			binary.BigEndian.PutUint32(name, uint32(len(s.exportName)))
+			copy(name[4:], s.exportName)
+			if err := writeOptionReply(conn, opt.Option, nbdRepServer, name); err != nil {
+				return false, err
+			}
+			if err := writeOptionReply(conn, opt.Option, nbdRepAck, nil); err != nil {
+				return false, err
+			}
+		case nbdOptInfo, nbdOptGo:
+			name, err := parseInfoRequest(data)
+			if err != nil {
+				if err := writeOptionReply(conn, opt.Option, nbdRepErrUnsup, []byte(err.Error())); err != nil {
+					return false, err
+				}
+				continue
+			}
+			if !s.isExport(name) {
+				if err := writeOptionReply(conn, opt.Option, nbdRepErrUnknown, []byte("unknown export")); err != nil {
+					return false, err
+				}
+				continue
+			}
+			info := make([]byte, 12)
+			binary.BigEndian.PutUint16(info[0:], nbdInfoExport)
+			binary.BigEndian.PutUint64(info[2:], uint64(s.size))
+			binary.BigEndian.PutUint16(info[10:], transmissionFlags)
+			if err := writeOptionReply(conn, opt.Option, nbdRepInfo, info); err != nil {
+				return false, err
+			}
+			if err := writeOptionReply(conn, opt.Option, nbdRepAck, nil); err != nil {
+				return false, err
+			}
+			if opt.Option == nbdOptGo {
+				return true, nil
+			}
+		default:
+			if err := writeOptionReply(conn, opt.Option, nbdRepErrUnsup, nil); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+func (s *Server) isExport(name string) bool {
+	return s.exportName == "" || name == s.exportName
+}
+
+// parseInfoRequest returns the export name of NBD_OPT_INFO and NBD_OPT_GO, the information requests are ignored
+// since only NBD_INFO_EXPORT is sent
+func parseInfoRequest(data []byte) (string, error) {
+	if len(data) < 4 {
+		return "", fmt.Errorf("invalid info request length %v", len(data))
+	}
+	nameLength := binary.BigEndian.Uint32(data)
+	if uint64(nameLength)+6 > uint64(len(data)) {
+		return "", fmt.Errorf("invalid export name length %v", nameLength)
+	}
+	return string(data[4 : 4+nameLength]), nil
+}
+
+func writeOptionReply(w io.Writer, option, replyType uint32, data []byte) error {
+	reply := make([]byte, 20+len(data))
+	binary.BigEndian.PutUint64(reply[0:], nbdRepMagic)
+	binary.BigEndian.PutUint32(reply[8:], option)
+	binary.BigEndian.PutUint32(reply[12:], replyType)
+	binary.BigEndian.PutUint32(reply[16:], uint32(len(data)))
+	copy(reply[20:], data)
+	_, err := w.Write(reply)
+	return err
+}
+
+func (s *Server) transmission(conn net.Conn) error {
+	for {
+		var req struct {
+			Magic  uint32
+			Flags  uint16
+			Type   uint16
+			Handle uint64
+			Offset uint64
+			Length uint32
+		}
+		if err := binary.Read(conn, binary.BigEndian, &req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if req.Magic != nbdReqMagic {
+			return fmt.Errorf("invalid request magic %x", req.Magic)
+		}
+
+		switch req.Type {
+		case nbdCmdRead:
+			if req.Length > maxRequestLength || req.Offset+uint64(req.Length) > uint64(s.size) {
+				if err := writeReply(conn, req.Handle, nbdEINVAL, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			data := make([]byte, req.Length)
+			if _, err := s.export.ReadAt(data, int64(req.Offset)); err != nil && !errors.Is(err, io.EOF) {
+				log.WithError(err).Errorf("Failed to read %v bytes at offset %v", req.Length, req.Offset)
+				if err := writeReply(conn, req.Handle, nbdEIO, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := writeReply(conn, req.Handle, 0, data); err != nil {
+				return err
+			}
+		case nbdCmdWrite:
+			if _, err := io.CopyN(io.Discard, conn, int64(req.Length)); err != nil {
+				return err
+			}
+			if err := writeReply(conn, req.Handle, nbdEPERM, nil); err != nil {
+				return err
+			}
+		case nbdCmdDisc:
+			return nil
+		case nbdCmdFlush:
+			if err := writeReply(conn, req.Handle, 0, nil); err != nil {
+				return err
+			}
+		case nbdCmdTrim:
+			if err := writeReply(conn, req.Handle, nbdEPERM, nil); err != nil {
+				return err
+			}
+		default:
+			if err := writeReply(conn, req.Handle, nbdEINVAL, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func writeReply(w io.Writer, handle uint64, errno uint32, data []byte) error {
+	reply := make([]byte, 16+len(data))
+	binary.BigEndian.PutUint32(reply[0:], nbdReplyMagic)
+	binary.BigEndian.PutUint32(reply[4:], errno)
+	binary.BigEndian.PutUint64(reply[8:], handle)
+	copy(reply[16:], data)
+	_, err := w.Write(reply)
+	return err
+}
@@ -0,0 +1,103 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeConn(t *testing.T) {
+	assert := assert.New(t)
+
+	export := bytes.Repeat([]byte("0123456789abcdef"), 256)
+	server := NewServer("backup", bytes.NewReader(export), int64(len(export)))
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ServeConn(conn)
+	}()
+
+	hdr := make([]byte, 18)
+	_, err := io.ReadFull(client, hdr)
+	assert.NoError(err)
+	assert.Equal(uint64(nbdMagic), binary.BigEndian.Uint64(hdr[0:]))
+	assert.Equal(uint64(nbdOptMagic), binary.BigEndian.Uint64(hdr[8:]))
+	assert.NoError(binary.Write(client, binary.BigEndian, uint32(nbdFlagCFixedNewstyle|nbdFlagCNoZeroes)))
+
+	writeOption := func(option uint32, name string) {
+		data := make([]byte, 4+len(name)+2)
+		binary.BigEndian.PutUint32(data, uint32(len(name)))
+		copy(data[4:], name)
+		opt := make([]byte, 16)
+		binary.BigEndian.PutUint64(opt[0:], nbdOptMagic)
+		binary.BigEndian.PutUint32(opt[8:], option)
+		binary.BigEndian.PutUint32(opt[12:], uint32(len(data)))
+		_, err := client.Write(append(opt, data...))
+		assert.NoError(err)
+	}
+	readOptionReply := func() (uint32, []byte) {
+		reply := make([]byte, 20)
+		_, err := io.ReadFull(client, reply)
+		assert.NoError(err)
+		assert.Equal(uint64(nbdRepMagic), binary.BigEndian.Uint64(reply[0:]))
+		data := make([]byte, binary.BigEndian.Uint32(reply[16:]))
+		_, err = io.ReadFull(client, data)
+		assert.NoError(err)
+		return binary.BigEndian.Uint32(reply[12:]), data
+	}
+
+	writeOption(nbdOptGo, "unknown")
+	replyType, _ := readOptionReply()
+	assert.Equal(uint32(nbdRepErrUnknown), replyType)
+
+	writeOption(nbdOptGo, "backup")
+	replyType, info := readOptionReply()
+	assert.Equal(uint32(nbdRepInfo), replyType)
+	assert.Equal(uint64(len(export)), binary.BigEndian.Uint64(info[2:]))
+	assert.Equal(uint16(nbdFlagHasFlags|nbdFlagReadOnly), binary.BigEndian.Uint16(info[10:]))
+	replyType, _ = readOptionReply()
+	assert.Equal(uint32(nbdRepAck), replyType)
+
+	writeRequest := func(cmd uint16, handle, offset uint64, length uint32) {
+		req := make([]byte, 28)
+		binary.BigEndian.PutUint32(req[0:], nbdReqMagic)
+		binary.BigEndian.PutUint16(req[6:], cmd)
+		binary.BigEndian.PutUint64(req[8:], handle)
+		binary.BigEndian.PutUint64(req[16:], offset)
+		binary.BigEndian.PutUint32(req[24:], length)
+		_, err := client.Write(req)
+		assert.NoError(err)
+	}
+	readReply := func(handle uint64, length int) (uint32, []byte) {
+		reply := make([]byte, 16+length)
+		_, err := io.ReadFull(client, reply)
+		assert.NoError(err)
+		assert.Equal(uint32(nbdReplyMagic), binary.BigEndian.Uint32(reply[0:]))
+		assert.Equal(handle, binary.BigEndian.Uint64(reply[8:]))
+		return binary.BigEndian.Uint32(reply[4:]), reply[16:]
+	}
+
+	writeRequest(nbdCmdRead, 1, 100, 50)
+	errno, data := readReply(1, 50)
+	assert.Equal(uint32(0), errno)
+	assert.Equal(export[100:150], data)
+
+	writeRequest(nbdCmdRead, 2, uint64(len(export))-10, 20)
+	errno, _ = readReply(2, 0)
+	assert.Equal(uint32(nbdEINVAL), errno)
+
+	writeRequest(nbdCmdWrite, 3, 0, 4)
+	_, err = client.Write([]byte("data"))
+	assert.NoError(err)
+	errno, _ = readReply(3, 0)
+	assert.Equal(uint32(nbdEPERM), errno)
+
+	writeRequest(nbdCmdDisc, 4, 0, 0)
+	assert.NoError(<-done)
+}
@@ -0,0 +1,127 @@
+package nfs
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/types"
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	SecurityKrb5  = "krb5"
+	SecurityKrb5i = "krb5i"
+	SecurityKrb5p = "krb5p"
+
+	// DefaultTicketRefreshInterval is shorter than the common ticket lifetime of 10 hours,
+	// so the long running backups never see an expired ticket
+	DefaultTicketRefreshInterval = 1 * time.Hour
+)
+
+var (
+	ticketRefreshersLock sync.Mutex
+	ticketRefreshers     = map[string]bool{}
+)
+
+// krb5Config is the Kerberos configuration of the NFS mount
+type krb5Config struct {
+	*util.NFSCredential
+}
+
+// getKrb5Config returns the Kerberos configuration from the credential provider of the backup target, or the
+// environment variables if no provider is set. nil is returned if Kerberos is not used.
+func getKrb5Config(destURL string) (*krb5Config, error) {
+	credential := map[string]string{
+		types.NFSSecurity:      os.Getenv(types.NFSSecurity),
+		types.NFSKrb5Principal: os.Getenv(types.NFSKrb5Principal),
+		types.NFSKrb5Keytab:    os.Getenv(types.NFSKrb5Keytab),
+		types.NFSKrb5CCache:    os.Getenv(types.NFSKrb5CCache),
+	}
+	if provider := backupstore.GetCredentialProvider(destURL); provider != nil {
+		var err error
+		if credential, err = provider.GetCredential(destURL); err != nil {
+			return nil, errors.Wrapf(err, "failed to get credential for %v", destURL)
+		}
+	}
+	return newKrb5Config(credential)
+}
+
+func newKrb5Config(credential map[string]string) (*krb5Config, error) {
+	typed, err := util.CredentialFromMap(KIND, credential)
+	if err != nil {
+		return nil, err
+	}
+	nfsCredential := typed.(*util.NFSCredential)
+	if nfsCredential.Security == "" {
+		return nil, nil
+	}
+	return &krb5Config{nfsCredential}, nil
+}
+
+// addSecurityOption adds the sec option to the mount options unless it's specified already
+func (c *krb5Config) addSecurityOption(options []string) []string {
+	for _, option := range options {
+		if strings.HasPrefix(option, "sec=") {
+			return options
+		}
+	}
+	return append(options, "sec="+c.Security)
+}
+
+// obtainTicket gets the ticket using the keytab, or checks the ticket in the credential cache if there is no keytab
+func (c *krb5Config) obtainTicket() error {
+	if c.Keytab == "" {
+		args := []string{"-s"}
+		if c.CCache != "" {
+			args = append(args, c.CCache)
+		}
+		if _, err := util.Execute("klist", args); err != nil {
+			return errors.Wrapf(err, "no valid Kerberos ticket found in credential cache %v", c.CCache)
+		}
+		return nil
+	}
+
+	args := []string{"-k", "-t", c.Keytab}
+	if c.CCache != "" {
+		args = append(args, "-c", c.CCache)
+	}
+	args = append(args, c.Principal)
+	if _, err := util.Execute("kinit", args); err != nil {
+		return errors.Wrapf(err, "failed to obtain Kerberos ticket for %v", c.Principal)
+	}
+	return nil
+}
+
+// startTicketRefresher refreshes the ticket in the background for the lifetime of the process, so the mount
+// keeps working during the long running backups. Only the tickets obtained by the keytab can be refreshed.
+func (c *krb5Config) startTicketRefresher() {
+	if c.Keytab == "" {
+		log.Warnf("Kerberos ticket in credential cache %v cannot be refreshed without keytab", c.CCache)
+		return
+	}
+
+	key := c.Principal + "@" + c.Keytab + "@" + c.CCache
+	ticketRefreshersLock.Lock()
+	defer ticketRefreshersLock.Unlock()
+	if ticketRefreshers[key] {
+		return
+	}
+	ticketRefreshers[key] = true
+
+	go func() {
+		ticker := time.NewTicker(DefaultTicketRefreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := c.obtainTicket(); err != nil {
+				log.WithError(err).Errorf("Failed to refresh Kerberos ticket for %v", c.Principal)
+				continue
+			}
+			log.Debugf("Refreshed Kerberos ticket for %v", c.Principal)
+		}
+	}()
+}
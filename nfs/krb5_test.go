@@ -0,0 +1,35 @@
+package nfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/types"
+)
+
+func TestKrb5Config(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := newKrb5Config(map[string]string{})
+	assert.NoError(err)
+	assert.Nil(config)
+
+	_, err = newKrb5Config(map[string]string{types.NFSSecurity: "sys"})
+	assert.Error(err)
+
+	_, err = newKrb5Config(map[string]string{
+		types.NFSSecurity:   SecurityKrb5p,
+		types.NFSKrb5Keytab: "/etc/krb5.keytab",
+	})
+	assert.Error(err)
+
+	config, err = newKrb5Config(map[string]string{
+		types.NFSSecurity:      SecurityKrb5i,
+		types.NFSKrb5Principal: "backup@EXAMPLE.COM",
+		types.NFSKrb5Keytab:    "/etc/krb5.keytab",
+	})
+	assert.NoError(err)
+	assert.Equal([]string{"nfsvers=4.1", "sec=krb5i"}, config.addSecurityOption([]string{"nfsvers=4.1"}))
+	assert.Equal([]string{"sec=krb5p"}, config.addSecurityOption([]string{"sec=krb5p"}))
+}
@@ -24,7 +24,8 @@ var (
 
 	// Ref: https://github.com/longhorn/backupstore/pull/91
 	defaultMountInterval = 1 * time.Second
-	defaultMountTimeout  = 5 * time.Second
+	// defaultMountTimeout bounds each mount attempt unless it's overridden by util.MountTimeoutParam
+	defaultMountTimeout = time.Minute
 )
 
 type BackupStoreDriver struct {
@@ -32,6 +33,10 @@ type BackupStoreDriver struct {
 	serverPath   string
 	mountDir     string
 	mountOptions []string
+	// mountTimeouts are the timeouts of mounting and cleaning up the share, overridden by the URL params
+	mountTimeouts util.MountTimeouts
+	// krb5 is the Kerberos configuration if the share is mounted with sec=krb5, krb5i or krb5p
+	krb5 *krb5Config
 	*fsops.FileSystemOperator
 }
 
@@ -79,9 +84,22 @@ func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
 		b.mountOptions = util.SplitMountOptions(nfsOptions)
 		log.Infof("Overriding NFS mountOptions:  %v", b.mountOptions)
 	}
+	if b.mountTimeouts, err = util.ParseMountTimeouts(u, util.MountTimeouts{Mount: defaultMountTimeout}); err != nil {
+		return nil, err
+	}
+
+	if b.krb5, err = getKrb5Config(destURL); err != nil {
+		return nil, err
+	}
+	if b.krb5 != nil {
+		if err := b.krb5.obtainTicket(); err != nil {
+			return nil, err
+		}
+		b.krb5.startTicketRefresher()
+	}
 
 	if err := b.mount(); err != nil {
-		return nil, errors.Wrapf(err, "cannot mount nfs %v, options %v", b.serverPath, b.mountOptions)
+		return nil, errors.Wrapf(err, "cannot mount nfs %v, options %v, %v", b.serverPath, b.mountOptions, b.mountTimeouts)
 	}
 
 	if _, err := b.List(""); err != nil {
@@ -96,7 +114,7 @@ func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
 func (b *BackupStoreDriver) mount() error {
 	mounter := mount.New("")
 
-	mounted, err := util.EnsureMountPoint(KIND, b.mountDir, mounter, log)
+	mounted, err := util.EnsureMountPointWithTimeout(KIND, b.mountDir, mounter, log, b.mountTimeouts.Cleanup)
 	if err != nil {
 		return err
 	}
@@ -108,12 +126,15 @@ func (b *BackupStoreDriver) mount() error {
 
 	// If overridden, assume minor version is specified or defaulted.
 	if len(b.mountOptions) > 0 {
+		if b.krb5 != nil {
+			b.mountOptions = b.krb5.addSecurityOption(b.mountOptions)
+		}
 		sensitiveMountOptions := []string{}
 
 		log.Infof("Mounting NFS share %v on mount point %v with options %+v", b.destURL, b.mountDir, b.mountOptions)
 
 		err := util.MountWithTimeout(mounter, b.serverPath, b.mountDir, "nfs4", b.mountOptions, sensitiveMountOptions,
-			defaultMountInterval, defaultMountTimeout)
+			defaultMountInterval, b.mountTimeouts.Mount)
 		if err == nil {
 			return nil
 		}
@@ -132,12 +153,15 @@ func (b *BackupStoreDriver) mount() error {
 				"timeo=300",
 				"retry=2",
 			}
+			if b.krb5 != nil {
+				b.mountOptions = b.krb5.addSecurityOption(b.mountOptions)
+			}
 			sensitiveMountOptions := []string{}
 
 			log.Infof("Mounting NFS share %v on mount point %v with options %+v", b.destURL, b.mountDir, b.mountOptions)
 
 			err := util.MountWithTimeout(mounter, b.serverPath, b.mountDir, "nfs4", b.mountOptions, sensitiveMountOptions,
-				defaultMountInterval, defaultMountTimeout)
+				defaultMountInterval, b.mountTimeouts.Mount)
 			if err == nil {
 				return nil
 			}
@@ -149,6 +173,12 @@ func (b *BackupStoreDriver) mount() error {
 	return retErr
 }
 
+// Remount mounts the share again if the mount point is stale, it's called by the file operations failed with
+// ESTALE or EIO before retrying
+func (b *BackupStoreDriver) Remount() error {
+	return b.mount()
+}
+
 func (b *BackupStoreDriver) Kind() string {
 	return KIND
 }
@@ -0,0 +1,181 @@
+package backupstore
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+)
+
+var (
+	clusterIdentityLock sync.RWMutex
+	clusterID           string
+	writerID            string
+)
+
+// SetClusterIdentity sets the UUID of the cluster and the identity of the writer in the cluster, e.g. the node
+// name, which are recorded in the volume configs written afterwards. The new backup volumes are owned by the
+// cluster, and the backups of the volumes owned by another cluster cannot be created or deleted unless forced,
+// so the clusters sharing a backup target don't corrupt each other's backups. The ownership isn't checked if
+// the cluster UUID is empty, which is the default.
+func SetClusterIdentity(clusterUUID, writer string) {
+	clusterIdentityLock.Lock()
+	defer clusterIdentityLock.Unlock()
+	clusterID = clusterUUID
+	writerID = writer
+}
+
+// GetClusterIdentity returns the UUID of the cluster and the identity of the writer
+func GetClusterIdentity() (string, string) {
+	clusterIdentityLock.RLock()
+	defer clusterIdentityLock.RUnlock()
+	return clusterID, writerID
+}
+
+// getLastWriter returns the identity recorded as the last writer of the volume configs
+func getLastWriter() string {
+	cluster, writer := GetClusterIdentity()
+	if writer == "" {
+		return cluster
+	}
+	return cluster + "/" + writer
+}
+
+// NotOwnerError is returned when writing a backup volume owned by another cluster without the force option
+type NotOwnerError struct {
+	VolumeName string
+	Owner      string
+	ClusterID  string
+}
+
+func (e *NotOwnerError) Error() string {
+	return fmt.Sprintf("backup volume %v is owned by cluster %v instead of %v", e.VolumeName, e.Owner, e.ClusterID)
+}
+
+// IsNotOwnerError checks if the error is caused by writing a backup volume owned by another cluster
+func IsNotOwnerError(err error) bool {
+	var notOwnerErr *NotOwnerError
+	return errors.As(err, &notOwnerErr)
+}
+
+type VolumeOwnership struct {
+	// OwnerClusterID is the UUID of the cluster owning the volume, the volume isn't owned if empty
+	OwnerClusterID string
+	// LastWriter is the cluster UUID and the writer identity which wrote the volume config last
+	LastWriter string
+}
+
+// GetVolumeOwnership returns the owner and the last writer of the backup volume
+func GetVolumeOwnership(volumeURL string) (*VolumeOwnership, error) {
+	bsDriver, volumeName, err := getVolumeDriver(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	v, err := loadVolume(bsDriver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	return &VolumeOwnership{OwnerClusterID: v.OwnerClusterID, LastWriter: v.LastWriter}, nil
+}
+
+// ClaimVolumeOwnership makes the cluster set by SetClusterIdentity the owner of the backup volume. It fails
+// with NotOwnerError if the volume is owned by another cluster, unless force is set to take over the volume.
+func ClaimVolumeOwnership(volumeURL string, force bool) error {
+	cluster, _ := GetClusterIdentity()
+	if cluster == "" {
+		return fmt.Errorf("cannot claim ownership of backup volume without the cluster identity")
+	}
+	return setVolumeOwner(volumeURL, cluster, force)
+}
+
+// ReleaseVolumeOwnership releases the backup volume owned by the cluster set by SetClusterIdentity, so it can
+// be written or claimed by any cluster. It fails with NotOwnerError if the volume is owned by another cluster,
+// unless force is set.
+func ReleaseVolumeOwnership(volumeURL string, force bool) error {
+	return setVolumeOwner(volumeURL, "", force)
+}
+
+func setVolumeOwner(volumeURL, owner string, force bool) error {
+	bsDriver, volumeName, err := getVolumeDriver(volumeURL)
+	if err != nil {
+		return err
+	}
+
+	// prevent racing with the deletion of the volume
+	lock, err := New(bsDriver, volumeName, DELETION_LOCK)
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	previous := ""
+	if _, err := updateVolume(bsDriver, volumeName, func(v *Volume) error {
+		if err := checkVolumeOwnership(v, force); err != nil {
+			return err
+		}
+		previous = v.OwnerClusterID
+		v.OwnerClusterID = owner
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		LogFieldVolume: volumeName,
+	}).Infof("Changed owner of backup volume from %v to %v", previous, owner)
+	return nil
+}
+
+// ListOwnedBackupVolumes lists the backup volumes owned by the cluster set by SetClusterIdentity and the volumes
+// not owned by any cluster, which the cluster can write. The volumes of the other clusters sharing the backup
+// target are skipped after reading their configs, without listing their backups.
+func ListOwnedBackupVolumes(destURL string, volumeOnly bool) (map[string]*VolumeInfo, error) {
+	cluster, _ := GetClusterIdentity()
+	if cluster == "" {
+		return nil, fmt.Errorf("cannot list owned backup volumes without the cluster identity")
+	}
+	return ListWithFilter(destURL, &VolumeFilter{OwnerClusterID: cluster, IncludeUnowned: true}, volumeOnly)
+}
+
+func getVolumeDriver(volumeURL string) (BackupStoreDriver, string, error) {
+	bsDriver, err := GetBackupStoreDriver(volumeURL)
+	if err != nil {
+		return nil, "", err
+	}
+	_, volumeName, _, err := DecodeBackupURL(volumeURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if volumeName == "" {
+		return nil, "", fmt.Errorf("missing volume name in %v", volumeURL)
+	}
+	return bsDriver, volumeName, nil
+}
+
+// checkVolumeOwnership fails if the volume is owned by a cluster other than the one set by SetClusterIdentity
+func checkVolumeOwnership(v *Volume, force bool) error {
+	cluster, _ := GetClusterIdentity()
+	if force || cluster == "" || v.OwnerClusterID == "" || v.OwnerClusterID == cluster {
+		return nil
+	}
+	return &NotOwnerError{VolumeName: v.Name, Owner: v.OwnerClusterID, ClusterID: cluster}
+}
+
+// checkVolumeOwnershipInBackupStore checks the ownership of the volume in the backupstore, the volume can be
+// written if it doesn't exist
+func checkVolumeOwnershipInBackupStore(bsDriver BackupStoreDriver, volumeName string, force bool) error {
+	if !volumeExists(bsDriver, volumeName) {
+		return nil
+	}
+	v, err := loadVolume(bsDriver, volumeName)
+	if err != nil {
+		return err
+	}
+	return checkVolumeOwnership(v, force)
+}
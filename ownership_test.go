@@ -0,0 +1,75 @@
+package backupstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeOwnership(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	defer SetClusterIdentity("", "")
+
+	// the ownership isn't checked without the cluster identity
+	assert.NoError(checkVolumeOwnership(&Volume{Name: "pvc-1", OwnerClusterID: "cluster-b"}, false))
+
+	SetClusterIdentity("cluster-a", "node-1")
+	assert.NoError(addVolume(m, &Volume{Name: "pvc-1"}))
+	v, err := loadVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal("cluster-a", v.OwnerClusterID)
+	assert.Equal("cluster-a/node-1", v.LastWriter)
+	assert.NoError(checkVolumeOwnership(v, false))
+
+	SetClusterIdentity("cluster-b", "")
+	err = checkVolumeOwnershipInBackupStore(m, "pvc-1", false)
+	assert.True(IsNotOwnerError(err))
+	assert.NoError(checkVolumeOwnershipInBackupStore(m, "pvc-1", true))
+	assert.NoError(checkVolumeOwnershipInBackupStore(m, "pvc-2", false))
+
+	err = deleteDeltaBlockBackups(m, []string{"backup-1"}, "pvc-1", nil)
+	assert.True(IsNotOwnerError(err))
+
+	// the volume can be written by any cluster once released
+	_, err = updateVolume(m, "pvc-1", func(v *Volume) error {
+		v.OwnerClusterID = ""
+		return nil
+	})
+	assert.NoError(err)
+	v, err = loadVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal("cluster-b", v.LastWriter)
+	assert.NoError(checkVolumeOwnership(v, false))
+}
+
+func TestListOwnedBackupVolumes(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	defer SetClusterIdentity("", "")
+
+	_, err := ListOwnedBackupVolumes(mockDriverURL, true)
+	assert.Error(err)
+
+	for volumeName, owner := range map[string]string{"pvc-1": "cluster-a", "pvc-2": "cluster-b", "pvc-3": ""} {
+		assert.NoError(saveVolume(m, &Volume{Name: volumeName, OwnerClusterID: owner}))
+	}
+
+	SetClusterIdentity("cluster-a", "node-1")
+	volumeInfo, err := ListOwnedBackupVolumes(mockDriverURL, true)
+	assert.NoError(err)
+	assert.Len(volumeInfo, 2)
+	assert.Contains(volumeInfo, "pvc-1")
+	assert.Contains(volumeInfo, "pvc-3")
+
+	volumeInfo, err = ListWithFilter(mockDriverURL, &VolumeFilter{OwnerClusterID: "cluster-b"}, true)
+	assert.NoError(err)
+	assert.Len(volumeInfo, 1)
+	assert.Contains(volumeInfo, "pvc-2")
+}
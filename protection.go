@@ -0,0 +1,102 @@
+package backupstore
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+)
+
+type DeleteOptions struct {
+	// Force deletes the backups even though they are deletion protected
+	Force bool
+	// ForceOwnership deletes the backups even though the volume is owned by another cluster
+	ForceOwnership bool
+	// SkipTrash removes the backups immediately even though the soft deletion is enabled by
+	// SetBackupTrashRetention
+	SkipTrash bool
+}
+
+// DeletionProtectedError is returned when deleting a deletion protected backup without the force option
+type DeletionProtectedError struct {
+	BackupName string
+	VolumeName string
+}
+
+func (e *DeletionProtectedError) Error() string {
+	return fmt.Sprintf("backup %v of volume %v is deletion protected", e.BackupName, e.VolumeName)
+}
+
+// IsDeletionProtectedError checks if the error is caused by deleting a deletion protected backup
+func IsDeletionProtectedError(err error) bool {
+	var protectedErr *DeletionProtectedError
+	return errors.As(err, &protectedErr)
+}
+
+// SetBackupDeletionProtection enables or disables the deletion protection of the backup
+func SetBackupDeletionProtection(backupURL string, protected bool) error {
+	bsDriver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return err
+	}
+
+	backupName, volumeName, _, err := DecodeBackupURL(backupURL)
+	if err != nil {
+		return err
+	}
+	if backupName == "" {
+		return fmt.Errorf("missing backup name in %v", backupURL)
+	}
+
+	// prevent racing with the deletion of the backup
+	lock, err := New(bsDriver, volumeName, DELETION_LOCK)
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	backup, err := loadBackup(bsDriver, backupName, volumeName)
+	if err != nil {
+		return err
+	}
+	if isBackupInProgress(backup) {
+		return fmt.Errorf("backup %v is still in progress", backup.Name)
+	}
+	if backup.DeletionProtected == protected {
+		return nil
+	}
+
+	backup.DeletionProtected = protected
+	if err := saveBackup(bsDriver, backup); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		LogFieldBackup: backupName,
+		LogFieldVolume: volumeName,
+	}).Infof("Set backup deletion protection to %v", protected)
+	return nil
+}
+
+func checkVolumeDeletionProtection(bsDriver BackupStoreDriver, volumeName string) error {
+	backupNames, err := getBackupNamesForVolume(bsDriver, volumeName)
+	if err != nil {
+		return err
+	}
+	for _, backupName := range backupNames {
+		backup, err := loadBackup(bsDriver, backupName, volumeName)
+		if err != nil {
+			// the backup config is corrupted, it cannot be protected
+			continue
+		}
+		if backup.DeletionProtected {
+			return &DeletionProtectedError{BackupName: backupName, VolumeName: volumeName}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package backupstore
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/types"
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestBackupDeletionProtection(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m, nil
+	})
+	defer SetClusterIdentity("", "")
+	SetClusterIdentity("cluster-a", "")
+
+	data := append(bytes.Repeat([]byte("a"), DEFAULT_BLOCK_SIZE), bytes.Repeat([]byte("b"), DEFAULT_BLOCK_SIZE)...)
+	source := &memoryBlockSource{data: data, extents: []types.Mapping{{Offset: 0, Size: 2 * DEFAULT_BLOCK_SIZE}}}
+	for _, name := range []string{"backup-1", "backup-2"} {
+		summary := runDeltaBlockBackup(name, &DeltaBackupConfig{
+			Volume:          &Volume{Name: "pvc-1", Size: 2 * DEFAULT_BLOCK_SIZE, CompressionMethod: "lz4"},
+			Snapshot:        &Snapshot{Name: "snap-" + name, CreatedTime: util.Now()},
+			DestURL:         mockDriverURL,
+			Source:          source,
+			ConcurrentLimit: 1,
+		})
+		assert.Equal(types.ProgressStateComplete, summary.State, "%v", summary.Error)
+	}
+	volumeURL := EncodeBackupURL("", "pvc-1", mockDriverURL)
+	backup1URL := EncodeBackupURL("backup-1", "pvc-1", mockDriverURL)
+	backup2URL := EncodeBackupURL("backup-2", "pvc-1", mockDriverURL)
+
+	assert.NoError(SetBackupDeletionProtection(backup1URL, true))
+	assert.NoError(SetBackupDeletionProtection(backup1URL, true))
+	backup, err := loadBackup(m, "backup-1", "pvc-1")
+	assert.NoError(err)
+	assert.True(backup.DeletionProtected)
+	assert.Error(SetBackupDeletionProtection(volumeURL, true))
+
+	// the protected backup is refused without force, and none of the backups deleted together is removed
+	err = DeleteDeltaBlockBackup(backup1URL)
+	assert.True(IsDeletionProtectedError(err))
+	assert.Contains(err.Error(), "backup-1")
+	err = DeleteBackups(volumeURL, []string{"backup-2", "backup-1"})
+	assert.True(IsDeletionProtectedError(err))
+	assert.True(IsDeletionProtectedError(DeleteBackupVolume("pvc-1", mockDriverURL)))
+	names, err := getBackupNamesForVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"backup-1", "backup-2"}, names)
+	for _, block := range backup.Blocks {
+		assert.True(m.FileExists(getBlockFilePath(m, "pvc-1", block.BlockChecksum)))
+	}
+
+	// the protection survives the rewrite of the backup config
+	assert.NoError(MigrateVolumeCompression(volumeURL, "gzip"))
+	backup, err = loadBackup(m, "backup-1", "pvc-1")
+	assert.NoError(err)
+	assert.Equal("gzip", backup.CompressionMethod)
+	assert.True(backup.DeletionProtected)
+	assert.True(IsDeletionProtectedError(DeleteDeltaBlockBackup(backup1URL)))
+
+	// the volume owned by another cluster is only written with ForceOwnership, which doesn't imply Force
+	SetBackupTrashRetention(time.Hour)
+	defer SetBackupTrashRetention(0)
+	SetClusterIdentity("cluster-b", "")
+	assert.True(IsNotOwnerError(DeleteDeltaBlockBackup(backup2URL)))
+	assert.True(IsNotOwnerError(DeleteDeltaBlockBackupWithOptions(backup1URL, &DeleteOptions{Force: true})))
+	err = DeleteDeltaBlockBackupWithOptions(backup1URL, &DeleteOptions{ForceOwnership: true})
+	assert.True(IsDeletionProtectedError(err))
+
+	// the backups are moved to the trash unless SkipTrash is set
+	assert.NoError(DeleteDeltaBlockBackupWithOptions(backup2URL, &DeleteOptions{ForceOwnership: true}))
+	assert.NoError(DeleteDeltaBlockBackupWithOptions(backup1URL,
+		&DeleteOptions{Force: true, ForceOwnership: true, SkipTrash: true}))
+	names, err = getBackupNamesForVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Empty(names)
+	trashed, err := ListTrashedBackups(volumeURL)
+	assert.NoError(err)
+	if assert.Len(trashed, 1) {
+		assert.Equal("backup-2", trashed[0].Name)
+	}
+	assert.False(m.FileExists(getTrashedBackupConfigPath(m, "backup-1", "pvc-1")))
+}
@@ -0,0 +1,445 @@
+package backupstore
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+)
+
+const (
+	// BACKUP_PROVENANCE_SUFFIX is appended to the path of the backup config for the provenance of the backup
+	BACKUP_PROVENANCE_SUFFIX = ".intoto.json"
+
+	ProvenancePayloadType   = "application/vnd.in-toto+json"
+	ProvenanceStatementType = "https://in-toto.io/Statement/v1"
+	ProvenancePredicateType = "https://slsa.dev/provenance/v1"
+	ProvenanceBuildType     = "https://github.com/longhorn/backupstore/delta-block-backup/v1"
+
+	provenanceBlocksDigest = "sha256"
+	provenanceBuilderIDURI = "backupstore://"
+)
+
+// ProvenanceSigner signs the provenance of the backups, e.g. by a key held in a KMS
+type ProvenanceSigner interface {
+	KeyID() string
+	// Sign signs the DSSE pre-authentication encoding of the provenance statement
+	Sign(payload []byte) ([]byte, error)
+}
+
+// ProvenanceVerifier verifies the signatures of the provenance of the backups
+type ProvenanceVerifier interface {
+	// Verify fails if the signature of the payload by the key isn't valid, or the key isn't trusted
+	Verify(keyID string, payload, signature []byte) error
+}
+
+type ed25519ProvenanceSigner struct {
+	keyID string
+	key   ed25519.PrivateKey
+}
+
+// NewEd25519ProvenanceSigner returns the signer of the provenance by the Ed25519 key
+func NewEd25519ProvenanceSigner(keyID string, key ed25519.PrivateKey) ProvenanceSigner {
+	return &ed25519ProvenanceSigner{keyID: keyID, key: key}
+}
+
+func (s *ed25519ProvenanceSigner) KeyID() string {
+	return s.keyID
+}
+
+func (s *ed25519ProvenanceSigner) Sign(payload []byte) ([]byte, error) {
+	return ed25519.Sign(s.key, payload), nil
+}
+
+// Ed25519ProvenanceKeys are the trusted Ed25519 public keys verifying the provenance, keyed by the key IDs
+type Ed25519ProvenanceKeys map[string]ed25519.PublicKey
+
+func (k Ed25519ProvenanceKeys) Verify(keyID string, payload, signature []byte) error {
+	key, ok := k[keyID]
+	if !ok {
+		return fmt.Errorf("untrusted key %v", keyID)
+	}
+	if !ed25519.Verify(key, payload, signature) {
+		return fmt.Errorf("invalid signature by key %v", keyID)
+	}
+	return nil
+}
+
+var (
+	provenanceLock     sync.RWMutex
+	provenanceSigner   ProvenanceSigner
+	provenanceVerifier ProvenanceVerifier
+	provenanceRequired bool
+)
+
+// SetProvenanceSigner sets the signer of the provenance written next to the config of the delta block backups
+// created afterwards. The provenance is an in-toto statement with the SLSA provenance predicate in a DSSE
+// envelope, recording the volume, the snapshot and its checksum, the backup target, the cluster identity set by
+// SetClusterIdentity and the library version, with the digest of the blocks of the backup as the subject. The
+// provenance isn't written if the signer is nil, which is the default.
+func SetProvenanceSigner(signer ProvenanceSigner) {
+	provenanceLock.Lock()
+	defer provenanceLock.Unlock()
+	provenanceSigner = signer
+}
+
+// SetProvenanceVerifier sets the verifier of the provenance of the backups being restored. The restore fails
+// with ProvenanceError if the provenance of the backup cannot be verified, the backups without the provenance
+// are only rejected if required is set. The provenance isn't verified if the verifier is nil, which is the
+// default.
+func SetProvenanceVerifier(verifier ProvenanceVerifier, required bool) {
+	provenanceLock.Lock()
+	defer provenanceLock.Unlock()
+	provenanceVerifier = verifier
+	provenanceRequired = required
+}
+
+func getProvenanceSigner() ProvenanceSigner {
+	provenanceLock.RLock()
+	defer provenanceLock.RUnlock()
+	return provenanceSigner
+}
+
+func getProvenanceVerifier() (ProvenanceVerifier, bool) {
+	provenanceLock.RLock()
+	defer provenanceLock.RUnlock()
+	return provenanceVerifier, provenanceRequired
+}
+
+// ProvenanceError is returned when the provenance of the backup cannot be verified
+type ProvenanceError struct {
+	BackupName string
+	VolumeName string
+	Reason     string
+}
+
+func (e *ProvenanceError) Error() string {
+	return fmt.Sprintf("cannot verify provenance of backup %v of volume %v: %v", e.BackupName, e.VolumeName, e.Reason)
+}
+
+// IsProvenanceError checks if the error is caused by the provenance of the backup failing the verification
+func IsProvenanceError(err error) bool {
+	var provenanceErr *ProvenanceError
+	return errors.As(err, &provenanceErr)
+}
+
+// ProvenanceEnvelope is the DSSE envelope of the signed provenance statement
+type ProvenanceEnvelope struct {
+	PayloadType string                `json:"payloadType"`
+	Payload     []byte                `json:"payload"`
+	Signatures  []ProvenanceSignature `json:"signatures"`
+}
+
+type ProvenanceSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   []byte `json:"sig"`
+}
+
+// ProvenanceStatement is the in-toto statement of the provenance of the backup
+type ProvenanceStatement struct {
+	Type          string                   `json:"_type"`
+	Subject       []ProvenanceDescriptor   `json:"subject"`
+	PredicateType string                   `json:"predicateType"`
+	Predicate     ProvenancePredicateSLSA1 `json:"predicate"`
+}
+
+// ProvenanceDescriptor is the in-toto resource descriptor of the backup or the snapshot
+type ProvenanceDescriptor struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// ProvenancePredicateSLSA1 is the subset of the SLSA provenance v1 predicate describing the backup
+type ProvenancePredicateSLSA1 struct {
+	BuildDefinition struct {
+		BuildType            string                 `json:"buildType"`
+		ExternalParameters   map[string]string      `json:"externalParameters"`
+		ResolvedDependencies []ProvenanceDescriptor `json:"resolvedDependencies,omitempty"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID      string            `json:"id"`
+			Version map[string]string `json:"version,omitempty"`
+		} `json:"builder"`
+		Metadata struct {
+			InvocationID string `json:"invocationId"`
+			FinishedOn   string `json:"finishedOn,omitempty"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+func getBackupProvenancePath(driver BackupStoreDriver, backupName, volumeName string) string {
+	return getBackupConfigPath(driver, backupName, volumeName) + BACKUP_PROVENANCE_SUFFIX
+}
+
+// getProvenanceSubjectName identifies the backup independent of the backup target
+func getProvenanceSubjectName(backup *Backup) string {
+	return backup.VolumeName + "/" + backup.Name
+}
+
+// getBackupBlocksDigest returns the SHA-256 of the block mappings of the backup sorted by the offsets, which
+// identifies the data of the backup regardless of the encoding of the backup config
+func getBackupBlocksDigest(backup *Backup) string {
+	blocks := make([]BlockMapping, len(backup.Blocks))
+	copy(blocks, backup.Blocks)
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Offset < blocks[j].Offset
+	})
+	h := sha256.New()
+	for _, block := range blocks {
+		fmt.Fprintf(h, "%d %s\n", block.Offset, block.BlockChecksum)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// getProvenancePAE returns the DSSE pre-authentication encoding of the payload, which is signed
+func getProvenancePAE(payloadType string, payload []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "DSSEv1 %d %s %d ", len(payloadType), payloadType, len(payload))
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+func newBackupProvenanceStatement(backup *Backup, destURL string) *ProvenanceStatement {
+	statement := &ProvenanceStatement{
+		Type: ProvenanceStatementType,
+		Subject: []ProvenanceDescriptor{{
+			Name:   getProvenanceSubjectName(backup),
+			Digest: map[string]string{provenanceBlocksDigest: getBackupBlocksDigest(backup)},
+		}},
+		PredicateType: ProvenancePredicateType,
+	}
+	predicate := &statement.Predicate
+	predicate.BuildDefinition.BuildType = ProvenanceBuildType
+	predicate.BuildDefinition.ExternalParameters = map[string]string{
+		"volume":            backup.VolumeName,
+		"snapshot":          backup.SnapshotName,
+		"target":            destURL,
+		"compressionMethod": backup.CompressionMethod,
+	}
+	if backup.SnapshotChecksum != "" {
+		predicate.BuildDefinition.ResolvedDependencies = []ProvenanceDescriptor{{
+			Name:   backup.SnapshotName,
+			Digest: map[string]string{"sha512": backup.SnapshotChecksum},
+		}}
+	}
+	builderID := getLastWriter()
+	if builderID == "" {
+		builderID, _ = os.Hostname()
+	}
+	predicate.RunDetails.Builder.ID = provenanceBuilderIDURI + builderID
+	predicate.RunDetails.Builder.Version = map[string]string{"backupstore": Version}
+	predicate.RunDetails.Metadata.InvocationID = backup.Name
+	predicate.RunDetails.Metadata.FinishedOn = backup.Prepared
+	if predicate.RunDetails.Metadata.FinishedOn == "" {
+		predicate.RunDetails.Metadata.FinishedOn = backup.CreatedTime
+	}
+	return statement
+}
+
+// saveBackupProvenance signs and saves the provenance of the backup if the signer is set
+func saveBackupProvenance(bsDriver BackupStoreDriver, backup *Backup, destURL string) error {
+	signer := getProvenanceSigner()
+	if signer == nil {
+		return nil
+	}
+	payload, err := json.Marshal(newBackupProvenanceStatement(backup, destURL))
+	if err != nil {
+		return err
+	}
+	signature, err := signer.Sign(getProvenancePAE(ProvenancePayloadType, payload))
+	if err != nil {
+		return errors.Wrapf(err, "failed to sign provenance of backup %v", backup.Name)
+	}
+	return SaveConfigInBackupStore(bsDriver, getBackupProvenancePath(bsDriver, backup.Name, backup.VolumeName),
+		&ProvenanceEnvelope{
+			PayloadType: ProvenancePayloadType,
+			Payload:     payload,
+			Signatures:  []ProvenanceSignature{{KeyID: signer.KeyID(), Sig: signature}},
+		})
+}
+
+// removeBackupProvenance removes the provenance of the deleted backup if there is one
+func removeBackupProvenance(bsDriver BackupStoreDriver, backupName, volumeName string) {
+	filePath := getBackupProvenancePath(bsDriver, backupName, volumeName)
+	if !bsDriver.FileExists(filePath) {
+		return
+	}
+	if err := bsDriver.Remove(filePath); err != nil {
+		log.WithError(err).Warnf("Failed to remove provenance %v of backup %v", filePath, backupName)
+	}
+}
+
+// checkBackupProvenanceSubject fails with ProvenanceError if the provenance of the backup doesn't match the backup
+// anymore, e.g. the blocks in the backup config are changed. The signature isn't verified, and the backups without
+// the provenance are not checked.
+func checkBackupProvenanceSubject(bsDriver BackupStoreDriver, backup *Backup) error {
+	filePath := getBackupProvenancePath(bsDriver, backup.Name, backup.VolumeName)
+	if !bsDriver.FileExists(filePath) {
+		return nil
+	}
+	envelope := &ProvenanceEnvelope{}
+	if err := LoadConfigInBackupStore(bsDriver, filePath, envelope); err != nil {
+		return err
+	}
+	statement := &ProvenanceStatement{}
+	if err := json.Unmarshal(envelope.Payload, statement); err != nil {
+		return &ProvenanceError{BackupName: backup.Name, VolumeName: backup.VolumeName,
+			Reason: fmt.Sprintf("invalid statement: %v", err)}
+	}
+	if !isProvenanceSubject(statement, backup) {
+		return &ProvenanceError{BackupName: backup.Name, VolumeName: backup.VolumeName,
+			Reason: fmt.Sprintf("subject doesn't match blocks digest %v of backup", getBackupBlocksDigest(backup))}
+	}
+	return nil
+}
+
+// ResignBackupProvenance signs the provenance of the backup again by the signer set by SetProvenanceSigner, e.g.
+// after the backup config is rewritten in place on purpose. The backup config isn't checked, so a tampered one
+// would be signed as trusted. It's only done on request, RepairBackupChain reports the mismatch instead.
+func ResignBackupProvenance(backupURL string) error {
+	if getProvenanceSigner() == nil {
+		return fmt.Errorf("cannot sign provenance without the signer")
+	}
+	bsDriver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return err
+	}
+	backupName, volumeName, _, err := DecodeBackupURL(backupURL)
+	if err != nil {
+		return err
+	}
+	if backupName == "" {
+		return fmt.Errorf("missing backup name in %v", backupURL)
+	}
+
+	// prevent racing with the deletion of the backup
+	lock, err := New(bsDriver, volumeName, DELETION_LOCK)
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	backup, err := loadBackup(bsDriver, backupName, volumeName)
+	if err != nil {
+		return err
+	}
+	if isBackupInProgress(backup) {
+		return fmt.Errorf("backup %v is still in progress", backup.Name)
+	}
+	if err := saveBackupProvenance(bsDriver, backup, bsDriver.GetURL()); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		LogFieldBackup: backupName,
+		LogFieldVolume: volumeName,
+	}).Warn("Signed backup provenance again on request")
+	return nil
+}
+
+// isProvenanceSubject checks if the backup is the subject of the provenance statement
+func isProvenanceSubject(statement *ProvenanceStatement, backup *Backup) bool {
+	name, digest := getProvenanceSubjectName(backup), getBackupBlocksDigest(backup)
+	for _, subject := range statement.Subject {
+		if subject.Name == name && subject.Digest[provenanceBlocksDigest] == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyBackupProvenance verifies the signature of the provenance of the backup and its subject against the backup
+func verifyBackupProvenance(bsDriver BackupStoreDriver, verifier ProvenanceVerifier, backup *Backup) (*ProvenanceStatement, error) {
+	newError := func(format string, args ...interface{}) error {
+		return &ProvenanceError{BackupName: backup.Name, VolumeName: backup.VolumeName, Reason: fmt.Sprintf(format, args...)}
+	}
+
+	filePath := getBackupProvenancePath(bsDriver, backup.Name, backup.VolumeName)
+	if !bsDriver.FileExists(filePath) {
+		return nil, newError("missing provenance")
+	}
+	envelope := &ProvenanceEnvelope{}
+	if err := LoadConfigInBackupStore(bsDriver, filePath, envelope); err != nil {
+		return nil, err
+	}
+	if envelope.PayloadType != ProvenancePayloadType {
+		return nil, newError("unknown payload type %v", envelope.PayloadType)
+	}
+
+	pae := getProvenancePAE(envelope.PayloadType, envelope.Payload)
+	verified := false
+	var lastErr error
+	for _, signature := range envelope.Signatures {
+		if lastErr = verifier.Verify(signature.KeyID, pae, signature.Sig); lastErr == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		if lastErr == nil {
+			return nil, newError("no signature")
+		}
+		return nil, newError("%v", lastErr)
+	}
+
+	statement := &ProvenanceStatement{}
+	if err := json.Unmarshal(envelope.Payload, statement); err != nil {
+		return nil, newError("invalid statement: %v", err)
+	}
+	if statement.Type != ProvenanceStatementType || statement.PredicateType != ProvenancePredicateType {
+		return nil, newError("unknown statement type %v with predicate type %v", statement.Type, statement.PredicateType)
+	}
+	if !isProvenanceSubject(statement, backup) {
+		return nil, newError("subject doesn't match blocks digest %v of backup", getBackupBlocksDigest(backup))
+	}
+	return statement, nil
+}
+
+// checkBackupProvenance verifies the provenance of the backup being restored if the verifier is set
+func checkBackupProvenance(bsDriver BackupStoreDriver, backup *Backup) error {
+	verifier, required := getProvenanceVerifier()
+	if verifier == nil {
+		return nil
+	}
+	if !required && !bsDriver.FileExists(getBackupProvenancePath(bsDriver, backup.Name, backup.VolumeName)) {
+		return nil
+	}
+	_, err := verifyBackupProvenance(bsDriver, verifier, backup)
+	return err
+}
+
+// VerifyBackupProvenance verifies the provenance of the backup by the verifier set by SetProvenanceVerifier, and
+// returns the verified statement
+func VerifyBackupProvenance(backupURL string) (*ProvenanceStatement, error) {
+	verifier, _ := getProvenanceVerifier()
+	if verifier == nil {
+		return nil, fmt.Errorf("cannot verify provenance without the verifier")
+	}
+	bsDriver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	backupName, volumeName, _, err := DecodeBackupURL(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	backup, err := loadBackup(bsDriver, backupName, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	return verifyBackupProvenance(bsDriver, verifier, backup)
+}
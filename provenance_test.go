@@ -0,0 +1,192 @@
+package backupstore
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/types"
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestBackupProvenance(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m, nil
+	})
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(err)
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(err)
+	SetProvenanceSigner(NewEd25519ProvenanceSigner("key-1", privateKey))
+	defer SetProvenanceSigner(nil)
+	defer SetProvenanceVerifier(nil, false)
+
+	assert.NoError(addVolume(m, &Volume{Name: "pvc-1", LastBackupName: "backup-1"}))
+	a, b := util.GetChecksum([]byte("a")), util.GetChecksum([]byte("b"))
+	backup := &Backup{Name: "backup-1", VolumeName: "pvc-1", SnapshotName: "snap-1", CompressionMethod: "lz4",
+		SnapshotChecksum: util.GetChecksum([]byte("snap-1")), CreatedTime: "2026-01-01T00:00:00Z",
+		Blocks: []BlockMapping{{Offset: DEFAULT_BLOCK_SIZE, BlockChecksum: b}, {Offset: 0, BlockChecksum: a}}}
+	assert.NoError(saveBackup(m, backup))
+	assert.NoError(saveBackupProvenance(m, backup, mockDriverURL))
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-2", VolumeName: "pvc-1", CreatedTime: "2026-01-01T00:00:00Z"}))
+
+	// the backup names aren't affected by the provenance next to the backup config
+	names, err := getBackupNamesForVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"backup-1", "backup-2"}, names)
+
+	backupURL := EncodeBackupURL("backup-1", "pvc-1", mockDriverURL)
+	_, err = VerifyBackupProvenance(backupURL)
+	assert.Error(err)
+	SetProvenanceVerifier(Ed25519ProvenanceKeys{"key-1": publicKey}, false)
+	statement, err := VerifyBackupProvenance(backupURL)
+	assert.NoError(err)
+	if assert.NotNil(statement) {
+		assert.Equal("pvc-1/backup-1", statement.Subject[0].Name)
+		assert.Equal("snap-1", statement.Predicate.BuildDefinition.ExternalParameters["snapshot"])
+		assert.Equal(mockDriverURL, statement.Predicate.BuildDefinition.ExternalParameters["target"])
+		assert.Equal(Version, statement.Predicate.RunDetails.Builder.Version["backupstore"])
+	}
+
+	// the provenance doesn't verify the modified backup or the untrusted key
+	backup.Blocks[0].BlockChecksum = a
+	assert.NoError(saveBackup(m, backup))
+	_, err = VerifyBackupProvenance(backupURL)
+	assert.True(IsProvenanceError(err), "%v", err)
+	assert.True(IsProvenanceError(checkBackupProvenance(m, backup)))
+	backup.Blocks[0].BlockChecksum = b
+	assert.NoError(saveBackup(m, backup))
+	assert.NoError(checkBackupProvenance(m, backup))
+	SetProvenanceVerifier(Ed25519ProvenanceKeys{"key-1": otherKey}, false)
+	assert.True(IsProvenanceError(checkBackupProvenance(m, backup)))
+
+	// the backups without the provenance are only rejected if it's required
+	backup2, err := loadBackup(m, "backup-2", "pvc-1")
+	assert.NoError(err)
+	assert.NoError(checkBackupProvenance(m, backup2))
+	SetProvenanceVerifier(Ed25519ProvenanceKeys{"key-1": publicKey}, true)
+	assert.True(IsProvenanceError(checkBackupProvenance(m, backup2)))
+
+	// the provenance is removed with the backup
+	assert.NoError(DeleteBackupsWithOptions(EncodeBackupURL("", "pvc-1", mockDriverURL), []string{"backup-1"},
+		&DeleteOptions{SkipTrash: true}))
+	assert.False(m.FileExists(getBackupProvenancePath(m, "backup-1", "pvc-1")))
+}
+
+func TestCopiedBackupProvenance(t *testing.T) {
+	assert := assert.New(t)
+
+	primary := &writableMockStoreDriver{&mockStoreDriver{}}
+	primary.Init()
+	defer primary.uninstall()
+	secondary := &writableMockStoreDriver{&mockStoreDriver{fs: afero.NewMemMapFs(), destURL: "mock://secondary"}}
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		if strings.HasPrefix(destURL, secondary.destURL) {
+			return secondary, nil
+		}
+		return primary, nil
+	})
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(err)
+	SetProvenanceSigner(NewEd25519ProvenanceSigner("key-1", privateKey))
+	defer SetProvenanceSigner(nil)
+	defer SetProvenanceVerifier(nil, false)
+
+	data := bytes.Repeat([]byte("a"), DEFAULT_BLOCK_SIZE)
+	summary := runDeltaBlockBackup("backup-1", &DeltaBackupConfig{
+		Volume:          &Volume{Name: "pvc-1", Size: DEFAULT_BLOCK_SIZE, CompressionMethod: "none"},
+		Snapshot:        &Snapshot{Name: "snap-1", CreatedTime: util.Now()},
+		DestURL:         mockDriverURL,
+		Source:          &memoryBlockSource{data: data, extents: []types.Mapping{{Offset: 0, Size: DEFAULT_BLOCK_SIZE}}},
+		ConcurrentLimit: 1,
+	})
+	assert.Equal(types.ProgressStateComplete, summary.State, "%v", summary.Error)
+	SetProvenanceSigner(nil)
+
+	backupURL, err := CopyBackup(EncodeBackupURL("backup-1", "pvc-1", mockDriverURL), secondary.destURL)
+	assert.NoError(err)
+	assert.True(secondary.FileExists(getBackupProvenancePath(secondary, "backup-1", "pvc-1")))
+
+	restore := func() error {
+		summaries := make(chan *RestoreSummary, 1)
+		filename := filepath.Join(t.TempDir(), "restored")
+		err := RestoreDeltaBlockBackup(&DeltaRestoreConfig{
+			BackupURL:       backupURL,
+			DeltaOps:        &fileRestoreOperations{},
+			Filename:        filename,
+			ConcurrentLimit: 1,
+			OnComplete: func(summary *RestoreSummary) {
+				summaries <- summary
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if summary := <-summaries; summary.Error != nil {
+			return summary.Error
+		}
+		restored, err := os.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		assert.True(bytes.Equal(data, restored))
+		return nil
+	}
+
+	// the copied backup is restored with the provenance required
+	SetProvenanceVerifier(Ed25519ProvenanceKeys{"key-1": publicKey}, true)
+	assert.NoError(restore())
+
+	// the provenance missing in the destination is copied by copying the backup again
+	assert.NoError(secondary.Remove(getBackupProvenancePath(secondary, "backup-1", "pvc-1")))
+	err = restore()
+	assert.True(IsProvenanceError(err), "%v", err)
+	_, err = CopyBackup(EncodeBackupURL("backup-1", "pvc-1", mockDriverURL), secondary.destURL)
+	assert.NoError(err)
+	assert.NoError(restore())
+
+	// the repaired backup still matches the provenance
+	_, err = RepairBackupChain(EncodeBackupURL("", "pvc-1", secondary.destURL))
+	assert.NoError(err)
+	_, err = VerifyBackupProvenance(backupURL)
+	assert.NoError(err)
+
+	// the repair reports the backup config tampered with instead of signing its provenance again
+	backup, err := loadBackup(secondary, "backup-1", "pvc-1")
+	assert.NoError(err)
+	backup.Blocks = append(backup.Blocks, BlockMapping{Offset: DEFAULT_BLOCK_SIZE, BlockChecksum: backup.Blocks[0].BlockChecksum})
+	assert.NoError(saveBackup(secondary, backup))
+	SetProvenanceSigner(NewEd25519ProvenanceSigner("key-1", privateKey))
+	report, err := RepairBackupChain(EncodeBackupURL("", "pvc-1", secondary.destURL))
+	assert.NoError(err)
+	assert.Contains(report.ProvenanceMismatches["backup-1"], "subject doesn't match")
+	_, err = VerifyBackupProvenance(backupURL)
+	assert.True(IsProvenanceError(err), "%v", err)
+	assert.True(IsProvenanceError(restore()))
+
+	// the backup rewritten in place on purpose is only signed again on request
+	assert.NoError(ResignBackupProvenance(backupURL))
+	_, err = VerifyBackupProvenance(backupURL)
+	assert.NoError(err)
+	report, err = RepairBackupChain(EncodeBackupURL("", "pvc-1", secondary.destURL))
+	assert.NoError(err)
+	assert.Empty(report.ProvenanceMismatches)
+	SetProvenanceSigner(nil)
+	assert.Error(ResignBackupProvenance(backupURL))
+}
@@ -0,0 +1,236 @@
+package backupstore
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+	"github.com/longhorn/backupstore/util"
+)
+
+// ErrQuotaExceeded is returned when the backup creation would exceed the quota of the backup volume
+var ErrQuotaExceeded = errors.New("backup volume quota exceeded")
+
+// VolumeQuota limits the backups kept in the backupstore for the volume
+type VolumeQuota struct {
+	// MaxBytes limits the physical bytes of the stored blocks and backup files, no limit if 0.
+	// The compressed blocks are estimated by the compression ratio of the backups, see getStoredBlockBytes.
+	MaxBytes int64 `json:",string,omitempty"`
+	// MaxBackupCount limits the number of the completed backups, no limit if 0
+	MaxBackupCount int `json:",omitempty"`
+	// AutoPrune deletes the oldest backups which are not deletion protected to free up the quota,
+	// instead of failing the backup creation
+	AutoPrune bool `json:",omitempty"`
+}
+
+// IsQuotaExceededError checks if the error is caused by exceeding the quota of the backup volume
+func IsQuotaExceededError(err error) bool {
+	return errors.Is(err, ErrQuotaExceeded)
+}
+
+// SetBackupVolumeQuota sets the quota of the backup volume, the quota is removed if quota is nil
+func SetBackupVolumeQuota(volumeName, destURL string, quota *VolumeQuota) error {
+	if !util.ValidateName(volumeName) {
+		return fmt.Errorf("invalid volume name %v", volumeName)
+	}
+	if quota != nil && (quota.MaxBytes < 0 || quota.MaxBackupCount < 0) {
+		return fmt.Errorf("invalid negative quota %+v", *quota)
+	}
+
+	bsDriver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return err
+	}
+
+	// prevent racing with the backup creation which updates the volume config
+	lock, err := New(bsDriver, volumeName, DELETION_LOCK)
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	volume, err := loadVolume(bsDriver, volumeName)
+	if err != nil {
+		return err
+	}
+	volume.Quota = quota
+	if err := saveVolume(bsDriver, volume); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		LogFieldVolume:  volumeName,
+		LogFieldDestURL: destURL,
+	}).Infof("Set backup volume quota to %+v", quota)
+	return nil
+}
+
+type volumeUsage struct {
+	bytes int64
+	// backups are the completed backups, the backups in progress, aborted or prepared are not counted since they
+	// cannot be pruned
+	backups []*Backup
+}
+
+func getVolumeUsage(bsDriver BackupStoreDriver, volume *Volume) (*volumeUsage, error) {
+	backupNames, err := getBackupNamesForVolume(bsDriver, volume.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &volumeUsage{}
+	for _, backupName := range backupNames {
+		backup, err := loadBackup(bsDriver, backupName, volume.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load backup %v for quota check", backupName)
+		}
+		if isBackupInProgress(backup) {
+			continue
+		}
+		if backup.SingleFile.FilePath != "" {
+			if size := bsDriver.FileSize(backup.SingleFile.FilePath); size > 0 {
+				usage.bytes += size
+			}
+		}
+		usage.backups = append(usage.backups, backup)
+	}
+	usage.bytes += getStoredBlockBytes(volume.BlockCount, usage.backups)
+	return usage, nil
+}
+
+// getStoredBlockBytes estimates the physical bytes of the stored blocks by the compression ratio of the blocks
+// uploaded by the backups, since the compressed size of each block isn't recorded. The blocks are counted with
+// DEFAULT_BLOCK_SIZE if none of the backups has the compression stats.
+func getStoredBlockBytes(blockCount int64, backups []*Backup) int64 {
+	var compressedBytes, uncompressedBytes int64
+	for _, backup := range backups {
+		if backup.CompressionStats == nil {
+			continue
+		}
+		compressedBytes += backup.CompressionStats.CompressedBytes
+		uncompressedBytes += backup.CompressionStats.UncompressedBytes
+	}
+
+	blockBytes := blockCount * DEFAULT_BLOCK_SIZE
+	if uncompressedBytes > 0 {
+		return int64(float64(blockBytes) * float64(compressedBytes) / float64(uncompressedBytes))
+	}
+	return blockBytes
+}
+
+func (q *VolumeQuota) getExceededReason(usage *volumeUsage) string {
+	// the backup being created adds one more backup
+	if q.MaxBackupCount > 0 && len(usage.backups)+1 > q.MaxBackupCount {
+		return fmt.Sprintf("%v backups reach the limit %v", len(usage.backups), q.MaxBackupCount)
+	}
+	if q.MaxBytes > 0 && usage.bytes >= q.MaxBytes {
+		return fmt.Sprintf("%v bytes reach the limit %v", usage.bytes, q.MaxBytes)
+	}
+	return ""
+}
+
+// getPruneCandidate returns the oldest completed backup which is not deletion protected
+func getPruneCandidate(backups []*Backup) *Backup {
+	candidates := []*Backup{}
+	for _, backup := range backups {
+		if isBackupInProgress(backup) || backup.DeletionProtected {
+			continue
+		}
+		candidates = append(candidates, backup)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].CreatedTime < candidates[j].CreatedTime
+	})
+	return candidates[0]
+}
+
+func pruneBackup(bsDriver BackupStoreDriver, backup *Backup) error {
+	if backup.SingleFile.FilePath == "" {
+		return deleteDeltaBlockBackup(bsDriver, backup.Name, backup.VolumeName, nil)
+	}
+	if err := bsDriver.Remove(backup.SingleFile.FilePath); err != nil {
+		return err
+	}
+	return removeBackup(backup, bsDriver)
+}
+
+// pruneBackupWithDeletionLock prunes the backup under the deletion lock, since the restores share the backup lock
+// and must not have the blocks removed underneath. The backup lock held by the caller is released meanwhile, and
+// acquired again after.
+func pruneBackupWithDeletionLock(bsDriver BackupStoreDriver, backup *Backup, backupLock *FileLock) error {
+	if err := backupLock.Unlock(); err != nil {
+		return err
+	}
+	pruneErr := func() error {
+		lock, err := New(bsDriver, backup.VolumeName, DELETION_LOCK)
+		if err != nil {
+			return err
+		}
+		if err := lock.Lock(); err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		return pruneBackup(bsDriver, backup)
+	}()
+	if err := backupLock.Lock(); err != nil {
+		return errors.Wrapf(err, "failed to acquire backup lock again after pruning backup %v", backup.Name)
+	}
+	return pruneErr
+}
+
+// checkVolumeQuota checks if one more backup can be created for the volume. If the quota is exceeded and
+// auto prune is enabled, the oldest backups are deleted until the quota is met. The volume without a quota takes
+// the default quota of the backup target. The caller should hold the backup lock, which is released while pruning.
+func checkVolumeQuota(bsDriver BackupStoreDriver, volumeName string, lock *FileLock) error {
+	volume, err := loadVolume(bsDriver, volumeName)
+	if err != nil {
+		return err
+	}
+	quota := volume.Quota
+	if quota == nil {
+		quota = getTargetConfig(bsDriver).DefaultQuota
+	}
+	if quota == nil {
+		return nil
+	}
+
+	log := log.WithFields(logrus.Fields{
+		LogFieldVolume:  volumeName,
+		LogFieldDestURL: bsDriver.GetURL(),
+	})
+
+	for {
+		usage, err := getVolumeUsage(bsDriver, volume)
+		if err != nil {
+			return err
+		}
+		reason := quota.getExceededReason(usage)
+		if reason == "" {
+			return nil
+		}
+
+		candidate := getPruneCandidate(usage.backups)
+		if !quota.AutoPrune || candidate == nil {
+			return errors.Wrapf(ErrQuotaExceeded, "volume %v: %v", volumeName, reason)
+		}
+
+		log.WithField(LogFieldBackup, candidate.Name).Infof("Pruning backup since the quota is exceeded: %v", reason)
+		if err := pruneBackupWithDeletionLock(bsDriver, candidate, lock); err != nil {
+			return errors.Wrapf(err, "failed to prune backup %v", candidate.Name)
+		}
+
+		// the block count is updated by the deletion
+		if volume, err = loadVolume(bsDriver, volumeName); err != nil {
+			return err
+		}
+	}
+}
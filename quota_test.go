@@ -0,0 +1,147 @@
+package backupstore
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/types"
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestVolumeQuotaExceededReason(t *testing.T) {
+	assert := assert.New(t)
+
+	usage := &volumeUsage{bytes: 2 * DEFAULT_BLOCK_SIZE, backups: []*Backup{{Name: "backup-1"}, {Name: "backup-2"}}}
+	assert.Empty((&VolumeQuota{}).getExceededReason(usage))
+	assert.Empty((&VolumeQuota{MaxBackupCount: 3, MaxBytes: 3 * DEFAULT_BLOCK_SIZE}).getExceededReason(usage))
+	assert.Equal("2 backups reach the limit 2", (&VolumeQuota{MaxBackupCount: 2}).getExceededReason(usage))
+	assert.Contains((&VolumeQuota{MaxBytes: 2 * DEFAULT_BLOCK_SIZE}).getExceededReason(usage), "bytes reach the limit")
+
+	// the oldest backup which is neither in progress nor protected is pruned first
+	backups := []*Backup{
+		{Name: "backup-3", CreatedTime: "2026-01-03T00:00:00Z"},
+		{Name: "backup-1", CreatedTime: "2026-01-01T00:00:00Z", DeletionProtected: true},
+		{Name: "backup-2", CreatedTime: "2026-01-02T00:00:00Z"},
+		{Name: "backup-0"},
+	}
+	assert.Equal("backup-2", getPruneCandidate(backups).Name)
+	assert.Nil(getPruneCandidate(backups[1:2]))
+
+	// the stored blocks are estimated by the compression ratio of the backups
+	assert.Equal(int64(4*DEFAULT_BLOCK_SIZE), getStoredBlockBytes(4, backups))
+	backups[0].CompressionStats = &CompressionStats{UncompressedBytes: 3 * DEFAULT_BLOCK_SIZE, CompressedBytes: DEFAULT_BLOCK_SIZE}
+	backups[2].CompressionStats = &CompressionStats{UncompressedBytes: DEFAULT_BLOCK_SIZE, CompressedBytes: DEFAULT_BLOCK_SIZE}
+	assert.Equal(int64(2*DEFAULT_BLOCK_SIZE), getStoredBlockBytes(4, backups))
+}
+
+func TestVolumeQuota(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m, nil
+	})
+
+	data := bytes.Repeat([]byte("a"), DEFAULT_BLOCK_SIZE)
+	source := &memoryBlockSource{data: data, extents: []types.Mapping{{Offset: 0, Size: DEFAULT_BLOCK_SIZE}}}
+	newConfig := func(volumeName, snapshotName string) *DeltaBackupConfig {
+		return &DeltaBackupConfig{
+			Volume:          &Volume{Name: volumeName, Size: DEFAULT_BLOCK_SIZE, CompressionMethod: "none"},
+			Snapshot:        &Snapshot{Name: snapshotName, CreatedTime: util.Now()},
+			DestURL:         mockDriverURL,
+			Source:          source,
+			ConcurrentLimit: 1,
+		}
+	}
+
+	for _, name := range []string{"backup-1", "backup-2"} {
+		summary := runDeltaBlockBackup(name, newConfig("pvc-1", "snap-"+name))
+		assert.Equal(types.ProgressStateComplete, summary.State, "%v", summary.Error)
+	}
+	assert.NoError(SetBackupVolumeQuota("pvc-1", mockDriverURL, &VolumeQuota{MaxBackupCount: 2}))
+	volume, err := loadVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal(&VolumeQuota{MaxBackupCount: 2}, volume.Quota)
+
+	// the aborted and prepared backups are not counted since they cannot be pruned
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-aborted", VolumeName: "pvc-1", Aborted: util.Now()}))
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-prepared", VolumeName: "pvc-1", Prepared: util.Now()}))
+	usage, err := getVolumeUsage(m, volume)
+	assert.NoError(err)
+	assert.Len(usage.backups, 2)
+	assert.Equal(int64(DEFAULT_BLOCK_SIZE), usage.bytes)
+	for _, name := range []string{"backup-aborted", "backup-prepared"} {
+		assert.NoError(m.Remove(getBackupConfigPath(m, name, "pvc-1")))
+	}
+
+	summary := runDeltaBlockBackup("backup-3", newConfig("pvc-1", "snap-3"))
+	assert.Equal(types.ProgressStateError, summary.State)
+	assert.True(IsQuotaExceededError(summary.Error))
+	_, err = loadBackup(m, "backup-3", "pvc-1")
+	assert.Error(err)
+
+	// the auto prune doesn't delete the blocks under a restore, which shares the lock with the backups
+	assert.NoError(SetBackupVolumeQuota("pvc-1", mockDriverURL, &VolumeQuota{MaxBackupCount: 2, AutoPrune: true}))
+	restoreLock, err := New(m, "pvc-1", RESTORE_LOCK)
+	assert.NoError(err)
+	assert.NoError(restoreLock.lockUncontended())
+	summary = runDeltaBlockBackup("backup-3", newConfig("pvc-1", "snap-3"))
+	assert.Equal(types.ProgressStateError, summary.State)
+	assert.True(IsLockBlockedError(summary.Error), "%v", summary.Error)
+	_, err = loadBackup(m, "backup-1", "pvc-1")
+	assert.NoError(err)
+	assert.NoError(restoreLock.Unlock())
+
+	// the oldest backup not protected is pruned
+	assert.NoError(SetBackupDeletionProtection(EncodeBackupURL("backup-1", "pvc-1", mockDriverURL), true))
+	summary = runDeltaBlockBackup("backup-3", newConfig("pvc-1", "snap-3"))
+	assert.Equal(types.ProgressStateComplete, summary.State, "%v", summary.Error)
+	names, err := getBackupNamesForVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"backup-1", "backup-3"}, names)
+	assert.Empty(getLockNamesForVolume("pvc-1", m))
+
+	// no backup can be pruned once all of them are protected
+	assert.NoError(SetBackupDeletionProtection(EncodeBackupURL("backup-3", "pvc-1", mockDriverURL), true))
+	summary = runDeltaBlockBackup("backup-4", newConfig("pvc-1", "snap-4"))
+	assert.True(IsQuotaExceededError(summary.Error), "%v", summary.Error)
+}
+
+func TestFirstBackupDefaultQuota(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m, nil
+	})
+	assert.NoError(SetTargetConfig(mockDriverURL, &TargetConfig{DefaultQuota: &VolumeQuota{MaxBackupCount: 1}}))
+	defer SetTargetConfig(mockDriverURL, nil)
+	SetFirstBackupFastPathEnabled(true)
+	defer SetFirstBackupFastPathEnabled(false)
+
+	data := bytes.Repeat([]byte("a"), DEFAULT_BLOCK_SIZE)
+	source := &memoryBlockSource{data: data, extents: []types.Mapping{{Offset: 0, Size: DEFAULT_BLOCK_SIZE}}}
+	newConfig := func(snapshotName string) *DeltaBackupConfig {
+		return &DeltaBackupConfig{
+			Volume:          &Volume{Name: "pvc-1", Size: DEFAULT_BLOCK_SIZE, CompressionMethod: "none"},
+			Snapshot:        &Snapshot{Name: snapshotName, CreatedTime: util.Now()},
+			DestURL:         mockDriverURL,
+			Source:          source,
+			ConcurrentLimit: 1,
+		}
+	}
+
+	// the first backup takes the fast path, the next one the regular path
+	summary := runDeltaBlockBackup("backup-1", newConfig("snap-1"))
+	assert.Equal(types.ProgressStateComplete, summary.State, "%v", summary.Error)
+	summary = runDeltaBlockBackup("backup-2", newConfig("snap-2"))
+	assert.True(IsQuotaExceededError(summary.Error), "%v", summary.Error)
+}
@@ -0,0 +1,337 @@
+package rclone
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/backupstore"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "rclone"})
+)
+
+// BackupStoreDriver stores the backups in any remote supported by rclone (e.g. Google Drive, Dropbox,
+// OneDrive or SFTP) by running the rclone binary. The remotes are configured in the rclone config file,
+// which can be pointed to by the RCLONE_CONFIG environment variable.
+type BackupStoreDriver struct {
+	destURL string
+	remote  string
+	path    string
+	binary  string
+}
+
+const (
+	KIND = "rclone"
+
+	DefaultBinary = "rclone"
+
+	// metadataTimeout bounds the commands not transferring any file data
+	metadataTimeout = 5 * time.Minute
+)
+
+// The exit codes of rclone, see https://rclone.org/docs/#exit-code
+const (
+	exitCodeDirNotFound  = 3
+	exitCodeFileNotFound = 4
+	exitCodeTemporary    = 5
+)
+
+func init() {
+	if err := backupstore.RegisterDriver(KIND, initFunc); err != nil {
+		panic(err)
+	}
+}
+
+func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
+	b := &BackupStoreDriver{}
+
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != KIND {
+		return nil, fmt.Errorf("BUG: Why dispatch %v to %v?", u.Scheme, KIND)
+	}
+
+	// rclone://remote/path maps to the rclone path remote:path, since remote:path is not a valid URL host
+	b.remote = u.Host
+	b.path = strings.TrimLeft(u.Path, "/")
+	if b.remote == "" || b.path == "" {
+		return nil, fmt.Errorf("invalid URL. Must be rclone://remote/path")
+	}
+
+	b.binary = getBinary()
+	if _, err := exec.LookPath(b.binary); err != nil {
+		return nil, fmt.Errorf("cannot find rclone binary %v: %v", b.binary, err)
+	}
+
+	//Test connection
+	if _, err := b.List(""); err != nil {
+		return nil, err
+	}
+
+	b.destURL = KIND + "://" + b.remote + "/" + b.path
+	log.Infof("Loaded driver for %v", b.destURL)
+	return b, nil
+}
+
+func getBinary() string {
+	binary := os.Getenv("RCLONE_BINARY")
+	if binary == "" {
+		return DefaultBinary
+	}
+	return binary
+}
+
+func (r *BackupStoreDriver) Kind() string {
+	return KIND
+}
+
+func (r *BackupStoreDriver) GetURL() string {
+	return r.destURL
+}
+
+// remotePath returns the rclone path of the file in the backupstore
+func (r *BackupStoreDriver) remotePath(path string) string {
+	return r.remote + ":" + filepath.Join(r.path, path)
+}
+
+// Error is returned when rclone fails. The not found errors match os.ErrNotExist.
+type Error struct {
+	Args     []string
+	ExitCode int
+	Output   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("failed to execute: rclone %v, exit code %v, output %v",
+		strings.Join(e.Args, " "), e.ExitCode, e.Output)
+}
+
+func (e *Error) Unwrap() error {
+	if e.IsNotFound() {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// IsNotFound checks if rclone failed because the file or directory doesn't exist
+func (e *Error) IsNotFound() bool {
+	return e.ExitCode == exitCodeDirNotFound || e.ExitCode == exitCodeFileNotFound
+}
+
+// Temporary checks if rclone failed because of a temporary error, so the command can be retried
+func (e *Error) Temporary() bool {
+	return e.ExitCode == exitCodeTemporary
+}
+
+func isNotFound(err error) bool {
+	rerr, ok := err.(*Error)
+	return ok && rerr.IsNotFound()
+}
+
+func (r *BackupStoreDriver) command(ctx context.Context, stdin io.Reader, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, r.binary, args...)
+	cmd.Stdin = stdin
+	return cmd
+}
+
+// run executes rclone and returns its standard output
+func (r *BackupStoreDriver) run(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := r.command(ctx, stdin, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, toError(args, err, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+func (r *BackupStoreDriver) runWithTimeout(args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), metadataTimeout)
+	defer cancel()
+	return r.run(ctx, nil, args...)
+}
+
+func toError(args []string, err error, output string) error {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return fmt.Errorf("failed to execute: rclone %v, error %v", strings.Join(args, " "), err)
+	}
+	return &Error{Args: args, ExitCode: exitErr.ExitCode(), Output: strings.TrimSpace(output)}
+}
+
+type fileInfo struct {
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+func (r *BackupStoreDriver) stat(filePath string) (*fileInfo, error) {
+	out, err := r.runWithTimeout("lsjson", "--stat", r.remotePath(filePath))
+	if err != nil {
+		return nil, err
+	}
+	info := &fileInfo{}
+	if err := json.Unmarshal(out, info); err != nil {
+		return nil, fmt.Errorf("failed to parse rclone stat of %v: %v", filePath, err)
+	}
+	return info, nil
+}
+
+func (r *BackupStoreDriver) FileExists(filePath string) bool {
+	return r.FileSize(filePath) >= 0
+}
+
+func (r *BackupStoreDriver) FileSize(filePath string) int64 {
+	info, err := r.stat(filePath)
+	if err != nil || info.IsDir {
+		return -1
+	}
+	return info.Size
+}
+
+func (r *BackupStoreDriver) FileTime(filePath string) time.Time {
+	info, err := r.stat(filePath)
+	if err != nil || info.IsDir {
+		return time.Time{}
+	}
+	return info.ModTime.UTC()
+}
+
+func (r *BackupStoreDriver) Remove(path string) error {
+	info, err := r.stat(path)
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if info.IsDir {
+		_, err = r.run(context.Background(), nil, "purge", r.remotePath(path))
+	} else {
+		_, err = r.runWithTimeout("deletefile", r.remotePath(path))
+	}
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// catReader streams the output of rclone cat, the failure of rclone is returned instead of io.EOF
+type catReader struct {
+	cmd    *exec.Cmd
+	args   []string
+	reader *bufio.Reader
+	stderr bytes.Buffer
+	done   bool
+	err    error
+}
+
+func (c *catReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	if err == io.EOF {
+		if werr := c.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (c *catReader) Close() error {
+	if !c.done {
+		_ = c.cmd.Process.Kill()
+		_ = c.wait()
+	}
+	return nil
+}
+
+func (c *catReader) wait() error {
+	if c.done {
+		return c.err
+	}
+	c.done = true
+	if err := c.cmd.Wait(); err != nil {
+		c.err = toError(c.args, err, c.stderr.String())
+	}
+	return c.err
+}
+
+func (r *BackupStoreDriver) Read(src string) (io.ReadCloser, error) {
+	args := []string{"cat", r.remotePath(src)}
+	c := &catReader{args: args}
+	c.cmd = r.command(context.Background(), nil, args...)
+	c.cmd.Stderr = &c.stderr
+	stdout, err := c.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	c.reader = bufio.NewReader(stdout)
+	if err := c.cmd.Start(); err != nil {
+		return nil, toError(args, err, "")
+	}
+
+	// Wait for the first data, so the missing files fail here instead of in the middle of the reading
+	if _, err := c.reader.Peek(1); err != nil {
+		if werr := c.wait(); werr != nil {
+			return nil, werr
+		}
+		if err != io.EOF {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (r *BackupStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	_, err := r.run(context.Background(), rs, "rcat", r.remotePath(dst))
+	return err
+}
+
+func (r *BackupStoreDriver) List(listPath string) ([]string, error) {
+	out, err := r.runWithTimeout("lsf", "--max-depth", "1", r.remotePath(listPath)+"/")
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		log.WithError(err).Error("Failed to list rclone remote")
+		return nil, err
+	}
+
+	var result []string
+	for _, line := range strings.Split(string(out), "\n") {
+		entry := strings.TrimSuffix(line, "/")
+		if entry != "" {
+			result = append(result, entry)
+		}
+	}
+	return result, nil
+}
+
+func (r *BackupStoreDriver) Upload(src, dst string) error {
+	_, err := r.run(context.Background(), nil, "copyto", src, r.remotePath(dst))
+	return err
+}
+
+func (r *BackupStoreDriver) Download(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModeDir|0700); err != nil {
+		return err
+	}
+	_, err := r.run(context.Background(), nil, "copyto", r.remotePath(src), dst)
+	return err
+}
@@ -0,0 +1,114 @@
+package rclone
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRclone implements the rclone commands used by the driver for the remote "test" on top of FAKE_RCLONE_ROOT
+const fakeRclone = `#!/bin/sh
+cmd=$1
+shift
+for arg; do last=$arg; done
+local_path() { echo "$FAKE_RCLONE_ROOT/${1#test:}"; }
+case $cmd in
+lsf)
+	p=$(local_path "$last")
+	[ -d "$p" ] || exit 3
+	for f in "$p"/*; do
+		[ -e "$f" ] || continue
+		if [ -d "$f" ]; then echo "$(basename "$f")/"; else basename "$f"; fi
+	done ;;
+lsjson)
+	p=$(local_path "$last")
+	[ -e "$p" ] || exit 4
+	if [ -d "$p" ]; then
+		echo '{"Size":-1,"IsDir":true,"ModTime":"2023-01-01T00:00:00Z"}'
+	else
+		echo "{\"Size\":$(stat -c %s "$p"),\"IsDir\":false,\"ModTime\":\"2023-01-01T00:00:00Z\"}"
+	fi ;;
+cat)
+	p=$(local_path "$1")
+	[ -f "$p" ] || { echo "object not found" >&2; exit 4; }
+	cat "$p" ;;
+rcat)
+	p=$(local_path "$1")
+	mkdir -p "$(dirname "$p")" && cat > "$p" ;;
+copyto)
+	case $1 in
+	test:*) cp "$(local_path "$1")" "$2" ;;
+	*) p=$(local_path "$2"); mkdir -p "$(dirname "$p")" && cp "$1" "$p" ;;
+	esac ;;
+deletefile)
+	rm "$(local_path "$1")" ;;
+purge)
+	rm -r "$(local_path "$1")" ;;
+*)
+	exit 1 ;;
+esac
+`
+
+func TestDriver(t *testing.T) {
+	assert := assert.New(t)
+
+	binary := filepath.Join(t.TempDir(), "rclone")
+	assert.NoError(os.WriteFile(binary, []byte(fakeRclone), 0700))
+	t.Setenv("RCLONE_BINARY", binary)
+	t.Setenv("FAKE_RCLONE_ROOT", t.TempDir())
+
+	_, err := initFunc("rclone://test")
+	assert.Error(err)
+
+	driver, err := initFunc("rclone://test/backups")
+	assert.NoError(err)
+	assert.Equal("rclone://test/backups", driver.GetURL())
+
+	dst := "backupstore/volumes/vol/volume.cfg"
+	assert.False(driver.FileExists(dst))
+	assert.NoError(driver.Write(dst, bytes.NewReader([]byte("config"))))
+	assert.Equal(int64(len("config")), driver.FileSize(dst))
+	assert.False(driver.FileTime(dst).IsZero())
+
+	rc, err := driver.Read(dst)
+	assert.NoError(err)
+	data, err := io.ReadAll(rc)
+	assert.NoError(err)
+	assert.NoError(rc.Close())
+	assert.Equal("config", string(data))
+
+	_, err = driver.Read("backupstore/nonexistent")
+	assert.True(errors.Is(err, os.ErrNotExist))
+
+	src := filepath.Join(t.TempDir(), "upload")
+	assert.NoError(os.WriteFile(src, []byte("uploaded"), 0600))
+	assert.NoError(driver.Upload(src, "backupstore/volumes/vol/upload"))
+	downloaded := filepath.Join(t.TempDir(), "download", "file")
+	assert.NoError(driver.Download("backupstore/volumes/vol/upload", downloaded))
+	data, err = os.ReadFile(downloaded)
+	assert.NoError(err)
+	assert.Equal("uploaded", string(data))
+
+	entries, err := driver.List("backupstore/volumes")
+	assert.NoError(err)
+	assert.Equal([]string{"vol"}, entries)
+	entries, err = driver.List("backupstore/volumes/vol")
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"upload", "volume.cfg"}, entries)
+	entries, err = driver.List("backupstore/nonexistent")
+	assert.NoError(err)
+	assert.Empty(entries)
+
+	assert.NoError(driver.Remove(dst))
+	assert.False(driver.FileExists(dst))
+	assert.NoError(driver.Remove("backupstore/volumes"))
+	assert.NoError(driver.Remove("backupstore/volumes"))
+	entries, err = driver.List("backupstore")
+	assert.NoError(err)
+	assert.Empty(entries)
+}
@@ -0,0 +1,45 @@
+package backupstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type readOnlyMockStoreDriver struct {
+	*writableMockStoreDriver
+}
+
+func (m *readOnlyMockStoreDriver) IsReadOnly() bool {
+	return true
+}
+
+func TestReadOnlyDriverLock(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	readOnly := &readOnlyMockStoreDriver{m}
+	assert.True(isReadOnlyDriver(readOnly))
+	assert.False(isReadOnlyDriver(m))
+
+	// the lock is acquired without being stored
+	lock, err := New(readOnly, "pvc-1", RESTORE_LOCK)
+	assert.NoError(err)
+	assert.NoError(lock.Lock())
+	assert.True(lock.Acquired)
+	assert.False(m.FileExists(getLockFilePath(m, "pvc-1", lock.Name)))
+	assert.NoError(lock.Unlock())
+
+	// the locks stored by the other clients still block it
+	deletion, err := New(m, "pvc-1", DELETION_LOCK)
+	assert.NoError(err)
+	deletion.Acquired = true
+	assert.NoError(saveLock(deletion))
+	lock, err = New(readOnly, "pvc-1", RESTORE_LOCK)
+	assert.NoError(err)
+	assert.True(IsLockBlockedError(lock.Lock()))
+	assert.False(lock.Acquired)
+	assert.True(m.FileExists(getLockFilePath(m, "pvc-1", deletion.Name)))
+}
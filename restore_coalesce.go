@@ -0,0 +1,128 @@
+package backupstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// MAX_RESTORE_COALESCE_SIZE is the largest write the contiguous blocks are coalesced into during restore
+	MAX_RESTORE_COALESCE_SIZE = 64 * 1024 * 1024
+)
+
+// getRestoreCoalesceBlocks returns the number of the contiguous blocks written at once
+func getRestoreCoalesceBlocks(config *DeltaRestoreConfig) (int, error) {
+	size := config.CoalesceSize
+	if size == 0 {
+		return 1, nil
+	}
+	if size < 0 || size > MAX_RESTORE_COALESCE_SIZE || size%DEFAULT_BLOCK_SIZE != 0 {
+		return 0, fmt.Errorf("invalid coalesce size %v, must be a multiple of %v up to %v",
+			size, DEFAULT_BLOCK_SIZE, MAX_RESTORE_COALESCE_SIZE)
+	}
+	return int(size / DEFAULT_BLOCK_SIZE), nil
+}
+
+// coalesceBlockRuns groups the contiguous blocks into the runs of up to maxBlocks blocks, the zero blocks and
+// the blocks with data are grouped separately. The blocks are only coalesced if they are sorted by offset.
+func coalesceBlockRuns(ctx context.Context, in <-chan *Block, maxBlocks int) <-chan []*Block {
+	out := make(chan []*Block, 10)
+
+	go func() {
+		defer close(out)
+
+		var run []*Block
+		flush := func() bool {
+			if len(run) == 0 {
+				return true
+			}
+			select {
+			case out <- run:
+				run = nil
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for block := range in {
+			if len(run) > 0 {
+				last := run[len(run)-1]
+				if len(run) >= maxBlocks || block.isZeroBlock != last.isZeroBlock ||
+					block.offset != last.offset+DEFAULT_BLOCK_SIZE {
+					if !flush() {
+						return
+					}
+				}
+			}
+			run = append(run, block)
+		}
+		flush()
+	}()
+
+	return out
+}
+
+// restoreBlockRun restores the contiguous blocks by a single write, or a single zero fill for the zero blocks.
+// The write time is split evenly between the blocks in the profile.
+func restoreBlockRun(bsDriver BackupStoreDriver, deltaOps DeltaRestoreOperations, volumeName string, volDev *os.File,
+	run []*Block, runBuf []byte, zeroStrategy ZeroBlockStrategy, progress *progress, profiler *restoreProfiler,
+	workerID int) (err error) {
+	blockProfiles := make([]RestoreBlockProfile, len(run))
+	downloadBytes := make([]int64, len(run))
+	for i, block := range run {
+		blockProfiles[i] = RestoreBlockProfile{
+			Offset:        block.offset,
+			BlockChecksum: block.blockChecksum,
+		}
+	}
+	defer func() {
+		for i, block := range run {
+			completeRestoreBlock(deltaOps, volumeName, progress, profiler, workerID, blockProfiles[i], downloadBytes[i],
+				block.isZeroBlock, err)
+		}
+	}()
+
+	length := int64(len(run)) * DEFAULT_BLOCK_SIZE
+	if run[0].isZeroBlock {
+		start := time.Now()
+		err = fillZeros(volDev, zeroStrategy, run[0].offset, length, profiler)
+		splitRunWriteTime(blockProfiles, time.Since(start))
+		return err
+	}
+
+	buf := blockBuffers.Get()
+	defer blockBuffers.Put(buf)
+	for i, block := range run {
+		start := time.Now()
+		buf.Reset()
+		downloadBytes[i], err = readRestoreBlock(progress.group, bsDriver, volumeName, block.compressionMethod,
+			BlockMapping{
+				Offset:        block.offset,
+				BlockChecksum: block.blockChecksum,
+			}, &blockProfiles[i], buf)
+		if err != nil {
+			return err
+		}
+		if buf.Len() != DEFAULT_BLOCK_SIZE {
+			return fmt.Errorf("invalid size %v of block %v", buf.Len(), block.blockChecksum)
+		}
+		copy(runBuf[int64(i)*DEFAULT_BLOCK_SIZE:], buf.Bytes())
+		blockProfiles[i].Duration = time.Since(start)
+	}
+
+	start := time.Now()
+	_, err = volDev.WriteAt(runBuf[:length], run[0].offset)
+	splitRunWriteTime(blockProfiles, time.Since(start))
+	return err
+}
+
+func splitRunWriteTime(blockProfiles []RestoreBlockProfile, write time.Duration) {
+	share := write / time.Duration(len(blockProfiles))
+	for i := range blockProfiles {
+		blockProfiles[i].Write = share
+		blockProfiles[i].Duration += share
+	}
+}
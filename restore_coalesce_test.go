@@ -0,0 +1,109 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+type mockRestoreOperations struct {
+	progress int
+}
+
+func (m *mockRestoreOperations) OpenVolumeDev(volDevName string) (*os.File, string, error) {
+	return nil, "", nil
+}
+
+func (m *mockRestoreOperations) CloseVolumeDev(volDev *os.File) error { return nil }
+
+func (m *mockRestoreOperations) UpdateRestoreStatus(snapshot string, restoreProgress int, err error) {
+	m.progress = restoreProgress
+}
+
+func (m *mockRestoreOperations) Stop() {}
+
+func (m *mockRestoreOperations) GetStopChan() chan struct{} { return nil }
+
+func TestCoalesceBlockRuns(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := getRestoreCoalesceBlocks(&DeltaRestoreConfig{CoalesceSize: DEFAULT_BLOCK_SIZE + 1})
+	assert.Error(err)
+	_, err = getRestoreCoalesceBlocks(&DeltaRestoreConfig{CoalesceSize: 2 * MAX_RESTORE_COALESCE_SIZE})
+	assert.Error(err)
+	blocks, err := getRestoreCoalesceBlocks(&DeltaRestoreConfig{CoalesceSize: 32 * 1024 * 1024})
+	assert.NoError(err)
+	assert.Equal(16, blocks)
+
+	in := make(chan *Block, 10)
+	for _, i := range []int64{0, 1, 2, 3, 5, 6} {
+		in <- &Block{offset: i * DEFAULT_BLOCK_SIZE}
+	}
+	in <- &Block{offset: 7 * DEFAULT_BLOCK_SIZE, isZeroBlock: true}
+	close(in)
+
+	runs := [][]int64{}
+	for run := range coalesceBlockRuns(context.Background(), in, 3) {
+		offsets := []int64{}
+		for _, block := range run {
+			offsets = append(offsets, block.offset/DEFAULT_BLOCK_SIZE)
+		}
+		runs = append(runs, offsets)
+	}
+	assert.Equal([][]int64{{0, 1, 2}, {3}, {5, 6}, {7}}, runs)
+}
+
+func TestRestoreBlockRun(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	run := []*Block{}
+	expected := []byte{}
+	for i, pattern := range []string{"first", "second"} {
+		data := bytes.Repeat([]byte(pattern), DEFAULT_BLOCK_SIZE/len(pattern)+1)[:DEFAULT_BLOCK_SIZE]
+		checksum := util.GetChecksum(data)
+		compressed, err := util.CompressData("lz4", data)
+		assert.NoError(err)
+		assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", checksum), compressed))
+		run = append(run, &Block{
+			offset:            int64(i+1) * DEFAULT_BLOCK_SIZE,
+			blockChecksum:     checksum,
+			compressionMethod: "lz4",
+		})
+		expected = append(expected, data...)
+	}
+
+	volDev, err := os.Create(filepath.Join(t.TempDir(), "volume"))
+	assert.NoError(err)
+	defer volDev.Close()
+
+	deltaOps := &mockRestoreOperations{}
+	profiler := newRestoreProfiler()
+	runBuf := make([]byte, 2*DEFAULT_BLOCK_SIZE)
+	assert.NoError(restoreBlockRun(m, deltaOps, "pvc-1", volDev, run, runBuf, ZeroBlockStrategyAllocate,
+		&progress{totalBlockCounts: 2}, profiler, 0))
+
+	restored := make([]byte, 2*DEFAULT_BLOCK_SIZE)
+	_, err = volDev.ReadAt(restored, DEFAULT_BLOCK_SIZE)
+	assert.NoError(err)
+	assert.Equal(expected, restored)
+	assert.Equal(getProgress(2, 2), deltaOps.progress)
+	profile := profiler.finish()
+	assert.Equal(int64(2), profile.BlockCount)
+	assert.Greater(profile.DownloadBytes, int64(0))
+	assert.Equal(int64(2*DEFAULT_BLOCK_SIZE), profile.WriteBytes)
+
+	// the missing block fails the whole run
+	run[1].blockChecksum = util.GetChecksum([]byte("missing"))
+	assert.Error(restoreBlockRun(m, deltaOps, "pvc-1", volDev, run, runBuf, ZeroBlockStrategyAllocate,
+		&progress{totalBlockCounts: 2}, newRestoreProfiler(), 0))
+}
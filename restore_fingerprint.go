@@ -0,0 +1,100 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+// getFingerprintZeroBlockStrategy returns the zero block strategy clearing the stale data of the local volume,
+// since the allocate and skip strategies keep the data of the blocks
+func getFingerprintZeroBlockStrategy(strategy ZeroBlockStrategy) ZeroBlockStrategy {
+	switch strategy {
+	case ZeroBlockStrategyAllocate, ZeroBlockStrategySkip:
+		return ZeroBlockStrategyWriteZeros
+	}
+	return strategy
+}
+
+// populateBlocksForFingerprintRestore fingerprints the local volume block by block, and populates the blocks of the
+// backup differing from the local ones and the zero blocks for the local blocks with data outside of the backup.
+// The local blocks already matching the backup are completed right away without being downloaded.
+func populateBlocksForFingerprintRestore(ctx context.Context, volDevPath string, volumeSize int64, backup *Backup,
+	deltaOps DeltaRestoreOperations, volumeName string, progress *progress, profiler *restoreProfiler) (<-chan *Block, <-chan error) {
+	blockChan := make(chan *Block, 10)
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer close(blockChan)
+		defer close(errChan)
+
+		volDev, err := os.Open(volDevPath)
+		if err != nil {
+			errChan <- errors.Wrapf(err, "failed to open %v for fingerprinting", volDevPath)
+			return
+		}
+		defer volDev.Close()
+
+		buf := make([]byte, DEFAULT_BLOCK_SIZE)
+		b := 0
+		for offset := int64(0); offset < volumeSize; offset += DEFAULT_BLOCK_SIZE {
+			start := time.Now()
+			n, err := volDev.ReadAt(buf, offset)
+			if err != nil && err != io.EOF {
+				errChan <- errors.Wrapf(err, "failed to fingerprint block at offset %v", offset)
+				return
+			}
+			// the data beyond the end of the volume is read as zeros
+			copy(buf[n:], zeroBlock)
+
+			var block *Block
+			for b < len(backup.Blocks) && backup.Blocks[b].Offset < offset {
+				b++
+			}
+			if b < len(backup.Blocks) && backup.Blocks[b].Offset == offset {
+				if util.GetChecksum(buf) != backup.Blocks[b].BlockChecksum {
+					block = &Block{
+						offset:            offset,
+						blockChecksum:     backup.Blocks[b].BlockChecksum,
+						compressionMethod: getBlockCompressionMethod(backup, backup.Blocks[b]),
+					}
+				}
+			} else if !bytes.Equal(buf, zeroBlock) {
+				block = &Block{
+					offset:      offset,
+					isZeroBlock: true,
+				}
+			}
+			profiler.recordFingerprint(time.Since(start), block == nil)
+
+			if block == nil {
+				completeUnchangedRestoreBlock(deltaOps, volumeName, progress)
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case blockChan <- block:
+			}
+		}
+	}()
+
+	return blockChan, errChan
+}
+
+// completeUnchangedRestoreBlock updates the restore progress for the local block matching the backup
+func completeUnchangedRestoreBlock(deltaOps DeltaRestoreOperations, volumeName string, progress *progress) {
+	progress.Lock()
+	defer progress.Unlock()
+
+	progress.processedBlockCounts++
+	progress.progress = getProgress(progress.totalBlockCounts, progress.processedBlockCounts)
+	progress.reportLockProgress()
+	deltaOps.UpdateRestoreStatus(volumeName, progress.progress, nil)
+}
@@ -0,0 +1,89 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestFingerprintRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	newBlock := func(pattern string) []byte {
+		return bytes.Repeat([]byte(pattern), DEFAULT_BLOCK_SIZE/len(pattern)+1)[:DEFAULT_BLOCK_SIZE]
+	}
+	backup := &Backup{Name: "backup-1", VolumeName: "pvc-1", CompressionMethod: "lz4"}
+	expected := []byte{}
+	for i, pattern := range []string{"unchanged", "changed", "", "", "tail"} {
+		data := make([]byte, DEFAULT_BLOCK_SIZE)
+		if pattern != "" {
+			data = newBlock(pattern)
+			checksum := util.GetChecksum(data)
+			compressed, err := util.CompressData("lz4", data)
+			assert.NoError(err)
+			assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", checksum), compressed))
+			backup.Blocks = append(backup.Blocks, BlockMapping{Offset: int64(i) * DEFAULT_BLOCK_SIZE, BlockChecksum: checksum})
+		}
+		expected = append(expected, data...)
+	}
+
+	// the local volume is stale, and shorter than the volume in the backup
+	volDevPath := filepath.Join(t.TempDir(), "volume")
+	local := append(newBlock("unchanged"), newBlock("stale")...)
+	local = append(local, newBlock("removed")...)
+	local = append(local, make([]byte, DEFAULT_BLOCK_SIZE)...)
+	assert.NoError(os.WriteFile(volDevPath, local, 0644))
+	volDev, err := os.OpenFile(volDevPath, os.O_RDWR, 0644)
+	assert.NoError(err)
+	defer volDev.Close()
+
+	deltaOps := &mockRestoreOperations{}
+	profiler := newRestoreProfiler()
+	progress := &progress{totalBlockCounts: 5}
+	blockChan, errChan := populateBlocksForFingerprintRestore(context.Background(), volDevPath, 5*DEFAULT_BLOCK_SIZE,
+		backup, deltaOps, "pvc-1", progress, profiler)
+	blocks := []*Block{}
+	for block := range blockChan {
+		blocks = append(blocks, block)
+	}
+	assert.NoError(<-errChan)
+
+	// only the changed block, the stale block outside of the backup and the missing tail are restored
+	if !assert.Len(blocks, 3) {
+		return
+	}
+	assert.Equal(int64(DEFAULT_BLOCK_SIZE), blocks[0].offset)
+	assert.Equal(backup.Blocks[1].BlockChecksum, blocks[0].blockChecksum)
+	assert.Equal(int64(2*DEFAULT_BLOCK_SIZE), blocks[1].offset)
+	assert.True(blocks[1].isZeroBlock)
+	assert.Equal(int64(4*DEFAULT_BLOCK_SIZE), blocks[2].offset)
+	assert.Equal(getProgress(5, 2), deltaOps.progress)
+
+	zeroStrategy := getFingerprintZeroBlockStrategy(ZeroBlockStrategyAllocate)
+	assert.Equal(ZeroBlockStrategyWriteZeros, zeroStrategy)
+	assert.Equal(ZeroBlockStrategyPunchHole, getFingerprintZeroBlockStrategy(ZeroBlockStrategyPunchHole))
+	for _, block := range blocks {
+		assert.NoError(restoreBlock(m, deltaOps, "pvc-1", volDev, block, zeroStrategy, progress, profiler, 0))
+	}
+	assert.Equal(getProgress(5, 5), deltaOps.progress)
+
+	restored, err := os.ReadFile(volDevPath)
+	assert.NoError(err)
+	assert.True(bytes.Equal(expected, restored))
+
+	profile := profiler.finish()
+	assert.Equal(int64(2), profile.UnchangedBlockCount)
+	assert.Equal(int64(3), profile.BlockCount)
+	assert.Equal(int64(1), profile.ZeroBlockCount)
+	assert.Greater(profile.Fingerprint, int64(0))
+}
@@ -0,0 +1,607 @@
+package backupstore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RestoreOutputFormat is the image format RestoreDeltaBlockBackup writes the volume in
+type RestoreOutputFormat string
+
+const (
+	// RestoreOutputFormatRaw writes the blocks at their offsets of the volume device, which is the default
+	RestoreOutputFormatRaw = RestoreOutputFormat("raw")
+	// RestoreOutputFormatVHD streams a dynamic VHD, which Hyper-V imports directly or converts to VHDX. The volume
+	// must not be larger than MAX_VHD_SIZE.
+	RestoreOutputFormatVHD = RestoreOutputFormat("vhd")
+	// RestoreOutputFormatVMDK streams a streamOptimized VMDK, which vSphere imports as an OVF disk
+	RestoreOutputFormatVMDK = RestoreOutputFormat("vmdk")
+)
+
+const (
+	// MAX_VHD_SIZE is the maximal disk size of the VHD format
+	MAX_VHD_SIZE = 2040 * 1024 * 1024 * 1024
+
+	imageSectorSize = 512
+
+	vhdFooterSize        = 512
+	vhdDynamicHeaderSize = 1024
+	// vhdBlockSize is the block size of the dynamic VHD, the same as the blocks of the backup
+	vhdBlockSize = DEFAULT_BLOCK_SIZE
+	// vhdBlockBitmapSize is the sector bitmap in front of each VHD block, padded to a sector
+	vhdBlockBitmapSize = imageSectorSize
+	vhdUnusedBlock     = 0xFFFFFFFF
+
+	// vmdkGrainSize is the grain size of the streamOptimized VMDK in bytes, which is the unit of the compression
+	vmdkGrainSize = 64 * 1024
+	vmdkGTEsPerGT = 512
+	// vmdkOverhead is the metadata in front of the first grain in sectors, the header and the descriptor
+	vmdkOverhead = vmdkGrainSize / imageSectorSize
+
+	vmdkMarkerGT     = 1
+	vmdkMarkerGD     = 2
+	vmdkMarkerFooter = 3
+)
+
+// vhdEpoch is the time the VHD timestamps count the seconds from
+var vhdEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// imageWriter streams the blocks of the volume as a disk image. The blocks must be written in ascending offset order,
+// so the image can be written to a pipe or a device.
+type imageWriter interface {
+	WriteBlock(offset int64, data []byte) error
+	Close() error
+}
+
+// getRestoreOutputFormat returns the output format of the restore, RestoreOutputFormatRaw by default. The image
+// formats write the volume as a stream, so they don't take the options writing the volume device in place.
+func getRestoreOutputFormat(config *DeltaRestoreConfig) (RestoreOutputFormat, error) {
+	switch config.OutputFormat {
+	case "", RestoreOutputFormatRaw:
+		return RestoreOutputFormatRaw, nil
+	case RestoreOutputFormatVHD, RestoreOutputFormatVMDK:
+		if config.FingerprintLocal {
+			return "", fmt.Errorf("output format %v cannot restore with FingerprintLocal", config.OutputFormat)
+		}
+		if config.CoalesceSize != 0 {
+			return "", fmt.Errorf("output format %v cannot restore with CoalesceSize", config.OutputFormat)
+		}
+		return config.OutputFormat, nil
+	}
+	return "", fmt.Errorf("invalid restore output format %v", config.OutputFormat)
+}
+
+// newImageWriter returns the writer of the image format for the volume of the size with the blocks at the offsets
+func newImageWriter(format RestoreOutputFormat, w io.Writer, name string, size int64, offsets []int64) (imageWriter, error) {
+	switch format {
+	case RestoreOutputFormatVHD:
+		return newVHDWriter(w, size, offsets)
+	case RestoreOutputFormatVMDK:
+		return newVMDKWriter(w, name, size)
+	}
+	return nil, fmt.Errorf("invalid image output format %v", format)
+}
+
+// vhdWriter writes a dynamic VHD. The block allocation table is known from the offsets of the blocks of the backup,
+// so it's written ahead of the blocks, and the blocks not in the backup are left unallocated.
+type vhdWriter struct {
+	w       io.Writer
+	footer  []byte
+	offsets []int64
+	// next is the index of the next block expected in offsets
+	next   int
+	bitmap []byte
+}
+
+func newVHDWriter(w io.Writer, size int64, offsets []int64) (*vhdWriter, error) {
+	if size <= 0 || size%vhdBlockSize != 0 || size > MAX_VHD_SIZE {
+		return nil, fmt.Errorf("invalid volume size %v for VHD, must be a multiple of %v up to %v",
+			size, vhdBlockSize, int64(MAX_VHD_SIZE))
+	}
+
+	blockCount := size / vhdBlockSize
+	batOffset := int64(vhdFooterSize + vhdDynamicHeaderSize)
+	batSize := alignUp(blockCount*4, imageSectorSize)
+	footer, err := newVHDFooter(size, uint64(vhdFooterSize))
+	if err != nil {
+		return nil, err
+	}
+
+	bat := make([]byte, batSize)
+	for i := int64(0); i < batSize/4; i++ {
+		binary.BigEndian.PutUint32(bat[i*4:], vhdUnusedBlock)
+	}
+	sector := (batOffset + batSize) / imageSectorSize
+	for _, offset := range offsets {
+		if offset < 0 || offset >= size || offset%vhdBlockSize != 0 {
+			return nil, fmt.Errorf("invalid block offset %v for VHD of size %v", offset, size)
+		}
+		binary.BigEndian.PutUint32(bat[offset/vhdBlockSize*4:], uint32(sector))
+		sector += (vhdBlockBitmapSize + vhdBlockSize) / imageSectorSize
+	}
+
+	header := make([]byte, vhdDynamicHeaderSize)
+	copy(header[0:8], "cxsparse")
+	binary.BigEndian.PutUint64(header[8:], 0xFFFFFFFFFFFFFFFF)
+	binary.BigEndian.PutUint64(header[16:], uint64(batOffset))
+	binary.BigEndian.PutUint32(header[24:], 0x00010000)
+	binary.BigEndian.PutUint32(header[28:], uint32(blockCount))
+	binary.BigEndian.PutUint32(header[32:], vhdBlockSize)
+	binary.BigEndian.PutUint32(header[36:], vhdChecksum(header))
+
+	bitmap := make([]byte, vhdBlockBitmapSize)
+	for i := range bitmap {
+		bitmap[i] = 0xFF
+	}
+
+	// the copy of the footer at the start of the file is the same as the one at the end
+	for _, data := range [][]byte{footer, header, bat} {
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	return &vhdWriter{w: w, footer: footer, offsets: offsets, bitmap: bitmap}, nil
+}
+
+func (v *vhdWriter) WriteBlock(offset int64, data []byte) error {
+	if v.next >= len(v.offsets) || v.offsets[v.next] != offset || int64(len(data)) != vhdBlockSize {
+		return fmt.Errorf("unexpected block at offset %v of size %v for VHD", offset, len(data))
+	}
+	if _, err := v.w.Write(v.bitmap); err != nil {
+		return err
+	}
+	if _, err := v.w.Write(data); err != nil {
+		return err
+	}
+	v.next++
+	return nil
+}
+
+func (v *vhdWriter) Close() error {
+	if v.next != len(v.offsets) {
+		return fmt.Errorf("VHD is incomplete, %v of %v blocks written", v.next, len(v.offsets))
+	}
+	_, err := v.w.Write(v.footer)
+	return err
+}
+
+// newVHDFooter returns the footer of the dynamic VHD of the size, whose dynamic header is at the header offset
+func newVHDFooter(size int64, headerOffset uint64) ([]byte, error) {
+	footer := make([]byte, vhdFooterSize)
+	copy(footer[0:8], "conectix")
+	binary.BigEndian.PutUint32(footer[8:], 0x00000002)
+	binary.BigEndian.PutUint32(footer[12:], 0x00010000)
+	binary.BigEndian.PutUint64(footer[16:], headerOffset)
+	binary.BigEndian.PutUint32(footer[24:], uint32(time.Since(vhdEpoch)/time.Second))
+	copy(footer[28:32], "lhbs")
+	binary.BigEndian.PutUint32(footer[32:], 0x00010000)
+	copy(footer[36:40], "Wi2k")
+	binary.BigEndian.PutUint64(footer[40:], uint64(size))
+	binary.BigEndian.PutUint64(footer[48:], uint64(size))
+	cylinders, heads, sectors := getVHDGeometry(size)
+	binary.BigEndian.PutUint16(footer[56:], cylinders)
+	footer[58] = heads
+	footer[59] = sectors
+	// dynamic hard disk
+	binary.BigEndian.PutUint32(footer[60:], 3)
+	if _, err := rand.Read(footer[68:84]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(footer[64:], vhdChecksum(footer))
+	return footer, nil
+}
+
+// vhdChecksum is the one's complement of the sum of the bytes, the checksum field must be zero
+func vhdChecksum(data []byte) uint32 {
+	sum := uint32(0)
+	for _, b := range data {
+		sum += uint32(b)
+	}
+	return ^sum
+}
+
+// getVHDGeometry returns the CHS geometry of the disk size, calculated as the VHD specification does
+func getVHDGeometry(size int64) (uint16, uint8, uint8) {
+	totalSectors := size / imageSectorSize
+	if totalSectors > 65535*16*255 {
+		totalSectors = 65535 * 16 * 255
+	}
+
+	var sectorsPerTrack, heads, cylinderTimesHeads int64
+	if totalSectors >= 65535*16*63 {
+		sectorsPerTrack = 255
+		heads = 16
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+	} else {
+		sectorsPerTrack = 17
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+		heads = (cylinderTimesHeads + 1023) / 1024
+		if heads < 4 {
+			heads = 4
+		}
+		if cylinderTimesHeads >= heads*1024 || heads > 16 {
+			sectorsPerTrack = 31
+			heads = 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+		if cylinderTimesHeads >= heads*1024 {
+			sectorsPerTrack = 63
+			heads = 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+	}
+	return uint16(cylinderTimesHeads / heads), uint8(heads), uint8(sectorsPerTrack)
+}
+
+// vmdkWriter writes a streamOptimized VMDK. The grains are compressed and written in order, each grain table is
+// written once the grains it covers are written, and the grain directory and the footer are written at the end.
+// The grains of zeros and the grains not in the backup are left unallocated.
+type vmdkWriter struct {
+	w      io.Writer
+	header []byte
+	// pos is the current position of the stream in bytes
+	pos int64
+	// last is the offset of the last written block, to check the blocks are in order
+	last int64
+
+	gd []uint32
+	gt []uint32
+	// gtIndex is the index of the grain table being filled
+	gtIndex int64
+
+	compressed bytes.Buffer
+	zw         *zlib.Writer
+}
+
+func newVMDKWriter(w io.Writer, name string, size int64) (*vmdkWriter, error) {
+	if size <= 0 || size%vmdkGrainSize != 0 {
+		return nil, fmt.Errorf("invalid volume size %v for VMDK, must be a multiple of %v", size, vmdkGrainSize)
+	}
+
+	capacity := size / imageSectorSize
+	grains := size / vmdkGrainSize
+	descriptor := getVMDKDescriptor(filepath.Base(name), capacity)
+	descriptorSize := alignUp(int64(len(descriptor)), imageSectorSize)
+	if imageSectorSize+descriptorSize > vmdkOverhead*imageSectorSize {
+		return nil, fmt.Errorf("VMDK descriptor of %v bytes is too large", len(descriptor))
+	}
+
+	header := make([]byte, imageSectorSize)
+	binary.LittleEndian.PutUint32(header[0:], 0x564d444b)
+	binary.LittleEndian.PutUint32(header[4:], 3)
+	// valid new line detection, compressed grains and markers
+	binary.LittleEndian.PutUint32(header[8:], 1|1<<16|1<<17)
+	binary.LittleEndian.PutUint64(header[12:], uint64(capacity))
+	binary.LittleEndian.PutUint64(header[20:], vmdkGrainSize/imageSectorSize)
+	binary.LittleEndian.PutUint64(header[28:], 1)
+	binary.LittleEndian.PutUint64(header[36:], uint64(descriptorSize/imageSectorSize))
+	binary.LittleEndian.PutUint32(header[44:], vmdkGTEsPerGT)
+	// the grain directory is at the end of the stream, recorded by the footer
+	binary.LittleEndian.PutUint64(header[56:], 0xFFFFFFFFFFFFFFFF)
+	binary.LittleEndian.PutUint64(header[64:], vmdkOverhead)
+	copy(header[73:77], "\n \r\n")
+	// deflate
+	binary.LittleEndian.PutUint16(header[77:], 1)
+
+	v := &vmdkWriter{
+		w:      w,
+		header: header,
+		last:   -1,
+		gd:     make([]uint32, (grains+vmdkGTEsPerGT-1)/vmdkGTEsPerGT),
+		gt:     make([]uint32, vmdkGTEsPerGT),
+	}
+	v.zw = zlib.NewWriter(&v.compressed)
+
+	metadata := make([]byte, vmdkOverhead*imageSectorSize)
+	copy(metadata, header)
+	copy(metadata[imageSectorSize:], descriptor)
+	if err := v.write(metadata); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func getVMDKDescriptor(name string, capacity int64) string {
+	cid := make([]byte, 4)
+	_, _ = rand.Read(cid)
+	cylinders := capacity / (255 * 63)
+	if cylinders > 65535 {
+		cylinders = 65535
+	}
+	return fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=%x
+parentCID=ffffffff
+createType="streamOptimized"
+
+# Extent description
+RW %d SPARSE "%s"
+
+# The Disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "4"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "255"
+ddb.geometry.sectors = "63"
+ddb.adapterType = "lsilogic"
+`, cid, capacity, name, cylinders)
+}
+
+func (v *vmdkWriter) write(data []byte) error {
+	n, err := v.w.Write(data)
+	v.pos += int64(n)
+	return err
+}
+
+// writeMarker writes the metadata marker of the type followed by the metadata, the marker takes a sector
+func (v *vmdkWriter) writeMarker(markerType uint32, data []byte) error {
+	marker := make([]byte, imageSectorSize)
+	binary.LittleEndian.PutUint64(marker[0:], uint64(alignUp(int64(len(data)), imageSectorSize)/imageSectorSize))
+	binary.LittleEndian.PutUint32(marker[12:], markerType)
+	if err := v.write(marker); err != nil {
+		return err
+	}
+	padded := make([]byte, alignUp(int64(len(data)), imageSectorSize))
+	copy(padded, data)
+	return v.write(padded)
+}
+
+// flushGrainTable writes the grain table being filled if it has any grains, and moves to the grain table of the
+// grain index
+func (v *vmdkWriter) flushGrainTable(gtIndex int64) error {
+	if gtIndex == v.gtIndex {
+		return nil
+	}
+	for _, gte := range v.gt {
+		if gte == 0 {
+			continue
+		}
+		data := make([]byte, vmdkGTEsPerGT*4)
+		for i, gte := range v.gt {
+			binary.LittleEndian.PutUint32(data[i*4:], gte)
+		}
+		v.gd[v.gtIndex] = uint32(v.pos/imageSectorSize + 1)
+		if err := v.writeMarker(vmdkMarkerGT, data); err != nil {
+			return err
+		}
+		break
+	}
+	v.gt = make([]uint32, vmdkGTEsPerGT)
+	v.gtIndex = gtIndex
+	return nil
+}
+
+func (v *vmdkWriter) WriteBlock(offset int64, data []byte) error {
+	if offset <= v.last || offset%vmdkGrainSize != 0 || int64(len(data))%vmdkGrainSize != 0 ||
+		offset+int64(len(data)) > int64(len(v.gd))*vmdkGTEsPerGT*vmdkGrainSize {
+		return fmt.Errorf("unexpected block at offset %v of size %v for VMDK", offset, len(data))
+	}
+	v.last = offset
+
+	for i := int64(0); i < int64(len(data)); i += vmdkGrainSize {
+		grain := data[i : i+vmdkGrainSize]
+		if isZeroBlock(grain) {
+			continue
+		}
+		grainIndex := (offset + i) / vmdkGrainSize
+		if err := v.flushGrainTable(grainIndex / vmdkGTEsPerGT); err != nil {
+			return err
+		}
+
+		v.compressed.Reset()
+		v.zw.Reset(&v.compressed)
+		if _, err := v.zw.Write(grain); err != nil {
+			return err
+		}
+		if err := v.zw.Close(); err != nil {
+			return err
+		}
+
+		// the grain marker is the sector of the grain and the size of the compressed data, followed by the data
+		marker := make([]byte, alignUp(int64(12+v.compressed.Len()), imageSectorSize))
+		binary.LittleEndian.PutUint64(marker[0:], uint64((offset+i)/imageSectorSize))
+		binary.LittleEndian.PutUint32(marker[8:], uint32(v.compressed.Len()))
+		copy(marker[12:], v.compressed.Bytes())
+		v.gt[grainIndex%vmdkGTEsPerGT] = uint32(v.pos / imageSectorSize)
+		if err := v.write(marker); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *vmdkWriter) Close() error {
+	if err := v.flushGrainTable(-1); err != nil {
+		return err
+	}
+
+	gd := make([]byte, len(v.gd)*4)
+	for i, gde := range v.gd {
+		binary.LittleEndian.PutUint32(gd[i*4:], gde)
+	}
+	gdOffset := v.pos/imageSectorSize + 1
+	if err := v.writeMarker(vmdkMarkerGD, gd); err != nil {
+		return err
+	}
+
+	footer := make([]byte, imageSectorSize)
+	copy(footer, v.header)
+	binary.LittleEndian.PutUint64(footer[56:], uint64(gdOffset))
+	if err := v.writeMarker(vmdkMarkerFooter, footer); err != nil {
+		return err
+	}
+	// the end of stream marker is a sector of zeros
+	return v.write(make([]byte, imageSectorSize))
+}
+
+func alignUp(size, alignment int64) int64 {
+	return (size + alignment - 1) / alignment * alignment
+}
+
+func isZeroBlock(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// imageBlockFetch is a block being downloaded for the image, the results are taken in the order of the blocks
+type imageBlockFetch struct {
+	block  BlockMapping
+	result chan imageBlockResult
+}
+
+type imageBlockResult struct {
+	buf           *bytes.Buffer
+	blockProfile  RestoreBlockProfile
+	downloadBytes int64
+	err           error
+}
+
+// restoreBlocksToImage downloads the blocks of the backup by the concurrent workers, and streams them to the volume
+// device in the image format in offset order. Up to concurrentLimit downloaded blocks are buffered ahead of the block
+// being written. The blocks and their compressed copies are reserved in the memory budget before they are
+// downloaded.
+func restoreBlocksToImage(ctx context.Context, bsDriver BackupStoreDriver, deltaOps DeltaRestoreOperations,
+	volDev *os.File, volDevName, volumeName string, format RestoreOutputFormat, vol *Volume, backup *Backup,
+	concurrentLimit int32, progress *progress, profiler *restoreProfiler) error {
+	if stat, err := volDev.Stat(); err != nil {
+		return err
+	} else if stat.Mode().IsRegular() {
+		if err := volDev.Truncate(0); err != nil {
+			return err
+		}
+	}
+	if _, err := volDev.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	blocks := append([]BlockMapping{}, backup.Blocks...)
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Offset < blocks[j].Offset })
+	offsets := make([]int64, len(blocks))
+	for i, block := range blocks {
+		offsets[i] = block.Offset
+	}
+
+	bufWriter := bufio.NewWriterSize(volDev, DEFAULT_BLOCK_SIZE)
+	writer, err := newImageWriter(format, bufWriter, volDevName, vol.Size, offsets)
+	if err != nil {
+		return err
+	}
+
+	if concurrentLimit <= 0 {
+		concurrentLimit = 1
+	}
+	pending := make(chan *imageBlockFetch, concurrentLimit)
+	jobs := make(chan *imageBlockFetch)
+	ctx, cancel := context.WithCancel(ctx)
+	wg := sync.WaitGroup{}
+	defer func() {
+		// return the buffers of the blocks downloaded but not written
+		cancel()
+		wg.Wait()
+		for fetch := range pending {
+			select {
+			case result := <-fetch.result:
+				blockBuffers.Put(result.buf)
+				progress.budget.Release(DEFAULT_BLOCK_SIZE)
+			default:
+			}
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(pending)
+		defer close(jobs)
+		for _, block := range blocks {
+			if progress.budget.Reserve(ctx, blockJobBytes) != nil {
+				return
+			}
+			fetch := &imageBlockFetch{block: block, result: make(chan imageBlockResult, 1)}
+			select {
+			case pending <- fetch:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- fetch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for i := 0; i < int(concurrentLimit); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fetch := range jobs {
+				start := time.Now()
+				result := imageBlockResult{
+					buf:          blockBuffers.Get(),
+					blockProfile: RestoreBlockProfile{Offset: fetch.block.Offset, BlockChecksum: fetch.block.BlockChecksum},
+				}
+				result.downloadBytes, result.err = readRestoreBlock(progress.group, bsDriver, volumeName,
+					getBlockCompressionMethod(backup, fetch.block), fetch.block, &result.blockProfile, result.buf)
+				result.blockProfile.Duration = time.Since(start)
+				// the compressed copy is returned by readBlock
+				progress.budget.Release(DEFAULT_BLOCK_SIZE)
+				fetch.result <- result
+			}
+		}()
+	}
+
+	for {
+		var fetch *imageBlockFetch
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deltaOps.GetStopChan():
+			return fmt.Errorf("restoration is cancelled since received stop signal")
+		case f, open := <-pending:
+			if !open {
+				if err := writer.Close(); err != nil {
+					return err
+				}
+				return bufWriter.Flush()
+			}
+			fetch = f
+		}
+
+		var result imageBlockResult
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case result = <-fetch.result:
+		}
+		err := result.err
+		if err == nil {
+			start := time.Now()
+			err = writer.WriteBlock(fetch.block.Offset, result.buf.Bytes())
+			result.blockProfile.Write = time.Since(start)
+			result.blockProfile.Duration += result.blockProfile.Write
+		}
+		blockBuffers.Put(result.buf)
+		progress.budget.Release(DEFAULT_BLOCK_SIZE)
+		completeRestoreBlock(deltaOps, volumeName, progress, profiler, 0, result.blockProfile, result.downloadBytes,
+			false, err)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package backupstore
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRestoreOutputFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	format, err := getRestoreOutputFormat(&DeltaRestoreConfig{})
+	assert.NoError(err)
+	assert.Equal(RestoreOutputFormatRaw, format)
+	format, err = getRestoreOutputFormat(&DeltaRestoreConfig{OutputFormat: RestoreOutputFormatVMDK})
+	assert.NoError(err)
+	assert.Equal(RestoreOutputFormatVMDK, format)
+
+	for _, config := range []*DeltaRestoreConfig{
+		{OutputFormat: "qcow2"},
+		{OutputFormat: RestoreOutputFormatVHD, FingerprintLocal: true},
+		{OutputFormat: RestoreOutputFormatVMDK, CoalesceSize: 2 * DEFAULT_BLOCK_SIZE},
+	} {
+		_, err := getRestoreOutputFormat(config)
+		assert.Error(err, "%+v", *config)
+	}
+}
+
+func getImageTestBlock(seed byte) []byte {
+	data := make([]byte, DEFAULT_BLOCK_SIZE)
+	// the second grain of the block is left zero
+	for i := 0; i < vmdkGrainSize; i++ {
+		data[i] = seed + byte(i%251)
+	}
+	for i := 2 * vmdkGrainSize; i < DEFAULT_BLOCK_SIZE; i += 4096 {
+		data[i] = seed
+	}
+	return data
+}
+
+func TestVHDWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	size := int64(8 * DEFAULT_BLOCK_SIZE)
+	offsets := []int64{DEFAULT_BLOCK_SIZE, 5 * DEFAULT_BLOCK_SIZE}
+	var image bytes.Buffer
+	writer, err := newVHDWriter(&image, size, offsets)
+	assert.NoError(err)
+	assert.Error(writer.WriteBlock(5*DEFAULT_BLOCK_SIZE, getImageTestBlock(5)))
+	for _, offset := range offsets {
+		assert.NoError(writer.WriteBlock(offset, getImageTestBlock(byte(offset/DEFAULT_BLOCK_SIZE))))
+	}
+	assert.NoError(writer.Close())
+
+	data := image.Bytes()
+	footer := data[len(data)-vhdFooterSize:]
+	assert.Equal(footer, data[:vhdFooterSize])
+	assert.Equal("conectix", string(footer[0:8]))
+	assert.Equal(uint64(size), binary.BigEndian.Uint64(footer[48:]))
+	assert.Equal(uint32(3), binary.BigEndian.Uint32(footer[60:]))
+	checksum := binary.BigEndian.Uint32(footer[64:])
+	withoutChecksum := append([]byte{}, footer...)
+	copy(withoutChecksum[64:68], make([]byte, 4))
+	assert.Equal(vhdChecksum(withoutChecksum), checksum)
+
+	header := data[binary.BigEndian.Uint64(footer[16:]):]
+	assert.Equal("cxsparse", string(header[0:8]))
+	assert.Equal(uint32(8), binary.BigEndian.Uint32(header[28:]))
+	assert.Equal(uint32(DEFAULT_BLOCK_SIZE), binary.BigEndian.Uint32(header[32:]))
+
+	bat := data[binary.BigEndian.Uint64(header[16:]):]
+	for i := int64(0); i < size/DEFAULT_BLOCK_SIZE; i++ {
+		sector := binary.BigEndian.Uint32(bat[i*4:])
+		if i != 1 && i != 5 {
+			assert.Equal(uint32(vhdUnusedBlock), sector)
+			continue
+		}
+		blockStart := int64(sector)*imageSectorSize + vhdBlockBitmapSize
+		assert.Equal(getImageTestBlock(byte(i)), data[blockStart:blockStart+DEFAULT_BLOCK_SIZE])
+	}
+
+	_, err = newVHDWriter(&image, MAX_VHD_SIZE+DEFAULT_BLOCK_SIZE, nil)
+	assert.Error(err)
+}
+
+func TestVMDKWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	// the volume spans two grain tables
+	size := int64(32 * DEFAULT_BLOCK_SIZE)
+	blocks := map[int64][]byte{
+		0:                       getImageTestBlock(1),
+		17 * DEFAULT_BLOCK_SIZE: getImageTestBlock(2),
+		31 * DEFAULT_BLOCK_SIZE: getImageTestBlock(3),
+	}
+	var image bytes.Buffer
+	writer, err := newVMDKWriter(&image, "/tmp/volume.vmdk", size)
+	assert.NoError(err)
+	for _, offset := range []int64{0, 17 * DEFAULT_BLOCK_SIZE, 31 * DEFAULT_BLOCK_SIZE} {
+		assert.NoError(writer.WriteBlock(offset, blocks[offset]))
+	}
+	assert.Error(writer.WriteBlock(DEFAULT_BLOCK_SIZE, getImageTestBlock(4)))
+	assert.NoError(writer.Close())
+
+	data := image.Bytes()
+	assert.Equal(uint32(0x564d444b), binary.LittleEndian.Uint32(data[0:]))
+	assert.Equal(uint64(size/imageSectorSize), binary.LittleEndian.Uint64(data[12:]))
+	assert.Contains(string(data[imageSectorSize:2*imageSectorSize]), `createType="streamOptimized"`)
+	assert.Contains(string(data[imageSectorSize:2*imageSectorSize]), `SPARSE "volume.vmdk"`)
+	assert.Equal(make([]byte, imageSectorSize), data[len(data)-imageSectorSize:])
+	footerMarker := data[len(data)-3*imageSectorSize:]
+	assert.Equal(uint32(vmdkMarkerFooter), binary.LittleEndian.Uint32(footerMarker[12:]))
+	footer := footerMarker[imageSectorSize:]
+	gdOffset := int64(binary.LittleEndian.Uint64(footer[56:])) * imageSectorSize
+	assert.Equal(uint32(vmdkMarkerGD), binary.LittleEndian.Uint32(data[gdOffset-imageSectorSize+12:]))
+
+	restored := make([]byte, size)
+	grains := 0
+	for gtIndex := 0; gtIndex < 2; gtIndex++ {
+		gtOffset := int64(binary.LittleEndian.Uint32(data[gdOffset+int64(gtIndex)*4:])) * imageSectorSize
+		assert.NotZero(gtOffset)
+		assert.Equal(uint32(vmdkMarkerGT), binary.LittleEndian.Uint32(data[gtOffset-imageSectorSize+12:]))
+		for i := int64(0); i < vmdkGTEsPerGT; i++ {
+			grainOffset := int64(binary.LittleEndian.Uint32(data[gtOffset+i*4:])) * imageSectorSize
+			if grainOffset == 0 {
+				continue
+			}
+			grains++
+			lba := int64(binary.LittleEndian.Uint64(data[grainOffset:]))
+			assert.Equal((int64(gtIndex)*vmdkGTEsPerGT+i)*vmdkGrainSize, lba*imageSectorSize)
+			compressedSize := int64(binary.LittleEndian.Uint32(data[grainOffset+8:]))
+			zr, err := zlib.NewReader(bytes.NewReader(data[grainOffset+12 : grainOffset+12+compressedSize]))
+			assert.NoError(err)
+			_, err = io.ReadFull(zr, restored[lba*imageSectorSize:lba*imageSectorSize+vmdkGrainSize])
+			assert.NoError(err)
+		}
+	}
+	// the zero grain of each block is left unallocated
+	assert.Equal(3*(DEFAULT_BLOCK_SIZE/vmdkGrainSize-1), grains)
+	for offset, block := range blocks {
+		assert.Equal(block, restored[offset:offset+DEFAULT_BLOCK_SIZE])
+	}
+}
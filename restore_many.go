@@ -0,0 +1,361 @@
+package backupstore
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/longhorn/backupstore/types"
+)
+
+const (
+	// DEFAULT_RESTORE_MANY_CONCURRENT_LIMIT is the number of the blocks downloaded at the same time by all the
+	// restores of RestoreMany
+	DEFAULT_RESTORE_MANY_CONCURRENT_LIMIT = 32
+	// DEFAULT_RESTORE_MANY_DEDUP_CACHE_SIZE is the bytes of the blocks kept for the other restores of RestoreMany
+	DEFAULT_RESTORE_MANY_DEDUP_CACHE_SIZE = 64 * DEFAULT_BLOCK_SIZE
+)
+
+type RestoreManyOptions struct {
+	// ConcurrentLimit is the number of the blocks downloaded at the same time by all the restores, on top of the
+	// concurrent limit of each restore. It defaults to DEFAULT_RESTORE_MANY_CONCURRENT_LIMIT
+	ConcurrentLimit int32
+	// RateLimit is the bytes per second downloaded by all the restores, no limit if 0
+	RateLimit int64
+	// DedupCacheSize is the bytes of the downloaded blocks kept for the other restores needing the same blocks,
+	// e.g. the restores of the cloned volumes. It defaults to DEFAULT_RESTORE_MANY_DEDUP_CACHE_SIZE, the blocks
+	// are not shared if negative
+	DedupCacheSize int64
+}
+
+// RestoreManyProgress is the combined progress of the restores of RestoreMany
+type RestoreManyProgress struct {
+	// Progress is the percentage of the blocks processed by all the restores
+	Progress        int
+	TotalBlocks     int64
+	ProcessedBlocks int64
+	// DedupedBlocks is the number of the blocks copied from another restore instead of downloaded
+	DedupedBlocks int64
+
+	Running   int
+	Completed int
+	Failed    int
+}
+
+// RestoreGroup is the restores started together by RestoreMany
+type RestoreGroup struct {
+	lock     sync.Mutex
+	restores []*restoreGroupMember
+	wg       sync.WaitGroup
+
+	downloads chan struct{}
+	limiter   *rateLimiter
+	cache     *restoreBlockCache
+}
+
+// restoreGroupMember is a restore of the group, the progress is set once the restore starts restoring the blocks
+type restoreGroupMember struct {
+	group    *RestoreGroup
+	progress *progress
+	summary  *RestoreSummary
+}
+
+// restoreBlockCache keeps the downloaded blocks needed by more than one restore of the group, so they are only
+// downloaded once. A block is dropped once all the restores referring to it have read it.
+type restoreBlockCache struct {
+	sync.Mutex
+
+	maxBytes int64
+	bytes    int64
+	// refs is the number of the restores still going to read the block
+	refs    map[string]int
+	entries map[string]*cachedRestoreBlock
+	deduped int64
+}
+
+type cachedRestoreBlock struct {
+	done chan struct{}
+	// data is nil if the download failed or the cache is full
+	data []byte
+}
+
+func (o *RestoreManyOptions) withDefaults() *RestoreManyOptions {
+	opts := RestoreManyOptions{}
+	if o != nil {
+		opts = *o
+	}
+	if opts.ConcurrentLimit <= 0 {
+		opts.ConcurrentLimit = DEFAULT_RESTORE_MANY_CONCURRENT_LIMIT
+	}
+	if opts.DedupCacheSize == 0 {
+		opts.DedupCacheSize = DEFAULT_RESTORE_MANY_DEDUP_CACHE_SIZE
+	}
+	return &opts
+}
+
+// RestoreMany starts the restores of the configs together, e.g. restoring all the volumes of a cluster for the
+// disaster recovery. The block downloads of the restores share the concurrent limit and the rate limit, and the
+// blocks needed by several restores, e.g. of the cloned volumes, are only downloaded once. The restores are
+// incremental if LastBackupName is set. Like RestoreDeltaBlockBackup, it returns once the restores are started,
+// the results are reported by the OnComplete of the configs and by the Wait of the group.
+func RestoreMany(configs []*DeltaRestoreConfig, opts *RestoreManyOptions) (*RestoreGroup, error) {
+	opts = opts.withDefaults()
+	filenames := map[string]bool{}
+	for _, config := range configs {
+		if config == nil {
+			return nil, fmt.Errorf("invalid empty config for restore")
+		}
+		if filenames[config.Filename] {
+			return nil, fmt.Errorf("cannot restore more than one backup to %v", config.Filename)
+		}
+		filenames[config.Filename] = true
+	}
+
+	g := &RestoreGroup{
+		downloads: make(chan struct{}, opts.ConcurrentLimit),
+		limiter:   newRateLimiter(opts.RateLimit),
+	}
+	if opts.DedupCacheSize > 0 {
+		g.cache = newRestoreBlockCache(configs, opts.DedupCacheSize)
+	}
+
+	for _, config := range configs {
+		config := config
+		member := &restoreGroupMember{group: g}
+		g.restores = append(g.restores, member)
+		g.wg.Add(1)
+
+		groupConfig := *config
+		groupConfig.groupMember = member
+		groupConfig.OnComplete = func(summary *RestoreSummary) {
+			g.lock.Lock()
+			member.summary = summary
+			g.lock.Unlock()
+			if config.OnComplete != nil {
+				config.OnComplete(summary)
+			}
+			g.wg.Done()
+		}
+
+		// the failures are reported by OnComplete
+		if config.LastBackupName != "" {
+			_ = RestoreDeltaBlockBackupIncrementally(&groupConfig)
+		} else {
+			_ = RestoreDeltaBlockBackup(&groupConfig)
+		}
+	}
+	return g, nil
+}
+
+// newRestoreBlockCache counts the restores referring to each block, the blocks of the incremental restores
+// which are in the last restored backup are not downloaded
+func newRestoreBlockCache(configs []*DeltaRestoreConfig, maxBytes int64) *restoreBlockCache {
+	c := &restoreBlockCache{
+		maxBytes: maxBytes,
+		refs:     map[string]int{},
+		entries:  map[string]*cachedRestoreBlock{},
+	}
+	for _, config := range configs {
+		checksums, err := getRestoreBlockChecksums(config)
+		if err != nil {
+			// the restore fails on its own
+			log.WithError(err).Warnf("Failed to get blocks of backup %v to share with the other restores", config.BackupURL)
+			continue
+		}
+		for checksum := range checksums {
+			c.refs[checksum]++
+		}
+	}
+	return c
+}
+
+func getRestoreBlockChecksums(config *DeltaRestoreConfig) (map[string]bool, error) {
+	bsDriver, err := GetBackupStoreDriver(config.BackupURL)
+	if err != nil {
+		return nil, err
+	}
+	backupName, volumeName, _, err := DecodeBackupURL(config.BackupURL)
+	if err != nil {
+		return nil, err
+	}
+	backup, err := loadBackup(bsDriver, backupName, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	checksums := map[string]bool{}
+	for _, block := range backup.Blocks {
+		checksums[block.BlockChecksum] = true
+	}
+	if config.LastBackupName != "" {
+		lastBackup, err := loadBackup(bsDriver, config.LastBackupName, volumeName)
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range lastBackup.Blocks {
+			delete(checksums, block.BlockChecksum)
+		}
+	}
+	return checksums, nil
+}
+
+// track includes the progress of the restore in the combined progress, and makes the restore read the blocks
+// within the group. It does nothing if the restore isn't started by RestoreMany.
+func (m *restoreGroupMember) track(progress *progress) {
+	if m == nil {
+		return
+	}
+	m.group.lock.Lock()
+	defer m.group.lock.Unlock()
+	m.progress = progress
+	progress.group = m.group
+}
+
+// Progress returns the combined progress of the restores
+func (g *RestoreGroup) Progress() *RestoreManyProgress {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	p := &RestoreManyProgress{}
+	for _, restore := range g.restores {
+		switch {
+		case restore.summary == nil:
+			p.Running++
+		case restore.summary.State == types.ProgressStateComplete:
+			p.Completed++
+		default:
+			p.Failed++
+		}
+		if restore.progress == nil {
+			continue
+		}
+		restore.progress.Lock()
+		total, processed := restore.progress.totalBlockCounts, restore.progress.processedBlockCounts
+		restore.progress.Unlock()
+		// the blocks unchanged since the last restored backup are skipped
+		if restore.summary != nil && restore.summary.State == types.ProgressStateComplete {
+			processed = total
+		}
+		p.TotalBlocks += total
+		p.ProcessedBlocks += processed
+	}
+	if p.TotalBlocks > 0 {
+		p.Progress = int(p.ProcessedBlocks * PROGRESS_PERCENTAGE_BACKUP_TOTAL / p.TotalBlocks)
+	}
+	if p.Running == 0 && p.Failed == 0 {
+		p.Progress = PROGRESS_PERCENTAGE_BACKUP_TOTAL
+	}
+	if g.cache != nil {
+		g.cache.Lock()
+		p.DedupedBlocks = g.cache.deduped
+		g.cache.Unlock()
+	}
+	return p
+}
+
+// Wait waits for all the restores to complete, and returns their summaries in the order of the configs
+func (g *RestoreGroup) Wait() []*RestoreSummary {
+	g.wg.Wait()
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	summaries := make([]*RestoreSummary, 0, len(g.restores))
+	for _, restore := range g.restores {
+		summaries = append(summaries, restore.summary)
+	}
+	return summaries
+}
+
+// readBlock reads the block from the cache if another restore has downloaded it, or downloads it within the
+// limits of the group. The downloaded bytes are 0 if the block is read from the cache.
+func (g *RestoreGroup) readBlock(bsDriver BackupStoreDriver, volumeName string, decompression string, blk BlockMapping,
+	blockProfile *RestoreBlockProfile, buf *bytes.Buffer) (int64, error) {
+	if g.cache == nil {
+		return g.downloadBlock(bsDriver, volumeName, decompression, blk, blockProfile, buf)
+	}
+
+	entry, owner := g.cache.get(blk.BlockChecksum)
+	if entry == nil {
+		return g.downloadBlock(bsDriver, volumeName, decompression, blk, blockProfile, buf)
+	}
+	if !owner {
+		<-entry.done
+		if entry.data != nil {
+			buf.Write(entry.data)
+			g.cache.release(blk.BlockChecksum, true)
+			return 0, nil
+		}
+		g.cache.release(blk.BlockChecksum, false)
+		return g.downloadBlock(bsDriver, volumeName, decompression, blk, blockProfile, buf)
+	}
+
+	downloadBytes, err := g.downloadBlock(bsDriver, volumeName, decompression, blk, blockProfile, buf)
+	if err == nil {
+		g.cache.fill(entry, buf.Bytes())
+	}
+	close(entry.done)
+	g.cache.release(blk.BlockChecksum, false)
+	return downloadBytes, err
+}
+
+func (g *RestoreGroup) downloadBlock(bsDriver BackupStoreDriver, volumeName string, decompression string,
+	blk BlockMapping, blockProfile *RestoreBlockProfile, buf *bytes.Buffer) (int64, error) {
+	g.downloads <- struct{}{}
+	defer func() { <-g.downloads }()
+	downloadBytes, err := readBlock(bsDriver, volumeName, decompression, blk, blockProfile, buf)
+	g.limiter.wait(downloadBytes)
+	return downloadBytes, err
+}
+
+// get returns the cache entry of the block referred to by the other restores, and if the caller is the owner
+// downloading the block. It returns nil if the block isn't shared with the other restores.
+func (c *restoreBlockCache) get(checksum string) (*cachedRestoreBlock, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if entry, ok := c.entries[checksum]; ok {
+		return entry, false
+	}
+	if c.refs[checksum] <= 1 {
+		return nil, false
+	}
+	entry := &cachedRestoreBlock{done: make(chan struct{})}
+	c.entries[checksum] = entry
+	return entry, true
+}
+
+// fill keeps the data of the downloaded block if the cache has room for it
+func (c *restoreBlockCache) fill(entry *cachedRestoreBlock, data []byte) {
+	c.Lock()
+	defer c.Unlock()
+	if c.bytes+int64(len(data)) > c.maxBytes {
+		return
+	}
+	entry.data = append([]byte(nil), data...)
+	c.bytes += int64(len(data))
+}
+
+// release drops a reference of the block, the block is removed from the cache once no restore refers to it
+func (c *restoreBlockCache) release(checksum string, deduped bool) {
+	c.Lock()
+	defer c.Unlock()
+	if deduped {
+		c.deduped++
+	}
+	c.refs[checksum]--
+	if c.refs[checksum] > 0 {
+		return
+	}
+	delete(c.refs, checksum)
+	if entry, ok := c.entries[checksum]; ok {
+		c.bytes -= int64(len(entry.data))
+		delete(c.entries, checksum)
+	}
+}
+
+// readRestoreBlock reads the block within the restore group if the restore is started by RestoreMany
+func readRestoreBlock(group *RestoreGroup, bsDriver BackupStoreDriver, volumeName string, decompression string,
+	blk BlockMapping, blockProfile *RestoreBlockProfile, buf *bytes.Buffer) (int64, error) {
+	if group == nil {
+		return readBlock(bsDriver, volumeName, decompression, blk, blockProfile, buf)
+	}
+	return group.readBlock(bsDriver, volumeName, decompression, blk, blockProfile, buf)
+}
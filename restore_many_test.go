@@ -0,0 +1,126 @@
+package backupstore
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/types"
+	"github.com/longhorn/backupstore/util"
+)
+
+// countingMockStoreDriver counts the block reads
+type countingMockStoreDriver struct {
+	*writableMockStoreDriver
+	lock       sync.Mutex
+	blockReads int
+}
+
+func (m *countingMockStoreDriver) Read(src string) (io.ReadCloser, error) {
+	if strings.HasSuffix(src, BLK_SUFFIX) {
+		m.lock.Lock()
+		m.blockReads++
+		m.lock.Unlock()
+	}
+	return m.writableMockStoreDriver.Read(src)
+}
+
+// fileRestoreOperations restores to the regular files
+type fileRestoreOperations struct {
+	mockRestoreOperations
+}
+
+func (o *fileRestoreOperations) OpenVolumeDev(volDevName string) (*os.File, string, error) {
+	volDev, err := os.OpenFile(volDevName, os.O_RDWR|os.O_CREATE, 0644)
+	return volDev, volDevName, err
+}
+
+func (o *fileRestoreOperations) CloseVolumeDev(volDev *os.File) error {
+	return volDev.Close()
+}
+
+func (o *fileRestoreOperations) UpdateRestoreStatus(snapshot string, restoreProgress int, err error) {
+}
+
+func TestRestoreMany(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &countingMockStoreDriver{writableMockStoreDriver: &writableMockStoreDriver{&mockStoreDriver{}}}
+	m.Init()
+	defer m.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m, nil
+	})
+
+	// pvc-2 is a clone of pvc-1, so the volumes share the blocks
+	expected := []byte{}
+	blocks := []BlockMapping{}
+	for i, pattern := range []string{"first", "second"} {
+		data := bytes.Repeat([]byte(pattern), DEFAULT_BLOCK_SIZE/len(pattern)+1)[:DEFAULT_BLOCK_SIZE]
+		blocks = append(blocks, BlockMapping{Offset: int64(i) * DEFAULT_BLOCK_SIZE, BlockChecksum: util.GetChecksum(data)})
+		expected = append(expected, data...)
+	}
+	configs := []*DeltaRestoreConfig{}
+	var completedLock sync.Mutex
+	completed := 0
+	for _, volumeName := range []string{"pvc-1", "pvc-2"} {
+		assert.NoError(addVolume(m, &Volume{Name: volumeName, Size: 2 * DEFAULT_BLOCK_SIZE, CompressionMethod: "lz4"}))
+		for i, block := range blocks {
+			compressed, err := util.CompressData("lz4", expected[i*DEFAULT_BLOCK_SIZE:(i+1)*DEFAULT_BLOCK_SIZE])
+			assert.NoError(err)
+			assert.NoError(m.Write(getBlockFilePath(m, volumeName, block.BlockChecksum), compressed))
+		}
+		assert.NoError(saveBackup(m, &Backup{Name: "backup-1", VolumeName: volumeName, CompressionMethod: "lz4",
+			Blocks: blocks, CreatedTime: "2026-01-01T00:00:00Z"}))
+		configs = append(configs, &DeltaRestoreConfig{
+			BackupURL:       EncodeBackupURL("backup-1", volumeName, mockDriverURL),
+			DeltaOps:        &fileRestoreOperations{},
+			Filename:        filepath.Join(t.TempDir(), volumeName),
+			ConcurrentLimit: 1,
+			OnComplete: func(summary *RestoreSummary) {
+				completedLock.Lock()
+				defer completedLock.Unlock()
+				completed++
+			},
+		})
+	}
+
+	_, err := RestoreMany([]*DeltaRestoreConfig{configs[0], configs[0]}, nil)
+	assert.Error(err)
+
+	group, err := RestoreMany(configs, &RestoreManyOptions{ConcurrentLimit: 1})
+	assert.NoError(err)
+	summaries := group.Wait()
+	assert.Len(summaries, 2)
+	for i, summary := range summaries {
+		assert.Equal(types.ProgressStateComplete, summary.State, "%v", summary.Error)
+		restored, err := os.ReadFile(configs[i].Filename)
+		assert.NoError(err)
+		assert.True(bytes.Equal(expected, restored))
+	}
+	assert.Equal(2, completed)
+
+	// the shared blocks are only downloaded once
+	assert.Equal(2, m.blockReads)
+	progress := group.Progress()
+	assert.Equal(PROGRESS_PERCENTAGE_BACKUP_TOTAL, progress.Progress)
+	assert.Equal(int64(4), progress.TotalBlocks)
+	assert.Equal(int64(4), progress.ProcessedBlocks)
+	assert.Equal(int64(2), progress.DedupedBlocks)
+	assert.Equal(2, progress.Completed)
+
+	// the restores don't share the blocks without the dedup cache
+	m.blockReads = 0
+	group, err = RestoreMany(configs, &RestoreManyOptions{DedupCacheSize: -1})
+	assert.NoError(err)
+	group.Wait()
+	assert.Equal(4, m.blockReads)
+	assert.Equal(int64(0), group.Progress().DedupedBlocks)
+}
@@ -0,0 +1,282 @@
+package backupstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	PINS_DIRECTORY = "pins"
+	PIN_PREFIX     = "pin"
+	PIN_SUFFIX     = ".pin"
+
+	// PIN_DURATION is how long the pin of a restore lasts without being refreshed, e.g. the restore crashed
+	PIN_DURATION         = time.Minute * 10
+	PIN_REFRESH_INTERVAL = time.Minute * 4
+)
+
+// BlockPin keeps the blocks from being garbage collected by the backup deletion, so the blocks being read are not
+// pruned by the deletion of a backup sharing them. The pin holds either the blocks referenced by a backup, which
+// are kept even if the backup itself is deleted, or the listed blocks. The pin is ignored by the garbage
+// collection once it expires.
+type BlockPin struct {
+	Name       string
+	VolumeName string
+	// BackupName is the backup whose blocks are pinned
+	BackupName string `json:",omitempty"`
+	// Blocks are the checksums of the pinned blocks
+	Blocks []string `json:",omitempty"`
+	// Owner and CreatedTime are only used for the diagnostics
+	Owner       string `json:",omitempty"`
+	CreatedTime string
+	// ExpiresAt is the server time the pin expires at
+	ExpiresAt string
+
+	driver    BackupStoreDriver
+	keepAlive chan struct{}
+	mutex     sync.Mutex
+	unpinned  bool
+}
+
+// PinBackupBlocks pins the blocks referenced by the backup for the duration, PIN_DURATION is used if the duration
+// is 0. The caller must Unpin it once done, or Refresh it to extend it.
+func PinBackupBlocks(backupURL string, duration time.Duration) (*BlockPin, error) {
+	bsDriver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	backupName, volumeName, _, err := DecodeBackupURL(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	if backupName == "" {
+		return nil, fmt.Errorf("missing backup name in %v", backupURL)
+	}
+	if _, err := loadBackup(bsDriver, backupName, volumeName); err != nil {
+		return nil, err
+	}
+	return pinBackupBlocks(bsDriver, backupName, volumeName, duration)
+}
+
+// PinBlocks pins the blocks of the volume by their checksums for the duration, PIN_DURATION is used if the
+// duration is 0. The caller must Unpin it once done, or Refresh it to extend it.
+func PinBlocks(volumeURL string, checksums []string, duration time.Duration) (*BlockPin, error) {
+	bsDriver, err := GetBackupStoreDriver(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	_, volumeName, _, err := DecodeBackupURL(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	if !volumeExists(bsDriver, volumeName) {
+		return nil, fmt.Errorf("cannot find volume %v in backupstore", volumeName)
+	}
+	pin := newBlockPin(bsDriver, volumeName)
+	pin.Blocks = checksums
+	if err := pin.Refresh(duration); err != nil {
+		return nil, err
+	}
+	return pin, nil
+}
+
+// ListBlockPins returns the unexpired pins of the volume
+func ListBlockPins(volumeURL string) ([]*BlockPin, error) {
+	bsDriver, err := GetBackupStoreDriver(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	_, volumeName, _, err := DecodeBackupURL(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	return getBlockPinsForVolume(bsDriver, volumeName)
+}
+
+func newBlockPin(bsDriver BackupStoreDriver, volumeName string) *BlockPin {
+	owner, _ := os.Hostname()
+	return &BlockPin{
+		Name:        util.GenerateName(PIN_PREFIX),
+		VolumeName:  volumeName,
+		Owner:       owner,
+		CreatedTime: util.Now(),
+		driver:      bsDriver,
+	}
+}
+
+// Refresh extends the pin to expire after the duration from now, PIN_DURATION is used if the duration is 0
+func (pin *BlockPin) Refresh(duration time.Duration) error {
+	if duration == 0 {
+		duration = PIN_DURATION
+	}
+	pin.mutex.Lock()
+	defer pin.mutex.Unlock()
+	if pin.unpinned {
+		return fmt.Errorf("block pin %v of volume %v is already removed", pin.Name, pin.VolumeName)
+	}
+	pin.ExpiresAt = serverNow(pin.driver).Add(duration).Format(time.RFC3339)
+	// the pin of the read-only backup target isn't needed, since the blocks cannot be deleted through it
+	if isReadOnlyDriver(pin.driver) {
+		return nil
+	}
+	return SaveConfigInBackupStore(pin.driver, getPinFilePath(pin.driver, pin.VolumeName, pin.Name), pin)
+}
+
+// Unpin removes the pin, the blocks can be garbage collected by the next backup deletion
+func (pin *BlockPin) Unpin() error {
+	pin.mutex.Lock()
+	defer pin.mutex.Unlock()
+	if pin.unpinned {
+		return nil
+	}
+	pin.unpinned = true
+	if pin.keepAlive != nil {
+		close(pin.keepAlive)
+		pin.keepAlive = nil
+	}
+
+	if isReadOnlyDriver(pin.driver) {
+		return nil
+	}
+	file := getPinFilePath(pin.driver, pin.VolumeName, pin.Name)
+	if err := pin.driver.Remove(file); err != nil {
+		return err
+	}
+	log.Infof("Removed block pin %v on backupstore", file)
+	return nil
+}
+
+// keepRefreshed refreshes the pin until it's unpinned, so the pin of a long restore doesn't expire
+func (pin *BlockPin) keepRefreshed() {
+	keepAlive := make(chan struct{})
+	pin.mutex.Lock()
+	pin.keepAlive = keepAlive
+	pin.mutex.Unlock()
+	go func() {
+		refreshTimer := time.NewTicker(PIN_REFRESH_INTERVAL)
+		defer refreshTimer.Stop()
+		for {
+			select {
+			case <-keepAlive:
+				return
+			case <-refreshTimer.C:
+				if err := pin.Refresh(PIN_DURATION); err != nil {
+					log.WithError(err).Warnf("Failed to refresh block pin %v of volume %v", pin.Name, pin.VolumeName)
+				}
+			}
+		}
+	}()
+}
+
+func (pin *BlockPin) isExpired() bool {
+	expiresAt, err := time.Parse(time.RFC3339, pin.ExpiresAt)
+	if err != nil {
+		return true
+	}
+	return serverNow(pin.driver).After(expiresAt)
+}
+
+func pinBackupBlocks(bsDriver BackupStoreDriver, backupName, volumeName string, duration time.Duration) (*BlockPin, error) {
+	pin := newBlockPin(bsDriver, volumeName)
+	pin.BackupName = backupName
+	if err := pin.Refresh(duration); err != nil {
+		return nil, errors.Wrapf(err, "failed to pin blocks of backup %v", backupName)
+	}
+	return pin, nil
+}
+
+// pinRestoredBackup pins the blocks of the backup being restored until the restore completes
+func pinRestoredBackup(bsDriver BackupStoreDriver, backupName, volumeName string) (*BlockPin, error) {
+	pin, err := pinBackupBlocks(bsDriver, backupName, volumeName, PIN_DURATION)
+	if err != nil {
+		return nil, err
+	}
+	pin.keepRefreshed()
+	return pin, nil
+}
+
+// unpinRestoredBackup removes the pin of the completed restore, the pin expires if it cannot be removed
+func unpinRestoredBackup(pin *BlockPin) {
+	if err := pin.Unpin(); err != nil {
+		log.WithError(err).Warnf("Failed to remove block pin %v of volume %v", pin.Name, pin.VolumeName)
+	}
+}
+
+// addPinnedBlockReferences counts the blocks pinned by the unexpired pins, so they are not garbage collected. The
+// pinned backups being deleted are taken from deletedBackups, since their configs are already removed.
+func addPinnedBlockReferences(bsDriver BackupStoreDriver, blockInfos map[string]*BlockInfo, volumeName string,
+	deletedBackups []*Backup) error {
+	pins, err := getBlockPinsForVolume(bsDriver, volumeName)
+	if err != nil {
+		return err
+	}
+	for _, pin := range pins {
+		for _, checksum := range pin.Blocks {
+			if info, known := blockInfos[checksum]; known {
+				info.refcount++
+			}
+		}
+		if pin.BackupName == "" {
+			continue
+		}
+		backup := findBackup(deletedBackups, pin.BackupName)
+		if backup == nil {
+			if backup, err = loadBackup(bsDriver, pin.BackupName, volumeName); err != nil {
+				return errors.Wrapf(err, "failed to load backup %v pinned by %v", pin.BackupName, pin.Name)
+			}
+		}
+		log.Infof("Keeping blocks of backup %v pinned by %v until %v", pin.BackupName, pin.Name, pin.ExpiresAt)
+		checkBlockReferenceCount(blockInfos, backup, volumeName, bsDriver)
+	}
+	return nil
+}
+
+func findBackup(backups []*Backup, backupName string) *Backup {
+	for _, backup := range backups {
+		if backup.Name == backupName {
+			return backup
+		}
+	}
+	return nil
+}
+
+func getBlockPinsForVolume(bsDriver BackupStoreDriver, volumeName string) ([]*BlockPin, error) {
+	fileList, err := bsDriver.List(getPinPath(bsDriver, volumeName))
+	if err != nil {
+		// path doesn't exist
+		return []*BlockPin{}, nil
+	}
+	pins := []*BlockPin{}
+	for _, name := range util.ExtractNames(fileList, "", PIN_SUFFIX) {
+		file := getPinFilePath(bsDriver, volumeName, name)
+		pin := &BlockPin{driver: bsDriver}
+		if err := LoadConfigInBackupStore(bsDriver, file, pin); err != nil {
+			// the pin may have been removed by its owner in the meantime
+			if !bsDriver.FileExists(file) {
+				continue
+			}
+			return nil, errors.Wrapf(err, "failed to load block pin %v", file)
+		}
+		if pin.isExpired() {
+			log.Infof("Ignored expired block pin %v on backupstore", file)
+			continue
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+func getPinPath(driver BackupStoreDriver, volumeName string) string {
+	return filepath.Join(getVolumePath(driver, volumeName), PINS_DIRECTORY) + "/"
+}
+
+func getPinFilePath(driver BackupStoreDriver, volumeName, name string) string {
+	return filepath.Join(getPinPath(driver, volumeName), name+PIN_SUFFIX)
+}
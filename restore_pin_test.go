@@ -0,0 +1,70 @@
+package backupstore
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestBlockPins(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m, nil
+	})
+
+	assert.NoError(addVolume(m, &Volume{Name: "pvc-1", LastBackupName: "backup-3", CompressionMethod: "lz4"}))
+	a, b, c := util.GetChecksum([]byte("a")), util.GetChecksum([]byte("b")), util.GetChecksum([]byte("c"))
+	d := util.GetChecksum([]byte("d"))
+	for _, checksum := range []string{a, b, c, d} {
+		assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", checksum), bytes.NewReader([]byte(checksum))))
+	}
+	backups := []*Backup{
+		{Name: "backup-1", Blocks: []BlockMapping{{BlockChecksum: a}}},
+		{Name: "backup-2", Blocks: []BlockMapping{{BlockChecksum: b}, {BlockChecksum: d}}},
+		{Name: "backup-3", Blocks: []BlockMapping{{BlockChecksum: c}}},
+	}
+	for _, backup := range backups {
+		backup.VolumeName = "pvc-1"
+		backup.CreatedTime = "2026-01-01T00:00:00Z"
+		assert.NoError(saveBackup(m, backup))
+	}
+	volumeURL := EncodeBackupURL("", "pvc-1", mockDriverURL)
+
+	_, err := PinBackupBlocks(EncodeBackupURL("backup-0", "pvc-1", mockDriverURL), 0)
+	assert.Error(err)
+	backupPin, err := PinBackupBlocks(EncodeBackupURL("backup-1", "pvc-1", mockDriverURL), 0)
+	assert.NoError(err)
+	blocksPin, err := PinBlocks(volumeURL, []string{b}, 0)
+	assert.NoError(err)
+	_, err = PinBlocks(volumeURL, []string{d}, -time.Minute)
+	assert.NoError(err)
+	pins, err := ListBlockPins(volumeURL)
+	assert.NoError(err)
+	assert.Len(pins, 2)
+
+	// the blocks of the pinned backup are kept even though the backup is deleted, the expired pin is ignored
+	assert.NoError(DeleteBackups(volumeURL, []string{"backup-1", "backup-2"}))
+	assert.True(m.FileExists(getBlockFilePath(m, "pvc-1", a)))
+	assert.True(m.FileExists(getBlockFilePath(m, "pvc-1", b)))
+	assert.True(m.FileExists(getBlockFilePath(m, "pvc-1", c)))
+	assert.False(m.FileExists(getBlockFilePath(m, "pvc-1", d)))
+
+	// the blocks are collected once unpinned
+	assert.NoError(backupPin.Unpin())
+	assert.NoError(backupPin.Unpin())
+	assert.Error(backupPin.Refresh(0))
+	assert.NoError(blocksPin.Unpin())
+	assert.NoError(DeleteBackups(volumeURL, []string{"backup-3"}))
+	assert.False(m.FileExists(getBlockFilePath(m, "pvc-1", a)))
+	assert.False(m.FileExists(getBlockFilePath(m, "pvc-1", b)))
+	assert.False(m.FileExists(getBlockFilePath(m, "pvc-1", c)))
+}
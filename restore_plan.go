@@ -0,0 +1,345 @@
+package backupstore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gammazero/workerpool"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ArchiveState is the state of a file which can be moved to an archive tier by the backend
+type ArchiveState string
+
+const (
+	ArchiveStateOnline      = ArchiveState("Online")
+	ArchiveStateArchived    = ArchiveState("Archived")
+	ArchiveStateRehydrating = ArchiveState("Rehydrating")
+)
+
+// RehydratePriority trades the cost of the rehydration for the time it takes, the drivers map it to the
+// closest retrieval option of the backend
+type RehydratePriority string
+
+const (
+	RehydratePriorityLow      = RehydratePriority("Low")
+	RehydratePriorityStandard = RehydratePriority("Standard")
+	RehydratePriorityHigh     = RehydratePriority("High")
+)
+
+const (
+	// DEFAULT_REHYDRATION_POLL_INTERVAL is the interval checking if the rehydrating blocks are readable
+	DEFAULT_REHYDRATION_POLL_INTERVAL = 5 * time.Minute
+	// DEFAULT_REHYDRATION_CONCURRENT_LIMIT is the number of the blocks checked or rehydrated in parallel
+	DEFAULT_REHYDRATION_CONCURRENT_LIMIT = 32
+)
+
+// ArchivedError is returned by the drivers reading a file in an archive tier, which must be rehydrated first
+type ArchivedError struct {
+	Path string
+}
+
+func (e *ArchivedError) Error() string {
+	return fmt.Sprintf("%v is in an archive tier and must be rehydrated before reading it", e.Path)
+}
+
+// IsArchivedError checks if the file cannot be read since it's archived
+func IsArchivedError(err error) bool {
+	var archivedErr *ArchivedError
+	return errors.As(err, &archivedErr)
+}
+
+// DeltaRestoreRehydrationOperations can be optionally implemented by the DeltaRestoreOperations to receive
+// the restore plan whenever the rehydration of the blocks is checked by RestoreDeltaBlockBackupWhenReady
+type DeltaRestoreRehydrationOperations interface {
+	UpdateRehydrationStatus(snapshot string, plan *RestorePlan)
+}
+
+type RestorePlanOptions struct {
+	// Priority of the rehydration, defaults to RehydratePriorityStandard
+	Priority RehydratePriority
+	// PollInterval defaults to DEFAULT_REHYDRATION_POLL_INTERVAL
+	PollInterval time.Duration
+	// ConcurrentLimit defaults to DEFAULT_REHYDRATION_CONCURRENT_LIMIT
+	ConcurrentLimit int32
+}
+
+// RestorePlan is the archive state of the blocks of a backup, the backup can be restored once it's Ready
+type RestorePlan struct {
+	BackupURL string
+
+	BlockCount       int
+	OnlineCount      int
+	ArchivedCount    int
+	RehydratingCount int
+
+	// ETA is the estimated time until all the blocks are readable, it's only known after the rehydration
+	// is requested and doesn't include the time restoring the blocks
+	ETA   time.Duration
+	Ready bool
+
+	archiveOps BackupStoreArchiveDriver
+	// pendingPaths are the blocks not online, archivedPaths are the ones of them not being rehydrated yet
+	pendingPaths  []string
+	archivedPaths []string
+	readyAt       time.Time
+}
+
+func (o *RestorePlanOptions) withDefaults() *RestorePlanOptions {
+	opts := RestorePlanOptions{}
+	if o != nil {
+		opts = *o
+	}
+	if opts.Priority == "" {
+		opts.Priority = RehydratePriorityStandard
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DEFAULT_REHYDRATION_POLL_INTERVAL
+	}
+	if opts.ConcurrentLimit <= 0 {
+		opts.ConcurrentLimit = DEFAULT_REHYDRATION_CONCURRENT_LIMIT
+	}
+	return &opts
+}
+
+// PlanRestore checks the archive state of the blocks of the backup without changing anything. The backup is
+// always ready on the backup targets without archive tiers.
+func PlanRestore(backupURL string, opts *RestorePlanOptions) (*RestorePlan, error) {
+	opts = opts.withDefaults()
+	plan, err := newRestorePlan(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := plan.refresh(opts); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// RehydrateBackup requests the rehydration of all the archived blocks of the backup in bulk, and returns the
+// plan with the estimated time until the backup can be restored
+func RehydrateBackup(backupURL string, opts *RestorePlanOptions) (*RestorePlan, error) {
+	opts = opts.withDefaults()
+	plan, err := PlanRestore(backupURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := plan.rehydrate(plan.pendingPaths, opts); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// RestoreDeltaBlockBackupWhenReady rehydrates the archived blocks of the backup, and starts the restore by
+// RestoreDeltaBlockBackup once all the blocks are readable. The rehydration is waited for in the background,
+// the progress is reported by DeltaRestoreRehydrationOperations if implemented by config.DeltaOps and the
+// failures by UpdateRestoreStatus.
+func RestoreDeltaBlockBackupWhenReady(config *DeltaRestoreConfig, opts *RestorePlanOptions) error {
+	if config == nil {
+		return fmt.Errorf("invalid empty config for restore")
+	}
+	deltaOps := config.DeltaOps
+	if deltaOps == nil {
+		return fmt.Errorf("missing DeltaRestoreOperations")
+	}
+
+	opts = opts.withDefaults()
+	plan, err := RehydrateBackup(config.BackupURL, opts)
+	if err != nil {
+		return err
+	}
+	if plan.Ready {
+		return RestoreDeltaBlockBackup(config)
+	}
+
+	log := log.WithFields(logrus.Fields{
+		"backupURL": config.BackupURL,
+	})
+	go func() {
+		ticker := time.NewTicker(opts.PollInterval)
+		defer ticker.Stop()
+		for !plan.Ready {
+			updateRehydrationStatus(deltaOps, config.Filename, plan)
+			log.Infof("Waiting for %v archived and %v rehydrating blocks, ETA %v",
+				plan.ArchivedCount, plan.RehydratingCount, plan.ETA)
+
+			select {
+			case <-deltaOps.GetStopChan():
+				deltaOps.UpdateRestoreStatus(config.Filename, 0, fmt.Errorf("restore stopped while rehydrating blocks"))
+				return
+			case <-ticker.C:
+			}
+
+			if err := plan.refresh(opts); err != nil {
+				deltaOps.UpdateRestoreStatus(config.Filename, 0, err)
+				return
+			}
+			// the rehydrated blocks can be archived again by the lifecycle rules before the restore starts
+			if err := plan.rehydrate(plan.archivedPaths, opts); err != nil {
+				deltaOps.UpdateRestoreStatus(config.Filename, 0, err)
+				return
+			}
+		}
+		updateRehydrationStatus(deltaOps, config.Filename, plan)
+
+		log.Info("All blocks are rehydrated, starting restore")
+		if err := RestoreDeltaBlockBackup(config); err != nil {
+			deltaOps.UpdateRestoreStatus(config.Filename, 0, err)
+		}
+	}()
+	return nil
+}
+
+func updateRehydrationStatus(deltaOps DeltaRestoreOperations, snapshot string, plan *RestorePlan) {
+	rehydrationOps, ok := deltaOps.(DeltaRestoreRehydrationOperations)
+	if !ok {
+		return
+	}
+	p := *plan
+	rehydrationOps.UpdateRehydrationStatus(snapshot, &p)
+}
+
+func newRestorePlan(backupURL string) (*RestorePlan, error) {
+	driver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	backupName, volumeName, _, err := DecodeBackupURL(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	backup, err := loadBackup(driver, backupName, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	if isBackupInProgress(backup) {
+		return nil, fmt.Errorf("backup %v of volume %v is in progress", backupName, volumeName)
+	}
+
+	plan := &RestorePlan{
+		BackupURL: backupURL,
+	}
+	plan.archiveOps, _ = driver.(BackupStoreArchiveDriver)
+
+	checksums := map[string]bool{}
+	for _, block := range backup.Blocks {
+		if checksums[block.BlockChecksum] {
+			continue
+		}
+		checksums[block.BlockChecksum] = true
+		plan.pendingPaths = append(plan.pendingPaths, getBlockFilePath(driver, volumeName, block.BlockChecksum))
+	}
+	plan.BlockCount = len(plan.pendingPaths)
+	return plan, nil
+}
+
+// refresh checks the archive state of the blocks not known to be online yet
+func (p *RestorePlan) refresh(opts *RestorePlanOptions) error {
+	if p.archiveOps == nil {
+		p.pendingPaths = nil
+	}
+
+	var (
+		lock     sync.Mutex
+		pending  []string
+		archived []string
+		errs     []error
+	)
+	forEach(p.pendingPaths, opts, func(path string) {
+		state, err := p.archiveOps.ArchiveState(path)
+
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to get archive state of %v", path))
+			return
+		}
+		if state == ArchiveStateOnline {
+			return
+		}
+		if state == ArchiveStateArchived {
+			archived = append(archived, path)
+		}
+		pending = append(pending, path)
+	})
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	p.pendingPaths = pending
+	p.archivedPaths = archived
+	p.ArchivedCount = len(archived)
+	p.RehydratingCount = len(pending) - len(archived)
+	p.OnlineCount = p.BlockCount - len(pending)
+	p.Ready = len(pending) == 0
+	p.updateETA(opts)
+	return nil
+}
+
+// rehydrate requests the rehydration of the blocks. The blocks being rehydrated can be requested as well to
+// get the estimated time until they are readable.
+func (p *RestorePlan) rehydrate(paths []string, opts *RestorePlanOptions) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	var (
+		lock sync.Mutex
+		errs []error
+	)
+	readyAt := p.readyAt
+	start := time.Now()
+	forEach(paths, opts, func(path string) {
+		eta, err := p.archiveOps.Rehydrate(path, opts.Priority)
+
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to rehydrate %v", path))
+			return
+		}
+		if t := start.Add(eta); t.After(readyAt) {
+			readyAt = t
+		}
+	})
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	log.Infof("Requested rehydration of %v blocks of backup %v", len(paths), p.BackupURL)
+	p.readyAt = readyAt
+	p.archivedPaths = nil
+	p.RehydratingCount = len(p.pendingPaths)
+	p.ArchivedCount = 0
+	p.updateETA(opts)
+	return nil
+}
+
+func forEach(paths []string, opts *RestorePlanOptions, f func(path string)) {
+	pool := workerpool.New(int(opts.ConcurrentLimit))
+	for _, path := range paths {
+		path := path
+		pool.Submit(func() {
+			f(path)
+		})
+	}
+	pool.StopWait()
+}
+
+// updateETA estimates the time until the blocks are readable. It's at least a poll interval if the
+// rehydration takes longer than estimated.
+func (p *RestorePlan) updateETA(opts *RestorePlanOptions) {
+	switch {
+	case p.Ready:
+		p.ETA = 0
+	case p.readyAt.IsZero():
+		p.ETA = 0
+	default:
+		p.ETA = time.Until(p.readyAt)
+		if p.ETA < opts.PollInterval {
+			p.ETA = opts.PollInterval
+		}
+	}
+}
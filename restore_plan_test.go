@@ -0,0 +1,128 @@
+package backupstore
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+// archiveMockStoreDriver keeps the archive state of the files, the rehydration completes when the state
+// is checked for the rehydrateChecks time
+type archiveMockStoreDriver struct {
+	*writableMockStoreDriver
+
+	sync.Mutex
+	states          map[string]ArchiveState
+	checks          map[string]int
+	rehydrateChecks int
+	rehydrated      []string
+}
+
+func (m *archiveMockStoreDriver) ArchiveState(filePath string) (ArchiveState, error) {
+	m.Lock()
+	defer m.Unlock()
+	state, exists := m.states[filePath]
+	if !exists {
+		return ArchiveStateOnline, nil
+	}
+	if state == ArchiveStateRehydrating {
+		if m.checks[filePath]++; m.checks[filePath] >= m.rehydrateChecks {
+			m.states[filePath] = ArchiveStateOnline
+		}
+	}
+	return state, nil
+}
+
+func (m *archiveMockStoreDriver) Rehydrate(filePath string, priority RehydratePriority) (time.Duration, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.states[filePath] == ArchiveStateArchived {
+		m.states[filePath] = ArchiveStateRehydrating
+		m.rehydrated = append(m.rehydrated, filePath)
+	}
+	if priority == RehydratePriorityHigh {
+		return time.Hour, nil
+	}
+	return 10 * time.Hour, nil
+}
+
+func TestRestorePlan(t *testing.T) {
+	assert := assert.New(t)
+
+	mock := &mockStoreDriver{}
+	m := &archiveMockStoreDriver{
+		writableMockStoreDriver: &writableMockStoreDriver{mock},
+		states:                  map[string]ArchiveState{},
+		checks:                  map[string]int{},
+	}
+	mock.Init()
+	defer mock.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m, nil
+	})
+
+	a, b, c := util.GetChecksum([]byte("a")), util.GetChecksum([]byte("b")), util.GetChecksum([]byte("c"))
+	assert.NoError(saveBackup(m, &Backup{
+		Name:        "backup-1",
+		VolumeName:  "pvc-1",
+		CreatedTime: "2023-01-01T00:00:00Z",
+		Blocks: []BlockMapping{
+			{Offset: 0, BlockChecksum: a},
+			{Offset: DEFAULT_BLOCK_SIZE, BlockChecksum: b},
+			{Offset: 2 * DEFAULT_BLOCK_SIZE, BlockChecksum: c},
+			{Offset: 3 * DEFAULT_BLOCK_SIZE, BlockChecksum: c},
+		},
+	}))
+	m.states[getBlockFilePath(m, "pvc-1", a)] = ArchiveStateArchived
+	m.states[getBlockFilePath(m, "pvc-1", b)] = ArchiveStateRehydrating
+	m.rehydrateChecks = 3
+	backupURL := EncodeBackupURL("backup-1", "pvc-1", mockDriverURL)
+
+	plan, err := PlanRestore(backupURL, nil)
+	assert.NoError(err)
+	assert.Equal(3, plan.BlockCount)
+	assert.Equal(1, plan.OnlineCount)
+	assert.Equal(1, plan.ArchivedCount)
+	assert.Equal(1, plan.RehydratingCount)
+	assert.False(plan.Ready)
+	assert.Equal(time.Duration(0), plan.ETA)
+	assert.Empty(m.rehydrated)
+
+	opts := &RestorePlanOptions{Priority: RehydratePriorityHigh, PollInterval: time.Minute}
+	plan, err = RehydrateBackup(backupURL, opts)
+	assert.NoError(err)
+	assert.Equal(0, plan.ArchivedCount)
+	assert.Equal(2, plan.RehydratingCount)
+	assert.Equal([]string{getBlockFilePath(m, "pvc-1", a)}, m.rehydrated)
+	assert.InDelta(float64(time.Hour), float64(plan.ETA), float64(time.Minute))
+
+	// only the blocks not online are checked again until all of them are rehydrated
+	for i := 0; i < m.rehydrateChecks && !plan.Ready; i++ {
+		assert.NoError(plan.refresh(opts.withDefaults()))
+		assert.GreaterOrEqual(plan.ETA, time.Minute)
+		plan.readyAt = time.Now()
+	}
+	assert.NoError(plan.refresh(opts.withDefaults()))
+	assert.Equal(3, plan.OnlineCount)
+	assert.True(plan.Ready)
+	assert.Equal(time.Duration(0), plan.ETA)
+	assert.Equal(m.rehydrateChecks, m.checks[getBlockFilePath(m, "pvc-1", a)])
+
+	// the backups are always ready without archive tiers
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m.writableMockStoreDriver, nil
+	})
+	plan, err = PlanRestore(backupURL, nil)
+	assert.NoError(err)
+	assert.True(plan.Ready)
+	assert.Equal(3, plan.OnlineCount)
+
+	assert.True(IsArchivedError(&ArchivedError{Path: "blocks/a.blk"}))
+	assert.False(IsArchivedError(&ConflictError{Path: "volume.cfg"}))
+}
@@ -0,0 +1,279 @@
+package backupstore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/gammazero/workerpool"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	// DEFAULT_RESTORE_PRECHECK_CONCURRENT_LIMIT is the number of the blocks checked for existence in parallel
+	DEFAULT_RESTORE_PRECHECK_CONCURRENT_LIMIT = 32
+)
+
+type RestorePrecheckOptions struct {
+	// Filename is the file or the block device the delta block backup is going to be restored to, the capacity
+	// isn't checked if empty
+	Filename string
+	// SamplePercent is the percent of the blocks of the backup checked for existence, the blocks are sampled
+	// evenly. All the blocks are checked if 0
+	SamplePercent int
+	// ConcurrentLimit defaults to DEFAULT_RESTORE_PRECHECK_CONCURRENT_LIMIT
+	ConcurrentLimit int32
+}
+
+// RestorePrecheckReport tells if the backup can be restored, it's Ready if there is no problem
+type RestorePrecheckReport struct {
+	BackupURL  string
+	VolumeName string
+	BackupName string
+	VolumeSize int64 `json:",string"`
+
+	// BlockCount is the number of the distinct blocks of the backup, CheckedBlocks of them were checked
+	BlockCount    int
+	CheckedBlocks int
+	MissingBlocks []string `json:",omitempty"`
+
+	RequiredFeatures              []string `json:",omitempty"`
+	UnsupportedFeatures           []string `json:",omitempty"`
+	UnsupportedCompressionMethods []string `json:",omitempty"`
+
+	// RequiredBytes is the capacity needed by the restore, the volume size for the block devices, and the bytes
+	// of the blocks for the sparse files. AvailableBytes is the capacity of Filename, -1 if it isn't checked
+	RequiredBytes  int64 `json:",string"`
+	AvailableBytes int64 `json:",string"`
+
+	// Problems are the reasons the backup cannot be restored
+	Problems []string `json:",omitempty"`
+	Ready    bool
+}
+
+func (o *RestorePrecheckOptions) withDefaults() (*RestorePrecheckOptions, error) {
+	opts := RestorePrecheckOptions{}
+	if o != nil {
+		opts = *o
+	}
+	if opts.SamplePercent < 0 || opts.SamplePercent > 100 {
+		return nil, fmt.Errorf("invalid sample percent %v, must be between 0 and 100", opts.SamplePercent)
+	}
+	if opts.SamplePercent == 0 {
+		opts.SamplePercent = 100
+	}
+	if opts.ConcurrentLimit <= 0 {
+		opts.ConcurrentLimit = DEFAULT_RESTORE_PRECHECK_CONCURRENT_LIMIT
+	}
+	return &opts, nil
+}
+
+// PrecheckRestore checks if the backup can be restored without touching the restore target: the backup is
+// complete, the blocks exist, the capacity of the restore target suffices, and the features and the compression
+// methods required by the backup are supported. The backup problems are returned in the report instead of
+// failing, the error is only returned if the checks cannot be done.
+func PrecheckRestore(backupURL string, opts *RestorePrecheckOptions) (*RestorePrecheckReport, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	backupName, volumeName, _, err := DecodeBackupURL(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	if backupName == "" {
+		return nil, fmt.Errorf("missing backup name in %v", backupURL)
+	}
+
+	report := &RestorePrecheckReport{
+		BackupURL:      backupURL,
+		VolumeName:     volumeName,
+		BackupName:     backupName,
+		AvailableBytes: -1,
+	}
+	addProblem := func(err error) {
+		if err != nil {
+			report.Problems = append(report.Problems, err.Error())
+		}
+	}
+
+	volume, err := loadVolume(driver, volumeName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load volume %v", volumeName)
+	}
+	report.VolumeSize = volume.Size
+	addProblem(checkVolumeCompressionMigration(volume))
+
+	backup, err := loadBackup(driver, backupName, volumeName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load backup %v of volume %v", backupName, volumeName)
+	}
+	if isBackupInProgress(backup) {
+		addProblem(fmt.Errorf("backup %v of volume %v is in progress", backupName, volumeName))
+	}
+	addProblem(checkBackupAborted(backup))
+	addProblem(checkBackupBroken(backup))
+	addProblem(checkBackupCompliance(backup))
+
+	report.RequiredFeatures = backup.RequiredFeatures
+	if err := checkBackupFeatures(backup); err != nil {
+		var featureErr *UnsupportedFeatureError
+		if errors.As(err, &featureErr) {
+			report.UnsupportedFeatures = featureErr.Features
+		}
+		addProblem(err)
+	}
+	report.UnsupportedCompressionMethods = getUnsupportedCompressionMethods(backup)
+	if len(report.UnsupportedCompressionMethods) > 0 {
+		addProblem(fmt.Errorf("backup %v requires unsupported compression method(s) %v", backupName,
+			report.UnsupportedCompressionMethods))
+	}
+
+	if backup.SingleFile.FilePath != "" {
+		if !backup.SingleFile.Inline && !driver.FileExists(backup.SingleFile.FilePath) {
+			addProblem(fmt.Errorf("file %v of backup %v is missing", backup.SingleFile.FilePath, backupName))
+		}
+	} else {
+		if volume.Size == 0 || volume.Size%DEFAULT_BLOCK_SIZE != 0 {
+			addProblem(fmt.Errorf("invalid volume size %v", volume.Size))
+		}
+		precheckBlocks(driver, backup, opts, report)
+		if len(report.MissingBlocks) > 0 {
+			addProblem(fmt.Errorf("%v of %v checked blocks of backup %v are missing", len(report.MissingBlocks),
+				report.CheckedBlocks, backupName))
+		}
+	}
+
+	// the size of the single file backup is unknown until it's downloaded
+	if opts.Filename != "" && backup.SingleFile.FilePath == "" {
+		if err := precheckCapacity(opts.Filename, volume, backup, report); err != nil {
+			return nil, err
+		}
+		if report.AvailableBytes < report.RequiredBytes {
+			addProblem(fmt.Errorf("%v has %v bytes available, but the restore requires %v bytes", opts.Filename,
+				report.AvailableBytes, report.RequiredBytes))
+		}
+	}
+
+	report.Ready = len(report.Problems) == 0
+	return report, nil
+}
+
+// getUnsupportedCompressionMethods returns the compression methods of the backup and its blocks without a codec
+func getUnsupportedCompressionMethods(backup *Backup) []string {
+	methods := map[string]bool{backup.CompressionMethod: true}
+	for _, block := range backup.Blocks {
+		methods[getBlockCompressionMethod(backup, block)] = true
+	}
+	unsupported := []string{}
+	for method := range methods {
+		if method == "" {
+			continue
+		}
+		if _, err := util.GetCompressor(method); err != nil {
+			unsupported = append(unsupported, method)
+		}
+	}
+	if len(unsupported) == 0 {
+		return nil
+	}
+	sort.Strings(unsupported)
+	return unsupported
+}
+
+// precheckBlocks checks the existence of the distinct blocks of the backup, or the evenly sampled part of them
+func precheckBlocks(driver BackupStoreDriver, backup *Backup, opts *RestorePrecheckOptions, report *RestorePrecheckReport) {
+	checksums := []string{}
+	seen := map[string]bool{}
+	for _, block := range backup.Blocks {
+		if !seen[block.BlockChecksum] {
+			seen[block.BlockChecksum] = true
+			checksums = append(checksums, block.BlockChecksum)
+		}
+	}
+	sort.Strings(checksums)
+	report.BlockCount = len(checksums)
+
+	sampled := checksums
+	if opts.SamplePercent < 100 && len(checksums) > 0 {
+		count := (len(checksums)*opts.SamplePercent + 99) / 100
+		sampled = make([]string, 0, count)
+		for i := 0; i < count; i++ {
+			sampled = append(sampled, checksums[i*len(checksums)/count])
+		}
+	}
+	report.CheckedBlocks = len(sampled)
+
+	var (
+		lock    sync.Mutex
+		missing []string
+	)
+	pool := workerpool.New(int(opts.ConcurrentLimit))
+	for _, checksum := range sampled {
+		checksum := checksum
+		pool.Submit(func() {
+			if driver.FileExists(getBlockFilePath(driver, backup.VolumeName, checksum)) {
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			missing = append(missing, checksum)
+		})
+	}
+	pool.StopWait()
+
+	sort.Strings(missing)
+	report.MissingBlocks = missing
+}
+
+// precheckCapacity fills the capacity required by the restore to the file or the block device, and the capacity
+// it has. The block device must hold the whole volume, while the file is sparse and only needs the room of the
+// blocks on the filesystem.
+func precheckCapacity(filename string, volume *Volume, backup *Backup, report *RestorePrecheckReport) error {
+	info, err := os.Stat(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if info != nil && info.Mode()&os.ModeDevice != 0 {
+		file, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		// the size of the block device is only reported by seeking to its end
+		size, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get size of %v", filename)
+		}
+		report.RequiredBytes = volume.Size
+		report.AvailableBytes = size
+		return nil
+	}
+
+	report.RequiredBytes = int64(len(backup.Blocks)) * DEFAULT_BLOCK_SIZE
+	var stat unix.Statfs_t
+	if err := unix.Statfs(filepath.Dir(filename), &stat); err != nil {
+		return errors.Wrapf(err, "failed to get available space for %v", filename)
+	}
+	report.AvailableBytes = int64(stat.Bavail) * int64(stat.Bsize)
+	// the space of the existing file is reused by the restore
+	if info != nil {
+		if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+			report.AvailableBytes += sys.Blocks * 512
+		}
+	}
+	return nil
+}
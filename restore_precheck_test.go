@@ -0,0 +1,78 @@
+package backupstore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestPrecheckRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	assert.NoError(saveVolume(m, &Volume{Name: "pvc-1", Size: 8 * DEFAULT_BLOCK_SIZE, CompressionMethod: "lz4"}))
+	checksums := []string{}
+	blocks := []BlockMapping{}
+	for i := 0; i < 4; i++ {
+		checksum := util.GetChecksum([]byte(fmt.Sprintf("block-%v", i)))
+		assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", checksum), bytes.NewReader([]byte("data"))))
+		checksums = append(checksums, checksum)
+		blocks = append(blocks, BlockMapping{Offset: int64(i) * DEFAULT_BLOCK_SIZE, BlockChecksum: checksum})
+	}
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-1", VolumeName: "pvc-1", CompressionMethod: "lz4",
+		CreatedTime: "2023-01-01T00:00:00Z", Blocks: blocks}))
+	backupURL := EncodeBackupURL("backup-1", "pvc-1", mockDriverURL)
+
+	filename := filepath.Join(t.TempDir(), "volume.img")
+	report, err := PrecheckRestore(backupURL, &RestorePrecheckOptions{Filename: filename})
+	assert.NoError(err)
+	assert.True(report.Ready, report.Problems)
+	assert.Equal(4, report.BlockCount)
+	assert.Equal(4, report.CheckedBlocks)
+	assert.Equal(int64(4*DEFAULT_BLOCK_SIZE), report.RequiredBytes)
+	assert.Greater(report.AvailableBytes, int64(0))
+	_, err = os.Stat(filename)
+	assert.True(os.IsNotExist(err))
+
+	// the missing blocks are found by the full check, the sampled check may miss them
+	assert.NoError(m.Remove(getBlockFilePath(m, "pvc-1", checksums[2])))
+	report, err = PrecheckRestore(backupURL, nil)
+	assert.NoError(err)
+	assert.False(report.Ready)
+	assert.Equal([]string{checksums[2]}, report.MissingBlocks)
+	assert.Equal(int64(-1), report.AvailableBytes)
+	report, err = PrecheckRestore(backupURL, &RestorePrecheckOptions{SamplePercent: 50})
+	assert.NoError(err)
+	assert.Equal(2, report.CheckedBlocks)
+
+	_, err = PrecheckRestore(backupURL, &RestorePrecheckOptions{SamplePercent: 101})
+	assert.Error(err)
+
+	// the unsupported features and compression methods are reported
+	blocks[0].CompressionMethod = "zstd"
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-2", VolumeName: "pvc-1", CompressionMethod: "lz4",
+		CreatedTime: "2023-01-02T00:00:00Z", Blocks: blocks[:2], RequiredFeatures: []string{FeaturePacking}}))
+	report, err = PrecheckRestore(EncodeBackupURL("backup-2", "pvc-1", mockDriverURL), nil)
+	assert.NoError(err)
+	assert.False(report.Ready)
+	assert.Empty(report.MissingBlocks)
+	assert.Equal([]string{FeaturePacking}, report.UnsupportedFeatures)
+	assert.Equal([]string{"zstd"}, report.UnsupportedCompressionMethods)
+	assert.Len(report.Problems, 2)
+
+	// the in progress backup is not ready
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-3", VolumeName: "pvc-1"}))
+	report, err = PrecheckRestore(EncodeBackupURL("backup-3", "pvc-1", mockDriverURL), nil)
+	assert.NoError(err)
+	assert.False(report.Ready)
+	assert.Len(report.Problems, 1)
+}
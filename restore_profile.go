@@ -0,0 +1,187 @@
+package backupstore
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_RESTORE_PROFILE_SLOWEST_BLOCKS is the number of the slowest blocks kept in the restore profile
+	DEFAULT_RESTORE_PROFILE_SLOWEST_BLOCKS = 10
+)
+
+// DeltaRestoreProfileOperations can be optionally implemented by the DeltaRestoreOperations to receive
+// the performance profile of the restore. It's called right before the final restore status update.
+type DeltaRestoreProfileOperations interface {
+	UpdateRestoreProfile(snapshot string, profile *RestoreProfile)
+}
+
+// RestoreProfile is the time breakdown of a restore. The stage durations are summed over all the workers,
+// so they can exceed the Duration of the restore.
+type RestoreProfile struct {
+	Duration time.Duration
+
+	BlockCount     int64
+	ZeroBlockCount int64
+	DownloadBytes  int64
+
+	// WriteBytes is the data written to the volume, including the zeros written for the zero blocks
+	WriteBytes int64
+	// PunchedHoleCount and PunchedHoleBytes are the holes punched for the zero blocks
+	PunchedHoleCount int64
+	PunchedHoleBytes int64
+	// SkippedZeroBytes is the size of the zero blocks left as they are by ZeroBlockStrategySkip
+	SkippedZeroBytes int64
+	// UnchangedBlockCount is the number of the local blocks matching the backup, which are skipped by
+	// DeltaRestoreConfig.FingerprintLocal
+	UnchangedBlockCount int64
+	// ClonedBlockCount is the number of the blocks cloned from the block files instead of being written, they
+	// aren't counted in WriteBytes
+	ClonedBlockCount int64
+
+	Download   time.Duration
+	Decompress time.Duration
+	Checksum   time.Duration
+	Write      time.Duration
+	// Fingerprint is the time spent reading and checksumming the local blocks for DeltaRestoreConfig.FingerprintLocal
+	Fingerprint time.Duration
+
+	Workers       []RestoreWorkerProfile
+	SlowestBlocks []RestoreBlockProfile
+}
+
+// RestoreWorkerProfile is the utilization of a restore worker
+type RestoreWorkerProfile struct {
+	ID          int
+	BlockCount  int64
+	Busy        time.Duration
+	Utilization float64
+}
+
+// RestoreBlockProfile is the time breakdown of restoring a block
+type RestoreBlockProfile struct {
+	Offset        int64
+	BlockChecksum string
+
+	Duration   time.Duration
+	Download   time.Duration
+	Decompress time.Duration
+	Checksum   time.Duration
+	Write      time.Duration
+	// Cloned is set if the block is cloned from the block file by SetReflinkRestoreEnabled
+	Cloned bool
+}
+
+// restoreProfiler collects the block timings from the restore workers
+type restoreProfiler struct {
+	sync.Mutex
+
+	start   time.Time
+	profile RestoreProfile
+	workers map[int]*RestoreWorkerProfile
+}
+
+func newRestoreProfiler() *restoreProfiler {
+	return &restoreProfiler{
+		start:   time.Now(),
+		workers: map[int]*RestoreWorkerProfile{},
+	}
+}
+
+// record adds the timings of the block restored by the worker
+func (p *restoreProfiler) record(workerID int, block RestoreBlockProfile, downloadBytes int64, zero bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	worker, exists := p.workers[workerID]
+	if !exists {
+		worker = &RestoreWorkerProfile{ID: workerID}
+		p.workers[workerID] = worker
+	}
+	worker.BlockCount++
+	worker.Busy += block.Duration
+
+	p.profile.BlockCount++
+	if zero {
+		p.profile.ZeroBlockCount++
+		p.profile.Write += block.Write
+		return
+	}
+	p.profile.DownloadBytes += downloadBytes
+	if block.Cloned {
+		p.profile.ClonedBlockCount++
+	} else {
+		p.profile.WriteBytes += DEFAULT_BLOCK_SIZE
+	}
+	p.profile.Download += block.Download
+	p.profile.Decompress += block.Decompress
+	p.profile.Checksum += block.Checksum
+	p.profile.Write += block.Write
+
+	slowest := p.profile.SlowestBlocks
+	if len(slowest) == DEFAULT_RESTORE_PROFILE_SLOWEST_BLOCKS && block.Duration <= slowest[len(slowest)-1].Duration {
+		return
+	}
+	i := sort.Search(len(slowest), func(i int) bool { return slowest[i].Duration < block.Duration })
+	slowest = append(slowest, RestoreBlockProfile{})
+	copy(slowest[i+1:], slowest[i:])
+	slowest[i] = block
+	if len(slowest) > DEFAULT_RESTORE_PROFILE_SLOWEST_BLOCKS {
+		slowest = slowest[:DEFAULT_RESTORE_PROFILE_SLOWEST_BLOCKS]
+	}
+	p.profile.SlowestBlocks = slowest
+}
+
+// recordZeroFill adds how the range of the zero blocks is cleared
+func (p *restoreProfiler) recordZeroFill(punchedBytes, writeBytes, skippedBytes int64) {
+	p.Lock()
+	defer p.Unlock()
+
+	if punchedBytes > 0 {
+		p.profile.PunchedHoleCount++
+		p.profile.PunchedHoleBytes += punchedBytes
+	}
+	p.profile.WriteBytes += writeBytes
+	p.profile.SkippedZeroBytes += skippedBytes
+}
+
+// recordFingerprint adds the time of fingerprinting a local block
+func (p *restoreProfiler) recordFingerprint(duration time.Duration, unchanged bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.profile.Fingerprint += duration
+	if unchanged {
+		p.profile.UnchangedBlockCount++
+	}
+}
+
+// finish returns the profile of the restore ended now
+func (p *restoreProfiler) finish() *RestoreProfile {
+	p.Lock()
+	defer p.Unlock()
+
+	profile := p.profile
+	profile.Duration = time.Since(p.start)
+	profile.SlowestBlocks = append([]RestoreBlockProfile{}, p.profile.SlowestBlocks...)
+	profile.Workers = make([]RestoreWorkerProfile, 0, len(p.workers))
+	for _, worker := range p.workers {
+		w := *worker
+		if profile.Duration > 0 {
+			w.Utilization = float64(w.Busy) / float64(profile.Duration)
+		}
+		profile.Workers = append(profile.Workers, w)
+	}
+	sort.Slice(profile.Workers, func(i, j int) bool { return profile.Workers[i].ID < profile.Workers[j].ID })
+	return &profile
+}
+
+// updateRestoreProfile passes the profile to the DeltaRestoreOperations if it's interested
+func updateRestoreProfile(deltaOps DeltaRestoreOperations, snapshot string, profiler *restoreProfiler) {
+	profileOps, ok := deltaOps.(DeltaRestoreProfileOperations)
+	if !ok {
+		return
+	}
+	profileOps.UpdateRestoreProfile(snapshot, profiler.finish())
+}
@@ -0,0 +1,68 @@
+package backupstore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestRestoreProfile(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	data := bytes.Repeat([]byte("block"), DEFAULT_BLOCK_SIZE/5+1)[:DEFAULT_BLOCK_SIZE]
+	checksum := util.GetChecksum(data)
+	compressed, err := util.CompressData("lz4", data)
+	assert.NoError(err)
+	assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", checksum), compressed))
+
+	volDev, err := os.Create(filepath.Join(t.TempDir(), "volume"))
+	assert.NoError(err)
+	defer volDev.Close()
+
+	blockProfile := RestoreBlockProfile{Offset: DEFAULT_BLOCK_SIZE, BlockChecksum: checksum}
+	downloadBytes, err := restoreBlockToFile(nil, m, "pvc-1", volDev, "lz4",
+		BlockMapping{Offset: DEFAULT_BLOCK_SIZE, BlockChecksum: checksum}, &blockProfile)
+	assert.NoError(err)
+	assert.Less(downloadBytes, int64(DEFAULT_BLOCK_SIZE))
+	restored := make([]byte, DEFAULT_BLOCK_SIZE)
+	_, err = volDev.ReadAt(restored, DEFAULT_BLOCK_SIZE)
+	assert.NoError(err)
+	assert.Equal(data, restored)
+
+	_, err = restoreBlockToFile(nil, m, "pvc-1", volDev, "gzip",
+		BlockMapping{Offset: 0, BlockChecksum: checksum}, &RestoreBlockProfile{})
+	assert.Error(err)
+
+	// only the slowest blocks are kept, in descending order of the duration
+	profiler := newRestoreProfiler()
+	for i := 0; i < DEFAULT_RESTORE_PROFILE_SLOWEST_BLOCKS+5; i++ {
+		profiler.record(i%2, RestoreBlockProfile{
+			Offset:   int64(i) * DEFAULT_BLOCK_SIZE,
+			Duration: time.Duration(i) * time.Millisecond,
+			Download: time.Millisecond,
+		}, 100, false)
+	}
+	profiler.record(0, RestoreBlockProfile{Duration: time.Hour}, 0, true)
+
+	profile := profiler.finish()
+	assert.Equal(int64(DEFAULT_RESTORE_PROFILE_SLOWEST_BLOCKS+6), profile.BlockCount)
+	assert.Equal(int64(1), profile.ZeroBlockCount)
+	assert.Equal(int64(100*(DEFAULT_RESTORE_PROFILE_SLOWEST_BLOCKS+5)), profile.DownloadBytes)
+	assert.Equal(time.Duration(DEFAULT_RESTORE_PROFILE_SLOWEST_BLOCKS+5)*time.Millisecond, profile.Download)
+	assert.Len(profile.SlowestBlocks, DEFAULT_RESTORE_PROFILE_SLOWEST_BLOCKS)
+	assert.Equal(time.Duration(DEFAULT_RESTORE_PROFILE_SLOWEST_BLOCKS+4)*time.Millisecond, profile.SlowestBlocks[0].Duration)
+	assert.Equal(5*time.Millisecond, profile.SlowestBlocks[DEFAULT_RESTORE_PROFILE_SLOWEST_BLOCKS-1].Duration)
+	assert.Len(profile.Workers, 2)
+	assert.Equal(0, profile.Workers[0].ID)
+	assert.Equal(int64(9), profile.Workers[0].BlockCount)
+}
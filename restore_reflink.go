@@ -0,0 +1,97 @@
+package backupstore
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+var (
+	reflinkRestoreLock    sync.RWMutex
+	reflinkRestoreEnabled = true
+)
+
+// SetReflinkRestoreEnabled sets if the uncompressed blocks of the backup targets on a local filesystem, e.g. vfs
+// and nfs, are cloned into the restored volume by FICLONERANGE instead of being copied. Enabled by default. The
+// blocks are still read and verified, only the writes are saved, and the restored volume shares the extents with
+// the block files on the filesystems supporting reflinks, e.g. xfs and btrfs. The blocks are copied as usual if
+// the volume is on another filesystem or the filesystem doesn't support reflinks, and the coalesced blocks of
+// DeltaRestoreConfig.CoalesceSize are always copied.
+func SetReflinkRestoreEnabled(enabled bool) {
+	reflinkRestoreLock.Lock()
+	defer reflinkRestoreLock.Unlock()
+	reflinkRestoreEnabled = enabled
+}
+
+func IsReflinkRestoreEnabled() bool {
+	reflinkRestoreLock.RLock()
+	defer reflinkRestoreLock.RUnlock()
+	return reflinkRestoreEnabled
+}
+
+// getReflinkBlockFile returns the local path of the block file if the block can be cloned, the block file must
+// hold the uncompressed block without the block header, so it's aligned to the filesystem blocks
+func getReflinkBlockFile(bsDriver BackupStoreDriver, volumeName string, block *Block, progress *progress) (string, bool) {
+	localDriver, ok := bsDriver.(BackupStoreLocalDriver)
+	if !ok || block.compressionMethod != "none" || atomic.LoadInt32(&progress.reflinkUnsupported) != 0 ||
+		!IsReflinkRestoreEnabled() {
+		return "", false
+	}
+	blkFile := getBlockFilePath(bsDriver, volumeName, block.blockChecksum)
+	if bsDriver.FileSize(blkFile) != DEFAULT_BLOCK_SIZE {
+		return "", false
+	}
+	return localDriver.LocalPath(blkFile), true
+}
+
+// reflinkBlockToFile reads and verifies the uncompressed block, then clones it from the block file into the
+// volume. The read block is written if the clone fails, and the later blocks of the restore aren't cloned then.
+// It returns false if the block file cannot be verified as the uncompressed block, the block is restored as
+// usual then.
+func reflinkBlockToFile(blkFile string, volDev *os.File, block *Block, blockProfile *RestoreBlockProfile,
+	progress *progress) (int64, bool, error) {
+	start := time.Now()
+	src, err := os.Open(blkFile)
+	if err != nil {
+		return 0, false, nil
+	}
+	defer src.Close()
+	buf := blockBuffers.Get()
+	defer blockBuffers.Put(buf)
+	downloadBytes, err := buf.ReadFrom(src)
+	if err != nil {
+		return 0, false, nil
+	}
+	blockProfile.Download = time.Since(start)
+
+	start = time.Now()
+	if util.GetChecksum(buf.Bytes()) != block.blockChecksum {
+		return 0, false, nil
+	}
+	blockProfile.Checksum = time.Since(start)
+
+	start = time.Now()
+	defer func() {
+		blockProfile.Write = time.Since(start)
+	}()
+	err = unix.IoctlFileCloneRange(int(volDev.Fd()), &unix.FileCloneRange{
+		Src_fd:      int64(src.Fd()),
+		Src_offset:  0,
+		Src_length:  uint64(buf.Len()),
+		Dest_offset: uint64(block.offset),
+	})
+	if err == nil {
+		blockProfile.Cloned = true
+		return downloadBytes, true, nil
+	}
+	if atomic.CompareAndSwapInt32(&progress.reflinkUnsupported, 0, 1) {
+		log.WithError(err).Infof("Cannot clone block %v into %v, copying the blocks instead", blkFile, volDev.Name())
+	}
+	_, err = volDev.WriteAt(buf.Bytes(), block.offset)
+	return downloadBytes, true, err
+}
@@ -0,0 +1,131 @@
+package backupstore
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"github.com/longhorn/backupstore/types"
+	"github.com/longhorn/backupstore/util"
+)
+
+// localMockStoreDriver stores the files on the local filesystem
+type localMockStoreDriver struct {
+	*writableMockStoreDriver
+	dir string
+}
+
+func (m *localMockStoreDriver) LocalPath(path string) string {
+	return filepath.Join(m.dir, path)
+}
+
+func (m *localMockStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	if err := m.fs.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return m.writableMockStoreDriver.Write(dst, rs)
+}
+
+// profilingRestoreOperations captures the restore profile
+type profilingRestoreOperations struct {
+	fileRestoreOperations
+	profile *RestoreProfile
+}
+
+func (o *profilingRestoreOperations) UpdateRestoreProfile(snapshot string, profile *RestoreProfile) {
+	o.profile = profile
+}
+
+// isReflinkSupported checks if the files in the directory can be cloned
+func isReflinkSupported(dir string) bool {
+	src, err := os.Create(filepath.Join(dir, "reflink-src"))
+	if err != nil {
+		return false
+	}
+	defer src.Close()
+	dst, err := os.Create(filepath.Join(dir, "reflink-dst"))
+	if err != nil {
+		return false
+	}
+	defer dst.Close()
+	if _, err := src.Write(make([]byte, DEFAULT_BLOCK_SIZE)); err != nil {
+		return false
+	}
+	return unix.IoctlFileCloneRange(int(dst.Fd()), &unix.FileCloneRange{Src_fd: int64(src.Fd()),
+		Src_length: DEFAULT_BLOCK_SIZE}) == nil
+}
+
+func TestReflinkRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	m := &localMockStoreDriver{writableMockStoreDriver: &writableMockStoreDriver{&mockStoreDriver{}}, dir: dir}
+	m.Init()
+	defer m.uninstall()
+	m.fs = afero.NewBasePathFs(afero.NewOsFs(), dir)
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m, nil
+	})
+
+	expected := []byte{}
+	blocks := []BlockMapping{}
+	assert.NoError(addVolume(m, &Volume{Name: "pvc-1", Size: 2 * DEFAULT_BLOCK_SIZE, CompressionMethod: "none"}))
+	for i, pattern := range []string{"first", "second"} {
+		data := bytes.Repeat([]byte(pattern), DEFAULT_BLOCK_SIZE/len(pattern)+1)[:DEFAULT_BLOCK_SIZE]
+		checksum := util.GetChecksum(data)
+		blocks = append(blocks, BlockMapping{Offset: int64(i) * DEFAULT_BLOCK_SIZE, BlockChecksum: checksum})
+		expected = append(expected, data...)
+		assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", checksum), bytes.NewReader(data)))
+	}
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-1", VolumeName: "pvc-1", CompressionMethod: "none",
+		Blocks: blocks, CreatedTime: "2026-01-01T00:00:00Z"}))
+
+	restore := func() *RestoreProfile {
+		ops := &profilingRestoreOperations{}
+		filename := filepath.Join(dir, "restored")
+		os.Remove(filename)
+		summaries := make(chan *RestoreSummary, 1)
+		assert.NoError(RestoreDeltaBlockBackup(&DeltaRestoreConfig{
+			BackupURL:       EncodeBackupURL("backup-1", "pvc-1", mockDriverURL),
+			DeltaOps:        ops,
+			Filename:        filename,
+			ConcurrentLimit: 1,
+			OnComplete: func(summary *RestoreSummary) {
+				summaries <- summary
+			},
+		}))
+		summary := <-summaries
+		assert.Equal(types.ProgressStateComplete, summary.State, "%v", summary.Error)
+		restored, err := os.ReadFile(filename)
+		assert.NoError(err)
+		assert.True(bytes.Equal(expected, restored))
+		return ops.profile
+	}
+
+	// the blocks are cloned if the filesystem supports it, and copied otherwise
+	profile := restore()
+	if assert.NotNil(profile) {
+		if isReflinkSupported(dir) {
+			assert.Equal(int64(2), profile.ClonedBlockCount)
+			assert.Equal(int64(0), profile.WriteBytes)
+		} else {
+			assert.Equal(int64(0), profile.ClonedBlockCount)
+			assert.Equal(int64(2*DEFAULT_BLOCK_SIZE), profile.WriteBytes)
+		}
+	}
+
+	SetReflinkRestoreEnabled(false)
+	defer SetReflinkRestoreEnabled(true)
+	profile = restore()
+	if assert.NotNil(profile) {
+		assert.Equal(int64(0), profile.ClonedBlockCount)
+		assert.Equal(int64(2*DEFAULT_BLOCK_SIZE), profile.WriteBytes)
+	}
+}
@@ -0,0 +1,78 @@
+package backupstore
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ZeroBlockStrategy is how the incremental restore clears the blocks removed since the last restored backup
+type ZeroBlockStrategy string
+
+const (
+	// ZeroBlockStrategyAllocate allocates the range by fallocate without punching it, which is the default
+	ZeroBlockStrategyAllocate = ZeroBlockStrategy("allocate")
+	// ZeroBlockStrategySkip leaves the range as it is, e.g. when restoring to a freshly created sparse file
+	ZeroBlockStrategySkip = ZeroBlockStrategy("skip")
+	// ZeroBlockStrategyPunchHole punches a hole for the range, and writes zeros if the filesystem doesn't
+	// support punching holes
+	ZeroBlockStrategyPunchHole = ZeroBlockStrategy("punch-hole")
+	// ZeroBlockStrategyWriteZeros writes zeros to the range, e.g. for the block devices not discarding the data
+	ZeroBlockStrategyWriteZeros = ZeroBlockStrategy("write-zeros")
+	// ZeroBlockStrategyFallocate punches a hole by fallocate PUNCH_HOLE|KEEP_SIZE, and fails if the filesystem
+	// doesn't support it
+	ZeroBlockStrategyFallocate = ZeroBlockStrategy("fallocate")
+)
+
+var zeroBlock = make([]byte, DEFAULT_BLOCK_SIZE)
+
+// getZeroBlockStrategy returns the zero block strategy of the restore, ZeroBlockStrategyAllocate by default
+func getZeroBlockStrategy(config *DeltaRestoreConfig) (ZeroBlockStrategy, error) {
+	switch config.ZeroBlockStrategy {
+	case "":
+		return ZeroBlockStrategyAllocate, nil
+	case ZeroBlockStrategyAllocate, ZeroBlockStrategySkip, ZeroBlockStrategyPunchHole,
+		ZeroBlockStrategyWriteZeros, ZeroBlockStrategyFallocate:
+		return config.ZeroBlockStrategy, nil
+	}
+	return "", fmt.Errorf("invalid zero block strategy %v", config.ZeroBlockStrategy)
+}
+
+// fillZeros clears the range of the volume by the strategy, and records how it's cleared in the profile
+func fillZeros(volDev *os.File, strategy ZeroBlockStrategy, offset, length int64, profiler *restoreProfiler) error {
+	switch strategy {
+	case ZeroBlockStrategySkip:
+		profiler.recordZeroFill(0, 0, length)
+		return nil
+	case ZeroBlockStrategyWriteZeros:
+		return writeZeros(volDev, offset, length, profiler)
+	case ZeroBlockStrategyPunchHole, ZeroBlockStrategyFallocate:
+		err := unix.Fallocate(int(volDev.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+		if err == nil {
+			profiler.recordZeroFill(length, 0, 0)
+			return nil
+		}
+		if strategy == ZeroBlockStrategyPunchHole && errors.Is(err, unix.EOPNOTSUPP) {
+			return writeZeros(volDev, offset, length, profiler)
+		}
+		return errors.Wrapf(err, "failed to punch hole at offset %v length %v", offset, length)
+	}
+	return unix.Fallocate(int(volDev.Fd()), 0, offset, length)
+}
+
+func writeZeros(volDev *os.File, offset, length int64, profiler *restoreProfiler) error {
+	for written := int64(0); written < length; {
+		n := length - written
+		if n > DEFAULT_BLOCK_SIZE {
+			n = DEFAULT_BLOCK_SIZE
+		}
+		if _, err := volDev.WriteAt(zeroBlock[:n], offset+written); err != nil {
+			return err
+		}
+		written += n
+	}
+	profiler.recordZeroFill(0, length, 0)
+	return nil
+}
@@ -0,0 +1,60 @@
+package backupstore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestFillZeros(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := getZeroBlockStrategy(&DeltaRestoreConfig{ZeroBlockStrategy: "discard"})
+	assert.Error(err)
+	strategy, err := getZeroBlockStrategy(&DeltaRestoreConfig{})
+	assert.NoError(err)
+	assert.Equal(ZeroBlockStrategyAllocate, strategy)
+
+	data := bytes.Repeat([]byte("a"), 2*DEFAULT_BLOCK_SIZE)
+	zeros := make([]byte, DEFAULT_BLOCK_SIZE)
+	for _, strategy := range []ZeroBlockStrategy{ZeroBlockStrategySkip, ZeroBlockStrategyWriteZeros,
+		ZeroBlockStrategyPunchHole, ZeroBlockStrategyFallocate} {
+		volDev, err := os.Create(filepath.Join(t.TempDir(), "volume"))
+		assert.NoError(err)
+		_, err = volDev.WriteAt(data, 0)
+		assert.NoError(err)
+
+		profiler := newRestoreProfiler()
+		err = fillZeros(volDev, strategy, DEFAULT_BLOCK_SIZE, DEFAULT_BLOCK_SIZE, profiler)
+		if strategy == ZeroBlockStrategyFallocate && err != nil {
+			// the temporary directory may not support punching holes
+			assert.ErrorIs(err, unix.EOPNOTSUPP)
+			volDev.Close()
+			continue
+		}
+		assert.NoError(err, strategy)
+
+		restored := make([]byte, 2*DEFAULT_BLOCK_SIZE)
+		_, err = volDev.ReadAt(restored, 0)
+		assert.NoError(err)
+		volDev.Close()
+		assert.Equal(data[:DEFAULT_BLOCK_SIZE], restored[:DEFAULT_BLOCK_SIZE], strategy)
+
+		profile := profiler.finish()
+		switch strategy {
+		case ZeroBlockStrategySkip:
+			assert.Equal(data[DEFAULT_BLOCK_SIZE:], restored[DEFAULT_BLOCK_SIZE:])
+			assert.Equal(int64(DEFAULT_BLOCK_SIZE), profile.SkippedZeroBytes)
+		case ZeroBlockStrategyWriteZeros:
+			assert.Equal(zeros, restored[DEFAULT_BLOCK_SIZE:])
+			assert.Equal(int64(DEFAULT_BLOCK_SIZE), profile.WriteBytes)
+		default:
+			assert.Equal(zeros, restored[DEFAULT_BLOCK_SIZE:], strategy)
+			assert.Equal(int64(DEFAULT_BLOCK_SIZE), profile.PunchedHoleBytes+profile.WriteBytes, strategy)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package s3
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore"
+)
+
+// publicBucketServer serves the listing of a public bucket by the path style, and rejects the signed requests
+// and the writes
+type publicBucketServer struct {
+	sync.Mutex
+
+	writes int
+}
+
+func (p *publicBucketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.Lock()
+	defer p.Unlock()
+
+	if r.Header.Get("Authorization") != "" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>InvalidAccessKeyId</Code></Error>`)
+		return
+	}
+	if r.Method != http.MethodGet {
+		p.writes++
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code></Error>`)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult>`+
+		`<CommonPrefixes><Prefix>%vvolumes/</Prefix></CommonPrefixes></ListBucketResult>`, prefix)
+}
+
+func TestAnonymousAccess(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &publicBucketServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	t.Setenv("AWS_ENDPOINTS", ts.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+	// the requests are not signed, and the credentials are not required
+	driver, err := initFunc("s3://bucket@us-east-1/backupstore/?anonymous=true")
+	assert.NoError(err)
+	assert.Equal("s3://bucket@us-east-1/backupstore/?anonymous=true", driver.GetURL())
+	assert.True(driver.(*BackupStoreDriver).IsReadOnly())
+	entries, err := driver.List("")
+	assert.NoError(err)
+	assert.Equal([]string{"volumes"}, entries)
+
+	// the writes are rejected without sending the requests
+	err = driver.Write("volumes/volume.cfg", strings.NewReader("volume"))
+	assert.Equal(backupstore.ErrorClassPermissionDenied, backupstore.GetErrorClass(err))
+	assert.Error(driver.Remove("volumes"))
+	assert.Error(driver.(*BackupStoreDriver).service.RestoreObject("volumes/volume.cfg", "GLACIER", "Standard"))
+	server.Lock()
+	assert.Equal(0, server.writes)
+	server.Unlock()
+
+	_, err = initFunc("s3://bucket@us-east-1/backupstore/?anonymous=maybe")
+	assert.Error(err)
+	_, err = initFunc("s3://" + testDirectoryBucket + "@us-east-1/backupstore/?anonymous=true")
+	assert.Error(err)
+}
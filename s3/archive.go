@@ -0,0 +1,177 @@
+package s3
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+
+	"github.com/longhorn/backupstore"
+)
+
+const (
+	// RehydrateDays is the number of days the restored copy of the object in GLACIER or DEEP_ARCHIVE is kept
+	RehydrateDays = 7
+
+	// the archive access tiers of INTELLIGENT_TIERING are reported by the archive status header, which isn't
+	// modeled by this SDK version
+	archiveStatusHeader       = "x-amz-archive-status"
+	archiveStatusAccess       = "ARCHIVE_ACCESS"
+	archiveStatusDeepAccess   = "DEEP_ARCHIVE_ACCESS"
+	errCodeInvalidObjectState = "InvalidObjectState"
+	errCodeRestoreInProgress  = "RestoreAlreadyInProgress"
+)
+
+// rehydrateETAs are the upper bounds of the retrieval times documented by AWS by the archive class and the tier
+var rehydrateETAs = map[string]map[string]time.Duration{
+	s3.StorageClassGlacier: {
+		s3.TierExpedited: 5 * time.Minute,
+		s3.TierStandard:  5 * time.Hour,
+		s3.TierBulk:      12 * time.Hour,
+	},
+	s3.StorageClassDeepArchive: {
+		s3.TierStandard: 12 * time.Hour,
+		s3.TierBulk:     48 * time.Hour,
+	},
+	archiveStatusAccess: {
+		s3.TierStandard: 5 * time.Hour,
+		s3.TierBulk:     12 * time.Hour,
+	},
+	archiveStatusDeepAccess: {
+		s3.TierStandard: 12 * time.Hour,
+		s3.TierBulk:     48 * time.Hour,
+	},
+}
+
+// getRestoreTier returns the retrieval tier of the priority, the standard tier is used if the archive class
+// doesn't support the tier, e.g. there is no expedited retrieval from DEEP_ARCHIVE
+func getRestoreTier(archiveClass string, priority backupstore.RehydratePriority) string {
+	tier := s3.TierStandard
+	switch priority {
+	case backupstore.RehydratePriorityHigh:
+		tier = s3.TierExpedited
+	case backupstore.RehydratePriorityLow:
+		tier = s3.TierBulk
+	}
+	if _, ok := rehydrateETAs[archiveClass][tier]; !ok {
+		return s3.TierStandard
+	}
+	return tier
+}
+
+// ObjectArchiveState returns the archive state of the object, and the archive class of the object which is
+// either the storage class or the archive access tier of INTELLIGENT_TIERING
+func (s *Service) ObjectArchiveState(key string) (backupstore.ArchiveState, string, error) {
+	params := &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}
+
+	resp := &s3.HeadObjectOutput{}
+	archiveStatus := ""
+	err := s.do(func(svc *s3.S3) error {
+		req, out := svc.HeadObjectRequest(params)
+		resp = out
+		if err := req.Send(); err != nil {
+			return err
+		}
+		archiveStatus = req.HTTPResponse.Header.Get(archiveStatusHeader)
+		return nil
+	})
+	if err != nil {
+		return "", "", errors.Wrapf(parseAwsError(err), "failed to get metadata for object %v", key)
+	}
+
+	archiveClass := archiveStatus
+	if archiveClass == "" {
+		archiveClass = aws.StringValue(resp.StorageClass)
+	}
+	if _, ok := rehydrateETAs[archiveClass]; !ok {
+		return backupstore.ArchiveStateOnline, "", nil
+	}
+
+	restore := aws.StringValue(resp.Restore)
+	switch {
+	case strings.Contains(restore, `ongoing-request="true"`):
+		return backupstore.ArchiveStateRehydrating, archiveClass, nil
+	case strings.Contains(restore, `ongoing-request="false"`):
+		// the restored copy is readable until it expires
+		return backupstore.ArchiveStateOnline, archiveClass, nil
+	}
+	return backupstore.ArchiveStateArchived, archiveClass, nil
+}
+
+// RestoreObject requests the archived object to be restored by the retrieval tier. The restored copy of the
+// object in GLACIER or DEEP_ARCHIVE is kept for RehydrateDays, while the object in the archive access tiers of
+// INTELLIGENT_TIERING is moved back to the frequent access tier.
+func (s *Service) RestoreObject(key, archiveClass, tier string) error {
+	if err := s.checkWritable(key); err != nil {
+		return err
+	}
+	request := &s3.RestoreRequest{
+		GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(tier)},
+	}
+	if archiveClass != archiveStatusAccess && archiveClass != archiveStatusDeepAccess {
+		request.Days = aws.Int64(RehydrateDays)
+	}
+	params := &s3.RestoreObjectInput{
+		Bucket:         aws.String(s.Bucket),
+		Key:            aws.String(key),
+		RestoreRequest: request,
+	}
+
+	err := s.do(func(svc *s3.S3) error {
+		_, err := svc.RestoreObject(params)
+		return err
+	})
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case errCodeRestoreInProgress, s3.ErrCodeObjectAlreadyInActiveTierError:
+			return nil
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(parseAwsError(err), "failed to restore object %v", key)
+	}
+	return nil
+}
+
+// isArchivedError checks if the object cannot be read since it's archived
+func isArchivedError(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == errCodeInvalidObjectState
+}
+
+func (s *BackupStoreDriver) ArchiveState(filePath string) (backupstore.ArchiveState, error) {
+	path, err := s.updatePath(filePath)
+	if err != nil {
+		return "", err
+	}
+	state, _, err := s.service.ObjectArchiveState(path)
+	return state, err
+}
+
+func (s *BackupStoreDriver) Rehydrate(filePath string, priority backupstore.RehydratePriority) (time.Duration, error) {
+	path, err := s.updatePath(filePath)
+	if err != nil {
+		return 0, err
+	}
+	state, archiveClass, err := s.service.ObjectArchiveState(path)
+	if err != nil {
+		return 0, err
+	}
+	if state == backupstore.ArchiveStateOnline {
+		return 0, nil
+	}
+
+	tier := getRestoreTier(archiveClass, priority)
+	if state == backupstore.ArchiveStateArchived {
+		if err := s.service.RestoreObject(path, archiveClass, tier); err != nil {
+			return 0, err
+		}
+	}
+	return rehydrateETAs[archiveClass][tier], nil
+}
@@ -0,0 +1,35 @@
+package s3
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore"
+)
+
+func TestParseAwsError(t *testing.T) {
+	assert := assert.New(t)
+
+	for err, class := range map[error]backupstore.ErrorClass{
+		awserr.New("NoSuchKey", "not found", nil):                                                  backupstore.ErrorClassNotFound,
+		awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), 503, "id"):              backupstore.ErrorClassThrottled,
+		awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "id"):             backupstore.ErrorClassPermissionDenied,
+		awserr.NewRequestFailure(awserr.New("Custom", "custom", nil), http.StatusBadGateway, "id"): backupstore.ErrorClassUnavailable,
+		awserr.New(request.ErrCodeRequestError, "send request failed", fmt.Errorf("reset")):        backupstore.ErrorClassUnavailable,
+		awserr.New(errCodeInvalidObjectState, "archived", nil):                                     backupstore.ErrorClassArchived,
+		awserr.New("Custom", "custom", nil):                                                        backupstore.ErrorClassUnknown,
+	} {
+		parsed := fmt.Errorf("failed to get object: %w", parseAwsError(err))
+		assert.True(backupstore.IsDriverError(parsed))
+		assert.Equal(class, backupstore.GetErrorClass(parsed), err.Error())
+		assert.Contains(parsed.Error(), "AWS Error")
+	}
+
+	err := fmt.Errorf("not an AWS error")
+	assert.Equal(err, parseAwsError(err))
+}
@@ -0,0 +1,266 @@
+package s3
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+
+	"github.com/longhorn/backupstore"
+)
+
+const (
+	// WriteConfirmationPoll polls the object and the listing until the write is visible
+	WriteConfirmationPoll = "poll"
+	// WriteConfirmationNotification waits for the event of the write by the bucket notification API of MinIO,
+	// and falls back to polling if the API isn't supported
+	WriteConfirmationNotification = "notification"
+
+	// DefaultWriteConfirmationTimeout is the max time waiting for a write to be visible
+	DefaultWriteConfirmationTimeout = 30 * time.Second
+
+	writeConfirmationMinPollInterval = 100 * time.Millisecond
+	writeConfirmationMaxPollInterval = 2 * time.Second
+
+	objectCreatedEventPrefix = "s3:ObjectCreated:"
+)
+
+func getWriteConfirmation() (string, error) {
+	confirmation := os.Getenv(WriteConfirmation)
+	switch confirmation {
+	case "", WriteConfirmationPoll, WriteConfirmationNotification:
+		return confirmation, nil
+	}
+	return "", fmt.Errorf("invalid %v %v, must be %v or %v", WriteConfirmation, confirmation,
+		WriteConfirmationPoll, WriteConfirmationNotification)
+}
+
+// needsWriteConfirmation checks if the write of the path should be confirmed. The blocks are not confirmed since
+// they are only read after the config referring to them is confirmed, which is written after the blocks.
+func needsWriteConfirmation(path string) bool {
+	return !strings.HasSuffix(path, backupstore.BLK_SUFFIX)
+}
+
+// putConfirmed writes the object by put. If the write confirmation is enabled, it waits until the write is
+// visible to the reads and the lists, so the metadata is consistent on the eventually consistent S3 compatible
+// stores before the lock is released.
+func (s *BackupStoreDriver) putConfirmed(path string, put func() (*s3.PutObjectOutput, error)) error {
+	if s.writeConfirmation == "" || !needsWriteConfirmation(path) {
+		_, err := put()
+		return err
+	}
+
+	var listener *objectCreatedListener
+	if s.writeConfirmation == WriteConfirmationNotification {
+		// the listener is started before the put, otherwise the event can be missed
+		var err error
+		if listener, err = s.service.listenObjectCreated(path); err != nil {
+			log.WithError(err).Warnf("Failed to listen to bucket notification for %v, polling instead", path)
+		} else {
+			defer listener.Close()
+		}
+	}
+
+	resp, err := put()
+	if err != nil {
+		return err
+	}
+	etag := aws.StringValue(resp.ETag)
+
+	deadline := time.Now().Add(DefaultWriteConfirmationTimeout)
+	if listener != nil {
+		err := listener.wait(path, etag, deadline)
+		if err == nil {
+			return nil
+		}
+		log.WithError(err).Warnf("Failed to confirm write of %v by bucket notification, polling instead", path)
+	}
+	return s.service.WaitObjectVisible(path, etag, deadline)
+}
+
+// sameETag compares the ETags regardless of the quotes, an empty expected ETag matches any ETag
+func sameETag(etag, expected string) bool {
+	return expected == "" || strings.Trim(etag, `"`) == strings.Trim(expected, `"`)
+}
+
+// WaitObjectVisible polls the object until both the metadata and the listing return the ETag, or fails if
+// the object is still not visible at the deadline. Any ETag is accepted if etag is empty.
+func (s *Service) WaitObjectVisible(key, etag string, deadline time.Time) error {
+	interval := writeConfirmationMinPollInterval
+	for {
+		visible, err := s.isObjectVisible(key, etag)
+		if visible {
+			return nil
+		}
+		if time.Now().Add(interval).After(deadline) {
+			if err != nil {
+				return errors.Wrapf(err, "object %v is not visible", key)
+			}
+			return fmt.Errorf("object %v with ETag %v is not visible before %v", key, etag, deadline)
+		}
+		time.Sleep(interval)
+		if interval *= 2; interval > writeConfirmationMaxPollInterval {
+			interval = writeConfirmationMaxPollInterval
+		}
+	}
+}
+
+func (s *Service) isObjectVisible(key, etag string) (bool, error) {
+	head, err := s.HeadObject(key)
+	if err != nil {
+		return false, err
+	}
+	if !sameETag(aws.StringValue(head.ETag), etag) {
+		return false, nil
+	}
+
+	objects, _, err := s.ListObjects(key, "")
+	if err != nil {
+		return false, err
+	}
+	for _, object := range objects {
+		if aws.StringValue(object.Key) == key && sameETag(aws.StringValue(object.ETag), etag) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// listenBucketNotificationInput is the request of the MinIO extension, which isn't modeled by the SDK
+type listenBucketNotificationInput struct {
+	_ struct{} `type:"structure"`
+
+	Bucket *string   `location:"uri" locationName:"Bucket" type:"string" required:"true"`
+	Prefix *string   `location:"querystring" locationName:"prefix" type:"string"`
+	Events []*string `location:"querystring" locationName:"events" type:"list"`
+}
+
+// listenBucketNotificationOutput keeps the response body open, since the events are streamed in it
+type listenBucketNotificationOutput struct {
+	_ struct{} `type:"structure" payload:"Body"`
+
+	Body io.ReadCloser `type:"blob"`
+}
+
+// bucketNotification is the event streamed by the bucket notification API
+type bucketNotification struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Object struct {
+				Key  string `json:"key"`
+				ETag string `json:"eTag"`
+			} `json:"object"`
+		} `json:"s3"`
+	}
+}
+
+type objectCreatedEvent struct {
+	key  string
+	etag string
+}
+
+// objectCreatedListener receives the ObjectCreated events from the bucket notification stream
+type objectCreatedListener struct {
+	body      io.ReadCloser
+	events    chan objectCreatedEvent
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// listenObjectCreated subscribes to the ObjectCreated events of the objects with the key prefix
+func (s *Service) listenObjectCreated(prefix string) (*objectCreatedListener, error) {
+	params := &listenBucketNotificationInput{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+		Events: []*string{aws.String(objectCreatedEventPrefix + "*")},
+	}
+
+	resp := &listenBucketNotificationOutput{}
+	err := s.do(func(svc *s3.S3) error {
+		req := svc.NewRequest(&request.Operation{
+			Name:       "ListenBucketNotification",
+			HTTPMethod: "GET",
+			HTTPPath:   "/{Bucket}",
+		}, params, resp)
+		return req.Send()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen to bucket notification: %v error: %w", prefix, parseAwsError(err))
+	}
+	return newObjectCreatedListener(resp.Body), nil
+}
+
+func newObjectCreatedListener(body io.ReadCloser) *objectCreatedListener {
+	l := &objectCreatedListener{
+		body:   body,
+		events: make(chan objectCreatedEvent),
+		done:   make(chan struct{}),
+	}
+	go l.receive()
+	return l
+}
+
+// receive decodes the events until the stream is closed. The stream isn't JSON if the bucket notification
+// API isn't supported, which ends the events as well.
+func (l *objectCreatedListener) receive() {
+	defer close(l.events)
+
+	decoder := json.NewDecoder(l.body)
+	for {
+		notification := &bucketNotification{}
+		if err := decoder.Decode(notification); err != nil {
+			return
+		}
+		for _, record := range notification.Records {
+			if !strings.HasPrefix(record.EventName, objectCreatedEventPrefix) {
+				continue
+			}
+			// the keys in the events are URL encoded
+			key, err := url.QueryUnescape(record.S3.Object.Key)
+			if err != nil {
+				key = record.S3.Object.Key
+			}
+			select {
+			case l.events <- objectCreatedEvent{key: key, etag: record.S3.Object.ETag}:
+			case <-l.done:
+				return
+			}
+		}
+	}
+}
+
+// wait waits for the ObjectCreated event of the object with the ETag until the deadline
+func (l *objectCreatedListener) wait(key, etag string, deadline time.Time) error {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		select {
+		case event, ok := <-l.events:
+			if !ok {
+				return fmt.Errorf("bucket notification stream closed before the event of %v", key)
+			}
+			if event.key == key && sameETag(event.etag, etag) {
+				return nil
+			}
+		case <-timer.C:
+			return fmt.Errorf("timed out waiting for the bucket notification event of %v", key)
+		}
+	}
+}
+
+func (l *objectCreatedListener) Close() {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.body.Close()
+	})
+}
@@ -0,0 +1,152 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// minioServer serves the objects of a bucket, and streams the ObjectCreated events to the listeners
+type minioServer struct {
+	sync.Mutex
+
+	objects       map[string]string
+	listeners     []chan string
+	notifications bool
+}
+
+func (m *minioServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch {
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		sum := md5.Sum(data)
+		etag := hex.EncodeToString(sum[:])
+		m.Lock()
+		m.objects[key] = etag
+		for _, listener := range m.listeners {
+			listener <- fmt.Sprintf(`{"Records":[{"eventName":"s3:ObjectCreated:Put","s3":{"object":{"key":%q,"eTag":%q}}}]}`,
+				url.QueryEscape(key), etag)
+		}
+		m.Unlock()
+		w.Header().Set("ETag", `"`+etag+`"`)
+	case r.Method == http.MethodHead:
+		m.Lock()
+		etag, exists := m.objects[key]
+		m.Unlock()
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"`+etag+`"`)
+		w.Header().Set("Content-Length", "0")
+	case r.URL.Query().Get("events") != "" && m.notifications:
+		listener := make(chan string, 16)
+		m.Lock()
+		m.listeners = append(m.listeners, listener)
+		m.Unlock()
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event := <-listener:
+				fmt.Fprintln(w, event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		// the bucket notification request is taken as listing the objects if not supported
+		prefix := r.URL.Query().Get("prefix")
+		var contents bytes.Buffer
+		m.Lock()
+		for key, etag := range m.objects {
+			if strings.HasPrefix(key, prefix) {
+				fmt.Fprintf(&contents, `<Contents><Key>%v</Key><ETag>"%v"</ETag></Contents>`, key, etag)
+			}
+		}
+		m.Unlock()
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><Name>bucket</Name>%v</ListBucketResult>`,
+			contents.String())
+	}
+}
+
+func newTestDriver(t *testing.T, server *minioServer, confirmation string) *BackupStoreDriver {
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	t.Setenv("AWS_ENDPOINTS", ts.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "access")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	return &BackupStoreDriver{
+		path:              "backupstore",
+		service:           Service{Region: "us-east-1", Bucket: "bucket"},
+		writeConfirmation: confirmation,
+	}
+}
+
+func TestWriteConfirmation(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Setenv(WriteConfirmation, "unknown")
+	_, err := getWriteConfirmation()
+	assert.Error(err)
+	t.Setenv(WriteConfirmation, WriteConfirmationNotification)
+	confirmation, err := getWriteConfirmation()
+	assert.NoError(err)
+	assert.Equal(WriteConfirmationNotification, confirmation)
+
+	assert.True(needsWriteConfirmation("volumes/vol/volume.cfg"))
+	assert.False(needsWriteConfirmation("volumes/vol/blocks/ab/cd/abcd.blk"))
+	assert.True(sameETag(`"abcd"`, "abcd"))
+	assert.True(sameETag("abcd", ""))
+	assert.False(sameETag("abcd", "ef"))
+
+	for _, notifications := range []bool{true, false} {
+		server := &minioServer{objects: map[string]string{}, notifications: notifications}
+		driver := newTestDriver(t, server, WriteConfirmationNotification)
+		assert.NoError(driver.Write("volumes/vol/volume.cfg", bytes.NewReader([]byte("config"))))
+		assert.Equal(int64(0), driver.FileSize("volumes/vol/volume.cfg"))
+
+		server.Lock()
+		assert.Len(server.listeners, map[bool]int{true: 1, false: 0}[notifications])
+		server.Unlock()
+	}
+
+	server := &minioServer{objects: map[string]string{}}
+	driver := newTestDriver(t, server, WriteConfirmationPoll)
+	assert.NoError(driver.Write("volumes/vol/volume.cfg", bytes.NewReader([]byte("config"))))
+	assert.Error(driver.service.WaitObjectVisible("backupstore/volumes/vol/none.cfg", "", time.Now()))
+}
+
+func TestObjectCreatedListener(t *testing.T) {
+	assert := assert.New(t)
+
+	r, w := io.Pipe()
+	listener := newObjectCreatedListener(r)
+	go func() {
+		fmt.Fprintln(w, `{"Records":[{"eventName":"s3:ObjectRemoved:Delete","s3":{"object":{"key":"vol%2Fvolume.cfg"}}}]}`)
+		fmt.Fprintln(w, " ")
+		fmt.Fprintln(w, `{"Records":[{"eventName":"s3:ObjectCreated:Put","s3":{"object":{"key":"vol%2Fvolume.cfg","eTag":"abcd"}}}]}`)
+	}()
+	assert.NoError(listener.wait("vol/volume.cfg", `"abcd"`, time.Now().Add(time.Minute)))
+	assert.Error(listener.wait("vol/volume.cfg", `"abcd"`, time.Now().Add(10*time.Millisecond)))
+	listener.Close()
+	listener.Close()
+
+	// the stream of the S3 implementations without the bucket notification API
+	listener = newObjectCreatedListener(io.NopCloser(strings.NewReader("<ListBucketResult></ListBucketResult>")))
+	defer listener.Close()
+	assert.Error(listener.wait("vol/volume.cfg", "", time.Now().Add(time.Minute)))
+}
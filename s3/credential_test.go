@@ -0,0 +1,191 @@
+package s3
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/types"
+)
+
+// credentialServer serves the objects of a bucket by the path style, and only takes the requests signed by the
+// current access key with its session token
+type credentialServer struct {
+	sync.Mutex
+
+	objects      map[string]string
+	accessKey    string
+	sessionToken string
+	// rejected counts the requests rejected due to the credential
+	rejected int
+}
+
+func (c *credentialServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.Lock()
+	defer c.Unlock()
+
+	if !strings.Contains(r.Header.Get("Authorization"), "Credential="+c.accessKey+"/") ||
+		r.Header.Get("X-Amz-Security-Token") != c.sessionToken {
+		c.rejected++
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>InvalidAccessKeyId</Code></Error>`)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		c.objects[key] = string(data)
+		w.Header().Set("ETag", `"random"`)
+	case http.MethodGet:
+		if _, list := r.URL.Query()["prefix"]; list {
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><Name>bucket</Name></ListBucketResult>`)
+			return
+		}
+		data, exists := c.objects[key]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		fmt.Fprint(w, data)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *credentialServer) getRejected() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.rejected
+}
+
+// rotatingCredentialProvider hands out the credentials in turn, each refresh moves to the next one
+type rotatingCredentialProvider struct {
+	sync.Mutex
+
+	credentials []map[string]string
+	current     int
+	refreshErr  error
+	refreshes   int
+}
+
+func (p *rotatingCredentialProvider) GetCredential(destURL string) (map[string]string, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.current >= len(p.credentials) {
+		return nil, fmt.Errorf("no credential left for %v", destURL)
+	}
+	return p.credentials[p.current], nil
+}
+
+func (p *rotatingCredentialProvider) RefreshCredential(destURL string) error {
+	p.Lock()
+	defer p.Unlock()
+	p.refreshes++
+	if p.refreshErr != nil {
+		return p.refreshErr
+	}
+	p.current++
+	return nil
+}
+
+func newSessionCredential(accessKey, sessionToken string) map[string]string {
+	return map[string]string{
+		types.AWSAccessKey:    accessKey,
+		types.AWSSecretKey:    "secret",
+		types.AWSSessionToken: sessionToken,
+	}
+}
+
+func TestCredentialProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	server := &credentialServer{objects: map[string]string{}, accessKey: "env"}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	t.Setenv("AWS_ENDPOINTS", ts.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "env")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	// the backup target without a provider takes the credential from the environment variables
+	const destURL = "s3://bucket@us-east-1/backupstore/"
+	driver, err := initFunc(destURL)
+	assert.NoError(err)
+	assert.Nil(driver.(*BackupStoreDriver).service.CredentialProvider)
+	assert.NoError(driver.Write("volumes/volume.cfg", strings.NewReader("volume")))
+
+	// the provider of the backup target takes precedence over the environment variables
+	provider := &rotatingCredentialProvider{credentials: []map[string]string{
+		newSessionCredential("sts-1", "token-1"),
+		newSessionCredential("sts-2", "token-2"),
+	}}
+	backupstore.SetCredentialProvider(destURL, provider)
+	defer backupstore.SetCredentialProvider(destURL, nil)
+	server.Lock()
+	server.accessKey, server.sessionToken = "sts-1", "token-1"
+	server.Unlock()
+	driver, err = initFunc(destURL)
+	assert.NoError(err)
+	assert.Same(provider, driver.(*BackupStoreDriver).service.CredentialProvider)
+	assert.Equal(destURL, driver.(*BackupStoreDriver).service.DestURL)
+	assert.Equal(0, provider.refreshes)
+
+	// the other backup targets still use the environment variables
+	_, err = initFunc("s3://bucket@us-east-1/other/")
+	assert.Error(err)
+	assert.Equal(0, provider.refreshes)
+
+	// the expired credential is refreshed once, and the rejected write is sent again with the whole body
+	server.Lock()
+	server.accessKey, server.sessionToken = "sts-2", "token-2"
+	server.Unlock()
+	rejected := server.getRejected()
+	assert.NoError(driver.Write("volumes/backup.cfg", strings.NewReader("backup")))
+	assert.Equal(1, provider.refreshes)
+	assert.Equal(rejected+1, server.getRejected())
+	server.Lock()
+	assert.Equal("backup", server.objects["backupstore/volumes/backup.cfg"])
+	server.Unlock()
+	rc, err := driver.Read("volumes/backup.cfg")
+	assert.NoError(err)
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	assert.NoError(err)
+	assert.Equal("backup", string(data))
+	assert.Equal(1, provider.refreshes)
+
+	// the request failed for another reason doesn't refresh the credential
+	_, err = driver.Read("volumes/missing.cfg")
+	assert.Error(err)
+	assert.Equal(1, provider.refreshes)
+
+	// the original error is returned if the refresh fails, and the request isn't sent again
+	server.Lock()
+	server.accessKey, server.sessionToken = "sts-3", "token-3"
+	server.Unlock()
+	provider.refreshErr = fmt.Errorf("identity provider unavailable")
+	rejected = server.getRejected()
+	err = driver.Write("volumes/backup.cfg", strings.NewReader("backup"))
+	assert.Error(err)
+	assert.Equal(backupstore.ErrorClassPermissionDenied, backupstore.GetErrorClass(err))
+	assert.Equal(2, provider.refreshes)
+	assert.Equal(rejected+1, server.getRejected())
+
+	// the credential which cannot be provided fails the request without sending it
+	provider.refreshErr = nil
+	provider.current = len(provider.credentials)
+	rejected = server.getRejected()
+	_, err = driver.Read("volumes/backup.cfg")
+	assert.Error(err)
+	assert.Contains(err.Error(), "failed to get credential")
+	assert.Equal(rejected, server.getRejected())
+}
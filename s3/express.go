@@ -0,0 +1,181 @@
+package s3
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// directoryBucketSuffix ends the names of the S3 Express One Zone directory buckets, which are named
+	// <base name>--<zone id>--x-s3
+	directoryBucketSuffix = "--x-s3"
+
+	// directoryBucketSigningName is the SigV4 service name of the requests to the directory buckets
+	directoryBucketSigningName = "s3express"
+	// directoryBucketSessionTokenHeader carries the session token instead of X-Amz-Security-Token
+	directoryBucketSessionTokenHeader = "x-amz-s3session-token"
+
+	// DirectoryBucketSessionRefreshWindow is how long before the expiration the session of a directory bucket is
+	// renewed, the sessions last 5 minutes
+	DirectoryBucketSessionRefreshWindow = time.Minute
+)
+
+// isDirectoryBucket checks if the bucket is an S3 Express One Zone directory bucket. The directory buckets are
+// addressed by the zonal endpoints, the requests are authorized by the sessions created by CreateSession, the
+// listings are not sorted and only take the prefixes ending with the delimiter, and the writes are strongly
+// consistent.
+func isDirectoryBucket(bucket string) bool {
+	return strings.HasSuffix(bucket, directoryBucketSuffix)
+}
+
+// getDirectoryBucketZone returns the availability zone ID in the name of the directory bucket
+func getDirectoryBucketZone(bucket string) (string, error) {
+	elems := strings.Split(strings.TrimSuffix(bucket, directoryBucketSuffix), "--")
+	if len(elems) < 2 || elems[0] == "" || elems[len(elems)-1] == "" {
+		return "", fmt.Errorf("invalid directory bucket name %v, must be <name>--<zone id>%v", bucket, directoryBucketSuffix)
+	}
+	return elems[len(elems)-1], nil
+}
+
+// getDirectoryBucketEndpoint returns the zonal endpoint of the directory bucket
+func getDirectoryBucketEndpoint(bucket, region string) (string, error) {
+	zone, err := getDirectoryBucketZone(bucket)
+	if err != nil {
+		return "", err
+	}
+	if region == "" {
+		return "", fmt.Errorf("region is required for directory bucket %v", bucket)
+	}
+	return fmt.Sprintf("https://s3express-%s.%s.amazonaws.com", zone, region), nil
+}
+
+// directoryBucketSession is the temporary credential of a directory bucket returned by CreateSession
+type directoryBucketSession struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	expiration      time.Time
+}
+
+type directoryBucketSessionKey struct {
+	bucket      string
+	accessKeyID string
+}
+
+var (
+	directoryBucketSessionsLock sync.Mutex
+	// directoryBucketSessions are shared by the drivers of the same directory bucket and credential
+	directoryBucketSessions = map[directoryBucketSessionKey]*directoryBucketSession{}
+)
+
+// createSessionOutput is the result of CreateSession, which isn't modeled by this SDK version
+type createSessionOutput struct {
+	_ struct{} `type:"structure"`
+
+	Credentials *createSessionCredentials `type:"structure"`
+}
+
+type createSessionCredentials struct {
+	_ struct{} `type:"structure"`
+
+	AccessKeyId     *string    `type:"string"`
+	Expiration      *time.Time `type:"timestamp"`
+	SecretAccessKey *string    `type:"string" sensitive:"true"`
+	SessionToken    *string    `type:"string" sensitive:"true"`
+}
+
+// createDirectoryBucketSession creates the read write session of the directory bucket with the base credential
+func (s *Service) createDirectoryBucketSession(svc *s3.S3) (*directoryBucketSession, error) {
+	path := "/?session"
+	if aws.BoolValue(svc.Config.S3ForcePathStyle) {
+		path = "/" + s.Bucket + path
+	}
+	output := &createSessionOutput{}
+	req := svc.NewRequest(&request.Operation{
+		Name:       "CreateSession",
+		HTTPMethod: "GET",
+		HTTPPath:   path,
+	}, &struct{}{}, output)
+	if !aws.BoolValue(svc.Config.S3ForcePathStyle) {
+		req.HTTPRequest.URL.Host = s.Bucket + "." + req.HTTPRequest.URL.Host
+	}
+	req.HTTPRequest.Header.Set("x-amz-create-session-mode", "ReadWrite")
+	s.pacer.wait()
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+
+	c := output.Credentials
+	if c == nil || aws.StringValue(c.AccessKeyId) == "" || aws.StringValue(c.SessionToken) == "" {
+		return nil, fmt.Errorf("no credentials returned by CreateSession of directory bucket %v", s.Bucket)
+	}
+	return &directoryBucketSession{
+		accessKeyID:     aws.StringValue(c.AccessKeyId),
+		secretAccessKey: aws.StringValue(c.SecretAccessKey),
+		sessionToken:    aws.StringValue(c.SessionToken),
+		expiration:      aws.TimeValue(c.Expiration),
+	}, nil
+}
+
+// getDirectoryBucketSession returns the session of the directory bucket for the base credential, a new session is
+// created if there is none or it's about to expire
+func (s *Service) getDirectoryBucketSession(svc *s3.S3, accessKeyID string) (*directoryBucketSession, error) {
+	key := directoryBucketSessionKey{bucket: s.Bucket, accessKeyID: accessKeyID}
+
+	directoryBucketSessionsLock.Lock()
+	defer directoryBucketSessionsLock.Unlock()
+	if bucketSession, ok := directoryBucketSessions[key]; ok &&
+		time.Until(bucketSession.expiration) > DirectoryBucketSessionRefreshWindow {
+		return bucketSession, nil
+	}
+	bucketSession, err := s.createDirectoryBucketSession(svc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session of directory bucket %v error: %w", s.Bucket, parseAwsError(err))
+	}
+	directoryBucketSessions[key] = bucketSession
+	return bucketSession, nil
+}
+
+// resetDirectoryBucketSessions drops the sessions of the directory bucket, e.g. the session has been rejected
+func (s *Service) resetDirectoryBucketSessions() {
+	directoryBucketSessionsLock.Lock()
+	defer directoryBucketSessionsLock.Unlock()
+	for key := range directoryBucketSessions {
+		if key.bucket == s.Bucket {
+			delete(directoryBucketSessions, key)
+		}
+	}
+}
+
+// newDirectoryBucketClient returns the client of the directory bucket authorized by the session created with the
+// base credential of the session
+func (s *Service) newDirectoryBucketClient(ses *session.Session) (*s3.S3, error) {
+	base, err := ses.Config.Credentials.Get()
+	if err != nil {
+		return nil, err
+	}
+	svc := s3.New(ses)
+	svc.ClientInfo.SigningName = directoryBucketSigningName
+	bucketSession, err := s.getDirectoryBucketSession(svc, base.AccessKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the session token isn't signed as the security token of the temporary credentials
+	svc = s3.New(ses.Copy(&aws.Config{
+		Credentials: credentials.NewStaticCredentials(bucketSession.accessKeyID, bucketSession.secretAccessKey, ""),
+	}))
+	svc.ClientInfo.SigningName = directoryBucketSigningName
+	svc.Handlers.Sign.PushFront(func(r *request.Request) {
+		r.HTTPRequest.Header.Set(directoryBucketSessionTokenHeader, bucketSession.sessionToken)
+	})
+	return svc, nil
+}
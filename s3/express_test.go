@@ -0,0 +1,139 @@
+package s3
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore"
+)
+
+const testDirectoryBucket = "bucket--use1-az4--x-s3"
+
+// directoryBucketServer serves the objects of a directory bucket by the path style, and only takes the requests
+// authorized by the sessions it created
+type directoryBucketServer struct {
+	sync.Mutex
+
+	objects  map[string]string
+	sessions int
+	token    string
+}
+
+func (d *directoryBucketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.Lock()
+	defer d.Unlock()
+
+	if !strings.Contains(r.Header.Get("Authorization"), "/"+directoryBucketSigningName+"/aws4_request") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if _, ok := r.URL.Query()["session"]; ok {
+		d.sessions++
+		d.token = fmt.Sprintf("token-%v", d.sessions)
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><CreateSessionResult><Credentials>`+
+			`<SessionToken>%v</SessionToken><SecretAccessKey>secret</SecretAccessKey><AccessKeyId>session</AccessKeyId>`+
+			`<Expiration>%v</Expiration></Credentials></CreateSessionResult>`,
+			d.token, time.Now().Add(5*time.Minute).UTC().Format(time.RFC3339))
+		return
+	}
+	if r.Header.Get(directoryBucketSessionTokenHeader) != d.token {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>ExpiredToken</Code></Error>`)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/"+testDirectoryBucket+"/")
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		d.objects[key] = string(data)
+		w.Header().Set("ETag", `"random"`)
+	case http.MethodGet:
+		if r.URL.Query().Get("list-type") != "2" {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		prefix := r.URL.Query().Get("prefix")
+		if !strings.HasSuffix(prefix, "/") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		contents := ""
+		// the listings of the directory buckets are not sorted
+		for _, key := range []string{prefix + "b.cfg", prefix + "a.cfg", prefix + "c.cfg"} {
+			if _, ok := d.objects[key]; ok {
+				contents += fmt.Sprintf(`<Contents><Key>%v</Key></Contents>`, key)
+			}
+		}
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult>%v</ListBucketResult>`, contents)
+	}
+}
+
+func TestDirectoryBucket(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(isDirectoryBucket(testDirectoryBucket))
+	assert.False(isDirectoryBucket("bucket"))
+	zone, err := getDirectoryBucketZone(testDirectoryBucket)
+	assert.NoError(err)
+	assert.Equal("use1-az4", zone)
+	_, err = getDirectoryBucketZone("use1-az4--x-s3")
+	assert.Error(err)
+	endpoint, err := getDirectoryBucketEndpoint(testDirectoryBucket, "us-east-1")
+	assert.NoError(err)
+	assert.Equal("https://s3express-use1-az4.us-east-1.amazonaws.com", endpoint)
+	_, err = getDirectoryBucketEndpoint(testDirectoryBucket, "")
+	assert.Error(err)
+
+	server := &directoryBucketServer{objects: map[string]string{}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	t.Setenv("AWS_ENDPOINTS", ts.URL)
+	t.Setenv(VirtualHostedStyle, "false")
+	t.Setenv("AWS_ACCESS_KEY_ID", "access")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer (&Service{Bucket: testDirectoryBucket}).resetDirectoryBucketSessions()
+
+	driver := &BackupStoreDriver{
+		path:    "backupstore",
+		service: Service{Region: "us-east-1", Bucket: testDirectoryBucket},
+	}
+	for _, name := range []string{"c.cfg", "a.cfg", "b.cfg"} {
+		assert.NoError(driver.Write("volumes/"+name, strings.NewReader(name)))
+	}
+	checksum, err := driver.WriteVerified("volumes/b.cfg", strings.NewReader("b.cfg"))
+	assert.NoError(err)
+	assert.Empty(checksum)
+	server.Lock()
+	assert.Equal(1, server.sessions)
+	server.Unlock()
+
+	entries, err := driver.List("volumes")
+	assert.NoError(err)
+	assert.Equal([]string{"a.cfg", "b.cfg", "c.cfg"}, entries)
+	entries, err = driver.ListPrefix("volumes", "b")
+	assert.NoError(err)
+	assert.Equal([]string{"b.cfg"}, entries)
+	status, err := driver.VersioningStatus()
+	assert.NoError(err)
+	assert.Equal(backupstore.VersioningStatusDisabled, status)
+
+	// the session rejected by the server is renewed
+	server.Lock()
+	server.token = "revoked"
+	server.Unlock()
+	entries, err = driver.List("volumes")
+	assert.NoError(err)
+	assert.Len(entries, 3)
+	server.Lock()
+	assert.Equal(2, server.sessions)
+	server.Unlock()
+}
@@ -0,0 +1,149 @@
+package s3
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ProviderParam selects the provider preset in the backup target URL, e.g. s3://bucket@fr-par/path/?provider=scaleway
+	ProviderParam = "provider"
+
+	ProviderWasabi   = "wasabi"
+	ProviderScaleway = "scaleway"
+	ProviderOVH      = "ovh"
+)
+
+// Provider is the preset of an S3 compatible cloud, so the backup target only needs the bucket and the region
+type Provider struct {
+	Name string
+	// EndpointPattern is the endpoint of the region, %s is replaced by the region
+	EndpointPattern string
+	// DefaultRegion is used if the backup target URL has no region
+	DefaultRegion string
+	// Regions are the known regions of the provider, the other regions are used as is with a warning
+	Regions []string
+	// VirtualHostedStyle addresses the bucket by the host name instead of the path
+	VirtualHostedStyle bool
+	// RequestsPerSecond paces the requests to the backup target below the rate limit of the provider, no limit if 0
+	RequestsPerSecond int
+}
+
+var providers = map[string]*Provider{
+	ProviderWasabi: {
+		Name:               ProviderWasabi,
+		EndpointPattern:    "https://s3.%s.wasabisys.com",
+		DefaultRegion:      "us-east-1",
+		Regions:            []string{"us-east-1", "us-east-2", "us-central-1", "us-west-1", "ca-central-1", "eu-central-1", "eu-central-2", "eu-west-1", "eu-west-2", "ap-northeast-1", "ap-northeast-2", "ap-southeast-1", "ap-southeast-2"},
+		VirtualHostedStyle: true,
+	},
+	ProviderScaleway: {
+		Name:               ProviderScaleway,
+		EndpointPattern:    "https://s3.%s.scw.cloud",
+		DefaultRegion:      "fr-par",
+		Regions:            []string{"fr-par", "nl-ams", "pl-waw"},
+		VirtualHostedStyle: true,
+		RequestsPerSecond:  250,
+	},
+	ProviderOVH: {
+		Name:            ProviderOVH,
+		EndpointPattern: "https://s3.%s.io.cloud.ovh.net",
+		DefaultRegion:   "gra",
+		Regions:         []string{"gra", "sbg", "rbx", "de", "uk", "waw", "bhs", "ca-east-tor", "sgp", "ap-southeast-syd"},
+		// the buckets with dots in the name don't match the wildcard certificate of the virtual hosts
+		VirtualHostedStyle: false,
+		RequestsPerSecond:  100,
+	},
+}
+
+// GetProviders returns the names of the provider presets
+func GetProviders() []string {
+	names := []string{}
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getProvider returns the provider preset selected by the backup target URL, nil if no provider is selected
+func getProvider(u *url.URL) (*Provider, error) {
+	name := u.Query().Get(ProviderParam)
+	if name == "" {
+		return nil, nil
+	}
+	provider, exists := providers[strings.ToLower(name)]
+	if !exists {
+		return nil, fmt.Errorf("unknown S3 provider %v, must be one of %v", name, GetProviders())
+	}
+	return provider, nil
+}
+
+// getRegion returns the region of the provider, the regions are case insensitive for the providers
+func (p *Provider) getRegion(region string) string {
+	if region == "" {
+		return p.DefaultRegion
+	}
+	region = strings.ToLower(region)
+	for _, known := range p.Regions {
+		if region == known {
+			return region
+		}
+	}
+	log.Warnf("Region %v is not a known region of S3 provider %v, using it as is", region, p.Name)
+	return region
+}
+
+func (p *Provider) getEndpoint(region string) string {
+	return fmt.Sprintf(p.EndpointPattern, region)
+}
+
+var (
+	requestPacersLock sync.Mutex
+	// requestPacers are shared by the drivers of the same bucket, since the rate limits apply to the bucket
+	requestPacers = map[string]*requestPacer{}
+)
+
+// requestPacer spaces the requests evenly to stay below the requests per second
+type requestPacer struct {
+	lock     sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// getRequestPacer returns the pacer of the bucket of the provider, nil if the provider has no rate limit
+func getRequestPacer(provider *Provider, region, bucket string) *requestPacer {
+	if provider == nil || provider.RequestsPerSecond <= 0 {
+		return nil
+	}
+	requestPacersLock.Lock()
+	defer requestPacersLock.Unlock()
+	key := provider.getEndpoint(region) + "/" + bucket
+	if pacer, exists := requestPacers[key]; exists {
+		return pacer
+	}
+	pacer := &requestPacer{interval: time.Second / time.Duration(provider.RequestsPerSecond)}
+	requestPacers[key] = pacer
+	return pacer
+}
+
+func (p *requestPacer) wait() {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	delay := p.next.Sub(now)
+	p.next = p.next.Add(p.interval)
+	p.lock.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,66 @@
+package s3
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	u, _ := url.Parse("s3://bucket@GRA/path/?provider=OVH")
+	provider, err := getProvider(u)
+	assert.NoError(err)
+	assert.Equal(ProviderOVH, provider.Name)
+	assert.Equal("gra", provider.getRegion(u.Host))
+	assert.Equal("us-east-1", providers[ProviderWasabi].getRegion(""))
+	assert.Equal("mars-1", providers[ProviderWasabi].getRegion("mars-1"))
+
+	u, _ = url.Parse("s3://bucket@us-east-1/path/")
+	provider, err = getProvider(u)
+	assert.NoError(err)
+	assert.Nil(provider)
+	u, _ = url.Parse("s3://bucket@us-east-1/path/?provider=unknown")
+	_, err = getProvider(u)
+	assert.Error(err)
+	assert.Equal([]string{ProviderOVH, ProviderScaleway, ProviderWasabi}, GetProviders())
+
+	// the preset configures the endpoint and the addressing style unless they're set by the environment
+	t.Setenv("AWS_ACCESS_KEY_ID", "access")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	service := &Service{Region: "nl-ams", Bucket: "bucket", Provider: providers[ProviderScaleway]}
+	svc, err := service.New()
+	assert.NoError(err)
+	assert.Equal("https://s3.nl-ams.scw.cloud", aws.StringValue(svc.Config.Endpoint))
+	assert.False(aws.BoolValue(svc.Config.S3ForcePathStyle))
+
+	t.Setenv("AWS_ENDPOINTS", "https://proxy.local")
+	t.Setenv(VirtualHostedStyle, "false")
+	svc, err = service.New()
+	assert.NoError(err)
+	assert.Equal("https://proxy.local", aws.StringValue(svc.Config.Endpoint))
+	assert.True(aws.BoolValue(svc.Config.S3ForcePathStyle))
+}
+
+func TestRequestPacer(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(getRequestPacer(providers[ProviderWasabi], "us-east-1", "bucket"))
+	pacer := getRequestPacer(providers[ProviderOVH], "gra", "bucket")
+	assert.Same(pacer, getRequestPacer(providers[ProviderOVH], "gra", "bucket"))
+	assert.NotSame(pacer, getRequestPacer(providers[ProviderOVH], "gra", "other"))
+
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		pacer.wait()
+	}
+	assert.GreaterOrEqual(time.Since(start), 100*time.Millisecond)
+
+	// no pacer doesn't wait
+	var none *requestPacer
+	none.wait()
+}
@@ -6,14 +6,18 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/sirupsen/logrus"
 
 	"github.com/longhorn/backupstore"
 	"github.com/longhorn/backupstore/http"
+	"github.com/longhorn/backupstore/util"
 )
 
 var (
@@ -24,10 +28,17 @@ type BackupStoreDriver struct {
 	destURL string
 	path    string
 	service Service
+
+	// writeConfirmation is how the metadata writes are confirmed to be visible, see WriteConfirmation
+	writeConfirmation string
 }
 
 const (
 	KIND = "s3"
+
+	// AnonymousParam enables the unsigned access to the public bucket in the backup target URL, e.g.
+	// s3://bucket@us-east-1/path/?anonymous=true. The backup target can only be read, e.g. by the restores.
+	AnonymousParam = "anonymous"
 )
 
 func init() {
@@ -60,6 +71,32 @@ func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
 		return nil, fmt.Errorf("invalid URL. Must be either s3://bucket@region/path/, or s3://bucket/path")
 	}
 
+	if b.service.Provider, err = getProvider(u); err != nil {
+		return nil, err
+	}
+	if anonymous := u.Query().Get(AnonymousParam); anonymous != "" {
+		if b.service.Anonymous, err = strconv.ParseBool(anonymous); err != nil {
+			return nil, fmt.Errorf("invalid %v param %v of the backup target URL", AnonymousParam, anonymous)
+		}
+	}
+	if isDirectoryBucket(b.service.Bucket) {
+		// the sessions of the directory buckets are created with the credentials
+		if b.service.Anonymous {
+			return nil, fmt.Errorf("directory bucket %v cannot be accessed anonymously", b.service.Bucket)
+		}
+		if b.service.Provider != nil {
+			return nil, fmt.Errorf("S3 provider %v doesn't support directory bucket %v", b.service.Provider.Name,
+				b.service.Bucket)
+		}
+		if _, err := getDirectoryBucketZone(b.service.Bucket); err != nil {
+			return nil, err
+		}
+	}
+	if b.service.Provider != nil {
+		b.service.Region = b.service.Provider.getRegion(b.service.Region)
+		b.service.pacer = getRequestPacer(b.service.Provider, b.service.Region, b.service.Bucket)
+	}
+
 	// add custom ca to http client that is used by s3 service
 	customCerts := getCustomCerts()
 	client, err := http.GetClientWithCustomCerts(customCerts)
@@ -67,10 +104,29 @@ func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
 		return nil, err
 	}
 	b.service.Client = client
+	if !b.service.Anonymous {
+		b.service.CredentialProvider = backupstore.GetCredentialProvider(destURL)
+	}
+	b.service.DestURL = destURL
+
+	if b.writeConfirmation, err = getWriteConfirmation(); err != nil {
+		return nil, err
+	}
+	// the writes to the directory buckets are strongly consistent
+	if isDirectoryBucket(b.service.Bucket) {
+		b.writeConfirmation = ""
+	}
 
 	//Leading '/' can cause mystery problems for s3
 	b.path = strings.TrimLeft(b.path, "/")
 
+	// don't connect to the non-compliant endpoint at all
+	if backupstore.IsFIPSModeEnabled() {
+		if err := b.CheckFIPSCompliance(); err != nil {
+			return nil, &backupstore.NonCompliantTargetError{URL: destURL, Reason: err}
+		}
+	}
+
 	//Test connection
 	if _, err := b.List(""); err != nil {
 		return nil, err
@@ -81,6 +137,18 @@ func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
 		b.destURL += "@" + b.service.Region
 	}
 	b.destURL += "/" + b.path
+	// keep the preset and the anonymous access in the URL of the backup target, so the backup URLs derived from
+	// it use them as well
+	params := url.Values{}
+	if b.service.Provider != nil {
+		params.Set(ProviderParam, b.service.Provider.Name)
+	}
+	if b.service.Anonymous {
+		params.Set(AnonymousParam, "true")
+	}
+	if len(params) > 0 {
+		b.destURL += "?" + params.Encode()
+	}
 
 	log.Infof("Loaded driver for %v", b.destURL)
 	return b, nil
@@ -104,22 +172,45 @@ func (s *BackupStoreDriver) GetURL() string {
 	return s.destURL
 }
 
-func (s *BackupStoreDriver) updatePath(path string) string {
-	joinedPath := filepath.Join(s.path, path)
-
-	// The filepath.Join removes the trailing slash when joining paths, so we
-	// need to check and add back the trailing slash if it exists in the input
-	// path.
-	if !strings.HasSuffix(path, "/") {
-		return joinedPath
+// CheckFIPSCompliance fails if the custom endpoint isn't connected by TLS
+func (s *BackupStoreDriver) CheckFIPSCompliance() error {
+	endpoint := os.Getenv("AWS_ENDPOINTS")
+	if endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
 	}
-	return joinedPath + "/"
+	if u.Scheme != "https" {
+		return fmt.Errorf("endpoint %v is not connected by TLS", endpoint)
+	}
+	return nil
+}
+
+// IsReadOnly returns true if the bucket is accessed anonymously, which only allows reading the backup target
+func (s *BackupStoreDriver) IsReadOnly() bool {
+	return s.service.Anonymous
+}
+
+// VersioningStatus returns the versioning status of the bucket
+func (s *BackupStoreDriver) VersioningStatus() (backupstore.VersioningStatus, error) {
+	return s.service.GetBucketVersioning()
+}
+
+// updatePath returns the object key of the path, which must stay under the path of the backup target, so the
+// tenants sharing the bucket under different prefixes cannot reach each other's objects
+func (s *BackupStoreDriver) updatePath(path string) (string, error) {
+	return util.JoinPathWithin(s.path, path)
 }
 
 func (s *BackupStoreDriver) List(listPath string) ([]string, error) {
 	var result []string
 
-	path := s.updatePath(listPath)
+	path, err := s.updatePath(listPath)
+	if err != nil {
+		return result, err
+	}
 	if !strings.HasSuffix(path, "/") {
 		path += "/"
 	}
@@ -129,10 +220,71 @@ func (s *BackupStoreDriver) List(listPath string) ([]string, error) {
 		return result, err
 	}
 
+	result = getListEntries(path, contents, prefixes)
+	// the listings of the directory buckets are not sorted
+	if isDirectoryBucket(s.service.Bucket) {
+		sort.Strings(result)
+	}
+	return result, nil
+}
+
+// ListPrefix lists the entries of the path starting with the prefix, the filtering is done by s3
+func (s *BackupStoreDriver) ListPrefix(listPath, prefix string) ([]string, error) {
+	path, err := s.updatePath(listPath)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	// the directory buckets only take the prefixes ending with the delimiter, the entries are filtered here then
+	if isDirectoryBucket(s.service.Bucket) {
+		entries, err := s.List(listPath)
+		if err != nil {
+			return nil, err
+		}
+		var result []string
+		for _, entry := range entries {
+			if strings.HasPrefix(entry, prefix) {
+				result = append(result, entry)
+			}
+		}
+		return result, nil
+	}
+	contents, prefixes, err := s.service.ListObjects(path+prefix, "/")
+	if err != nil {
+		log.WithError(err).Error("Failed to list s3")
+		return nil, err
+	}
+
+	return getListEntries(path, contents, prefixes), nil
+}
+
+// ListPage lists up to limit entries of the path starting from the continuation token
+func (s *BackupStoreDriver) ListPage(listPath, continuationToken string, limit int) ([]string, string, error) {
+	path, err := s.updatePath(listPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	contents, prefixes, nextToken, err := s.service.ListObjectsPage(path, "/", continuationToken, int64(limit))
+	if err != nil {
+		log.WithError(err).Error("Failed to list s3")
+		return nil, "", err
+	}
+
+	return getListEntries(path, contents, prefixes), nextToken, nil
+}
+
+func getListEntries(path string, contents []*s3.Object, prefixes []*s3.CommonPrefix) []string {
+	var result []string
+
 	sizeC := len(contents)
 	sizeP := len(prefixes)
 	if sizeC == 0 && sizeP == 0 {
-		return result, nil
+		return result
 	}
 	result = []string{}
 	for _, obj := range contents {
@@ -149,7 +301,7 @@ func (s *BackupStoreDriver) List(listPath string) ([]string, error) {
 		}
 	}
 
-	return result, nil
+	return result
 }
 
 func (s *BackupStoreDriver) FileExists(filePath string) bool {
@@ -157,7 +309,10 @@ func (s *BackupStoreDriver) FileExists(filePath string) bool {
 }
 
 func (s *BackupStoreDriver) FileSize(filePath string) int64 {
-	path := s.updatePath(filePath)
+	path, err := s.updatePath(filePath)
+	if err != nil {
+		return -1
+	}
 	head, err := s.service.HeadObject(path)
 	if err != nil || head.ContentLength == nil {
 		return -1
@@ -166,7 +321,10 @@ func (s *BackupStoreDriver) FileSize(filePath string) int64 {
 }
 
 func (s *BackupStoreDriver) FileTime(filePath string) time.Time {
-	path := s.updatePath(filePath)
+	path, err := s.updatePath(filePath)
+	if err != nil {
+		return time.Time{}
+	}
 	head, err := s.service.HeadObject(path)
 	if err != nil || head.ContentLength == nil {
 		return time.Time{}
@@ -175,11 +333,18 @@ func (s *BackupStoreDriver) FileTime(filePath string) time.Time {
 }
 
 func (s *BackupStoreDriver) Remove(path string) error {
-	return s.service.DeleteObjects(s.updatePath(path))
+	key, err := s.updatePath(path)
+	if err != nil {
+		return err
+	}
+	return s.service.DeleteObjects(key)
 }
 
 func (s *BackupStoreDriver) Read(src string) (io.ReadCloser, error) {
-	path := s.updatePath(src)
+	path, err := s.updatePath(src)
+	if err != nil {
+		return nil, err
+	}
 	rc, err := s.service.GetObject(path)
 	if err != nil {
 		return nil, err
@@ -187,9 +352,77 @@ func (s *BackupStoreDriver) Read(src string) (io.ReadCloser, error) {
 	return rc, nil
 }
 
+func (s *BackupStoreDriver) ReadRange(src string, offset, length int64) (io.ReadCloser, error) {
+	path, err := s.updatePath(src)
+	if err != nil {
+		return nil, err
+	}
+	return s.service.GetObjectRange(path, offset, length)
+}
+
 func (s *BackupStoreDriver) Write(dst string, rs io.ReadSeeker) error {
-	path := s.updatePath(dst)
-	return s.service.PutObject(path, rs)
+	path, err := s.updatePath(dst)
+	if err != nil {
+		return err
+	}
+	return s.putConfirmed(path, func() (*s3.PutObjectOutput, error) {
+		return s.service.putObject(path, rs)
+	})
+}
+
+func (s *BackupStoreDriver) WriteVerified(dst string, rs io.ReadSeeker) (string, error) {
+	path, err := s.updatePath(dst)
+	if err != nil {
+		return "", err
+	}
+	return s.service.PutObjectVerified(path, rs)
+}
+
+func (s *BackupStoreDriver) FileETag(filePath string) (string, error) {
+	path, err := s.updatePath(filePath)
+	if err != nil {
+		return "", err
+	}
+	if s.FileSize(filePath) < 0 {
+		return "", nil
+	}
+	head, err := s.service.HeadObject(path)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(head.ETag), nil
+}
+
+func (s *BackupStoreDriver) WriteIfMatch(dst string, rs io.ReadSeeker, etag string) error {
+	path, err := s.updatePath(dst)
+	if err != nil {
+		return err
+	}
+	err = s.putConfirmed(path, func() (*s3.PutObjectOutput, error) {
+		return s.service.putObjectIfMatch(path, rs, etag)
+	})
+	if err != nil {
+		if backupstore.IsConflictError(err) {
+			return &backupstore.ConflictError{Path: dst, ETag: etag}
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *BackupStoreDriver) WriteVerifiedIfMatch(dst string, rs io.ReadSeeker, etag string) (string, error) {
+	path, err := s.updatePath(dst)
+	if err != nil {
+		return "", err
+	}
+	checksum, err := s.service.PutObjectVerifiedIfMatch(path, rs, etag)
+	if err != nil {
+		if backupstore.IsConflictError(err) {
+			return "", &backupstore.ConflictError{Path: dst, ETag: etag}
+		}
+		return "", err
+	}
+	return checksum, nil
 }
 
 func (s *BackupStoreDriver) Upload(src, dst string) error {
@@ -198,7 +431,10 @@ func (s *BackupStoreDriver) Upload(src, dst string) error {
 		return nil
 	}
 	defer file.Close()
-	path := s.updatePath(dst)
+	path, err := s.updatePath(dst)
+	if err != nil {
+		return err
+	}
 	return s.service.PutObject(path, file)
 }
 
@@ -217,7 +453,10 @@ func (s *BackupStoreDriver) Download(src, dst string) error {
 	}
 	defer f.Close()
 
-	path := s.updatePath(src)
+	path, err := s.updatePath(src)
+	if err != nil {
+		return err
+	}
 	rc, err := s.service.GetObject(path)
 	if err != nil {
 		return err
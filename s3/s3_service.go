@@ -1,26 +1,48 @@
 package s3
 
 import (
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/pkg/errors"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/util"
 )
 
 type Service struct {
 	Region string
 	Bucket string
 	Client *http.Client
+
+	// CredentialProvider is consulted for each request instead of the environment variables if specified
+	CredentialProvider backupstore.CredentialProvider
+	DestURL            string
+
+	// Provider is the preset of the S3 compatible cloud, the environment variables take precedence over it
+	Provider *Provider
+	pacer    *requestPacer
+
+	// Anonymous sends the requests unsigned, so the public bucket can be read without credentials
+	Anonymous bool
 }
 
 const (
 	VirtualHostedStyle = "VIRTUAL_HOSTED_STYLE"
+	// WriteConfirmation is one of WriteConfirmationPoll and WriteConfirmationNotification to wait for the
+	// metadata writes to be visible, the writes are not confirmed if empty
+	WriteConfirmation = "S3_WRITE_CONFIRMATION"
 )
 
 func (s *Service) New() (*s3.S3, error) {
@@ -35,6 +57,29 @@ func (s *Service) New() (*s3.S3, error) {
 		config.S3ForcePathStyle = aws.Bool(true)
 	}
 
+	if isDirectoryBucket(s.Bucket) {
+		if endpoints == "" {
+			endpoint, err := getDirectoryBucketEndpoint(s.Bucket, s.getRegion())
+			if err != nil {
+				return nil, err
+			}
+			endpoints = endpoint
+		}
+		// the directory buckets are addressed by the host name
+		if config.S3ForcePathStyle == nil {
+			config.S3ForcePathStyle = aws.Bool(false)
+		}
+	}
+
+	if s.Provider != nil {
+		if endpoints == "" {
+			endpoints = s.Provider.getEndpoint(s.Region)
+		}
+		if config.S3ForcePathStyle == nil {
+			config.S3ForcePathStyle = aws.Bool(!s.Provider.VirtualHostedStyle)
+		}
+	}
+
 	if endpoints != "" {
 		config.Endpoint = aws.String(endpoints)
 		if config.S3ForcePathStyle == nil {
@@ -46,36 +91,157 @@ func (s *Service) New() (*s3.S3, error) {
 		config.HTTPClient = s.Client
 	}
 
+	if s.Anonymous {
+		config.Credentials = credentials.AnonymousCredentials
+	} else if s.CredentialProvider != nil {
+		credential, err := s.CredentialProvider.GetCredential(s.DestURL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get credential for %v", s.DestURL)
+		}
+		typed, err := util.CredentialFromMap(KIND, credential)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid credential for %v", s.DestURL)
+		}
+		if s3Credential := typed.(*util.S3Credential); s3Credential.AccessKey != "" {
+			config.Credentials = credentials.NewStaticCredentials(s3Credential.AccessKey,
+				s3Credential.SecretKey, s3Credential.SessionToken)
+		}
+	}
+
 	ses, err := session.NewSession(config)
 	if err != nil {
 		return nil, err
 	}
-	if _, err := ses.Config.Credentials.Get(); err != nil {
-		return nil, err
+	// the anonymous credentials cannot be retrieved, the requests are just not signed
+	if !s.Anonymous {
+		if _, err := ses.Config.Credentials.Get(); err != nil {
+			return nil, err
+		}
+	}
+	if isDirectoryBucket(s.Bucket) {
+		return s.newDirectoryBucketClient(ses)
 	}
 	return s3.New(ses), nil
 }
 
+// getRegion returns the region of the bucket, AWS_REGION is used if the backup target URL has no region
+func (s *Service) getRegion() string {
+	if s.Region != "" {
+		return s.Region
+	}
+	return os.Getenv("AWS_REGION")
+}
+
 func (s *Service) Close() {
 }
 
+// checkWritable fails the modification of the object if the bucket is accessed anonymously, instead of sending
+// the request bound to be rejected
+func (s *Service) checkWritable(key string) error {
+	if !s.Anonymous {
+		return nil
+	}
+	return backupstore.NewDriverError(backupstore.ErrorClassPermissionDenied, "AnonymousAccess",
+		fmt.Errorf("cannot modify object %v of bucket %v with the anonymous access", key, s.Bucket))
+}
+
+// isAuthError checks if the request is rejected due to the credential, e.g. the temporary credential expired
+func isAuthError(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		if reqErr.StatusCode() == http.StatusUnauthorized || reqErr.StatusCode() == http.StatusForbidden {
+			return true
+		}
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "ExpiredToken", "InvalidToken", "TokenRefreshRequired":
+			return true
+		}
+	}
+	return false
+}
+
+// do runs the request with a new s3 client. If the request is rejected due to the credential
+// and there is a credential provider, the credential is refreshed and the request is retried once.
+// The session of the directory bucket is renewed and the request is retried once as well.
+func (s *Service) do(request func(svc *s3.S3) error) error {
+	svc, err := s.New()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	s.pacer.wait()
+	err = request(svc)
+	directoryBucket := isDirectoryBucket(s.Bucket)
+	if err == nil || (s.CredentialProvider == nil && !directoryBucket) || !isAuthError(err) {
+		return err
+	}
+
+	if directoryBucket {
+		log.WithError(err).Warnf("Renewing session of directory bucket %v since the request is rejected", s.Bucket)
+		s.resetDirectoryBucketSessions()
+	}
+	if s.CredentialProvider != nil {
+		log.WithError(err).Warnf("Refreshing credential for %v since the request is rejected", s.DestURL)
+		if refreshErr := s.CredentialProvider.RefreshCredential(s.DestURL); refreshErr != nil {
+			log.WithError(refreshErr).Errorf("Failed to refresh credential for %v", s.DestURL)
+			return err
+		}
+	}
+	if svc, err = s.New(); err != nil {
+		return err
+	}
+	s.pacer.wait()
+	return request(svc)
+}
+
+// parseAwsError flattens the AWS error into the message, and classifies it by the AWS error code or the HTTP
+// status code
 func parseAwsError(err error) error {
 	if awsErr, ok := err.(awserr.Error); ok {
 		message := fmt.Sprintln("AWS Error: ", awsErr.Code(), awsErr.Message(), awsErr.OrigErr())
 		if reqErr, ok := err.(awserr.RequestFailure); ok {
 			message += fmt.Sprintln(reqErr.StatusCode(), reqErr.RequestID())
 		}
-		return fmt.Errorf(message)
+		return backupstore.NewDriverError(classifyAwsError(awsErr), awsErr.Code(), fmt.Errorf(message))
 	}
 	return err
 }
 
-func (s *Service) ListObjects(key, delimiter string) ([]*s3.Object, []*s3.CommonPrefix, error) {
-	svc, err := s.New()
-	if err != nil {
-		return nil, nil, err
+func classifyAwsError(awsErr awserr.Error) backupstore.ErrorClass {
+	switch awsErr.Code() {
+	case s3.ErrCodeNoSuchKey, s3.ErrCodeNoSuchBucket, "NotFound":
+		return backupstore.ErrorClassNotFound
+	case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "InvalidToken",
+		"AllAccessDisabled", "AccountProblem":
+		return backupstore.ErrorClassPermissionDenied
+	case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequests",
+		"RequestThrottled", "RequestThrottledException":
+		return backupstore.ErrorClassThrottled
+	case "InternalError", "ServiceUnavailable", "RequestTimeout", "RequestTimeoutException",
+		request.ErrCodeRequestError, request.ErrCodeResponseTimeout, "XMinioServerNotInitialized":
+		return backupstore.ErrorClassUnavailable
+	case "PreconditionFailed", "OperationAborted", "ConditionalRequestConflict":
+		return backupstore.ErrorClassConflict
+	case errCodeInvalidObjectState:
+		return backupstore.ErrorClassArchived
+	case "QuotaExceeded", "XMinioStorageFull", "XMinioAdminBucketQuotaExceeded", "StorageQuotaExceeded":
+		return backupstore.ErrorClassQuotaExceeded
+	case "InvalidArgument", "InvalidRequest", "InvalidBucketName", "MalformedXML", "EntityTooLarge",
+		"AuthorizationHeaderMalformed", "InvalidRange":
+		return backupstore.ErrorClassInvalid
 	}
-	defer s.Close()
+	if reqErr, ok := awsErr.(awserr.RequestFailure); ok && reqErr.StatusCode() != 0 {
+		return backupstore.ClassifyHTTPStatus(reqErr.StatusCode())
+	}
+	if awsErr.OrigErr() != nil {
+		return backupstore.GetErrorClass(awsErr.OrigErr())
+	}
+	return backupstore.ErrorClassUnknown
+}
+
+func (s *Service) ListObjects(key, delimiter string) ([]*s3.Object, []*s3.CommonPrefix, error) {
 	// WARNING: Directory must end in "/" in S3, otherwise it may match
 	// unintentionally
 	params := &s3.ListObjectsInput{
@@ -88,96 +254,280 @@ func (s *Service) ListObjects(key, delimiter string) ([]*s3.Object, []*s3.Common
 		objects       []*s3.Object
 		commonPrefixs []*s3.CommonPrefix
 	)
-	err = svc.ListObjectsPages(params, func(page *s3.ListObjectsOutput, lastPage bool) bool {
-		objects = append(objects, page.Contents...)
-		commonPrefixs = append(commonPrefixs, page.CommonPrefixes...)
-		return !lastPage
+	err := s.do(func(svc *s3.S3) error {
+		objects, commonPrefixs = nil, nil
+		// the directory buckets only support ListObjectsV2
+		if isDirectoryBucket(s.Bucket) {
+			return svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+				Bucket:    params.Bucket,
+				Prefix:    params.Prefix,
+				Delimiter: params.Delimiter,
+			}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+				objects = append(objects, page.Contents...)
+				commonPrefixs = append(commonPrefixs, page.CommonPrefixes...)
+				return !lastPage
+			})
+		}
+		return svc.ListObjectsPages(params, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+			objects = append(objects, page.Contents...)
+			commonPrefixs = append(commonPrefixs, page.CommonPrefixes...)
+			return !lastPage
+		})
 	})
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to list objects with param: %+v error: %v",
+		return nil, nil, fmt.Errorf("failed to list objects with param: %+v error: %w",
 			params, parseAwsError(err))
 	}
 	return objects, commonPrefixs, nil
 }
 
-func (s *Service) HeadObject(key string) (*s3.HeadObjectOutput, error) {
-	svc, err := s.New()
+// ListObjectsPage lists up to maxKeys objects starting from the continuation token,
+// the returned token is empty if there are no more objects
+func (s *Service) ListObjectsPage(key, delimiter, continuationToken string, maxKeys int64) ([]*s3.Object, []*s3.CommonPrefix, string, error) {
+	params := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.Bucket),
+		Prefix:    aws.String(key),
+		Delimiter: aws.String(delimiter),
+		MaxKeys:   aws.Int64(maxKeys),
+	}
+	if continuationToken != "" {
+		params.ContinuationToken = aws.String(continuationToken)
+	}
+
+	resp := &s3.ListObjectsV2Output{}
+	err := s.do(func(svc *s3.S3) (err error) {
+		resp, err = svc.ListObjectsV2(params)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return nil, nil, "", fmt.Errorf("failed to list objects with param: %+v error: %w",
+			params, parseAwsError(err))
 	}
-	defer s.Close()
+
+	nextToken := ""
+	if aws.BoolValue(resp.IsTruncated) {
+		nextToken = aws.StringValue(resp.NextContinuationToken)
+	}
+	return resp.Contents, resp.CommonPrefixes, nextToken, nil
+}
+
+func (s *Service) HeadObject(key string) (*s3.HeadObjectOutput, error) {
 	params := &s3.HeadObjectInput{
 		Bucket: aws.String(s.Bucket),
 		Key:    aws.String(key),
 	}
-	resp, err := svc.HeadObject(params)
+
+	resp := &s3.HeadObjectOutput{}
+	err := s.do(func(svc *s3.S3) (err error) {
+		resp, err = svc.HeadObject(params)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get metadata for object: %v response: %v error: %v",
+		return nil, fmt.Errorf("failed to get metadata for object: %v response: %v error: %w",
 			key, resp.String(), parseAwsError(err))
 	}
 	return resp, nil
 }
 
 func (s *Service) PutObject(key string, reader io.ReadSeeker) error {
-	svc, err := s.New()
+	_, err := s.putObject(key, reader)
+	return err
+}
+
+// PutObjectVerified puts the object, and returns the MD5 checksum in hex of the stored object taken from the ETag.
+// An empty checksum is returned if the ETag isn't the MD5 checksum, which is the case for the encrypted objects
+// and the objects of the directory buckets.
+func (s *Service) PutObjectVerified(key string, reader io.ReadSeeker) (string, error) {
+	resp, err := s.putObject(key, reader)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer s.Close()
+	if isDirectoryBucket(s.Bucket) {
+		return "", nil
+	}
+	return getETagChecksum(resp), nil
+}
 
+func (s *Service) putObject(key string, reader io.ReadSeeker) (*s3.PutObjectOutput, error) {
+	if err := s.checkWritable(key); err != nil {
+		return nil, err
+	}
 	params := &s3.PutObjectInput{
 		Bucket: aws.String(s.Bucket),
 		Key:    aws.String(key),
 		Body:   reader,
 	}
 
-	resp, err := svc.PutObject(params)
+	resp := &s3.PutObjectOutput{}
+	err := s.do(func(svc *s3.S3) (err error) {
+		// rewind the body in case the request is retried
+		if _, err := reader.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		resp, err = svc.PutObject(params)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("failed to put object: %v response: %v error: %v",
+		return nil, fmt.Errorf("failed to put object: %v response: %v error: %w",
 			key, resp.String(), parseAwsError(err))
 	}
-	return nil
+	return resp, nil
 }
 
-func (s *Service) GetObject(key string) (io.ReadCloser, error) {
-	svc, err := s.New()
+// getETagChecksum returns the MD5 checksum from the ETag of the single part object stored without SSE-KMS or SSE-C
+func getETagChecksum(resp *s3.PutObjectOutput) string {
+	if resp.SSECustomerAlgorithm != nil {
+		return ""
+	}
+	if sse := aws.StringValue(resp.ServerSideEncryption); sse != "" && sse != s3.ServerSideEncryptionAes256 {
+		return ""
+	}
+	etag := strings.Trim(aws.StringValue(resp.ETag), `"`)
+	if len(etag) != 2*md5.Size {
+		return ""
+	}
+	if _, err := hex.DecodeString(etag); err != nil {
+		return ""
+	}
+	return etag
+}
+
+// PutObjectIfMatch puts the object only if its ETag is still etag, an empty etag requires the object not to exist.
+// ConflictError is returned if the condition doesn't hold.
+func (s *Service) PutObjectIfMatch(key string, reader io.ReadSeeker, etag string) error {
+	_, err := s.putObjectIfMatch(key, reader, etag)
+	return err
+}
+
+// PutObjectVerifiedIfMatch puts the object like PutObjectIfMatch, and returns the MD5 checksum of the stored
+// object like PutObjectVerified
+func (s *Service) PutObjectVerifiedIfMatch(key string, reader io.ReadSeeker, etag string) (string, error) {
+	resp, err := s.putObjectIfMatch(key, reader, etag)
 	if err != nil {
+		return "", err
+	}
+	if isDirectoryBucket(s.Bucket) {
+		return "", nil
+	}
+	return getETagChecksum(resp), nil
+}
+
+func (s *Service) putObjectIfMatch(key string, reader io.ReadSeeker, etag string) (*s3.PutObjectOutput, error) {
+	if err := s.checkWritable(key); err != nil {
 		return nil, err
 	}
-	defer s.Close()
+	params := &s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Body:   reader,
+	}
+
+	resp := &s3.PutObjectOutput{}
+	err := s.do(func(svc *s3.S3) error {
+		// rewind the body in case the request is retried
+		if _, err := reader.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		// the conditional headers are not modeled by this SDK version, so they are set on the request directly
+		req, out := svc.PutObjectRequest(params)
+		if etag == "" {
+			req.HTTPRequest.Header.Set("If-None-Match", "*")
+			// the existing object is rejected before the body is sent
+			req.HTTPRequest.Header.Set("Expect", "100-continue")
+		} else {
+			req.HTTPRequest.Header.Set("If-Match", etag)
+		}
+		resp = out
+		return req.Send()
+	})
+	if isConflictError(err) {
+		return nil, &backupstore.ConflictError{Path: key, ETag: etag}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to put object: %v response: %v error: %w",
+			key, resp.String(), parseAwsError(err))
+	}
+	return resp, nil
+}
+
+// isConflictError checks if the conditional request failed, 409 is returned instead of 412 if the
+// object is changed by another conditional request in progress
+func isConflictError(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusPreconditionFailed || reqErr.StatusCode() == http.StatusConflict
+	}
+	return false
+}
 
-	params := &s3.GetObjectInput{
+func (s *Service) GetObject(key string) (io.ReadCloser, error) {
+	return s.getObject(&s3.GetObjectInput{
 		Bucket: aws.String(s.Bucket),
 		Key:    aws.String(key),
+	})
+}
+
+// GetObjectRange gets up to length bytes of the object from offset by a ranged GET
+func (s *Service) GetObjectRange(key string, offset, length int64) (io.ReadCloser, error) {
+	if length <= 0 {
+		return io.NopCloser(strings.NewReader("")), nil
 	}
+	return s.getObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+}
 
-	resp, err := svc.GetObject(params)
+func (s *Service) getObject(params *s3.GetObjectInput) (io.ReadCloser, error) {
+	key := aws.StringValue(params.Key)
+	resp := &s3.GetObjectOutput{}
+	err := s.do(func(svc *s3.S3) (err error) {
+		resp, err = svc.GetObject(params)
+		return err
+	})
+	if isArchivedError(err) {
+		return nil, &backupstore.ArchivedError{Path: key}
+	}
+	// the range starts after the end of the object
+	if params.Range != nil && isInvalidRangeError(err) {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get object: %v response: %v error: %v",
+		return nil, fmt.Errorf("failed to get object: %v response: %v error: %w",
 			key, resp.String(), parseAwsError(err))
 	}
 
 	return resp.Body, nil
 }
 
+func isInvalidRangeError(err error) bool {
+	reqErr, ok := err.(awserr.RequestFailure)
+	return ok && reqErr.StatusCode() == http.StatusRequestedRangeNotSatisfiable
+}
+
 func (s *Service) DeleteObjects(key string) error {
+	if err := s.checkWritable(key); err != nil {
+		return err
+	}
+	// the directory buckets don't support versioning
+	if backupstore.IsPurgeNoncurrentVersionsEnabled() && !isDirectoryBucket(s.Bucket) {
+		return s.purgeObjects(key)
+	}
 
 	objects, _, err := s.ListObjects(key, "")
 	if err != nil {
 		return errors.Wrapf(err, "failed to list objects with prefix %v before removing them", key)
 	}
 
-	svc, err := s.New()
-	if err != nil {
-		return errors.Wrap(err, "failed to get a new s3 client instance before removing objects")
-	}
-	defer s.Close()
-
 	var deletionFailures []string
 	for _, object := range objects {
-		resp, err := svc.DeleteObject(&s3.DeleteObjectInput{
-			Bucket: aws.String(s.Bucket),
-			Key:    object.Key,
+		resp := &s3.DeleteObjectOutput{}
+		err := s.do(func(svc *s3.S3) (err error) {
+			resp, err = svc.DeleteObject(&s3.DeleteObjectInput{
+				Bucket: aws.String(s.Bucket),
+				Key:    object.Key,
+			})
+			return err
 		})
 
 		if err != nil {
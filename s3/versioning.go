@@ -0,0 +1,101 @@
+package s3
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+
+	"github.com/longhorn/backupstore"
+)
+
+// GetBucketVersioning returns the versioning status of the bucket, the bucket never versioned is disabled
+func (s *Service) GetBucketVersioning() (backupstore.VersioningStatus, error) {
+	// the directory buckets don't support versioning
+	if isDirectoryBucket(s.Bucket) {
+		return backupstore.VersioningStatusDisabled, nil
+	}
+	resp := &s3.GetBucketVersioningOutput{}
+	err := s.do(func(svc *s3.S3) (err error) {
+		resp, err = svc.GetBucketVersioning(&s3.GetBucketVersioningInput{
+			Bucket: aws.String(s.Bucket),
+		})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get versioning of bucket %v error: %w", s.Bucket, parseAwsError(err))
+	}
+
+	switch aws.StringValue(resp.Status) {
+	case s3.BucketVersioningStatusEnabled:
+		return backupstore.VersioningStatusEnabled, nil
+	case s3.BucketVersioningStatusSuspended:
+		return backupstore.VersioningStatusSuspended, nil
+	default:
+		return backupstore.VersioningStatusDisabled, nil
+	}
+}
+
+// objectVersion is a version or a delete marker of an object
+type objectVersion struct {
+	key       string
+	versionID string
+}
+
+func (s *Service) listObjectVersions(prefix string) ([]objectVersion, error) {
+	params := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	var versions []objectVersion
+	err := s.do(func(svc *s3.S3) error {
+		versions = nil
+		return svc.ListObjectVersionsPages(params, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+			for _, v := range page.Versions {
+				versions = append(versions, objectVersion{aws.StringValue(v.Key), aws.StringValue(v.VersionId)})
+			}
+			for _, m := range page.DeleteMarkers {
+				versions = append(versions, objectVersion{aws.StringValue(m.Key), aws.StringValue(m.VersionId)})
+			}
+			return !lastPage
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list object versions with param: %+v error: %w",
+			params, parseAwsError(err))
+	}
+	return versions, nil
+}
+
+// purgeObjects removes all the versions and the delete markers of the objects with the prefix
+func (s *Service) purgeObjects(prefix string) error {
+	versions, err := s.listObjectVersions(prefix)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list object versions with prefix %v before purging them", prefix)
+	}
+
+	var deletionFailures []string
+	for _, version := range versions {
+		resp := &s3.DeleteObjectOutput{}
+		err := s.do(func(svc *s3.S3) (err error) {
+			resp, err = svc.DeleteObject(&s3.DeleteObjectInput{
+				Bucket:    aws.String(s.Bucket),
+				Key:       aws.String(version.key),
+				VersionId: aws.String(version.versionID),
+			})
+			return err
+		})
+		if err != nil {
+			log.Errorf("Failed to delete object: %v version: %v response: %v error: %v",
+				version.key, version.versionID, resp.String(), parseAwsError(err))
+			deletionFailures = append(deletionFailures, version.key+"?versionId="+version.versionID)
+		}
+	}
+
+	if len(deletionFailures) > 0 {
+		return fmt.Errorf("failed to delete object versions %v", deletionFailures)
+	}
+	return nil
+}
@@ -0,0 +1,368 @@
+package backupstore
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gammazero/workerpool"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	// SCRUB_INDEX_FILE records when each block of the volume was verified by the scrubbing
+	SCRUB_INDEX_FILE = "scrub.cfg"
+
+	// DEFAULT_SCRUB_PERCENT is the percentage of the blocks of each volume verified by a scrub run, so all the
+	// blocks are verified by 10 runs
+	DEFAULT_SCRUB_PERCENT = 10
+	// DEFAULT_SCRUB_CONCURRENT_LIMIT is the number of the blocks verified in parallel
+	DEFAULT_SCRUB_CONCURRENT_LIMIT = 4
+)
+
+// scrubNow returns the time recorded for the verified blocks, replaced by the tests
+var scrubNow = time.Now
+
+// ScrubOptions are the options of ScrubBackupTarget
+type ScrubOptions struct {
+	// VolumeNames limits the scrubbing to the backup volumes, all the volumes are scrubbed if empty
+	VolumeNames []string
+	// Percent is the percentage of the blocks of each volume verified by the run, DEFAULT_SCRUB_PERCENT if 0.
+	// At least 1 block of each volume is verified.
+	Percent int
+	// ConcurrentLimit is the number of the blocks verified concurrently, DEFAULT_SCRUB_CONCURRENT_LIMIT if 0
+	ConcurrentLimit int
+	// RateLimit limits the bytes read from the backup target per second, no limit if 0
+	RateLimit int64
+}
+
+// ScrubReport is the result of ScrubBackupTarget
+type ScrubReport struct {
+	DestURL string
+
+	VolumeCount int
+	// TotalBlocks are the blocks referenced by the completed backups of the scrubbed volumes
+	TotalBlocks int64
+	// VerifiedBlocks are the blocks read and verified by this run, including the corrupted and missing ones
+	VerifiedBlocks int64
+	VerifiedBytes  int64
+	// NeverVerifiedBlocks are the blocks not verified by any run yet, including this one
+	NeverVerifiedBlocks int64
+	// OldestVerifiedAt is the time the least recently verified block was verified, empty if a block has never
+	// been verified
+	OldestVerifiedAt string `json:",omitempty"`
+
+	// CorruptedBlocks and MissingBlocks are the volume/checksum of the blocks failed the verification
+	CorruptedBlocks []string `json:",omitempty"`
+	MissingBlocks   []string `json:",omitempty"`
+	// Failures maps the volume or the volume/checksum to the reason it cannot be scrubbed or the block cannot be
+	// read
+	Failures map[string]string `json:",omitempty"`
+}
+
+// scrubIndex is the scrub index of a volume in the backupstore. The blocks verified at least once are mapped
+// to the Unix time they were last verified, the corrupted and missing blocks keep the time of the last successful
+// verification, so they are verified again by the next run.
+type scrubIndex struct {
+	LastScrubAt string
+	Blocks      map[string]int64
+}
+
+func getScrubIndexFilePath(driver BackupStoreDriver, volumeName string) string {
+	return filepath.Join(getVolumePath(driver, volumeName), SCRUB_INDEX_FILE)
+}
+
+func loadScrubIndex(driver BackupStoreDriver, volumeName string) (*scrubIndex, error) {
+	index := &scrubIndex{}
+	filePath := getScrubIndexFilePath(driver, volumeName)
+	if driver.FileExists(filePath) {
+		if err := LoadConfigInBackupStore(driver, filePath, index); err != nil {
+			return nil, err
+		}
+	}
+	if index.Blocks == nil {
+		index.Blocks = map[string]int64{}
+	}
+	return index, nil
+}
+
+func saveScrubIndex(driver BackupStoreDriver, volumeName string, index *scrubIndex) error {
+	return SaveConfigInBackupStore(driver, getScrubIndexFilePath(driver, volumeName), index)
+}
+
+// ScrubBackupTarget verifies a part of the blocks of the backup volumes in the backup target destURL, so the
+// cost of checking the integrity of the whole backup target is spread across the runs, e.g. a daily run with
+// the default percentage verifies all the blocks every 10 days. The never-verified blocks are verified first,
+// then the blocks verified the longest time ago. The verification time of each block is recorded in the scrub
+// index of the volume. The corrupted and missing blocks are reported but not repaired, see RepairBackupChain.
+func ScrubBackupTarget(destURL string, opts *ScrubOptions) (*ScrubReport, error) {
+	if opts == nil {
+		opts = &ScrubOptions{}
+	}
+	if opts.Percent < 0 || opts.Percent > 100 {
+		return nil, fmt.Errorf("invalid scrub percent %v", opts.Percent)
+	}
+	if opts.ConcurrentLimit < 0 || opts.RateLimit < 0 {
+		return nil, fmt.Errorf("invalid negative concurrent limit %v or rate limit %v", opts.ConcurrentLimit, opts.RateLimit)
+	}
+	percent := opts.Percent
+	if percent == 0 {
+		percent = DEFAULT_SCRUB_PERCENT
+	}
+	concurrentLimit := opts.ConcurrentLimit
+	if concurrentLimit == 0 {
+		concurrentLimit = DEFAULT_SCRUB_CONCURRENT_LIMIT
+	}
+
+	bsDriver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	volumeNames := opts.VolumeNames
+	if len(volumeNames) == 0 {
+		jobQueues := workerpool.New(runtime.NumCPU() * 16)
+		volumeNames, err = getVolumeNames(jobQueues, bsDriver)
+		jobQueues.StopWait()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list backup volumes of %v", destURL)
+		}
+	}
+	for _, volumeName := range volumeNames {
+		if !util.ValidateName(volumeName) {
+			return nil, fmt.Errorf("invalid volume name %v", volumeName)
+		}
+	}
+	sort.Strings(volumeNames)
+
+	scrubber := &volumeScrubber{
+		bsDriver:        bsDriver,
+		percent:         percent,
+		concurrentLimit: concurrentLimit,
+		limiter:         newRateLimiter(opts.RateLimit),
+		report: &ScrubReport{
+			DestURL:  bsDriver.GetURL(),
+			Failures: map[string]string{},
+		},
+	}
+	for _, volumeName := range volumeNames {
+		if err := scrubber.scrubVolume(volumeName); err != nil {
+			log.WithError(err).Errorf("Failed to scrub backup volume %v", volumeName)
+			scrubber.report.Failures[volumeName] = err.Error()
+		}
+	}
+	report := scrubber.report
+	sort.Strings(report.CorruptedBlocks)
+	sort.Strings(report.MissingBlocks)
+	if len(report.Failures) == 0 {
+		report.Failures = nil
+	}
+
+	log.WithFields(logrus.Fields{
+		LogFieldDestURL: destURL,
+	}).Infof("Scrubbed %v backup volumes, verified %v of %v blocks, %v never verified, %v corrupted, %v missing, %v failures",
+		report.VolumeCount, report.VerifiedBlocks, report.TotalBlocks, report.NeverVerifiedBlocks,
+		len(report.CorruptedBlocks), len(report.MissingBlocks), len(report.Failures))
+	return report, nil
+}
+
+// volumeScrubber verifies the blocks of the volumes and accumulates the results in the report
+type volumeScrubber struct {
+	bsDriver        BackupStoreDriver
+	percent         int
+	concurrentLimit int
+	limiter         *rateLimiter
+
+	lock   sync.Mutex
+	report *ScrubReport
+	oldest int64
+}
+
+func (s *volumeScrubber) scrubVolume(volumeName string) error {
+	bsDriver := s.bsDriver
+	log := log.WithFields(logrus.Fields{
+		LogFieldVolume:  volumeName,
+		LogFieldDestURL: bsDriver.GetURL(),
+	})
+
+	// the backup lock prevents the blocks from being removed by the backup deletion while verifying them
+	lock, err := New(bsDriver, volumeName, BACKUP_LOCK)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+
+	compressionMethods, err := getScrubBlocks(bsDriver, volumeName)
+	if err != nil {
+		return err
+	}
+	index, err := loadScrubIndex(bsDriver, volumeName)
+	if err != nil {
+		return err
+	}
+	// the blocks of the deleted backups are dropped from the index
+	for checksum := range index.Blocks {
+		if _, exists := compressionMethods[checksum]; !exists {
+			delete(index.Blocks, checksum)
+		}
+	}
+
+	checksums := make([]string, 0, len(compressionMethods))
+	for checksum := range compressionMethods {
+		checksums = append(checksums, checksum)
+	}
+	// the never-verified blocks have no time in the index, so they are sorted before the others
+	sort.Slice(checksums, func(i, j int) bool {
+		ti, tj := index.Blocks[checksums[i]], index.Blocks[checksums[j]]
+		if ti != tj {
+			return ti < tj
+		}
+		return checksums[i] < checksums[j]
+	})
+	count := (len(checksums)*s.percent + 99) / 100
+	if count == 0 && len(checksums) > 0 {
+		count = 1
+	}
+
+	now := scrubNow().Unix()
+	var (
+		resultLock sync.Mutex
+		corrupted  []string
+		missing    []string
+		failures   = map[string]string{}
+		verified   int64
+		readBytes  int64
+	)
+	pool := workerpool.New(s.concurrentLimit)
+	for _, checksum := range checksums[:count] {
+		checksum := checksum
+		pool.Submit(func() {
+			size, result, err := s.verifyBlock(volumeName, checksum, compressionMethods[checksum])
+
+			resultLock.Lock()
+			defer resultLock.Unlock()
+			verified++
+			readBytes += size
+			switch result {
+			case scrubBlockVerified:
+				index.Blocks[checksum] = now
+			case scrubBlockMissing:
+				log.Warnf("Block %v is missing", checksum)
+				missing = append(missing, volumeName+"/"+checksum)
+			case scrubBlockCorrupted:
+				log.WithError(err).Warnf("Block %v is corrupted", checksum)
+				corrupted = append(corrupted, volumeName+"/"+checksum)
+			default:
+				failures[volumeName+"/"+checksum] = err.Error()
+			}
+		})
+	}
+	pool.StopWait()
+
+	index.LastScrubAt = scrubNow().UTC().Format(time.RFC3339)
+	if err := saveScrubIndex(bsDriver, volumeName, index); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r := s.report
+	r.VolumeCount++
+	r.TotalBlocks += int64(len(checksums))
+	r.VerifiedBlocks += verified
+	r.VerifiedBytes += readBytes
+	r.CorruptedBlocks = append(r.CorruptedBlocks, corrupted...)
+	r.MissingBlocks = append(r.MissingBlocks, missing...)
+	for key, reason := range failures {
+		r.Failures[key] = reason
+	}
+	for _, checksum := range checksums {
+		verifiedAt := index.Blocks[checksum]
+		if verifiedAt == 0 {
+			r.NeverVerifiedBlocks++
+			continue
+		}
+		if s.oldest == 0 || verifiedAt < s.oldest {
+			s.oldest = verifiedAt
+		}
+	}
+	if r.NeverVerifiedBlocks == 0 && s.oldest != 0 {
+		r.OldestVerifiedAt = time.Unix(s.oldest, 0).UTC().Format(time.RFC3339)
+	} else {
+		r.OldestVerifiedAt = ""
+	}
+
+	log.Infof("Scrubbed %v of %v blocks, %v corrupted, %v missing", verified, len(checksums), len(corrupted), len(missing))
+	return nil
+}
+
+// getScrubBlocks returns the blocks referenced by the completed backups of the volume and their compression methods
+func getScrubBlocks(bsDriver BackupStoreDriver, volumeName string) (map[string]string, error) {
+	backupNames, err := getBackupNamesForVolume(bsDriver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	compressionMethods := map[string]string{}
+	for _, backupName := range backupNames {
+		backup, err := loadBackup(bsDriver, backupName, volumeName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load backup %v for scrubbing", backupName)
+		}
+		if isBackupInProgress(backup) {
+			continue
+		}
+		for _, block := range backup.Blocks {
+			if _, exists := compressionMethods[block.BlockChecksum]; !exists {
+				compressionMethods[block.BlockChecksum] = getBlockCompressionMethod(backup, block)
+			}
+		}
+	}
+	return compressionMethods, nil
+}
+
+// scrubBlockResult is the result of the verification of a block
+type scrubBlockResult int
+
+const (
+	scrubBlockVerified scrubBlockResult = iota
+	scrubBlockMissing
+	scrubBlockCorrupted
+	// scrubBlockFailed means the block cannot be read, e.g. by a network error, so it's neither verified nor corrupted
+	scrubBlockFailed
+)
+
+// verifyBlock reads the block and verifies its checksum, it returns the size of the stored block
+func (s *volumeScrubber) verifyBlock(volumeName, checksum, compressionMethod string) (int64, scrubBlockResult, error) {
+	blkFile := getBlockFilePath(s.bsDriver, volumeName, checksum)
+	if !s.bsDriver.FileExists(blkFile) {
+		return 0, scrubBlockMissing, nil
+	}
+	rc, err := s.bsDriver.Read(blkFile)
+	if err != nil {
+		return 0, scrubBlockFailed, errors.Wrapf(err, "failed to read %v", blkFile)
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return 0, scrubBlockFailed, errors.Wrapf(err, "failed to read %v", blkFile)
+	}
+	s.limiter.wait(int64(len(data)))
+
+	buf := blockBuffers.Get()
+	defer blockBuffers.Put(buf)
+	if _, err := decodeBlock(compressionMethod, data, buf, checksum); err != nil {
+		return int64(len(data)), scrubBlockCorrupted, err
+	}
+	return int64(len(data)), scrubBlockVerified, nil
+}
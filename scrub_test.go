@@ -0,0 +1,81 @@
+package backupstore
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestScrubVolume(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	defer func() { scrubNow = time.Now }()
+
+	assert.NoError(saveVolume(m, &Volume{Name: "pvc-1", Size: 4 * 4096, CompressionMethod: "lz4"}))
+	checksums := []string{}
+	blocks := []BlockMapping{}
+	for i := 0; i < 4; i++ {
+		data := bytes.Repeat([]byte{byte('a' + i)}, 4096)
+		checksum := util.GetChecksum(data)
+		compressed, err := util.CompressData("lz4", data)
+		assert.NoError(err)
+		assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", checksum), compressed))
+		checksums = append(checksums, checksum)
+		blocks = append(blocks, BlockMapping{Offset: int64(i) * 4096, BlockChecksum: checksum})
+	}
+	sort.Strings(checksums)
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-1", VolumeName: "pvc-1", CompressionMethod: "lz4",
+		CreatedTime: "2023-01-01T00:00:00Z", Blocks: blocks[:3]}))
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-2", VolumeName: "pvc-1", CompressionMethod: "lz4",
+		CreatedTime: "2023-01-02T00:00:00Z", Blocks: blocks[1:]}))
+
+	scrub := func(now int64) *ScrubReport {
+		scrubNow = func() time.Time { return time.Unix(now, 0) }
+		s := &volumeScrubber{
+			bsDriver:        m,
+			percent:         50,
+			concurrentLimit: 2,
+			limiter:         newRateLimiter(0),
+			report:          &ScrubReport{Failures: map[string]string{}},
+		}
+		assert.NoError(s.scrubVolume("pvc-1"))
+		return s.report
+	}
+
+	// the never-verified blocks are verified first
+	report := scrub(100)
+	assert.Equal(int64(4), report.TotalBlocks)
+	assert.Equal(int64(2), report.VerifiedBlocks)
+	assert.Equal(int64(2), report.NeverVerifiedBlocks)
+	assert.Empty(report.OldestVerifiedAt)
+	index, err := loadScrubIndex(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal(map[string]int64{checksums[0]: 100, checksums[1]: 100}, index.Blocks)
+
+	report = scrub(200)
+	assert.Equal(int64(0), report.NeverVerifiedBlocks)
+	assert.Equal(time.Unix(100, 0).UTC().Format(time.RFC3339), report.OldestVerifiedAt)
+	assert.Empty(report.CorruptedBlocks)
+
+	// the oldest verified blocks are verified next, the corrupted block keeps its last verified time
+	assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", checksums[0]), bytes.NewReader([]byte("corrupted"))))
+	report = scrub(300)
+	assert.Equal([]string{"pvc-1/" + checksums[0]}, report.CorruptedBlocks)
+	index, err = loadScrubIndex(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal(map[string]int64{checksums[0]: 100, checksums[1]: 300, checksums[2]: 200, checksums[3]: 200}, index.Blocks)
+
+	assert.NoError(m.Remove(getBlockFilePath(m, "pvc-1", checksums[2])))
+	report = scrub(400)
+	assert.Equal([]string{"pvc-1/" + checksums[0]}, report.CorruptedBlocks)
+	assert.Equal([]string{"pvc-1/" + checksums[2]}, report.MissingBlocks)
+	assert.Equal(time.Unix(100, 0).UTC().Format(time.RFC3339), report.OldestVerifiedAt)
+}
@@ -1,6 +1,9 @@
 package backupstore
 
 import (
+	"bytes"
+	"fmt"
+	"os"
 	"path/filepath"
 
 	"github.com/pkg/errors"
@@ -12,31 +15,77 @@ import (
 
 const (
 	BACKUP_FILES_DIRECTORY = "BackupFiles"
+
+	// SINGLE_FILE_INLINE_DATA_LIMIT is the max size of the file stored in the backup config instead of a
+	// separate object, which saves the requests for the small files
+	SINGLE_FILE_INLINE_DATA_LIMIT = 1024 * 1024
 )
 
 type BackupFile struct {
 	FilePath string
+	// Inline is set if the file is stored in Data instead of the object of FilePath. Data is compressed by
+	// the compression method of the backup and verified by DataChecksum.
+	Inline       bool   `json:",omitempty"`
+	Data         []byte `json:",omitempty"`
+	DataChecksum string `json:",omitempty"`
 }
 
-func getSingleFileBackupFilePath(sfBackup *Backup) string {
+func getSingleFileBackupFilePath(driver BackupStoreDriver, sfBackup *Backup) string {
 	backupFileName := sfBackup.Name + ".bak"
-	return filepath.Join(getVolumePath(sfBackup.VolumeName), BACKUP_FILES_DIRECTORY, backupFileName)
+	return filepath.Join(getVolumePath(driver, sfBackup.VolumeName), BACKUP_FILES_DIRECTORY, backupFileName)
+}
+
+type SingleFileBackupOptions struct {
+	// NameTemplate generates the backup name instead of the random one
+	NameTemplate *BackupNameTemplate
 }
 
 func CreateSingleFileBackup(volume *Volume, snapshot *Snapshot, filePath, destURL string) (string, error) {
+	return CreateSingleFileBackupWithOptions(volume, snapshot, filePath, destURL, nil)
+}
+
+// CreateSingleFileBackupWithOptions creates the single file backup like CreateSingleFileBackup. It fails with
+// BackupNameCollisionError if the name generated by opts.NameTemplate is taken and the collision policy is error.
+func CreateSingleFileBackupWithOptions(volume *Volume, snapshot *Snapshot, filePath, destURL string,
+	opts *SingleFileBackupOptions) (string, error) {
+	if opts == nil {
+		opts = &SingleFileBackupOptions{}
+	}
+	if opts.NameTemplate != nil {
+		if err := opts.NameTemplate.Validate(); err != nil {
+			return "", err
+		}
+	}
+
 	driver, err := GetBackupStoreDriver(destURL)
 	if err != nil {
 		return "", err
 	}
 
+	lock, err := New(driver, volume.Name, BACKUP_LOCK)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+	if err := lock.Lock(); err != nil {
+		return "", err
+	}
+
 	if err := addVolume(driver, volume); err != nil {
 		return "", err
 	}
 
+	if err := checkVolumeQuota(driver, volume.Name, lock); err != nil {
+		return "", err
+	}
+
 	volume, err = loadVolume(driver, volume.Name)
 	if err != nil {
 		return "", err
 	}
+	if err := checkVolumeOwnership(volume, false); err != nil {
+		return "", err
+	}
 
 	log.WithFields(logrus.Fields{
 		LogFieldReason:   LogReasonStart,
@@ -46,18 +95,35 @@ func CreateSingleFileBackup(volume *Volume, snapshot *Snapshot, filePath, destUR
 		LogFieldFilepath: filePath,
 	}).Info("Creating backup")
 
+	backupName := util.GenerateName("backup")
+	if opts.NameTemplate != nil {
+		data := newBackupNameData(volume.Name, snapshot.Name, volume.Labels)
+		if backupName, err = generateBackupName([]BackupStoreDriver{driver}, opts.NameTemplate, data); err != nil {
+			return "", err
+		}
+	}
+
 	backup := &Backup{
-		Name:              util.GenerateName("backup"),
+		Name:              backupName,
 		VolumeName:        volume.Name,
 		SnapshotName:      snapshot.Name,
 		SnapshotCreatedAt: snapshot.CreatedTime,
+		SnapshotChecksum:  snapshot.Checksum,
 		CompressionMethod: volume.CompressionMethod,
+		CreatedBy:         Version,
+		ComplianceMode:    getComplianceMode(),
 	}
-	backup.SingleFile.FilePath = getSingleFileBackupFilePath(backup)
+	backup.SingleFile.FilePath = getSingleFileBackupFilePath(driver, backup)
 
-	if err := driver.Upload(filePath, backup.SingleFile.FilePath); err != nil {
+	inline, err := inlineSingleFile(backup, filePath)
+	if err != nil {
 		return "", err
 	}
+	if !inline {
+		if err := driver.Upload(filePath, backup.SingleFile.FilePath); err != nil {
+			return "", err
+		}
+	}
 
 	backup.CreatedTime = util.Now()
 	if err := saveBackup(driver, backup); err != nil {
@@ -96,16 +162,40 @@ func RestoreSingleFileBackup(backupURL, path string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if err := checkBackupFeatures(backup); err != nil {
+		return "", err
+	}
+	if err := checkBackupCompliance(backup); err != nil {
+		return "", err
+	}
+	if err := checkBackupBroken(backup); err != nil {
+		return "", err
+	}
 
 	dstFile := filepath.Join(path, filepath.Base(backup.SingleFile.FilePath))
-	if err := driver.Download(backup.SingleFile.FilePath, dstFile); err != nil {
+	if backup.SingleFile.Inline {
+		err = restoreInlineSingleFile(backup, dstFile)
+	} else {
+		err = driver.Download(backup.SingleFile.FilePath, dstFile)
+	}
+	if err != nil {
+		emitRestoreEvent(driver, backupURL, srcVolumeName, srcBackupName, err)
 		return "", err
 	}
 
+	emitRestoreEvent(driver, backupURL, srcVolumeName, srcBackupName, nil)
 	return dstFile, nil
 }
 
 func DeleteSingleFileBackup(backupURL string) error {
+	return DeleteSingleFileBackupWithOptions(backupURL, nil)
+}
+
+func DeleteSingleFileBackupWithOptions(backupURL string, opts *DeleteOptions) error {
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+
 	driver, err := GetBackupStoreDriver(backupURL)
 	if err != nil {
 		return err
@@ -116,19 +206,83 @@ func DeleteSingleFileBackup(backupURL string) error {
 		return err
 	}
 
-	_, err = loadVolume(driver, volumeName)
+	volume, err := loadVolume(driver, volumeName)
 	if err != nil {
 		return errors.Wrapf(err, "cannot find volume %v in backupstore", volumeName)
 	}
+	if err := checkVolumeOwnership(volume, opts.ForceOwnership); err != nil {
+		return err
+	}
 
 	backup, err := loadBackup(driver, backupName, volumeName)
 	if err != nil {
 		return err
 	}
+	if backup.DeletionProtected && !opts.Force {
+		return &DeletionProtectedError{BackupName: backupName, VolumeName: volumeName}
+	}
+
+	if isBackupTrashEnabled(opts) {
+		// the backup file is removed once the trash is purged
+		if err := trashBackup(driver, backup); err != nil {
+			return err
+		}
+		emitBackupDeletedEvent(driver, volumeName, backupName)
+		return nil
+	}
 
-	if err := driver.Remove(backup.SingleFile.FilePath); err != nil {
+	if !backup.SingleFile.Inline {
+		if err := driver.Remove(backup.SingleFile.FilePath); err != nil {
+			return err
+		}
+	}
+
+	if err := removeBackup(backup, driver); err != nil {
 		return err
 	}
+	emitBackupDeletedEvent(driver, volumeName, backupName)
+	return nil
+}
 
-	return removeBackup(backup, driver)
+// inlineSingleFile stores the file in the backup config if it's not larger than SINGLE_FILE_INLINE_DATA_LIMIT
+func inlineSingleFile(backup *Backup, filePath string) (bool, error) {
+	st, err := os.Stat(filePath)
+	if err != nil {
+		return false, err
+	}
+	if st.Size() > SINGLE_FILE_INLINE_DATA_LIMIT {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return false, err
+	}
+	compressed, err := util.CompressData(backup.CompressionMethod, data)
+	if err != nil {
+		return false, err
+	}
+	var buffer bytes.Buffer
+	if _, err := buffer.ReadFrom(compressed); err != nil {
+		return false, err
+	}
+
+	backup.SingleFile.Inline = true
+	backup.SingleFile.Data = buffer.Bytes()
+	backup.SingleFile.DataChecksum = util.GetChecksum(data)
+	backup.RequiredFeatures = addFeature(backup.RequiredFeatures, FeatureInlineData)
+	return true, nil
+}
+
+// restoreInlineSingleFile writes the file stored in the backup config to dstFile
+func restoreInlineSingleFile(backup *Backup, dstFile string) error {
+	var buffer bytes.Buffer
+	if err := util.DecompressAndVerifyInto(backup.CompressionMethod, &buffer, bytes.NewReader(backup.SingleFile.Data),
+		backup.SingleFile.DataChecksum); err != nil {
+		return fmt.Errorf("failed to restore inline data of backup %v: %v", backup.Name, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dstFile), os.ModeDir|0700); err != nil {
+		return err
+	}
+	return os.WriteFile(dstFile, buffer.Bytes(), 0600)
 }
@@ -0,0 +1,45 @@
+package backupstore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInlineSingleFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("config"), 1024)
+	filePath := filepath.Join(dir, "small")
+	assert.NoError(os.WriteFile(filePath, data, 0600))
+
+	backup := &Backup{Name: "backup-1", CompressionMethod: "lz4"}
+	inline, err := inlineSingleFile(backup, filePath)
+	assert.NoError(err)
+	assert.True(inline)
+	assert.True(backup.SingleFile.Inline)
+	assert.Less(len(backup.SingleFile.Data), len(data))
+	assert.Equal([]string{FeatureInlineData}, backup.RequiredFeatures)
+	assert.NoError(checkBackupFeatures(backup))
+
+	dstFile := filepath.Join(dir, "restore", "small.bak")
+	assert.NoError(restoreInlineSingleFile(backup, dstFile))
+	restored, err := os.ReadFile(dstFile)
+	assert.NoError(err)
+	assert.Equal(data, restored)
+
+	backup.SingleFile.DataChecksum = "invalid"
+	assert.Error(restoreInlineSingleFile(backup, dstFile))
+
+	largePath := filepath.Join(dir, "large")
+	assert.NoError(os.WriteFile(largePath, make([]byte, SINGLE_FILE_INLINE_DATA_LIMIT+1), 0600))
+	backup = &Backup{Name: "backup-2", CompressionMethod: "lz4"}
+	inline, err = inlineSingleFile(backup, largePath)
+	assert.NoError(err)
+	assert.False(inline)
+	assert.Empty(backup.SingleFile.Data)
+}
@@ -0,0 +1,111 @@
+package staging
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/longhorn/backupstore"
+	_ "github.com/longhorn/backupstore/local"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "staging"})
+)
+
+// BackupStoreDriver writes the backups to a local staging directory in the default layout, so the directory
+// can be carried to an air-gapped backup target and synced to it by Sync later
+type BackupStoreDriver struct {
+	backupstore.BackupStoreDriver
+
+	destURL string
+}
+
+const (
+	KIND = "staging"
+)
+
+func init() {
+	if err := backupstore.RegisterDriver(KIND, initFunc); err != nil {
+		panic(err)
+	}
+}
+
+func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != KIND {
+		return nil, fmt.Errorf("BUG: Why dispatch %v to %v?", u.Scheme, KIND)
+	}
+
+	if u.Host != "" {
+		return nil, fmt.Errorf("staging path must follow: %v:///path/ format", KIND)
+	}
+	if u.Path == "" {
+		return nil, fmt.Errorf("cannot find staging path")
+	}
+
+	// the staging directory is created on the first use
+	if err := os.MkdirAll(u.Path, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create staging directory %v", u.Path)
+	}
+	driver, err := backupstore.GetBackupStoreDriver("local://" + u.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &BackupStoreDriver{
+		BackupStoreDriver: driver,
+		destURL:           KIND + "://" + u.Path,
+	}
+	log.Infof("Loaded driver for %v", b.destURL)
+	return b, nil
+}
+
+func (s *BackupStoreDriver) Kind() string {
+	return KIND
+}
+
+func (s *BackupStoreDriver) GetURL() string {
+	return s.destURL
+}
+
+// Sync copies the completed backups in the staging directory to the backup target destURL, from the oldest
+// to the newest of each volume so only the changed blocks are copied. The backups already in the backup target
+// are skipped, so the sync can be resumed after a failure. The staging directory is kept as is.
+func Sync(stagingDir, destURL string) error {
+	stagingURL := KIND + "://" + stagingDir
+	volumes, err := backupstore.List("", stagingURL, true)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list staged volumes in %v", stagingDir)
+	}
+
+	volumeNames := make([]string, 0, len(volumes))
+	for name := range volumes {
+		volumeNames = append(volumeNames, name)
+	}
+	sort.Strings(volumeNames)
+
+	for _, volumeName := range volumeNames {
+		backups, err := backupstore.ListBackupsBetween(backupstore.EncodeBackupURL("", volumeName, stagingURL),
+			time.Time{}, time.Time{})
+		if err != nil {
+			return errors.Wrapf(err, "failed to list staged backups of volume %v", volumeName)
+		}
+		for _, backup := range backups {
+			if _, err := backupstore.CopyBackup(backup.URL, destURL); err != nil {
+				return errors.Wrapf(err, "failed to sync staged backup %v of volume %v", backup.Name, volumeName)
+			}
+		}
+		log.Infof("Synced %v staged backups of volume %v to %v", len(backups), volumeName, destURL)
+	}
+	return nil
+}
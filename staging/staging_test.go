@@ -0,0 +1,46 @@
+package staging
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore"
+	"github.com/longhorn/backupstore/memory"
+)
+
+func TestSync(t *testing.T) {
+	assert := assert.New(t)
+
+	stagingDir := filepath.Join(t.TempDir(), "staging")
+	destURL := "memory://test-staging"
+	defer memory.Reset(destURL)
+
+	// the file is larger than the inline data limit, so it's stored in a separate object
+	data := bytes.Repeat([]byte("snapshot data"), backupstore.SINGLE_FILE_INLINE_DATA_LIMIT/8)
+	src := filepath.Join(t.TempDir(), "snapshot")
+	assert.NoError(os.WriteFile(src, data, 0600))
+
+	backupURL, err := backupstore.CreateSingleFileBackup(
+		&backupstore.Volume{Name: "vol", Size: 4096, CreatedTime: "2023-01-01T00:00:00Z", CompressionMethod: "lz4"},
+		&backupstore.Snapshot{Name: "snap", CreatedTime: "2023-01-01T00:00:00Z"},
+		src, KIND+"://"+stagingDir)
+	assert.NoError(err)
+
+	assert.NoError(Sync(stagingDir, destURL))
+
+	backupName, volumeName, _, err := backupstore.DecodeBackupURL(backupURL)
+	assert.NoError(err)
+	restored, err := backupstore.RestoreSingleFileBackup(backupstore.EncodeBackupURL(backupName, volumeName, destURL), t.TempDir())
+	assert.NoError(err)
+	restoredData, err := os.ReadFile(restored)
+	assert.NoError(err)
+	assert.Equal(data, restoredData)
+
+	// the staged backups are kept
+	_, err = backupstore.InspectBackup(backupURL)
+	assert.NoError(err)
+}
@@ -0,0 +1,161 @@
+package backupstore
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	TARGET_CONFIG_FILE = "target.cfg"
+)
+
+// TargetConfig is the default settings recorded in the backup target, which are read by all the clients when
+// the backup target is registered, so the clusters sharing the backup target converge on the same settings.
+// The settings specified by the callers take precedence, and the zero values leave the settings unchanged.
+type TargetConfig struct {
+	// CompressionMethod is taken by the new volumes without a compression method instead of the recommended one
+	CompressionMethod string `json:",omitempty"`
+	// BlockSize must be DEFAULT_BLOCK_SIZE if specified, the blocks of all the backups share the same size
+	BlockSize int64 `json:",string,omitempty"`
+	// ConcurrentLimit is the number of the backup workers if the backup config doesn't specify it
+	ConcurrentLimit int32 `json:",omitempty"`
+	// RestoreConcurrentLimit is the number of the restore workers if the restore config doesn't specify it
+	RestoreConcurrentLimit int32 `json:",omitempty"`
+	// DefaultQuota is the retention of the backup volumes without a quota
+	DefaultQuota *VolumeQuota `json:",omitempty"`
+	// BlockLayout is taken by the new volumes without a block layout instead of the layout of the backup target
+	BlockLayout *BlockLayout `json:",omitempty"`
+	// KeyLayout names the backup configs and the blocks, it cannot be changed once there are backup volumes
+	KeyLayout *KeyLayout `json:",omitempty"`
+}
+
+var (
+	targetConfigsLock sync.RWMutex
+	// targetConfigs caches the config of the backup targets by the driver URL
+	targetConfigs = map[string]*TargetConfig{}
+)
+
+// Validate checks if the settings are supported
+func (c *TargetConfig) Validate() error {
+	if c.CompressionMethod != "" {
+		if _, err := util.GetCompressor(c.CompressionMethod); err != nil {
+			return err
+		}
+	}
+	if c.BlockSize != 0 && c.BlockSize != DEFAULT_BLOCK_SIZE {
+		return fmt.Errorf("unsupported block size %v, only %v is supported", c.BlockSize, DEFAULT_BLOCK_SIZE)
+	}
+	if c.ConcurrentLimit < 0 || c.RestoreConcurrentLimit < 0 {
+		return fmt.Errorf("invalid negative concurrent limit in %+v", *c)
+	}
+	if c.DefaultQuota != nil && (c.DefaultQuota.MaxBytes < 0 || c.DefaultQuota.MaxBackupCount < 0) {
+		return fmt.Errorf("invalid negative quota %+v", *c.DefaultQuota)
+	}
+	if c.BlockLayout != nil {
+		if err := c.BlockLayout.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.KeyLayout != nil {
+		if err := c.KeyLayout.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getTargetConfigPath() string {
+	return filepath.Join(backupstoreBase, TARGET_CONFIG_FILE)
+}
+
+// getTargetConfig returns the config of the backup target, an empty config is used
+// if no config has been recorded in the backupstore
+func getTargetConfig(driver BackupStoreDriver) *TargetConfig {
+	targetConfigsLock.RLock()
+	defer targetConfigsLock.RUnlock()
+	if config, ok := targetConfigs[driver.GetURL()]; ok {
+		return config
+	}
+	return &TargetConfig{}
+}
+
+func loadTargetConfigFile(driver BackupStoreDriver) (*TargetConfig, error) {
+	config := &TargetConfig{}
+	if !driver.FileExists(getTargetConfigPath()) {
+		return config, nil
+	}
+	if err := LoadConfigInBackupStore(driver, getTargetConfigPath(), config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// loadTargetConfig reads the config recorded in the backupstore and caches it for the backups and restores
+func loadTargetConfig(driver BackupStoreDriver) error {
+	config, err := loadTargetConfigFile(driver)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load backup target config of %v", driver.GetURL())
+	}
+	if err := config.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid backup target config of %v", driver.GetURL())
+	}
+	if err := setKeyNaming(driver, config.KeyLayout); err != nil {
+		return err
+	}
+
+	targetConfigsLock.Lock()
+	defer targetConfigsLock.Unlock()
+	targetConfigs[driver.GetURL()] = config
+	return nil
+}
+
+// GetTargetConfig returns the config recorded in the backup target
+func GetTargetConfig(destURL string) (*TargetConfig, error) {
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	return loadTargetConfigFile(driver)
+}
+
+// SetTargetConfig records the config of the backup target, which takes effect on the clients once they
+// register the backup target again. The config is removed if config is nil.
+func SetTargetConfig(destURL string, config *TargetConfig) error {
+	if config == nil {
+		config = &TargetConfig{}
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	driver, err := GetBackupStoreDriver(destURL)
+	if err != nil {
+		return err
+	}
+	if err := checkKeyLayoutChange(driver, config.KeyLayout); err != nil {
+		return err
+	}
+	if *config == (TargetConfig{}) {
+		if driver.FileExists(getTargetConfigPath()) {
+			if err := driver.Remove(getTargetConfigPath()); err != nil {
+				return err
+			}
+		}
+	} else if err := SaveConfigInBackupStore(driver, getTargetConfigPath(), config); err != nil {
+		return err
+	}
+	if err := setKeyNaming(driver, config.KeyLayout); err != nil {
+		return err
+	}
+
+	targetConfigsLock.Lock()
+	defer targetConfigsLock.Unlock()
+	targetConfigs[driver.GetURL()] = config
+	log.Infof("Set backup target config of %v to %+v", driver.GetURL(), *config)
+	return nil
+}
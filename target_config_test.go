@@ -0,0 +1,76 @@
+package backupstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&TargetConfig{}).Validate())
+	assert.NoError((&TargetConfig{
+		CompressionMethod:      "lz4",
+		BlockSize:              DEFAULT_BLOCK_SIZE,
+		ConcurrentLimit:        4,
+		RestoreConcurrentLimit: 8,
+		DefaultQuota:           &VolumeQuota{MaxBackupCount: 10, AutoPrune: true},
+	}).Validate())
+
+	assert.Error((&TargetConfig{CompressionMethod: "unknown"}).Validate())
+	assert.Error((&TargetConfig{BlockSize: 4096}).Validate())
+	assert.Error((&TargetConfig{ConcurrentLimit: -1}).Validate())
+	assert.Error((&TargetConfig{DefaultQuota: &VolumeQuota{MaxBytes: -1}}).Validate())
+}
+
+func TestSetTargetConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	mock := &mockStoreDriver{}
+	m := &writableMockStoreDriver{mock}
+	mock.Init()
+	defer mock.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m, nil
+	})
+
+	config, err := GetTargetConfig(mockDriverURL)
+	assert.NoError(err)
+	assert.Equal(&TargetConfig{}, config)
+	assert.Equal(&TargetConfig{}, getTargetConfig(m))
+
+	assert.Error(SetTargetConfig(mockDriverURL, &TargetConfig{CompressionMethod: "unknown"}))
+	assert.False(m.FileExists(getTargetConfigPath()))
+
+	expected := &TargetConfig{
+		CompressionMethod:      "lz4",
+		ConcurrentLimit:        4,
+		RestoreConcurrentLimit: 8,
+		DefaultQuota:           &VolumeQuota{MaxBackupCount: 1},
+	}
+	assert.NoError(SetTargetConfig(mockDriverURL, expected))
+	config, err = GetTargetConfig(mockDriverURL)
+	assert.NoError(err)
+	assert.Equal(expected, config)
+
+	// the other clients read the config when registering the backup target
+	targetConfigsLock.Lock()
+	delete(targetConfigs, mockDriverURL)
+	targetConfigsLock.Unlock()
+	_, err = GetBackupStoreDriver(mockDriverURL)
+	assert.NoError(err)
+	assert.Equal(expected, getTargetConfig(m))
+
+	// the volume without a quota takes the default quota
+	assert.NoError(addVolume(m, &Volume{Name: "pvc-1"}))
+	assert.NoError(checkVolumeQuota(m, "pvc-1", nil))
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-1", VolumeName: "pvc-1", CreatedTime: "2026-01-01T00:00:00Z"}))
+	assert.True(IsQuotaExceededError(checkVolumeQuota(m, "pvc-1", nil)))
+
+	assert.NoError(SetTargetConfig(mockDriverURL, nil))
+	assert.False(m.FileExists(getTargetConfigPath()))
+	assert.Equal(&TargetConfig{}, getTargetConfig(m))
+	assert.NoError(checkVolumeQuota(m, "pvc-1", nil))
+}
@@ -0,0 +1,182 @@
+package backupstore
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+
+	"github.com/gammazero/workerpool"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+	"github.com/longhorn/backupstore/util"
+)
+
+// TargetMigrationOptions are the options of MigrateBackupTarget
+type TargetMigrationOptions struct {
+	// VolumeNames limits the migration to the backup volumes, all the volumes are migrated if empty
+	VolumeNames []string
+	// Layout is recorded in the destination before the migration, so the migrated backups are placed by the new
+	// layout. It can only be set if the destination has no backup volume yet, the layout of the destination is
+	// kept if nil
+	Layout *LayoutConfig
+	// ConcurrentLimit is the number of the blocks copied concurrently, DEFAULT_COPY_CONCURRENT_LIMIT if 0
+	ConcurrentLimit int
+	// RateLimit limits the bytes read from the source per second, no limit if 0
+	RateLimit int64
+	// Verify reads back each copied file from the destination and compares it with the source
+	Verify bool
+}
+
+// TargetMigrationReport is the result of MigrateBackupTarget
+type TargetMigrationReport struct {
+	SourceURL string
+	DestURL   string
+
+	VolumeCount int
+	// CopiedBackups are the backups copied by this run, SkippedBackups are the ones already in the destination
+	CopiedBackups  int
+	SkippedBackups int
+	CopiedBlocks   int64
+	CopiedBytes    int64
+
+	// InProgressBackups are the backups in progress in the source, which are not migrated
+	InProgressBackups []string `json:",omitempty"`
+	// Failures maps the volume or the volume/backup to the reason it cannot be migrated
+	Failures map[string]string `json:",omitempty"`
+}
+
+// MigrateBackupTarget copies all the backup volumes, backups and blocks from the backup target srcURL to dstURL,
+// which may use a different driver, e.g. to replace an NFS server with an S3 bucket. The backups of each volume are
+// copied from the oldest to the newest, and the blocks are placed by the layout of the destination, so the backups
+// can be migrated to a newer layout. The migration can be resumed by calling it again, the backups and the blocks
+// already in the destination are skipped. The failed volumes and backups are reported, and the others are still
+// migrated.
+func MigrateBackupTarget(srcURL, dstURL string, opts *TargetMigrationOptions) (*TargetMigrationReport, error) {
+	if opts == nil {
+		opts = &TargetMigrationOptions{}
+	}
+	if opts.ConcurrentLimit < 0 || opts.RateLimit < 0 {
+		return nil, fmt.Errorf("invalid negative concurrent limit %v or rate limit %v", opts.ConcurrentLimit, opts.RateLimit)
+	}
+
+	srcDriver, err := GetBackupStoreDriver(srcURL)
+	if err != nil {
+		return nil, err
+	}
+	dstDriver, err := GetBackupStoreDriver(dstURL)
+	if err != nil {
+		return nil, err
+	}
+	if srcDriver.GetURL() == dstDriver.GetURL() {
+		return nil, fmt.Errorf("cannot migrate backup target %v to itself", srcURL)
+	}
+	if opts.Layout != nil {
+		if err := SetBackupStoreLayout(dstURL, opts.Layout); err != nil {
+			return nil, err
+		}
+	}
+
+	volumeNames := opts.VolumeNames
+	if len(volumeNames) == 0 {
+		jobQueues := workerpool.New(runtime.NumCPU() * 16)
+		volumeNames, err = getVolumeNames(jobQueues, srcDriver)
+		jobQueues.StopWait()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list backup volumes of %v", srcURL)
+		}
+	}
+	for _, volumeName := range volumeNames {
+		if !util.ValidateName(volumeName) {
+			return nil, fmt.Errorf("invalid volume name %v", volumeName)
+		}
+	}
+	sort.Strings(volumeNames)
+
+	copier := newBackupCopier(srcDriver, dstDriver)
+	if opts.ConcurrentLimit > 0 {
+		copier.concurrentLimit = opts.ConcurrentLimit
+	}
+	copier.limiter = newRateLimiter(opts.RateLimit)
+	copier.verify = opts.Verify
+
+	report := &TargetMigrationReport{
+		SourceURL: srcDriver.GetURL(),
+		DestURL:   dstDriver.GetURL(),
+		Failures:  map[string]string{},
+	}
+	for _, volumeName := range volumeNames {
+		if err := migrateVolume(copier, volumeName, report); err != nil {
+			log.WithError(err).Errorf("Failed to migrate backup volume %v to %v", volumeName, dstURL)
+			report.Failures[volumeName] = err.Error()
+		}
+	}
+	report.CopiedBlocks = copier.copiedBlocks
+	report.CopiedBytes = copier.copiedBytes
+	if len(report.Failures) == 0 {
+		report.Failures = nil
+	}
+
+	log.WithFields(logrus.Fields{
+		LogFieldDestURL: dstURL,
+	}).Infof("Migrated %v backup volumes from %v, copied %v backups and %v blocks, skipped %v backups, %v failures",
+		report.VolumeCount, srcURL, report.CopiedBackups, report.CopiedBlocks, report.SkippedBackups,
+		len(report.Failures))
+	return report, nil
+}
+
+// migrateVolume copies the completed backups of the volume from the oldest to the newest, so the blocks shared
+// with the older backups are only copied once
+func migrateVolume(copier *backupCopier, volumeName string, report *TargetMigrationReport) error {
+	// the backup lock of the source prevents the backups from being deleted while copying them
+	for _, driver := range []BackupStoreDriver{copier.srcDriver, copier.dstDriver} {
+		lock, err := New(driver, volumeName, BACKUP_LOCK)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		if err := lock.Lock(); err != nil {
+			return err
+		}
+	}
+
+	backupNames, err := getBackupNamesForVolume(copier.srcDriver, volumeName)
+	if err != nil {
+		return err
+	}
+	backups := []*Backup{}
+	for _, backupName := range backupNames {
+		backup, err := loadBackup(copier.srcDriver, backupName, volumeName)
+		if err != nil {
+			report.Failures[volumeName+"/"+backupName] = err.Error()
+			continue
+		}
+		if isBackupInProgress(backup) {
+			report.InProgressBackups = append(report.InProgressBackups, volumeName+"/"+backupName)
+			continue
+		}
+		backups = append(backups, backup)
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		if backups[i].SnapshotCreatedAt != backups[j].SnapshotCreatedAt {
+			return backups[i].SnapshotCreatedAt < backups[j].SnapshotCreatedAt
+		}
+		return backups[i].CreatedTime < backups[j].CreatedTime
+	})
+
+	report.VolumeCount++
+	for _, backup := range backups {
+		copied, err := copier.copyBackup(backup.Name, volumeName)
+		if err != nil {
+			report.Failures[volumeName+"/"+backup.Name] = err.Error()
+			continue
+		}
+		if copied {
+			report.CopiedBackups++
+		} else {
+			report.SkippedBackups++
+		}
+	}
+	return nil
+}
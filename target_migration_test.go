@@ -0,0 +1,83 @@
+package backupstore
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestMigrateVolume(t *testing.T) {
+	assert := assert.New(t)
+
+	src := &writableMockStoreDriver{&mockStoreDriver{}}
+	src.Init()
+	defer src.uninstall()
+	dst := &writableMockStoreDriver{&mockStoreDriver{}}
+	dst.Init()
+	defer dst.uninstall()
+	// the block layouts are cached by the URL of the backup target
+	dst.destURL = "mock://destination"
+
+	// the destination places the blocks of the new volumes by its block layout
+	targetConfigsLock.Lock()
+	targetConfigs[dst.GetURL()] = &TargetConfig{BlockLayout: &BlockLayout{Depth: 1, Width: 1}}
+	targetConfigsLock.Unlock()
+	defer func() {
+		targetConfigsLock.Lock()
+		delete(targetConfigs, dst.GetURL())
+		targetConfigsLock.Unlock()
+	}()
+	defer unsetVolumeBlockLayout(dst, "pvc-1")
+	defer unsetVolumeBlockLayout(src, "pvc-1")
+
+	assert.NoError(saveVolume(src, &Volume{Name: "pvc-1", Size: 4096, CompressionMethod: "lz4"}))
+	a, b, c := util.GetChecksum([]byte("a")), util.GetChecksum([]byte("b")), util.GetChecksum([]byte("c"))
+	for _, checksum := range []string{a, b, c} {
+		assert.NoError(src.Write(getBlockFilePath(src, "pvc-1", checksum), bytes.NewReader([]byte(checksum))))
+	}
+	backups := []*Backup{
+		{Name: "backup-2", SnapshotCreatedAt: "2023-01-02T00:00:00Z", Blocks: []BlockMapping{{BlockChecksum: b}, {Offset: 1, BlockChecksum: c}}},
+		{Name: "backup-1", SnapshotCreatedAt: "2023-01-01T00:00:00Z", Blocks: []BlockMapping{{BlockChecksum: a}, {Offset: 1, BlockChecksum: b}}},
+		{Name: "backup-3", SnapshotCreatedAt: "2023-01-03T00:00:00Z"},
+	}
+	for _, backup := range backups[:2] {
+		backup.VolumeName = "pvc-1"
+		backup.CompressionMethod = "lz4"
+		backup.CreatedTime = backup.SnapshotCreatedAt
+		assert.NoError(saveBackup(src, backup))
+	}
+	// the backup in progress has no created time
+	backups[2].VolumeName = "pvc-1"
+	assert.NoError(saveBackup(src, backups[2]))
+
+	copier := newBackupCopier(src, dst)
+	copier.verify = true
+	report := &TargetMigrationReport{Failures: map[string]string{}}
+	assert.NoError(migrateVolume(copier, "pvc-1", report))
+	assert.Equal(1, report.VolumeCount)
+	assert.Equal(2, report.CopiedBackups)
+	assert.Equal([]string{"pvc-1/backup-3"}, report.InProgressBackups)
+	assert.Empty(report.Failures)
+	assert.Equal(int64(3), copier.copiedBlocks)
+	assert.Equal(int64(3*len(a)), copier.copiedBytes)
+
+	v, err := loadVolume(dst, "pvc-1")
+	assert.NoError(err)
+	assert.Equal("backup-2", v.LastBackupName)
+	assert.Equal(int64(3), v.BlockCount)
+	assert.Equal(&BlockLayout{Depth: 1, Width: 1}, v.BlockLayout)
+	for _, checksum := range []string{a, b, c} {
+		assert.True(dst.FileExists(getBlockFilePath(dst, "pvc-1", checksum)))
+		assert.Equal(getBlockPath(dst, "pvc-1")+v.BlockLayout.BlockPath(checksum), getBlockFilePath(dst, "pvc-1", checksum))
+	}
+
+	// the migration is resumed by skipping the backups already copied
+	report = &TargetMigrationReport{Failures: map[string]string{}}
+	assert.NoError(migrateVolume(copier, "pvc-1", report))
+	assert.Equal(0, report.CopiedBackups)
+	assert.Equal(2, report.SkippedBackups)
+	assert.Equal(int64(3), copier.copiedBlocks)
+}
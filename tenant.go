@@ -0,0 +1,58 @@
+package backupstore
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+// GetTenantURL returns the backup target URL of the tenant under the base URL, e.g. s3://bucket@region/prefix/
+// and tenantA give s3://bucket@region/prefix/tenantA/. The object store drivers never reach the objects outside
+// of the path of the backup target, so the tenants can share a bucket.
+func GetTenantURL(baseURL, tenant string) (string, error) {
+	if !util.ValidateName(tenant) {
+		return "", fmt.Errorf("invalid tenant name %v", tenant)
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = path.Join("/", u.Path, tenant) + "/"
+	return u.String(), nil
+}
+
+// ListTenants returns the tenants under the base URL, which are the directories holding a backupstore
+func ListTenants(baseURL string) ([]string, error) {
+	driver, err := GetBackupStoreDriver(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := driver.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := []string{}
+	for _, entry := range entries {
+		entry = strings.TrimSuffix(entry, "/")
+		if entry == backupstoreBase || !util.ValidateName(entry) {
+			continue
+		}
+		subEntries, err := driver.List(entry)
+		if err != nil {
+			return nil, err
+		}
+		for _, subEntry := range subEntries {
+			if strings.TrimSuffix(subEntry, "/") == backupstoreBase {
+				tenants = append(tenants, entry)
+				break
+			}
+		}
+	}
+	sort.Strings(tenants)
+	return tenants, nil
+}
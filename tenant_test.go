@@ -0,0 +1,31 @@
+package backupstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenants(t *testing.T) {
+	assert := assert.New(t)
+
+	tenantURL, err := GetTenantURL("s3://bucket@us-east-1/prefix/", "tenantA")
+	assert.NoError(err)
+	assert.Equal("s3://bucket@us-east-1/prefix/tenantA/", tenantURL)
+	tenantURL, err = GetTenantURL("s3://bucket@us-east-1/", "tenantA")
+	assert.NoError(err)
+	assert.Equal("s3://bucket@us-east-1/tenantA/", tenantURL)
+	_, err = GetTenantURL("s3://bucket@us-east-1/prefix/", "../tenantB")
+	assert.Error(err)
+
+	m := &mockStoreDriver{}
+	m.Init()
+	defer m.uninstall()
+
+	for _, dir := range []string{"tenantA/backupstore", "tenantB/backupstore/volumes", "other/data"} {
+		assert.NoError(m.fs.MkdirAll(dir, 0755))
+	}
+	tenants, err := ListTenants(mockDriverURL)
+	assert.NoError(err)
+	assert.Equal([]string{"tenantA", "tenantB"}, tenants)
+}
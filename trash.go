@@ -0,0 +1,295 @@
+package backupstore
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	// TRASH_DIRECTORY keeps the configs of the soft deleted backups of the volume
+	TRASH_DIRECTORY = ".trash"
+)
+
+var (
+	backupTrashRetentionLock sync.RWMutex
+	backupTrashRetention     time.Duration
+)
+
+// SetBackupTrashRetention enables the soft deletion of the backups if the retention is positive. The deleted
+// backups are moved to the trash of the volume instead of being removed, and their blocks are kept until the
+// trash is purged by PurgeTrash after the retention. A zero retention disables the soft deletion.
+func SetBackupTrashRetention(retention time.Duration) {
+	backupTrashRetentionLock.Lock()
+	defer backupTrashRetentionLock.Unlock()
+	backupTrashRetention = retention
+}
+
+// GetBackupTrashRetention returns how long the soft deleted backups are kept in the trash
+func GetBackupTrashRetention() time.Duration {
+	backupTrashRetentionLock.RLock()
+	defer backupTrashRetentionLock.RUnlock()
+	return backupTrashRetention
+}
+
+func isBackupTrashEnabled(opts *DeleteOptions) bool {
+	return GetBackupTrashRetention() > 0 && (opts == nil || !opts.SkipTrash)
+}
+
+// TrashedBackup is the soft deleted backup in the trash
+type TrashedBackup struct {
+	Name       string
+	VolumeName string
+	// TrashedAt is when the backup was moved to the trash
+	TrashedAt string
+	// ExpiresAt is when the backup can be purged by PurgeTrash with the current retention
+	ExpiresAt string
+}
+
+func getTrashPath(driver BackupStoreDriver, volumeName string) string {
+	return filepath.Join(getVolumePath(driver, volumeName), TRASH_DIRECTORY) + "/"
+}
+
+func getTrashedBackupConfigPath(driver BackupStoreDriver, backupName, volumeName string) string {
+	return filepath.Join(getTrashPath(driver, volumeName), getBackupConfigName(driver, backupName))
+}
+
+func getTrashedBackupNamesForVolume(driver BackupStoreDriver, volumeName string) ([]string, error) {
+	fileList, err := driver.List(getTrashPath(driver, volumeName))
+	if err != nil {
+		// path doesn't exist
+		return []string{}, nil
+	}
+	naming := getKeyNaming(driver)
+	return util.ExtractNames(fileList, naming.backupPrefix, naming.backupSuffix), nil
+}
+
+func loadTrashedBackup(bsDriver BackupStoreDriver, backupName, volumeName string) (*Backup, error) {
+	backup := &Backup{}
+	if err := LoadConfigInBackupStore(bsDriver, getTrashedBackupConfigPath(bsDriver, backupName, volumeName), &backupConfig{Backup: backup}); err != nil {
+		return nil, err
+	}
+	if backup.CompressionMethod == "" {
+		backup.CompressionMethod = LEGACY_COMPRESSION_METHOD
+	}
+	return backup, nil
+}
+
+// trashBackup moves the backup config to the trash, the blocks or the file of the backup are kept
+func trashBackup(bsDriver BackupStoreDriver, backup *Backup) error {
+	backup.TrashedAt = util.Now()
+	filePath := getTrashedBackupConfigPath(bsDriver, backup.Name, backup.VolumeName)
+	if err := saveConfigInBackupStore(bsDriver, filePath, newBackupConfig(backup, IsBackupBlockIndexEnabled()), GetMetadataCompressionMethod()); err != nil {
+		return errors.Wrapf(err, "failed to move backup %v to trash", backup.Name)
+	}
+	return removeBackup(backup, bsDriver)
+}
+
+// addTrashedBlockReferences counts the blocks referenced by the backups in the trash, so they are not garbage
+// collected before the trash is purged
+func addTrashedBlockReferences(bsDriver BackupStoreDriver, blockInfos map[string]*BlockInfo, volumeName string) error {
+	backupNames, err := getTrashedBackupNamesForVolume(bsDriver, volumeName)
+	if err != nil {
+		return err
+	}
+	for _, backupName := range backupNames {
+		backup, err := loadTrashedBackup(bsDriver, backupName, volumeName)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load trashed backup %v", backupName)
+		}
+		checkBlockReferenceCount(blockInfos, backup, volumeName, bsDriver)
+	}
+	return nil
+}
+
+// ListTrashedBackups returns the soft deleted backups of the volume
+func ListTrashedBackups(volumeURL string) ([]*TrashedBackup, error) {
+	bsDriver, err := GetBackupStoreDriver(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	_, volumeName, _, err := DecodeBackupURL(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+
+	backupNames, err := getTrashedBackupNamesForVolume(bsDriver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(backupNames)
+
+	retention := GetBackupTrashRetention()
+	trashed := []*TrashedBackup{}
+	for _, backupName := range backupNames {
+		backup, err := loadTrashedBackup(bsDriver, backupName, volumeName)
+		if err != nil {
+			return nil, err
+		}
+		info := &TrashedBackup{
+			Name:       backup.Name,
+			VolumeName: backup.VolumeName,
+			TrashedAt:  backup.TrashedAt,
+		}
+		if trashedAt, err := time.Parse(time.RFC3339, backup.TrashedAt); err == nil {
+			info.ExpiresAt = trashedAt.Add(retention).UTC().Format(time.RFC3339)
+		}
+		trashed = append(trashed, info)
+	}
+	return trashed, nil
+}
+
+// RestoreFromTrash moves the soft deleted backup back to the backups of the volume. The next backup of the
+// volume is based on the restored backup if it's the latest one.
+func RestoreFromTrash(backupURL string) error {
+	bsDriver, err := GetBackupStoreDriver(backupURL)
+	if err != nil {
+		return err
+	}
+	backupName, volumeName, _, err := DecodeBackupURL(backupURL)
+	if err != nil {
+		return err
+	}
+	if backupName == "" {
+		return fmt.Errorf("missing backup name in %v", backupURL)
+	}
+
+	// prevent racing with the deletion and the trash purge
+	lock, err := New(bsDriver, volumeName, DELETION_LOCK)
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	trashedFile := getTrashedBackupConfigPath(bsDriver, backupName, volumeName)
+	if !bsDriver.FileExists(trashedFile) {
+		return fmt.Errorf("cannot find backup %v of volume %v in trash", backupName, volumeName)
+	}
+	if bsDriver.FileExists(getBackupConfigPath(bsDriver, backupName, volumeName)) {
+		return fmt.Errorf("backup %v of volume %v already exists", backupName, volumeName)
+	}
+	backup, err := loadTrashedBackup(bsDriver, backupName, volumeName)
+	if err != nil {
+		return err
+	}
+
+	backup.TrashedAt = ""
+	if err := saveBackup(bsDriver, backup); err != nil {
+		return err
+	}
+	if err := bsDriver.Remove(trashedFile); err != nil {
+		return err
+	}
+
+	if backup.SingleFile.FilePath == "" && backup.Broken == "" {
+		if _, err := updateVolume(bsDriver, volumeName, func(v *Volume) error {
+			lastBackup := &Backup{Name: v.LastBackupName, SnapshotCreatedAt: v.LastBackupAt}
+			if err := getLatestBackup(backup, lastBackup); err != nil {
+				return err
+			}
+			v.LastBackupName = lastBackup.Name
+			v.LastBackupAt = lastBackup.SnapshotCreatedAt
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		LogFieldBackup: backupName,
+		LogFieldVolume: volumeName,
+	}).Info("Restored backup from trash")
+	return nil
+}
+
+// PurgeTrash removes the soft deleted backups of the volume kept longer than the retention, or all of them if
+// all is set, and garbage collects the blocks no longer referenced. It returns the names of the purged backups.
+func PurgeTrash(volumeURL string, all bool) ([]string, error) {
+	bsDriver, err := GetBackupStoreDriver(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	_, volumeName, _, err := DecodeBackupURL(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := New(bsDriver, volumeName, DELETION_LOCK)
+	if err != nil {
+		return nil, err
+	}
+	if err := lock.Lock(); err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	return purgeTrash(bsDriver, volumeName, all, time.Now())
+}
+
+// purgeTrash removes the expired backups in the trash, the caller should hold the lock
+func purgeTrash(bsDriver BackupStoreDriver, volumeName string, all bool, now time.Time) ([]string, error) {
+	log := log.WithFields(logrus.Fields{
+		LogFieldVolume: volumeName,
+	})
+
+	if err := checkVolumeOwnershipInBackupStore(bsDriver, volumeName, false); err != nil {
+		return nil, err
+	}
+
+	backupNames, err := getTrashedBackupNamesForVolume(bsDriver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(backupNames)
+
+	retention := GetBackupTrashRetention()
+	purged := []string{}
+	for _, backupName := range backupNames {
+		backup, err := loadTrashedBackup(bsDriver, backupName, volumeName)
+		if err != nil {
+			return purged, err
+		}
+		if !all {
+			trashedAt, err := time.Parse(time.RFC3339, backup.TrashedAt)
+			if err != nil {
+				log.WithError(err).Warnf("Cannot parse trashed time of backup %v, keep it in trash", backupName)
+				continue
+			}
+			if now.Before(trashedAt.Add(retention)) {
+				continue
+			}
+		}
+
+		if backup.SingleFile.FilePath != "" && !backup.SingleFile.Inline {
+			if err := bsDriver.Remove(backup.SingleFile.FilePath); err != nil {
+				return purged, err
+			}
+		}
+		if err := bsDriver.Remove(getTrashedBackupConfigPath(bsDriver, backupName, volumeName)); err != nil {
+			return purged, err
+		}
+		removeBackupProvenance(bsDriver, backupName, volumeName)
+		log.WithField(LogFieldBackup, backupName).Info("Purged backup from trash")
+		purged = append(purged, backupName)
+	}
+
+	if len(purged) == 0 {
+		return purged, nil
+	}
+	// the blocks only referenced by the purged backups are garbage collected
+	if err := deleteDeltaBlockBackups(bsDriver, nil, volumeName, &DeleteOptions{SkipTrash: true}); err != nil {
+		return purged, err
+	}
+	return purged, nil
+}
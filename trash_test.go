@@ -0,0 +1,96 @@
+package backupstore
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestBackupTrash(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		m.fs.MkdirAll(filepath.Join(backupstoreBase, VOLUME_DIRECTORY), 0755)
+		return m, nil
+	})
+
+	SetBackupTrashRetention(time.Hour)
+	defer SetBackupTrashRetention(0)
+
+	assert.NoError(saveVolume(m, &Volume{Name: "pvc-1", LastBackupName: "backup-1"}))
+	a, b := util.GetChecksum([]byte("a")), util.GetChecksum([]byte("b"))
+	for _, checksum := range []string{a, b} {
+		assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", checksum), bytes.NewReader([]byte(checksum))))
+	}
+	backups := []*Backup{
+		{Name: "backup-0", Blocks: []BlockMapping{{BlockChecksum: a}}},
+		{Name: "backup-1", Blocks: []BlockMapping{{BlockChecksum: a}, {BlockChecksum: b}}},
+	}
+	for i, backup := range backups {
+		backup.VolumeName = "pvc-1"
+		backup.CreatedTime = "2023-01-01T00:00:00Z"
+		backup.SnapshotCreatedAt = time.Date(2023, 1, 1, i, 0, 0, 0, time.UTC).Format(time.RFC3339)
+		assert.NoError(saveBackup(m, backup))
+	}
+
+	// the deleted backup is moved to the trash and its blocks are kept
+	assert.NoError(deleteDeltaBlockBackup(m, "backup-1", "pvc-1", nil))
+	names, err := getBackupNamesForVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal([]string{"backup-0"}, names)
+	blocks, err := getBlockNamesForVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.ElementsMatch([]string{a, b}, blocks)
+	volume, err := loadVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal("backup-0", volume.LastBackupName)
+
+	volumeURL := EncodeBackupURL("", "pvc-1", mockDriverURL)
+	trashed, err := ListTrashedBackups(volumeURL)
+	assert.NoError(err)
+	assert.Len(trashed, 1)
+	assert.Equal("backup-1", trashed[0].Name)
+	assert.NotEmpty(trashed[0].ExpiresAt)
+
+	// the backup within the retention isn't purged
+	purged, err := PurgeTrash(volumeURL, false)
+	assert.NoError(err)
+	assert.Empty(purged)
+
+	// the restored backup is the base of the next backup again
+	assert.NoError(RestoreFromTrash(EncodeBackupURL("backup-1", "pvc-1", mockDriverURL)))
+	assert.Error(RestoreFromTrash(EncodeBackupURL("backup-1", "pvc-1", mockDriverURL)))
+	backup, err := loadBackup(m, "backup-1", "pvc-1")
+	assert.NoError(err)
+	assert.Empty(backup.TrashedAt)
+	volume, err = loadVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal("backup-1", volume.LastBackupName)
+
+	// the expired backup is purged with the blocks only it references
+	assert.NoError(deleteDeltaBlockBackup(m, "backup-1", "pvc-1", nil))
+	purged, err = purgeTrash(m, "pvc-1", false, time.Now().Add(2*time.Hour))
+	assert.NoError(err)
+	assert.Equal([]string{"backup-1"}, purged)
+	blocks, err = getBlockNamesForVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal([]string{a}, blocks)
+
+	// the backup is removed right away when skipping the trash
+	assert.NoError(deleteDeltaBlockBackup(m, "backup-0", "pvc-1", &DeleteOptions{SkipTrash: true}))
+	trashed, err = ListTrashedBackups(volumeURL)
+	assert.NoError(err)
+	assert.Empty(trashed)
+	blocks, err = getBlockNamesForVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Empty(blocks)
+}
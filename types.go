@@ -11,6 +11,8 @@ const (
 
 	PROGRESS_PERCENTAGE_BACKUP_SNAPSHOT = 95
 	PROGRESS_PERCENTAGE_BACKUP_TOTAL    = 100
+
+	DEFAULT_MAX_CONCURRENT_LIMIT_FACTOR = 4
 )
 
 type BackendStoreDriver string
@@ -13,14 +13,26 @@ const (
 	AWSSecretKey = "AWS_SECRET_ACCESS_KEY"
 	AWSEndPoint  = "AWS_ENDPOINTS"
 	AWSCert      = "AWS_CERT"
+	// AWSSessionToken is only used with the temporary credentials, e.g. AWS STS
+	AWSSessionToken = "AWS_SESSION_TOKEN"
 
 	CIFSUsername = "CIFS_USERNAME"
 	CIFSPassword = "CIFS_PASSWORD"
 
+	// NFSSecurity is the Kerberos security flavor of the NFS mount, one of krb5, krb5i and krb5p
+	NFSSecurity = "NFS_SEC"
+	// NFSKrb5Principal and NFSKrb5Keytab are used to obtain and refresh the Kerberos ticket
+	NFSKrb5Principal = "NFS_KRB5_PRINCIPAL"
+	NFSKrb5Keytab    = "NFS_KRB5_KEYTAB"
+	// NFSKrb5CCache is the credential cache of the Kerberos ticket, the default cache is used if empty
+	NFSKrb5CCache = "NFS_KRB5_CCACHE"
+
 	AZBlobAccountName = "AZBLOB_ACCOUNT_NAME"
 	AZBlobAccountKey  = "AZBLOB_ACCOUNT_KEY"
 	AZBlobEndpoint    = "AZBLOB_ENDPOINT"
 	AZBlobCert        = "AZBLOB_CERT"
+	// AZBlobSASToken is used instead of the account key if specified
+	AZBlobSASToken = "AZBLOB_SAS_TOKEN"
 
 	HTTPSProxy = "HTTPS_PROXY"
 	HTTPProxy  = "HTTP_PROXY"
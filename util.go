@@ -6,17 +6,14 @@ import (
 	"sync"
 )
 
-func getBlockPath(volumeName string) string {
-	return filepath.Join(getVolumePath(volumeName), BLOCKS_DIRECTORY) + "/"
+func getBlockPath(driver BackupStoreDriver, volumeName string) string {
+	return filepath.Join(getVolumePath(driver, volumeName), BLOCKS_DIRECTORY) + "/"
 }
 
-func getBlockFilePath(volumeName, checksum string) string {
-	blockSubDirLayer1 := checksum[0:BLOCK_SEPARATE_LAYER1]
-	blockSubDirLayer2 := checksum[BLOCK_SEPARATE_LAYER1:BLOCK_SEPARATE_LAYER2]
-	path := filepath.Join(getBlockPath(volumeName), blockSubDirLayer1, blockSubDirLayer2)
-	fileName := checksum + BLK_SUFFIX
-
-	return filepath.Join(path, fileName)
+func getBlockFilePath(driver BackupStoreDriver, volumeName, checksum string) string {
+	blockPath := getVolumeBlockLayout(driver, volumeName).BlockPath(checksum)
+	// the block file is named by the key layout of the backup target
+	return filepath.Join(getBlockPath(driver, volumeName), filepath.Dir(blockPath), getKeyNaming(driver).blockFileName(checksum))
 }
 
 // mergeErrorChannels will merge all error channels into a single error out channel.
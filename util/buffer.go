@@ -0,0 +1,209 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// BufferPool pools the buffers of the same size class, so the buffers can be shared by the stages
+// of a pipeline instead of allocating new ones for each block.
+type BufferPool struct {
+	pool sync.Pool
+	size int
+
+	gets      int64
+	misses    int64
+	inUse     int64
+	peakInUse int64
+}
+
+// BufferPoolStats is the usage of the buffer pool
+type BufferPoolStats struct {
+	Gets    int64
+	Hits    int64
+	HitRate float64
+	// InUseBytes and PeakInUseBytes are estimated by the number of the buffers taken from the pool
+	InUseBytes     int64
+	PeakInUseBytes int64
+}
+
+// NewBufferPool creates a buffer pool, the buffers returned by Get can hold at least size bytes without growing
+func NewBufferPool(size int) *BufferPool {
+	p := &BufferPool{size: size}
+	p.pool.New = func() interface{} {
+		atomic.AddInt64(&p.misses, 1)
+		return bytes.NewBuffer(make([]byte, 0, size))
+	}
+	return p
+}
+
+// Get returns an empty buffer, it should be returned with Put once unused
+func (p *BufferPool) Get() *bytes.Buffer {
+	atomic.AddInt64(&p.gets, 1)
+	inUse := atomic.AddInt64(&p.inUse, 1)
+	for {
+		peak := atomic.LoadInt64(&p.peakInUse)
+		if inUse <= peak || atomic.CompareAndSwapInt64(&p.peakInUse, peak, inUse) {
+			break
+		}
+	}
+
+	buf := p.pool.Get().(*bytes.Buffer)
+	buf.Reset()
+	buf.Grow(p.size)
+	return buf
+}
+
+// Put returns the buffer to the pool, the buffer must not be used afterwards
+func (p *BufferPool) Put(buf *bytes.Buffer) {
+	if buf == nil {
+		return
+	}
+	atomic.AddInt64(&p.inUse, -1)
+	p.pool.Put(buf)
+}
+
+// Stats returns the usage of the buffer pool
+func (p *BufferPool) Stats() BufferPoolStats {
+	gets := atomic.LoadInt64(&p.gets)
+	hits := gets - atomic.LoadInt64(&p.misses)
+	if hits < 0 {
+		hits = 0
+	}
+	stats := BufferPoolStats{
+		Gets:           gets,
+		Hits:           hits,
+		InUseBytes:     atomic.LoadInt64(&p.inUse) * int64(p.size),
+		PeakInUseBytes: atomic.LoadInt64(&p.peakInUse) * int64(p.size),
+	}
+	if gets > 0 {
+		stats.HitRate = float64(hits) / float64(gets)
+	}
+	return stats
+}
+
+// MemoryBudget caps the bytes of the buffers reserved by an operation, e.g. the buffers of a backup taken from
+// the pool, and records the high-water mark of the reserved bytes. The operation reserves the bytes before taking
+// the buffers, and releases them once the buffers are returned. The nil budget doesn't reserve anything.
+type MemoryBudget struct {
+	lock     sync.Mutex
+	limit    int64
+	reserved int64
+	peak     int64
+	// released is closed and replaced whenever the bytes are released, so Reserve can wait for it
+	released chan struct{}
+}
+
+// NewMemoryBudget creates a memory budget of limit bytes, the budget only records the high-water mark if limit
+// is 0
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{
+		limit:    limit,
+		released: make(chan struct{}),
+	}
+}
+
+// Reserve reserves n bytes, it blocks until the other reservations are released if the budget doesn't have room,
+// and fails if the context is done or n bytes never fit into the budget
+func (b *MemoryBudget) Reserve(ctx context.Context, n int64) error {
+	if b == nil {
+		return nil
+	}
+	if b.limit > 0 && n > b.limit {
+		return fmt.Errorf("cannot reserve %v bytes in memory budget of %v bytes", n, b.limit)
+	}
+	for {
+		b.lock.Lock()
+		if b.limit <= 0 || b.reserved+n <= b.limit {
+			b.reserved += n
+			if b.reserved > b.peak {
+				b.peak = b.reserved
+			}
+			b.lock.Unlock()
+			return nil
+		}
+		released := b.released
+		b.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+// Release releases n bytes reserved before
+func (b *MemoryBudget) Release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.reserved -= n
+	close(b.released)
+	b.released = make(chan struct{})
+}
+
+// Limit returns the limit of the budget, 0 if unlimited
+func (b *MemoryBudget) Limit() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.limit
+}
+
+// PeakBytes returns the high-water mark of the reserved bytes
+func (b *MemoryBudget) PeakBytes() int64 {
+	if b == nil {
+		return 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.peak
+}
+
+// AlignedBufferPool pools the buffers aligned in memory, e.g. for the O_DIRECT reads requiring the buffer address
+// to be aligned to the logical block size of the device
+type AlignedBufferPool struct {
+	pool sync.Pool
+}
+
+// NewAlignedBufferPool creates a pool of the size bytes buffers aligned to the alignment, which must be a power of 2
+func NewAlignedBufferPool(size, alignment int) *AlignedBufferPool {
+	return &AlignedBufferPool{
+		pool: sync.Pool{
+			New: func() interface{} {
+				return AlignedBuffer(size, alignment)
+			},
+		},
+	}
+}
+
+// Get returns an aligned buffer, it should be returned with Put once unused
+func (p *AlignedBufferPool) Get() []byte {
+	return p.pool.Get().([]byte)
+}
+
+// Put returns the buffer to the pool, the buffer must not be used afterwards
+func (p *AlignedBufferPool) Put(buf []byte) {
+	if buf == nil {
+		return
+	}
+	p.pool.Put(buf)
+}
+
+// AlignedBuffer allocates a size bytes buffer starting at an address aligned to the alignment, which must be a
+// power of 2
+func AlignedBuffer(size, alignment int) []byte {
+	buf := make([]byte, size+alignment)
+	shift := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & uintptr(alignment-1)); rem != 0 {
+		shift = alignment - rem
+	}
+	return buf[shift : shift+size : shift+size]
+}
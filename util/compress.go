@@ -0,0 +1,292 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	lz4 "github.com/pierrec/lz4/v4"
+	"github.com/pkg/errors"
+)
+
+// Compressor compresses and decompresses the data with streaming semantics,
+// so the callers don't need to hold the whole input and output in memory
+type Compressor interface {
+	Compress(dst io.Writer, src io.Reader) error
+	Decompress(dst io.Writer, src io.Reader) error
+}
+
+// CompressorFactory creates the compressor of a compression method, it's called once on the first use of the method
+type CompressorFactory func() (Compressor, error)
+
+// ErrIncompressible can be returned by Compress if the compressor refuses the data, e.g. a hardware accelerated
+// compressor with a size limit, then the data is stored uncompressed instead of failing the backup
+var ErrIncompressible = errors.New("data cannot be compressed by the compression method")
+
+// COMPRESSION_HEADER_SIZE is the size of the longest header the compressed data starts with
+const COMPRESSION_HEADER_SIZE = 16
+
+type compressorEntry struct {
+	factory CompressorFactory
+	// magic is the magic number the compressed data starts with, empty if the method has no header
+	magic []byte
+
+	once       sync.Once
+	compressor Compressor
+	err        error
+}
+
+func (e *compressorEntry) get() (Compressor, error) {
+	e.once.Do(func() {
+		e.compressor, e.err = e.factory()
+	})
+	return e.compressor, e.err
+}
+
+var (
+	compressorsLock sync.RWMutex
+	compressors     = map[string]*compressorEntry{}
+)
+
+func init() {
+	builtins := []struct {
+		name    string
+		factory CompressorFactory
+		magic   []byte
+	}{
+		{"none", func() (Compressor, error) { return noneCompressor{}, nil }, nil},
+		{"gzip", func() (Compressor, error) { return &gzipCompressor{}, nil }, []byte{0x1f, 0x8b}},
+		{"lz4", func() (Compressor, error) { return &lz4Compressor{}, nil }, []byte{0x04, 0x22, 0x4d, 0x18}},
+	}
+	for _, builtin := range builtins {
+		if err := RegisterCompressor(builtin.name, builtin.factory, builtin.magic); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterCompressor adds the compression method, so the builds can add the external codecs without modifying this
+// package. The magic number the compressed data starts with is used to detect the compression method of the data,
+// it can be empty if the compressed data has no header. The magic number must not be a prefix of the magic number of
+// another method, otherwise the methods cannot be told apart.
+func RegisterCompressor(name string, factory CompressorFactory, magic []byte) error {
+	if !ValidateName(name) {
+		return fmt.Errorf("invalid compression method name %v", name)
+	}
+	if factory == nil {
+		return fmt.Errorf("missing factory of compression method %v", name)
+	}
+	if len(magic) > COMPRESSION_HEADER_SIZE {
+		return fmt.Errorf("magic number %x of compression method %v is longer than %v bytes", magic, name, COMPRESSION_HEADER_SIZE)
+	}
+
+	compressorsLock.Lock()
+	defer compressorsLock.Unlock()
+	if _, exists := compressors[name]; exists {
+		return fmt.Errorf("compression method %v is already registered", name)
+	}
+	if len(magic) > 0 {
+		for method, entry := range compressors {
+			if len(entry.magic) > 0 && (bytes.HasPrefix(magic, entry.magic) || bytes.HasPrefix(entry.magic, magic)) {
+				return fmt.Errorf("magic number %x of compression method %v conflicts with compression method %v",
+					magic, name, method)
+			}
+		}
+	}
+	compressors[name] = &compressorEntry{
+		factory: factory,
+		magic:   append([]byte{}, magic...),
+	}
+	return nil
+}
+
+// UnregisterCompressor removes the compression method added by RegisterCompressor, so it can be registered again
+// with another implementation
+func UnregisterCompressor(name string) {
+	compressorsLock.Lock()
+	defer compressorsLock.Unlock()
+	delete(compressors, name)
+}
+
+func getCompressorEntry(method string) (*compressorEntry, error) {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+	entry, ok := compressors[method]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression method: %v", method)
+	}
+	return entry, nil
+}
+
+// GetCompressor returns the compressor of the compression method
+func GetCompressor(method string) (Compressor, error) {
+	entry, err := getCompressorEntry(method)
+	if err != nil {
+		return nil, err
+	}
+	compressor, err := entry.get()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create compressor of compression method %v", method)
+	}
+	return compressor, nil
+}
+
+// GetCompressionMethods returns the supported compression methods in sorted order
+func GetCompressionMethods() []string {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+	methods := make([]string, 0, len(compressors))
+	for method := range compressors {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// GetCompressionMagic returns the magic number the data compressed by the method starts with, nil if the method
+// has no header
+func GetCompressionMagic(method string) ([]byte, error) {
+	entry, err := getCompressorEntry(method)
+	if err != nil {
+		return nil, err
+	}
+	if len(entry.magic) == 0 {
+		return nil, nil
+	}
+	return append([]byte{}, entry.magic...), nil
+}
+
+// DetectCompressionMethod returns the compression method of the data starting with header by the magic numbers,
+// or an empty string if the header matches no method, e.g. the data is uncompressed
+func DetectCompressionMethod(header []byte) string {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+	for method, entry := range compressors {
+		// the magic numbers are never prefixes of each other, so at most one matches
+		if len(entry.magic) > 0 && bytes.HasPrefix(header, entry.magic) {
+			return method
+		}
+	}
+	return ""
+}
+
+// CheckCompressionHeader checks if the data starting with header is compressed by the method, so the data
+// compressed by another method or overwritten can be detected without downloading the whole data. The data
+// of the methods without a header always passes.
+func CheckCompressionHeader(method string, header []byte) error {
+	magic, err := GetCompressionMagic(method)
+	if err != nil {
+		return err
+	}
+	if len(magic) == 0 {
+		return nil
+	}
+	if !bytes.HasPrefix(header, magic) {
+		return fmt.Errorf("data is not compressed by %v, header %x", method, header)
+	}
+	return nil
+}
+
+type noneCompressor struct{}
+
+func (noneCompressor) Compress(dst io.Writer, src io.Reader) error {
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+func (noneCompressor) Decompress(dst io.Writer, src io.Reader) error {
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+type gzipCompressor struct {
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (c *gzipCompressor) Compress(dst io.Writer, src io.Reader) error {
+	w, ok := c.writers.Get().(*gzip.Writer)
+	if ok {
+		w.Reset(dst)
+	} else {
+		w = gzip.NewWriter(dst)
+	}
+	defer c.writers.Put(w)
+
+	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (c *gzipCompressor) Decompress(dst io.Writer, src io.Reader) error {
+	r, ok := c.readers.Get().(*gzip.Reader)
+	if ok {
+		if err := r.Reset(src); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if r, err = gzip.NewReader(src); err != nil {
+			return err
+		}
+	}
+	defer c.readers.Put(r)
+	defer r.Close()
+
+	_, err := io.Copy(dst, r)
+	return err
+}
+
+type lz4Compressor struct {
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (c *lz4Compressor) Compress(dst io.Writer, src io.Reader) error {
+	w, ok := c.writers.Get().(*lz4.Writer)
+	if ok {
+		w.Reset(dst)
+	} else {
+		w = lz4.NewWriter(dst)
+	}
+	defer c.writers.Put(w)
+
+	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (c *lz4Compressor) Decompress(dst io.Writer, src io.Reader) error {
+	r, ok := c.readers.Get().(*lz4.Reader)
+	if ok {
+		r.Reset(src)
+	} else {
+		r = lz4.NewReader(src)
+	}
+	defer c.readers.Put(r)
+
+	_, err := io.Copy(dst, r)
+	return err
+}
+
+// DecompressAndVerifyInto decompresses the data into dst and verifies the data integrity
+func DecompressAndVerifyInto(method string, dst *bytes.Buffer, src io.Reader, checksum string) error {
+	compressor, err := GetCompressor(method)
+	if err != nil {
+		return fmt.Errorf("unsupported decompression method: %v", method)
+	}
+	if err := compressor.Decompress(dst, src); err != nil {
+		return err
+	}
+	if GetChecksum(dst.Bytes()) != checksum {
+		return fmt.Errorf("checksum verification failed for block")
+	}
+	return nil
+}
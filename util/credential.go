@@ -2,89 +2,89 @@ package util
 
 import (
 	"errors"
+	"fmt"
 	"os"
 
 	"github.com/longhorn/backupstore/types"
 )
 
+// SetupCredential sets up the credential map of the backup type in the environment variables used by the drivers.
+// It's kept for compatibility, SetupTypedCredential should be used instead.
 func SetupCredential(backupType string, credential map[string]string) error {
-	switch backupType {
-	case "s3":
-		return setupS3Credential(credential)
-	case "cifs":
-		return setupCIFSCredential(credential)
-	case "azblob":
-		return setupAZBlobCredential(credential)
-	default:
-		return nil
-	}
-}
-
-func setupS3Credential(credential map[string]string) error {
 	if credential == nil {
 		return nil
 	}
 
-	if credential[types.AWSAccessKey] == "" && credential[types.AWSSecretKey] != "" {
-		return errors.New("s3 credential access key not found")
+	typed, err := CredentialFromMap(backupType, credential)
+	if err != nil || typed == nil {
+		return err
 	}
-	if credential[types.AWSAccessKey] != "" && credential[types.AWSSecretKey] == "" {
-		return errors.New("s3 credential secret access key not found")
-	}
-	if credential[types.AWSAccessKey] != "" && credential[types.AWSSecretKey] != "" {
-		os.Setenv(types.AWSAccessKey, credential[types.AWSAccessKey])
-		os.Setenv(types.AWSSecretKey, credential[types.AWSSecretKey])
-	}
-
-	os.Setenv(types.AWSEndPoint, credential[types.AWSEndPoint])
-	os.Setenv(types.HTTPSProxy, credential[types.HTTPSProxy])
-	os.Setenv(types.HTTPProxy, credential[types.HTTPProxy])
-	os.Setenv(types.NOProxy, credential[types.NOProxy])
-	os.Setenv(types.VirtualHostedStyle, credential[types.VirtualHostedStyle])
+	return SetupTypedCredential(typed)
+}
 
-	// set a custom ca cert if available
-	if credential[types.AWSCert] != "" {
-		os.Setenv(types.AWSCert, credential[types.AWSCert])
+// SetupTypedCredential validates the credential and sets it up in the environment variables used by the drivers
+func SetupTypedCredential(credential Credential) error {
+	if err := credential.Validate(); err != nil {
+		return err
+	}
+
+	switch c := credential.(type) {
+	case *S3Credential:
+		setupS3Credential(c)
+	case *SMBCredential:
+		setupCIFSCredential(c)
+	case *NFSCredential:
+		setupNFSCredential(c)
+	case *AzureCredential:
+		setupAZBlobCredential(c)
+	default:
+		return fmt.Errorf("unsupported credential kind %v", credential.Kind())
 	}
-
 	return nil
 }
 
-func setupCIFSCredential(credential map[string]string) error {
-	if credential == nil {
-		return nil
+func setupS3Credential(credential *S3Credential) {
+	if credential.AccessKey != "" && credential.SecretKey != "" {
+		os.Setenv(types.AWSAccessKey, credential.AccessKey)
+		os.Setenv(types.AWSSecretKey, credential.SecretKey)
 	}
 
-	os.Setenv(types.CIFSUsername, credential[types.CIFSUsername])
-	os.Setenv(types.CIFSPassword, credential[types.CIFSPassword])
+	os.Setenv(types.AWSEndPoint, credential.Endpoint)
+	os.Setenv(types.HTTPSProxy, credential.HTTPSProxy)
+	os.Setenv(types.HTTPProxy, credential.HTTPProxy)
+	os.Setenv(types.NOProxy, credential.NoProxy)
+	os.Setenv(types.VirtualHostedStyle, credential.VirtualHostedStyle)
 
-	return nil
+	// set a custom ca cert if available
+	if credential.Cert != "" {
+		os.Setenv(types.AWSCert, credential.Cert)
+	}
 }
 
-func setupAZBlobCredential(credential map[string]string) error {
-	if credential == nil {
-		return nil
-	}
+func setupCIFSCredential(credential *SMBCredential) {
+	os.Setenv(types.CIFSUsername, credential.Username)
+	os.Setenv(types.CIFSPassword, credential.Password)
+}
 
-	if credential[types.AZBlobAccountName] == "" && credential[types.AZBlobAccountKey] != "" {
-		return errors.New("Azure Blob Storage credential account name not found")
-	}
-	if credential[types.AZBlobAccountName] != "" && credential[types.AZBlobAccountKey] == "" {
-		return errors.New("Azure Blob Storage credential account key not found")
-	}
+func setupNFSCredential(credential *NFSCredential) {
+	os.Setenv(types.NFSSecurity, credential.Security)
+	os.Setenv(types.NFSKrb5Principal, credential.Principal)
+	os.Setenv(types.NFSKrb5Keytab, credential.Keytab)
+	os.Setenv(types.NFSKrb5CCache, credential.CCache)
+}
 
-	os.Setenv(types.AZBlobAccountName, credential[types.AZBlobAccountName])
-	os.Setenv(types.AZBlobAccountKey, credential[types.AZBlobAccountKey])
-	os.Setenv(types.AZBlobEndpoint, credential[types.AZBlobEndpoint])
-	os.Setenv(types.HTTPSProxy, credential[types.HTTPSProxy])
-	os.Setenv(types.HTTPProxy, credential[types.HTTPProxy])
-	os.Setenv(types.NOProxy, credential[types.NOProxy])
+func setupAZBlobCredential(credential *AzureCredential) {
+	os.Setenv(types.AZBlobAccountName, credential.AccountName)
+	os.Setenv(types.AZBlobAccountKey, credential.AccountKey)
+	os.Setenv(types.AZBlobSASToken, credential.SASToken)
+	os.Setenv(types.AZBlobEndpoint, credential.Endpoint)
+	os.Setenv(types.HTTPSProxy, credential.HTTPSProxy)
+	os.Setenv(types.HTTPProxy, credential.HTTPProxy)
+	os.Setenv(types.NOProxy, credential.NoProxy)
 
-	if credential[types.AZBlobCert] != "" {
-		os.Setenv(types.AZBlobCert, credential[types.AZBlobCert])
+	if credential.Cert != "" {
+		os.Setenv(types.AZBlobCert, credential.Cert)
 	}
-
-	return nil
 }
 
 func getCredentialFromEnvVars(backupType string) (map[string]string, error) {
@@ -95,6 +95,8 @@ func getCredentialFromEnvVars(backupType string) (map[string]string, error) {
 		return getCIFSCredentialFromEnvVars()
 	case "azblob":
 		return getAZBlobCredentialFromEnvVars()
+	case "nfs":
+		return getNFSCredentialFromEnvVars()
 	default:
 		return nil, nil
 	}
@@ -105,6 +107,7 @@ func getAZBlobCredentialFromEnvVars() (map[string]string, error) {
 
 	credential[types.AZBlobAccountName] = os.Getenv(types.AZBlobAccountName)
 	credential[types.AZBlobAccountKey] = os.Getenv(types.AZBlobAccountKey)
+	credential[types.AZBlobSASToken] = os.Getenv(types.AZBlobSASToken)
 	credential[types.AZBlobEndpoint] = os.Getenv(types.AZBlobEndpoint)
 	credential[types.AZBlobCert] = os.Getenv(types.AZBlobCert)
 	credential[types.HTTPSProxy] = os.Getenv(types.HTTPSProxy)
@@ -123,6 +126,17 @@ func getCIFSCredentialFromEnvVars() (map[string]string, error) {
 	return credential, nil
 }
 
+func getNFSCredentialFromEnvVars() (map[string]string, error) {
+	credential := map[string]string{}
+
+	credential[types.NFSSecurity] = os.Getenv(types.NFSSecurity)
+	credential[types.NFSKrb5Principal] = os.Getenv(types.NFSKrb5Principal)
+	credential[types.NFSKrb5Keytab] = os.Getenv(types.NFSKrb5Keytab)
+	credential[types.NFSKrb5CCache] = os.Getenv(types.NFSKrb5CCache)
+
+	return credential, nil
+}
+
 func getS3CredentialFromEnvVars() (map[string]string, error) {
 	credential := map[string]string{}
 
@@ -157,3 +171,18 @@ func GetBackupCredential(backupURL string) (map[string]string, error) {
 
 	return getCredentialFromEnvVars(backupType)
 }
+
+// GetBackupTypedCredential returns the typed credential of the backup target from the environment variables,
+// nil is returned for the backup types without credential
+func GetBackupTypedCredential(backupURL string) (Credential, error) {
+	backupType, err := CheckBackupType(backupURL)
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := getCredentialFromEnvVars(backupType)
+	if err != nil {
+		return nil, err
+	}
+	return CredentialFromMap(backupType, credential)
+}
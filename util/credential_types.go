@@ -0,0 +1,277 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/longhorn/backupstore/types"
+)
+
+const (
+	redactedValue = "<redacted>"
+)
+
+// Credential is the typed credential of a backup target. It replaces the raw credential map, which is
+// still accepted by SetupCredential and can be converted with CredentialFromMap and ToMap.
+type Credential interface {
+	// Kind returns the kind of the backup target the credential is used for, e.g. s3
+	Kind() string
+	// Validate checks if the credential is complete
+	Validate() error
+	// ToMap returns the credential in the map form, the keys are the ones in the types package
+	ToMap() map[string]string
+	// String returns the credential with the secrets redacted, so it can be logged
+	String() string
+}
+
+// ProxyConfig is the proxy used by the backup targets accessed over HTTP
+type ProxyConfig struct {
+	HTTPSProxy string
+	HTTPProxy  string
+	NoProxy    string
+}
+
+func (p ProxyConfig) toMap(m map[string]string) {
+	m[types.HTTPSProxy] = p.HTTPSProxy
+	m[types.HTTPProxy] = p.HTTPProxy
+	m[types.NOProxy] = p.NoProxy
+}
+
+func proxyConfigFromMap(m map[string]string) ProxyConfig {
+	return ProxyConfig{
+		HTTPSProxy: m[types.HTTPSProxy],
+		HTTPProxy:  m[types.HTTPProxy],
+		NoProxy:    m[types.NOProxy],
+	}
+}
+
+// S3Credential is the credential of the s3 backup targets
+type S3Credential struct {
+	AccessKey string
+	SecretKey string
+	// SessionToken is only used with the temporary credentials, e.g. AWS STS
+	SessionToken string
+	Endpoint     string
+	Cert         string
+	// VirtualHostedStyle is "true" or "false" to force the addressing style, the default is used if empty
+	VirtualHostedStyle string
+	ProxyConfig
+}
+
+func (c *S3Credential) Kind() string {
+	return "s3"
+}
+
+func (c *S3Credential) Validate() error {
+	if c.AccessKey == "" && c.SecretKey != "" {
+		return errors.New("s3 credential access key not found")
+	}
+	if c.AccessKey != "" && c.SecretKey == "" {
+		return errors.New("s3 credential secret access key not found")
+	}
+	return nil
+}
+
+func (c *S3Credential) ToMap() map[string]string {
+	m := map[string]string{
+		types.AWSAccessKey:       c.AccessKey,
+		types.AWSSecretKey:       c.SecretKey,
+		types.AWSSessionToken:    c.SessionToken,
+		types.AWSEndPoint:        c.Endpoint,
+		types.AWSCert:            c.Cert,
+		types.VirtualHostedStyle: c.VirtualHostedStyle,
+	}
+	c.ProxyConfig.toMap(m)
+	return m
+}
+
+func (c *S3Credential) String() string {
+	return redactCredential(c, types.AWSSecretKey, types.AWSSessionToken)
+}
+
+// AzureCredential is the credential of the azblob backup targets
+type AzureCredential struct {
+	AccountName string
+	AccountKey  string
+	// SASToken is used instead of the account key if specified
+	SASToken string
+	Endpoint string
+	Cert     string
+	ProxyConfig
+}
+
+func (c *AzureCredential) Kind() string {
+	return "azblob"
+}
+
+func (c *AzureCredential) Validate() error {
+	if c.AccountName == "" && (c.AccountKey != "" || c.SASToken != "") {
+		return errors.New("Azure Blob Storage credential account name not found")
+	}
+	if c.AccountName != "" && c.AccountKey == "" && c.SASToken == "" {
+		return errors.New("Azure Blob Storage credential account key not found")
+	}
+	return nil
+}
+
+func (c *AzureCredential) ToMap() map[string]string {
+	m := map[string]string{
+		types.AZBlobAccountName: c.AccountName,
+		types.AZBlobAccountKey:  c.AccountKey,
+		types.AZBlobSASToken:    c.SASToken,
+		types.AZBlobEndpoint:    c.Endpoint,
+		types.AZBlobCert:        c.Cert,
+	}
+	c.ProxyConfig.toMap(m)
+	return m
+}
+
+func (c *AzureCredential) String() string {
+	return redactCredential(c, types.AZBlobAccountKey, types.AZBlobSASToken)
+}
+
+// SMBCredential is the credential of the cifs backup targets
+type SMBCredential struct {
+	Username string
+	Password string
+}
+
+func (c *SMBCredential) Kind() string {
+	return "cifs"
+}
+
+func (c *SMBCredential) Validate() error {
+	if c.Username == "" && c.Password != "" {
+		return errors.New("CIFS credential username not found")
+	}
+	return nil
+}
+
+func (c *SMBCredential) ToMap() map[string]string {
+	return map[string]string{
+		types.CIFSUsername: c.Username,
+		types.CIFSPassword: c.Password,
+	}
+}
+
+func (c *SMBCredential) String() string {
+	return redactCredential(c, types.CIFSPassword)
+}
+
+// NFSCredential is the Kerberos configuration of the nfs backup targets
+type NFSCredential struct {
+	// Security is one of krb5, krb5i and krb5p, Kerberos is not used if empty
+	Security  string
+	Principal string
+	Keytab    string
+	CCache    string
+}
+
+func (c *NFSCredential) Kind() string {
+	return "nfs"
+}
+
+func (c *NFSCredential) Validate() error {
+	switch c.Security {
+	case "", "krb5", "krb5i", "krb5p":
+	default:
+		return fmt.Errorf("invalid NFS security %v, must be one of krb5, krb5i and krb5p", c.Security)
+	}
+	if c.Keytab != "" && c.Principal == "" {
+		return errors.New("NFS Kerberos principal not found for keytab")
+	}
+	return nil
+}
+
+func (c *NFSCredential) ToMap() map[string]string {
+	return map[string]string{
+		types.NFSSecurity:      c.Security,
+		types.NFSKrb5Principal: c.Principal,
+		types.NFSKrb5Keytab:    c.Keytab,
+		types.NFSKrb5CCache:    c.CCache,
+	}
+}
+
+func (c *NFSCredential) String() string {
+	// the keytab is a file path rather than the secret itself
+	return redactCredential(c)
+}
+
+// CredentialFromMap converts the credential map of the backup type to the typed credential.
+// nil is returned for the backup types without credential.
+func CredentialFromMap(backupType string, m map[string]string) (Credential, error) {
+	if m == nil {
+		m = map[string]string{}
+	}
+
+	var credential Credential
+	switch backupType {
+	case "s3":
+		credential = &S3Credential{
+			AccessKey:          m[types.AWSAccessKey],
+			SecretKey:          m[types.AWSSecretKey],
+			SessionToken:       m[types.AWSSessionToken],
+			Endpoint:           m[types.AWSEndPoint],
+			Cert:               m[types.AWSCert],
+			VirtualHostedStyle: m[types.VirtualHostedStyle],
+			ProxyConfig:        proxyConfigFromMap(m),
+		}
+	case "azblob":
+		credential = &AzureCredential{
+			AccountName: m[types.AZBlobAccountName],
+			AccountKey:  m[types.AZBlobAccountKey],
+			SASToken:    m[types.AZBlobSASToken],
+			Endpoint:    m[types.AZBlobEndpoint],
+			Cert:        m[types.AZBlobCert],
+			ProxyConfig: proxyConfigFromMap(m),
+		}
+	case "cifs":
+		credential = &SMBCredential{
+			Username: m[types.CIFSUsername],
+			Password: m[types.CIFSPassword],
+		}
+	case "nfs":
+		credential = &NFSCredential{
+			Security:  m[types.NFSSecurity],
+			Principal: m[types.NFSKrb5Principal],
+			Keytab:    m[types.NFSKrb5Keytab],
+			CCache:    m[types.NFSKrb5CCache],
+		}
+	default:
+		return nil, nil
+	}
+
+	if err := credential.Validate(); err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+// redactCredential formats the non-empty fields of the credential, the values of the secret keys are redacted
+func redactCredential(credential Credential, secretKeys ...string) string {
+	secrets := map[string]bool{}
+	for _, key := range secretKeys {
+		secrets[key] = true
+	}
+
+	m := credential.ToMap()
+	keys := make([]string, 0, len(m))
+	for key, value := range m {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	fields := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value := m[key]
+		if secrets[key] {
+			value = redactedValue
+		}
+		fields = append(fields, key+"="+value)
+	}
+	return credential.Kind() + "{" + strings.Join(fields, ", ") + "}"
+}
@@ -0,0 +1,113 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// aimdLatencyTolerance is the ratio of the smoothed latency to the lowest latency seen,
+	// above which the transfers are considered congested
+	aimdLatencyTolerance = 3
+	aimdLatencyWeight    = 0.2
+)
+
+// AIMDLimiter limits the concurrent transfers with additive increase/multiplicative decrease. The limit grows by one
+// after a full window of successful transfers, and halves once the transfers fail or their latency rises.
+type AIMDLimiter struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	min      int
+	max      int
+	limit    float64
+	inFlight int
+
+	minLatency      time.Duration
+	smoothedLatency time.Duration
+	// cooldown is the number of transfers to complete before the next decrease,
+	// so the concurrent failures of the same congestion only decrease the limit once
+	cooldown int
+}
+
+// NewAIMDLimiter creates a limiter starting at the initial limit, which is adjusted within [min, max]
+func NewAIMDLimiter(initial, min, max int) *AIMDLimiter {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	if initial < min {
+		initial = min
+	} else if initial > max {
+		initial = max
+	}
+	l := &AIMDLimiter{
+		min:   min,
+		max:   max,
+		limit: float64(initial),
+	}
+	l.cond = sync.NewCond(&l.lock)
+	return l
+}
+
+// Acquire blocks until a transfer can be started, it must be followed by Release
+func (l *AIMDLimiter) Acquire() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for l.inFlight >= int(l.limit) {
+		l.cond.Wait()
+	}
+	l.inFlight++
+}
+
+// Release completes the transfer started by Acquire and adjusts the limit by its latency and result
+func (l *AIMDLimiter) Release(latency time.Duration, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	defer l.cond.Broadcast()
+
+	l.inFlight--
+	if l.cooldown > 0 {
+		l.cooldown--
+	}
+
+	congested := err != nil
+	if err == nil {
+		if l.minLatency == 0 || latency < l.minLatency {
+			l.minLatency = latency
+		}
+		if l.smoothedLatency == 0 {
+			l.smoothedLatency = latency
+		} else {
+			l.smoothedLatency = time.Duration(aimdLatencyWeight*float64(latency) + (1-aimdLatencyWeight)*float64(l.smoothedLatency))
+		}
+		congested = l.smoothedLatency > aimdLatencyTolerance*l.minLatency
+	}
+
+	if !congested {
+		l.limit += 1 / l.limit
+		if l.limit > float64(l.max) {
+			l.limit = float64(l.max)
+		}
+		return
+	}
+	if l.cooldown > 0 {
+		return
+	}
+	l.limit /= 2
+	if l.limit < float64(l.min) {
+		l.limit = float64(l.min)
+	}
+	l.cooldown = l.inFlight + 1
+	// start over measuring the latency at the decreased limit
+	l.smoothedLatency = 0
+}
+
+// Limit returns the current limit of the concurrent transfers
+func (l *AIMDLimiter) Limit() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return int(l.limit)
+}
@@ -2,7 +2,6 @@ package util
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
 	"crypto/sha256"
 	"crypto/sha512"
@@ -16,11 +15,11 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/google/uuid"
-	lz4 "github.com/pierrec/lz4/v4"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"go.uber.org/multierr"
@@ -34,6 +33,15 @@ const (
 	PreservedChecksumLength = 64
 
 	MountDir = "/var/lib/longhorn-backupstore-mounts"
+
+	// MaxNiceLevel is the nice level of the lowest scheduling priority
+	MaxNiceLevel = 19
+
+	// MountTimeoutParam overrides the timeout of mounting the share of the backup target, e.g.
+	// nfs://server:/path?mountTimeout=30s
+	MountTimeoutParam = "mountTimeout"
+	// MountCleanupTimeoutParam overrides the timeout of force cleaning up the corrupted mount point of the share
+	MountCleanupTimeoutParam = "mountCleanupTimeout"
 )
 
 var (
@@ -101,60 +109,25 @@ func CompressData(method string, data []byte) (io.ReadSeeker, error) {
 		return bytes.NewReader(data), nil
 	}
 
-	var buffer bytes.Buffer
-
-	w, err := newCompressionWriter(method, &buffer)
+	compressor, err := GetCompressor(method)
 	if err != nil {
 		return nil, err
 	}
 
-	if _, err := w.Write(data); err != nil {
-		w.Close()
+	var buffer bytes.Buffer
+	if err := compressor.Compress(&buffer, bytes.NewReader(data)); err != nil {
 		return nil, err
 	}
-	w.Close()
 	return bytes.NewReader(buffer.Bytes()), nil
 }
 
 // DecompressAndVerify decompresses the given data and verifies the data integrity
 func DecompressAndVerify(method string, src io.Reader, checksum string) (io.Reader, error) {
-	r, err := newDecompressionReader(method, src)
-	if err != nil {
-		return nil, err
-	}
-	defer r.Close()
-	block, err := io.ReadAll(r)
-	if err != nil {
+	var buffer bytes.Buffer
+	if err := DecompressAndVerifyInto(method, &buffer, src, checksum); err != nil {
 		return nil, err
 	}
-	if GetChecksum(block) != checksum {
-		return nil, fmt.Errorf("checksum verification failed for block")
-	}
-	return bytes.NewReader(block), nil
-}
-
-func newCompressionWriter(method string, buffer io.Writer) (io.WriteCloser, error) {
-	switch method {
-	case "gzip":
-		return gzip.NewWriter(buffer), nil
-	case "lz4":
-		return lz4.NewWriter(buffer), nil
-	default:
-		return nil, fmt.Errorf("unsupported compression method: %v", method)
-	}
-}
-
-func newDecompressionReader(method string, r io.Reader) (io.ReadCloser, error) {
-	switch method {
-	case "none":
-		return io.NopCloser(r), nil
-	case "gzip":
-		return gzip.NewReader(r)
-	case "lz4":
-		return io.NopCloser(lz4.NewReader(r)), nil
-	default:
-		return nil, fmt.Errorf("unsupported decompression method: %v", method)
-	}
+	return bytes.NewReader(buffer.Bytes()), nil
 }
 
 func Now() string {
@@ -216,6 +189,25 @@ func ValidateName(name string) bool {
 	return validName.MatchString(name)
 }
 
+// JoinPathWithin joins the path to the prefix of the backup target, and fails if the joined path escapes the
+// prefix, e.g. by "..". The trailing slash of the path is kept, and the prefix itself is returned with a trailing
+// slash, so the prefix listing or deletion never matches the sibling prefixes starting with the same name.
+func JoinPathWithin(prefix, path string) (string, error) {
+	root := strings.Trim(filepath.Clean("/"+prefix), "/")
+	joined := strings.TrimLeft(filepath.Join("/", root, path), "/")
+	if root == "" {
+		if joined == "" {
+			return "", nil
+		}
+	} else if joined != root && !strings.HasPrefix(joined, root+"/") {
+		return "", fmt.Errorf("path %v escapes prefix %v", path, prefix)
+	}
+	if joined == root || strings.HasSuffix(path, "/") {
+		return joined + "/", nil
+	}
+	return joined, nil
+}
+
 // Execute executes a command
 func Execute(binary string, args []string) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), cmdTimeout)
@@ -279,11 +271,50 @@ func IsMounted(mountPoint string) bool {
 	return false
 }
 
-func cleanupMount(mountDir string, mounter mount.Interface, log logrus.FieldLogger) error {
+// MountTimeouts are the timeouts of the mount commands of the share of a backup target
+type MountTimeouts struct {
+	// Mount bounds each mount attempt
+	Mount time.Duration
+	// Cleanup bounds the force unmount of the corrupted mount point
+	Cleanup time.Duration
+}
+
+// ParseMountTimeouts returns the mount timeouts overridden by the URL params of the backup target, the timeouts
+// not overridden are the defaults
+func ParseMountTimeouts(u *url.URL, defaults MountTimeouts) (MountTimeouts, error) {
+	timeouts := defaults
+	if timeouts.Cleanup == 0 {
+		timeouts.Cleanup = forceCleanupMountTimeout
+	}
+	for param, timeout := range map[string]*time.Duration{
+		MountTimeoutParam:        &timeouts.Mount,
+		MountCleanupTimeoutParam: &timeouts.Cleanup,
+	} {
+		value := u.Query().Get(param)
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return timeouts, fmt.Errorf("invalid %v %v, must be a positive duration", param, value)
+		}
+		*timeout = d
+	}
+	return timeouts, nil
+}
+
+func (t MountTimeouts) String() string {
+	return fmt.Sprintf("mount timeout %v, cleanup timeout %v", t.Mount, t.Cleanup)
+}
+
+func cleanupMount(mountDir string, mounter mount.Interface, log logrus.FieldLogger, timeout time.Duration) error {
 	forceUnmounter, ok := mounter.(mount.MounterForceUnmounter)
 	if ok {
-		log.Infof("Trying to force clean up mount point %v", mountDir)
-		return mount.CleanupMountWithForce(mountDir, forceUnmounter, false, forceCleanupMountTimeout)
+		log.Infof("Trying to force clean up mount point %v with timeout %v", mountDir, timeout)
+		if err := mount.CleanupMountWithForce(mountDir, forceUnmounter, false, timeout); err != nil {
+			return errors.Wrapf(err, "failed to force clean up mount point %v with timeout %v", mountDir, timeout)
+		}
+		return nil
 	}
 
 	log.Infof("Trying to clean up mount point %v", mountDir)
@@ -292,6 +323,13 @@ func cleanupMount(mountDir string, mounter mount.Interface, log logrus.FieldLogg
 
 // EnsureMountPoint checks if the mount point is valid. If it is invalid, clean up mount point.
 func EnsureMountPoint(Kind, mountPoint string, mounter mount.Interface, log logrus.FieldLogger) (mounted bool, err error) {
+	return EnsureMountPointWithTimeout(Kind, mountPoint, mounter, log, forceCleanupMountTimeout)
+}
+
+// EnsureMountPointWithTimeout checks if the mount point is valid, the invalid mount point is cleaned up within
+// the cleanup timeout
+func EnsureMountPointWithTimeout(Kind, mountPoint string, mounter mount.Interface, log logrus.FieldLogger,
+	cleanupTimeout time.Duration) (mounted bool, err error) {
 	defer func() {
 		if !mounted && err == nil {
 			if mkdirErr := os.MkdirAll(mountPoint, 0700); mkdirErr != nil {
@@ -316,7 +354,7 @@ func EnsureMountPoint(Kind, mountPoint string, mounter mount.Interface, log logr
 
 	if IsCorruptedMnt {
 		log.Warnf("Failed to check mount point %v (mounted=%v)", mountPoint, mounted)
-		if mntErr := cleanupMount(mountPoint, mounter, log); mntErr != nil {
+		if mntErr := cleanupMount(mountPoint, mounter, log, cleanupTimeout); mntErr != nil {
 			return true, errors.Wrapf(mntErr, "failed to clean up corrupted mount point %v", mountPoint)
 		}
 		notMounted = true
@@ -343,26 +381,68 @@ func EnsureMountPoint(Kind, mountPoint string, mounter mount.Interface, log logr
 
 	log.Warnf("Cleaning up the mount point %v because the fstype %v is changed to %v", mountPoint, kind, Kind)
 
-	if mntErr := cleanupMount(mountPoint, mounter, log); mntErr != nil {
+	if mntErr := cleanupMount(mountPoint, mounter, log, cleanupTimeout); mntErr != nil {
 		return true, errors.Wrapf(mntErr, "failed to clean up mount point %v (%v) for %v protocol", kind, mountPoint, Kind)
 	}
 
 	return false, nil
 }
 
-// MountWithTimeout mounts the backup store to a given mount point with a specified timeout
+// MountWithTimeout mounts the backup store to a given mount point with a specified timeout. The mount command
+// isn't killed once it times out, the share is unmounted again if it's mounted after the timeout, so the mount
+// point isn't left mounted once the caller has given up.
 func MountWithTimeout(mounter mount.Interface, source string, target string, fstype string,
 	options []string, sensitiveOptions []string, interval, timeout time.Duration) error {
 	mountComplete := false
 	err := wait.PollImmediate(interval, timeout, func() (bool, error) {
-		err := mounter.MountSensitiveWithoutSystemd(source, target, fstype, options, sensitiveOptions)
-		mountComplete = true
-		return true, err
+		var (
+			lock      sync.Mutex
+			abandoned bool
+		)
+		done := make(chan error, 1)
+		go func() {
+			err := mounter.MountSensitiveWithoutSystemd(source, target, fstype, options, sensitiveOptions)
+			lock.Lock()
+			defer lock.Unlock()
+			if !abandoned {
+				done <- err
+				return
+			}
+			if err != nil {
+				logrus.WithError(err).Warnf("Mounting %v share %v on %v failed after it timed out", fstype, source, target)
+				return
+			}
+			logrus.Warnf("Unmounting %v share %v on %v mounted after it timed out", fstype, source, target)
+			if err := mounter.Unmount(target); err != nil {
+				logrus.WithError(err).Warnf("Failed to unmount %v mounted after it timed out", target)
+			}
+		}()
+
+		select {
+		case err := <-done:
+			mountComplete = true
+			return true, err
+		case <-time.After(timeout):
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		// the mount may complete in the meantime
+		select {
+		case err := <-done:
+			mountComplete = true
+			return true, err
+		default:
+		}
+		abandoned = true
+		return false, wait.ErrWaitTimeout
 	})
 	if !mountComplete {
-		return errors.Wrapf(err, "mounting %v share %v on %v timed out", fstype, source, target)
+		return errors.Wrapf(err, "mounting %v share %v on %v timed out after %v", fstype, source, target, timeout)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to mount %v share %v on %v with timeout %v", fstype, source, target, timeout)
 	}
-	return err
+	return nil
 }
 
 // CleanUpMountPoints tries to clean up all existing mount points for existing backup stores
@@ -389,7 +469,7 @@ func CleanUpMountPoints(mounter mount.Interface, log logrus.FieldLogger) error {
 			return nil
 		}
 
-		if err := cleanupMount(path, mounter, log); err != nil {
+		if err := cleanupMount(path, mounter, log, forceCleanupMountTimeout); err != nil {
 			errs = multierr.Append(errs, errors.Wrapf(err, "failed to clean up mount point %v", path))
 		}
 
@@ -418,3 +498,23 @@ func SplitMountOptions(options []string) []string {
 	// Options in the form "nfsOptions=soft,timeo=450,retrans=3" are more likely, but we must split them.
 	return strings.Split(options[0], ",")
 }
+
+// SetThreadNiceLevel sets the nice level of the calling thread. The caller should lock the goroutine
+// to the thread with runtime.LockOSThread, otherwise the other goroutines run at the nice level too.
+func SetThreadNiceLevel(niceLevel int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, syscall.Gettid(), niceLevel)
+}
+
+// SetThreadCPUAffinity pins the calling thread to the CPUs. The caller should lock the goroutine to the thread
+// with runtime.LockOSThread, otherwise the other goroutines are pinned too.
+func SetThreadCPUAffinity(cpus []int) error {
+	if len(cpus) == 0 {
+		return fmt.Errorf("missing CPUs for thread affinity")
+	}
+	var set unix.CPUSet
+	set.Zero()
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return unix.SchedSetaffinity(0, &set)
+}
@@ -1,6 +1,9 @@
 package util
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"math/rand"
 	"net/url"
@@ -8,8 +11,13 @@ import (
 	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
+	"unsafe"
 
 	. "gopkg.in/check.v1"
+	mount "k8s.io/mount-utils"
+
+	"github.com/longhorn/backupstore/types"
 )
 
 func Test(t *testing.T) { TestingT(t) }
@@ -75,6 +83,143 @@ func (s *TestSuite) TestCompress(c *C) {
 		c.Assert(err, IsNil)
 
 		c.Assert(result, DeepEquals, data)
+
+		compressed.Seek(0, io.SeekStart)
+		header := make([]byte, COMPRESSION_HEADER_SIZE)
+		_, err = io.ReadFull(compressed, header)
+		c.Assert(err, IsNil)
+		c.Assert(CheckCompressionHeader(compressionMethod, header), IsNil)
+		if compressionMethod != "none" {
+			c.Assert(CheckCompressionHeader(compressionMethod, []byte("data")), NotNil)
+		}
+
+		compressor, err := GetCompressor(compressionMethod)
+		c.Assert(err, IsNil)
+
+		// the pooled coders should be reusable
+		for i := 0; i < 2; i++ {
+			var buf bytes.Buffer
+			err = compressor.Compress(&buf, bytes.NewReader(data))
+			c.Assert(err, IsNil)
+
+			var decompressedBuf bytes.Buffer
+			err = DecompressAndVerifyInto(compressionMethod, &decompressedBuf, &buf, checksum)
+			c.Assert(err, IsNil)
+			c.Assert(decompressedBuf.Bytes(), DeepEquals, data)
+		}
+	}
+
+	_, err := GetCompressor("unknown")
+	c.Assert(err, NotNil)
+
+	c.Assert(GetCompressionMethods(), DeepEquals, []string{"gzip", "lz4", "none"})
+}
+
+func (s *TestSuite) TestRegisterCompressor(c *C) {
+	created := 0
+	factory := func() (Compressor, error) {
+		created++
+		return noneCompressor{}, nil
+	}
+	err := RegisterCompressor("test-codec", factory, []byte("TC01"))
+	c.Assert(err, IsNil)
+	defer UnregisterCompressor("test-codec")
+
+	// the compressor is created once on the first use
+	c.Assert(created, Equals, 0)
+	for i := 0; i < 2; i++ {
+		_, err = GetCompressor("test-codec")
+		c.Assert(err, IsNil)
+	}
+	c.Assert(created, Equals, 1)
+	c.Assert(GetCompressionMethods(), DeepEquals, []string{"gzip", "lz4", "none", "test-codec"})
+
+	c.Assert(DetectCompressionMethod([]byte("TC01data")), Equals, "test-codec")
+	c.Assert(DetectCompressionMethod([]byte{0x1f, 0x8b, 0x08}), Equals, "gzip")
+	c.Assert(DetectCompressionMethod([]byte("data")), Equals, "")
+	c.Assert(CheckCompressionHeader("test-codec", []byte("TC01data")), IsNil)
+	c.Assert(CheckCompressionHeader("test-codec", []byte("data")), NotNil)
+	magic, err := GetCompressionMagic("test-codec")
+	c.Assert(err, IsNil)
+	c.Assert(magic, DeepEquals, []byte("TC01"))
+
+	// the duplicated names, the ambiguous magic numbers and the invalid registrations are refused
+	c.Assert(RegisterCompressor("test-codec", factory, nil), NotNil)
+	c.Assert(RegisterCompressor("test-other", factory, []byte("TC")), NotNil)
+	c.Assert(RegisterCompressor("test-other", factory, []byte("TC01X")), NotNil)
+	c.Assert(RegisterCompressor("test-other", nil, nil), NotNil)
+	c.Assert(RegisterCompressor("-", factory, nil), NotNil)
+	c.Assert(RegisterCompressor("test-other", factory, bytes.Repeat([]byte("x"), COMPRESSION_HEADER_SIZE+1)), NotNil)
+
+	// the failure of the factory is returned on the use
+	err = RegisterCompressor("test-failing", func() (Compressor, error) {
+		return nil, fmt.Errorf("no accelerator")
+	}, nil)
+	c.Assert(err, IsNil)
+	defer UnregisterCompressor("test-failing")
+	_, err = GetCompressor("test-failing")
+	c.Assert(err, ErrorMatches, ".*no accelerator")
+}
+
+func (s *TestSuite) TestBufferPool(c *C) {
+	pool := NewBufferPool(1024)
+
+	buf := pool.Get()
+	c.Assert(buf.Cap() >= 1024, Equals, true)
+	buf.WriteString("data")
+	pool.Put(buf)
+
+	stats := pool.Stats()
+	c.Assert(stats.Gets, Equals, int64(1))
+	c.Assert(stats.InUseBytes, Equals, int64(0))
+	c.Assert(stats.PeakInUseBytes, Equals, int64(1024))
+
+	buf = pool.Get()
+	c.Assert(buf.Len(), Equals, 0)
+	pool.Put(buf)
+	c.Assert(pool.Stats().Gets, Equals, int64(2))
+}
+
+func (s *TestSuite) TestMemoryBudget(c *C) {
+	budget := NewMemoryBudget(100)
+	c.Assert(budget.Reserve(context.Background(), 60), IsNil)
+	c.Assert(budget.Reserve(context.Background(), 101), ErrorMatches, "cannot reserve 101 bytes.*")
+
+	// the reservation waits until the bytes are released
+	reserved := make(chan error)
+	go func() {
+		reserved <- budget.Reserve(context.Background(), 60)
+	}()
+	select {
+	case <-reserved:
+		c.Fatal("reserved bytes over the budget")
+	case <-time.After(100 * time.Millisecond):
+	}
+	budget.Release(60)
+	c.Assert(<-reserved, IsNil)
+	c.Assert(budget.PeakBytes(), Equals, int64(60))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(budget.Reserve(ctx, 60), Equals, context.Canceled)
+
+	// the unlimited and the nil budgets only record the high-water mark
+	budget = NewMemoryBudget(0)
+	c.Assert(budget.Reserve(context.Background(), 1000), IsNil)
+	c.Assert(budget.PeakBytes(), Equals, int64(1000))
+	var nilBudget *MemoryBudget
+	c.Assert(nilBudget.Reserve(context.Background(), 1000), IsNil)
+	nilBudget.Release(1000)
+	c.Assert(nilBudget.PeakBytes(), Equals, int64(0))
+}
+
+func (s *TestSuite) TestAlignedBufferPool(c *C) {
+	pool := NewAlignedBufferPool(8192, 4096)
+	for i := 0; i < 3; i++ {
+		buf := pool.Get()
+		c.Assert(len(buf), Equals, 8192)
+		c.Assert(uintptr(unsafe.Pointer(&buf[0]))%4096, Equals, uintptr(0))
+		pool.Put(buf)
 	}
 }
 
@@ -137,6 +282,35 @@ func (s *TestSuite) TestValidateName(c *C) {
 	c.Assert(ValidateName("ubuntu14.04_v1 "), Equals, false)
 }
 
+func (s *TestSuite) TestJoinPathWithin(c *C) {
+	testCases := []struct {
+		prefix    string
+		path      string
+		expected  string
+		expectErr bool
+	}{
+		{"prefix/tenantA/", "backupstore/volumes", "prefix/tenantA/backupstore/volumes", false},
+		{"prefix/tenantA/", "backupstore/volumes/", "prefix/tenantA/backupstore/volumes/", false},
+		{"prefix/tenantA", "", "prefix/tenantA/", false},
+		{"prefix/tenantA/", "backupstore/../", "prefix/tenantA/", false},
+		{"prefix/tenantA/", "../tenantB/backupstore", "", true},
+		{"prefix/tenantA/", "../tenantAB", "", true},
+		{"prefix/tenantA/", "../../../etc", "", true},
+		{"", "backupstore/volumes", "backupstore/volumes", false},
+		{"", "../backupstore", "backupstore", false},
+		{"", "", "", false},
+	}
+	for _, tc := range testCases {
+		joined, err := JoinPathWithin(tc.prefix, tc.path)
+		if tc.expectErr {
+			c.Assert(err, NotNil, Commentf("prefix %v path %v", tc.prefix, tc.path))
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(joined, Equals, tc.expected, Commentf("prefix %v path %v", tc.prefix, tc.path))
+	}
+}
+
 func (s *TestSuite) TestSplitMountOptions(c *C) {
 	testCases := []struct {
 		destURL          string
@@ -199,3 +373,122 @@ func (s *TestSuite) TestSplitMountOptions(c *C) {
 		}
 	}
 }
+
+func (s *TestSuite) TestAIMDLimiter(c *C) {
+	l := NewAIMDLimiter(2, 1, 4)
+	c.Assert(l.Limit(), Equals, 2)
+
+	// the limit grows by about one after a window of successful transfers
+	for i := 0; i < 3; i++ {
+		l.Acquire()
+		l.Release(time.Millisecond, nil)
+	}
+	c.Assert(l.Limit(), Equals, 3)
+	for i := 0; i < 20; i++ {
+		l.Acquire()
+		l.Release(time.Millisecond, nil)
+	}
+	c.Assert(l.Limit(), Equals, 4)
+
+	// the concurrent failures only halve the limit once
+	for i := 0; i < 4; i++ {
+		l.Acquire()
+	}
+	for i := 0; i < 4; i++ {
+		l.Release(time.Millisecond, fmt.Errorf("throttled"))
+	}
+	c.Assert(l.Limit(), Equals, 2)
+
+	// the rising latency halves the limit
+	for i := 0; i < 20; i++ {
+		l.Acquire()
+		l.Release(100*time.Millisecond, nil)
+	}
+	c.Assert(l.Limit(), Equals, 1)
+}
+
+func (s *TestSuite) TestTypedCredential(c *C) {
+	credential, err := CredentialFromMap("s3", map[string]string{
+		types.AWSAccessKey:       "access",
+		types.AWSSecretKey:       "secret",
+		types.AWSEndPoint:        "https://minio:9000",
+		types.VirtualHostedStyle: "false",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(credential.(*S3Credential).SecretKey, Equals, "secret")
+	c.Assert(credential.String(), Equals,
+		"s3{AWS_ACCESS_KEY_ID=access, AWS_ENDPOINTS=https://minio:9000, AWS_SECRET_ACCESS_KEY=<redacted>, VIRTUAL_HOSTED_STYLE=false}")
+
+	// the map form round trips
+	roundTrip, err := CredentialFromMap("s3", credential.ToMap())
+	c.Assert(err, IsNil)
+	c.Assert(roundTrip, DeepEquals, credential)
+
+	_, err = CredentialFromMap("s3", map[string]string{types.AWSSecretKey: "secret"})
+	c.Assert(err, NotNil)
+	c.Assert((&AzureCredential{AccountName: "account", SASToken: "token"}).Validate(), IsNil)
+	c.Assert((&AzureCredential{AccountName: "account"}).Validate(), NotNil)
+	c.Assert((&NFSCredential{Security: "sys"}).Validate(), NotNil)
+
+	credential, err = CredentialFromMap("vfs", map[string]string{})
+	c.Assert(err, IsNil)
+	c.Assert(credential, IsNil)
+}
+
+// slowMounter blocks the mounts until the delay elapses, and reports the unmounted targets to unmounted
+type slowMounter struct {
+	*mount.FakeMounter
+	delay     time.Duration
+	unmounted chan string
+}
+
+func (m *slowMounter) Unmount(target string) error {
+	err := m.FakeMounter.Unmount(target)
+	if m.unmounted != nil {
+		m.unmounted <- target
+	}
+	return err
+}
+
+func (m *slowMounter) MountSensitiveWithoutSystemd(source, target, fstype string, options, sensitiveOptions []string) error {
+	time.Sleep(m.delay)
+	return m.FakeMounter.MountSensitiveWithoutSystemd(source, target, fstype, options, sensitiveOptions)
+}
+
+func (s *TestSuite) TestMountTimeouts(c *C) {
+	u, err := url.Parse("nfs://server:/path?mountTimeout=30s")
+	c.Assert(err, IsNil)
+	timeouts, err := ParseMountTimeouts(u, MountTimeouts{Mount: time.Minute})
+	c.Assert(err, IsNil)
+	c.Assert(timeouts, Equals, MountTimeouts{Mount: 30 * time.Second, Cleanup: forceCleanupMountTimeout})
+
+	u, err = url.Parse("nfs://server:/path?mountCleanupTimeout=2m")
+	c.Assert(err, IsNil)
+	timeouts, err = ParseMountTimeouts(u, MountTimeouts{Mount: time.Minute})
+	c.Assert(err, IsNil)
+	c.Assert(timeouts, Equals, MountTimeouts{Mount: time.Minute, Cleanup: 2 * time.Minute})
+
+	for _, invalid := range []string{"mountTimeout=0s", "mountTimeout=abc", "mountCleanupTimeout=-1s"} {
+		u, err = url.Parse("nfs://server:/path?" + invalid)
+		c.Assert(err, IsNil)
+		_, err = ParseMountTimeouts(u, MountTimeouts{Mount: time.Minute})
+		c.Assert(err, NotNil, Commentf(invalid))
+	}
+
+	// the effective timeout is reported once the mount times out, and the share mounted afterwards is unmounted
+	mounter := &slowMounter{FakeMounter: mount.NewFakeMounter(nil), delay: 200 * time.Millisecond,
+		unmounted: make(chan string, 1)}
+	err = MountWithTimeout(mounter, "server:/path", "/mnt", "nfs4", nil, nil, 10*time.Millisecond, 50*time.Millisecond)
+	c.Assert(err, ErrorMatches, ".*timed out after 50ms.*")
+	c.Assert(<-mounter.unmounted, Equals, "/mnt")
+	mountPoints, err := mounter.List()
+	c.Assert(err, IsNil)
+	c.Assert(mountPoints, HasLen, 0)
+
+	mounter = &slowMounter{FakeMounter: mount.NewFakeMounter(nil)}
+	err = MountWithTimeout(mounter, "server:/path", "/mnt", "nfs4", nil, nil, 10*time.Millisecond, time.Second)
+	c.Assert(err, IsNil)
+	mountPoints, err = mounter.List()
+	c.Assert(err, IsNil)
+	c.Assert(mountPoints, HasLen, 1)
+}
@@ -0,0 +1,56 @@
+package backupstore
+
+import (
+	"sync"
+)
+
+// VersioningStatus is the object versioning status of the bucket or the container of the backup target
+type VersioningStatus string
+
+const (
+	// VersioningStatusUnsupported is reported for the drivers without object versioning, e.g. nfs
+	VersioningStatusUnsupported = VersioningStatus("Unsupported")
+	VersioningStatusDisabled    = VersioningStatus("Disabled")
+	VersioningStatusEnabled     = VersioningStatus("Enabled")
+	// VersioningStatusSuspended keeps the noncurrent versions created while the versioning was enabled
+	VersioningStatusSuspended = VersioningStatus("Suspended")
+)
+
+// BackupStoreVersioningAware can be optionally implemented by the drivers of the object stores supporting the
+// object versioning. With the versioning enabled the removed objects leave the delete markers and the noncurrent
+// versions behind, so the storage keeps growing unless they are purged as well.
+type BackupStoreVersioningAware interface {
+	// VersioningStatus returns the versioning status of the bucket or the container
+	VersioningStatus() (VersioningStatus, error)
+}
+
+var (
+	purgeNoncurrentVersionsLock sync.RWMutex
+	purgeNoncurrentVersions     bool
+)
+
+// SetPurgeNoncurrentVersionsEnabled makes the versioning aware drivers remove all the versions and the delete
+// markers of the removed objects, instead of only the current versions. Only the objects under the backupstore
+// path of the backup target are purged.
+func SetPurgeNoncurrentVersionsEnabled(enabled bool) {
+	purgeNoncurrentVersionsLock.Lock()
+	defer purgeNoncurrentVersionsLock.Unlock()
+	purgeNoncurrentVersions = enabled
+}
+
+// IsPurgeNoncurrentVersionsEnabled checks if the removed objects are purged with all their versions
+func IsPurgeNoncurrentVersionsEnabled() bool {
+	purgeNoncurrentVersionsLock.RLock()
+	defer purgeNoncurrentVersionsLock.RUnlock()
+	return purgeNoncurrentVersions
+}
+
+// getVersioningStatus returns the versioning status of the backup target, VersioningStatusUnsupported is
+// returned if the driver isn't versioning aware
+func getVersioningStatus(driver BackupStoreDriver) (VersioningStatus, error) {
+	versioningAware, ok := driver.(BackupStoreVersioningAware)
+	if !ok {
+		return VersioningStatusUnsupported, nil
+	}
+	return versioningAware.VersioningStatus()
+}
@@ -0,0 +1,47 @@
+package backupstore
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type versionedMockStoreDriver struct {
+	*mockStoreDriver
+	status VersioningStatus
+}
+
+func (m *versionedMockStoreDriver) VersioningStatus() (VersioningStatus, error) {
+	return m.status, nil
+}
+
+func TestVersioningStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	mock := &mockStoreDriver{}
+	mock.Init()
+	defer mock.uninstall()
+
+	status, err := getVersioningStatus(mock)
+	assert.NoError(err)
+	assert.Equal(VersioningStatusUnsupported, status)
+
+	m := &versionedMockStoreDriver{mockStoreDriver: mock, status: VersioningStatusEnabled}
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		mock.fs.MkdirAll(filepath.Join(backupstoreBase, VOLUME_DIRECTORY), 0755)
+		return m, nil
+	})
+
+	// the versioning status is surfaced by the audit of the backup target
+	report, err := AuditBackupTarget(mockDriverURL, nil)
+	assert.NoError(err)
+	assert.Equal(VersioningStatusEnabled, report.VersioningStatus)
+	assert.True(report.IsHealthy())
+
+	assert.False(IsPurgeNoncurrentVersionsEnabled())
+	SetPurgeNoncurrentVersionsEnabled(true)
+	defer SetPurgeNoncurrentVersionsEnabled(false)
+	assert.True(IsPurgeNoncurrentVersionsEnabled())
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/url"
 	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/longhorn/backupstore"
 	"github.com/longhorn/backupstore/fsops"
@@ -25,6 +27,14 @@ const (
 	KIND = "vfs"
 
 	VfsPath = "vfs.path"
+
+	// FsyncParam fsyncs the written files and their parent directories, e.g. vfs:///path?fsync=true
+	FsyncParam = "fsync"
+	// WriteRetriesParam is the number of times a write failed by a transient error is retried
+	WriteRetriesParam = "writeRetries"
+	// WriteRetryIntervalParam is the interval before the first retry of a write, e.g. 500ms, doubled after
+	// each retry
+	WriteRetryIntervalParam = "writeRetryInterval"
 )
 
 func init() {
@@ -51,6 +61,11 @@ func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
 	}
 
 	b.path = u.Path
+	opts, err := parseWriteOptions(u)
+	if err != nil {
+		return nil, err
+	}
+	b.SetWriteOptions(opts)
 
 	if b.path == "" {
 		return nil, fmt.Errorf("cannot find vfs path")
@@ -64,6 +79,34 @@ func initFunc(destURL string) (backupstore.BackupStoreDriver, error) {
 	return b, nil
 }
 
+// parseWriteOptions returns the write options set by the URL params of the backup target
+func parseWriteOptions(u *url.URL) (fsops.WriteOptions, error) {
+	opts := fsops.WriteOptions{}
+	query := u.Query()
+	if value := query.Get(FsyncParam); value != "" {
+		fsync, err := strconv.ParseBool(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %v %v, must be a boolean", FsyncParam, value)
+		}
+		opts.Fsync = fsync
+	}
+	if value := query.Get(WriteRetriesParam); value != "" {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return opts, fmt.Errorf("invalid %v %v, must be a non-negative integer", WriteRetriesParam, value)
+		}
+		opts.Retries = retries
+	}
+	if value := query.Get(WriteRetryIntervalParam); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return opts, fmt.Errorf("invalid %v %v, must be a positive duration", WriteRetryIntervalParam, value)
+		}
+		opts.RetryInterval = interval
+	}
+	return opts, nil
+}
+
 func (v *BackupStoreDriver) LocalPath(path string) string {
 	return filepath.Join(v.path, path)
 }
@@ -0,0 +1,174 @@
+package backupstore
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	// VOLUME_HISTORY_DIRECTORY keeps the revisions of the volume config
+	VOLUME_HISTORY_DIRECTORY = ".history"
+
+	volumeRevisionPrefix = "volume_"
+)
+
+var (
+	volumeConfigHistoryLimitLock sync.RWMutex
+	volumeConfigHistoryLimit     int
+)
+
+// SetVolumeConfigHistoryLimit sets the number of the revisions of the volume config kept in the history of the
+// volume. Each save of the volume config is recorded in the history, and the oldest revisions beyond the limit
+// are removed. The history is disabled if the limit is 0, which is the default.
+func SetVolumeConfigHistoryLimit(limit int) {
+	volumeConfigHistoryLimitLock.Lock()
+	defer volumeConfigHistoryLimitLock.Unlock()
+	volumeConfigHistoryLimit = limit
+}
+
+// GetVolumeConfigHistoryLimit returns the number of the revisions of the volume config kept in the history
+func GetVolumeConfigHistoryLimit() int {
+	volumeConfigHistoryLimitLock.RLock()
+	defer volumeConfigHistoryLimitLock.RUnlock()
+	return volumeConfigHistoryLimit
+}
+
+// VolumeConfigRevision is a revision of the volume config in the history
+type VolumeConfigRevision struct {
+	// Revision identifies the revision, the later revisions sort after the earlier ones
+	Revision string
+	SavedAt  string
+	// Writer is the identity set by SetClusterIdentity which saved the revision
+	Writer string
+	Volume *Volume
+}
+
+func getVolumeHistoryPath(driver BackupStoreDriver, volumeName string) string {
+	return filepath.Join(getVolumePath(driver, volumeName), VOLUME_HISTORY_DIRECTORY) + "/"
+}
+
+func getVolumeRevisionPath(driver BackupStoreDriver, volumeName, revision string) string {
+	return filepath.Join(getVolumeHistoryPath(driver, volumeName), volumeRevisionPrefix+revision+CFG_SUFFIX)
+}
+
+func getVolumeRevisions(driver BackupStoreDriver, volumeName string) []string {
+	fileList, err := driver.List(getVolumeHistoryPath(driver, volumeName))
+	if err != nil {
+		// path doesn't exist
+		return []string{}
+	}
+	revisions := util.ExtractNames(fileList, volumeRevisionPrefix, CFG_SUFFIX)
+	sort.Strings(revisions)
+	return revisions
+}
+
+// recordVolumeConfigRevision saves the volume config just saved in the history and removes the oldest revisions
+// beyond the limit. The history is best effort, so the failures don't fail saving the volume config.
+func recordVolumeConfigRevision(driver BackupStoreDriver, v *Volume) {
+	limit := GetVolumeConfigHistoryLimit()
+	if limit <= 0 {
+		return
+	}
+
+	now := time.Now().UTC()
+	revision := &VolumeConfigRevision{
+		// the fixed width keeps the revisions sorted by time
+		Revision: fmt.Sprintf("%020d", now.UnixNano()),
+		SavedAt:  now.Format(time.RFC3339),
+		Writer:   v.LastWriter,
+		Volume:   v,
+	}
+	filePath := getVolumeRevisionPath(driver, v.Name, revision.Revision)
+	if err := saveConfigInBackupStore(driver, filePath, revision, GetMetadataCompressionMethod()); err != nil {
+		log.WithError(err).Warnf("Failed to record revision %v of volume %v config", revision.Revision, v.Name)
+		return
+	}
+
+	revisions := getVolumeRevisions(driver, v.Name)
+	for len(revisions) > limit {
+		if err := driver.Remove(getVolumeRevisionPath(driver, v.Name, revisions[0])); err != nil {
+			log.WithError(err).Warnf("Failed to remove revision %v of volume %v config", revisions[0], v.Name)
+			return
+		}
+		revisions = revisions[1:]
+	}
+}
+
+func loadVolumeConfigRevision(driver BackupStoreDriver, volumeName, revision string) (*VolumeConfigRevision, error) {
+	r := &VolumeConfigRevision{}
+	if err := LoadConfigInBackupStore(driver, getVolumeRevisionPath(driver, volumeName, revision), r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetVolumeConfigHistory returns the revisions of the volume config in the history from the latest to the earliest
+func GetVolumeConfigHistory(volumeURL string) ([]*VolumeConfigRevision, error) {
+	driver, err := GetBackupStoreDriver(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	_, volumeName, _, err := DecodeBackupURL(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := getVolumeRevisions(driver, volumeName)
+	history := make([]*VolumeConfigRevision, 0, len(revisions))
+	for i := len(revisions) - 1; i >= 0; i-- {
+		revision, err := loadVolumeConfigRevision(driver, volumeName, revisions[i])
+		if err != nil {
+			log.WithError(err).Warnf("Failed to load revision %v of volume %v config", revisions[i], volumeName)
+			continue
+		}
+		history = append(history, revision)
+	}
+	return history, nil
+}
+
+// RevertVolumeConfig saves the revision of the volume config in the history as the volume config, e.g. to
+// recover from a bad write of the volume config. The revert is recorded in the history as a new revision.
+func RevertVolumeConfig(volumeURL, revision string) error {
+	driver, err := GetBackupStoreDriver(volumeURL)
+	if err != nil {
+		return err
+	}
+	_, volumeName, _, err := DecodeBackupURL(volumeURL)
+	if err != nil {
+		return err
+	}
+
+	if revision == "" || strings.Trim(revision, "0123456789") != "" {
+		return fmt.Errorf("invalid revision %v", revision)
+	}
+
+	// prevent racing with the backups and the deletions updating the volume config
+	lock, err := New(driver, volumeName, DELETION_LOCK)
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	r, err := loadVolumeConfigRevision(driver, volumeName, revision)
+	if err != nil {
+		return err
+	}
+	if r.Volume == nil || r.Volume.Name != volumeName {
+		return fmt.Errorf("invalid revision %v of volume %v config", revision, volumeName)
+	}
+	// the volume config is overwritten as a whole since it may be unreadable after the bad write
+	if err := saveVolume(driver, r.Volume); err != nil {
+		return err
+	}
+	log.Infof("Reverted volume %v config to revision %v", volumeName, revision)
+	return nil
+}
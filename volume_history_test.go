@@ -0,0 +1,69 @@
+package backupstore
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeConfigHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		m.fs.MkdirAll(filepath.Join(backupstoreBase, VOLUME_DIRECTORY), 0755)
+		return m, nil
+	})
+	volumeURL := EncodeBackupURL("", "pvc-1", mockDriverURL)
+
+	// no history is kept by default
+	assert.NoError(saveVolume(m, &Volume{Name: "pvc-1", LastBackupName: "backup-0"}))
+	history, err := GetVolumeConfigHistory(volumeURL)
+	assert.NoError(err)
+	assert.Empty(history)
+
+	SetVolumeConfigHistoryLimit(2)
+	defer SetVolumeConfigHistoryLimit(0)
+	SetClusterIdentity("cluster-1", "node-1")
+	defer SetClusterIdentity("", "")
+
+	assert.NoError(saveVolume(m, &Volume{Name: "pvc-1", LastBackupName: "backup-1"}))
+	for _, backupName := range []string{"backup-2", "backup-3"} {
+		_, err := updateVolume(m, "pvc-1", func(v *Volume) error {
+			v.LastBackupName = backupName
+			return nil
+		})
+		assert.NoError(err)
+	}
+
+	// the oldest revisions beyond the limit are removed
+	history, err = GetVolumeConfigHistory(volumeURL)
+	assert.NoError(err)
+	assert.Len(history, 2)
+	assert.Equal("backup-3", history[0].Volume.LastBackupName)
+	assert.Equal("backup-2", history[1].Volume.LastBackupName)
+	assert.Equal("cluster-1/node-1", history[0].Writer)
+	assert.Greater(history[0].Revision, history[1].Revision)
+	assert.NotEmpty(history[0].SavedAt)
+
+	// the bad write is recovered by reverting to the previous revision
+	assert.NoError(m.Write(getVolumeFilePath(m, "pvc-1"), bytes.NewReader([]byte("{corrupted"))))
+	_, err = loadVolume(m, "pvc-1")
+	assert.Error(err)
+	assert.NoError(RevertVolumeConfig(volumeURL, history[1].Revision))
+	volume, err := loadVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal("backup-2", volume.LastBackupName)
+	assert.Error(RevertVolumeConfig(volumeURL, "../volume"))
+	assert.Error(RevertVolumeConfig(volumeURL, "1"))
+
+	history, err = GetVolumeConfigHistory(volumeURL)
+	assert.NoError(err)
+	assert.Len(history, 2)
+	assert.Equal("backup-2", history[0].Volume.LastBackupName)
+}
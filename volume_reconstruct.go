@@ -0,0 +1,310 @@
+package backupstore
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	. "github.com/longhorn/backupstore/logging"
+	"github.com/longhorn/backupstore/util"
+)
+
+const (
+	// VOLUME_CONFIG_CORRUPTED_SUFFIX is appended to the path of the corrupted volume config kept by
+	// ReconstructVolumeConfig
+	VOLUME_CONFIG_CORRUPTED_SUFFIX = ".corrupted"
+
+	VolumeReconstructionSourceHistory = "history"
+	VolumeReconstructionSourceRecords = "records"
+	VolumeReconstructionSourceBackups = "backups"
+)
+
+// VolumeReconstructionReport describes the volume config rebuilt by ReconstructVolumeConfig
+type VolumeReconstructionReport struct {
+	VolumeName string
+	// Source is where the volume metadata not derived from the backups was taken from, either the history of
+	// the volume config, the volume records or the backups only
+	Source string
+	// Volume is the reconstructed volume config
+	Volume *Volume
+	// BackupCount is the number of the completed backups found
+	BackupCount int
+	// UnreadableBackups are the errors of the backup configs which cannot be loaded keyed by the backup names
+	UnreadableBackups map[string]string
+	// MissingBlocks are the blocks referenced by the completed backups but not found, keyed by the checksums
+	// with the names of the backups referencing them
+	MissingBlocks map[string][]string
+	// OrphanBlockCount is the number of the blocks not referenced by any completed backup, they are garbage
+	// collected by the next backup deletion
+	OrphanBlockCount int
+	// Gaps are the fields of the volume config which cannot be recovered and are left empty or estimated
+	Gaps []string
+}
+
+// ReconstructVolumeConfig rebuilds the lost or corrupted volume config from the backup configs and the blocks of
+// the volume, as the last resort after the volume config is removed or damaged, e.g. by the manual edits of the
+// bucket. The metadata of the volume is taken from the latest revision in the history of the volume config or the
+// latest volume record if any, the last backup and the block count are derived from the backups and the blocks.
+// The fields which cannot be recovered are reported as gaps. The corrupted volume config is kept with the suffix
+// VOLUME_CONFIG_CORRUPTED_SUFFIX. It fails if the volume config can be loaded.
+func ReconstructVolumeConfig(volumeURL string) (*VolumeReconstructionReport, error) {
+	bsDriver, volumeName, err := getVolumeDriver(volumeURL)
+	if err != nil {
+		return nil, err
+	}
+	if !util.ValidateName(volumeName) {
+		return nil, fmt.Errorf("invalid volume name %v", volumeName)
+	}
+	if _, err := loadVolume(bsDriver, volumeName); err == nil {
+		return nil, fmt.Errorf("volume config of %v is intact, nothing to reconstruct", volumeName)
+	}
+
+	lock, err := New(bsDriver, volumeName, DELETION_LOCK)
+	if err != nil {
+		return nil, err
+	}
+	if err := lock.Lock(); err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	report := &VolumeReconstructionReport{
+		VolumeName:        volumeName,
+		UnreadableBackups: map[string]string{},
+		MissingBlocks:     map[string][]string{},
+	}
+	volume := loadVolumeReconstructionBase(bsDriver, volumeName, report)
+	volume.Name = volumeName
+
+	// the block layout is needed to find the blocks
+	if report.Source != VolumeReconstructionSourceHistory {
+		if volume.BlockLayout, err = detectVolumeBlockLayout(bsDriver, volumeName); err != nil {
+			return nil, err
+		}
+	}
+	setVolumeBlockLayout(bsDriver, volume)
+	defer unsetVolumeBlockLayout(bsDriver, volumeName)
+
+	backups, err := loadVolumeReconstructionBackups(bsDriver, volumeName, report)
+	if err != nil {
+		return nil, err
+	}
+	blockNames, err := getBlockNamesForVolume(bsDriver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	blockInfos := make(map[string]*BlockInfo, len(blockNames))
+	for _, name := range blockNames {
+		blockInfos[name] = &BlockInfo{checksum: name, path: getBlockFilePath(bsDriver, volumeName, name)}
+	}
+
+	var size int64
+	volume.BlockCount = 0
+	for _, backup := range backups {
+		for _, block := range backup.Blocks {
+			info, known := blockInfos[block.BlockChecksum]
+			if !known {
+				report.MissingBlocks[block.BlockChecksum] = append(report.MissingBlocks[block.BlockChecksum], backup.Name)
+				continue
+			}
+			if info.refcount == 0 {
+				volume.BlockCount++
+			}
+			info.refcount++
+			if block.Offset+DEFAULT_BLOCK_SIZE > size {
+				size = block.Offset + DEFAULT_BLOCK_SIZE
+			}
+		}
+	}
+	report.OrphanBlockCount = len(blockInfos) - int(volume.BlockCount)
+
+	// the blocks never reach beyond the volume, so the size is at least the end of the last block
+	if volume.Size < size {
+		if report.Source == VolumeReconstructionSourceBackups {
+			report.Gaps = append(report.Gaps, "Size")
+		}
+		volume.Size = size
+	}
+
+	volume.LastBackupName, volume.LastBackupAt = "", ""
+	if len(backups) > 0 {
+		// the backups are sorted by the point in time
+		first, last := backups[0], backups[len(backups)-1]
+		volume.LastBackupName = last.Name
+		volume.LastBackupAt = last.SnapshotCreatedAt
+		if volume.CreatedTime == "" || first.CreatedTime < volume.CreatedTime {
+			volume.CreatedTime = first.CreatedTime
+		}
+		if report.Source == VolumeReconstructionSourceBackups {
+			volume.Labels = last.Labels
+			volume.CompressionMethod = last.CompressionMethod
+		}
+	}
+	if volume.CompressionMethod == "" {
+		report.Gaps = append(report.Gaps, "CompressionMethod")
+		volume.CompressionMethod = LEGACY_COMPRESSION_METHOD
+	}
+	if volume.CreatedTime == "" {
+		report.Gaps = append(report.Gaps, "CreatedTime")
+		volume.CreatedTime = util.Now()
+	}
+
+	if err := keepCorruptedVolumeConfig(bsDriver, volumeName); err != nil {
+		return nil, err
+	}
+	if err := saveVolume(bsDriver, volume); err != nil {
+		return nil, err
+	}
+	report.Volume = volume
+	sort.Strings(report.Gaps)
+
+	log.WithFields(logrus.Fields{
+		LogFieldVolume:   volumeName,
+		"source":         report.Source,
+		"backups":        report.BackupCount,
+		"missing_blocks": len(report.MissingBlocks),
+		"orphan_blocks":  report.OrphanBlockCount,
+		"gaps":           strings.Join(report.Gaps, ","),
+	}).Warn("Reconstructed volume config")
+	return report, nil
+}
+
+// loadVolumeReconstructionBase returns the volume metadata from the latest readable revision of the volume config
+// history, or from the latest readable volume record, or an empty volume with the gaps reported
+func loadVolumeReconstructionBase(bsDriver BackupStoreDriver, volumeName string, report *VolumeReconstructionReport) *Volume {
+	volume := &Volume{}
+	seqs, _ := listVolumeRecords(bsDriver, volumeName)
+	if len(seqs) > 0 {
+		// the leftover records are regarded as folded, the new records are numbered after them
+		defer func() {
+			volume.VolumeRecords = true
+			volume.LastRecordSeq = seqs[len(seqs)-1]
+		}()
+	}
+
+	revisions := getVolumeRevisions(bsDriver, volumeName)
+	for i := len(revisions) - 1; i >= 0; i-- {
+		revision := &VolumeConfigRevision{}
+		if err := LoadConfigInBackupStore(bsDriver, getVolumeRevisionPath(bsDriver, volumeName, revisions[i]), revision); err != nil || revision.Volume == nil {
+			log.WithError(err).Warnf("Skipped unreadable revision %v of volume %v", revisions[i], volumeName)
+			continue
+		}
+		report.Source = VolumeReconstructionSourceHistory
+		*volume = *revision.Volume
+		return volume
+	}
+
+	for i := len(seqs) - 1; i >= 0; i-- {
+		record := &volumeRecord{}
+		if err := LoadConfigInBackupStore(bsDriver, getVolumeRecordFilePath(bsDriver, volumeName, seqs[i]), record); err != nil {
+			log.WithError(err).Warnf("Skipped unreadable record %v of volume %v", seqs[i], volumeName)
+			continue
+		}
+		report.Source = VolumeReconstructionSourceRecords
+		record.apply(volume)
+		report.Gaps = append(report.Gaps, "Quota", "OwnerClusterID", "EncryptionRequired")
+		return volume
+	}
+
+	report.Source = VolumeReconstructionSourceBackups
+	report.Gaps = append(report.Gaps, "BackingImageName", "BackingImageChecksum", "StorageClassName",
+		"BackendStoreDriver", "Quota", "OwnerClusterID", "EncryptionRequired")
+	return volume
+}
+
+// loadVolumeReconstructionBackups loads the completed backups of the volume sorted by the point in time
+func loadVolumeReconstructionBackups(bsDriver BackupStoreDriver, volumeName string, report *VolumeReconstructionReport) ([]*Backup, error) {
+	backupNames, err := getBackupNamesForVolume(bsDriver, volumeName)
+	if err != nil {
+		return nil, err
+	}
+	entries := []*catalogEntry{}
+	for _, backupName := range backupNames {
+		backup, err := loadBackup(bsDriver, backupName, volumeName)
+		if err != nil {
+			report.UnreadableBackups[backupName] = err.Error()
+			continue
+		}
+		// the prepared backups are regarded as in progress, they're resolved by the next backup deletion
+		if isBackupInProgress(backup) || isBackupAborted(backup) {
+			continue
+		}
+		t, err := getBackupPointInTime(backup)
+		if err != nil {
+			report.UnreadableBackups[backupName] = err.Error()
+			continue
+		}
+		entries = append(entries, &catalogEntry{backup: backup, time: t})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].time.Equal(entries[j].time) {
+			return entries[i].backup.Name < entries[j].backup.Name
+		}
+		return entries[i].time.Before(entries[j].time)
+	})
+
+	backups := make([]*Backup, 0, len(entries))
+	for _, entry := range entries {
+		backups = append(backups, entry.backup)
+	}
+	report.BackupCount = len(backups)
+	return backups, nil
+}
+
+// detectVolumeBlockLayout finds the block layout of the volume from the directories of the blocks. It returns nil
+// if the blocks are placed as the layout of the backup target does, or the volume has no blocks.
+func detectVolumeBlockLayout(bsDriver BackupStoreDriver, volumeName string) (*BlockLayout, error) {
+	naming := getKeyNaming(bsDriver)
+	path := getBlockPath(bsDriver, volumeName)
+	layout := &BlockLayout{}
+	for {
+		entries, err := bsDriver.List(path)
+		if err != nil || len(entries) == 0 {
+			return nil, nil
+		}
+		if len(util.ExtractNames(entries, naming.blockPrefix, naming.blockSuffix)) > 0 {
+			break
+		}
+		if layout.Depth == MAX_BLOCK_LAYOUT_DEPTH {
+			return nil, fmt.Errorf("cannot find blocks of volume %v within %v directory levels", volumeName, MAX_BLOCK_LAYOUT_DEPTH)
+		}
+		dir := strings.Trim(entries[0], "/")
+		layout.Depth++
+		layout.Width = len(dir)
+		path = filepath.Join(path, dir)
+	}
+
+	sample := util.GetChecksum([]byte(volumeName))
+	targetLayout := getLayout(bsDriver)
+	if targetLayout.BlockPathDepth() == layout.Depth &&
+		filepath.Dir(targetLayout.BlockPath(sample)) == filepath.Dir(layout.BlockPath(sample)) {
+		return nil, nil
+	}
+	if err := layout.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "cannot detect block layout of volume %v", volumeName)
+	}
+	return layout, nil
+}
+
+// keepCorruptedVolumeConfig copies the corrupted volume config aside before it's overwritten
+func keepCorruptedVolumeConfig(bsDriver BackupStoreDriver, volumeName string) error {
+	filePath := getVolumeFilePath(bsDriver, volumeName)
+	if !bsDriver.FileExists(filePath) {
+		return nil
+	}
+	rc, err := bsDriver.Read(filePath)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	return bsDriver.Write(filePath+VOLUME_CONFIG_CORRUPTED_SUFFIX, strings.NewReader(string(data)))
+}
@@ -0,0 +1,69 @@
+package backupstore
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/longhorn/backupstore/util"
+)
+
+func TestReconstructVolumeConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+	unregisterDriver(mockDriverName)
+	RegisterDriver(mockDriverName, func(destURL string) (BackupStoreDriver, error) {
+		return m, nil
+	})
+
+	checksums := []string{}
+	for _, pattern := range []string{"first", "second", "orphan"} {
+		data := bytes.Repeat([]byte(pattern), 64)
+		checksum := util.GetChecksum(data)
+		checksums = append(checksums, checksum)
+		assert.NoError(m.Write(getBlockFilePath(m, "pvc-1", checksum), bytes.NewReader(data)))
+	}
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-1", VolumeName: "pvc-1", CompressionMethod: "lz4",
+		Labels: map[string]string{"app": "db"}, CreatedTime: "2026-01-01T00:00:00Z",
+		SnapshotCreatedAt: "2026-01-01T00:00:00Z",
+		Blocks:            []BlockMapping{{Offset: 0, BlockChecksum: checksums[0]}}}))
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-2", VolumeName: "pvc-1", CompressionMethod: "lz4",
+		Labels: map[string]string{"app": "db"}, CreatedTime: "2026-01-02T00:00:00Z",
+		SnapshotCreatedAt: "2026-01-02T00:00:00Z",
+		Blocks: []BlockMapping{{Offset: 0, BlockChecksum: checksums[0]},
+			{Offset: 3 * DEFAULT_BLOCK_SIZE, BlockChecksum: checksums[1]},
+			{Offset: 4 * DEFAULT_BLOCK_SIZE, BlockChecksum: "missing"}}}))
+	// the in-progress backup isn't regarded as the last backup
+	assert.NoError(saveBackup(m, &Backup{Name: "backup-3", VolumeName: "pvc-1", CompressionMethod: "lz4",
+		SnapshotCreatedAt: "2026-01-03T00:00:00Z"}))
+	assert.NoError(m.Write(getVolumeFilePath(m, "pvc-1"), bytes.NewReader([]byte("{corrupted"))))
+
+	volumeURL := EncodeBackupURL("", "pvc-1", mockDriverURL)
+	report, err := ReconstructVolumeConfig(volumeURL)
+	assert.NoError(err)
+	assert.Equal(VolumeReconstructionSourceBackups, report.Source)
+	assert.Equal(2, report.BackupCount)
+	assert.Equal([]string{"backup-2"}, report.MissingBlocks["missing"])
+	assert.Equal(1, report.OrphanBlockCount)
+	assert.Contains(report.Gaps, "Size")
+	assert.Contains(report.Gaps, "BackingImageName")
+	assert.True(m.FileExists(getVolumeFilePath(m, "pvc-1") + VOLUME_CONFIG_CORRUPTED_SUFFIX))
+
+	v, err := loadVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal("backup-2", v.LastBackupName)
+	assert.Equal("2026-01-02T00:00:00Z", v.LastBackupAt)
+	assert.Equal("2026-01-01T00:00:00Z", v.CreatedTime)
+	assert.Equal(int64(2), v.BlockCount)
+	assert.Equal(int64(4*DEFAULT_BLOCK_SIZE), v.Size)
+	assert.Equal("lz4", v.CompressionMethod)
+	assert.Equal("db", v.Labels["app"])
+
+	// the intact volume config isn't overwritten
+	_, err = ReconstructVolumeConfig(volumeURL)
+	assert.Error(err)
+}
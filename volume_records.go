@@ -0,0 +1,227 @@
+package backupstore
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The volume records keep the updates of the volume config by the created backups in small objects, so the
+// volume config isn't rewritten by every backup. The records are named by a sequence number allocated by
+// creating the record only if it doesn't exist, and loadVolume folds the records after LastRecordSeq of the
+// volume config into the volume. Once VOLUME_RECORD_COMPACTION_THRESHOLD records are pending, they are
+// compacted into the volume config and removed. The versions before the volume records support read the
+// volume config as of the last compaction.
+const (
+	VOLUME_RECORD_DIRECTORY = "records"
+	VOLUME_RECORD_SUFFIX    = ".rec"
+
+	// VOLUME_RECORD_COMPACTION_THRESHOLD is the number of the records kept before compacting them into the
+	// volume config
+	VOLUME_RECORD_COMPACTION_THRESHOLD = 64
+)
+
+var (
+	volumeRecordsLock    sync.RWMutex
+	volumeRecordsEnabled bool
+)
+
+// SetVolumeRecordsEnabled sets if the backups created afterwards update the volume config by the volume records
+// instead of rewriting it. The volumes with the records are read correctly regardless of the setting.
+func SetVolumeRecordsEnabled(enabled bool) {
+	volumeRecordsLock.Lock()
+	defer volumeRecordsLock.Unlock()
+	volumeRecordsEnabled = enabled
+}
+
+// IsVolumeRecordsEnabled returns if the volume records are used for updating the volume configs
+func IsVolumeRecordsEnabled() bool {
+	volumeRecordsLock.RLock()
+	defer volumeRecordsLock.RUnlock()
+	return volumeRecordsEnabled
+}
+
+// volumeRecord is the update of the volume config by a created backup
+type volumeRecord struct {
+	BackupName           string
+	BackupAt             string
+	NewBlockCount        int64 `json:",string"`
+	Size                 int64 `json:",string"`
+	Labels               map[string]string
+	BackingImageName     string
+	BackingImageChecksum string
+	CompressionMethod    string
+	StorageClassName     string
+	BackendStoreDriver   string
+	LastWriter           string `json:",omitempty"`
+}
+
+func (r *volumeRecord) apply(v *Volume) {
+	v.LastBackupName = r.BackupName
+	v.LastBackupAt = r.BackupAt
+	v.BlockCount = v.BlockCount + r.NewBlockCount
+	// The volume may be expanded
+	v.Size = r.Size
+	v.Labels = r.Labels
+	v.BackingImageName = r.BackingImageName
+	v.BackingImageChecksum = r.BackingImageChecksum
+	v.CompressionMethod = r.CompressionMethod
+	v.StorageClassName = r.StorageClassName
+	v.BackendStoreDriver = r.BackendStoreDriver
+	if r.LastWriter != "" {
+		v.LastWriter = r.LastWriter
+	}
+}
+
+func getVolumeRecordPath(driver BackupStoreDriver, volumeName string) string {
+	return filepath.Join(getVolumePath(driver, volumeName), VOLUME_RECORD_DIRECTORY) + "/"
+}
+
+func getVolumeRecordFilePath(driver BackupStoreDriver, volumeName string, seq int64) string {
+	return filepath.Join(getVolumeRecordPath(driver, volumeName), fmt.Sprintf("%020d%v", seq, VOLUME_RECORD_SUFFIX))
+}
+
+// listVolumeRecords returns the sequence numbers of the records of the volume in order
+func listVolumeRecords(driver BackupStoreDriver, volumeName string) ([]int64, error) {
+	fileList, err := driver.List(getVolumeRecordPath(driver, volumeName))
+	if err != nil {
+		// path doesn't exist
+		return nil, nil
+	}
+
+	seqs := []int64{}
+	for _, name := range fileList {
+		if !strings.HasSuffix(name, VOLUME_RECORD_SUFFIX) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, VOLUME_RECORD_SUFFIX), 10, 64)
+		if err != nil {
+			log.WithError(err).Warnf("Skipping invalid record %v of volume %v", name, volumeName)
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// foldVolumeRecords applies the records after LastRecordSeq to the volume
+func foldVolumeRecords(driver BackupStoreDriver, v *Volume) error {
+	if !v.VolumeRecords {
+		return nil
+	}
+	seqs, err := listVolumeRecords(driver, v.Name)
+	if err != nil {
+		return err
+	}
+	for _, seq := range seqs {
+		if seq <= v.LastRecordSeq {
+			continue
+		}
+		record := &volumeRecord{}
+		if err := LoadConfigInBackupStore(driver, getVolumeRecordFilePath(driver, v.Name, seq), record); err != nil {
+			return errors.Wrapf(err, "failed to load record %v of volume %v", seq, v.Name)
+		}
+		record.apply(v)
+		v.LastRecordSeq = seq
+	}
+	return nil
+}
+
+// addVolumeRecord updates the volume by the record of the created backup. The volume config is updated
+// instead if the volume doesn't use the records yet, and the records are compacted into the volume config
+// once there are VOLUME_RECORD_COMPACTION_THRESHOLD of them.
+func addVolumeRecord(driver BackupStoreDriver, volumeName string, record *volumeRecord) (*Volume, error) {
+	for i := 0; ; i++ {
+		// The records are listed before the volume config, so the sequence number is after the compacted
+		// records even if they are removed in between
+		seqs, err := listVolumeRecords(driver, volumeName)
+		if err != nil {
+			return nil, err
+		}
+		v, err := loadVolume(driver, volumeName)
+		if err != nil {
+			return nil, err
+		}
+		if !v.VolumeRecords {
+			return updateVolume(driver, volumeName, func(v *Volume) error {
+				record.apply(v)
+				v.VolumeRecords = true
+				return nil
+			})
+		}
+
+		seq := v.LastRecordSeq
+		if len(seqs) > 0 && seqs[len(seqs)-1] > seq {
+			seq = seqs[len(seqs)-1]
+		}
+		seq++
+
+		filePath := getVolumeRecordFilePath(driver, volumeName, seq)
+		err = saveConfigInBackupStoreIfMatch(driver, filePath, record, GetMetadataCompressionMethod(), "")
+		if err == nil {
+			record.apply(v)
+			v.LastRecordSeq = seq
+			if len(seqs)+1 >= VOLUME_RECORD_COMPACTION_THRESHOLD {
+				if err := compactVolumeRecords(driver, volumeName); err != nil {
+					log.WithError(err).Warnf("Failed to compact records of volume %v", volumeName)
+				}
+			}
+			return v, nil
+		}
+		if !IsConflictError(err) || i >= configUpdateRetries {
+			return nil, err
+		}
+		log.WithError(err).Warnf("Retrying record of volume %v", volumeName)
+	}
+}
+
+// compactVolumeRecords folds the records into the volume config and removes them. A record is only created
+// after the ones before it, so the records created meanwhile are after LastRecordSeq and kept.
+func compactVolumeRecords(driver BackupStoreDriver, volumeName string) error {
+	v, err := updateVolume(driver, volumeName, func(v *Volume) error {
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return removeCompactedVolumeRecords(driver, v)
+}
+
+// removeCompactedVolumeRecords removes the records already folded into the saved volume config
+func removeCompactedVolumeRecords(driver BackupStoreDriver, v *Volume) error {
+	seqs, err := listVolumeRecords(driver, v.Name)
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, seq := range seqs {
+		if seq > v.LastRecordSeq {
+			break
+		}
+		if err := driver.Remove(getVolumeRecordFilePath(driver, v.Name, seq)); err != nil {
+			return errors.Wrapf(err, "failed to remove record %v of volume %v", seq, v.Name)
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Infof("Compacted %v records of volume %v", removed, v.Name)
+	}
+	return nil
+}
+
+// getVolumeRecordsModificationTime returns the modification time of the last record of the volume, so the
+// volume is known to be changed by the backups updating only the records
+func getVolumeRecordsModificationTime(driver BackupStoreDriver, volumeName string) (t time.Time) {
+	seqs, err := listVolumeRecords(driver, volumeName)
+	if err != nil || len(seqs) == 0 {
+		return t
+	}
+	return driver.FileTime(getVolumeRecordFilePath(driver, volumeName, seqs[len(seqs)-1]))
+}
@@ -0,0 +1,79 @@
+package backupstore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeRecords(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &writableMockStoreDriver{&mockStoreDriver{}}
+	m.Init()
+	defer m.uninstall()
+
+	assert.NoError(saveVolume(m, &Volume{Name: "pvc-1", CompressionMethod: "lz4"}))
+
+	addRecord := func(i int) *Volume {
+		v, err := addVolumeRecord(m, "pvc-1", &volumeRecord{
+			BackupName:        fmt.Sprintf("backup-%v", i),
+			NewBlockCount:     2,
+			Size:              int64(i),
+			CompressionMethod: "lz4",
+		})
+		assert.NoError(err)
+		return v
+	}
+
+	// the first record is saved in the volume config, which enables the records of the volume
+	v := addRecord(1)
+	assert.True(v.VolumeRecords)
+	seqs, err := listVolumeRecords(m, "pvc-1")
+	assert.NoError(err)
+	assert.Empty(seqs)
+
+	addRecord(2)
+	v = addRecord(3)
+	assert.Equal("backup-3", v.LastBackupName)
+	assert.Equal(int64(2), v.LastRecordSeq)
+	seqs, err = listVolumeRecords(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal([]int64{1, 2}, seqs)
+
+	// the volume config isn't rewritten, the records are folded on load
+	config := &Volume{}
+	assert.NoError(LoadConfigInBackupStore(m, getVolumeFilePath(m, "pvc-1"), config))
+	assert.Equal("backup-1", config.LastBackupName)
+	v, err = loadVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal("backup-3", v.LastBackupName)
+	assert.Equal(int64(6), v.BlockCount)
+	assert.Equal(int64(3), v.Size)
+
+	assert.NoError(compactVolumeRecords(m, "pvc-1"))
+	seqs, err = listVolumeRecords(m, "pvc-1")
+	assert.NoError(err)
+	assert.Empty(seqs)
+	compacted, err := loadVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal(v, compacted)
+
+	// the sequence continues after the compacted records
+	v = addRecord(4)
+	assert.Equal(int64(3), v.LastRecordSeq)
+	assert.Equal(int64(8), v.BlockCount)
+	assert.True(m.FileExists(getVolumeRecordFilePath(m, "pvc-1", 3)))
+
+	for i := 5; i < 5+VOLUME_RECORD_COMPACTION_THRESHOLD; i++ {
+		addRecord(i)
+	}
+	seqs, err = listVolumeRecords(m, "pvc-1")
+	assert.NoError(err)
+	assert.Less(len(seqs), VOLUME_RECORD_COMPACTION_THRESHOLD)
+	v, err = loadVolume(m, "pvc-1")
+	assert.NoError(err)
+	assert.Equal(fmt.Sprintf("backup-%v", 4+VOLUME_RECORD_COMPACTION_THRESHOLD), v.LastBackupName)
+	assert.Equal(int64(2*(4+VOLUME_RECORD_COMPACTION_THRESHOLD)), v.BlockCount)
+}